@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWSIoTALPN is the ALPN protocol name that allows AWS IoT Core to accept MQTT connections, authenticated by X.509
+// client certificate, on port 443
+const AWSIoTALPN = "x-amzn-mqtt-ca"
+
+// awsIoTService is the service name used when signing AWS IoT Core websocket URLs
+const awsIoTService = "iotdevicegateway"
+
+// AWSCredentials are the AWS credentials used to sign websocket connections
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // only required for temporary credentials
+}
+
+// AWSCredentialsProvider returns the AWS credentials to use for a connection attempt; it is called before each
+// attempt so temporary credentials can be refreshed (e.g. by wrapping an AWS SDK credentials provider)
+type AWSCredentialsProvider func(ctx context.Context) (AWSCredentials, error)
+
+// StaticAWSCredentials returns an AWSCredentialsProvider that always returns the specified credentials
+func StaticAWSCredentials(accessKeyID, secretAccessKey, sessionToken string) AWSCredentialsProvider {
+	return func(context.Context) (AWSCredentials, error) {
+		return AWSCredentials{AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey, SessionToken: sessionToken}, nil
+	}
+}
+
+// NewAWSIoTOptions returns ClientOptions for connecting to the AWS IoT Core endpoint (e.g.
+// "xxxxxxxx-ats.iot.eu-west-1.amazonaws.com") in region. The client ID must still be set (and must be permitted by
+// the IoT policy).
+//
+// If creds is nil the connection is made to port 443 using TLS with the AWSIoTALPN protocol; the client certificate
+// must be added to TLSConfig (e.g. o.TLSConfig.Certificates = ...) or set with SetTLSCertificateProvider or, where
+// the key is held in hardware, SetTLSClientSigner. Otherwise the connection is made over a secure websocket using a
+// SigV4 signed URL; creds is called, and the URL signed afresh, before each connection attempt (signatures and
+// temporary credentials expire, so a URL cannot be reused when reconnecting). creds is called via
+// CredentialsProviderCtx, which must not be replaced.
+//
+// The options also reflect AWS IoT Core's requirements: MQTT 3.1.1 (no fallback to 3.1), a keepalive of 60s (the
+// broker accepts 30 to 1200 seconds) and reconnection with exponential backoff and jitter (1s to 128s, as used by
+// the AWS device SDKs) so that a fleet of devices does not reconnect in lock step following an outage.
+func NewAWSIoTOptions(endpoint, region string, creds AWSCredentialsProvider) *ClientOptions {
+	o := NewClientOptions().
+		SetProtocolVersion(4).
+		SetKeepAlive(60 * time.Second).
+		SetMaxReconnectInterval(128 * time.Second)
+	o.ConnectRetryPolicy = awsRetryPolicy
+	if creds == nil {
+		o.AddBroker("mqtts://" + endpoint + ":443")
+		o.SetTLSConfig(&tls.Config{ServerName: endpoint, MinVersion: tls.VersionTLS12})
+		o.SetBrokerALPNProtocols(endpoint+":443", AWSIoTALPN)
+		return o
+	}
+
+	s := &awsSigner{region: region, creds: creds, now: time.Now}
+	o.AddBroker("wss://" + endpoint + "/mqtt")
+	o.SetTLSConfig(&tls.Config{ServerName: endpoint, MinVersion: tls.VersionTLS12})
+	o.SetCredentialsProviderContext(s.fetch)
+	o.SetWebsocketConnectionOptions(func(_ int, _ *url.URL, wsOpts *WebsocketConnectionOptions) {
+		s.sign(wsOpts.URL)
+	})
+	return o
+}
+
+// awsRetryPolicy retries (when the network connection fails or the server is unavailable) with exponential backoff
+// and full jitter
+func awsRetryPolicy(class ConnectErrorClass, attempt int, _ error) (bool, time.Duration) {
+	switch class {
+	case ConnectErrorNetwork, ConnectErrorServerUnavailable:
+	default:
+		return false, 0
+	}
+	limit := 128 * time.Second
+	if attempt <= 7 {
+		limit = time.Second << (attempt - 1)
+	}
+	return true, time.Duration(rand.Int64N(int64(limit))) + time.Millisecond
+}
+
+// awsSigner signs AWS IoT Core websocket URLs using the credentials obtained for the current connection attempt
+type awsSigner struct {
+	region string
+	creds  AWSCredentialsProvider
+	now    func() time.Time
+
+	mu      sync.Mutex
+	current AWSCredentials
+}
+
+// fetch obtains the credentials for a connection attempt (it is used as the CredentialsProviderCtx; the username and
+// password are not used by AWS IoT Core websocket connections)
+func (s *awsSigner) fetch(ctx context.Context) (string, string, error) {
+	c, err := s.creds(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return "", "", errors.New("AWS credentials are incomplete")
+	}
+	s.mu.Lock()
+	s.current = c
+	s.mu.Unlock()
+	return "", "", nil
+}
+
+// sign adds a SigV4 signature to u. AWS IoT Core requires that the session token (if any) is added after signing.
+func (s *awsSigner) sign(u *url.URL) {
+	s.mu.Lock()
+	c := s.current
+	s.mu.Unlock()
+	presignAWSURL(u, awsIoTService, s.region, c, s.now(), 24*time.Hour, hex.EncodeToString(sha256Sum(nil)))
+	if c.SessionToken != "" {
+		u.RawQuery += "&X-Amz-Security-Token=" + awsEscape(c.SessionToken)
+	}
+}
+
+// presignAWSURL adds AWS Signature Version 4 query parameters to u (a GET request signing only the host header)
+func presignAWSURL(u *url.URL, service, region string, c AWSCredentials, t time.Time, expires time.Duration, payloadHash string) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	amzDate := t.Format("20060102T150405Z")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+
+	params := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    c.AccessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(expires / time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	for k, v := range u.Query() {
+		params[k] = v[0]
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var query strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			query.WriteByte('&')
+		}
+		query.WriteString(awsEscape(k) + "=" + awsEscape(params[k]))
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{"GET", path, query.String(), "host:" + u.Host + "\n", "host", payloadHash}, "\n")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(sha256Sum([]byte(canonicalRequest)))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	u.RawQuery = query.String() + "&X-Amz-Signature=" + hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// awsEscape percent-encodes s as required by SigV4 (everything other than unreserved characters is encoded)
+func awsEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(s), "+", "%20"), "%7E", "~")
+}
+
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,381 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AzureIoTHubAPIVersion is the IoT Hub API version requested in the username
+const AzureIoTHubAPIVersion = "2021-04-12"
+
+// ErrAzureIoTHub is wrapped by errors relating to IoT Hub requests (e.g. a twin request that fails)
+var ErrAzureIoTHub = errors.New("azure iot hub")
+
+// AzureSASToken returns a shared access signature for resourceURI (e.g. "myhub.azure-devices.net/devices/dev1")
+// signed with key (base64 encoded, as it appears in a connection string) that expires at expiry. policy is the
+// shared access policy name (empty when using a device key).
+func AzureSASToken(resourceURI, key, policy string, expiry time.Time) (string, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid shared access key: %w", err)
+	}
+	sr := url.QueryEscape(resourceURI)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+	h := hmac.New(sha256.New, k)
+	h.Write([]byte(sr + "\n" + se))
+	token := "SharedAccessSignature sr=" + sr + "&sig=" + url.QueryEscape(base64.StdEncoding.EncodeToString(h.Sum(nil))) + "&se=" + se
+	if policy != "" {
+		token += "&skn=" + url.QueryEscape(policy)
+	}
+	return token, nil
+}
+
+// AzureIoTHubOptions configures an AzureIoTHub
+type AzureIoTHubOptions struct {
+	ConnectionString string        // device connection string ("HostName=...;DeviceId=...;SharedAccessKey=..." and optionally ModuleId)
+	TokenLifetime    time.Duration // lifetime of each SAS token (default 1 hour)
+	RenewBefore      time.Duration // how long before the token expires that the connection is cycled (default 5 minutes)
+	Websocket        bool          // connect using a secure websocket (port 443) rather than MQTT over TLS (port 8883)
+	Timeout          time.Duration // how long twin requests wait for a response (default 30s)
+}
+
+// AzureIoTHub connects a device (or module) to Azure IoT Hub using SAS token authentication and implements the
+// hub's topic conventions (telemetry, cloud-to-device messages, device twins and direct methods).
+//
+// IoT Hub closes connections when the SAS token used to authenticate expires; to avoid this AzureIoTHub generates
+// a new token for each connection attempt and, shortly before the token expires, disconnects (gracefully) so that
+// the client reconnects with a fresh token. The connection lost handler receives ErrCredentialsExpiring when this
+// happens. This relies upon AutoReconnect (enabled by default). Use AzureIoTHub.Disconnect, rather than
+// Client.Disconnect, so that the pending renewal is cancelled.
+type AzureIoTHub struct {
+	hostName, deviceID, moduleID string
+	key, policy                  string
+	opts                         AzureIoTHubOptions
+	logger                       *slog.Logger
+
+	mu      sync.Mutex
+	expiry  time.Time   // expiry of the token used for the most recent connection attempt
+	renew   *time.Timer // fires when the connection should be cycled
+	nextRID uint64      // request ID for twin requests
+	pending map[string]chan twinResponse
+}
+
+type twinResponse struct {
+	status  int
+	version int
+	body    []byte
+}
+
+// NewAzureIoTHub returns an AzureIoTHub for the client that will be created with o. o is modified (the broker,
+// client ID, TLS config, credentials provider and protocol version are set, and the OnConnect and OnConnectionLost
+// handlers wrapped) so must be passed to NewClient after this is called.
+func NewAzureIoTHub(o *ClientOptions, opts AzureIoTHubOptions) (*AzureIoTHub, error) {
+	h := &AzureIoTHub{opts: opts, logger: o.Logger, pending: make(map[string]chan twinResponse)}
+	for _, part := range strings.Split(opts.ConnectionString, ";") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "HostName":
+			h.hostName = v
+		case "DeviceId":
+			h.deviceID = v
+		case "ModuleId":
+			h.moduleID = v
+		case "SharedAccessKey":
+			h.key = v
+		case "SharedAccessKeyName":
+			h.policy = v
+		}
+	}
+	if h.hostName == "" || h.deviceID == "" || h.key == "" {
+		return nil, fmt.Errorf("%w: connection string must include HostName, DeviceId and SharedAccessKey", ErrAzureIoTHub)
+	}
+	if _, err := base64.StdEncoding.DecodeString(h.key); err != nil {
+		return nil, fmt.Errorf("%w: invalid SharedAccessKey: %w", ErrAzureIoTHub, err)
+	}
+	if h.opts.TokenLifetime <= 0 {
+		h.opts.TokenLifetime = time.Hour
+	}
+	if h.opts.RenewBefore <= 0 {
+		h.opts.RenewBefore = 5 * time.Minute
+	}
+	if h.opts.RenewBefore >= h.opts.TokenLifetime {
+		h.opts.RenewBefore = h.opts.TokenLifetime / 2
+	}
+	if h.opts.Timeout <= 0 {
+		h.opts.Timeout = 30 * time.Second
+	}
+	if h.logger == nil {
+		h.logger = slog.Default()
+	}
+
+	clientID := h.deviceID
+	if h.moduleID != "" {
+		clientID += "/" + h.moduleID
+	}
+	o.Servers = nil
+	if h.opts.Websocket {
+		o.AddBroker("wss://" + h.hostName + "/$iothub/websocket?iothub-no-client-cert=true")
+	} else {
+		o.AddBroker("mqtts://" + h.hostName + ":8883")
+	}
+	o.SetClientID(clientID).
+		SetProtocolVersion(4).
+		SetTLSConfig(&tls.Config{ServerName: h.hostName, MinVersion: tls.VersionTLS12}).
+		SetCredentialsProviderContext(h.credentials)
+
+	onConnect, onLost := o.OnConnect, o.OnConnectionLost
+	o.SetOnConnectHandler(func(c Client) {
+		h.connected(c)
+		if onConnect != nil {
+			onConnect(c)
+		}
+	})
+	o.SetConnectionLostHandler(func(c Client, err error) {
+		h.stopRenewal()
+		if onLost != nil {
+			onLost(c, err)
+		}
+	})
+	return h, nil
+}
+
+// DeviceID returns the device ID from the connection string
+func (h *AzureIoTHub) DeviceID() string { return h.deviceID }
+
+// credentials generates the username and SAS token for a connection attempt (used as the CredentialsProviderCtx)
+func (h *AzureIoTHub) credentials(context.Context) (string, string, error) {
+	resource := h.hostName + "/devices/" + url.PathEscape(h.deviceID)
+	if h.moduleID != "" {
+		resource += "/modules/" + url.PathEscape(h.moduleID)
+	}
+	expiry := time.Now().Add(h.opts.TokenLifetime)
+	token, err := AzureSASToken(resource, h.key, h.policy, expiry)
+	if err != nil {
+		return "", "", err
+	}
+	h.mu.Lock()
+	h.expiry = expiry
+	h.mu.Unlock()
+	clientID := h.deviceID
+	if h.moduleID != "" {
+		clientID += "/" + h.moduleID
+	}
+	return h.hostName + "/" + clientID + "/?api-version=" + AzureIoTHubAPIVersion, token, nil
+}
+
+// Disconnect cancels the scheduled renewal of the connection and disconnects c; quiesce is passed to
+// Client.Disconnect
+func (h *AzureIoTHub) Disconnect(c Client, quiesce uint) {
+	h.stopRenewal()
+	c.Disconnect(quiesce)
+}
+
+// connected subscribes to twin responses and schedules the renewal of the connection
+func (h *AzureIoTHub) connected(c Client) {
+	OnComplete(c.Subscribe("$iothub/twin/res/#", 0, h.twinResponse), func(err error) {
+		if err != nil {
+			h.logger.Error("failed to subscribe to twin responses", slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		}
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.renew != nil {
+		h.renew.Stop()
+	}
+	h.renew = time.AfterFunc(time.Until(h.expiry.Add(-h.opts.RenewBefore)), func() {
+		if r, ok := c.(interface{ reauthenticate(error) }); ok {
+			r.reauthenticate(ErrCredentialsExpiring)
+		}
+	})
+}
+
+// stopRenewal cancels the scheduled renewal of the connection
+func (h *AzureIoTHub) stopRenewal() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.renew != nil {
+		h.renew.Stop()
+		h.renew = nil
+	}
+}
+
+// TelemetryTopic returns the topic to which device-to-cloud messages with the specified application properties (which
+// may be nil) are published
+func (h *AzureIoTHub) TelemetryTopic(properties map[string]string) string {
+	t := "devices/" + h.deviceID + "/messages/events/"
+	if h.moduleID != "" {
+		t = "devices/" + h.deviceID + "/modules/" + h.moduleID + "/messages/events/"
+	}
+	if len(properties) > 0 {
+		v := url.Values{}
+		for k, p := range properties {
+			v.Set(k, p)
+		}
+		t += v.Encode()
+	}
+	return t
+}
+
+// SendTelemetry publishes a device-to-cloud message (IoT Hub does not support QoS 2 so qos must be 0 or 1)
+func (h *AzureIoTHub) SendTelemetry(c Client, qos byte, payload []byte, properties map[string]string) Token {
+	return c.Publish(h.TelemetryTopic(properties), qos, false, payload)
+}
+
+// SubscribeC2D subscribes to cloud-to-device messages; the message properties are encoded in the topic (see
+// AzureC2DProperties)
+func (h *AzureIoTHub) SubscribeC2D(c Client, callback MessageHandler) Token {
+	return c.Subscribe("devices/"+h.deviceID+"/messages/devicebound/#", 1, callback)
+}
+
+// AzureC2DProperties returns the properties encoded in the topic of a cloud-to-device message
+func AzureC2DProperties(topic string) map[string]string {
+	_, encoded, ok := strings.Cut(topic, "/messages/devicebound/")
+	if !ok {
+		return nil
+	}
+	v, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil
+	}
+	props := make(map[string]string, len(v))
+	for k := range v {
+		props[k] = v.Get(k)
+	}
+	return props
+}
+
+// GetTwin requests the device twin, returning the JSON document
+func (h *AzureIoTHub) GetTwin(ctx context.Context, c Client) ([]byte, error) {
+	r, err := h.twinRequest(ctx, c, "$iothub/twin/GET/", nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.body, nil
+}
+
+// UpdateReportedProperties applies patch (a JSON document) to the reported properties of the device twin, returning
+// the new version of the reported properties
+func (h *AzureIoTHub) UpdateReportedProperties(ctx context.Context, c Client, patch []byte) (int, error) {
+	r, err := h.twinRequest(ctx, c, "$iothub/twin/PATCH/properties/reported/", patch)
+	if err != nil {
+		return 0, err
+	}
+	return r.version, nil
+}
+
+// SubscribeDesiredProperties subscribes to changes to the desired properties of the device twin; callback receives
+// the patch (a JSON document) and the new version
+func (h *AzureIoTHub) SubscribeDesiredProperties(c Client, callback func(patch []byte, version int)) Token {
+	return c.Subscribe("$iothub/twin/PATCH/properties/desired/#", 0, func(_ Client, m Message) {
+		version, _ := strconv.Atoi(topicQuery(m.Topic()).Get("$version"))
+		callback(m.Payload(), version)
+	})
+}
+
+// SubscribeMethods subscribes to direct method invocations; callback receives the method name and payload and
+// returns the status and (JSON) response, which are sent to the hub
+func (h *AzureIoTHub) SubscribeMethods(c Client, callback func(method string, payload []byte) (status int, response []byte)) Token {
+	return c.Subscribe("$iothub/methods/POST/#", 0, func(c Client, m Message) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(m.Topic(), "$iothub/methods/POST/"), "/")
+		rid := topicQuery(m.Topic()).Get("$rid")
+		status, response := callback(name, m.Payload())
+		if response == nil {
+			response = []byte("{}")
+		}
+		c.Publish("$iothub/methods/res/"+strconv.Itoa(status)+"/?$rid="+url.QueryEscape(rid), 0, false, response)
+	})
+}
+
+// twinRequest publishes a twin request to topic and waits for the response
+func (h *AzureIoTHub) twinRequest(ctx context.Context, c Client, topic string, payload []byte) (twinResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.opts.Timeout)
+	defer cancel()
+	resp := make(chan twinResponse, 1)
+	h.mu.Lock()
+	h.nextRID++
+	rid := strconv.FormatUint(h.nextRID, 10)
+	h.pending[rid] = resp
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, rid)
+		h.mu.Unlock()
+	}()
+
+	if payload == nil {
+		payload = []byte{}
+	}
+	t := c.Publish(topic+"?$rid="+rid, 0, false, payload)
+	select {
+	case <-t.Done():
+		if err := t.Error(); err != nil {
+			return twinResponse{}, err
+		}
+	case <-ctx.Done():
+		return twinResponse{}, ctx.Err()
+	}
+	select {
+	case r := <-resp:
+		if r.status < 200 || r.status > 299 {
+			return r, fmt.Errorf("%w: twin request failed with status %d: %s", ErrAzureIoTHub, r.status, r.body)
+		}
+		return r, nil
+	case <-ctx.Done():
+		return twinResponse{}, ctx.Err()
+	}
+}
+
+// twinResponse handles messages on $iothub/twin/res/{status}/?$rid={request id}[&$version={version}]
+func (h *AzureIoTHub) twinResponse(_ Client, m Message) {
+	statusPart, _, _ := strings.Cut(strings.TrimPrefix(m.Topic(), "$iothub/twin/res/"), "/")
+	status, _ := strconv.Atoi(statusPart)
+	q := topicQuery(m.Topic())
+	version, _ := strconv.Atoi(q.Get("$version"))
+	h.mu.Lock()
+	resp, ok := h.pending[q.Get("$rid")]
+	h.mu.Unlock()
+	if !ok {
+		h.logger.Debug("twin response without matching request", slog.String("topic", m.Topic()), slog.String("component", string(CLI)))
+		return
+	}
+	select {
+	case resp <- twinResponse{status: status, version: version, body: m.Payload()}:
+	default: // duplicate response
+	}
+}
+
+// topicQuery returns the query parameters at the end of an IoT Hub topic (following the final "?")
+func topicQuery(topic string) url.Values {
+	i := strings.LastIndex(topic, "?")
+	if i < 0 {
+		return nil
+	}
+	v, _ := url.ParseQuery(topic[i+1:])
+	return v
+}
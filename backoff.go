@@ -20,6 +20,8 @@ package mqtt
 import (
 	"sync"
 	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
 )
 
 // Controller for sleep with backoff when the client attempts reconnection
@@ -27,6 +29,7 @@ import (
 type backoffController struct {
 	sync.RWMutex
 	statusMap map[string]*backoffStatus
+	clock     clock.Clock
 }
 
 type backoffStatus struct {
@@ -37,6 +40,7 @@ type backoffStatus struct {
 func newBackoffController() *backoffController {
 	return &backoffController{
 		statusMap: map[string]*backoffStatus{},
+		clock:     clock.Real,
 	}
 }
 
@@ -66,12 +70,12 @@ func (b *backoffController) getBackoffSleepTime(
 
 	status, exist := b.statusMap[situation]
 	if !exist {
-		b.statusMap[situation] = &backoffStatus{initSleepPeriod, time.Now()}
+		b.statusMap[situation] = &backoffStatus{initSleepPeriod, b.clock.Now()}
 		return firstProcess(b.statusMap[situation], initSleepPeriod, skipFirst)
 	}
 
 	oldTime := status.lastErrorTime
-	status.lastErrorTime = time.Now()
+	status.lastErrorTime = b.clock.Now()
 
 	// When there is a lot of time between last and this error, sleep period is initialized.
 	if status.lastErrorTime.Sub(oldTime) > (processTime*2 + status.lastSleepPeriod) {
@@ -98,7 +102,7 @@ func (b *backoffController) sleepWithBackoff(
 ) (time.Duration, bool) {
 	sleep, isFirst := b.getBackoffSleepTime(situation, initSleepPeriod, maxSleepPeriod, processTime, skipFirst)
 	if sleep != 0 {
-		time.Sleep(sleep)
+		b.clock.Sleep(sleep)
 	}
 	return sleep, isFirst
 }
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BridgeDirection determines the direction in which a BridgeRule forwards messages
+type BridgeDirection int
+
+const (
+	// BridgeOut forwards messages from the local broker to the remote broker
+	BridgeOut BridgeDirection = iota
+	// BridgeIn forwards messages from the remote broker to the local broker
+	BridgeIn
+)
+
+// bridgeRetryInterval is the delay before retrying a message that could not be forwarded
+const bridgeRetryInterval = time.Second
+
+// BridgeRule defines a set of messages that a Bridge forwards
+type BridgeRule struct {
+	Direction BridgeDirection
+	Filter    string // the topic filter subscribed to on the source broker
+	Qos       byte   // QoS used when subscribing to the source broker and publishing to the target broker
+	// SourcePrefix is removed from the topic (if present) and TargetPrefix added before the message is
+	// published to the target broker (e.g. SourcePrefix "" and TargetPrefix "site1/" maps "a/b" to "site1/a/b")
+	SourcePrefix string
+	TargetPrefix string
+}
+
+// targetTopic returns the topic that a message received on topic will be forwarded to
+func (r BridgeRule) targetTopic(topic string) string {
+	return r.TargetPrefix + strings.TrimPrefix(topic, r.SourcePrefix)
+}
+
+// sourceTopicMatches returns true if topic could be the result of this rule forwarding a message (i.e. topic
+// starts with a non-empty TargetPrefix and the corresponding source topic matches Filter)
+func (r BridgeRule) sourceTopicMatches(topic string) bool {
+	if r.TargetPrefix == "" {
+		return false
+	}
+	rest, ok := strings.CutPrefix(topic, r.TargetPrefix)
+	if !ok {
+		return false
+	}
+	return routeIncludesTopic(r.Filter, rest) || (r.SourcePrefix != "" && routeIncludesTopic(r.Filter, r.SourcePrefix+rest))
+}
+
+// Bridge connects two brokers (via a local and a remote client) and forwards messages between them as per its
+// BridgeRules. Messages received by the bridge are only acknowledged once they have been delivered to the target
+// broker (failed publishes are retried until the bridge is stopped); so, when the clients are configured with
+// persistent sessions (CleanSession false and a persistent Store such as FileStore), messages in flight when the
+// bridge is stopped will be redelivered when it restarts.
+//
+// Where rules forward messages in both directions a message could be returned to its source (and loop
+// indefinitely). The TargetPrefix marks messages that the bridge has forwarded: a message received from a broker
+// is dropped if its topic could have been produced by a rule forwarding to that broker (it starts with the rule's
+// TargetPrefix and the remainder matches the rule's Filter). Rules that could otherwise loop must therefore set
+// a TargetPrefix (MQTT v3.1.1 has no other means of marking a message).
+type Bridge struct {
+	local, remote Client
+	rules         []BridgeRule
+	logger        *slog.Logger
+
+	subscribed map[BridgeDirection]chan error // receives the outcome of the subscriptions made when connecting
+	stop       chan struct{}                  // closed by Stop (abandons retries)
+	stopOnce   sync.Once
+}
+
+// NewBridge returns a Bridge that will forward messages between the brokers configured in local and remote as per
+// rules. The options are modified (automatic acknowledgement is disabled, and the OnConnect handler is wrapped so
+// that subscriptions are made whenever a connection is established) and must not be used elsewhere.
+func NewBridge(local, remote *ClientOptions, rules ...BridgeRule) *Bridge {
+	b := &Bridge{
+		rules:  rules,
+		logger: local.Logger,
+		subscribed: map[BridgeDirection]chan error{
+			BridgeOut: make(chan error, 1),
+			BridgeIn:  make(chan error, 1),
+		},
+		stop: make(chan struct{}),
+	}
+	if b.logger == nil {
+		b.logger = slog.Default()
+	}
+	b.local = NewClient(b.bridgeOptions(local, BridgeOut))
+	b.remote = NewClient(b.bridgeOptions(remote, BridgeIn))
+	return b
+}
+
+// bridgeOptions configures o for use by the bridge; direction is that of the rules for which the client receives
+// messages.
+func (b *Bridge) bridgeOptions(o *ClientOptions, direction BridgeDirection) *ClientOptions {
+	onConnect := o.OnConnect
+	o.SetAutoAckDisabled(true)
+	o.SetOnConnectHandler(func(c Client) {
+		err := b.subscribe(c, direction)
+		if err != nil {
+			b.logger.Error("bridge failed to subscribe", slog.String("error", err.Error()), slog.String("component", string(BRG)))
+		}
+		select { // only the outcome of the first connection is needed (by Start)
+		case b.subscribed[direction] <- err:
+		default:
+		}
+		if onConnect != nil {
+			onConnect(c)
+		}
+	})
+	return o
+}
+
+// Local returns the client connected to the local broker
+func (b *Bridge) Local() Client { return b.local }
+
+// Remote returns the client connected to the remote broker
+func (b *Bridge) Remote() Client { return b.remote }
+
+// Start connects to both brokers and waits until the bridge's subscriptions have been made (returning an error if
+// either connection fails or a subscription is refused)
+func (b *Bridge) Start() error {
+	if t := b.local.Connect(); t.Wait() && t.Error() != nil {
+		return t.Error()
+	}
+	if t := b.remote.Connect(); t.Wait() && t.Error() != nil {
+		b.local.Disconnect(0)
+		return t.Error()
+	}
+	for _, direction := range []BridgeDirection{BridgeOut, BridgeIn} {
+		if err := <-b.subscribed[direction]; err != nil {
+			b.local.Disconnect(0)
+			b.remote.Disconnect(0)
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop disconnects from both brokers; quiesce is passed to Client.Disconnect
+func (b *Bridge) Stop(quiesce uint) {
+	b.stopOnce.Do(func() { close(b.stop) })
+	b.local.Disconnect(quiesce)
+	b.remote.Disconnect(quiesce)
+}
+
+// subscribe subscribes c (the source client) to the filters of the rules in direction and waits for the
+// subscriptions to complete
+func (b *Bridge) subscribe(c Client, direction BridgeDirection) error {
+	var tokens []Token
+	for _, r := range b.rules {
+		if r.Direction != direction {
+			continue
+		}
+		tokens = append(tokens, c.Subscribe(r.Filter, r.Qos, func(_ Client, m Message) { b.forward(r, m) }))
+	}
+	var errs []error
+	for _, t := range tokens {
+		if t.Wait(); t.Error() != nil {
+			errs = append(errs, t.Error())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// forwardedBy returns true if a message on topic, received by a rule in direction, could have been forwarded by
+// the bridge (i.e. by a rule in the opposite direction)
+func (b *Bridge) forwardedBy(direction BridgeDirection, topic string) bool {
+	for _, r := range b.rules {
+		if r.Direction != direction && r.sourceTopicMatches(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward publishes m to the target broker as per r (retrying until successful or the bridge is stopped); m is
+// acknowledged once it has been delivered
+func (b *Bridge) forward(r BridgeRule, m Message) {
+	target := b.remote
+	if r.Direction == BridgeIn {
+		target = b.local
+	}
+	if b.forwardedBy(r.Direction, m.Topic()) {
+		b.logger.Debug("bridge dropping looped message", slog.String("topic", m.Topic()), slog.String("component", string(BRG)))
+		m.Ack()
+		return
+	}
+	topic := r.targetTopic(m.Topic())
+	go func() {
+		for {
+			t := target.Publish(topic, r.Qos, m.Retained(), m.Payload())
+			<-t.Done()
+			err := t.Error()
+			if err == nil {
+				m.Ack()
+				return
+			}
+			b.logger.Warn("bridge failed to forward message; will retry", slog.String("topic", topic), slog.String("error", err.Error()), slog.String("component", string(BRG)))
+			select {
+			case <-time.After(bridgeRetryInterval):
+			case <-b.stop: // The message is not acknowledged so will be redelivered if the session is resumed
+				return
+			}
+		}
+	}()
+}
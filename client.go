@@ -25,10 +25,14 @@ package mqtt
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -36,6 +40,7 @@ import (
 
 	"golang.org/x/sync/semaphore"
 
+	"github.com/eclipse/paho.mqtt.golang/clock"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -64,6 +69,11 @@ const maxDuration = 1<<63 - 1
 // and then supplying a ClientOptions type.
 // Implementations of Client must be safe for concurrent use by multiple
 // goroutines
+//
+// Functionality added since Client was defined is provided through separate
+// interfaces (e.g. Pinger), which the Client returned by NewClient implements,
+// so that existing implementations of Client are not broken; use a type
+// assertion to access it (e.g. c.(mqtt.Pinger).Ping(ctx)).
 type Client interface {
 	// IsConnected returns a bool signifying whether
 	// the client is connected or not.
@@ -73,7 +83,8 @@ type Client interface {
 	IsConnectionOpen() bool
 	// Connect will create a connection to the message broker, by default,
 	// it will attempt to connect at v3.1.1 and auto retry at v3.1 if that
-	// fails
+	// fails. If the broker refuses the connection the token's error is a
+	// *ConnackError (e.g. packets.ErrorRefusedNotAuthorised).
 	Connect() Token
 	// Disconnect will end the connection with the server, but not before waiting
 	// the specified number of milliseconds to wait for existing work to be
@@ -123,13 +134,154 @@ type Client interface {
 	OptionsReader() ClientOptionsReader
 }
 
+// ContextDisconnecter is implemented by clients that can disconnect once in-flight messages have been
+// acknowledged.
+type ContextDisconnecter interface {
+	// DisconnectContext will end the connection with the server once all in-flight QoS 1/2 publish
+	// flows have completed (or ctx is done). New publishes are rejected whilst this is in progress.
+	// Returns ctx.Err() if ctx was done before the in-flight messages were acknowledged.
+	DisconnectContext(ctx context.Context) error
+}
+
+// ConnectionWaiter is implemented by clients that can report the state of the connection and wait for it to
+// come up.
+type ConnectionWaiter interface {
+	// ConnectionState returns the current state of the connection (unlike IsConnected
+	// this distinguishes between being connected and reconnecting)
+	ConnectionState() ConnState
+	// WaitForConnection blocks until the connection is up or ctx is done (in which
+	// case ctx.Err() is returned)
+	WaitForConnection(ctx context.Context) error
+}
+
+// OptionsPublisher is implemented by clients that can publish with PublishOptions.
+type OptionsPublisher interface {
+	// PublishWithOptions is as per Publish but accepts additional options (e.g. an expiry for messages
+	// buffered whilst offline).
+	PublishWithOptions(topic string, qos byte, retained bool, payload interface{}, opts PublishOptions) Token
+}
+
+// BatchPublisher is implemented by clients that can publish multiple messages together.
+type BatchPublisher interface {
+	// PublishBatch publishes multiple messages using a single network write. The returned
+	// token completes when all of the messages have been delivered (or failed); the token
+	// returned by the client from NewClient is a *BatchToken.
+	PublishBatch(requests []PublishRequest) Token
+}
+
+// OptionsSubscriber is implemented by clients that can subscribe, or add routes, with RouteOptions.
+type OptionsSubscriber interface {
+	// SubscribeWithOptions is as per Subscribe but accepts options controlling how messages are passed
+	// to callback (e.g. allowing a slow handler to run without delaying messages for other routes).
+	SubscribeWithOptions(topic string, qos byte, callback MessageHandler, opts RouteOptions) Token
+	// SubscribeLatest starts a new subscription where, if multiple messages for the same topic arrive
+	// before callback is called, only the latest is passed to it (earlier messages are acknowledged
+	// and discarded). This is equivalent to SubscribeWithOptions with RouteOptions{LatestOnly: true}.
+	SubscribeLatest(topic string, qos byte, callback MessageHandler) Token
+	// AddRouteWithOptions is as per AddRoute but accepts options controlling how messages are passed
+	// to callback (see RouteOptions).
+	AddRouteWithOptions(topic string, callback MessageHandler, opts RouteOptions)
+}
+
+// MatcherRouter is implemented by clients that can add routes using a RouteMatcher.
+type MatcherRouter interface {
+	// AddMatcherRoute is as AddRoute but matcher (e.g. a TopicTemplate) determines which topics the
+	// route matches; messages passed to callback implement TopicParamsMessage. Subscribe to
+	// matcher.Filter() to receive the messages. Use DeleteRoute(matcher.String()) to remove the route.
+	AddMatcherRoute(matcher RouteMatcher, callback MessageHandler)
+}
+
+// HealthReporter is implemented by clients that can report on the health of their connection.
+type HealthReporter interface {
+	// ConnectionHealth returns a snapshot of the health of the connection (ping round trip time etc.)
+	ConnectionHealth() ConnectionHealth
+}
+
+// WillUpdater is implemented by clients that can change their will message after they have been created.
+type WillUpdater interface {
+	// UpdateWill replaces the will message; the change takes effect when the client next
+	// connects (including automatic reconnection). An empty topic removes the will.
+	UpdateWill(topic string, payload []byte, qos byte, retained bool)
+}
+
+// AsyncPublisher is implemented by clients that can report the outcome of a publish on a channel.
+type AsyncPublisher interface {
+	// PublishAsync is as per Publish but, rather than a token, returns a channel that will
+	// receive a single DeliveryReceipt when the flow completes (the channel is buffered so
+	// need not be read).
+	PublishAsync(topic string, qos byte, retained bool, payload interface{}) <-chan DeliveryReceipt
+}
+
+// ConnectionHistoryReader is implemented by clients that can report their recent connection attempts.
+type ConnectionHistoryReader interface {
+	// ConnectionHistory returns details of the most recent connection attempts (oldest first),
+	// including the reason for any failure and the delay before the following attempt.
+	ConnectionHistory() []ConnectionAttempt
+}
+
+// InflightInspector is implemented by clients that can report the message IDs in use by incomplete flows.
+type InflightInspector interface {
+	// InflightIDs returns the message IDs in use by QoS 1/2 PUBLISH, SUBSCRIBE and UNSUBSCRIBE flows that have not
+	// yet completed (ordered by ID); this is intended to help debug flows that do not complete.
+	InflightIDs() []InflightID
+}
+
+// SubscriptionLister is implemented by clients that can report the subscriptions they have made.
+type SubscriptionLister interface {
+	// Subscriptions returns details of the subscriptions that the client has requested
+	// (excluding those that have been unsubscribed or were rejected by the broker)
+	Subscriptions() []SubscriptionInfo
+}
+
+// Pinger is implemented by clients that can check the connection to the broker on demand.
+type Pinger interface {
+	// Ping sends a PINGREQ to the broker and waits for the PINGRESP (or ctx to be done, in which
+	// case ctx.Err() is returned). This allows application-driven health checks.
+	Ping(ctx context.Context) error
+}
+
+// GroupSubscriber is implemented by clients that can manage their subscriptions in groups and make shared
+// subscriptions (where the broker distributes messages between the members of a group).
+type GroupSubscriber interface {
+	// UnsubscribeAll ends all subscriptions made by the client (as reported by Subscriptions).
+	UnsubscribeAll() Token
+	// SubscribeGroup is as per SubscribeMultiple but also adds the topic filters to the named subscription
+	// group (creating it if needed) so they can be unsubscribed together with UnsubscribeGroup. A topic filter
+	// may belong to more than one group. Groups are tracked in memory only (they are not persisted).
+	SubscribeGroup(name string, filters map[string]byte, callback MessageHandler) Token
+	// UnsubscribeGroup ends the subscriptions in the named group (other than those that also belong to another
+	// group) and, once the broker has acknowledged this, removes the group.
+	UnsubscribeGroup(name string) Token
+	// SubscribeShared starts a new shared subscription ($share/<group>/<topic>); the broker will distribute
+	// messages matching topic between the members of group. Messages passed to callback implement
+	// SharedSubscriptionMessage. Use Unsubscribe("$share/<group>/<topic>") to end the subscription.
+	SubscribeShared(group string, topic string, qos byte, callback MessageHandler) Token
+}
+
+// NamedSubscriber is implemented by clients that can subscribe using a handler registered with
+// ClientOptions.SetNamedHandler.
+type NamedSubscriber interface {
+	// SubscribeNamed starts a new subscription with messages passed to the handler registered
+	// (via ClientOptions.SetNamedHandler) as handlerName. When CleanSession is false the
+	// subscription is persisted so the handler is rebound following a restart.
+	SubscribeNamed(topic string, qos byte, handlerName string) Token
+}
+
 // client implements the Client interface
 // clients are safe for concurrent use by multiple
 // goroutines
 type client struct {
-	lastSent        atomic.Value // time.Time - the last time a packet was successfully sent to network
-	lastReceived    atomic.Value // time.Time - the last time a packet was successfully received from network
-	pingOutstanding int32        // set to 1 if a ping has been sent, but the response has not yet been received
+	lastSent        atomic.Value  // time.Time - the last time a packet was successfully sent to network
+	lastReceived    atomic.Value  // time.Time - the last time a packet was successfully received from network
+	pingOutstanding int32         // set to 1 if a ping has been sent, but the response has not yet been received
+	pingSent        atomic.Value  // time.Time - the time at which the outstanding ping was sent
+	pingRTT         atomic.Int64  // time.Duration - round trip time of the most recent ping
+	packetsTraced   atomic.Uint64 // count of publish flow packets considered by tracePacket (for sampling)
+	stats           connStats     // counters for the current connection (see ConnectionStats)
+	subs            subscriptionRegistry
+
+	pingMu      sync.Mutex
+	pingWaiters []chan struct{} // closed when the next PINGRESP is received (see Ping)
 
 	status connectionStatus // see constants in status.go for values
 
@@ -139,17 +291,29 @@ type client struct {
 	oboundP   chan *PacketAndToken // outgoing 'priority' packet (anything other than a publish packet)
 	msgRouter *router              // routes topics to handlers
 	persist   Store
+	offline   offlineBuffer   // messages published whilst offline (if OfflineBufferSize > 0)
+	dedup     *dedupCache     // detects redelivered QoS 1 messages (nil if DeduplicationWindow is 0)
+	inflight  *inflightWindow // limits outstanding QoS 1/2 publishes (nil if MaxInflight is 0)
+	history   *connHistory    // recent connection attempts (nil if ConnectionHistorySize is 0)
 	options   ClientOptions
 	optionsMu sync.Mutex // Protects the options in a few limited cases where needed for testing
 
+	sessionReset error // non-nil if the session has been discarded (see CleanSessionFallback); protected by optionsMu
+
 	conn   net.Conn   // the network connection must only be set with connMu locked (only used when starting/stopping workers)
 	connMu sync.Mutex // mutex for the connection (again only used in two functions)
 
 	stop         chan struct{}  // Closed to request that workers stop
+	lost         chan struct{}  // Closed if the connection drops whilst disconnecting (internalConnLost leaves cleanup to the disconnecter)
 	workers      sync.WaitGroup // used to wait for workers to complete (ping, keepalive, errwatch, resume)
 	commsStopped chan struct{}  // closed when the comms routines have stopped (kept running until after workers have closed to avoid deadlocks)
 
+	connectedBroker atomic.Pointer[url.URL] // the broker most recently connected to
+	cycleReason     atomic.Pointer[error]   // reason passed to the connection lost handler following reauthenticate
+	tokenExpiry     time.Time               // expiry of the JWT used for the current connection (only accessed whilst connecting)
+
 	backoff *backoffController
+	clock   clock.Clock  // source of time (options.Clock or clock.Real)
 	logger  *slog.Logger // logger for the client, set to options.Logger if not nil, otherwise uses slog.Default() logger
 }
 
@@ -177,12 +341,25 @@ func NewClient(o *ClientOptions) Client {
 	c.logger = slog.New(wrapper)
 
 	c.persist = c.options.Store
-	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor), logger: c.logger}
+	if c.options.StoreHook != nil {
+		c.persist = newHookedStore(c.persist, c.options.StoreHook)
+	}
+	if c.options.DeduplicationWindow > 0 {
+		c.dedup = newDedupCache(c.options.DeduplicationWindow)
+	}
+	c.inflight = newInflightWindow(c.options.MaxInflight)
+	c.history = newConnHistory(c.options.ConnectionHistorySize)
+	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor), allocator: c.options.MessageIDAllocator, logger: c.logger}
 	c.msgRouter = newRouter(c.logger)
 	c.msgRouter.setDefaultHandler(c.options.DefaultPublishHandler)
 	c.obound = make(chan *PacketAndToken)
 	c.oboundP = make(chan *PacketAndToken)
+	c.clock = c.options.Clock
+	if c.clock == nil {
+		c.clock = clock.Real
+	}
 	c.backoff = newBackoffController()
+	c.backoff.clock = c.clock
 	return c
 }
 
@@ -200,6 +377,14 @@ func (c *client) AddRoute(topic string, callback MessageHandler) {
 	}
 }
 
+// AddRouteWithOptions is as per AddRoute but accepts options controlling how messages are passed
+// to callback (see RouteOptions).
+func (c *client) AddRouteWithOptions(topic string, callback MessageHandler, opts RouteOptions) {
+	if callback != nil {
+		c.msgRouter.addRouteWithOptions(topic, callback, opts)
+	}
+}
+
 // DeleteRoute removes the handler previously added for the given topic with
 // AddRoute. It is a no-op if no handler is registered for that exact topic.
 // Note that this does not unsubscribe; use Unsubscribe for that.
@@ -207,6 +392,15 @@ func (c *client) DeleteRoute(topic string) {
 	c.msgRouter.deleteRoute(topic)
 }
 
+// AddMatcherRoute is as AddRoute but matcher (e.g. a TopicTemplate) determines which topics the
+// route matches; messages passed to callback implement TopicParamsMessage. Subscribe to
+// matcher.Filter() to receive the messages. Use DeleteRoute(matcher.String()) to remove the route.
+func (c *client) AddMatcherRoute(matcher RouteMatcher, callback MessageHandler) {
+	if matcher != nil && callback != nil {
+		c.msgRouter.addMatcherRoute(matcher, callback)
+	}
+}
+
 // IsConnected returns a bool signifying whether
 // the client is connected or not.
 // connected means that the connection is up now OR it will
@@ -234,10 +428,130 @@ func (c *client) IsConnectionOpen() bool {
 	return c.status.ConnectionStatus() == connected
 }
 
+// ConnectionState returns the current state of the connection
+// Warning: The connection status may change at any time so use this with care!
+func (c *client) ConnectionState() ConnState {
+	return c.status.ConnectionStatus().connState()
+}
+
+// WaitForConnection blocks until the connection is up or ctx is done (in which case ctx.Err() is returned).
+// Note that this does not initiate a connection; if the client is disconnected it will wait until the
+// connection is established following a call to Connect.
+func (c *client) WaitForConnection(ctx context.Context) error {
+	for {
+		s, changed := c.status.statusChanged()
+		if s == connected {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Subscriptions returns details of the subscriptions that the client has requested (excluding those that
+// have been unsubscribed or rejected by the broker). Subscriptions that were acknowledged are forgotten
+// when the client connects and the broker reports that no session was present.
+func (c *client) Subscriptions() []SubscriptionInfo {
+	return c.subs.list(c.msgRouter.messageCount)
+}
+
+// subscriptionsGranted is called by the comms routines when a SUBACK is received; the routes for any subscriptions
+// that were refused are removed (no messages will be received for them). When CleanSession is false granted
+// subscriptions made with SubscribeNamed are recorded in the store, and any record of refused ones removed.
+func (c *client) subscriptionsGranted(result map[string]byte) {
+	named := c.subs.granted(result)
+	for topic, rc := range result {
+		if rc == 0x80 { // failure
+			c.msgRouter.deleteRoute(topic)
+			if key := subscriptionKey(topic); !c.options.CleanSession && c.persist.Get(key) != nil {
+				c.persist.Del(key)
+			}
+		}
+	}
+	if c.options.CleanSession {
+		return
+	}
+	for _, s := range named {
+		persistSubscription(c.persist, s.Topic, s.Qos, s.HandlerName)
+	}
+}
+
+// ErrPayloadTooLarge is wrapped by the error returned when a payload exceeds the limit set with
+// ClientOptions.SetMaxOutboundPayload
+var ErrPayloadTooLarge = packets.ErrPayloadTooLarge
+
 // ErrNotConnected is the error returned from function calls that are
 // made when the client is not connected to a broker
 var ErrNotConnected = errors.New("not Connected")
 
+// ErrTimeout is wrapped by the errors set on tokens when an operation could not be completed within the
+// configured timeout (e.g. a publish could not be queued within ClientOptions.WriteTimeout). Note that
+// WaitTokenTimeout returns TimedOut (the operation may still complete).
+var ErrTimeout = errors.New("timeout")
+
+// ErrConnectionLost is wrapped by the errors set on tokens when the connection was lost before the operation
+// completed (and it will not be retried).
+var ErrConnectionLost = errors.New("connection lost")
+
+// ErrWriteStalled is wrapped by the error reported (e.g. to the OnConnectionLost handler) when writing a packet
+// blocked for longer than ClientOptions.WriteStallTimeout
+var ErrWriteStalled = errors.New("write stalled")
+
+// ErrServerDisconnected is wrapped by the error passed to the OnConnectionLost handler (and connection
+// notifications) when the broker closed the connection by sending a DISCONNECT packet (see ServerDisconnectError).
+var ErrServerDisconnected = errors.New("disconnected by server")
+
+// ErrUnsupportedPayload is the error set on a token when the payload passed to Publish is not of a supported type
+var ErrUnsupportedPayload = errors.New("unknown payload type")
+
+// ConnackError is the error returned when the broker refuses a connection; Code is the return code from the
+// CONNACK packet. For the return codes defined by the MQTT spec the error is the corresponding packets error
+// (e.g. packets.ErrorRefusedNotAuthorised) so it can be compared directly as well as examined with errors.As.
+type ConnackError = packets.ConnackError
+
+// refusedError returns the error for CONNACK return code rc (see ConnackError)
+func refusedError(rc byte) error {
+	if err, ok := packets.ConnErrors[rc].(*ConnackError); ok {
+		return err
+	}
+	return &ConnackError{Code: rc}
+}
+
+// ServerDisconnectError is the error reported when the broker sends a DISCONNECT packet. ReasonCode is only
+// sent by MQTT v5 brokers (it will be 0, normal disconnection, otherwise). It wraps ErrServerDisconnected.
+type ServerDisconnectError struct {
+	ReasonCode byte
+}
+
+// Error implements the error interface
+func (e *ServerDisconnectError) Error() string {
+	if e.ReasonCode == 0 {
+		return ErrServerDisconnected.Error()
+	}
+	return fmt.Sprintf("%s (reason code %d)", ErrServerDisconnected, e.ReasonCode)
+}
+
+// Unwrap returns ErrServerDisconnected
+func (e *ServerDisconnectError) Unwrap() error {
+	return ErrServerDisconnected
+}
+
+// ErrMessageIDsExhausted is the error set on a token when all message IDs are in use (i.e. 65535 QoS 1/2 messages,
+// subscribes and unsubscribes are awaiting acknowledgement) and none became free within the
+// ClientOptions.MessageIDWaitTimeout.
+var ErrMessageIDsExhausted = errors.New("no message IDs available")
+
+// ErrUnknownHandler is the error returned from SubscribeNamed when no handler has been
+// registered with the requested name
+var ErrUnknownHandler = errors.New("no handler registered with that name")
+
+// ErrCredentialsProvider wraps errors returned by the function passed to
+// ClientOptions.SetCredentialsProviderContext
+var ErrCredentialsProvider = errors.New("credentials provider failed")
+
 // Connect will create a connection to the message broker. By default,
 // it will attempt to connect at v3.1.1 and auto retry at v3.1 if that
 // fails.
@@ -245,7 +559,7 @@ var ErrNotConnected = errors.New("not Connected")
 // routes (or a DefaultPublishHandler) prior to calling Connect()
 // because queued messages may be delivered immediately upon connection
 func (c *client) Connect() Token {
-	t := newToken(packets.Connect).(*ConnectToken)
+	t := c.newToken(packets.Connect).(*ConnectToken)
 	c.logger.Debug("Connect()", slog.String("component", string(CLI)))
 
 	connectionUp, err := c.status.Connecting()
@@ -264,14 +578,20 @@ func (c *client) Connect() Token {
 		return t
 	}
 
-	c.persist.Open()
+	c.openStore()
+	if !c.options.CleanSession {
+		c.restoreSubscriptions() // Routes must be in place before messages from the session arrive
+	}
+	if c.options.OfflineBufferSize > 0 {
+		c.loadOfflineBuffer()
+	}
 	if c.options.ConnectRetry {
 		c.reserveStoredPublishIDs() // Reserve IDs to allow publishing before connect complete
 	}
 
 	go func() {
-		if len(c.options.Servers) == 0 {
-			t.setError(fmt.Errorf("no servers defined to connect to"))
+		if len(c.options.Servers) == 0 && c.options.SRVDomain == "" {
+			t.setError(fmt.Errorf("%w (no servers defined)", ErrNoBrokers))
 			if err := connectionUp(false); err != nil {
 				c.logger.Error(err.Error(), slog.String("component", string(CLI)))
 			}
@@ -279,22 +599,43 @@ func (c *client) Connect() Token {
 		}
 
 		var attemptCount int
+		var deadline time.Time // see ConnectTimeouts.Overall
+		if t := c.options.ConnectTimeouts.Overall; t > 0 {
+			deadline = c.clock.Now().Add(t)
+		}
 
 	RETRYCONN:
 		var conn net.Conn
 		var rc byte
 		var err error
-		conn, rc, t.sessionPresent, err = c.attemptConnection(false, attemptCount)
+		conn, rc, t.sessionPresent, err = c.attemptConnection(false, attemptCount, deadline)
 		if err != nil {
 			attemptCount++
-			if c.options.ConnectRetry {
+			retry, retryInterval := c.options.ConnectRetry, c.options.ConnectRetryInterval
+			class := classifyConnectFailure(rc, err)
+			gaveUp := false // true if the ConnectRetryPolicy decided to stop (see ConnectGiveUpHandler)
+			if retry && c.options.ConnectRetryPolicy != nil {
+				retry, retryInterval = c.options.ConnectRetryPolicy(class, attemptCount, err)
+				gaveUp = !retry
+			} else if errors.Is(err, ErrCertificatePinMismatch) {
+				retry = false // retrying will not change the key presented (other certificate errors may be resolved by the broker)
+			}
+			if retry && !deadline.IsZero() && !c.clock.Now().Add(retryInterval).Before(deadline) {
+				retry = false // the next attempt could not begin before the deadline
+				if !errors.Is(err, ErrConnectDeadline) {
+					err = fmt.Errorf("%w: %w", ErrConnectDeadline, err)
+				}
+			}
+			if retry {
+				t.addError(err) // retain the error so users can see why retries are occurring
 				c.logger.Debug("Connect failed, sleeping for retry_interval and will then retry",
-					slog.Int("retry_interval_sec", int(c.options.ConnectRetryInterval.Seconds())),
+					slog.Int("retry_interval_sec", int(retryInterval.Seconds())),
 					slog.String("error", err.Error()),
 					slog.String("component", string(CLI)),
 				)
 
-				time.Sleep(c.options.ConnectRetryInterval)
+				c.clock.Sleep(retryInterval)
+				c.history.setBackoff(retryInterval)
 
 				if c.status.ConnectionStatus() == connecting { // Possible connection aborted elsewhere
 					goto RETRYCONN
@@ -308,15 +649,21 @@ func (c *client) Connect() Token {
 			if err := connectionUp(false); err != nil {
 				c.logger.Error("Connect() failed", slog.String("error", err.Error()), slog.String("component", string(CLI)))
 			}
+			if gaveUp && c.options.OnConnectGiveUp != nil {
+				c.options.OnConnectGiveUp(c, err)
+			}
 			return
 		}
 		inboundFromStore := make(chan packets.ControlPacket)           // there may be some inbound comms packets in the store that are awaiting processing
 		if c.startCommsWorkers(conn, connectionUp, inboundFromStore) { // note that this takes care of updating the status (to connected or disconnected)
 			// Take care of any messages in the store
-			if !c.options.CleanSession {
+			if reset := c.sessionResetComplete(); !c.options.CleanSession && !reset {
 				c.resume(c.options.ResumeSubs, inboundFromStore)
 			} else {
-				c.persist.Reset()
+				c.resetStore()
+			}
+			if c.options.OfflineBufferSize > 0 {
+				go c.forwardOffline()
 			}
 		} else { // Note: With the new status subsystem this should only happen if Disconnect called simultaneously with the above
 			c.logger.Info("Connect() called but connection established in another goroutine", slog.String("component", string(CLI)))
@@ -352,12 +699,38 @@ func (c *client) reconnect(connectionUp connCompletedFn) {
 			c.options.OnReconnecting(c, &c.options)
 		}
 		var err error
-		conn, _, _, err = c.attemptConnection(true, attemptCount)
+		var rc byte
+		conn, rc, _, err = c.attemptConnection(true, attemptCount, time.Time{})
 		if err == nil {
 			break
 		}
 		attemptCount++
-		sleep, _ := c.backoff.sleepWithBackoff("attemptReconnection", initSleep, c.options.MaxReconnectInterval, c.options.ConnectTimeout, false)
+		var sleep time.Duration
+		retry, delay, class := true, time.Duration(0), classifyConnectFailure(rc, err)
+		gaveUp := false // true if the ConnectRetryPolicy decided to stop (see ConnectGiveUpHandler)
+		if p := c.options.ConnectRetryPolicy; p != nil {
+			retry, delay = p(class, attemptCount, err)
+			gaveUp = !retry
+		} else if errors.Is(err, ErrCertificatePinMismatch) {
+			retry = false // retrying will not change the key presented (other certificate errors may be resolved by the broker)
+		}
+		if !retry {
+			c.logger.Warn("Reconnect abandoned", slog.String("class", class.String()), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+			if err := connectionUp(false); err != nil {
+				c.logger.Error(err.Error(), slog.String("component", string(CLI)))
+			}
+			if gaveUp && c.options.OnConnectGiveUp != nil {
+				c.options.OnConnectGiveUp(c, err)
+			}
+			return
+		}
+		if c.options.ConnectRetryPolicy != nil {
+			c.clock.Sleep(delay)
+			sleep = delay
+		} else {
+			sleep, _ = c.backoff.sleepWithBackoff("attemptReconnection", initSleep, c.options.MaxReconnectInterval, c.options.ConnectTimeout, false)
+		}
+		c.history.setBackoff(sleep)
 		c.logger.Debug("Reconnect failed, slept for", slog.Int("seconds", int(sleep.Seconds())), slog.String("error", err.Error()), slog.String("component", string(CLI)))
 
 		if c.status.ConnectionStatus() != reconnecting { // Disconnect may have been called
@@ -371,20 +744,21 @@ func (c *client) reconnect(connectionUp connCompletedFn) {
 
 	inboundFromStore := make(chan packets.ControlPacket)           // there may be some inbound comms packets in the store that are awaiting processing
 	if c.startCommsWorkers(conn, connectionUp, inboundFromStore) { // note that this takes care of updating the status (to connected or disconnected)
-		c.resume(c.options.ResumeSubs, inboundFromStore)
+		if c.sessionResetComplete() {
+			c.resetStore()
+		} else {
+			c.resume(c.options.ResumeSubs, inboundFromStore)
+		}
+		if c.options.OfflineBufferSize > 0 {
+			go c.forwardOffline()
+		}
 	}
 	close(inboundFromStore)
 }
 
-// attemptConnection makes a single attempt to connect to each of the brokers
-// the protocol version to use is passed in (as c.options.ProtocolVersion)
-// Note: Does not set c.conn so that race conditions are minimized
-// Returns:
-// net.Conn - Connected network connection
-// byte - Return code (packets.Accepted indicates a successful connection).
-// bool - SessionPresent flag from the connect ack (only valid if packets.Accepted)
-// err - Error (err != nil guarantees that conn has been set to active connection).
-func (c *client) attemptConnection(isReconnect bool, attempt int) (net.Conn, byte, bool, error) {
+// attemptConnection makes a connection attempt to each broker in turn, returning the first successful connection;
+// deadline, if not zero, is the time by which the connection must be established (see ConnectTimeouts.Overall)
+func (c *client) attemptConnection(isReconnect bool, attempt int, deadline time.Time) (net.Conn, byte, bool, error) {
 	protocolVersion := c.options.ProtocolVersion
 	var (
 		sessionPresent bool
@@ -393,64 +767,109 @@ func (c *client) attemptConnection(isReconnect bool, attempt int) (net.Conn, byt
 		rc             byte
 	)
 
-	if c.options.OnConnectionNotification != nil {
-		c.options.OnConnectionNotification(c, ConnectionNotificationConnecting{isReconnect, attempt})
-	}
+	c.notifyConnection(ConnectionNotificationConnecting{isReconnect, attempt}, false)
 
 	c.optionsMu.Lock() // Protect c.options.Servers so that servers can be added in test cases
-	brokers := c.options.Servers
+	servers := c.options.Servers
+	srvDomain := c.options.SRVDomain
 	c.optionsMu.Unlock()
-	for _, broker := range brokers {
-		cm := newConnectMsgFromOptions(&c.options, broker)
-		c.logger.Debug("about to write new connect msg", slog.String("component", string(CLI)))
-	CONN:
-		tlsCfg := c.options.TLSConfig
-		if c.options.OnConnectAttempt != nil {
-			c.logger.Debug("using custom onConnectAttempt handler", slog.String("component", string(CLI)))
-
-			tlsCfg = c.options.OnConnectAttempt(broker, c.options.TLSConfig)
+	if srvDomain != "" { // Resolved on every attempt because the cluster membership may change
+		servers = append(c.resolveSRVBrokers(srvDomain), servers...)
+	}
+	c.optionsMu.Lock()
+	brokers := brokersByPriority(servers, c.options.ServerPriority)
+	c.optionsMu.Unlock()
+	if len(brokers) == 0 {
+		err = fmt.Errorf("%w : %w", packets.ConnErrors[packets.ErrNetworkError], ErrNoBrokers)
+		c.recordAttempt(nil, isReconnect, packets.ErrNetworkError, err)
+		c.notifyConnection(ConnectionNotificationFailed{err}, false)
+		return nil, packets.ErrNetworkError, false, err
+	}
+	var username, password string
+	if p := c.options.JWTProvider; p != nil {
+		username, password, err = c.fetchJWT(p)
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrCredentialsProvider, err)
+			c.logger.Error("Failed to obtain token", slog.String("error", err.Error()), slog.String("component", string(CLI)))
+			c.recordAttempt(nil, isReconnect, packets.ErrNetworkError, err)
+			c.notifyConnection(ConnectionNotificationFailed{err}, false)
+			return nil, packets.ErrNetworkError, false, err
+		}
+	} else if p := c.options.CredentialsProviderCtx; p != nil {
+		if username, password, err = c.fetchCredentials(p); err != nil {
+			err = fmt.Errorf("%w: %w", ErrCredentialsProvider, err)
+			c.logger.Error("Failed to obtain credentials", slog.String("error", err.Error()), slog.String("component", string(CLI)))
+			c.recordAttempt(nil, isReconnect, packets.ErrNetworkError, err)
+			c.notifyConnection(ConnectionNotificationFailed{err}, false)
+			return nil, packets.ErrNetworkError, false, err
 		}
-		if c.options.OnConnectionNotification != nil {
-			c.options.OnConnectionNotification(c, ConnectionNotificationBroker{broker})
+	}
+	var race *brokerRace
+	if c.options.ParallelConnect && !isReconnect && len(brokers) > 1 {
+		race = c.raceBrokers(brokers, attempt, deadline)
+		defer race.close()
+	}
+	for i := range brokers {
+		broker := brokers[i]
+		var raced *dialResult
+		if race != nil { // the connections are used in the order in which they were established
+			raced = race.next()
+			broker = raced.broker
 		}
-		connTimeOut := c.options.ConnectTimeout
-		if connTimeOut == 0 { // SetConnectTimeout states "duration of 0 never times out." (default is 30s)
-			connTimeOut = maxDuration
+		c.optionsMu.Lock() // The will may be changed by UpdateWill
+		cm := newConnectMsgFromOptions(&c.options, broker)
+		if c.sessionReset != nil {
+			cm.CleanSession = true // the session state has been discarded so the broker must do the same
 		}
-		connDeadline := time.Now().Add(connTimeOut) // Time by which connection must be established
-		dialer := c.options.Dialer
-		if dialer == nil { //
-			c.logger.Info("dialer was nil, using default", slog.String("component", string(CLI)))
-			dialer = &net.Dialer{Timeout: connTimeOut}
+		c.optionsMu.Unlock()
+		if c.options.CredentialsProviderCtx != nil || c.options.JWTProvider != nil {
+			setConnectCredentials(cm, username, password)
 		}
-		// Start by opening the network connection (tcp, tls, ws) etc.
-		if c.options.CustomOpenConnectionFn != nil {
-			conn, err = c.options.CustomOpenConnectionFn(broker, c.options)
+		c.logger.Debug("about to write new connect msg", slog.String("component", string(CLI)))
+	CONN:
+		var connDeadline time.Time // Time by which connection must be established
+		if raced != nil {
+			conn, connDeadline, err = raced.conn, raced.deadline, raced.err
+			raced = nil // falling back to MQTT 3.1 requires a new connection
 		} else {
-			conn, err = openConnection(broker, tlsCfg, connTimeOut, c.options.HTTPHeaders, c.options.WebsocketOptions, dialer)
+			conn, connDeadline, err = c.dialBroker(broker, attempt, deadline)
+		}
+		if errors.Is(err, ErrConnectDeadline) {
+			rc = packets.ErrNetworkError
+			break
 		}
 		if err != nil {
 			c.logger.Error("Failed to connect to broker", slog.String("error", err.Error()), slog.String("component", string(CLI)))
 
 			rc = packets.ErrNetworkError
-			if c.options.OnConnectionNotification != nil {
-				c.options.OnConnectionNotification(c, ConnectionNotificationBrokerFailed{broker, err})
-			}
+			c.recordAttempt(broker, isReconnect, rc, err)
+			c.notifyConnection(ConnectionNotificationBrokerFailed{broker, err}, false)
 			continue
 		}
 		c.logger.Debug("socket connected to broker", slog.String("component", string(CLI)))
+		c.stats.reset()
+		conn = &statsConn{Conn: conn, stats: &c.stats}
 
 		// Now we perform the MQTT connection handshake ensuring that it does not exceed the timeout
-		if err := conn.SetDeadline(connDeadline); err != nil {
+		if err := conn.SetDeadline(c.connackDeadline(connDeadline, deadline)); err != nil {
 			c.logger.Error("set deadline for handshake", slog.String("error", err.Error()), slog.String("component", string(CLI)))
 		}
 
 		// Now we perform the MQTT connection handshake
 		rc, sessionPresent, err = connectMQTT(conn, cm, protocolVersion, c.logger)
+		err = connackError(err)
+		if err == nil { // trace (and count) the handshake
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ReturnCode, ca.SessionPresent = rc, sessionPresent
+			c.tracePacket(PacketSent, cm)
+			c.tracePacket(PacketReceived, ca)
+		}
 		if rc == packets.Accepted {
 			if err := conn.SetDeadline(time.Time{}); err != nil {
 				c.logger.Error("reset deadline following handshake", slog.String("error", err.Error()), slog.String("component", string(CLI)))
 			}
+			c.connectedBroker.Store(broker)
+			c.recordAttempt(broker, isReconnect, rc, nil)
 			break // successfully connected
 		}
 
@@ -463,6 +882,11 @@ func (c *client) attemptConnection(isReconnect bool, attempt int) (net.Conn, byt
 			protocolVersion = 3
 			goto CONN
 		}
+		if rc != packets.ErrNetworkError {
+			c.recordAttempt(broker, isReconnect, rc, refusedError(rc))
+		} else {
+			c.recordAttempt(broker, isReconnect, rc, fmt.Errorf("%w : %w", packets.ConnErrors[rc], err))
+		}
 		if c.options.protocolVersionExplicit { // to maintain logging from previous version
 			c.logger.Error("CONNACK was not CONN_ACCEPTED, but rather",
 				slog.String("CONNACK", packets.ConnackReturnCodes[rc]),
@@ -475,20 +899,236 @@ func (c *client) attemptConnection(isReconnect bool, attempt int) (net.Conn, byt
 	if rc == packets.Accepted {
 		c.options.ProtocolVersion = protocolVersion
 		c.options.protocolVersionExplicit = true
+		if !sessionPresent {
+			c.subs.sessionLost()
+		}
 	} else {
 		// Maintain same error format as used previously
 		if rc != packets.ErrNetworkError { // mqtt error
-			err = packets.ConnErrors[rc]
+			err = refusedError(rc)
 		} else { // network error (if this occurred in ConnectMQTT then err will be nil)
 			err = fmt.Errorf("%w : %w", packets.ConnErrors[rc], err)
 		}
 	}
-	if err != nil && c.options.OnConnectionNotification != nil {
-		c.options.OnConnectionNotification(c, ConnectionNotificationFailed{err})
+	if err != nil {
+		c.notifyConnection(ConnectionNotificationFailed{err}, false)
 	}
 	return conn, rc, sessionPresent, err
 }
 
+// dialBroker opens the network connection (tcp, tls, ws etc.) to broker, returning it along with the time by which
+// the MQTT handshake must be complete. ErrConnectDeadline is returned, without dialing, if deadline has passed.
+func (c *client) dialBroker(broker *url.URL, attempt int, deadline time.Time) (net.Conn, time.Time, error) {
+	tlsCfg := c.tlsConfigFor(broker)
+	if c.options.OnConnectAttempt != nil {
+		c.logger.Debug("using custom onConnectAttempt handler", slog.String("component", string(CLI)))
+
+		tlsCfg = c.options.OnConnectAttempt(broker, tlsCfg)
+	}
+	c.notifyConnection(ConnectionNotificationBroker{broker}, false)
+	connTimeOut := c.options.ConnectTimeout
+	if connTimeOut == 0 { // SetConnectTimeout states "duration of 0 never times out." (default is 30s)
+		connTimeOut = maxDuration
+	}
+	if !deadline.IsZero() { // no attempt may extend beyond the overall deadline
+		remaining := deadline.Sub(c.clock.Now())
+		if remaining <= 0 {
+			return nil, time.Time{}, ErrConnectDeadline
+		}
+		connTimeOut = min(connTimeOut, remaining)
+	}
+	connDeadline := c.clock.Now().Add(connTimeOut)
+	conn, err := c.openNetConn(broker, tlsCfg, connTimeOut, attempt)
+	return conn, connDeadline, err
+}
+
+// recordAttempt adds the outcome of an attempt to connect to broker (nil if none was selected) to the history
+func (c *client) recordAttempt(broker *url.URL, isReconnect bool, rc byte, err error) {
+	if c.history == nil {
+		return
+	}
+	a := ConnectionAttempt{Time: c.clock.Now(), Reconnect: isReconnect, ReturnCode: rc, Err: err}
+	if broker != nil {
+		a.Broker = broker.Redacted()
+	}
+	c.history.add(a)
+}
+
+// fetchCredentials calls the context aware credentials provider. The context is cancelled once the connect timeout
+// expires; at this point an error is returned even if the provider has not returned.
+func (c *client) fetchCredentials(p CredentialsProviderContext) (string, string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c.options.ConnectTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.options.ConnectTimeout)
+		defer cancel()
+	}
+	type credentials struct {
+		username, password string
+		err                error
+	}
+	res := make(chan credentials, 1) // buffered so the goroutine can exit after a timeout
+	go func() {
+		var cr credentials
+		cr.username, cr.password, cr.err = p(ctx)
+		res <- cr
+	}()
+	select {
+	case cr := <-res:
+		return cr.username, cr.password, cr.err
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+}
+
+// tlsConfigFor returns the TLS configuration to use when connecting to broker (before OnConnectAttempt is called)
+func (c *client) tlsConfigFor(broker *url.URL) *tls.Config {
+	tlsCfg := c.options.TLSConfig
+	if cfg, ok := c.options.BrokerTLSConfigs[broker.Host]; ok {
+		tlsCfg = cfg
+	}
+	addCache := c.options.TLSSessionCache != nil && (tlsCfg == nil || tlsCfg.ClientSessionCache == nil)
+	alpn, ok := c.options.BrokerALPNProtocols[broker.Host]
+	if !ok && broker.Scheme != "ws" && broker.Scheme != "wss" {
+		alpn = c.options.ALPNProtocols
+	}
+	verify := c.options.VerifyPeerCertificate != nil || len(c.options.SPKIPins) > 0
+	provider := c.options.TLSCertificateProvider
+	if p := c.options.TLSClientSigner; p != nil {
+		provider = func() (*tls.Certificate, error) {
+			signer, chain, err := p()
+			if err != nil {
+				return nil, err
+			}
+			return TLSCertificateFromSigner(signer, chain...)
+		}
+	}
+	if !addCache && provider == nil && len(alpn) == 0 && !verify {
+		return tlsCfg
+	}
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	} else {
+		tlsCfg = tlsCfg.Clone()
+	}
+	if addCache {
+		tlsCfg.ClientSessionCache = c.options.TLSSessionCache
+	}
+	if len(alpn) > 0 {
+		tlsCfg.NextProtos = alpn
+	}
+	if verify {
+		tlsCfg.VerifyPeerCertificate = verifyPeerCertificate(tlsCfg.VerifyPeerCertificate, c.options.SPKIPins, c.options.VerifyPeerCertificate)
+	}
+	if provider != nil {
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return provider()
+		}
+	}
+	return tlsCfg
+}
+
+// openNetConn opens the network connection (tcp, tls, ws etc.) to the broker using the configured
+// dialer or CustomOpenConnectionFn and applies any rate limits and ConnWrapper. Does not carry out any MQTT specific handshakes.
+func (c *client) openNetConn(broker *url.URL, tlsCfg *tls.Config, connTimeOut time.Duration, attempt int) (net.Conn, error) {
+	conn, err := c.dialNetConn(broker, tlsCfg, connTimeOut, attempt)
+	if err != nil {
+		return nil, err
+	}
+	conn = newRateLimitedConn(conn, c.options.WriteRateLimit, c.options.ReadRateLimit, c.clock)
+	if c.options.ConnWrapper != nil {
+		conn = c.options.ConnWrapper(conn)
+	}
+	return conn, nil
+}
+
+// dialNetConn opens the network connection (using CustomOpenConnectionFn if set)
+func (c *client) dialNetConn(broker *url.URL, tlsCfg *tls.Config, connTimeOut time.Duration, attempt int) (net.Conn, error) {
+	if c.options.CustomOpenConnectionFn != nil {
+		c.optionsMu.Lock() // The options are copied and the will may be changed by UpdateWill
+		opts := c.options
+		c.optionsMu.Unlock()
+		return c.options.CustomOpenConnectionFn(broker, opts)
+	}
+	dialer := c.options.Dialer
+	if dialer == nil { //
+		c.logger.Info("dialer was nil, using default", slog.String("component", string(CLI)))
+		dialer = &net.Dialer{Timeout: connTimeOut}
+	}
+	wsURL := *broker
+	wsConnOpts := &WebsocketConnectionOptions{Header: c.options.HTTPHeaders.Clone(), Subprotocols: []string{"mqtt"}, URL: &wsURL}
+	if wsConnOpts.Header == nil {
+		wsConnOpts.Header = make(http.Header)
+	}
+	if c.options.OnWebsocketConnection != nil && (broker.Scheme == "ws" || broker.Scheme == "wss") {
+		c.options.OnWebsocketConnection(attempt, broker, wsConnOpts)
+	}
+	localAddrs, ok := c.options.BrokerLocalAddrs[broker.String()]
+	if !ok {
+		localAddrs = c.options.LocalAddrs
+	}
+	dialer, handshakeTimeout := c.phaseTimeouts(dialer, connTimeOut)
+	dialURL := broker
+	psk := c.pskFor(broker)
+	if psk != nil && c.options.TLSPSKConnector == nil {
+		return nil, ErrPSKConnectorRequired
+	}
+	if psk != nil || (handshakeTimeout > 0 && isTLSScheme(broker.Scheme)) { // the TLS handshake is performed separately over a tcp connection
+		u := *broker
+		u.Scheme = "tcp"
+		dialURL = &u
+	}
+	var conn net.Conn
+	var err error
+	if len(localAddrs) == 0 || broker.Scheme == "unix" || broker.Scheme == "ws" || broker.Scheme == "wss" {
+		conn, err = openConnection(dialURL, tlsCfg, connTimeOut, wsConnOpts, c.options.WebsocketOptions, dialer, c.options.ProxyURL, c.options.HappyEyeballsDelay)
+	} else {
+		conn, err = c.openConnectionFrom(localAddrs, dialURL, tlsCfg, connTimeOut, dialer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.options.TCPNoDelayDisabled || c.options.SocketReadBuffer > 0 || c.options.SocketWriteBuffer > 0 {
+		if err := applySocketOptions(conn, !c.options.TCPNoDelayDisabled, c.options.SocketReadBuffer, c.options.SocketWriteBuffer); err != nil {
+			c.logger.Warn("unable to apply socket options", slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		}
+	}
+	if psk != nil {
+		if handshakeTimeout == 0 {
+			handshakeTimeout = dialer.Timeout
+		}
+		return c.pskHandshake(conn, broker, tlsCfg, psk, handshakeTimeout)
+	}
+	if handshakeTimeout > 0 && isTLSScheme(broker.Scheme) {
+		return tlsHandshake(conn, broker, tlsCfg, handshakeTimeout)
+	}
+	return conn, nil
+}
+
+// openConnectionFrom opens a tcp or ssl connection to broker from the first of localAddrs from which a connection
+// can be established
+func (c *client) openConnectionFrom(localAddrs []string, broker *url.URL, tlsCfg *tls.Config, connTimeOut time.Duration, dialer *net.Dialer) (net.Conn, error) {
+	var errs []error
+	for _, addr := range localAddrs {
+		local, err := resolveLocalAddr(addr)
+		if err != nil {
+			c.logger.Warn("unable to resolve local address", slog.String("localAddr", addr), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+			errs = append(errs, err)
+			continue
+		}
+		d := *dialer
+		d.LocalAddr = local
+		conn, err := openConnection(broker, tlsCfg, connTimeOut, nil, nil, &d, c.options.ProxyURL, c.options.HappyEyeballsDelay)
+		if err == nil {
+			c.logger.Debug("connection established", slog.String("broker", broker.String()), slog.String("localAddr", local.String()), slog.String("component", string(CLI)))
+			return conn, nil
+		}
+		c.logger.Warn("unable to connect from local address", slog.String("localAddr", addr), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		errs = append(errs, fmt.Errorf("from %s: %w", addr, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
 // Disconnect will end the connection with the server, but not before waiting
 // the specified number of milliseconds to wait for existing work to be
 // completed.
@@ -513,7 +1153,7 @@ func (c *client) Disconnect(quiesce uint) {
 		c.logger.Debug("disconnecting", slog.String("component", string(CLI)))
 
 		dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
-		dt := newToken(packets.Disconnect)
+		dt := c.newToken(packets.Disconnect)
 		select {
 		case c.oboundP <- &PacketAndToken{p: dm, t: dt}:
 			// wait for work to finish or quiesce time consumed
@@ -537,6 +1177,96 @@ func (c *client) Disconnect(quiesce uint) {
 	}
 }
 
+// DisconnectContext will end the connection with the server, but not before waiting for all in-flight
+// QoS 1/2 PUBLISH flows to complete (i.e. be acknowledged by the broker) or ctx to be done.
+// Once this has been called new publishes will fail with ErrNotConnected. The DISCONNECT packet is sent
+// after the in-flight messages have been acknowledged (if ctx is done first the connection is closed
+// without waiting for the DISCONNECT to be written; the broker may then publish the will message).
+// Returns ctx.Err() if ctx was done before the disconnection process completed; messages not acknowledged
+// remain in the store (so will be resent when next connecting if CleanSession is false).
+// DisconnectContext can be safely called regardless of connection status.
+func (c *client) DisconnectContext(ctx context.Context) error {
+	// Disconnecting may need to wait for a connection attempt to complete; ctx must be honoured whilst doing so
+	type statusResult struct {
+		disDone disconnectCompletedFn
+		err     error
+	}
+	statusCh := make(chan statusResult, 1)
+	go func() {
+		disDone, err := c.status.Disconnecting()
+		statusCh <- statusResult{disDone: disDone, err: err}
+	}()
+	var disDone disconnectCompletedFn
+	var err error
+	select {
+	case r := <-statusCh:
+		disDone, err = r.disDone, r.err
+	case <-ctx.Done():
+		go func() { // Complete the disconnection once the status allows
+			if r := <-statusCh; r.err == nil {
+				c.disconnect()
+				r.disDone()
+			}
+		}()
+		return ctx.Err()
+	}
+	if err != nil {
+		// Status has been set to disconnecting, but we had to wait for something else to complete
+		c.logger.Info("DisconnectContext() called but waiting for something else to complete", slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		return nil
+	}
+	defer func() {
+		c.disconnect() // Force disconnection
+		disDone()      // Update status
+	}()
+
+	c.connMu.Lock()
+	connected, stop, lost := c.conn != nil, c.stop, c.lost
+	c.connMu.Unlock()
+	if !connected { // e.g. connection attempt aborted; nothing to drain and no connection to send DISCONNECT on
+		return nil
+	}
+	errConnLost := fmt.Errorf("%w before disconnection completed", ErrConnectionLost)
+
+	tokens := c.messageIds.publishTokens()
+	c.logger.Debug("disconnecting, waiting for in-flight messages", slog.Int("inFlight", len(tokens)), slog.String("component", string(CLI)))
+	for _, t := range tokens {
+		select {
+		case <-t.Done():
+		case <-stop:
+			return errConnLost
+		case <-lost:
+			return errConnLost
+		case <-ctx.Done():
+			c.logger.Warn("context done before in-flight messages acknowledged", slog.String("error", ctx.Err().Error()), slog.String("component", string(CLI)))
+			return ctx.Err()
+		}
+	}
+
+	dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	dt := c.newToken(packets.Disconnect)
+	select {
+	case c.oboundP <- &PacketAndToken{p: dm, t: dt}:
+		select {
+		case <-dt.Done():
+		case <-stop:
+			return errConnLost
+		case <-lost:
+			return errConnLost
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case <-stop:
+		return errConnLost
+	case <-lost:
+		return errConnLost
+	case <-ctx.Done():
+		c.logger.Info("Disconnect packet not sent due to context", slog.String("component", string(CLI)))
+		return ctx.Err()
+	}
+	return nil
+}
+
 // forceDisconnect will end the connection with the mqtt broker immediately (used for tests only)
 func (c *client) forceDisconnect() {
 	disDone, err := c.status.Disconnecting()
@@ -560,6 +1290,7 @@ func (c *client) disconnect() {
 		c.logger.Debug("disconnected", slog.String("component", string(CLI)))
 		c.persist.Close()
 	}
+	c.offlineDisconnected()
 }
 
 // internalConnLost cleanup when a connection is lost or an error occurs
@@ -575,12 +1306,19 @@ func (c *client) internalConnLost(whyConnLost error) {
 	reconnectExpected := c.options.AutoReconnect && c.status.ConnectionStatus() > connecting
 	disDone, err := c.status.ConnectionLost(reconnectExpected)
 	if err != nil {
-		if err == errConnLossWhileDisconnecting || err == errAlreadyHandlingConnectionLoss {
+		if err == errDisconnectionInProgress || err == errConnLossWhileDisconnecting {
+			c.connLostWhileDisconnecting() // the disconnecter (e.g. DisconnectContext) is responsible for cleanup
+			return
+		}
+		if err == errAlreadyHandlingConnectionLoss {
 			return // Loss of connection is expected or already being handled
 		}
 		c.logger.Error("internalConnLost unexpected status", slog.String("error", err.Error()), slog.String("component", string(CLI)))
 		return
 	}
+	if reason := c.cycleReason.Swap(nil); reason != nil { // the connection was closed by reauthenticate
+		whyConnLost = *reason
+	}
 
 	// c.stopCommsWorker returns a channel that is closed when the operation completes. This was required prior
 	// to the implementation of proper status management but has been left in place, for now, to minimise change
@@ -605,9 +1343,9 @@ func (c *client) internalConnLost(whyConnLost error) {
 
 		reConnDone, err := disDone(true)
 		if err != nil {
-			c.logger.Error("failure whilst reporting completion of disconnect", slog.Any("error", err), slog.String("component", string(CLI)))
+			c.logger.Error("failure whilst reporting completion of disconnect", slog.String("error", err.Error()), slog.String("component", string(CLI)))
 		} else if reConnDone == nil && reconnectExpected { // Should never happen (reconnect was expected but no reconnect function was returned)
-			c.logger.Error("BUG BUG BUG reconnection function is nil", slog.Any("error", err), slog.String("component", string(CLI)))
+			c.logger.Error("BUG BUG BUG reconnection function is nil", slog.String("component", string(CLI)))
 		}
 
 		reconnect := err == nil && reConnDone != nil
@@ -623,9 +1361,10 @@ func (c *client) internalConnLost(whyConnLost error) {
 		if c.options.OnConnectionLost != nil {
 			go c.options.OnConnectionLost(c, whyConnLost)
 		}
-		if c.options.OnConnectionNotification != nil {
-			go c.options.OnConnectionNotification(c, ConnectionNotificationLost{whyConnLost})
+		if c.options.OnConnectionLostStats != nil {
+			go c.options.OnConnectionLostStats(c, whyConnLost, c.connectionStats(whyConnLost))
 		}
+		c.notifyConnection(ConnectionNotificationLost{whyConnLost}, true)
 		c.logger.Debug("internalConnLost complete", slog.String("component", string(CLI)))
 	}()
 }
@@ -647,12 +1386,28 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 		return false
 	}
 	c.conn = conn // Store the connection
+	c.stats.connectedAt.Store(c.clock.Now())
 
 	c.stop = make(chan struct{})
-	if c.options.KeepAlive != 0 {
+	c.lost = make(chan struct{})
+	if broker := c.connectedBroker.Load(); broker != nil && c.options.FailbackInterval > 0 && c.options.AutoReconnect {
+		c.optionsMu.Lock()
+		preferred := preferredBrokers(c.options.Servers, c.options.ServerPriority, broker)
+		c.optionsMu.Unlock()
+		if len(preferred) > 0 {
+			c.workers.Add(1)
+			go failback(c, preferred)
+		}
+	}
+	if renewAt := c.credentialsRenewal(); !renewAt.IsZero() && c.options.AutoReconnect {
+		c.workers.Add(1)
+		go renewCredentials(c, renewAt)
+	}
+	if c.keepAliveInterval() > 0 {
 		atomic.StoreInt32(&c.pingOutstanding, 0)
-		c.lastReceived.Store(time.Now())
-		c.lastSent.Store(time.Now())
+		now := c.clock.Now()
+		c.lastReceived.Store(now)
+		c.lastSent.Store(now)
 		c.workers.Add(1)
 		go keepalive(c, conn)
 	}
@@ -661,7 +1416,7 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 	// It will complete when incomingPubChan is closed and will close ackOut before exiting
 	incomingPubChan := make(chan *packets.PublishPacket)
 	c.workers.Add(1) // Done will be called when ackOut is closed
-	ackOut := c.msgRouter.matchAndDispatch(incomingPubChan, c.options.Order, c)
+	ackOut := c.msgRouter.matchAndDispatch(incomingPubChan, c.options.Order && !c.options.OrderedPerTopic, c)
 
 	// The connection is now ready for use (we spin up a few go routines below).
 	// It is possible that Disconnect has been called in the interim...
@@ -675,9 +1430,7 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 	if c.options.OnConnect != nil {
 		go c.options.OnConnect(c)
 	}
-	if c.options.OnConnectionNotification != nil {
-		go c.options.OnConnectionNotification(c, ConnectionNotificationConnected{})
-	}
+	c.notifyConnection(ConnectionNotificationConnected{}, true)
 
 	// c.oboundP and c.obound need to stay active for the life of the client because, depending upon the options,
 	// messages may be published while the client is disconnected (they will block unless in a goroutine). However,
@@ -765,6 +1518,29 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 	return true
 }
 
+// stopChan returns the channel that will be closed when the current connection is lost or the client disconnects
+// (nil if there has not been a connection)
+func (c *client) stopChan() <-chan struct{} {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.stop
+}
+
+// connLostWhileDisconnecting lets a disconnection that is in progress (e.g. DisconnectContext waiting for
+// in-flight messages) know that the connection has gone, so it does not wait for acknowledgements that cannot arrive
+func (c *client) connLostWhileDisconnecting() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.lost == nil {
+		return
+	}
+	select {
+	case <-c.lost: // already closed
+	default:
+		close(c.lost)
+	}
+}
+
 // stopWorkersAndComms - Cleanly shuts down worker go routines (including the comms routines) and waits until everything has stopped
 // Returns nil if workers did not need to be stopped; otherwise returns a channel which will be closed when the stop is complete
 // Note: This may block so run as a go routine if calling from any of the comms routines
@@ -808,46 +1584,42 @@ func (c *client) stopCommsWorkers() chan struct{} {
 }
 
 // Publish will publish a message with the specified QoS and content
-// to the specified topic.
+// to the specified topic. The payload may be a string, []byte, bytes.Buffer, PooledPayload or an
+// io.Reader (which will be read in full before Publish returns).
 // Returns a token to track delivery of the message to the broker
 func (c *client) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
-	token := newToken(packets.Publish).(*PublishToken)
+	return c.PublishWithOptions(topic, qos, retained, payload, PublishOptions{})
+}
+
+// PublishOptions holds optional settings for PublishWithOptions
+type PublishOptions struct {
+	// Expiry is the time after which a message buffered whilst offline (see ClientOptions.SetOfflineBuffer)
+	// will be discarded rather than sent. It is measured from the call to PublishWithOptions and retained in
+	// the store. 0 means the message does not expire. Messages that are not buffered are unaffected.
+	Expiry time.Duration
+}
+
+// PublishWithOptions will publish a message, as per Publish, with the additional options provided.
+func (c *client) PublishWithOptions(topic string, qos byte, retained bool, payload interface{}, opts PublishOptions) Token {
+	token := c.newToken(packets.Publish).(*PublishToken)
 	c.logger.Debug("enter Publish", slog.String("component", string(CLI)))
-	switch {
-	case !c.IsConnected():
-		token.setError(ErrNotConnected)
-		return token
-	case c.status.ConnectionStatus() == reconnecting && qos == 0:
-		// message written to store and will be sent when connection comes up
-		token.flowComplete()
+	if err := validatePublish(topic, qos); err != nil {
+		token.setError(err)
 		return token
 	}
-	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-	pub.Qos = qos
-	pub.TopicName = topic
-	pub.Retain = retained
-	switch p := payload.(type) {
-	case string:
-		pub.Payload = []byte(p)
-	case []byte:
-		pub.Payload = p
-	case bytes.Buffer:
-		pub.Payload = p.Bytes()
-	default:
-		token.setError(fmt.Errorf("unknown payload type"))
+	if c.bufferOffline(topic, qos, retained, payload, opts.Expiry, token) {
 		return token
 	}
-
-	if pub.Qos != 0 && pub.MessageID == 0 {
-		mID := c.getID(token)
-		if mID == 0 {
-			token.setError(fmt.Errorf("no message IDs available"))
+	if qos != 0 && c.IsConnected() { // checked so that an error is returned, rather than blocking, if not connected
+		if err := c.inflight.acquire(c.stopChan(), token); err != nil {
+			token.setError(err)
 			return token
 		}
-		pub.MessageID = mID
-		token.messageID = mID
 	}
-	persistOutbound(c.persist, pub, c.logger)
+	pub := c.preparePublish(topic, qos, retained, payload, token)
+	if pub == nil {
+		return token
+	}
 	switch c.status.ConnectionStatus() {
 	case connecting:
 		c.logger.Debug("storing publish message (connecting)", slog.String("topic", topic), slog.String("component", string(CLI)))
@@ -857,21 +1629,226 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 		c.logger.Debug("storing publish message (disconnecting)", slog.String("topic", topic), slog.String("component", string(CLI)))
 	default:
 		c.logger.Debug("sending publish message", slog.String("topic", topic), slog.String("component", string(CLI)))
-		publishWaitTimeout := c.options.WriteTimeout
-		if publishWaitTimeout == 0 {
-			publishWaitTimeout = time.Second * 30
+		c.sendPublish(&PacketAndToken{p: pub, t: token})
+	}
+	return token
+}
+
+// PublishBatch publishes multiple messages, writing them to the network using a single Write call (i.e.
+// one syscall rather than one per message). This can significantly improve throughput when sending
+// many small messages. The returned token completes when the flows for all messages have completed;
+// use Tokens() to check the outcome of individual messages. If the connection is not currently up
+// (e.g. reconnecting) then the messages are handled as they would be by Publish.
+func (c *client) PublishBatch(requests []PublishRequest) Token {
+	c.logger.Debug("enter PublishBatch", slog.Int("messages", len(requests)), slog.String("component", string(CLI)))
+	batch := make([]*PacketAndToken, 0, len(requests))
+	tokens := make([]*PublishToken, len(requests))
+	for i, r := range requests {
+		tokens[i] = c.newToken(packets.Publish).(*PublishToken)
+		if err := validatePublish(r.Topic, r.Qos); err != nil {
+			tokens[i].setError(err)
+			continue
+		}
+		if c.bufferOffline(r.Topic, r.Qos, r.Retained, r.Payload, r.Expiry, tokens[i]) {
+			continue
+		}
+		if r.Qos != 0 && c.IsConnected() && !c.inflight.tryAcquire(tokens[i]) {
+			// The window is full; send what we have so far (otherwise those messages could never be acknowledged)
+			if len(batch) > 0 && c.status.ConnectionStatus() == connected {
+				c.sendPublish(&PacketAndToken{batch: batch})
+				batch = make([]*PacketAndToken, 0, len(requests)-i)
+			}
+			if err := c.inflight.acquire(c.stopChan(), tokens[i]); err != nil {
+				tokens[i].setError(err)
+				continue
+			}
+		}
+		if pub := c.preparePublish(r.Topic, r.Qos, r.Retained, r.Payload, tokens[i]); pub != nil {
+			batch = append(batch, &PacketAndToken{p: pub, t: tokens[i]})
+		}
+	}
+	if len(batch) > 0 && c.status.ConnectionStatus() == connected {
+		c.sendPublish(&PacketAndToken{batch: batch})
+	}
+	return newBatchToken(tokens)
+}
+
+// PublishAsync is as per Publish but returns a channel that receives a DeliveryReceipt when the flow
+// completes. This allows messages to be pipelined with confirmations handled separately, without
+// a goroutine per message. The channel has a buffer of one so it is not necessary to read from it.
+func (c *client) PublishAsync(topic string, qos byte, retained bool, payload interface{}) <-chan DeliveryReceipt {
+	ch := make(chan DeliveryReceipt, 1)
+	token := c.Publish(topic, qos, retained, payload)
+	OnComplete(token, func(err error) {
+		r := DeliveryReceipt{Completed: c.clock.Now(), Err: err}
+		if pt, ok := token.(*PublishToken); ok {
+			r.MessageID = pt.MessageID()
 		}
+		ch <- r
+	})
+	return ch
+}
 
-		t := time.NewTimer(publishWaitTimeout)
-		defer t.Stop()
+// preparePublish creates the PUBLISH packet, allocates a message ID and persists the message (if needed).
+// Returns nil if the token has been completed (e.g. due to an error) and there is nothing to send.
+func (c *client) preparePublish(topic string, qos byte, retained bool, payload interface{}, token *PublishToken) *packets.PublishPacket {
+	if !c.canPublish(qos, token) {
+		return nil
+	}
+	topic, data, release, err := c.outboundPayload(topic, payload)
+	if err != nil {
+		token.setError(err)
+		return nil
+	}
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = qos
+	pub.TopicName = topic
+	pub.Retain = retained
+	pub.Payload, token.release = data, release
+	return c.storePublish(pub, token)
+}
 
-		select {
-		case c.obound <- &PacketAndToken{p: pub, t: token}:
-		case <-t.C:
-			token.setError(errors.New("publish was broken by timeout"))
+// forwardPublish is as per preparePublish but for a message buffered whilst offline; the buffered payload has
+// already been through outboundPayload so is sent as-is (MaxOutboundPayload is checked again as it may have been
+// reduced since the message was buffered).
+func (c *client) forwardPublish(stored *packets.PublishPacket, token *PublishToken) *packets.PublishPacket {
+	if !c.canPublish(stored.Qos, token) {
+		return nil
+	}
+	if maxSize := c.options.MaxOutboundPayload; maxSize > 0 && len(stored.Payload) > maxSize {
+		token.setError(&packets.PayloadTooLargeError{Size: len(stored.Payload), Limit: maxSize})
+		return nil
+	}
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = stored.Qos
+	pub.TopicName = stored.TopicName
+	pub.Retain = stored.Retain
+	pub.Payload = stored.Payload
+	return c.storePublish(pub, token)
+}
+
+// canPublish returns true if a message with the given QoS can be sent now; otherwise token is completed
+func (c *client) canPublish(qos byte, token *PublishToken) bool {
+	switch {
+	case !c.IsConnected():
+		token.setError(ErrNotConnected)
+		return false
+	case c.status.ConnectionStatus() == reconnecting && qos == 0:
+		// message written to store and will be sent when connection comes up
+		token.flowComplete()
+		return false
+	}
+	return true
+}
+
+// storePublish allocates a message ID for pub (if needed) and persists it. Returns nil if the token has been
+// completed due to an error.
+func (c *client) storePublish(pub *packets.PublishPacket, token *PublishToken) *packets.PublishPacket {
+	if pub.Qos != 0 && pub.MessageID == 0 {
+		mID := c.getIDWait(token, c.options.MessageIDWaitTimeout)
+		if mID == 0 {
+			token.setError(ErrMessageIDsExhausted)
+			return nil
 		}
+		pub.MessageID = mID
+		token.messageID = mID
+	}
+	persistOutbound(c.persist, pub, c.logger)
+	return pub
+}
+
+// publishPayload returns the bytes to be sent for payload (one of the types accepted by Publish) along
+// with the function to be called once they are no longer required (only set for PooledPayload). If maxSize
+// is > 0 and the payload is larger than this a *packets.PayloadTooLargeError is returned.
+func publishPayload(payload interface{}, maxSize int) ([]byte, func(), error) {
+	var data []byte
+	var release func()
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	case bytes.Buffer:
+		data = p.Bytes()
+	case PooledPayload:
+		data, release = p.Data, p.Release
+	case io.Reader:
+		var err error
+		if maxSize > 0 { // Avoid reading more than is needed to determine that the payload is too large
+			p = io.LimitReader(p, int64(maxSize)+1)
+		}
+		if data, err = io.ReadAll(p); err != nil {
+			return nil, nil, fmt.Errorf("reading payload: %w", err)
+		}
+	default:
+		return nil, nil, ErrUnsupportedPayload
+	}
+	if maxSize > 0 && len(data) > maxSize {
+		if release != nil {
+			release()
+		}
+		return nil, nil, &packets.PayloadTooLargeError{Size: len(data), Limit: maxSize}
+	}
+	return data, release, nil
+}
+
+// outboundPayload returns the topic and bytes to be sent for payload (see publishPayload), once passed through the
+// PublishInterceptors and then compressed if compression applies to the topic, they are at least
+// CompressionMinSize bytes long and compression makes them smaller. MaxOutboundPayload applies to the result.
+func (c *client) outboundPayload(topic string, payload interface{}) (string, []byte, func(), error) {
+	if len(c.options.PublishInterceptors) == 0 && c.compressionFor(topic) == nil {
+		data, release, err := publishPayload(payload, c.options.MaxOutboundPayload)
+		return topic, data, release, err
+	}
+	data, release, err := publishPayload(payload, 0)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	// release is retained (rather than called once the data is transformed) as the result may share its memory
+	if topic, data, err = c.interceptPublish(topic, data); err != nil {
+		if release != nil {
+			release()
+		}
+		return "", nil, nil, err
+	}
+	if codec := c.compressionFor(topic); codec != nil && len(data) >= c.options.CompressionMinSize {
+		compressed, err := codec.Compress(data)
+		if err != nil {
+			if release != nil {
+				release()
+			}
+			return "", nil, nil, fmt.Errorf("compressing payload: %w", err)
+		}
+		if len(compressionHeader)+1+len(compressed) < len(data) {
+			out := make([]byte, 0, len(compressionHeader)+1+len(compressed))
+			out = append(append(out, compressionHeader...), codec.ID())
+			data = append(out, compressed...)
+		}
+	}
+	if maxSize := c.options.MaxOutboundPayload; maxSize > 0 && len(data) > maxSize {
+		if release != nil {
+			release()
+		}
+		return "", nil, nil, &packets.PayloadTooLargeError{Size: len(data), Limit: maxSize}
+	}
+	return topic, data, release, nil
+}
+
+// sendPublish passes pt to the outgoing comms (setting an error on the token(s) if this times out)
+func (c *client) sendPublish(pt *PacketAndToken) {
+	publishWaitTimeout := c.options.WriteTimeout
+	if publishWaitTimeout == 0 {
+		publishWaitTimeout = time.Second * 30
+	}
+
+	t := time.NewTimer(publishWaitTimeout)
+	defer t.Stop()
+
+	select {
+	case c.obound <- pt:
+	case <-t.C:
+		pt.setError(fmt.Errorf("publish was broken by %w", ErrTimeout))
 	}
-	return token
 }
 
 // Subscribe starts a new subscription. Provide a MessageHandler to be executed when
@@ -882,7 +1859,24 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 // a new go routine.
 // Callback must be safe for concurrent use by multiple goroutines.
 func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Token {
-	token := newToken(packets.Subscribe).(*SubscribeToken)
+	return c.SubscribeWithOptions(topic, qos, callback, RouteOptions{})
+}
+
+// SubscribeLatest starts a new subscription where, if multiple messages for the same topic arrive
+// before callback is called, only the latest is passed to it (earlier messages are acknowledged
+// and discarded). This is equivalent to SubscribeWithOptions with RouteOptions{LatestOnly: true}.
+func (c *client) SubscribeLatest(topic string, qos byte, callback MessageHandler) Token {
+	return c.SubscribeWithOptions(topic, qos, callback, RouteOptions{LatestOnly: true})
+}
+
+// SubscribeWithOptions will subscribe, as per Subscribe, with messages passed to callback as per opts.
+func (c *client) SubscribeWithOptions(topic string, qos byte, callback MessageHandler, opts RouteOptions) Token {
+	return c.subscribe(topic, qos, callback, opts, "")
+}
+
+// subscribe implements SubscribeWithOptions; handlerName is the name passed to SubscribeNamed (empty otherwise)
+func (c *client) subscribe(topic string, qos byte, callback MessageHandler, opts RouteOptions, handlerName string) Token {
+	token := c.newToken(packets.Subscribe).(*SubscribeToken)
 	c.logger.Debug("enter Subscribe", slog.String("component", string(CLI)))
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
@@ -892,11 +1886,11 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		switch {
 		case !c.options.ResumeSubs:
 			// if not connected and resumeSubs not set, this sub will be thrown away
-			token.setError(fmt.Errorf("not currently connected and ResumeSubs not set"))
+			token.setError(fmt.Errorf("%w (currently connecting and ResumeSubs not set)", ErrNotConnected))
 			return token
 		case c.options.CleanSession && c.status.ConnectionStatus() == reconnecting:
 			// if reconnecting and cleanSession is true, this sub will be thrown away
-			token.setError(fmt.Errorf("reconnecting state and cleansession is true"))
+			token.setError(fmt.Errorf("%w (reconnecting and cleansession is true)", ErrNotConnected))
 			return token
 		}
 	}
@@ -907,23 +1901,19 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 	}
 	sub.Topics = append(sub.Topics, topic)
 	sub.Qoss = append(sub.Qoss, qos)
+	revert := c.subs.requested(topic, qos, handlerName)
 
-	if strings.HasPrefix(topic, "$share/") {
-		topic = strings.Join(strings.Split(topic, "/")[2:], "/")
-	}
-
-	topic = strings.TrimPrefix(topic, "$queue/")
-
-	if callback != nil {
-		c.msgRouter.addRoute(topic, callback)
+	if callback != nil { // The router handles shared subscriptions ($share/<group>/<filter> and $queue/<filter>)
+		c.msgRouter.addRouteWithOptions(topic, callback, opts)
 	}
 
 	token.subs = append(token.subs, topic)
 
 	if sub.MessageID == 0 {
-		mID := c.getID(token)
+		mID := c.getIDWait(token, c.options.MessageIDWaitTimeout)
 		if mID == 0 {
-			token.setError(fmt.Errorf("no message IDs available"))
+			revert()
+			token.setError(ErrMessageIDsExhausted)
 			return token
 		}
 		sub.MessageID = mID
@@ -950,13 +1940,43 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		select {
 		case c.oboundP <- &PacketAndToken{p: sub, t: token}:
 		case <-time.After(subscribeWaitTimeout):
-			token.setError(errors.New("subscribe was broken by timeout"))
+			revert()
+			token.setError(fmt.Errorf("subscribe was broken by %w", ErrTimeout))
 		}
 	}
 	c.logger.Debug("exit Subscribe", slog.String("component", string(CLI)))
 	return token
 }
 
+// SubscribeShared starts a new shared subscription ($share/<group>/<topic>). The broker will distribute
+// messages matching topic between all clients subscribed with the same group (note that support for shared
+// subscriptions with MQTT v3.1.1 is broker specific). Messages passed to callback implement
+// SharedSubscriptionMessage. Note that, as the broker does not indicate which subscription a message was
+// delivered due to, the callback will be called for messages that match topic even if they were received
+// due to another subscription.
+func (c *client) SubscribeShared(group string, topic string, qos byte, callback MessageHandler) Token {
+	if !validShareGroup(group) {
+		token := c.newToken(packets.Subscribe).(*SubscribeToken)
+		token.setError(ErrInvalidSharedSubscription)
+		return token
+	}
+	return c.Subscribe(sharePrefix+group+"/"+topic, qos, callback)
+}
+
+// SubscribeNamed starts a new subscription to topic with messages passed to the handler registered
+// (via ClientOptions.SetNamedHandler) as handlerName. When CleanSession is false the subscription is
+// recorded in the Store once the broker grants it, allowing the route to be restored when the client
+// is next started (before any messages from the persistent session are received).
+func (c *client) SubscribeNamed(topic string, qos byte, handlerName string) Token {
+	handler, ok := c.options.NamedHandlers[handlerName]
+	if !ok {
+		token := c.newToken(packets.Subscribe).(*SubscribeToken)
+		token.setError(ErrUnknownHandler)
+		return token
+	}
+	return c.subscribe(topic, qos, handler, RouteOptions{}, handlerName)
+}
+
 // SubscribeMultiple starts a new subscription for multiple topics. Provide a MessageHandler to
 // be executed when a message is published on one of the topics provided.
 //
@@ -966,7 +1986,7 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 // Callback must be safe for concurrent use by multiple goroutines.
 func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHandler) Token {
 	var err error
-	token := newToken(packets.Subscribe).(*SubscribeToken)
+	token := c.newToken(packets.Subscribe).(*SubscribeToken)
 	c.logger.Debug("enter SubscribeMultiple", slog.String("component", string(CLI)))
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
@@ -976,11 +1996,11 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 		switch {
 		case !c.options.ResumeSubs:
 			// if not connected and resumesubs not set, this sub will be thrown away
-			token.setError(fmt.Errorf("not currently connected and ResumeSubs not set"))
+			token.setError(fmt.Errorf("%w (currently connecting and ResumeSubs not set)", ErrNotConnected))
 			return token
 		case c.options.CleanSession && c.status.ConnectionStatus() == reconnecting:
 			// if reconnecting and cleanSession is true, this sub will be thrown away
-			token.setError(fmt.Errorf("reconnecting state and cleansession is true"))
+			token.setError(fmt.Errorf("%w (reconnecting and cleansession is true)", ErrNotConnected))
 			return token
 		}
 	}
@@ -989,6 +2009,15 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 		token.setError(err)
 		return token
 	}
+	reverts := make([]func(), len(sub.Topics))
+	for i, topic := range sub.Topics {
+		reverts[i] = c.subs.requested(topic, sub.Qoss[i], "")
+	}
+	revert := func() {
+		for _, r := range reverts {
+			r()
+		}
+	}
 
 	if callback != nil {
 		for topic := range filters {
@@ -999,9 +2028,10 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 	copy(token.subs, sub.Topics)
 
 	if sub.MessageID == 0 {
-		mID := c.getID(token)
+		mID := c.getIDWait(token, c.options.MessageIDWaitTimeout)
 		if mID == 0 {
-			token.setError(fmt.Errorf("no message IDs available"))
+			revert()
+			token.setError(ErrMessageIDsExhausted)
 			return token
 		}
 		sub.MessageID = mID
@@ -1026,13 +2056,59 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 		select {
 		case c.oboundP <- &PacketAndToken{p: sub, t: token}:
 		case <-time.After(subscribeWaitTimeout):
-			token.setError(errors.New("subscribe was broken by timeout"))
+			revert()
+			token.setError(fmt.Errorf("subscribe was broken by %w", ErrTimeout))
 		}
 	}
 	c.logger.Debug("exit SubscribeMultiple", slog.String("component", string(CLI)))
 	return token
 }
 
+// forgetSubscriptions removes subscriptions made with SubscribeNamed to topics from the store. If the client
+// is not connected (so the store is closed) they are removed when the client next connects.
+func (c *client) forgetSubscriptions(topics []string) {
+	if c.options.CleanSession {
+		return
+	}
+	if !c.IsConnected() {
+		c.subs.unsubscribedOffline(topics...)
+		return
+	}
+	for _, topic := range topics {
+		if key := subscriptionKey(topic); c.persist.Get(key) != nil {
+			c.persist.Del(key)
+		}
+	}
+}
+
+// restoreSubscriptions adds routes for subscriptions made with SubscribeNamed that are held in the store
+// (other than those unsubscribed whilst the client was not connected, which are removed)
+func (c *client) restoreSubscriptions() {
+	forgotten := c.subs.takeUnsubscribedOffline()
+	for _, key := range c.persist.All() {
+		if !isKeySubscription(key) {
+			continue
+		}
+		if _, ok := forgotten[key]; ok {
+			c.persist.Del(key)
+			continue
+		}
+		topic, _, name, ok := subscriptionFromPacket(c.persist.Get(key))
+		if !ok {
+			c.logger.Error("invalid subscription in store (discarded)", slog.String("key", key), slog.String("component", string(STR)))
+			c.persist.Del(key)
+			continue
+		}
+		handler, ok := c.options.NamedHandlers[name]
+		if !ok {
+			c.logger.Warn("no handler registered for stored subscription", slog.String("topic", topic), slog.String("handler", name), slog.String("component", string(STR)))
+			continue
+		}
+		c.logger.Debug("restored subscription", slog.String("topic", topic), slog.String("handler", name), slog.String("component", string(STR)))
+		c.msgRouter.addRoute(topic, handler)
+	}
+}
+
 // reserveStoredPublishIDs reserves the ids for publish packets in the persistent store to ensure these are not duplicated
 func (c *client) reserveStoredPublishIDs() {
 	// The resume function sets the stored id for publish packets only (some other packets
@@ -1041,6 +2117,9 @@ func (c *client) reserveStoredPublishIDs() {
 	if !c.options.CleanSession {
 		storedKeys := c.persist.All()
 		for _, key := range storedKeys {
+			if isKeySubscription(key) || isKeyForward(key) {
+				continue
+			}
 			packet := c.persist.Get(key)
 			if packet == nil {
 				continue
@@ -1095,53 +2174,91 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 	}
 
 	storedKeys := c.persist.All()
+	outbound := 0
+	for _, key := range storedKeys {
+		if isKeyOutbound(key) {
+			outbound++
+		}
+	}
+	pacer := newResumePacer(c.options.ResumeRate, c.options.ResumeBatchSize, outbound, c.clock, func(n ConnectionNotificationResume) {
+		c.notifyConnection(n, false)
+	})
 	for _, key := range storedKeys {
+		if isKeySubscription(key) || isKeyForward(key) { // Routes were restored by Connect; forwardOffline sends buffered messages
+			continue
+		}
 		packet := c.persist.Get(key)
 		if packet == nil {
 			c.logger.Debug(fmt.Sprintf("resume found NIL packet (%s)", key), slog.String("component", string(STR)))
+			if isKeyOutbound(key) {
+				pacer.skip()
+			}
 			continue
 		}
 		details := packet.Details()
 		if isKeyOutbound(key) {
+			if _, isPubrel := packet.(*packets.PubrelPacket); !isPubrel && c.options.ResumeFilter != nil && !c.options.ResumeFilter(key, packet) {
+				c.logger.Debug(fmt.Sprintf("resume filter discarded stored packet (%s)", key), slog.String("component", string(STR)))
+				c.persist.Del(key)
+				pacer.skip()
+				continue
+			}
 			switch p := packet.(type) {
 			case *packets.SubscribePacket:
 				if subscription {
 					c.logger.Debug(fmt.Sprintf("loaded pending subscribe (%d)", details.MessageID), slog.String("component", string(STR)))
 					subPacket := packet.(*packets.SubscribePacket)
-					token := newToken(packets.Subscribe).(*SubscribeToken)
+					token := c.newToken(packets.Subscribe).(*SubscribeToken)
 					token.messageID = details.MessageID
 					token.subs = append(token.subs, subPacket.Topics...)
 					c.claimID(token, details.MessageID)
+					if !pacer.wait(c.stop) {
+						c.logger.Debug("resume exiting due to stop", slog.String("component", string(STR)))
+						return
+					}
 					select {
 					case c.oboundP <- &PacketAndToken{p: packet, t: token}:
 					case <-c.stop:
 						c.logger.Debug("resume exiting due to stop", slog.String("component", string(STR)))
 						return
 					}
+					pacer.done()
 				} else {
 					c.persist.Del(key) // Unsubscribe packets should not be retained following a reconnection
+					pacer.skip()
 				}
 			case *packets.UnsubscribePacket:
 				if subscription {
 					c.logger.Debug(fmt.Sprintf("loaded pending unsubscribe (%d)", details.MessageID), slog.String("component", string(STR)))
-					token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
+					token := c.newToken(packets.Unsubscribe).(*UnsubscribeToken)
+					if !pacer.wait(c.stop) {
+						c.logger.Debug("resume exiting due to stop", slog.String("component", string(STR)))
+						return
+					}
 					select {
 					case c.oboundP <- &PacketAndToken{p: packet, t: token}:
 					case <-c.stop:
 						c.logger.Debug("resume exiting due to stop", slog.String("component", string(STR)))
 						return
 					}
+					pacer.done()
 				} else {
 					c.persist.Del(key) // Unsubscribe packets should not be retained following a reconnection
+					pacer.skip()
 				}
 			case *packets.PubrelPacket:
 				c.logger.Debug(fmt.Sprintf("loaded pending pubrel (%d)", details.MessageID), slog.String("component", string(STR)))
+				if !pacer.wait(c.stop) {
+					c.logger.Debug("resume exiting due to stop", slog.String("component", string(STR)))
+					return
+				}
 				select {
 				case c.oboundP <- &PacketAndToken{p: packet, t: nil}:
 				case <-c.stop:
 					c.logger.Debug("resume exiting due to stop", slog.String("component", string(STR)))
 					return
 				}
+				pacer.done()
 			case *packets.PublishPacket:
 				// spec: If the DUP flag is set to 0, it indicates that this is the first occasion that the Client or
 				// Server has attempted to send this MQTT PUBLISH Packet. If the DUP flag is set to 1, it indicates that
@@ -1152,11 +2269,15 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 				if p.Qos != 0 { // spec: The DUP flag MUST be set to 0 for all QoS 0 messages
 					p.Dup = true
 				}
-				token := newToken(packets.Publish).(*PublishToken)
+				token := c.newToken(packets.Publish).(*PublishToken)
 				token.messageID = details.MessageID
 				c.claimID(token, details.MessageID)
 				c.logger.Debug(fmt.Sprintf("loaded pending publish (%d)", details.MessageID), slog.String("component", string(STR)))
 				c.logger.Debug("details", slog.String("messageID", fmt.Sprintf("%d", details.MessageID)), slog.Int("QoS", int(details.Qos)), slog.String("component", string(STR)))
+				if !pacer.wait(c.stop) {
+					c.logger.Debug("resume exiting due to stop", slog.String("component", string(STR)))
+					return
+				}
 				getSemaphore()
 				select {
 				case c.obound <- &PacketAndToken{p: p, t: token}:
@@ -1165,15 +2286,21 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 					return
 				}
 				releaseSemaphore(token) // If limiting simultaneous messages, then we need to know when message is acknowledged
+				pacer.done()
 			default:
 				c.logger.Error("invalid message type in store (discarded)",
 					slog.String("type", fmt.Sprintf("%T", packet)),
 					slog.String("component", string(STR)),
 				)
 				c.persist.Del(key)
+				pacer.skip()
 			}
 		} else {
 			switch packet.(type) {
+			case *packets.PubrecPacket:
+				// A QoS 2 message that has been handled; retained so that, if the broker redelivers it, it will not
+				// be passed to the handler again (removed when the PUBREL is received)
+				c.logger.Debug("loaded acknowledged incoming", slog.String("messageID", fmt.Sprintf("%d", details.MessageID)), slog.String("component", string(STR)))
 			case *packets.PubrelPacket:
 				c.logger.Debug("loaded pending incoming", slog.String("messageID", fmt.Sprintf("%d", details.MessageID)), slog.String("component", string(STR)))
 				select {
@@ -1191,6 +2318,7 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 			}
 		}
 	}
+	pacer.finish()
 	c.logger.Debug("exit resume", slog.String("component", string(STR)))
 }
 
@@ -1198,8 +2326,9 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 // Messages published to those topics from other clients will no longer be
 // received.
 func (c *client) Unsubscribe(topics ...string) Token {
-	token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
+	token := c.newToken(packets.Unsubscribe).(*UnsubscribeToken)
 	c.logger.Debug("enter Unsubscribe", slog.String("component", string(CLI)))
+	c.forgetSubscriptions(topics)
 	if !c.IsConnected() {
 		token.setError(ErrNotConnected)
 		return token
@@ -1208,22 +2337,23 @@ func (c *client) Unsubscribe(topics ...string) Token {
 		switch {
 		case !c.options.ResumeSubs:
 			// if not connected and resumeSubs not set, then this unsub will be thrown away
-			token.setError(fmt.Errorf("not currently connected and ResumeSubs not set"))
+			token.setError(fmt.Errorf("%w (currently connecting and ResumeSubs not set)", ErrNotConnected))
 			return token
 		case c.options.CleanSession && c.status.ConnectionStatus() == reconnecting:
 			// if reconnecting and cleanSession is true, then this unsub will be thrown away
-			token.setError(fmt.Errorf("reconnecting state and cleansession is true"))
+			token.setError(fmt.Errorf("%w (reconnecting and cleansession is true)", ErrNotConnected))
 			return token
 		}
 	}
 	unsub := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
 	unsub.Topics = make([]string, len(topics))
 	copy(unsub.Topics, topics)
+	c.subs.remove(topics...)
 
 	if unsub.MessageID == 0 {
-		mID := c.getID(token)
+		mID := c.getIDWait(token, c.options.MessageIDWaitTimeout)
 		if mID == 0 {
-			token.setError(fmt.Errorf("no message IDs available"))
+			token.setError(ErrMessageIDsExhausted)
 			return token
 		}
 		unsub.MessageID = mID
@@ -1253,7 +2383,7 @@ func (c *client) Unsubscribe(topics ...string) Token {
 				c.msgRouter.deleteRoute(topic)
 			}
 		case <-time.After(subscribeWaitTimeout):
-			token.setError(errors.New("unsubscribe was broken by timeout"))
+			token.setError(fmt.Errorf("unsubscribe was broken by %w", ErrTimeout))
 		}
 	}
 
@@ -1261,13 +2391,76 @@ func (c *client) Unsubscribe(topics ...string) Token {
 	return token
 }
 
+// UnsubscribeAll ends all subscriptions made by the client (as reported by Subscriptions).
+func (c *client) UnsubscribeAll() Token {
+	topics := c.subs.topics()
+	if len(topics) == 0 {
+		token := c.newToken(packets.Unsubscribe).(*UnsubscribeToken)
+		token.flowComplete()
+		return token
+	}
+	return c.Unsubscribe(topics...)
+}
+
+// SubscribeGroup is as per SubscribeMultiple but also adds the topic filters to the named subscription group
+// (creating it if needed) so they can be unsubscribed together with UnsubscribeGroup.
+func (c *client) SubscribeGroup(name string, filters map[string]byte, callback MessageHandler) Token {
+	token := c.SubscribeMultiple(filters, callback)
+	topics := make([]string, 0, len(filters))
+	for t := range filters {
+		topics = append(topics, t)
+	}
+	c.subs.addToGroup(name, topics...) // Topics that were not subscribed (e.g. not connected) are ignored
+	return token
+}
+
+// UnsubscribeGroup ends the subscriptions in the named group (other than those that also belong to another
+// group) and removes the group. The group is removed, before the token completes, once the unsubscribe has been
+// acknowledged; if it fails the group is retained.
+func (c *client) UnsubscribeGroup(name string) Token {
+	token := c.newToken(packets.Unsubscribe).(*UnsubscribeToken)
+	topics := c.subs.groupTopics(name)
+	if len(topics) == 0 {
+		c.subs.removeGroup(name)
+		token.flowComplete()
+		return token
+	}
+	unsub := c.Unsubscribe(topics...).(*UnsubscribeToken)
+	token.messageID = unsub.messageID
+	OnComplete(unsub, func(err error) {
+		if err != nil {
+			token.setError(err)
+			return
+		}
+		c.subs.removeGroup(name)
+		token.flowComplete()
+	})
+	return token
+}
+
 // OptionsReader returns a ClientOptionsReader which is a copy of the clientoptions
 // in use by the client.
 func (c *client) OptionsReader() ClientOptionsReader {
-	r := ClientOptionsReader{options: &c.options}
+	c.optionsMu.Lock() // The will may be changed by UpdateWill
+	o := c.options
+	c.optionsMu.Unlock()
+	r := ClientOptionsReader{options: &o}
 	return r
 }
 
+// UpdateWill replaces the will message; the change takes effect when the client next connects
+// (the broker retains the will provided when the current connection was established). This allows
+// the will to include state captured after the client was created. An empty topic removes the will.
+func (c *client) UpdateWill(topic string, payload []byte, qos byte, retained bool) {
+	c.optionsMu.Lock()
+	defer c.optionsMu.Unlock()
+	if topic == "" {
+		c.options.UnsetWill()
+		return
+	}
+	c.options.SetBinaryWill(topic, bytes.Clone(payload), qos, retained)
+}
+
 // DefaultConnectionLostHandler is a definition of a function that simply
 // reports to the DEBUG log the reason for the client losing a connection.
 func DefaultConnectionLostHandler(client Client, reason error) {
@@ -1277,15 +2470,15 @@ func DefaultConnectionLostHandler(client Client, reason error) {
 // UpdateLastReceived - Will be called whenever a packet is received off the network
 // This is used by the keepalive routine to
 func (c *client) UpdateLastReceived() {
-	if c.options.KeepAlive != 0 {
-		c.lastReceived.Store(time.Now())
+	if c.keepAliveInterval() > 0 {
+		c.lastReceived.Store(c.clock.Now())
 	}
 }
 
 // UpdateLastReceived - Will be called whenever a packet is successfully transmitted to the network
 func (c *client) UpdateLastSent() {
-	if c.options.KeepAlive != 0 {
-		c.lastSent.Store(time.Now())
+	if c.keepAliveInterval() > 0 {
+		c.lastSent.Store(c.clock.Now())
 	}
 }
 
@@ -1294,17 +2487,46 @@ func (c *client) getWriteTimeOut() time.Duration {
 	return c.options.WriteTimeout
 }
 
+// writeStallTimeout returns the limit set with SetWriteStallTimeout
+func (c *client) writeStallTimeout() time.Duration {
+	return c.options.WriteStallTimeout
+}
+
+// maxInboundPayload returns the limit set with SetMaxInboundPayload
+func (c *client) maxInboundPayload() int {
+	return c.options.MaxInboundPayload
+}
+
 // persistOutbound adds the packet to the outbound store
 func (c *client) persistOutbound(m packets.ControlPacket) {
 	persistOutbound(c.persist, m, c.logger)
 }
 
-// persistInbound adds the packet to the inbound store
-func (c *client) persistInbound(m packets.ControlPacket) {
-	persistInbound(c.persist, m, c.logger)
+// persistInbound adds the packet to the inbound store (returning false if it is a redelivery of a QoS 2 message
+// that has already been acknowledged)
+func (c *client) persistInbound(m packets.ControlPacket) bool {
+	return persistInbound(c.persist, m, c.logger)
+}
+
+// newToken returns a new token (as per the newToken function) that uses the client's clock
+func (c *client) newToken(tType byte) tokenCompletor {
+	t := newToken(tType)
+	if ct, ok := t.(interface{ setClock(clock.Clock) }); ok {
+		ct.setClock(c.clock)
+	}
+	return t
 }
 
 // pingRespReceived will be called by the network routines when a ping response is received
 func (c *client) pingRespReceived() {
+	if sent, ok := c.pingSent.Load().(time.Time); ok && atomic.LoadInt32(&c.pingOutstanding) > 0 {
+		c.pingRTT.Store(int64(c.clock.Now().Sub(sent)))
+	}
 	atomic.StoreInt32(&c.pingOutstanding, 0)
+	c.pingMu.Lock()
+	for _, w := range c.pingWaiters {
+		close(w)
+	}
+	c.pingWaiters = nil
+	c.pingMu.Unlock()
 }
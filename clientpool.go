@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"sync/atomic"
+)
+
+// PoolDistribution determines how a ClientPool distributes publishes between its clients
+type PoolDistribution int
+
+const (
+	// PoolRoundRobin uses each client in turn (so messages on the same topic may be delivered out of order)
+	PoolRoundRobin PoolDistribution = iota
+	// PoolByTopic always uses the same client for a topic, even while its connection is down (so ordering per topic
+	// is maintained; messages published while the client is reconnecting are handled as for any other client)
+	PoolByTopic
+)
+
+// ClientPool manages a number of connections to the same broker and distributes publishes between them; this
+// allows throughput beyond that which the broker permits for a single connection. Each client manages its own
+// reconnection (as per the options).
+type ClientPool struct {
+	clients      []Client
+	distribution PoolDistribution
+	next         atomic.Uint64
+}
+
+// NewClientPool returns a pool of size clients created using (copies of) o. If a client ID is set then each client
+// uses the ID with "-<n>" appended (n being 0 to size-1). Each client uses its own MemoryStore (o.Store is ignored
+// as a Store cannot be shared between clients).
+func NewClientPool(o *ClientOptions, size int, distribution PoolDistribution) *ClientPool {
+	p := &ClientPool{distribution: distribution}
+	for i := 0; i < max(size, 1); i++ {
+		co := cloneOptions(o)
+		if co.ClientID != "" {
+			co.ClientID = fmt.Sprintf("%s-%d", o.ClientID, i)
+		}
+		co.Store = nil
+		p.clients = append(p.clients, NewClient(&co))
+	}
+	return p
+}
+
+// Clients returns the clients in the pool
+func (p *ClientPool) Clients() []Client {
+	return p.clients
+}
+
+// Connect connects all of the clients; the returned token completes when all connection attempts have completed
+// (its error will join the errors from any that failed).
+func (p *ClientPool) Connect() Token {
+	tokens := make([]Token, len(p.clients))
+	for i, c := range p.clients {
+		tokens[i] = c.Connect()
+	}
+	return joinTokens(tokens)
+}
+
+// Disconnect disconnects all of the clients (in parallel); quiesce is passed to Client.Disconnect
+func (p *ClientPool) Disconnect(quiesce uint) {
+	done := make(chan struct{})
+	for _, c := range p.clients {
+		go func() {
+			c.Disconnect(quiesce)
+			done <- struct{}{}
+		}()
+	}
+	for range p.clients {
+		<-done
+	}
+}
+
+// Publish publishes a message via one of the clients in the pool (see PoolDistribution). With PoolRoundRobin, clients
+// whose connection is not currently open are skipped unless no connection is open.
+func (p *ClientPool) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	return p.pick(topic).Publish(topic, qos, retained, payload)
+}
+
+// pick returns the client to use for a publish to topic
+func (p *ClientPool) pick(topic string) Client {
+	if p.distribution == PoolByTopic {
+		h := fnv.New32a()
+		h.Write([]byte(topic))
+		return p.clients[h.Sum32()%uint32(len(p.clients))]
+	}
+	start := int(p.next.Add(1) % uint64(len(p.clients)))
+	for i := range p.clients {
+		if c := p.clients[(start+i)%len(p.clients)]; c.IsConnectionOpen() {
+			return c
+		}
+	}
+	return p.clients[start]
+}
+
+// cloneOptions returns a copy of o that shares no maps, slices or TLS configurations with it (so that changes made
+// by, or to, one client of a pool do not affect the others)
+func cloneOptions(o *ClientOptions) ClientOptions {
+	co := *o
+	co.Servers = slices.Clone(o.Servers)
+	co.ServerPriority = maps.Clone(o.ServerPriority)
+	co.LocalAddrs = slices.Clone(o.LocalAddrs)
+	if o.BrokerLocalAddrs != nil {
+		co.BrokerLocalAddrs = make(map[string][]string, len(o.BrokerLocalAddrs))
+		for k, v := range o.BrokerLocalAddrs {
+			co.BrokerLocalAddrs[k] = slices.Clone(v)
+		}
+	}
+	co.WillPayload = slices.Clone(o.WillPayload)
+	if o.TLSConfig != nil {
+		co.TLSConfig = o.TLSConfig.Clone()
+	}
+	if o.BrokerTLSConfigs != nil {
+		co.BrokerTLSConfigs = make(map[string]*tls.Config, len(o.BrokerTLSConfigs))
+		for k, v := range o.BrokerTLSConfigs {
+			co.BrokerTLSConfigs[k] = v.Clone()
+		}
+	}
+	co.ALPNProtocols = slices.Clone(o.ALPNProtocols)
+	if o.BrokerALPNProtocols != nil {
+		co.BrokerALPNProtocols = make(map[string][]string, len(o.BrokerALPNProtocols))
+		for k, v := range o.BrokerALPNProtocols {
+			co.BrokerALPNProtocols[k] = slices.Clone(v)
+		}
+	}
+	co.BrokerTLSPSK = maps.Clone(o.BrokerTLSPSK)
+	co.SPKIPins = slices.Clone(o.SPKIPins)
+	co.NamedHandlers = maps.Clone(o.NamedHandlers)
+	co.HTTPHeaders = o.HTTPHeaders.Clone()
+	if o.WebsocketOptions != nil {
+		wo := *o.WebsocketOptions
+		co.WebsocketOptions = &wo
+	}
+	co.CompressionTopics = slices.Clone(o.CompressionTopics)
+	co.PublishInterceptors = slices.Clone(o.PublishInterceptors)
+	co.InboundInterceptors = slices.Clone(o.InboundInterceptors)
+	return co
+}
+
+// ConnectedCount returns the number of clients whose connection is currently open
+func (p *ClientPool) ConnectedCount() int {
+	n := 0
+	for _, c := range p.clients {
+		if c.IsConnectionOpen() {
+			n++
+		}
+	}
+	return n
+}
+
+// ConnectionState returns an aggregate of the state of the clients: Connected if all are connected, Disconnected if
+// all are disconnected, and otherwise the state of the first client that is not connected.
+func (p *ClientPool) ConnectionState() ConnState {
+	disconnected := 0
+	notConnected := Connected
+	for _, c := range p.clients {
+		switch s := c.(ConnectionWaiter).ConnectionState(); s {
+		case Connected:
+		case Disconnected:
+			disconnected++
+			if notConnected == Connected {
+				notConnected = s
+			}
+		default:
+			if notConnected == Connected {
+				notConnected = s
+			}
+		}
+	}
+	if disconnected == len(p.clients) {
+		return Disconnected
+	}
+	return notConnected
+}
+
+// joinTokens returns a token that completes when all of tokens have completed; its error joins their errors
+func joinTokens(tokens []Token) Token {
+	t := &baseToken{complete: make(chan struct{})}
+	t.completeWhenAll(tokens)
+	return t
+}
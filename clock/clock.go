@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package clock provides the source of time used by the MQTT client. By default the client uses the system clock
+// (Real); tests can substitute a Fake, which only moves when advanced, to exercise time-dependent behaviour (such
+// as keepalive expiry and reconnection backoff) deterministically and without real delays.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and timers
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	Sleep(d time.Duration)
+}
+
+// Timer is the equivalent of time.Timer (which cannot be substituted as its channel is a field)
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Real is the system clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                 { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+func (realClock) Sleep(d time.Duration)          { time.Sleep(d) }
+
+type realTimer struct{ t *time.Timer }
+
+func (r realTimer) C() <-chan time.Time        { return r.t.C }
+func (r realTimer) Stop() bool                 { return r.t.Stop() }
+func (r realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+
+// Fake is a Clock whose time only changes when Advance is called. Timers (including those used by Sleep) fire
+// when the time is advanced to, or past, their deadline.
+type Fake struct {
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when the number of active timers changes
+	now    time.Time
+	timers map[*fakeTimer]struct{} // active timers
+}
+
+// NewFake returns a Fake clock set to now
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now, timers: make(map[*fakeTimer]struct{})}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer returns a Timer that fires once the clock has been advanced by d
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{f: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Sleep blocks until the clock has been advanced by d
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d, firing any timers that become due (in deadline order)
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	var due []*fakeTimer
+	for t := range f.timers {
+		if !t.deadline.After(f.now) {
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].deadline.Before(due[j].deadline) })
+	for _, t := range due {
+		t.fire(f.now)
+	}
+}
+
+// Timers returns the number of active timers (those that have neither fired nor been stopped)
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// BlockUntil waits until there are at least n active timers; this allows a test to ensure that the code under test
+// is waiting on the clock before calling Advance.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	f        *Fake
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop prevents the timer from firing (returning false if it had already fired or been stopped)
+func (t *fakeTimer) Stop() bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	_, active := t.f.timers[t]
+	delete(t.f.timers, t)
+	t.f.cond.Broadcast()
+	return active
+}
+
+// Reset changes the timer to fire after d (returning true if it was active)
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	_, active := t.f.timers[t]
+	t.deadline = t.f.now.Add(d)
+	if d <= 0 {
+		t.fire(t.f.now)
+		return active
+	}
+	t.f.timers[t] = struct{}{}
+	t.f.cond.Broadcast()
+	return active
+}
+
+// fire sends the time on the timer channel and deactivates it (must be called with the clock locked)
+func (t *fakeTimer) fire(now time.Time) {
+	delete(t.f.timers, t)
+	t.f.cond.Broadcast()
+	select {
+	case t.c <- now:
+	default: // as per time.Timer, the value is dropped if the previous one has not been received
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	t1 := f.NewTimer(2 * time.Second)
+	t2 := f.NewTimer(time.Second)
+	if n := f.Timers(); n != 2 {
+		t.Fatalf("expected 2 timers, got %d", n)
+	}
+
+	f.Advance(time.Second)
+	select {
+	case now := <-t2.C():
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("unexpected time %s", now)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+	select {
+	case <-t1.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+	if !t1.Stop() || t1.Stop() {
+		t.Fatal("unexpected Stop result")
+	}
+	f.Advance(time.Hour)
+	select {
+	case <-t1.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+	if t1.Reset(time.Second) {
+		t.Fatal("Reset of stopped timer should return false")
+	}
+	f.Advance(time.Second)
+	<-t1.C()
+
+	done := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(done)
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Sleep did not return")
+	}
+	if now := f.Now(); !now.Equal(start.Add(time.Hour + 2*time.Second + time.Minute)) {
+		t.Fatalf("unexpected time %s", now)
+	}
+}
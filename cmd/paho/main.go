@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+/*
+paho is a command line tool, similar to mosquitto_pub and mosquitto_sub, for publishing and subscribing to MQTT
+brokers. It is intended both as a debugging aid and as an example of the use of this library.
+
+Usage:
+
+	paho pub [options] -t <topic> (-m <message> | -f <file> | -l)
+	paho sub [options] -t <topic> [-t <topic>...]
+
+The broker is specified with -broker (e.g. tcp://localhost:1883, ssl://host:8883, ws://host:8080/mqtt or
+wss://host:8081/mqtt). Run "paho pub -h" or "paho sub -h" for the full list of options.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "pub":
+		err = pub(os.Args[2:])
+	case "sub":
+		err = sub(os.Args[2:], os.Stdout)
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: paho <command> [options]
+
+commands:
+  pub   publish messages
+  sub   subscribe and print received messages
+
+Use "paho <command> -h" for the options of each command.`)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// connFlags holds the options common to all commands
+type connFlags struct {
+	broker    string
+	id        string
+	user      string
+	password  string
+	qos       int
+	clean     bool
+	keepAlive time.Duration
+	timeout   time.Duration
+	cafile    string
+	cert      string
+	key       string
+	insecure  bool
+	events    bool
+	debug     bool
+}
+
+// register adds the common flags to fs
+func (c *connFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.broker, "broker", "tcp://localhost:1883", "broker URI (tcp://, ssl://, ws:// or wss://)")
+	fs.StringVar(&c.id, "id", "", "client ID (default: generated)")
+	fs.StringVar(&c.user, "u", "", "username")
+	fs.StringVar(&c.password, "P", "", "password")
+	fs.IntVar(&c.qos, "q", 0, "quality of service (0, 1 or 2)")
+	fs.BoolVar(&c.clean, "clean", true, "request a clean session")
+	fs.DurationVar(&c.keepAlive, "keepalive", 30*time.Second, "keepalive interval")
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "connection timeout")
+	fs.StringVar(&c.cafile, "cafile", "", "PEM file containing the CA certificates used to verify the broker")
+	fs.StringVar(&c.cert, "cert", "", "PEM file containing the client certificate")
+	fs.StringVar(&c.key, "key", "", "PEM file containing the client private key")
+	fs.BoolVar(&c.insecure, "insecure", false, "do not verify the broker certificate")
+	fs.BoolVar(&c.events, "events", false, "print connection events to stderr")
+	fs.BoolVar(&c.debug, "debug", false, "print library debug logging to stderr")
+}
+
+// validate checks the flag values
+func (c *connFlags) validate() error {
+	if c.qos < 0 || c.qos > 2 {
+		return fmt.Errorf("invalid QoS %d", c.qos)
+	}
+	if (c.cert == "") != (c.key == "") {
+		return errors.New("-cert and -key must be used together")
+	}
+	return nil
+}
+
+// clientOptions returns the options for a client using the flag values
+func (c *connFlags) clientOptions(prefix string) (*mqtt.ClientOptions, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	id := c.id
+	if id == "" {
+		id = fmt.Sprintf("%s-%d", prefix, os.Getpid())
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.broker).
+		SetClientID(id).
+		SetUsername(c.user).
+		SetPassword(c.password).
+		SetCleanSession(c.clean).
+		SetKeepAlive(c.keepAlive).
+		SetConnectTimeout(c.timeout)
+	if c.debug {
+		opts.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+	if c.events {
+		opts.SetConnectionNotificationHandler(func(_ mqtt.Client, n mqtt.ConnectionNotification) {
+			fmt.Fprintf(os.Stderr, "%T %+v\n", n, n)
+		})
+	}
+	if c.cafile != "" || c.cert != "" || c.insecure {
+		cfg, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(cfg)
+	}
+	return opts, nil
+}
+
+// tlsConfig returns the TLS configuration specified by the flags
+func (c *connFlags) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: c.insecure} // #nosec G402 -- only if requested by the user
+	if c.cafile != "" {
+		pem, err := os.ReadFile(c.cafile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.cafile)
+		}
+	}
+	if c.cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// connect connects to the broker
+func connect(opts *mqtt.ClientOptions) (mqtt.Client, error) {
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+// stringsFlag is a flag that may be repeated
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
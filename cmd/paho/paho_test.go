@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+// slowWriter delays each write (allowing messages to queue up)
+type slowWriter struct {
+	bytes.Buffer
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.Buffer.Write(p)
+}
+
+// runSub runs sub with args, failing the test if it does not return within a few seconds
+func runSub(t *testing.T, args ...string) string {
+	t.Helper()
+	out := slowWriter{delay: 100 * time.Millisecond}
+	result := make(chan error, 1)
+	go func() { result <- sub(args, &out) }()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("sub failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sub did not exit")
+	}
+	return out.String()
+}
+
+func Test_subCount(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := 0; i < 200; i++ { // more than are buffered, so the handler would block once sub stops reading
+		b.Publish(fmt.Sprintf("a/%d", i), 0, true, []byte("x"))
+	}
+
+	out := runSub(t, "-broker", b.URL(), "-id", "sub", "-t", "a/#", "-n", "2", "-v")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "a/") {
+		t.Fatalf("expected two messages, got %q", out)
+	}
+
+	// The client must not be left blocked in the handler trying to pass messages to sub
+	buf := make([]byte, 1<<20)
+	time.Sleep(200 * time.Millisecond)
+	t.Log(string(buf[:runtime.Stack(buf, true)]))
+	for start := time.Now(); bytes.Contains(buf[:runtime.Stack(buf, true)], []byte("paho.sub.func")); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("message handler still running after sub returned")
+		}
+	}
+}
+
+func Test_subJSON(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Publish("a/b", 1, true, []byte{0xff})
+
+	out := runSub(t, "-broker", b.URL(), "-id", "sub", "-q", "1", "-t", "a/b", "-n", "1", "-json")
+	var m jsonMessage
+	if err := json.Unmarshal([]byte(out), &m); err != nil {
+		t.Fatalf("invalid output %q: %s", out, err)
+	}
+	if m.Topic != "a/b" || !m.Retained || m.Payload != "" || !bytes.Equal(m.PayloadBase64, []byte{0xff}) {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func Test_subNoTopic(t *testing.T) {
+	if err := sub(nil, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected an error when no topic is specified")
+	}
+}
+
+func Test_pub(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	received := make(chan string, 10)
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("subscriber"))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	if token := c.Subscribe("p", 1, func(_ mqtt.Client, m mqtt.Message) { received <- string(m.Payload()) }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	if err := pub([]string{"-broker", b.URL(), "-id", "pub", "-q", "1", "-t", "p", "-m", "hello", "-n", "2"}); err != nil {
+		t.Fatalf("pub failed: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-received:
+			if p != "hello" {
+				t.Fatalf("unexpected payload %q", p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+	if err := pub([]string{"-broker", b.URL(), "-t", "p", "-m", "x", "-l"}); err == nil {
+		t.Fatal("expected -l to be rejected with -m")
+	}
+}
+
+func Test_publishLines(t *testing.T) {
+	var sent []string
+	send := func(p []byte) error {
+		sent = append(sent, string(p))
+		return nil
+	}
+	if err := publishLines(strings.NewReader("a\nb\n\nc"), send, 0); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(sent, ",") != "a,b,,c" {
+		t.Fatalf("unexpected messages %q", sent)
+	}
+
+	failed := errors.New("failed")
+	if err := publishLines(strings.NewReader("a\nb"), func([]byte) error { return failed }, 0); !errors.Is(err, failed) {
+		t.Fatalf("expected error to be returned, got %v", err)
+	}
+}
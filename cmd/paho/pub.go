@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// pub publishes the message(s) specified by args
+func pub(args []string) error {
+	var cf connFlags
+	fs := flag.NewFlagSet("pub", flag.ExitOnError)
+	cf.register(fs)
+	topic := fs.String("t", "", "topic to publish to (required)")
+	message := fs.String("m", "", "message payload")
+	file := fs.String("f", "", "file whose contents are sent as the payload")
+	lines := fs.Bool("l", false, "read lines from stdin and publish each as a separate message")
+	retain := fs.Bool("r", false, "set the retain flag")
+	count := fs.Int("n", 1, "number of times to publish the message (not used with -l)")
+	interval := fs.Duration("interval", 0, "delay between messages")
+	_ = fs.Parse(args)
+
+	if *topic == "" {
+		return errors.New("a topic must be specified with -t")
+	}
+	var payload []byte
+	switch {
+	case *file != "":
+		b, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		payload = b
+	case *message != "":
+		payload = []byte(*message)
+	}
+	if *lines && payload != nil {
+		return errors.New("-l cannot be used with -m or -f")
+	}
+
+	opts, err := cf.clientOptions("paho-pub")
+	if err != nil {
+		return err
+	}
+	client, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	send := func(p []byte) error { // waits for the flow to complete so p may be reused
+		t := client.Publish(*topic, byte(cf.qos), *retain, p)
+		if !t.WaitTimeout(cf.timeout) {
+			return errors.New("timed out waiting for the publish to complete")
+		}
+		return t.Error()
+	}
+	if *lines {
+		return publishLines(os.Stdin, send, *interval)
+	}
+	for i := 0; i < *count; i++ {
+		if i > 0 && *interval > 0 {
+			time.Sleep(*interval)
+		}
+		if err := send(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishLines calls send with each line read from r
+func publishLines(r io.Reader, send func([]byte) error, interval time.Duration) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 256*1024*1024) // MQTT allows payloads of up to 256MB
+	for first := true; s.Scan(); first = false {
+		if !first && interval > 0 {
+			time.Sleep(interval)
+		}
+		if err := send(s.Bytes()); err != nil {
+			return fmt.Errorf("publish failed: %w", err)
+		}
+	}
+	return s.Err()
+}
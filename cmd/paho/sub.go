@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// jsonMessage is the output format used with -json (one object per line)
+type jsonMessage struct {
+	Topic         string `json:"topic"`
+	QoS           byte   `json:"qos"`
+	Retained      bool   `json:"retained"`
+	Duplicate     bool   `json:"duplicate"`
+	MessageID     uint16 `json:"messageId"`
+	Payload       string `json:"payload,omitempty"`
+	PayloadBase64 []byte `json:"payloadBase64,omitempty"` // used if the payload is not valid UTF-8
+}
+
+// sub subscribes to the topics specified by args and writes received messages to out
+func sub(args []string, out io.Writer) error {
+	var cf connFlags
+	var topics stringsFlag
+	fs := flag.NewFlagSet("sub", flag.ExitOnError)
+	cf.register(fs)
+	fs.Var(&topics, "t", "topic filter to subscribe to (may be repeated; required)")
+	verbose := fs.Bool("v", false, "print the topic before each payload")
+	asJSON := fs.Bool("json", false, "print each message as a JSON object")
+	count := fs.Int("n", 0, "exit after receiving this many messages (0 = run until interrupted)")
+	noRetained := fs.Bool("R", false, "do not print retained messages")
+	_ = fs.Parse(args)
+
+	if len(topics) == 0 {
+		return errors.New("at least one topic must be specified with -t")
+	}
+	opts, err := cf.clientOptions("paho-sub")
+	if err != nil {
+		return err
+	}
+
+	msgs := make(chan mqtt.Message, 100)
+	done := make(chan struct{}) // closed on return so the handler cannot block once messages are no longer read
+	opts.SetDefaultPublishHandler(func(_ mqtt.Client, m mqtt.Message) {
+		select {
+		case msgs <- m:
+		case <-done:
+		}
+	})
+	filters := make(map[string]byte, len(topics))
+	for _, t := range topics {
+		filters[t] = byte(cf.qos)
+	}
+	opts.SetOnConnectHandler(func(c mqtt.Client) { // subscribe on each connection in case the session was lost
+		if t := c.SubscribeMultiple(filters, nil); t.Wait() && t.Error() != nil {
+			fmt.Fprintln(os.Stderr, "Subscribe failed:", t.Error())
+		}
+	})
+	client, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+	defer close(done) // before Disconnect (which waits for the handler to return)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	enc := json.NewEncoder(out)
+	for received := 0; *count == 0 || received < *count; {
+		select {
+		case m := <-msgs:
+			if *noRetained && m.Retained() {
+				continue
+			}
+			received++
+			if err := printMessage(out, enc, m, *verbose, *asJSON); err != nil {
+				return err
+			}
+		case <-sig:
+			return nil
+		}
+	}
+	return nil
+}
+
+// printMessage writes m to w (or enc if asJSON is true)
+func printMessage(w io.Writer, enc *json.Encoder, m mqtt.Message, verbose, asJSON bool) error {
+	if asJSON {
+		jm := jsonMessage{Topic: m.Topic(), QoS: m.Qos(), Retained: m.Retained(), Duplicate: m.Duplicate(), MessageID: m.MessageID()}
+		if utf8.Valid(m.Payload()) {
+			jm.Payload = string(m.Payload())
+		} else {
+			jm.PayloadBase64 = m.Payload()
+		}
+		return enc.Encode(jm)
+	}
+	var err error
+	if verbose {
+		_, err = fmt.Fprintf(w, "%s %s\n", m.Topic(), m.Payload())
+	} else {
+		_, err = fmt.Fprintf(w, "%s\n", m.Payload())
+	}
+	return err
+}
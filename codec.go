@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrPayloadEncode is wrapped by the error set on the token returned by PublishWithCodec when v cannot be encoded
+var ErrPayloadEncode = errors.New("unable to encode payload")
+
+// ErrPayloadDecode is wrapped by the errors passed to the DecodeErrorHandler when a payload cannot be decoded
+var ErrPayloadDecode = errors.New("unable to decode payload")
+
+// Codec encodes and decodes message payloads (see SubscribeWithCodec and PublishWithCodec). Only JSONCodec is provided
+// (so that this module does not depend on a Protocol Buffers or CBOR library); other formats can be supported by
+// implementing Codec using the relevant library (e.g. a Marshal that calls proto.Marshal(v.(proto.Message))).
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// jsonCodec implements Codec using encoding/json
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// JSONCodec is a Codec that encodes payloads as JSON
+var JSONCodec Codec = jsonCodec{}
+
+// TypedMessageHandler is called with the decoded payload of a message (see SubscribeWithCodec)
+type TypedMessageHandler[T any] func(Client, T, Message)
+
+// TypedHandler returns a MessageHandler that decodes the payload of each message into a T using codec and
+// passes it to handler. If the payload cannot be decoded the DecodeErrorHandler (see
+// ClientOptions.SetDecodeErrorHandler) is called instead and the message is otherwise discarded.
+func TypedHandler[T any](codec Codec, handler TypedMessageHandler[T]) MessageHandler {
+	return func(c Client, m Message) {
+		var v T
+		if err := codec.Unmarshal(m.Payload(), &v); err != nil {
+			r := c.OptionsReader()
+			if onError := r.DecodeErrorHandler(); onError != nil {
+				onError(c, m, fmt.Errorf("%w: %w", ErrPayloadDecode, err))
+			}
+			return
+		}
+		handler(c, v, m)
+	}
+}
+
+// SubscribeWithCodec subscribes to topic with message payloads decoded using codec before being passed to
+// handler (see TypedHandler).
+func SubscribeWithCodec[T any](c Client, codec Codec, topic string, qos byte, handler TypedMessageHandler[T]) Token {
+	return c.Subscribe(topic, qos, TypedHandler(codec, handler))
+}
+
+// SubscribeJSON subscribes to topic with message payloads decoded from JSON before being passed to handler.
+func SubscribeJSON[T any](c Client, topic string, qos byte, handler TypedMessageHandler[T]) Token {
+	return SubscribeWithCodec(c, JSONCodec, topic, qos, handler)
+}
+
+// PublishWithCodec encodes v using codec and publishes the result as per Client.Publish. If v cannot be encoded
+// nothing is published and the returned token is complete with an error wrapping ErrPayloadEncode. Note that
+// MQTT v3.1.1 provides no way to indicate the content type so subscribers must know the encoding in use.
+// There is no PublishProto; pass a Codec that wraps a Protocol Buffers library instead (see Codec).
+func PublishWithCodec(c Client, codec Codec, topic string, qos byte, retained bool, v interface{}) Token {
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		token := newToken(packets.Publish).(*PublishToken)
+		token.setError(fmt.Errorf("%w: %w", ErrPayloadEncode, err))
+		return token
+	}
+	return c.Publish(topic, qos, retained, payload)
+}
+
+// PublishJSON publishes v encoded as JSON (see PublishWithCodec).
+func PublishJSON(c Client, topic string, qos byte, retained bool, v interface{}) Token {
+	return PublishWithCodec(c, JSONCodec, topic, qos, retained, v)
+}
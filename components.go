@@ -33,4 +33,6 @@ const (
 	STA component = "[state]   "
 	ERR component = "[error]   "
 	ROU component = "[router]  "
+	BRG component = "[bridge]  "
+	SPL component = "[spool]   "
 )
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Identifiers of the compression algorithms used in the header of compressed payloads (see CompressionCodec)
+const (
+	CompressionGzip byte = 1
+	CompressionZstd byte = 2 // reserved; no implementation is provided (to avoid the dependency), see CompressionCodec
+)
+
+// compressionHeader precedes a compressed payload; it is followed by the CompressionCodec ID and the compressed data.
+// A leading zero byte is unlikely in text payloads so this is rarely mistaken for a payload that was not compressed
+// (and, if it is, decompression will fail and the payload will be delivered unchanged).
+var compressionHeader = []byte{0x00, 'Z'}
+
+// maxDecompressedPayload limits the size of a decompressed payload when MaxInboundPayload is not set (this is the
+// largest payload that could have been sent without compression)
+const maxDecompressedPayload = 268435455
+
+// CompressionCodec compresses message payloads (see SetPayloadCompression). Only gzip is implemented (see
+// NewGzipCompression). The ID is sent in the header of each compressed payload so that the receiver can select
+// the algorithm; use CompressionGzip or CompressionZstd (e.g. for an application supplied codec wrapping
+// github.com/klauspost/compress/zstd) so that other implementations can interoperate.
+// Decompress must return an error rather than produce more than limit bytes (if limit > 0).
+type CompressionCodec interface {
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// gzipCodec implements CompressionCodec using compress/gzip
+type gzipCodec struct {
+	level int
+}
+
+// NewGzipCompression returns a CompressionCodec that uses gzip at the specified level (e.g. gzip.BestSpeed; use
+// gzip.DefaultCompression if unsure)
+func NewGzipCompression(level int) CompressionCodec {
+	return gzipCodec{level: level}
+}
+
+func (gzipCodec) ID() byte { return CompressionGzip }
+
+func (g gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, g.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader = r
+	if limit > 0 {
+		src = io.LimitReader(r, int64(limit)+1)
+	}
+	out, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(out) > limit {
+		return nil, &packets.PayloadTooLargeError{Size: len(out), Limit: limit}
+	}
+	return out, nil
+}
+
+// compressionFor returns the CompressionCodec that applies to topic (nil if payloads are not compressed)
+func (c *client) compressionFor(topic string) CompressionCodec {
+	codec := c.options.PayloadCompression
+	if codec == nil || len(c.options.CompressionTopics) == 0 {
+		return codec
+	}
+	for _, filter := range c.options.CompressionTopics {
+		if routeIncludesTopic(filter, topic) {
+			return codec
+		}
+	}
+	return nil
+}
+
+// inboundPayload reverses the compression (if any) of a payload received on topic. If the payload cannot be
+// decompressed (e.g. the algorithm is unknown) it is logged and the payload is returned unchanged. If the
+// decompressed payload would exceed MaxInboundPayload (or maxDecompressedPayload if that is not set) this is
+// logged and false is returned (the message should be discarded).
+func (c *client) inboundPayload(topic string, payload []byte) ([]byte, bool) {
+	codec := c.compressionFor(topic)
+	if codec == nil || len(payload) <= len(compressionHeader) || !bytes.HasPrefix(payload, compressionHeader) {
+		return payload, true
+	}
+	id := payload[len(compressionHeader)]
+	switch {
+	case id == codec.ID():
+	case id == CompressionGzip: // always understood, so that peers may use gzip regardless of the local codec
+		codec = gzipCodec{}
+	default:
+		c.logger.Warn("payload compressed with unknown algorithm; delivered unchanged", slog.String("topic", topic), slog.Int("algorithm", int(id)), slog.String("component", string(CLI)))
+		return payload, true
+	}
+	limit := c.options.MaxInboundPayload
+	if limit <= 0 {
+		limit = maxDecompressedPayload
+	}
+	data, err := codec.Decompress(payload[len(compressionHeader)+1:], limit)
+	if errors.Is(err, ErrPayloadTooLarge) {
+		c.logger.Warn("discarding PUBLISH with oversize decompressed payload", slog.String("topic", topic), slog.Int("limit", limit), slog.String("component", string(CLI)))
+		return nil, false
+	}
+	if err != nil {
+		c.logger.Warn("unable to decompress payload; delivered unchanged", slog.String("topic", topic), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		return payload, true
+	}
+	return data, true
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionAttempt records the outcome of an attempt to connect to a broker (see Client.ConnectionHistory).
+// Each broker tried counts as a separate attempt.
+type ConnectionAttempt struct {
+	Time       time.Time     // when the attempt completed
+	Broker     string        // the broker URL ("" if the attempt failed before a broker was selected)
+	Reconnect  bool          // true if this was an automatic reconnection (as opposed to Connect)
+	ReturnCode byte          // the CONNACK return code (packets.ErrNetworkError if there was no CONNACK)
+	Err        error         // nil if the connection was established
+	Backoff    time.Duration // the delay applied before the next attempt (0 if there was no further attempt)
+}
+
+// connHistory is a ring buffer holding the most recent connection attempts; a nil *connHistory records nothing
+type connHistory struct {
+	mu       sync.Mutex
+	attempts []ConnectionAttempt // once full, next is the oldest entry
+	next     int
+	size     int
+}
+
+// newConnHistory returns a connHistory holding up to size attempts (nil if size <= 0)
+func newConnHistory(size int) *connHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &connHistory{attempts: make([]ConnectionAttempt, 0, size), size: size}
+}
+
+// add records an attempt, discarding the oldest if the buffer is full
+func (h *connHistory) add(a ConnectionAttempt) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.attempts) < h.size {
+		h.attempts = append(h.attempts, a)
+		return
+	}
+	h.attempts[h.next] = a
+	h.next = (h.next + 1) % h.size
+}
+
+// setBackoff records the delay applied following the most recent attempt
+func (h *connHistory) setBackoff(d time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.attempts) == 0 {
+		return
+	}
+	h.attempts[(h.next+len(h.attempts)-1)%len(h.attempts)].Backoff = d
+}
+
+// snapshot returns a copy of the recorded attempts, oldest first
+func (h *connHistory) snapshot() []ConnectionAttempt {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := make([]ConnectionAttempt, 0, len(h.attempts))
+	s = append(s, h.attempts[h.next:]...)
+	return append(s, h.attempts[:h.next]...)
+}
+
+// ConnectionHistory returns the most recent connection attempts (oldest first); the number retained is set with
+// ClientOptions.SetConnectionHistorySize. This is intended to help diagnose connection/reconnection problems.
+func (c *client) ConnectionHistory() []ConnectionAttempt {
+	return c.history.snapshot()
+}
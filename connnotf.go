@@ -1,6 +1,10 @@
 package mqtt
 
-import "net/url"
+import (
+	"log/slog"
+	"net/url"
+	"time"
+)
 
 type ConnectionNotificationType int64
 
@@ -11,6 +15,7 @@ const (
 	ConnectionNotificationTypeLost
 	ConnectionNotificationTypeBroker
 	ConnectionNotificationTypeBrokerFailed
+	ConnectionNotificationTypeResume
 )
 
 type ConnectionNotification interface {
@@ -77,3 +82,42 @@ type ConnectionNotificationBrokerFailed struct {
 func (n ConnectionNotificationBrokerFailed) Type() ConnectionNotificationType {
 	return ConnectionNotificationTypeBrokerFailed
 }
+
+// Resume Progress
+
+// ConnectionNotificationResume reports progress in resending the messages held in the store following a
+// connection (see ClientOptions.SetResumeBatchSize). Sent == Total once all messages have been sent.
+type ConnectionNotificationResume struct {
+	Sent  int
+	Total int
+}
+
+func (n ConnectionNotificationResume) Type() ConnectionNotificationType {
+	return ConnectionNotificationTypeResume
+}
+
+// ConnectionNotificationEvent wraps a ConnectionNotification with the time at which it occurred. Events are
+// delivered on the channel passed to ClientOptions.SetConnectionNotificationChannel.
+type ConnectionNotificationEvent struct {
+	ConnectionNotification
+	Time time.Time
+}
+
+// notifyConnection passes n to the ConnectionNotificationHandler and notification channel (where set).
+// Sending to the channel never blocks; if the channel is full the event is dropped.
+func (c *client) notifyConnection(n ConnectionNotification, async bool) {
+	if ch := c.options.NotificationChannel; ch != nil {
+		select {
+		case ch <- ConnectionNotificationEvent{ConnectionNotification: n, Time: time.Now()}:
+		default:
+			c.logger.Warn("connection notification channel full, event dropped", slog.Int64("type", int64(n.Type())), slog.String("component", string(CLI)))
+		}
+	}
+	if h := c.options.OnConnectionNotification; h != nil {
+		if async {
+			go h(c, n)
+		} else {
+			h(c, n)
+		}
+	}
+}
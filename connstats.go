@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionStats summarises a connection that has been lost (see ClientOptions.SetConnectionLostStatsHandler).
+// Packet and byte counts include the CONNECT/CONNACK exchange; bytes are those of the MQTT packets (i.e. excluding
+// any TLS or websocket overhead).
+type ConnectionStats struct {
+	Broker            *url.URL      // the broker that was connected to
+	ConnectedAt       time.Time     // when the connection was established
+	Uptime            time.Duration // how long the connection was up
+	PacketsIn         uint64        // packets received from the broker
+	PacketsOut        uint64        // packets sent to the broker
+	BytesIn           uint64        // bytes received from the broker
+	BytesOut          uint64        // bytes sent to the broker
+	LastError         error         // the reason the connection was lost
+	InflightPublishes int           // QoS 1/2 publishes awaiting acknowledgement when the connection was lost
+	InflightIDs       int           // message IDs in use (by PUBLISH, SUBSCRIBE and UNSUBSCRIBE flows) when the connection was lost
+}
+
+// connStats holds the counters for the current connection
+type connStats struct {
+	connectedAt atomic.Value // time.Time
+	packetsIn   atomic.Uint64
+	packetsOut  atomic.Uint64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+}
+
+// reset zeros the counters (called when a new connection is opened)
+func (s *connStats) reset() {
+	s.connectedAt.Store(time.Time{})
+	s.packetsIn.Store(0)
+	s.packetsOut.Store(0)
+	s.bytesIn.Store(0)
+	s.bytesOut.Store(0)
+}
+
+// connectionStats returns the stats for the connection that was lost with reason err
+func (c *client) connectionStats(err error) ConnectionStats {
+	s := ConnectionStats{
+		Broker:            c.connectedBroker.Load(),
+		PacketsIn:         c.stats.packetsIn.Load(),
+		PacketsOut:        c.stats.packetsOut.Load(),
+		BytesIn:           c.stats.bytesIn.Load(),
+		BytesOut:          c.stats.bytesOut.Load(),
+		LastError:         err,
+		InflightPublishes: len(c.messageIds.publishTokens()),
+		InflightIDs:       int(midMax) - c.messageIds.freeIDs(),
+	}
+	if t, ok := c.stats.connectedAt.Load().(time.Time); ok && !t.IsZero() {
+		s.ConnectedAt = t
+		s.Uptime = c.clock.Now().Sub(t)
+	}
+	return s
+}
+
+// statsConn counts the bytes read from, and written to, a connection
+type statsConn struct {
+	net.Conn
+	stats *connStats
+}
+
+// Read implements net.Conn
+func (s *statsConn) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	s.stats.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+// Write implements net.Conn
+func (s *statsConn) Write(b []byte) (int, error) {
+	n, err := s.Conn.Write(b)
+	s.stats.bytesOut.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// dedupKey identifies a QoS 1 message for the purposes of deduplication
+type dedupKey struct {
+	messageID uint16
+	topic     string
+}
+
+// dedupEntry records when a message was received (entries are held in the order received to simplify expiry)
+type dedupEntry struct {
+	key      dedupKey
+	received time.Time
+}
+
+// dedupCache detects redelivery of QoS 1 messages received within a sliding window. A message is
+// considered a duplicate if it has the DUP flag set and a message with the same ID and topic was
+// received within the window (message IDs are reused so the DUP flag check avoids discarding new
+// messages). It is retained across reconnections as this is when redelivery usually occurs.
+type dedupCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	seen    map[dedupKey]time.Time
+	entries []dedupEntry // oldest first
+}
+
+// newDedupCache returns a dedupCache covering the specified window
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{window: window, seen: make(map[dedupKey]time.Time)}
+}
+
+// duplicate records receipt of p and returns true if it is a redelivery of a message received within the window
+func (d *dedupCache) duplicate(p *packets.PublishPacket, now time.Time) bool {
+	if p.Qos != 1 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+	key := dedupKey{messageID: p.MessageID, topic: p.TopicName}
+	if _, ok := d.seen[key]; ok && p.Dup {
+		return true
+	}
+	d.seen[key] = now
+	d.entries = append(d.entries, dedupEntry{key: key, received: now})
+	return false
+}
+
+// expire removes entries that are older than the window
+func (d *dedupCache) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.entries) && now.Sub(d.entries[i].received) >= d.window; i++ {
+		e := d.entries[i]
+		if d.seen[e.key].Equal(e.received) { // the key may have been seen again since
+			delete(d.seen, e.key)
+		}
+	}
+	d.entries = d.entries[i:]
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+const (
+	e2eVersion      = 1
+	e2eKeyIDLen     = 8
+	e2eWrappedLen   = 32 + 16 // AES-256 key and GCM tag
+	e2eRecipientLen = e2eKeyIDLen + e2eWrappedLen
+	e2eHeaderLen    = 1 + 32 + 1 // version, ephemeral public key and number of recipients
+	e2eInfo         = "paho.mqtt.golang e2e v1"
+)
+
+// ErrE2EDecrypt is returned (wrapped) when an encrypted payload cannot be decrypted; e.g. because this client is not
+// one of its recipients or it has been modified
+var ErrE2EDecrypt = errors.New("e2e: unable to decrypt payload")
+
+// ErrE2EPlaintext is returned when a payload received on a topic that requires encryption was not encrypted
+var ErrE2EPlaintext = errors.New("e2e: payload is not encrypted")
+
+// ErrE2ENoRecipients is returned when the E2EKeyProvider returns no recipient keys for a topic
+var ErrE2ENoRecipients = errors.New("e2e: no recipients for topic")
+
+// E2EKeyProvider supplies the keys used by E2EEncryption. Implementations may, for example, retrieve recipients'
+// public keys from a directory service (caching them) and must be safe for concurrent use.
+type E2EKeyProvider interface {
+	// PrivateKey returns this client's X25519 private key, used to decrypt the messages it receives
+	PrivateKey() (*ecdh.PrivateKey, error)
+	// RecipientKeys returns the X25519 public keys of the clients able to decrypt messages published on topic
+	// (include this client's key if it should be able to read its own messages)
+	RecipientKeys(topic string) ([]*ecdh.PublicKey, error)
+}
+
+// StaticE2EKeys is an E2EKeyProvider holding a fixed set of keys
+type StaticE2EKeys struct {
+	Private    *ecdh.PrivateKey
+	Recipients map[string][]*ecdh.PublicKey // keyed by topic filter (which may contain wildcards)
+}
+
+// PrivateKey implements E2EKeyProvider
+func (k StaticE2EKeys) PrivateKey() (*ecdh.PrivateKey, error) {
+	if k.Private == nil {
+		return nil, errors.New("e2e: no private key")
+	}
+	return k.Private, nil
+}
+
+// RecipientKeys implements E2EKeyProvider; it returns the keys for all filters matching topic
+func (k StaticE2EKeys) RecipientKeys(topic string) ([]*ecdh.PublicKey, error) {
+	var keys []*ecdh.PublicKey
+	for filter, fk := range k.Recipients {
+		if routeIncludesTopic(filter, topic) {
+			keys = append(keys, fk...)
+		}
+	}
+	return keys, nil
+}
+
+// E2EOptions configures E2EEncryption
+type E2EOptions struct {
+	Keys           E2EKeyProvider
+	Topics         []string                      // filters selecting the topics to which encryption applies (all topics if empty)
+	AllowPlaintext bool                          // deliver unencrypted payloads received on those topics (e.g. whilst publishers migrate)
+	OnError        func(topic string, err error) // called when a received message is discarded (nil to just log)
+}
+
+// E2EEncryption encrypts message payloads so that only the intended recipients can read them, independently of
+// TLS (so the broker, and anything else with access to it, sees only ciphertext). Each payload is encrypted with a
+// random AES-256-GCM key which is, in turn, encrypted for each recipient using a key derived (with HKDF-SHA256,
+// salted with both public keys) from an X25519 exchange between an ephemeral key and the recipient's public key. The topic is authenticated
+// along with the payload so a message cannot be replayed on a different topic. The MQTT headers (topic, QoS etc.)
+// are not encrypted, and the sender is not authenticated (any client holding a recipient's public key can encrypt
+// messages for it); combine with signing (e.g. in a PublishInterceptor) if that is required.
+//
+// The encrypted payload is: version (1 byte), the ephemeral public key (32), the number of recipients (1), for each
+// recipient the first 8 bytes of the SHA-256 hash of its public key followed by the encrypted content key (48), and
+// then the nonce (12) and the AES-GCM sealed payload. The additional data for the payload is everything preceding
+// the nonce followed by the topic; the content key for each recipient is sealed with a zero nonce (each key
+// encryption key is used once) and the recipient's key hash as additional data.
+type E2EEncryption struct {
+	keys           E2EKeyProvider
+	topics         []string
+	allowPlaintext bool
+	onError        func(topic string, err error)
+	logger         *slog.Logger
+}
+
+// NewE2EEncryption returns an E2EEncryption and adds interceptors to o (see SetPublishInterceptor and
+// SetInboundInterceptor) so that payloads published by the client that will be created with o are encrypted, and
+// those it receives are decrypted (messages that cannot be decrypted are discarded), on the selected topics. o must
+// be passed to NewClient after this is called.
+func NewE2EEncryption(o *ClientOptions, opts E2EOptions) (*E2EEncryption, error) {
+	if opts.Keys == nil {
+		return nil, errors.New("e2e: a key provider is required")
+	}
+	for _, f := range opts.Topics {
+		if err := ValidateTopicFilter(f); err != nil {
+			return nil, fmt.Errorf("e2e topic %q: %w", f, err)
+		}
+	}
+	e := &E2EEncryption{keys: opts.Keys, topics: opts.Topics, allowPlaintext: opts.AllowPlaintext, onError: opts.OnError, logger: o.Logger}
+	if e.logger == nil {
+		e.logger = slog.Default()
+	}
+	o.SetPublishInterceptor(append(o.PublishInterceptors, e.interceptPublish)...)
+	o.SetInboundInterceptor(append(o.InboundInterceptors, e.interceptInbound)...)
+	return e, nil
+}
+
+// applies returns true if encryption applies to topic
+func (e *E2EEncryption) applies(topic string) bool {
+	if len(e.topics) == 0 {
+		return true
+	}
+	for _, f := range e.topics {
+		if routeIncludesTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *E2EEncryption) interceptPublish(topic string, payload []byte) (string, []byte, error) {
+	if !e.applies(topic) {
+		return topic, payload, nil
+	}
+	enc, err := e.Encrypt(topic, payload)
+	return topic, enc, err
+}
+
+func (e *E2EEncryption) interceptInbound(topic string, payload []byte) (string, []byte, error) {
+	if !e.applies(topic) {
+		return topic, payload, nil
+	}
+	dec, err := e.Decrypt(topic, payload)
+	if errors.Is(err, ErrE2EPlaintext) && e.allowPlaintext {
+		return topic, payload, nil
+	}
+	if err != nil {
+		if e.onError != nil {
+			e.onError(topic, err)
+		} else {
+			e.logger.Warn("discarding message that could not be decrypted", slog.String("topic", topic), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		}
+		return "", nil, err
+	}
+	return topic, dec, nil
+}
+
+// Encrypt returns payload encrypted for the recipients of topic (see E2EKeyProvider.RecipientKeys). This is called
+// automatically for messages published by the client; it is exported for use with other transports.
+func (e *E2EEncryption) Encrypt(topic string, payload []byte) ([]byte, error) {
+	recipients, err := e.keys.RecipientKeys(topic)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: recipient keys: %w", err)
+	}
+	if len(recipients) == 0 {
+		return nil, ErrE2ENoRecipients
+	}
+	if len(recipients) > 255 {
+		return nil, fmt.Errorf("e2e: %d recipients exceeds the limit of 255", len(recipients))
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	contentKey := make([]byte, 32)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, e2eHeaderLen+len(recipients)*e2eRecipientLen+12+len(payload)+16)
+	out = append(out, e2eVersion)
+	out = append(out, ephemeral.PublicKey().Bytes()...)
+	out = append(out, byte(len(recipients)))
+	for _, r := range recipients {
+		id := e2eKeyID(r)
+		kek, err := e2eKEK(ephemeral, r, ephemeral.PublicKey(), r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, id...)
+		out = kek.Seal(out, make([]byte, kek.NonceSize()), contentKey, id)
+	}
+	aead, err := e2eAEAD(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ad := append(bytes.Clone(out), topic...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, payload, ad), nil
+}
+
+// Decrypt reverses Encrypt using this client's private key (see E2EKeyProvider.PrivateKey). ErrE2EPlaintext is
+// returned if payload is not encrypted and an error wrapping ErrE2EDecrypt if it cannot be decrypted.
+func (e *E2EEncryption) Decrypt(topic string, payload []byte) ([]byte, error) {
+	if len(payload) < e2eHeaderLen || payload[0] != e2eVersion {
+		return nil, ErrE2EPlaintext
+	}
+	n := int(payload[e2eHeaderLen-1])
+	bodyStart := e2eHeaderLen + n*e2eRecipientLen
+	if n == 0 || len(payload) < bodyStart+12+16 {
+		return nil, ErrE2EPlaintext
+	}
+	priv, err := e.keys.PrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("e2e: private key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(payload[1:33])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrE2EDecrypt, err)
+	}
+	id := e2eKeyID(priv.PublicKey())
+	var contentKey []byte
+	for i := 0; i < n && contentKey == nil; i++ {
+		entry := payload[e2eHeaderLen+i*e2eRecipientLen : e2eHeaderLen+(i+1)*e2eRecipientLen]
+		if !bytes.Equal(entry[:e2eKeyIDLen], id) {
+			continue
+		}
+		kek, err := e2eKEK(priv, ephemeral, ephemeral, priv.PublicKey())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrE2EDecrypt, err)
+		}
+		contentKey, _ = kek.Open(nil, make([]byte, kek.NonceSize()), entry[e2eKeyIDLen:], id)
+	}
+	if contentKey == nil {
+		return nil, fmt.Errorf("%w: not a recipient", ErrE2EDecrypt)
+	}
+	aead, err := e2eAEAD(contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrE2EDecrypt, err)
+	}
+	ad := append(bytes.Clone(payload[:bodyStart]), topic...)
+	nonce := payload[bodyStart : bodyStart+aead.NonceSize()]
+	out, err := aead.Open(nil, nonce, payload[bodyStart+aead.NonceSize():], ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrE2EDecrypt, err)
+	}
+	return out, nil
+}
+
+// e2eKeyID returns the identifier of a recipient's public key (the first 8 bytes of its SHA-256 hash)
+func e2eKeyID(pub *ecdh.PublicKey) []byte {
+	h := sha256.Sum256(pub.Bytes())
+	return h[:e2eKeyIDLen]
+}
+
+// e2eKEK returns the AEAD used to seal the content key for recipient; the shared secret between priv and peer (one
+// of which is the ephemeral key, the other the recipient's) is expanded using HKDF with the ephemeral and recipient
+// public keys as salt
+func e2eKEK(priv *ecdh.PrivateKey, peer, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(bytes.Clone(ephemeral.Bytes()), recipient.Bytes()...)
+	key, err := hkdf.Key(sha256.New, shared, salt, e2eInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	return e2eAEAD(key)
+}
+
+// e2eAEAD returns AES-256-GCM using key
+func e2eAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
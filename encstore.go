@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// encryptedTopic is the topic of the PUBLISH packets used to hold encrypted packets in the inner store
+const encryptedTopic = "$paho/encrypted"
+
+// EncryptedStore wraps another Store, encrypting packets (using AES-GCM) before they are passed to it. This means
+// that, for example, a FileStore will not hold plaintext payloads on disk. Keys are not encrypted (the client relies
+// upon their format). Each packet is held in the inner store as a PUBLISH packet (with the same message ID) whose
+// payload is the nonce followed by the sealed packet; the key is used as additional data so a stored packet cannot
+// be moved to a different key without detection.
+// A packet that cannot be decrypted (e.g. because the encryption key has changed) is logged and treated as missing.
+type EncryptedStore struct {
+	inner  Store
+	aead   cipher.AEAD
+	logger *slog.Logger
+}
+
+// NewEncryptedStore returns an EncryptedStore that stores packets in inner encrypted with key (which must be 16,
+// 24 or 32 bytes long to select AES-128, AES-192 or AES-256).
+func NewEncryptedStore(inner Store, key []byte) (*EncryptedStore, error) {
+	return NewEncryptedStoreEx(inner, key, nil)
+}
+
+// NewEncryptedStoreEx is as per NewEncryptedStore but with a custom logger.
+func NewEncryptedStoreEx(inner Store, key []byte, logger *slog.Logger) (*EncryptedStore, error) {
+	if logger == nil {
+		logger = noopSLogger
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted store: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted store: %w", err)
+	}
+	return &EncryptedStore{inner: inner, aead: aead, logger: logger}, nil
+}
+
+// Open opens the inner store
+func (store *EncryptedStore) Open() {
+	store.inner.Open()
+}
+
+// Put encrypts the message and stores it in the inner store, associated with the provided key
+func (store *EncryptedStore) Put(key string, m packets.ControlPacket) {
+	enc, err := store.encrypt(key, m)
+	if err != nil {
+		store.logger.Error("failed to encrypt message", slog.String("key", key), slog.String("error", err.Error()), slog.String("component", string(STR)))
+		return
+	}
+	store.inner.Put(key, enc)
+}
+
+// Get retrieves, and decrypts, the message associated with the provided key (nil if there is none or it cannot
+// be decrypted)
+func (store *EncryptedStore) Get(key string) packets.ControlPacket {
+	return store.decrypt(key, store.inner.Get(key))
+}
+
+// All returns the keys of all messages in the inner store
+func (store *EncryptedStore) All() []string {
+	return store.inner.All()
+}
+
+// Del removes the message associated with the provided key from the inner store
+func (store *EncryptedStore) Del(key string) {
+	store.inner.Del(key)
+}
+
+// Close closes the inner store
+func (store *EncryptedStore) Close() {
+	store.inner.Close()
+}
+
+// Reset removes all messages from the inner store
+func (store *EncryptedStore) Reset() {
+	store.inner.Reset()
+}
+
+// Update implements UpdatableStore; it is atomic if the inner store implements UpdatableStore.
+func (store *EncryptedStore) Update(key string, fn UpdateFunc) error {
+	return storeUpdate(store.inner, key, func(cur packets.ControlPacket) (packets.ControlPacket, error) {
+		next, err := fn(store.decrypt(key, cur))
+		if err != nil || next == nil {
+			return nil, err
+		}
+		return store.encrypt(key, next)
+	})
+}
+
+// encrypt returns a PUBLISH packet holding m sealed using key as additional data
+func (store *EncryptedStore) encrypt(key string, m packets.ControlPacket) (packets.ControlPacket, error) {
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, store.aead.NonceSize(), store.aead.NonceSize()+buf.Len()+store.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = encryptedTopic
+	p.Qos = 1 // so that the message ID is retained (stores may use it)
+	p.MessageID = m.Details().MessageID
+	p.Payload = store.aead.Seal(nonce, nonce, buf.Bytes(), []byte(key))
+	return p, nil
+}
+
+// decrypt reverses encrypt (returning nil if p is nil or cannot be decrypted)
+func (store *EncryptedStore) decrypt(key string, p packets.ControlPacket) packets.ControlPacket {
+	if p == nil {
+		return nil
+	}
+	pub, ok := p.(*packets.PublishPacket)
+	if !ok || pub.TopicName != encryptedTopic || len(pub.Payload) < store.aead.NonceSize() {
+		store.logger.Error("stored message is not encrypted", slog.String("key", key), slog.String("component", string(STR)))
+		return nil
+	}
+	nonce, sealed := pub.Payload[:store.aead.NonceSize()], pub.Payload[store.aead.NonceSize():]
+	plain, err := store.aead.Open(nil, nonce, sealed, []byte(key))
+	if err != nil {
+		store.logger.Error("failed to decrypt stored message", slog.String("key", key), slog.String("error", err.Error()), slog.String("component", string(STR)))
+		return nil
+	}
+	m, err := packets.ReadPacket(bytes.NewReader(plain))
+	if err != nil {
+		store.logger.Error("failed to decode stored message", slog.String("key", key), slog.String("error", err.Error()), slog.String("component", string(STR)))
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// ErrFailback is the reason passed to the connection lost handler when the client drops its
+// connection in order to reconnect to a higher priority broker (see SetFailbackInterval).
+var ErrFailback = errors.New("disconnecting to fail back to a higher priority broker")
+
+// failbackCheckTimeout bounds the check for a reachable higher priority broker when ConnectTimeout is 0 (which,
+// when connecting, means never time out)
+const failbackCheckTimeout = 30 * time.Second
+
+// brokersByPriority returns a copy of servers sorted by priority (highest first). The sort is stable
+// so, where priorities are equal, the order in which the brokers were added is retained.
+func brokersByPriority(servers []*url.URL, priority map[string]int) []*url.URL {
+	sorted := make([]*url.URL, len(servers))
+	copy(sorted, servers)
+	if len(priority) == 0 {
+		return sorted
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return priority[sorted[i].String()] > priority[sorted[j].String()]
+	})
+	return sorted
+}
+
+// preferredBrokers returns the brokers (highest priority first) that have a higher priority than current
+func preferredBrokers(servers []*url.URL, priority map[string]int, current *url.URL) []*url.URL {
+	currentPriority := priority[current.String()]
+	var preferred []*url.URL
+	for _, broker := range brokersByPriority(servers, priority) {
+		if priority[broker.String()] > currentPriority {
+			preferred = append(preferred, broker)
+		}
+	}
+	return preferred
+}
+
+// failback - periodically checks whether any of the preferred brokers are reachable and, if so, drops
+// the current connection (the reconnect logic will then connect to the highest priority broker available)
+func failback(c *client, preferred []*url.URL) {
+	defer c.workers.Done()
+	c.logger.Debug("failback starting", slog.Int("preferredBrokers", len(preferred)), slog.String("component", string(CLI)))
+	ticker := time.NewTicker(c.options.FailbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			c.logger.Debug("failback stopped", slog.String("component", string(CLI)))
+			return
+		case <-ticker.C:
+			for _, broker := range preferred {
+				if !c.brokerReachable(broker) {
+					continue
+				}
+				c.logger.Info("higher priority broker available, failing back", slog.String("broker", broker.String()), slog.String("component", string(CLI)))
+				c.internalConnLost(fmt.Errorf("%w (%s)", ErrFailback, broker)) // no harm in calling this if the connection is already down
+				return
+			}
+		}
+	}
+}
+
+// brokerReachable returns true if a network connection to the broker can be established (the connection
+// is closed immediately; no MQTT handshake is attempted so any existing session is not disturbed). The check
+// is abandoned (and false returned) if the connection is not established within ConnectTimeout (or
+// failbackCheckTimeout if that is 0) because the dialer may not honour the timeout.
+func (c *client) brokerReachable(broker *url.URL) bool {
+	c.optionsMu.Lock() // The options may be changed (e.g. by UpdateWill) whilst connected
+	tlsCfg := c.tlsConfigFor(broker)
+	onConnectAttempt := c.options.OnConnectAttempt
+	connTimeOut := c.options.ConnectTimeout
+	c.optionsMu.Unlock()
+	if onConnectAttempt != nil {
+		tlsCfg = onConnectAttempt(broker, tlsCfg)
+	}
+	if connTimeOut == 0 {
+		connTimeOut = failbackCheckTimeout
+	}
+
+	result := make(chan error, 1) // buffered so the goroutine can exit after a timeout
+	go func() {
+		conn, err := c.openNetConn(broker, tlsCfg, connTimeOut, 0)
+		if err == nil {
+			_ = conn.Close()
+		}
+		result <- err
+	}()
+	timer := c.clock.NewTimer(connTimeOut)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-result:
+	case <-timer.C():
+		err = fmt.Errorf("failback check was broken by %w", ErrTimeout)
+	}
+	if err != nil {
+		c.logger.Debug("failback check failed", slog.String("broker", broker.String()), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		return false
+	}
+	return true
+}
@@ -1,3 +1,5 @@
+//go:build !tinygo && !paho_nofilestore
+
 /*
  * Copyright (c) 2021 IBM Corp and others.
  *
@@ -19,13 +21,23 @@
 package mqtt
 
 import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/fs"
 	"log/slog"
 	"os"
 	"path"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
@@ -38,8 +50,24 @@ const (
 	// to confirm the store directory is usable. The leading dot and reserved name avoid any
 	// clash with real message files (whose keys have the form "i.<id>"/"o.<id>").
 	writeTestFile = ".paho-write-test" + tmpExt
+	// versionFile holds the format version of the messages in the directory (see FileStoreFormatVersion)
+	versionFile = ".paho-store-version"
 )
 
+// FileStoreFormatVersion is the version of the on-disk format written by FileStore. It is recorded in the store
+// directory when the store is opened (directories written before the version was recorded use version 1). Open
+// refuses to use a directory with a newer version; use CopyStore to migrate data between stores/formats.
+// Version 2 protects each message with a CRC32 checksum; version 1 messages are upgraded when the store is opened.
+const FileStoreFormatVersion = 2
+
+// fileHeader starts each message file written in format version 2 (and is followed by the CRC32 checksum of the
+// packet and then the packet itself). A version 1 file holds just the packet, and no MQTT packet starts with a zero
+// byte, so the formats can be told apart.
+var fileHeader = []byte{0x00, 'm', 'q', 't'}
+
+// errChecksumMismatch is returned when a stored message does not match its checksum (e.g. it was truncated)
+var errChecksumMismatch = errors.New("checksum mismatch")
+
 // FileStore implements the store interface using the filesystem to provide
 // true persistence, even across client failure. This is designed to use a
 // single directory per running client. If you are running multiple clients
@@ -50,8 +78,58 @@ type FileStore struct {
 	directory string
 	opened    bool
 	logger    *slog.Logger
+
+	maxMessages  int           // 0 = no limit; otherwise the maximum number of messages held in the directory
+	maxAge       time.Duration // 0 = no limit; otherwise messages older than this are removed
+	maxSize      int64         // 0 = no limit; otherwise the maximum total size (in bytes) of the messages held
+	limitMode    FileStoreLimitMode
+	limited      *list.List               // *fileStoreEntry for each message subject to the limits, oldest first
+	limitedKeys  map[string]*list.Element // key -> element of limited
+	limitedSize  int64                    // total size of the messages in limited
+	onDrop       FileStoreDropHandler
+	sync         FileStoreSync // how writes are flushed to stable storage
+	verifyOnOpen bool          // if true Open removes interrupted writes and archives unreadable messages
+}
+
+// FileStoreSync determines whether FileStore flushes changes to stable storage (fsync) before returning. Without
+// this, changes may be held in the operating system's cache, so may be lost (or, for messages being written,
+// truncated) if power is lost.
+type FileStoreSync int
+
+const (
+	// FileStoreSyncNone leaves flushing to the operating system (the default)
+	FileStoreSyncNone FileStoreSync = iota
+	// FileStoreSyncFile flushes each message file before it is renamed into place, so a message that is present
+	// following a power failure is complete
+	FileStoreSyncFile
+	// FileStoreSyncFull additionally flushes the directory after a message is added or removed, so the change
+	// itself survives a power failure (not supported on all platforms; e.g. it has no effect on Windows)
+	FileStoreSyncFull
+)
+
+// FileStoreLimitMode determines what a FileStore does when storing a message would exceed its limits (see
+// NewFileStoreWithLimits)
+type FileStoreLimitMode int
+
+const (
+	// FileStoreEvict evicts the oldest messages to make room for the new one (the default)
+	FileStoreEvict FileStoreLimitMode = iota
+	// FileStoreReject rejects the new message (it is not stored, and its key is passed to the drop handler)
+	FileStoreReject
+)
+
+// fileStoreEntry records a message that is subject to a FileStore's limits
+type fileStoreEntry struct {
+	key    string
+	stored time.Time
+	size   int64
 }
 
+// FileStoreDropHandler is called with the keys of any messages that were removed from
+// a FileStore (or rejected by it) because one of its limits (see NewFileStoreWithLimits) was exceeded.
+// It is called without the store lock held, so may safely call back into the store.
+type FileStoreDropHandler func(keys []string)
+
 // NewFileStore will create a new FileStore which stores its messages in the
 // directory provided.
 func NewFileStore(directory string) *FileStore {
@@ -77,10 +155,78 @@ func NewFileStoreEx(directory string, logger *slog.Logger) *FileStore {
 	return store
 }
 
-// Open will allow the FileStore to be used.
-func (store *FileStore) Open() {
+// NewFileStoreWithLimits will create a new FileStore which stores its messages in the
+// directory provided and caps the number, and age, of the messages held there.
+// maxMessages - if > 0, when a new message would exceed this limit the oldest message(s) are evicted
+// maxAge - if > 0, messages that were stored longer ago than this are evicted
+// Limits are applied when the store is opened, when a message is Put and when Compact is called.
+// Only messages buffered whilst offline (see ClientOptions.SetOfflineBuffer) are subject to the limits;
+// session state (in-flight messages and subscriptions) is never evicted as that would break the delivery
+// guarantees. Note that evicted messages are lost (they will not be sent following a reconnection); use
+// SetDropHandler to be notified when this happens and SetLimitMode to reject new messages instead.
+func NewFileStoreWithLimits(directory string, maxMessages int, maxAge time.Duration) *FileStore {
+	store := NewFileStore(directory)
+	store.maxMessages = maxMessages
+	store.maxAge = maxAge
+	return store
+}
+
+// SetDropHandler sets a function that will be called with the keys of any messages
+// evicted from the store due to its limits being exceeded.
+func (store *FileStore) SetDropHandler(h FileStoreDropHandler) {
 	store.Lock()
 	defer store.Unlock()
+	store.onDrop = h
+}
+
+// SetLimitMode sets whether older messages are evicted (FileStoreEvict, the default) or new messages are rejected
+// (FileStoreReject) when storing a message would exceed the store's limits. Messages older than the maximum age are
+// removed in either mode.
+func (store *FileStore) SetLimitMode(mode FileStoreLimitMode) {
+	store.Lock()
+	defer store.Unlock()
+	store.limitMode = mode
+}
+
+// SetMaxSize limits the total size (in bytes) of the messages subject to the store's limits (see
+// NewFileStoreWithLimits); 0 (the default) means there is no limit. A message that is larger than this on its
+// own is always rejected.
+func (store *FileStore) SetMaxSize(bytes int64) {
+	store.Lock()
+	defer store.Unlock()
+	store.maxSize = bytes
+}
+
+// SetSync sets how changes are flushed to stable storage (FileStoreSyncNone by default). Flushing improves
+// durability at the cost of write latency (which can be significant on flash storage).
+func (store *FileStore) SetSync(mode FileStoreSync) {
+	store.Lock()
+	defer store.Unlock()
+	store.sync = mode
+}
+
+// SetVerifyOnOpen sets whether Open checks the messages held in the directory. When enabled, temporary files left
+// by writes that were interrupted (e.g. by power loss) are removed and any message that cannot be read is archived
+// (with the extension ".CORRUPT") immediately, rather than when the message is next retrieved. Note that this reads
+// every message in the directory.
+func (store *FileStore) SetVerifyOnOpen(verify bool) {
+	store.Lock()
+	defer store.Unlock()
+	store.verifyOnOpen = verify
+}
+
+// Open will allow the FileStore to be used.
+func (store *FileStore) Open() {
+	dropped := func() []string {
+		store.Lock()
+		defer store.Unlock()
+		return store.open()
+	}()
+	store.notifyDropped(dropped)
+}
+
+// lockless
+func (store *FileStore) open() []string {
 	// if no store directory was specified in ClientOpts, by default use the
 	// current working directory
 	if store.directory == "" {
@@ -102,9 +248,19 @@ func (store *FileStore) Open() {
 	// does not allow Open to return an error, so we fail fast by panicking if the directory is
 	// unusable. See https://github.com/eclipse-paho/paho.mqtt.golang/issues/720.
 	verifyReadWrite(store.directory)
+	version := checkFileStoreVersion(store.directory)
 
 	store.opened = true
 	store.logger.Debug("store is opened", slog.String("directory", store.directory), slog.String("component", string(STR)))
+	if version < FileStoreFormatVersion {
+		store.upgrade() // version is recorded once complete so, if interrupted, the upgrade will be repeated
+		writeFileStoreVersion(store.directory)
+	}
+	if store.verifyOnOpen {
+		store.verify()
+	}
+	store.index()
+	return store.compact(0, 0)
 }
 
 // Close will disallow the FileStore from being used.
@@ -117,18 +273,33 @@ func (store *FileStore) Close() {
 
 // Put will put a message into the store, associated with the provided
 // key value.
+// If the store has limits (see NewFileStoreWithLimits) then older messages may be evicted
+// to make room for this one.
 func (store *FileStore) Put(key string, m packets.ControlPacket) {
-	store.Lock()
-	defer store.Unlock()
-	if !store.opened {
-		store.logger.Error("Trying to use file store, but not open", slog.String("component", string(STR)))
-		return
-	}
-	full := fullpath(store.directory, key)
-	write(store.directory, key, m)
-	if !exists(full) {
-		store.logger.Error("file not created", slog.String("path", full), slog.String("component", string(STR)))
-	}
+	dropped := func() []string {
+		store.Lock()
+		defer store.Unlock()
+		return store.put(key, m)
+	}()
+	store.notifyDropped(dropped)
+}
+
+// Compact applies the stores limits (see NewFileStoreWithLimits), removing any messages that
+// are too old or exceed the maximum count or size. The directory is rescanned, so changes made
+// by other processes are taken into account. It returns the keys of the messages removed.
+func (store *FileStore) Compact() []string {
+	dropped := func() []string {
+		store.Lock()
+		defer store.Unlock()
+		if !store.opened {
+			store.logger.Error("trying to use file store, but not open", slog.String("component", string(STR)))
+			return nil
+		}
+		store.index()
+		return store.compact(0, 0)
+	}()
+	store.notifyDropped(dropped)
+	return dropped
 }
 
 // Get will retrieve a message from the store, the one associated with
@@ -136,6 +307,66 @@ func (store *FileStore) Put(key string, m packets.ControlPacket) {
 func (store *FileStore) Get(key string) packets.ControlPacket {
 	store.RLock()
 	defer store.RUnlock()
+	return store.get(key)
+}
+
+// Update atomically replaces the message associated with key with the result of fn (see UpdatableStore). The new
+// message is written to a temporary file which is then renamed so, following a crash, either the old or the new
+// message will be present.
+func (store *FileStore) Update(key string, fn UpdateFunc) error {
+	var dropped []string
+	err := func() error {
+		store.Lock()
+		defer store.Unlock()
+		if !store.opened {
+			store.logger.Error("trying to use file store, but not open", slog.String("component", string(STR)))
+			return ErrStoreClosed
+		}
+		next, err := fn(store.get(key))
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			if exists(fullpath(store.directory, key)) {
+				store.del(key)
+			}
+			return nil
+		}
+		dropped = store.put(key, next)
+		return nil
+	}()
+	store.notifyDropped(dropped)
+	return err
+}
+
+// lockless
+// verify removes temporary files left by interrupted writes and archives messages that cannot be read
+func (store *FileStore) verify() {
+	entries, err := os.ReadDir(store.directory)
+	chkerr(err)
+	var corrupt int
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, tmpExt):
+			store.logger.Warn("removing incomplete write", slog.String("name", name), slog.String("component", string(STR)))
+			if err := os.Remove(path.Join(store.directory, name)); err != nil {
+				store.logger.Error("failed to remove incomplete write", slog.String("error", err.Error()), slog.String("component", string(STR)))
+			}
+		case strings.HasSuffix(name, msgExt):
+			if store.get(name[:len(name)-len(msgExt)]) == nil {
+				corrupt++ // get will have archived the file
+			}
+		}
+	}
+	if corrupt > 0 {
+		store.logger.Warn("unreadable messages archived", slog.Int("count", corrupt), slog.String("component", string(STR)))
+	}
+	store.syncDir()
+}
+
+// lockless
+func (store *FileStore) get(key string) packets.ControlPacket {
 	if !store.opened {
 		store.logger.Error("trying to use file store, but not open", slog.String("component", string(STR)))
 		return nil
@@ -151,6 +382,7 @@ func (store *FileStore) Get(key string) packets.ControlPacket {
 		// treat this as a problem with this individual file: archive it out of the way and carry on
 		// rather than panicking and bringing down a (potentially long-running, unattended) client.
 		// See https://github.com/eclipse-paho/paho.mqtt.golang/issues/720.
+		store.untrack(key)
 		newpath := corruptpath(store.directory, key)
 		store.logger.Error("failed to open stored message; archiving and skipping", slog.String("error", oerr.Error()), slog.String("archived at", newpath), slog.String("component", string(STR)))
 		if archiveErr := os.Rename(filepath, newpath); archiveErr != nil {
@@ -158,11 +390,12 @@ func (store *FileStore) Get(key string) packets.ControlPacket {
 		}
 		return nil
 	}
-	msg, rerr := packets.ReadPacket(mfile)
+	msg, rerr := readMessage(mfile)
 	chkerr(mfile.Close())
 
 	// Message was unreadable, return nil
 	if rerr != nil {
+		store.untrack(key)
 		newpath := corruptpath(store.directory, key)
 		store.logger.Info("corrupted file detected", slog.String("error", rerr.Error()), slog.String("archived at", newpath), slog.String("component", string(STR)))
 		if err := os.Rename(filepath, newpath); err != nil {
@@ -173,6 +406,37 @@ func (store *FileStore) Get(key string) packets.ControlPacket {
 	return msg
 }
 
+// lockless
+// upgrade rewrites messages written in format version 1 so that they are protected by a checksum. The modification
+// time of each file (which determines the order in which messages are resent) is retained.
+func (store *FileStore) upgrade() {
+	var upgraded int
+	for _, key := range store.all() {
+		full := fullpath(store.directory, key)
+		info, err := os.Stat(full)
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(full)
+		if err != nil || len(b) == 0 || b[0] == fileHeader[0] {
+			continue // already upgraded (or unreadable, in which case it will be archived when retrieved)
+		}
+		m, err := packets.ReadPacket(bytes.NewReader(b))
+		if err != nil {
+			continue
+		}
+		write(store.directory, key, m, store.sync >= FileStoreSyncFile)
+		if err := os.Chtimes(full, info.ModTime(), info.ModTime()); err != nil {
+			store.logger.Warn("failed to retain message time", slog.String("key", key), slog.String("error", err.Error()), slog.String("component", string(STR)))
+		}
+		upgraded++
+	}
+	store.syncDir()
+	if upgraded > 0 {
+		store.logger.Info("messages upgraded", slog.Int("count", upgraded), slog.Int("version", FileStoreFormatVersion), slog.String("component", string(STR)))
+	}
+}
+
 // All will provide a list of all of the keys associated with messages
 // currently residing in the FileStore.
 func (store *FileStore) All() []string {
@@ -189,6 +453,34 @@ func (store *FileStore) Del(key string) {
 	store.del(key)
 }
 
+// Discard removes all persisted messages, and the recorded format version, from the FileStore directory; it may be
+// called whether or not the store is open. Files that have been archived as corrupt are retained.
+func (store *FileStore) Discard() error {
+	store.Lock()
+	defer store.Unlock()
+	entries, err := os.ReadDir(store.directory)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var errs []error
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == versionFile || strings.HasSuffix(name, msgExt) || strings.HasSuffix(name, tmpExt) {
+			if err := os.Remove(path.Join(store.directory, name)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if store.opened {
+		store.index()
+	}
+	store.logger.Info("FileStore discarded", slog.String("directory", store.directory), slog.String("component", string(STR)))
+	return errors.Join(errs...)
+}
+
 // Reset will remove all persisted messages from the FileStore.
 func (store *FileStore) Reset() {
 	store.Lock()
@@ -231,12 +523,138 @@ func (store *FileStore) all() []string {
 	return keys
 }
 
+// lockless
+// index records the messages in the directory that are subject to the limits (see isKeyEvictable), oldest first
+func (store *FileStore) index() {
+	store.limited = list.New()
+	store.limitedKeys = make(map[string]*list.Element)
+	store.limitedSize = 0
+	entries, err := os.ReadDir(store.directory)
+	chkerr(err)
+	files := make(fileInfos, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, msgExt) || !isKeyEvictable(name[:len(name)-len(msgExt)]) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil { // file may have been removed in the interim
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.Sort(files)
+	for _, f := range files {
+		store.track(&fileStoreEntry{key: f.Name()[:len(f.Name())-len(msgExt)], stored: f.ModTime(), size: f.Size()})
+	}
+}
+
+// lockless
+// track records that the message e (which is subject to the limits) has been stored, replacing any existing record
+func (store *FileStore) track(e *fileStoreEntry) {
+	store.untrack(e.key)
+	store.limitedKeys[e.key] = store.limited.PushBack(e)
+	store.limitedSize += e.size
+}
+
+// lockless
+// untrack removes the record of the message held under key (if any)
+func (store *FileStore) untrack(key string) {
+	if el, ok := store.limitedKeys[key]; ok {
+		store.limitedSize -= store.limited.Remove(el).(*fileStoreEntry).size
+		delete(store.limitedKeys, key)
+	}
+}
+
+// lockless
+// exceeds returns true if storing a further count messages, totalling size bytes, would exceed the limits
+func (store *FileStore) exceeds(count int, size int64) bool {
+	return (store.maxMessages > 0 && store.limited.Len()+count > store.maxMessages) ||
+		(store.maxSize > 0 && store.limitedSize+size > store.maxSize)
+}
+
+// lockless
+// compact removes messages older than maxAge and then, in FileStoreEvict mode, the oldest messages until there
+// is room for a further count messages totalling size bytes. Returns the keys of the removed messages.
+func (store *FileStore) compact(count int, size int64) []string {
+	var dropped []string
+	now := time.Now()
+	for el := store.limited.Front(); el != nil; el = store.limited.Front() {
+		e := el.Value.(*fileStoreEntry)
+		expired := store.maxAge > 0 && now.Sub(e.stored) > store.maxAge
+		if !expired && (store.limitMode == FileStoreReject || !store.exceeds(count, size)) {
+			break // entries are held oldest first so nothing further to do
+		}
+		store.untrack(e.key)
+		if rerr := os.Remove(fullpath(store.directory, e.key)); rerr != nil {
+			if !errors.Is(rerr, fs.ErrNotExist) {
+				store.logger.Error("failed to evict message", slog.String("key", e.key), slog.String("error", rerr.Error()), slog.String("component", string(STR)))
+			}
+			continue
+		}
+		store.logger.Warn("message evicted due to store limits", slog.String("key", e.key), slog.Bool("expired", expired), slog.String("component", string(STR)))
+		dropped = append(dropped, e.key)
+	}
+	if len(dropped) > 0 {
+		store.syncDir()
+	}
+	return dropped
+}
+
+// notifyDropped passes the keys of evicted messages to the drop handler (if any). Must be called without the lock held.
+func (store *FileStore) notifyDropped(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	store.RLock()
+	h := store.onDrop
+	store.RUnlock()
+	if h != nil {
+		h(keys)
+	}
+}
+
+// lockless
+// put writes the message to the store (evicting older messages, or rejecting this one, if required) and returns the
+// keys of any evicted or rejected messages
+func (store *FileStore) put(key string, m packets.ControlPacket) []string {
+	if !store.opened {
+		store.logger.Error("Trying to use file store, but not open", slog.String("component", string(STR)))
+		return nil
+	}
+	full := fullpath(store.directory, key)
+	data := encodeMessage(m)
+	var dropped []string
+	if isKeyEvictable(key) {
+		_, replacing := store.limitedKeys[key]
+		store.untrack(key) // the message being replaced (if any) does not count against the limits
+		dropped = store.compact(1, int64(len(data)))
+		if store.exceeds(1, int64(len(data))) {
+			store.logger.Warn("message rejected due to store limits", slog.String("key", key), slog.String("component", string(STR)))
+			if replacing {
+				store.del(key)
+			}
+			return append(dropped, key)
+		}
+	}
+	writeFile(store.directory, key, data, store.sync >= FileStoreSyncFile)
+	store.syncDir()
+	if isKeyEvictable(key) {
+		store.track(&fileStoreEntry{key: key, stored: time.Now(), size: int64(len(data))})
+	}
+	if !exists(full) {
+		store.logger.Error("file not created", slog.String("path", full), slog.String("component", string(STR)))
+	}
+	return dropped
+}
+
 // lockless
 func (store *FileStore) del(key string) {
 	if !store.opened {
 		store.logger.Error("trying to use file store, but not open", slog.String("component", string(STR)))
 		return
 	}
+	store.untrack(key)
 	store.logger.Debug("store del filepath", slog.String("directory", store.directory), slog.String("component", string(STR)))
 	store.logger.Debug("store delete key", slog.String("key", key), slog.String("component", string(STR)))
 	filepath := fullpath(store.directory, key)
@@ -247,12 +665,32 @@ func (store *FileStore) del(key string) {
 	}
 	rerr := os.Remove(filepath)
 	chkerr(rerr)
+	store.syncDir()
 	store.logger.Debug("del msg", slog.String("key", key), slog.String("component", string(STR)))
 	if exists(filepath) {
 		store.logger.Error("file not deleted", slog.String("filepath", filepath), slog.String("component", string(STR)))
 	}
 }
 
+// lockless
+// syncDir flushes the directory to stable storage (if FileStoreSyncFull is set) so that files that have been
+// created, renamed or removed remain so following a power failure
+func (store *FileStore) syncDir() {
+	if store.sync < FileStoreSyncFull || runtime.GOOS == "windows" { // Windows does not support syncing directories
+		return
+	}
+	d, err := os.Open(store.directory)
+	if err == nil {
+		err = d.Sync()
+		if cerr := d.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		store.logger.Warn("failed to sync store directory", slog.String("error", err.Error()), slog.String("component", string(STR)))
+	}
+}
+
 func fullpath(store string, key string) string {
 	p := path.Join(store, key+msgExt)
 	return p
@@ -273,18 +711,57 @@ func corruptpath(store string, key string) string {
 // rename it to "X.[messageid].msg", overwriting any existing
 // message with the same id
 // X will be 'i' for inbound messages, and O for outbound messages
-func write(store, key string, m packets.ControlPacket) {
+// If flush is true the file is flushed to stable storage before being renamed
+func write(store, key string, m packets.ControlPacket, flush bool) {
+	writeFile(store, key, encodeMessage(m), flush)
+}
+
+// encodeMessage returns the contents of the file holding m (a header, the CRC32 checksum of the packet and then
+// the packet itself)
+func encodeMessage(m packets.ControlPacket) []byte {
+	var buf bytes.Buffer
+	chkerr(m.Write(&buf))
+	data := make([]byte, len(fileHeader)+4, len(fileHeader)+4+buf.Len())
+	copy(data, fileHeader)
+	binary.BigEndian.PutUint32(data[len(fileHeader):], crc32.ChecksumIEEE(buf.Bytes()))
+	return append(data, buf.Bytes()...)
+}
+
+// writeFile writes data (see encodeMessage) to the file for key as per write
+func writeFile(store, key string, data []byte, flush bool) {
 	temppath := tmppath(store, key)
 	f, err := os.Create(temppath)
 	chkerr(err)
-	werr := m.Write(f)
+	_, werr := f.Write(data)
 	chkerr(werr)
+	if flush {
+		chkerr(f.Sync())
+	}
 	cerr := f.Close()
 	chkerr(cerr)
 	rerr := os.Rename(temppath, fullpath(store, key))
 	chkerr(rerr)
 }
 
+// readMessage reads a packet written by write (or, in format version 1, by packet.Write), verifying its checksum
+func readMessage(r io.Reader) (packets.ControlPacket, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && b[0] == fileHeader[0] {
+		if len(b) < len(fileHeader)+4 || !bytes.Equal(b[:len(fileHeader)], fileHeader) {
+			return nil, errors.New("invalid message header")
+		}
+		sum := binary.BigEndian.Uint32(b[len(fileHeader):])
+		b = b[len(fileHeader)+4:]
+		if crc32.ChecksumIEEE(b) != sum {
+			return nil, errChecksumMismatch
+		}
+	}
+	return packets.ReadPacket(bytes.NewReader(b))
+}
+
 // verifyReadWrite confirms that the store directory is usable by writing, reading back and then
 // removing a temporary file. It panics if any of those steps fail. The Store interface does not
 // allow Open to return an error, and failing fast at startup (when an operator is most likely to
@@ -304,6 +781,49 @@ func verifyReadWrite(directory string) {
 	}
 }
 
+// ReadFileStoreVersion returns the format version recorded in a FileStore directory, or 0 if none is recorded
+// (i.e. the store has never been opened or was written before versions were recorded, in which case the format is
+// version 1).
+func ReadFileStoreVersion(directory string) (int, error) {
+	data, err := os.ReadFile(path.Join(directory, versionFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid file store version %q: %w", data, err)
+	}
+	return v, nil
+}
+
+// checkFileStoreVersion panics if the directory holds messages in a format newer than FileStoreFormatVersion;
+// otherwise it returns the version recorded in the directory (0 if none).
+// As with verifyReadWrite, the Store interface does not allow Open to return an error so we fail fast.
+func checkFileStoreVersion(directory string) int {
+	v, err := ReadFileStoreVersion(directory)
+	if err != nil {
+		panic(fmt.Errorf("file store directory %q: %w", directory, err))
+	}
+	if v > FileStoreFormatVersion {
+		panic(fmt.Errorf("file store directory %q uses format version %d (only %d or earlier is supported)", directory, v, FileStoreFormatVersion))
+	}
+	return v
+}
+
+// writeFileStoreVersion records FileStoreFormatVersion in the directory (panicking on failure)
+func writeFileStoreVersion(directory string) {
+	tmp := path.Join(directory, versionFile+tmpExt)
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(FileStoreFormatVersion)+"\n"), 0600); err != nil {
+		panic(fmt.Errorf("file store directory %q: writing version: %w", directory, err))
+	}
+	if err := os.Rename(tmp, path.Join(directory, versionFile)); err != nil {
+		panic(fmt.Errorf("file store directory %q: writing version: %w", directory, err))
+	}
+}
+
 func exists(file string) bool {
 	if _, err := os.Stat(file); err != nil {
 		if os.IsNotExist(err) {
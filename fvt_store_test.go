@@ -23,7 +23,9 @@ import (
 	"io/ioutil"
 	"os"
 	"runtime"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
@@ -473,6 +475,74 @@ func Test_FileStore_Reset(t *testing.T) {
 	}
 }
 
+func Test_FileStore_Limits_MaxMessages(t *testing.T) {
+	storedir := t.TempDir()
+	f := NewFileStoreWithLimits(storedir, 2, 0)
+	var dropped []string
+	f.SetDropHandler(func(keys []string) { dropped = append(dropped, keys...) })
+	f.Open()
+
+	for i := uint16(1); i <= 3; i++ {
+		pm := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pm.Qos = 1
+		pm.TopicName = "a/b/c"
+		pm.MessageID = i
+		key := forwardPrefix + strconv.Itoa(int(i))
+		f.Put(key, pm)
+		// Ensure each message has a distinct modification time (ordering is based upon this)
+		ts := time.Now().Add(time.Duration(int(i)-10) * time.Second)
+		if err := os.Chtimes(fullpath(storedir, key), ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(dropped) != 1 || dropped[0] != "f.1" {
+		t.Fatalf("expected f.1 to be dropped, got %v", dropped)
+	}
+	if keys := f.All(); len(keys) != 2 {
+		t.Fatalf("expected 2 messages in store, got %v", keys)
+	}
+
+	// Replacing an existing message must not trigger an eviction
+	pm := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pm.Qos = 1
+	pm.TopicName = "a/b/c"
+	pm.MessageID = 3
+	f.Put(forwardPrefix+"3", pm)
+	if len(dropped) != 1 {
+		t.Fatalf("unexpected eviction on replace, dropped %v", dropped)
+	}
+}
+
+func Test_FileStore_Limits_MaxAge(t *testing.T) {
+	storedir := t.TempDir()
+	f := NewFileStoreWithLimits(storedir, 0, time.Minute)
+	f.Open()
+
+	for i := uint16(1); i <= 2; i++ {
+		pm := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pm.Qos = 1
+		pm.TopicName = "a/b/c"
+		pm.MessageID = i
+		f.Put(forwardPrefix+strconv.Itoa(int(i)), pm)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(fullpath(storedir, "f.1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := f.Compact()
+	if len(dropped) != 1 || dropped[0] != "f.1" {
+		t.Fatalf("expected f.1 to be dropped, got %v", dropped)
+	}
+	if exists(fullpath(storedir, "f.1")) {
+		t.Fatalf("expired message still in store")
+	}
+	if !exists(fullpath(storedir, "f.2")) {
+		t.Fatalf("unexpired message removed from store")
+	}
+}
+
 /*******************
  *** MemoryStore ***
  *******************/
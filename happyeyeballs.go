@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// racingDialer establishes TCP connections by racing attempts to the addresses that a host resolves to (a
+// simplified form of RFC 8305 "Happy Eyeballs"). Addresses are tried alternating between IPv6 and IPv4; each
+// attempt starts stagger after the previous one (or as soon as it fails) and the first connection established
+// is used (any other attempts are cancelled). This avoids long delays when one address (often IPv6) is
+// unreachable, as net.Dialer tries addresses of the same family one after another.
+type racingDialer struct {
+	dialer  *net.Dialer
+	stagger time.Duration
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, error) // nil to use dialer.Resolver
+}
+
+func (d *racingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *racingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if d.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialer.Timeout)
+		defer cancel()
+	}
+	lookup := d.lookup
+	if lookup == nil {
+		resolver := d.dialer.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		lookup = resolver.LookupIPAddr
+	}
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := interleaveAddrs(ips)
+	dialer := *d.dialer
+	dialer.Timeout = 0 // ctx applies the timeout to the whole operation
+	if len(addrs) == 1 {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0].String(), port))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- result{conn: conn, err: err}
+		}()
+	}
+	start()
+	stagger := time.NewTimer(d.stagger)
+	defer stagger.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) { // close any connections established by attempts still in progress
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) { // start the next attempt immediately
+				start()
+				stagger.Reset(d.stagger)
+			}
+		case <-stagger.C:
+			if next < len(addrs) {
+				start()
+				stagger.Reset(d.stagger)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// interleaveAddrs orders ips so that address families alternate, starting with the family of the first address
+// (as per RFC 8305 section 4)
+func interleaveAddrs(ips []net.IPAddr) []net.IPAddr {
+	if len(ips) == 0 {
+		return ips
+	}
+	var first, second []net.IPAddr
+	firstIs4 := ips[0].IP.To4() != nil
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			addrs = append(addrs, first[i])
+		}
+		if i < len(second) {
+			addrs = append(addrs, second[i])
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"math/rand/v2"
+	"sort"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// MessageIDAllocator chooses the message ID used for each new QoS 1/2 PUBLISH, SUBSCRIBE and UNSUBSCRIBE flow
+// (see ClientOptions.SetMessageIDAllocator). Next is passed the most recently issued ID and a function reporting
+// whether an ID is currently in use; it returns an ID that is not in use (or 0 if none is available).
+// Next is called with the client's message ID lock held, so must not call into the client.
+type MessageIDAllocator interface {
+	Next(last uint16, inUse func(id uint16) bool) uint16
+}
+
+// NewSequentialIDAllocator returns a MessageIDAllocator that issues the first free ID following the most recently
+// issued ID (wrapping at 65535). This is the default and means that IDs are not immediately reused (which makes
+// tracing flows simpler).
+func NewSequentialIDAllocator() MessageIDAllocator {
+	return rangeIDAllocator{min: midMin, max: midMax}
+}
+
+// NewRangeIDAllocator returns a MessageIDAllocator that issues IDs between min and max (inclusive) in sequence. This
+// allows the ID space to be partitioned (for example, so that IDs used by a bridge can be told apart from those
+// used by another client with the same session). Note that this limits the number of concurrent flows.
+func NewRangeIDAllocator(min, max uint16) MessageIDAllocator {
+	if min < midMin {
+		min = midMin
+	}
+	if max < min {
+		max = min
+	}
+	return rangeIDAllocator{min: min, max: max}
+}
+
+// NewRandomIDAllocator returns a MessageIDAllocator that issues free IDs at random. This reduces the chance that an
+// ID is reused soon after it was freed, which can be helpful with brokers whose duplicate detection is unreliable.
+func NewRandomIDAllocator() MessageIDAllocator {
+	return randomIDAllocator{}
+}
+
+// ReserveIDs returns a MessageIDAllocator that never issues IDs between min and max (inclusive) but otherwise
+// issues the IDs that a would (a may be nil, meaning NewSequentialIDAllocator).
+func ReserveIDs(a MessageIDAllocator, min, max uint16) MessageIDAllocator {
+	if a == nil {
+		a = NewSequentialIDAllocator()
+	}
+	return reservedIDAllocator{MessageIDAllocator: a, min: min, max: max}
+}
+
+// rangeIDAllocator issues IDs between min and max in sequence
+type rangeIDAllocator struct {
+	min, max uint16
+}
+
+// Next implements MessageIDAllocator
+func (r rangeIDAllocator) Next(last uint16, inUse func(uint16) bool) uint16 {
+	if last < r.min || last >= r.max {
+		last = r.max // so the search starts at min
+	}
+	i := last
+	for {
+		if i >= r.max {
+			i = r.min
+		} else {
+			i++
+		}
+		if !inUse(i) {
+			return i
+		}
+		if i == last {
+			return 0 // no free ids
+		}
+	}
+}
+
+// randomIDAllocator picks a random starting point and issues the first free ID from there
+type randomIDAllocator struct{}
+
+// Next implements MessageIDAllocator
+func (randomIDAllocator) Next(_ uint16, inUse func(uint16) bool) uint16 {
+	start := uint16(rand.N(uint32(midMax))) + midMin
+	return rangeIDAllocator{min: midMin, max: midMax}.Next(start-1, inUse)
+}
+
+// reservedIDAllocator wraps a MessageIDAllocator so that IDs between min and max are never issued
+type reservedIDAllocator struct {
+	MessageIDAllocator
+	min, max uint16
+}
+
+// Next implements MessageIDAllocator
+func (r reservedIDAllocator) Next(last uint16, inUse func(uint16) bool) uint16 {
+	return r.MessageIDAllocator.Next(last, func(id uint16) bool {
+		return (id >= r.min && id <= r.max) || inUse(id)
+	})
+}
+
+// InflightID describes a message ID that is in use (see InflightInspector)
+type InflightID struct {
+	ID   uint16
+	Type byte // packets.Publish, packets.Subscribe or packets.Unsubscribe (0 if the flow type is not known)
+}
+
+// InflightIDs returns the message IDs in use by flows that have not yet completed, ordered by ID
+func (c *client) InflightIDs() []InflightID {
+	return c.messageIds.inflight()
+}
+
+// inflight returns details of the message IDs that are in use, ordered by ID
+func (mids *messageIds) inflight() []InflightID {
+	mids.mu.RLock()
+	ids := make([]InflightID, 0, len(mids.index))
+	for id, token := range mids.index {
+		var typ byte
+		switch token.(type) {
+		case *PublishToken:
+			typ = packets.Publish
+		case *SubscribeToken:
+			typ = packets.Subscribe
+		case *UnsubscribeToken:
+			typ = packets.Unsubscribe
+		}
+		ids = append(ids, InflightID{ID: id, Type: typ})
+	}
+	mids.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i].ID < ids[j].ID })
+	return ids
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// inflightWindow limits the number of QoS 1/2 publishes awaiting acknowledgement (see ClientOptions.SetMaxInflight)
+// A nil *inflightWindow imposes no limit.
+type inflightWindow struct {
+	sem  *semaphore.Weighted // Weighted semaphore rather than a channel because this retains ordering
+	used atomic.Int32
+}
+
+// newInflightWindow returns a window allowing max outstanding messages (or nil if max <= 0)
+func newInflightWindow(max int) *inflightWindow {
+	if max <= 0 {
+		return nil
+	}
+	return &inflightWindow{sem: semaphore.NewWeighted(int64(max))}
+}
+
+// acquire blocks until there is space in the window for the publish associated with token; the space is released
+// when the token completes (regardless of the outcome). If stop is closed (the connection is lost or the client
+// disconnected) before space becomes available an error wrapping ErrConnectionLost is returned.
+func (w *inflightWindow) acquire(stop <-chan struct{}, token *PublishToken) error {
+	if w == nil || w.tryAcquire(token) {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := w.sem.Acquire(ctx, 1); err != nil {
+		return fmt.Errorf("%w whilst waiting for space in the in-flight window", ErrConnectionLost)
+	}
+	w.track(token)
+	return nil
+}
+
+// track records that token occupies a slot in the window, releasing it when the token completes
+func (w *inflightWindow) track(token *PublishToken) {
+	w.used.Add(1)
+	token.OnComplete(func(error) {
+		w.used.Add(-1)
+		w.sem.Release(1)
+	})
+}
+
+// tryAcquire is as per acquire but returns false, rather than blocking, if the window is full
+func (w *inflightWindow) tryAcquire(token *PublishToken) bool {
+	if w == nil {
+		return true
+	}
+	if !w.sem.TryAcquire(1) {
+		return false
+	}
+	w.track(token)
+	return true
+}
+
+// inUse returns the number of publishes currently occupying the window
+func (w *inflightWindow) inUse() int {
+	if w == nil {
+		return 0
+	}
+	return int(w.used.Load())
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrIntercepted is wrapped by the error set on the token when a PublishInterceptor rejects a message
+var ErrIntercepted = errors.New("rejected by interceptor")
+
+// PublishInterceptor is called with the topic and payload of each message published (see SetPublishInterceptor)
+// before the PUBLISH packet is built, and returns the topic and payload to be sent in their place; this allows,
+// for example, payloads to be encrypted, signed or validated against a schema, or topics to be rewritten, in one
+// place. Returning an error rejects the message (the error is set on the token returned by Publish). The payload
+// must not be modified in place (it may be the slice passed to Publish).
+type PublishInterceptor func(topic string, payload []byte) (string, []byte, error)
+
+// InboundInterceptor is the counterpart of PublishInterceptor for received messages (see SetInboundInterceptor).
+// It is called before the message is routed to a handler, so a rewritten topic is used to select the handler.
+// Returning an error discards the message (it is acknowledged, so will not be redelivered).
+type InboundInterceptor func(topic string, payload []byte) (string, []byte, error)
+
+// interceptPublish passes topic and payload through the PublishInterceptors in turn
+func (c *client) interceptPublish(topic string, payload []byte) (string, []byte, error) {
+	for _, i := range c.options.PublishInterceptors {
+		var err error
+		if topic, payload, err = i(topic, payload); err != nil {
+			return "", nil, fmt.Errorf("%w: %w", ErrIntercepted, err)
+		}
+	}
+	if len(c.options.PublishInterceptors) > 0 {
+		if err := ValidateTopicName(topic); err != nil {
+			return "", nil, fmt.Errorf("interceptor returned invalid topic %q: %w", topic, err)
+		}
+	}
+	return topic, payload, nil
+}
+
+// interceptInbound passes topic and payload through the InboundInterceptors in turn
+func (c *client) interceptInbound(topic string, payload []byte) (string, []byte, error) {
+	for _, i := range c.options.InboundInterceptors {
+		var err error
+		if topic, payload, err = i(topic, payload); err != nil {
+			return "", nil, err
+		}
+	}
+	return topic, payload, nil
+}
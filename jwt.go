@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// jwtMaxRenewBefore limits how long before a token expires the connection is renewed
+const jwtMaxRenewBefore = time.Minute
+
+// fetchJWT obtains the username and password (token) for a connection attempt, recording the token expiry
+func (c *client) fetchJWT(p JWTProvider) (string, string, error) {
+	token, expiry, err := p()
+	if err != nil {
+		return "", "", err
+	}
+	if token == "" {
+		return "", "", errors.New("empty token")
+	}
+	c.tokenExpiry = expiry
+	username := c.options.Username
+	if username == "" {
+		username = "unused"
+	}
+	return username, token, nil
+}
+
+// credentialsRenewal returns the time at which the connection should be renewed because the token it was
+// established with is about to expire (zero if there is no such token or it has no expiry)
+func (c *client) credentialsRenewal() time.Time {
+	if c.options.JWTProvider == nil || c.tokenExpiry.IsZero() {
+		return time.Time{}
+	}
+	lifetime := c.tokenExpiry.Sub(c.clock.Now())
+	if lifetime <= 0 {
+		c.logger.Warn("token has already expired; connection will not be renewed", slog.String("component", string(CLI)))
+		return time.Time{}
+	}
+	return c.tokenExpiry.Add(-min(lifetime/10, jwtMaxRenewBefore))
+}
+
+// renewCredentials disconnects (so that the client reconnects with a new token) at renewAt
+func renewCredentials(c *client, renewAt time.Time) {
+	defer c.workers.Done()
+	t := c.clock.NewTimer(renewAt.Sub(c.clock.Now()))
+	defer t.Stop()
+	select {
+	case <-c.stop:
+	case <-t.C():
+		c.reauthenticate(ErrCredentialsExpiring)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// LifecycleEvent is passed to a LifecyclePayloadFunc when a birth or death message is built
+type LifecycleEvent struct {
+	ClientID string
+	Seq      uint64    // the session sequence number (the birth and death messages for a session share the same number)
+	Time     time.Time // when the message was built
+}
+
+// LifecyclePayloadFunc returns the payload of a birth or death message
+type LifecyclePayloadFunc func(e LifecycleEvent) []byte
+
+// LifecycleOptions configures a Lifecycle. Topics may contain "{clientid}", which is replaced with the client ID.
+type LifecycleOptions struct {
+	BirthTopic  string               // published to whenever a connection is established
+	DeathTopic  string               // set as the will and published to by Lifecycle.Disconnect
+	Birth       LifecyclePayloadFunc // nil means an empty payload
+	Death       LifecyclePayloadFunc // nil means an empty payload
+	Qos         byte                 // QoS of the birth and death messages
+	Retained    bool                 // whether the birth and death messages are retained
+	InitialSeq  uint64               // sequence number of the first session (e.g. restored following a restart)
+	SeqModulus  uint64               // 0 = no limit; otherwise sequence numbers wrap to 0 on reaching this (256 for Sparkplug bdSeq)
+	Timeout     time.Duration        // how long Disconnect waits for the death message to be published (default 5s)
+	OnBirthSent func(seq uint64)     // optional; called once a birth message has been published
+	BeforeBirth func(c Client)       // optional; called before each birth message is built (e.g. to subscribe to command topics)
+
+	// PublishBirth, if set, is called in place of Birth to build and publish the birth message for session seq (to
+	// BirthTopic, with Qos and Retained); this allows the caller to order the birth message with its other messages.
+	PublishBirth func(c Client, seq uint64) Token
+}
+
+// Lifecycle publishes birth and death certificates (as used by Sparkplug and similar conventions): each time a
+// connection is established a birth message is published and the death message is set as the will (so the
+// broker publishes it if the connection is lost); Disconnect publishes the death message before disconnecting.
+// Each session (connection) has a sequence number, passed to the payload functions, that is incremented when a
+// session ends; this allows subscribers to pair birth and death messages (and detect stale death messages).
+type Lifecycle struct {
+	clientID   string
+	birthTopic string
+	deathTopic string
+	opts       LifecycleOptions
+	logger     *slog.Logger
+
+	mu   sync.Mutex
+	seq  uint64 // sequence number of the current (or next) session
+	born bool   // true if a birth message has been published for seq (so seq must be incremented when the session ends)
+}
+
+// NewLifecycle returns a Lifecycle for the client that will be created with o. o is modified (the will is set and
+// the OnConnect, OnConnectionLost and OnReconnecting handlers wrapped) so must be passed to NewClient after this is
+// called. An error is returned if a topic is invalid.
+func NewLifecycle(o *ClientOptions, opts LifecycleOptions) (*Lifecycle, error) {
+	l := &Lifecycle{clientID: o.ClientID, opts: opts, logger: o.Logger, seq: opts.InitialSeq}
+	var err error
+	if l.birthTopic, err = clientTopic(opts.BirthTopic, o.ClientID); err != nil {
+		return nil, fmt.Errorf("birth topic: %w", err)
+	}
+	if l.deathTopic, err = clientTopic(opts.DeathTopic, o.ClientID); err != nil {
+		return nil, fmt.Errorf("death topic: %w", err)
+	}
+	if l.opts.SeqModulus > 0 {
+		l.seq %= l.opts.SeqModulus
+	}
+	if l.opts.Timeout <= 0 {
+		l.opts.Timeout = 5 * time.Second
+	}
+	if l.logger == nil {
+		l.logger = slog.Default()
+	}
+
+	o.SetBinaryWill(l.deathTopic, l.payload(l.opts.Death, l.seq), l.opts.Qos, l.opts.Retained)
+	onConnect, onLost, onReconnecting, autoReconnect := o.OnConnect, o.OnConnectionLost, o.OnReconnecting, o.AutoReconnect
+	o.SetOnConnectHandler(func(c Client) {
+		l.mu.Lock()
+		seq := l.seq
+		l.born = true
+		l.mu.Unlock()
+		go l.birth(c, seq)
+		if onConnect != nil {
+			onConnect(c)
+		}
+	})
+	o.SetConnectionLostHandler(func(c Client, err error) {
+		if !autoReconnect { // otherwise handled by OnReconnecting (this handler may run after the reconnection)
+			l.endSession(c)
+		}
+		if onLost != nil {
+			onLost(c, err)
+		}
+	})
+	o.SetReconnectingHandler(func(c Client, o *ClientOptions) {
+		l.endSession(c)
+		if onReconnecting != nil {
+			onReconnecting(c, o)
+		}
+	})
+	return l, nil
+}
+
+// Seq returns the sequence number of the current session (or, if not connected, the next session)
+func (l *Lifecycle) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Disconnect publishes the death message (waiting up to the configured timeout for it to be delivered) and then
+// disconnects c; quiesce is passed to Client.Disconnect.
+func (l *Lifecycle) Disconnect(c Client, quiesce uint) {
+	if c.IsConnectionOpen() {
+		l.mu.Lock()
+		seq := l.seq
+		l.mu.Unlock()
+		l.publish(c, l.deathTopic, l.payload(l.opts.Death, seq))
+	}
+	c.Disconnect(quiesce)
+	l.endSession(c)
+}
+
+// birth publishes the birth message for session seq
+func (l *Lifecycle) birth(c Client, seq uint64) {
+	if l.opts.BeforeBirth != nil {
+		l.opts.BeforeBirth(c)
+	}
+	var t Token
+	if l.opts.PublishBirth != nil {
+		t = l.opts.PublishBirth(c, seq)
+	} else {
+		t = c.Publish(l.birthTopic, l.opts.Qos, l.opts.Retained, l.payload(l.opts.Birth, seq))
+	}
+	if l.wait(l.birthTopic, t) && l.opts.OnBirthSent != nil {
+		l.opts.OnBirthSent(seq)
+	}
+}
+
+// endSession moves to the next sequence number (if a birth message was published for the current one) and
+// updates the will accordingly
+func (l *Lifecycle) endSession(c Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.born {
+		return
+	}
+	l.born = false
+	l.seq++
+	if l.opts.SeqModulus > 0 {
+		l.seq %= l.opts.SeqModulus
+	}
+	w, ok := c.(WillUpdater)
+	if !ok {
+		l.logger.Warn("client cannot update its will; death message not updated", slog.String("component", string(CLI)))
+		return
+	}
+	w.UpdateWill(l.deathTopic, l.payload(l.opts.Death, l.seq), l.opts.Qos, l.opts.Retained)
+}
+
+// payload calls fn (if not nil) to build a message for session seq
+func (l *Lifecycle) payload(fn LifecyclePayloadFunc, seq uint64) []byte {
+	if fn == nil {
+		return nil
+	}
+	return fn(LifecycleEvent{ClientID: l.clientID, Seq: seq, Time: time.Now()})
+}
+
+// publish publishes a birth or death message, returning true if it was delivered (failures are logged)
+func (l *Lifecycle) publish(c Client, topic string, payload []byte) bool {
+	return l.wait(topic, c.Publish(topic, l.opts.Qos, l.opts.Retained, payload))
+}
+
+// wait waits for t, the publication of a birth or death message to topic, returning true if it was delivered
+// (failures are logged)
+func (l *Lifecycle) wait(topic string, t Token) bool {
+	if !t.WaitTimeout(l.opts.Timeout) {
+		l.logger.Warn("timeout publishing lifecycle message", slog.String("topic", topic), slog.String("component", string(CLI)))
+		return false
+	}
+	if err := t.Error(); err != nil {
+		l.logger.Warn("failed to publish lifecycle message", slog.String("topic", topic), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package loadtest
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// histogramBuckets is the number of buckets needed to cover all uint64 values (see bucketOf)
+const histogramBuckets = 16 + 60*16
+
+// Histogram records a distribution of durations. Values are held in logarithmic buckets (16 per power of two) so
+// percentiles are accurate to within about 6% whilst memory use is fixed. It is safe for concurrent use.
+type Histogram struct {
+	mu       sync.Mutex
+	counts   [histogramBuckets]uint64
+	count    uint64
+	sum      float64
+	min, max time.Duration
+}
+
+// bucketOf returns the index of the bucket holding v; values below 16 have their own bucket, above that the
+// index is formed from the position of the most significant bit and the following four bits
+func bucketOf(v uint64) int {
+	if v < 16 {
+		return int(v)
+	}
+	e := bits.Len64(v) - 1
+	return 16 + (e-4)*16 + int((v>>(e-4))&15)
+}
+
+// bucketLow returns the smallest value held in bucket i
+func bucketLow(i int) uint64 {
+	if i < 16 {
+		return uint64(i)
+	}
+	e := (i-16)/16 + 4
+	return uint64(16+(i-16)%16) << (e - 4)
+}
+
+// Record adds d to the histogram (negative durations are recorded as 0)
+func (h *Histogram) Record(d time.Duration) {
+	d = max(d, 0)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[bucketOf(uint64(d))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	h.max = max(h.max, d)
+	h.count++
+	h.sum += float64(d)
+}
+
+// Merge adds the values recorded in o to h
+func (h *Histogram) Merge(o *Histogram) {
+	o.mu.Lock()
+	counts, count, sum, oMin, oMax := o.counts, o.count, o.sum, o.min, o.max
+	o.mu.Unlock()
+	if count == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, c := range counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || oMin < h.min {
+		h.min = oMin
+	}
+	h.max = max(h.max, oMax)
+	h.count += count
+	h.sum += sum
+}
+
+// Count returns the number of values recorded
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Min returns the smallest value recorded (0 if none)
+func (h *Histogram) Min() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.min
+}
+
+// Max returns the largest value recorded (0 if none)
+func (h *Histogram) Max() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.max
+}
+
+// Mean returns the mean of the values recorded (0 if none)
+func (h *Histogram) Mean() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / float64(h.count))
+}
+
+// Percentile returns an estimate of the pth percentile (0 < p <= 100) of the values recorded (0 if none)
+func (h *Histogram) Percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(h.count)))
+	target = min(max(target, 1), h.count)
+	if target == h.count {
+		return h.max
+	}
+	var cumulative uint64
+	for i, c := range h.counts {
+		cumulative += c
+		if cumulative < target {
+			continue
+		}
+		// Use the middle of the bucket (the bounds are exact for the smallest buckets)
+		low := bucketLow(i)
+		high := low + 1
+		if i+1 < histogramBuckets {
+			high = bucketLow(i + 1)
+		}
+		v := time.Duration(low + (high-low-1)/2)
+		return min(max(v, h.min), h.max)
+	}
+	return h.max
+}
+
+// String returns a summary of the distribution
+func (h *Histogram) String() string {
+	return fmt.Sprintf("n=%d min=%s mean=%s p50=%s p90=%s p99=%s max=%s", h.Count(), h.Min(), h.Mean(),
+		h.Percentile(50), h.Percentile(90), h.Percentile(99), h.Max())
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package loadtest generates load against an MQTT broker using this library; it is intended for measuring the
+// performance of the client (e.g. to detect regressions) and for sizing deployments.
+//
+// A swarm of publishers sends messages to a set of topics whilst subscribers (subscribed to all of the topics)
+// receive them. Each payload carries the time it was sent so the end to end latency can be measured alongside
+// the time taken for each publish to complete (i.e. be acknowledged, for QoS 1 and 2).
+//
+//	res, err := loadtest.Run(ctx, loadtest.Config{Broker: "tcp://localhost:1883", Publishers: 10,
+//		Subscribers: 2, MessagesPerPublisher: 1000, QoSMix: [3]int{1, 1, 0}})
+//	if err == nil {
+//		fmt.Println(res)
+//	}
+package loadtest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// timestampSize is the number of bytes at the start of each payload holding the time it was sent
+const timestampSize = 8
+
+// Config specifies the load to generate
+type Config struct {
+	Broker               string        // broker URL (not used if Options is set)
+	Publishers           int           // number of publishing clients (must be at least 1)
+	Subscribers          int           // number of subscribing clients (each receives every message)
+	Topics               int           // number of topics messages are spread across (default 1)
+	TopicPrefix          string        // topics are TopicPrefix/0, TopicPrefix/1... (default "loadtest")
+	MessageSize          int           // payload size in bytes (minimum, and default, 8)
+	QoSMix               [3]int        // relative proportion of messages sent at QoS 0, 1 and 2 (all zero = QoS 0 only)
+	MessagesPerPublisher int           // number of messages each publisher sends (0 = until Duration expires)
+	Duration             time.Duration // maximum time to publish for (0 = no limit; one of this or MessagesPerPublisher must be set)
+	Interval             time.Duration // delay between messages from each publisher (0 = as fast as possible)
+	DrainTimeout         time.Duration // how long to wait for subscribers to receive outstanding messages (default 5s)
+
+	// Options, if set, returns the options for the client with the specified ID (allowing TLS etc. to be
+	// configured). The default is mqtt.NewClientOptions() with Broker added.
+	Options func(clientID string) *mqtt.ClientOptions
+}
+
+// Result holds the outcome of a run
+type Result struct {
+	Published      uint64        // messages successfully published
+	Failed         uint64        // publishes that completed with an error
+	Received       uint64        // messages received (across all subscribers)
+	Expected       uint64        // messages that subscribers should have received (Published * Subscribers)
+	Elapsed        time.Duration // time from the first publish until the last publish completed
+	PublishLatency Histogram     // time from Publish being called until the flow completed
+	EndToEnd       Histogram     // time from Publish being called until a subscriber received the message
+}
+
+// Throughput returns the number of messages published per second
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Published) / r.Elapsed.Seconds()
+}
+
+// String returns a summary of the result
+func (r *Result) String() string {
+	return fmt.Sprintf("published %d (%d failed) in %s (%.0f msg/s), received %d of %d\npublish:    %s\nend to end: %s",
+		r.Published, r.Failed, r.Elapsed, r.Throughput(), r.Received, r.Expected, &r.PublishLatency, &r.EndToEnd)
+}
+
+// withDefaults returns a copy of c with defaults applied; an error is returned if c is invalid
+func (c Config) withDefaults() (Config, error) {
+	if c.Publishers < 1 {
+		return c, errors.New("at least one publisher is required")
+	}
+	if c.Subscribers < 0 {
+		return c, errors.New("subscribers must not be negative")
+	}
+	if c.MessagesPerPublisher <= 0 && c.Duration <= 0 {
+		return c, errors.New("one of MessagesPerPublisher or Duration must be set")
+	}
+	for _, w := range c.QoSMix {
+		if w < 0 {
+			return c, errors.New("QoSMix weights must not be negative")
+		}
+	}
+	if c.Options == nil {
+		if c.Broker == "" {
+			return c, errors.New("a broker (or Options) must be specified")
+		}
+		broker := c.Broker
+		c.Options = func(id string) *mqtt.ClientOptions {
+			return mqtt.NewClientOptions().AddBroker(broker).SetClientID(id)
+		}
+	}
+	c.Topics = max(c.Topics, 1)
+	if c.TopicPrefix == "" {
+		c.TopicPrefix = "loadtest"
+	}
+	c.MessageSize = max(c.MessageSize, timestampSize)
+	if c.DrainTimeout <= 0 {
+		c.DrainTimeout = 5 * time.Second
+	}
+	return c, nil
+}
+
+// qosFor returns the QoS for the nth message sent by a publisher; messages cycle through the mix in order so
+// that the proportions are exact over each cycle
+func (c *Config) qosFor(n int) byte {
+	total := c.QoSMix[0] + c.QoSMix[1] + c.QoSMix[2]
+	if total == 0 {
+		return 0
+	}
+	n %= total
+	for q, w := range c.QoSMix {
+		if n < w {
+			return byte(q)
+		}
+		n -= w
+	}
+	return 0
+}
+
+// Run connects the clients, generates the load specified by cfg and returns the result once all publishes have
+// completed and subscribers have received all messages (or DrainTimeout has elapsed). If ctx is done the run is
+// stopped early; the result reflects the messages sent up to that point.
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	var received atomic.Uint64
+	var clients []mqtt.Client
+	defer func() {
+		for _, c := range clients {
+			c.Disconnect(250)
+		}
+	}()
+	connect := func(id string, opts *mqtt.ClientOptions) (mqtt.Client, error) {
+		c := mqtt.NewClient(opts)
+		if t := c.Connect(); t.Wait() && t.Error() != nil {
+			return nil, fmt.Errorf("%s: %w", id, t.Error())
+		}
+		clients = append(clients, c)
+		return c, nil
+	}
+
+	onMessage := func(_ mqtt.Client, m mqtt.Message) {
+		if p := m.Payload(); len(p) >= timestampSize {
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(p)))
+			res.EndToEnd.Record(time.Since(sent))
+		}
+		received.Add(1)
+	}
+	for i := 0; i < cfg.Subscribers; i++ {
+		id := "loadtest-sub-" + strconv.Itoa(i)
+		c, err := connect(id, cfg.Options(id).SetOrderMatters(false))
+		if err != nil {
+			return nil, err
+		}
+		if t := c.Subscribe(cfg.TopicPrefix+"/#", 2, onMessage); t.Wait() && t.Error() != nil {
+			return nil, fmt.Errorf("%s: %w", id, t.Error())
+		}
+	}
+	publishers := make([]mqtt.Client, cfg.Publishers)
+	for i := range publishers {
+		id := "loadtest-pub-" + strconv.Itoa(i)
+		if publishers[i], err = connect(id, cfg.Options(id)); err != nil {
+			return nil, err
+		}
+	}
+
+	runCtx := ctx
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	var published, failed atomic.Uint64
+	var inFlight, wg sync.WaitGroup
+	start := time.Now()
+	for i, c := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			publish(runCtx, &cfg, c, i, &res.PublishLatency, &inFlight, &published, &failed)
+		}()
+	}
+	wg.Wait()
+	inFlight.Wait() // every publish is bounded by the client's timeouts (or fails when the connection is lost)
+	res.Elapsed = time.Since(start)
+	res.Published, res.Failed = published.Load(), failed.Load()
+	res.Expected = res.Published * uint64(cfg.Subscribers)
+
+	drain := time.NewTimer(cfg.DrainTimeout)
+	defer drain.Stop()
+	for received.Load() < res.Expected {
+		select {
+		case <-ctx.Done():
+		case <-drain.C:
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	res.Received = received.Load()
+	return res, nil
+}
+
+// publish sends the messages for publisher n. Completion is tracked with callbacks rather than waiting, so
+// that QoS 1 and 2 messages are pipelined.
+func publish(ctx context.Context, cfg *Config, c mqtt.Client, n int, latency *Histogram, inFlight *sync.WaitGroup, published, failed *atomic.Uint64) {
+	for i := 0; cfg.MessagesPerPublisher <= 0 || i < cfg.MessagesPerPublisher; i++ {
+		if i > 0 && cfg.Interval > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cfg.Interval):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		payload := make([]byte, cfg.MessageSize) // not reused as the client may retain it until the flow completes
+		sent := time.Now()
+		binary.BigEndian.PutUint64(payload, uint64(sent.UnixNano()))
+		topic := cfg.TopicPrefix + "/" + strconv.Itoa((n+i)%cfg.Topics)
+		inFlight.Add(1)
+		mqtt.OnComplete(c.Publish(topic, cfg.qosFor(i), false, payload), func(err error) {
+			if err != nil {
+				failed.Add(1)
+			} else {
+				published.Add(1)
+				latency.Record(time.Since(sent))
+			}
+			inFlight.Done()
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package loadtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func TestHistogram(t *testing.T) {
+	for _, v := range []uint64{0, 1, 15, 16, 17, 31, 32, 1000, 123456789, 1 << 62, ^uint64(0)} {
+		i := bucketOf(v)
+		if i < 0 || i >= histogramBuckets || bucketLow(i) > v || (i+1 < histogramBuckets && bucketLow(i+1) <= v) {
+			t.Errorf("value %d placed in bucket %d [%d, %d)", v, i, bucketLow(i), bucketLow(i+1))
+		}
+	}
+
+	var h Histogram
+	if h.Percentile(50) != 0 || h.Mean() != 0 {
+		t.Fatal("empty histogram should report 0")
+	}
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	if h.Count() != 1000 || h.Min() != time.Millisecond || h.Max() != time.Second {
+		t.Fatalf("unexpected count/min/max: %s", &h)
+	}
+	if m := h.Mean(); m < 500*time.Millisecond || m > 501*time.Millisecond {
+		t.Errorf("unexpected mean %s", m)
+	}
+	for _, p := range []float64{50, 90, 99} {
+		want := time.Duration(p * 10 * float64(time.Millisecond))
+		if got := h.Percentile(p); got < want*94/100 || got > want*106/100 {
+			t.Errorf("p%v: expected about %s, got %s", p, want, got)
+		}
+	}
+	if h.Percentile(100) != time.Second {
+		t.Errorf("p100 should be the maximum, got %s", h.Percentile(100))
+	}
+
+	var merged Histogram
+	merged.Record(2 * time.Second)
+	merged.Merge(&h)
+	if merged.Count() != 1001 || merged.Min() != time.Millisecond || merged.Max() != 2*time.Second {
+		t.Fatalf("unexpected merge result: %s", &merged)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	if _, err := (Config{Broker: "tcp://localhost:1883"}).withDefaults(); err == nil {
+		t.Error("expected error with no publishers")
+	}
+	if _, err := (Config{Broker: "tcp://localhost:1883", Publishers: 1}).withDefaults(); err == nil {
+		t.Error("expected error with neither MessagesPerPublisher nor Duration")
+	}
+	cfg, err := (Config{Broker: "tcp://localhost:1883", Publishers: 1, Duration: time.Second, QoSMix: [3]int{2, 1, 1}}).withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Topics != 1 || cfg.MessageSize != timestampSize || cfg.TopicPrefix != "loadtest" {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+	var counts [3]int
+	for i := 0; i < 8; i++ {
+		counts[cfg.qosFor(i)]++
+	}
+	if counts != [3]int{4, 2, 2} {
+		t.Errorf("unexpected QoS distribution %v", counts)
+	}
+}
+
+func TestRun(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := Run(ctx, Config{
+		Broker:               b.URL(),
+		Publishers:           3,
+		Subscribers:          2,
+		Topics:               4,
+		MessageSize:          100,
+		QoSMix:               [3]int{1, 1, 1},
+		MessagesPerPublisher: 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Published != 90 || res.Failed != 0 || res.Expected != 180 {
+		t.Fatalf("unexpected result %s", res)
+	}
+	// QoS 0 messages are not guaranteed to arrive but will with a local broker
+	if res.Received != res.Expected || res.EndToEnd.Count() != res.Received || res.PublishLatency.Count() != 90 {
+		t.Fatalf("unexpected result %s", res)
+	}
+	if res.Throughput() <= 0 {
+		t.Errorf("unexpected throughput %f", res.Throughput())
+	}
+}
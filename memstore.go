@@ -89,16 +89,35 @@ func (store *MemoryStore) Get(key string) packets.ControlPacket {
 		store.logger.Error("Trying to use memory store, but not open", slog.String("component", string(STR)))
 		return nil
 	}
-	mid := mIDFromKey(key)
 	m := store.messages[key]
 	if m == nil {
-		store.logger.Warn("memorystore get: message not found", slog.Uint64("messageID", uint64(mid)), slog.String("component", string(STR)))
+		store.logger.Warn("memorystore get: message not found", slog.String("key", key), slog.String("component", string(STR)))
 	} else {
-		store.logger.Debug("memorystore get: message found", slog.Uint64("messageID", uint64(mid)), slog.String("component", string(STR)))
+		store.logger.Debug("memorystore get: message found", slog.String("key", key), slog.String("component", string(STR)))
 	}
 	return m
 }
 
+// Update atomically replaces the message associated with key with the result of fn (see UpdatableStore).
+func (store *MemoryStore) Update(key string, fn UpdateFunc) error {
+	store.Lock()
+	defer store.Unlock()
+	if !store.opened {
+		store.logger.Error("Trying to use memory store, but not open", slog.String("component", string(STR)))
+		return ErrStoreClosed
+	}
+	next, err := fn(store.messages[key])
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		delete(store.messages, key)
+	} else {
+		store.messages[key] = next
+	}
+	return nil
+}
+
 // All returns a slice of strings containing all the keys currently
 // in the MemoryStore.
 func (store *MemoryStore) All() []string {
@@ -124,13 +143,12 @@ func (store *MemoryStore) Del(key string) {
 		store.logger.Error("Trying to use memory store, but not open", slog.String("component", string(STR)))
 		return
 	}
-	mid := mIDFromKey(key)
 	m := store.messages[key]
 	if m == nil {
-		store.logger.Info("memorystore del: message not found", slog.Uint64("messageID", uint64(mid)), slog.String("component", string(STR)))
+		store.logger.Info("memorystore del: message not found", slog.String("key", key), slog.String("component", string(STR)))
 	} else {
 		delete(store.messages, key)
-		store.logger.Debug("memorystore del: message was deleted", slog.Uint64("messageID", uint64(mid)), slog.String("component", string(STR)))
+		store.logger.Debug("memorystore del: message was deleted", slog.String("key", key), slog.String("component", string(STR)))
 	}
 }
 
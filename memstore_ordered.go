@@ -25,6 +25,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/eclipse/paho.mqtt.golang/clock"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -46,6 +47,7 @@ type OrderedMemoryStore struct {
 	messages map[string]storedMessage
 	opened   bool
 	logger   *slog.Logger
+	clock    clock.Clock
 }
 
 // NewOrderedMemoryStore returns a pointer to a new instance of
@@ -56,6 +58,7 @@ func NewOrderedMemoryStore() *OrderedMemoryStore {
 		messages: make(map[string]storedMessage),
 		opened:   false,
 		logger:   noopSLogger,
+		clock:    clock.Real,
 	}
 	return store
 }
@@ -72,10 +75,19 @@ func NewOrderedMemoryStoreEx(logger *slog.Logger) *OrderedMemoryStore {
 		messages: make(map[string]storedMessage),
 		opened:   false,
 		logger:   logger,
+		clock:    clock.Real,
 	}
 	return store
 }
 
+// SetClock sets the clock used to timestamp messages (which determines the order in which All returns them);
+// this is intended for testing. The default is clock.Real.
+func (store *OrderedMemoryStore) SetClock(c clock.Clock) {
+	store.Lock()
+	defer store.Unlock()
+	store.clock = c
+}
+
 // Open initializes a OrderedMemoryStore instance.
 func (store *OrderedMemoryStore) Open() {
 	store.Lock()
@@ -93,7 +105,7 @@ func (store *OrderedMemoryStore) Put(key string, message packets.ControlPacket)
 		store.logger.Error("Trying to use memory store, but not open", slog.String("component", string(STR)))
 		return
 	}
-	store.messages[key] = storedMessage{ts: time.Now(), msg: message}
+	store.messages[key] = storedMessage{ts: store.clock.Now(), msg: message}
 }
 
 // Get takes a key and looks in the store for a matching Message
@@ -105,16 +117,40 @@ func (store *OrderedMemoryStore) Get(key string) packets.ControlPacket {
 		store.logger.Error("Trying to use memory store, but not open", slog.String("component", string(STR)))
 		return nil
 	}
-	mid := mIDFromKey(key)
 	m, ok := store.messages[key]
 	if !ok || m.msg == nil {
-		store.logger.Warn("OrderedMemoryStore get: message not found", slog.Uint64("messageID", uint64(mid)), slog.String("component", string(STR)))
+		store.logger.Warn("OrderedMemoryStore get: message not found", slog.String("key", key), slog.String("component", string(STR)))
 	} else {
-		store.logger.Debug("OrderedMemoryStore get: message found", slog.Uint64("messageID", uint64(mid)), slog.String("component", string(STR)))
+		store.logger.Debug("OrderedMemoryStore get: message found", slog.String("key", key), slog.String("component", string(STR)))
 	}
 	return m.msg
 }
 
+// Update atomically replaces the message associated with key with the result of fn (see UpdatableStore).
+// An updated message retains its position in the order.
+func (store *OrderedMemoryStore) Update(key string, fn UpdateFunc) error {
+	store.Lock()
+	defer store.Unlock()
+	if !store.opened {
+		store.logger.Error("Trying to use memory store, but not open", slog.String("component", string(STR)))
+		return ErrStoreClosed
+	}
+	m, ok := store.messages[key]
+	next, err := fn(m.msg)
+	if err != nil {
+		return err
+	}
+	switch {
+	case next == nil:
+		delete(store.messages, key)
+	case ok:
+		store.messages[key] = storedMessage{ts: m.ts, msg: next}
+	default:
+		store.messages[key] = storedMessage{ts: store.clock.Now(), msg: next}
+	}
+	return nil
+}
+
 // All returns a slice of strings containing all the keys currently
 // in the OrderedMemoryStore.
 func (store *OrderedMemoryStore) All() []string {
@@ -151,13 +187,12 @@ func (store *OrderedMemoryStore) Del(key string) {
 		store.logger.Error("Trying to use memory store, but not open", slog.String("component", string(STR)))
 		return
 	}
-	mid := mIDFromKey(key)
 	_, ok := store.messages[key]
 	if !ok {
-		store.logger.Info("OrderedMemoryStore del: message not found", slog.Uint64("messageID", uint64(mid)), slog.String("component", string(STR)))
+		store.logger.Info("OrderedMemoryStore del: message not found", slog.String("key", key), slog.String("component", string(STR)))
 	} else {
 		delete(store.messages, key)
-		store.logger.Debug("OrderedMemoryStore del: message was deleted", slog.Uint64("messageID", uint64(mid)), slog.String("component", string(STR)))
+		store.logger.Debug("OrderedMemoryStore del: message was deleted", slog.String("key", key), slog.String("component", string(STR)))
 	}
 }
 
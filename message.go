@@ -19,9 +19,13 @@
 package mqtt
 
 import (
+	"errors"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/eclipse/paho.mqtt.golang/clock"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -38,6 +42,51 @@ type Message interface {
 	Ack()
 }
 
+// ErrAckNotSent is returned when a message is acknowledged after the connection it was received on has been lost.
+// The acknowledgement cannot be sent; if the session is retained the broker will redeliver the message.
+var ErrAckNotSent = errors.New("acknowledgement not sent; the connection the message was received on has been lost")
+
+// ErrMessageSettled is returned when Nack is called on a message that has already been acknowledged (or
+// nacked), or Acknowledge is called on a message that has been nacked.
+var ErrMessageSettled = errors.New("message has already been acknowledged or nacked")
+
+// ManualAckMessage is implemented by the Messages passed to handlers by this package; it is primarily of use
+// when automatic acknowledgement has been disabled (ClientOptions.SetAutoAckDisabled).
+type ManualAckMessage interface {
+	Message
+	// Acknowledge acknowledges the message (as per Ack) but returns ErrAckNotSent if the connection the message
+	// was received on has been lost (or ErrMessageSettled if the message was nacked).
+	Acknowledge() error
+	// Nack rejects the message without acknowledging it; the message will be passed to the handler(s) again
+	// (with Duplicate() returning true), as held in the store for QoS 1 and 2 messages. ErrAckNotSent is returned
+	// if the connection has been lost, or the message is no longer in the store (in which case the broker will
+	// redeliver the message if the session is retained).
+	Nack() error
+}
+
+// AckTimeoutAction determines what happens to a message that was not acknowledged within the time
+// set with ClientOptions.SetAckTimeout
+type AckTimeoutAction int
+
+const (
+	// AckTimeoutDiscard acknowledges the message (freeing its slot in the in-flight window) without further processing
+	AckTimeoutDiscard AckTimeoutAction = iota
+	// AckTimeoutRedispatch nacks the message so that it is passed to the handler(s) again
+	AckTimeoutRedispatch
+	// AckTimeoutIgnore leaves the message unacknowledged; the handler remains responsible for acknowledging it
+	AckTimeoutIgnore
+)
+
+// PooledPayload can be passed to Publish as the payload to avoid copying pooled buffers. Release (if not
+// nil) is called once the client no longer references Data, i.e. when the publish flow completes successfully,
+// so the buffer can be returned to a pool (e.g. a sync.Pool). If the flow fails Release is not called (the
+// message may remain in the store and be resent), in which case Data will be garbage collected as usual.
+// Data must not be modified until Release is called.
+type PooledPayload struct {
+	Data    []byte
+	Release func()
+}
+
 type message struct {
 	duplicate bool
 	qos       byte
@@ -46,7 +95,14 @@ type message struct {
 	messageID uint16
 	payload   []byte
 	once      sync.Once
-	ack       func()
+	ack       func() error
+	ackErr    error         // result of ack (set within once)
+	nack      func() error  // requeues the message for redelivery
+	settled   atomic.Bool   // true once the message has been acknowledged or nacked
+	settledC  chan struct{} // closed when the message is settled (only set if the ack timeout is enabled)
+
+	receivedAt time.Time // when the message was received (passed to the router)
+	broker     *url.URL  // the broker the message was received from
 }
 
 func (m *message) Duplicate() bool {
@@ -74,10 +130,131 @@ func (m *message) Payload() []byte {
 }
 
 func (m *message) Ack() {
-	m.once.Do(m.ack)
+	_ = m.Acknowledge()
+}
+
+func (m *message) Acknowledge() error {
+	m.once.Do(func() { m.settle(); m.ackErr = m.ack() })
+	return m.ackErr
+}
+
+func (m *message) Nack() error {
+	nacked := false
+	m.once.Do(func() { m.settle(); nacked, m.ackErr = true, ErrMessageSettled })
+	if !nacked {
+		return ErrMessageSettled
+	}
+	if m.nack == nil {
+		return ErrAckNotSent
+	}
+	return m.nack()
+}
+
+// settle records that the message has been acknowledged or nacked (must be called within once)
+func (m *message) settle() {
+	m.settled.Store(true)
+	if m.settledC != nil {
+		close(m.settledC)
+	}
+}
+
+// startAckTimer calls onTimeout if the message has not been settled within timeout (measured by clk) and applies
+// the action returned. It must be called before the message is passed to a handler.
+func (m *message) startAckTimer(clk clock.Clock, timeout time.Duration, onTimeout AckTimeoutHandler) {
+	m.settledC = make(chan struct{})
+	t := clk.NewTimer(timeout)
+	go func() {
+		select {
+		case <-m.settledC:
+			t.Stop()
+			return
+		case <-t.C():
+		}
+		if m.settled.Load() {
+			return
+		}
+		action := AckTimeoutDiscard
+		if onTimeout != nil {
+			action = onTimeout(m)
+		}
+		switch action {
+		case AckTimeoutDiscard:
+			_ = m.Acknowledge()
+		case AckTimeoutRedispatch:
+			_ = m.Nack()
+		}
+	}()
+}
+
+// ReceivedAt returns the time at which the message was received
+func (m *message) ReceivedAt() time.Time {
+	return m.receivedAt
+}
+
+// Broker returns the URL of the broker the message was received from
+func (m *message) Broker() *url.URL {
+	return m.broker
+}
+
+// MatchedFilter returns ""; the message was passed to the default handler
+func (m *message) MatchedFilter() string {
+	return ""
+}
+
+// MetadataMessage is implemented by the Messages passed to handlers by this package; it provides details of
+// how, and when, the message was received.
+type MetadataMessage interface {
+	Message
+	// ReceivedAt returns the time at which the message was read from the network (messages redelivered
+	// following a Nack retain the original time)
+	ReceivedAt() time.Time
+	// Broker returns the URL of the broker the message was received from (the URL must not be modified)
+	Broker() *url.URL
+	// MatchedFilter returns the topic filter of the route (usually a subscription) that caused the handler to be
+	// called; this will be "" if the message was passed to the default handler.
+	MatchedFilter() string
+}
+
+// routedMessage is a message passed to the handler of a route
+type routedMessage struct {
+	*message
+	filter string
+}
+
+func (m *routedMessage) MatchedFilter() string {
+	return m.filter
+}
+
+// SharedSubscription returns false; the message was not routed via a shared subscription
+func (m *message) SharedSubscription() (string, bool) {
+	return "", false
+}
+
+// SharedSubscriptionMessage is implemented by the Messages passed to handlers by this package; it
+// indicates whether the message was routed to the handler via a shared subscription.
+type SharedSubscriptionMessage interface {
+	Message
+	// SharedSubscription returns the share group and true if the handler was called due to a shared
+	// subscription ($share/<group>/<filter>). The group will be "" for $queue/<filter> subscriptions.
+	SharedSubscription() (group string, ok bool)
+}
+
+// sharedMessage is a message that was routed via a shared subscription
+type sharedMessage struct {
+	*message
+	group  string
+	filter string
+}
+
+func (m *sharedMessage) SharedSubscription() (string, bool) {
+	return m.group, true
 }
 
-func messageFromPublish(p *packets.PublishPacket, ack func()) Message {
+func (m *sharedMessage) MatchedFilter() string {
+	return m.filter
+}
+
+func messageFromPublish(p *packets.PublishPacket, ack func() error) *message {
 	return &message{
 		duplicate: p.Dup,
 		qos:       p.Qos,
@@ -114,7 +291,17 @@ func newConnectMsgFromOptions(options *ClientOptions, broker *url.URL) *packets.
 	if options.CredentialsProvider != nil {
 		username, password = options.CredentialsProvider()
 	}
+	setConnectCredentials(m, username, password)
+
+	m.Keepalive = uint16(options.KeepAlive)
 
+	return m
+}
+
+// setConnectCredentials sets the username and password in the connect message
+func setConnectCredentials(m *packets.ConnectPacket, username, password string) {
+	m.UsernameFlag, m.Username = false, ""
+	m.PasswordFlag, m.Password = false, nil
 	if username != "" {
 		m.UsernameFlag = true
 		m.Username = username
@@ -124,8 +311,4 @@ func newConnectMsgFromOptions(options *ClientOptions, broker *url.URL) *packets.
 			m.Password = []byte(password)
 		}
 	}
-
-	m.Keepalive = uint16(options.KeepAlive)
-
-	return m
 }
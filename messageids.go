@@ -35,7 +35,9 @@ type messageIds struct {
 	mu    sync.RWMutex // Named to prevent Mu from being accessible directly via client
 	index map[uint16]tokenCompletor
 
-	lastIssuedID uint16 // The most recently issued ID. Used so we cycle through ids rather than immediately reusing them (can make debugging easier)
+	lastIssuedID uint16             // The most recently issued ID. Used so we cycle through ids rather than immediately reusing them (can make debugging easier)
+	allocator    MessageIDAllocator // chooses the next id (nil = sequential)
+	freed        chan struct{}      // closed when an id is freed (only created when getIDWait is waiting)
 	logger       *slog.Logger
 }
 
@@ -45,23 +47,29 @@ const (
 )
 
 // cleanup clears the message ID map; completes all token types and sets error on PUB, SUB and UNSUB tokens.
+// Tokens are completed after mu is unlocked because completion callbacks may call back into messageIds.
 func (mids *messageIds) cleanUp() {
 	mids.mu.Lock()
+	tokens := make([]tokenCompletor, 0, len(mids.index))
 	for _, token := range mids.index {
+		if token != nil { // should not be any nil entries
+			tokens = append(tokens, token)
+		}
+	}
+	mids.index = make(map[uint16]tokenCompletor)
+	mids.notifyFreed()
+	mids.mu.Unlock()
+	for _, token := range tokens {
 		switch token.(type) {
 		case *PublishToken:
-			token.setError(fmt.Errorf("connection lost before Publish completed"))
+			token.setError(fmt.Errorf("%w before Publish completed", ErrConnectionLost))
 		case *SubscribeToken:
-			token.setError(fmt.Errorf("connection lost before Subscribe completed"))
+			token.setError(fmt.Errorf("%w before Subscribe completed", ErrConnectionLost))
 		case *UnsubscribeToken:
-			token.setError(fmt.Errorf("connection lost before Unsubscribe completed"))
-		case nil: // should not be any nil entries
-			continue
+			token.setError(fmt.Errorf("%w before Unsubscribe completed", ErrConnectionLost))
 		}
 		token.flowComplete()
 	}
-	mids.index = make(map[uint16]tokenCompletor)
-	mids.mu.Unlock()
 	mids.logger.Debug("cleaned up", slog.String("component", string(MID)))
 }
 
@@ -69,46 +77,94 @@ func (mids *messageIds) cleanUp() {
 // This may be called when the connection is lost, and we will not be resending SUB/UNSUB packets
 func (mids *messageIds) cleanUpSubscribe() {
 	mids.mu.Lock()
+	var tokens []tokenCompletor
 	for mid, token := range mids.index {
 		switch token.(type) {
-		case *SubscribeToken:
-			token.setError(fmt.Errorf("connection lost before Subscribe completed"))
-			delete(mids.index, mid)
-		case *UnsubscribeToken:
-			token.setError(fmt.Errorf("connection lost before Unsubscribe completed"))
+		case *SubscribeToken, *UnsubscribeToken:
+			tokens = append(tokens, token)
 			delete(mids.index, mid)
 		}
 	}
+	mids.notifyFreed()
 	mids.mu.Unlock()
+	for _, token := range tokens { // completed without mu held (callbacks may call back into messageIds)
+		switch token.(type) {
+		case *SubscribeToken:
+			token.setError(fmt.Errorf("%w before Subscribe completed", ErrConnectionLost))
+		case *UnsubscribeToken:
+			token.setError(fmt.Errorf("%w before Unsubscribe completed", ErrConnectionLost))
+		}
+	}
 	mids.logger.Debug("cleaned up subs", slog.String("component", string(MID)))
 }
 
+// publishTokens returns the tokens for all outbound PUBLISH flows (QoS 1/2) that have not yet completed
+func (mids *messageIds) publishTokens() []tokenCompletor {
+	mids.mu.RLock()
+	defer mids.mu.RUnlock()
+	var tokens []tokenCompletor
+	for _, token := range mids.index {
+		if _, ok := token.(*PublishToken); ok {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
 func (mids *messageIds) freeID(id uint16) {
 	mids.mu.Lock()
 	delete(mids.index, id)
+	mids.notifyFreed()
 	mids.mu.Unlock()
 }
 
+// notifyFreed wakes anything waiting in getIDWait (must be called with mu locked)
+func (mids *messageIds) notifyFreed() {
+	if mids.freed != nil {
+		close(mids.freed)
+		mids.freed = nil
+	}
+}
+
+// freeIDs returns the number of message IDs that are not currently in use
+func (mids *messageIds) freeIDs() int {
+	mids.mu.RLock()
+	defer mids.mu.RUnlock()
+	return int(midMax) - len(mids.index)
+}
+
 func (mids *messageIds) claimID(token tokenCompletor, id uint16) {
 	mids.mu.Lock()
-	defer mids.mu.Unlock()
-	if _, ok := mids.index[id]; !ok {
-		mids.index[id] = token
-	} else {
-		old := mids.index[id]
-		old.flowComplete()
-		mids.index[id] = token
-	}
+	old := mids.index[id]
+	mids.index[id] = token
 	if id > mids.lastIssuedID {
 		mids.lastIssuedID = id
 	}
+	mids.mu.Unlock()
+	if old != nil {
+		old.flowComplete() // without mu held (callbacks may call back into messageIds)
+	}
 }
 
 // getID will return an available id or 0 if none available
-// The id will generally be the previous id + 1 (because this makes tracing messages a bit simpler)
+// The id will generally be the previous id + 1 (because this makes tracing messages a bit simpler) unless an
+// allocator has been set
 func (mids *messageIds) getID(t tokenCompletor) uint16 {
 	mids.mu.Lock()
 	defer mids.mu.Unlock()
+	if mids.allocator != nil {
+		i := mids.allocator.Next(mids.lastIssuedID, func(id uint16) bool { _, ok := mids.index[id]; return ok })
+		if i == 0 {
+			return 0
+		}
+		if _, ok := mids.index[i]; ok {
+			mids.logger.Error("message id allocator returned an id that is in use", slog.Int("id", int(i)), slog.String("component", string(MID)))
+			return 0
+		}
+		mids.index[i] = t
+		mids.lastIssuedID = i
+		return i
+	}
 	i := mids.lastIssuedID // note: the only situation where lastIssuedID is 0 the map will be empty
 	looped := false        // uint16 will loop from 65535->0
 	for {
@@ -128,6 +184,33 @@ func (mids *messageIds) getID(t tokenCompletor) uint16 {
 	}
 }
 
+// getIDWait is as per getID but, if no id is available, waits up to timeout for one to be freed (returning 0 if
+// none becomes available)
+func (mids *messageIds) getIDWait(t tokenCompletor, timeout time.Duration) uint16 {
+	id := mids.getID(t)
+	if id != 0 || timeout <= 0 {
+		return id
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		mids.mu.Lock()
+		if mids.freed == nil {
+			mids.freed = make(chan struct{})
+		}
+		freed := mids.freed
+		mids.mu.Unlock()
+		if id = mids.getID(t); id != 0 { // an id may have been freed before we started watching
+			return id
+		}
+		select {
+		case <-freed:
+		case <-deadline.C:
+			return 0
+		}
+	}
+}
+
 func (mids *messageIds) getToken(id uint16) tokenCompletor {
 	mids.mu.RLock()
 	defer mids.mu.RUnlock()
@@ -169,6 +252,11 @@ func (d *DummyToken) Error() error {
 	return nil
 }
 
+// OnComplete implements the CompletionToken OnComplete method (fn is called immediately).
+func (d *DummyToken) OnComplete(fn func(error)) {
+	fn(nil)
+}
+
 func (d *DummyToken) setError(e error) {}
 
 // PlaceHolderToken does nothing and was implemented to allow a messageid to be reserved
@@ -202,4 +290,9 @@ func (p *PlaceHolderToken) Error() error {
 	return nil
 }
 
+// OnComplete implements the CompletionToken OnComplete method (fn is called immediately).
+func (p *PlaceHolderToken) OnComplete(fn func(error)) {
+	fn(nil)
+}
+
 func (p *PlaceHolderToken) setError(e error) {}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package mock provides an in-memory implementation of the mqtt.Client interface along with a simple
+// in-process broker that routes messages between mock clients. This is intended for use in the tests
+// of applications that use the paho client; no network connections are made.
+//
+//	b := mock.NewBroker()
+//	sub := mock.NewClient(b, mqtt.NewClientOptions())
+//	pub := mock.NewClient(b, mqtt.NewClientOptions())
+//	sub.Connect().Wait()
+//	pub.Connect().Wait()
+//	sub.Subscribe("sensors/+/temp", 1, handler)
+//	pub.Publish("sensors/1/temp", 1, false, "21.5") // handler is called before Publish returns
+package mock
+
+import (
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/internal/topic"
+)
+
+// Broker is an in-process MQTT broker that routes messages between the mock clients connected to it.
+// Wildcard subscriptions, shared subscriptions (the $share prefix is ignored so every subscriber receives
+// the message) and retained messages are supported. Message delivery is synchronous; Publish will return
+// once the message has been passed to the handlers of all matching subscribers.
+type Broker struct {
+	mu       sync.Mutex
+	clients  map[*Client]struct{}
+	retained map[string]*message
+}
+
+// NewBroker returns a new, empty, Broker
+func NewBroker() *Broker {
+	return &Broker{
+		clients:  make(map[*Client]struct{}),
+		retained: make(map[string]*message),
+	}
+}
+
+// Publish delivers a message to all clients with a matching subscription (as if it had been published
+// by a client connected to the broker). This can be used to inject messages in tests.
+func (b *Broker) Publish(topic string, qos byte, retained bool, payload []byte) {
+	b.publish(&message{topic: topic, qos: qos, retained: retained, payload: payload})
+}
+
+// Retained returns the payload of the retained message for topic (and a bool indicating if one exists)
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.retained[topic]
+	if !ok {
+		return nil, false
+	}
+	return m.payload, true
+}
+
+// DropConnection simulates the loss of the connection to c; the clients ConnectionLostHandler will be
+// called with err (the client will not automatically reconnect).
+func (b *Broker) DropConnection(c *Client, err error) {
+	if !c.setDisconnected() {
+		return
+	}
+	if c.options.OnConnectionLost != nil {
+		go c.options.OnConnectionLost(c, err)
+	}
+}
+
+// connect registers c with the broker
+func (b *Broker) connect(c *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clients[c] = struct{}{}
+}
+
+// disconnect removes c from the broker
+func (b *Broker) disconnect(c *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, c)
+}
+
+// publish delivers m to all subscribed clients and updates the retained messages
+func (b *Broker) publish(m *message) {
+	b.mu.Lock()
+	if m.retained {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			b.retained[m.topic] = m
+		}
+	}
+	clients := make([]*Client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mu.Unlock() // Handlers may publish so must not hold the lock whilst delivering
+
+	for _, c := range clients {
+		if qos, ok := c.subscribedQos(m.topic); ok {
+			c.deliver(&message{topic: m.topic, qos: min(qos, m.qos), payload: m.payload})
+		}
+	}
+}
+
+// retainedFor returns the retained messages matching filter
+func (b *Broker) retainedFor(filter string) []*message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var msgs []*message
+	for t, m := range b.retained {
+		if topic.Match(filter, t) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
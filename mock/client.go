@@ -0,0 +1,475 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/internal/topic"
+)
+
+// Client is an in-memory implementation of mqtt.Client that communicates via a Broker
+type Client struct {
+	broker  *Broker
+	options mqtt.ClientOptions
+
+	mu            sync.Mutex
+	connected     bool
+	connChanged   chan struct{}                  // closed (and set to nil) when connected changes
+	subscriptions map[string]byte                // topic filter -> QoS
+	routes        map[string]mqtt.MessageHandler // topic filter -> handler (from Subscribe or AddRoute)
+	matchers      map[string]matcherRoute        // matcher.String() -> route (from AddMatcherRoute)
+	groups        map[string]map[string]bool     // group name -> topic filters (from SubscribeGroup)
+}
+
+// matcherRoute is a route added with AddMatcherRoute
+type matcherRoute struct {
+	matcher mqtt.RouteMatcher
+	handler mqtt.MessageHandler
+}
+
+var (
+	_ mqtt.Client                  = (*Client)(nil)
+	_ mqtt.ContextDisconnecter     = (*Client)(nil)
+	_ mqtt.NamedSubscriber         = (*Client)(nil)
+	_ mqtt.SubscriptionLister      = (*Client)(nil)
+	_ mqtt.Pinger                  = (*Client)(nil)
+	_ mqtt.GroupSubscriber         = (*Client)(nil)
+	_ mqtt.AsyncPublisher          = (*Client)(nil)
+	_ mqtt.ConnectionHistoryReader = (*Client)(nil)
+	_ mqtt.InflightInspector       = (*Client)(nil)
+	_ mqtt.ConnectionWaiter        = (*Client)(nil)
+	_ mqtt.OptionsPublisher        = (*Client)(nil)
+	_ mqtt.BatchPublisher          = (*Client)(nil)
+	_ mqtt.OptionsSubscriber       = (*Client)(nil)
+	_ mqtt.MatcherRouter           = (*Client)(nil)
+	_ mqtt.HealthReporter          = (*Client)(nil)
+	_ mqtt.WillUpdater             = (*Client)(nil)
+)
+
+// NewClient returns a new mock Client that will connect to broker. Only the options relating to
+// callbacks (e.g. OnConnect, OnConnectionLost, DefaultPublishHandler) are used.
+func NewClient(broker *Broker, o *mqtt.ClientOptions) *Client {
+	return &Client{
+		broker:        broker,
+		options:       *o,
+		subscriptions: make(map[string]byte),
+		routes:        make(map[string]mqtt.MessageHandler),
+		matchers:      make(map[string]matcherRoute),
+	}
+}
+
+// IsConnected returns true if the client is connected to the broker
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// IsConnectionOpen returns true if the client is connected to the broker
+func (c *Client) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+// ConnectionState returns mqtt.Connected or mqtt.Disconnected (the mock does not reconnect)
+func (c *Client) ConnectionState() mqtt.ConnState {
+	if c.IsConnected() {
+		return mqtt.Connected
+	}
+	return mqtt.Disconnected
+}
+
+// WaitForConnection blocks until Connect is called or ctx is done
+func (c *Client) WaitForConnection(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		if c.connected {
+			c.mu.Unlock()
+			return nil
+		}
+		if c.connChanged == nil {
+			c.connChanged = make(chan struct{})
+		}
+		changed := c.connChanged
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setConnected updates connected and alerts anything waiting on a change (c.mu must be held)
+func (c *Client) setConnected(connected bool) {
+	c.connected = connected
+	if c.connChanged != nil {
+		close(c.connChanged)
+		c.connChanged = nil
+	}
+}
+
+// Connect connects to the broker; this always succeeds. If CleanSession is set then any existing
+// subscriptions are cleared.
+func (c *Client) Connect() mqtt.Token {
+	c.mu.Lock()
+	c.setConnected(true)
+	if c.options.CleanSession {
+		c.subscriptions = make(map[string]byte)
+		c.groups = nil
+	}
+	c.mu.Unlock()
+	c.broker.connect(c)
+	if c.options.OnConnect != nil {
+		go c.options.OnConnect(c)
+	}
+	return newToken(nil)
+}
+
+// Disconnect disconnects from the broker (quiesce is ignored)
+func (c *Client) Disconnect(uint) {
+	c.setDisconnected()
+}
+
+// DisconnectContext disconnects from the broker; as delivery is synchronous there is nothing to drain
+func (c *Client) DisconnectContext(context.Context) error {
+	c.setDisconnected()
+	return nil
+}
+
+// Publish sends a message to the broker (it will have been delivered to all subscribers when this returns)
+func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if !c.IsConnected() {
+		return newToken(mqtt.ErrNotConnected)
+	}
+	m := &message{topic: topic, qos: qos, retained: retained}
+	switch p := payload.(type) {
+	case string:
+		m.payload = []byte(p)
+	case []byte:
+		m.payload = p
+	case bytes.Buffer:
+		m.payload = p.Bytes()
+	case mqtt.PooledPayload:
+		m.payload = bytes.Clone(p.Data) // delivery is synchronous but subscribers may retain the payload
+		if p.Release != nil {
+			defer p.Release()
+		}
+	case io.Reader:
+		b, err := io.ReadAll(p)
+		if err != nil {
+			return newToken(err)
+		}
+		m.payload = b
+	default:
+		return newToken(errors.New("unknown payload type"))
+	}
+	c.broker.publish(m)
+	return newToken(nil)
+}
+
+// PublishWithOptions is as per Publish (the mock client is never offline so the options have no effect)
+func (c *Client) PublishWithOptions(topic string, qos byte, retained bool, payload interface{}, _ mqtt.PublishOptions) mqtt.Token {
+	return c.Publish(topic, qos, retained, payload)
+}
+
+// PublishBatch publishes each of the messages in turn; the token error joins any errors encountered
+func (c *Client) PublishBatch(requests []mqtt.PublishRequest) mqtt.Token {
+	var errs []error
+	for _, r := range requests {
+		if err := c.Publish(r.Topic, r.Qos, r.Retained, r.Payload).Error(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return newToken(errors.Join(errs...))
+}
+
+// PublishAsync publishes the message; the receipt is available immediately
+func (c *Client) PublishAsync(topic string, qos byte, retained bool, payload interface{}) <-chan mqtt.DeliveryReceipt {
+	ch := make(chan mqtt.DeliveryReceipt, 1)
+	ch <- mqtt.DeliveryReceipt{Completed: time.Now(), Err: c.Publish(topic, qos, retained, payload).Error()}
+	return ch
+}
+
+// Subscribe subscribes to topic; any matching retained messages are delivered before this returns
+func (c *Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeWithOptions is as Subscribe (the mock delivers messages synchronously so opts is ignored)
+func (c *Client) SubscribeWithOptions(topic string, qos byte, callback mqtt.MessageHandler, _ mqtt.RouteOptions) mqtt.Token {
+	return c.Subscribe(topic, qos, callback)
+}
+
+// SubscribeMultiple subscribes to each of the filters; any matching retained messages are delivered
+// before this returns
+func (c *Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	if !c.IsConnected() {
+		return newToken(mqtt.ErrNotConnected)
+	}
+	c.mu.Lock()
+	for topic, qos := range filters {
+		c.subscriptions[topic] = qos
+		if callback != nil {
+			c.routes[topic] = callback
+		}
+	}
+	c.mu.Unlock()
+	for topic, qos := range filters {
+		for _, m := range c.broker.retainedFor(topic) {
+			c.deliver(&message{topic: m.topic, qos: min(qos, m.qos), retained: true, payload: m.payload})
+		}
+	}
+	return newToken(nil)
+}
+
+// SubscribeShared subscribes to $share/<group>/<topic> (the mock broker delivers messages to every member of the group)
+func (c *Client) SubscribeShared(group string, topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.Subscribe("$share/"+group+"/"+topic, qos, callback)
+}
+
+// SubscribeNamed subscribes to topic using the handler registered (via ClientOptions.SetNamedHandler) as handlerName
+func (c *Client) SubscribeNamed(topic string, qos byte, handlerName string) mqtt.Token {
+	handler, ok := c.options.NamedHandlers[handlerName]
+	if !ok {
+		return newToken(mqtt.ErrUnknownHandler)
+	}
+	return c.Subscribe(topic, qos, handler)
+}
+
+// Unsubscribe removes the subscriptions (and associated handlers) for each of the topics
+func (c *Client) Unsubscribe(topics ...string) mqtt.Token {
+	if !c.IsConnected() {
+		return newToken(mqtt.ErrNotConnected)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.subscriptions, topic)
+		delete(c.routes, topic)
+		for _, g := range c.groups {
+			delete(g, topic)
+		}
+	}
+	return newToken(nil)
+}
+
+// UnsubscribeAll removes all subscriptions (and associated handlers)
+func (c *Client) UnsubscribeAll() mqtt.Token {
+	c.mu.Lock()
+	topics := make([]string, 0, len(c.subscriptions))
+	for topic := range c.subscriptions {
+		topics = append(topics, topic)
+	}
+	c.mu.Unlock()
+	return c.Unsubscribe(topics...)
+}
+
+// SubscribeGroup is as SubscribeMultiple but also adds the filters to the named group
+func (c *Client) SubscribeGroup(name string, filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	token := c.SubscribeMultiple(filters, callback)
+	if token.Error() != nil {
+		return token
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.groups == nil {
+		c.groups = make(map[string]map[string]bool)
+	}
+	if c.groups[name] == nil {
+		c.groups[name] = make(map[string]bool)
+	}
+	for topic := range filters {
+		c.groups[name][topic] = true
+	}
+	return token
+}
+
+// UnsubscribeGroup removes the subscriptions in the named group that do not belong to another group
+func (c *Client) UnsubscribeGroup(name string) mqtt.Token {
+	c.mu.Lock()
+	var topics []string
+	for topic := range c.groups[name] {
+		shared := false
+		for other, g := range c.groups {
+			shared = shared || (other != name && g[topic])
+		}
+		if !shared {
+			topics = append(topics, topic)
+		}
+	}
+	c.mu.Unlock()
+	token := c.Unsubscribe(topics...)
+	if token.Error() == nil {
+		c.mu.Lock()
+		delete(c.groups, name)
+		c.mu.Unlock()
+	}
+	return token
+}
+
+// AddRoute adds a handler for messages on topic without making a subscription
+func (c *Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[topic] = callback
+}
+
+// SubscribeLatest is as Subscribe (the mock delivers messages synchronously so there is nothing to coalesce)
+func (c *Client) SubscribeLatest(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.Subscribe(topic, qos, callback)
+}
+
+// AddRouteWithOptions is as AddRoute (the mock delivers messages synchronously so opts is ignored)
+func (c *Client) AddRouteWithOptions(topic string, callback mqtt.MessageHandler, _ mqtt.RouteOptions) {
+	c.AddRoute(topic, callback)
+}
+
+// DeleteRoute removes the handler previously added for topic
+func (c *Client) DeleteRoute(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.routes, topic)
+	delete(c.matchers, topic)
+}
+
+// AddMatcherRoute adds a handler for messages on topics matched by matcher without making a subscription
+func (c *Client) AddMatcherRoute(matcher mqtt.RouteMatcher, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.matchers[matcher.String()] = matcherRoute{matcher: matcher, handler: callback}
+}
+
+// OptionsReader returns a ClientOptionsReader for the options passed to NewClient
+func (c *Client) OptionsReader() mqtt.ClientOptionsReader {
+	c.mu.Lock()
+	o := c.options
+	c.mu.Unlock()
+	return mqtt.NewOptionsReader(&o)
+}
+
+// ConnectionHealth reports whether the client is connected (the mock does not exchange pings)
+func (c *Client) ConnectionHealth() mqtt.ConnectionHealth {
+	return mqtt.ConnectionHealth{Connected: c.IsConnectionOpen()}
+}
+
+// Ping returns nil if connected (the mock broker always responds immediately)
+func (c *Client) Ping(ctx context.Context) error {
+	if !c.IsConnectionOpen() {
+		return mqtt.ErrNotConnected
+	}
+	return ctx.Err()
+}
+
+// ConnectionHistory returns nil (the mock does not make network connections)
+func (c *Client) ConnectionHistory() []mqtt.ConnectionAttempt { return nil }
+
+// InflightIDs returns nil (the mock completes flows immediately so no message IDs are in use)
+func (c *Client) InflightIDs() []mqtt.InflightID { return nil }
+
+// UpdateWill records the will in the client options (the mock broker does not publish wills)
+func (c *Client) UpdateWill(topic string, payload []byte, qos byte, retained bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if topic == "" {
+		c.options.UnsetWill()
+		return
+	}
+	c.options.SetBinaryWill(topic, payload, qos, retained)
+}
+
+// Subscriptions returns the topic filters the client is currently subscribed to sorted by topic (the mock
+// broker grants the QoS requested and message counts are not tracked)
+func (c *Client) Subscriptions() []mqtt.SubscriptionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subs := make([]mqtt.SubscriptionInfo, 0, len(c.subscriptions))
+	for topic, qos := range c.subscriptions {
+		subs = append(subs, mqtt.SubscriptionInfo{Topic: topic, Qos: qos, GrantedQos: qos})
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+	return subs
+}
+
+// setDisconnected marks the client as disconnected; returns false if it was not connected
+func (c *Client) setDisconnected() bool {
+	c.mu.Lock()
+	wasConnected := c.connected
+	c.setConnected(false)
+	c.mu.Unlock()
+	c.broker.disconnect(c)
+	return wasConnected
+}
+
+// subscribedQos returns the maximum QoS of the clients subscriptions matching t (false if none match)
+func (c *Client) subscribedQos(t string) (byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var found bool
+	var maxQos byte
+	for filter, qos := range c.subscriptions {
+		if topic.Match(filter, t) {
+			found = true
+			maxQos = max(maxQos, qos)
+		}
+	}
+	return maxQos, found
+}
+
+// deliver passes m to all matching handlers (or the default handler if there are none)
+func (c *Client) deliver(m *message) {
+	type handlerMessage struct {
+		handler mqtt.MessageHandler
+		message *message
+	}
+	m = m.routed("") // copy, as m may be delivered to multiple clients
+	m.receivedAt = time.Now()
+	c.mu.Lock()
+	var handlers []handlerMessage
+	for filter, h := range c.routes {
+		if topic.Match(filter, m.topic) {
+			hm := m.routed(filter)
+			if group, ok := strings.CutPrefix(filter, "$share/"); ok {
+				hm = m.shared(strings.SplitN(group, "/", 2)[0])
+			}
+			handlers = append(handlers, handlerMessage{handler: h, message: hm})
+		}
+	}
+	for _, r := range c.matchers {
+		if params, ok := r.matcher.Match(m.topic); ok {
+			hm := m.withParams(params).routed(r.matcher.Filter())
+			if group, ok := strings.CutPrefix(r.matcher.Filter(), "$share/"); ok {
+				hm = hm.shared(strings.SplitN(group, "/", 2)[0])
+			}
+			handlers = append(handlers, handlerMessage{handler: r.handler, message: hm})
+		}
+	}
+	c.mu.Unlock()
+	if len(handlers) == 0 && c.options.DefaultPublishHandler != nil {
+		handlers = append(handlers, handlerMessage{handler: c.options.DefaultPublishHandler, message: m})
+	}
+	for _, h := range handlers {
+		h.handler(c, h.message)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mock
+
+import (
+	"errors"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// TestMatch checks that the broker delivers messages (and retained messages) to subscriptions with matching filters
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		expected      bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"$share/group/a/+", "a/b", true},
+		{"a/b", "a/b/c", false},
+	}
+	for _, tt := range tests {
+		b := NewBroker()
+		c := NewClient(b, mqtt.NewClientOptions())
+		c.Connect().Wait()
+		b.Publish(tt.topic, 0, true, []byte("retained"))
+		received := 0
+		c.Subscribe(tt.filter, 0, func(mqtt.Client, mqtt.Message) { received++ })
+		b.Publish(tt.topic, 0, false, []byte("live"))
+		if got := received > 0; got != tt.expected {
+			t.Errorf("filter %q, topic %q: delivered = %t, expected %t", tt.filter, tt.topic, got, tt.expected)
+		} else if got && received != 2 {
+			t.Errorf("filter %q, topic %q: expected retained and live messages, got %d", tt.filter, tt.topic, received)
+		}
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := NewBroker()
+	var received []mqtt.Message
+	sub := NewClient(b, mqtt.NewClientOptions().SetDefaultPublishHandler(func(_ mqtt.Client, m mqtt.Message) {
+		received = append(received, m)
+	}))
+	pub := NewClient(b, mqtt.NewClientOptions())
+
+	if token := pub.Publish("a/b", 0, false, "x"); !errors.Is(token.Error(), mqtt.ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+	sub.Connect().Wait()
+	pub.Connect().Wait()
+
+	pub.Publish("sensors/1/temp", 1, true, "retained")
+	sub.Subscribe("sensors/+/temp", 2, nil)
+	if len(received) != 1 || !received[0].Retained() || string(received[0].Payload()) != "retained" {
+		t.Fatalf("retained message not delivered on subscribe: %v", received)
+	}
+
+	var routed []string
+	sub.AddRoute("sensors/2/#", func(_ mqtt.Client, m mqtt.Message) { routed = append(routed, m.Topic()) })
+	pub.Publish("sensors/2/temp", 1, false, []byte("21.5"))
+	pub.Publish("other", 1, false, "ignored")
+	if len(routed) != 1 || routed[0] != "sensors/2/temp" {
+		t.Fatalf("unexpected routed messages: %v", routed)
+	}
+	if len(received) != 1 {
+		t.Fatalf("default handler should not be called when a route matches")
+	}
+
+	pub.Publish("sensors/3/temp", 2, false, "qos")
+	if len(received) != 2 || received[1].Qos() != 2 || received[1].Retained() {
+		t.Fatalf("unexpected message: %v", received)
+	}
+
+	sub.Unsubscribe("sensors/+/temp")
+	pub.Publish("sensors/4/temp", 1, false, "x")
+	if len(received) != 2 {
+		t.Fatalf("message delivered after unsubscribe")
+	}
+}
+
+func TestDropConnection(t *testing.T) {
+	b := NewBroker()
+	lost := make(chan error, 1)
+	c := NewClient(b, mqtt.NewClientOptions().SetConnectionLostHandler(func(_ mqtt.Client, err error) { lost <- err }))
+	c.Connect().Wait()
+	errDrop := errors.New("dropped")
+	b.DropConnection(c, errDrop)
+	if c.IsConnected() {
+		t.Fatalf("client should not be connected")
+	}
+	if err := <-lost; !errors.Is(err, errDrop) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mock
+
+import (
+	"net/url"
+	"time"
+)
+
+// token implements mqtt.Token; as all mock operations complete synchronously tokens are always complete
+type token struct {
+	err  error
+	done chan struct{}
+}
+
+func newToken(err error) *token {
+	t := &token{err: err, done: make(chan struct{})}
+	close(t.done)
+	return t
+}
+
+// Wait returns true (the operation is always complete)
+func (t *token) Wait() bool { return true }
+
+// WaitTimeout returns true (the operation is always complete)
+func (t *token) WaitTimeout(time.Duration) bool { return true }
+
+// Done returns a closed channel
+func (t *token) Done() <-chan struct{} { return t.done }
+
+// Error returns the error (if any) resulting from the operation
+func (t *token) Error() error { return t.err }
+
+// OnComplete calls fn immediately (the operation is always complete; implements mqtt.CompletionToken)
+func (t *token) OnComplete(fn func(error)) { fn(t.err) }
+
+// Errors returns the error (if any) resulting from the operation (implements mqtt.MultiErrorToken)
+func (t *token) Errors() []error {
+	if t.err == nil {
+		return nil
+	}
+	return []error{t.err}
+}
+
+// message implements mqtt.Message
+type message struct {
+	duplicate bool
+	qos       byte
+	retained  bool
+	topic     string
+	messageID uint16
+	payload   []byte
+
+	shareGroup string // set if the message was routed via a shared subscription
+	isShared   bool
+	params     map[string]string // set if the message was routed via a RouteMatcher
+	filter     string            // the filter of the route the message was passed to ("" for the default handler)
+	receivedAt time.Time
+}
+
+// shared returns a copy of m marked as having been routed via the shared subscription group
+func (m *message) shared(group string) *message {
+	c := *m
+	c.shareGroup, c.isShared = group, true
+	return &c
+}
+
+// routed returns a copy of m marked as having been passed to the route for filter
+func (m *message) routed(filter string) *message {
+	c := *m
+	c.filter = filter
+	return &c
+}
+
+// withParams returns a copy of m carrying the parameters extracted by a RouteMatcher
+func (m *message) withParams(params map[string]string) *message {
+	c := *m
+	c.params = params
+	return &c
+}
+
+func (m *message) Duplicate() bool   { return m.duplicate }
+func (m *message) Qos() byte         { return m.qos }
+func (m *message) Retained() bool    { return m.retained }
+func (m *message) Topic() string     { return m.topic }
+func (m *message) MessageID() uint16 { return m.messageID }
+func (m *message) Payload() []byte   { return m.payload }
+func (m *message) Ack()              {}
+
+// Acknowledge and Nack implement mqtt.ManualAckMessage (the mock does not redeliver nacked messages)
+func (m *message) Acknowledge() error { return nil }
+func (m *message) Nack() error        { return nil }
+
+// SharedSubscription implements mqtt.SharedSubscriptionMessage
+func (m *message) SharedSubscription() (string, bool) { return m.shareGroup, m.isShared }
+
+// ReceivedAt, Broker and MatchedFilter implement mqtt.MetadataMessage (Broker always returns nil)
+func (m *message) ReceivedAt() time.Time { return m.receivedAt }
+func (m *message) Broker() *url.URL      { return nil }
+func (m *message) MatchedFilter() string { return m.filter }
+
+// Params and Param implement mqtt.TopicParamsMessage
+func (m *message) Params() map[string]string { return m.params }
+func (m *message) Param(name string) string  { return m.params[name] }
@@ -0,0 +1,450 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package mqtttest provides an embedded MQTT 3.1.1 broker intended for use in integration tests.
+//
+// The broker listens on a random local port and supports enough of the protocol (CONNECT, SUBSCRIBE,
+// UNSUBSCRIBE, PUBLISH at QoS 0-2, retained messages, wills, PINGREQ and DISCONNECT) for the client to be
+// exercised without an external broker. Tests can inject faults: connections can be dropped, acknowledgements
+// delayed, connections refused and arbitrary (e.g. malformed) data written to a client.
+//
+// Sessions are not persisted; when a client disconnects its subscriptions are discarded and CONNACK
+// will always report that no session is present.
+package mqtttest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/internal/topic"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrUnknownClient is returned when an operation references a client that is not connected
+var ErrUnknownClient = errors.New("client is not connected")
+
+// Broker is a minimal MQTT 3.1.1 broker
+type Broker struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu          sync.Mutex
+	sessions    map[string]*session // connected clients (keyed by client ID)
+	retained    map[string]*packets.PublishPacket
+	ackDelay    time.Duration
+	connackCode byte
+	refused     map[string]bool // topic filters for which subscriptions are refused
+	closed      bool
+}
+
+// NewBroker starts a broker listening on a random port on the loopback interface
+func NewBroker() (*Broker, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		listener: l,
+		sessions: make(map[string]*session),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the address the broker is listening on (host:port)
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// URL returns the URL of the broker in the format accepted by ClientOptions.AddBroker
+func (b *Broker) URL() string {
+	return "tcp://" + b.Addr()
+}
+
+// Close stops the broker, closing all client connections, and waits for its goroutines to exit
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	err := b.listener.Close()
+	b.DropConnections()
+	b.wg.Wait()
+	return err
+}
+
+// SetAckDelay delays all acknowledgements (CONNACK, PUBACK, PUBREC, PUBCOMP, SUBACK and UNSUBACK) sent by
+// the broker by d. This can be used to test timeouts and the handling of in-flight messages.
+func (b *Broker) SetAckDelay(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ackDelay = d
+}
+
+// SetConnackReturnCode sets the return code sent in response to CONNECT (e.g. packets.ErrRefusedNotAuthorised).
+// If this is not packets.Accepted then the connection will be closed after the CONNACK is sent.
+func (b *Broker) SetConnackReturnCode(rc byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connackCode = rc
+}
+
+// RefuseSubscriptions causes subsequent subscriptions to any of the topic filters to be refused (the SUBACK
+// will contain the failure return code, 0x80).
+func (b *Broker) RefuseSubscriptions(filters ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.refused == nil {
+		b.refused = make(map[string]bool)
+	}
+	for _, f := range filters {
+		b.refused[f] = true
+	}
+}
+
+// Clients returns the IDs of the connected clients
+func (b *Broker) Clients() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, 0, len(b.sessions))
+	for id := range b.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// DropConnection closes the network connection to the client (without sending anything)
+func (b *Broker) DropConnection(clientID string) error {
+	b.mu.Lock()
+	s, ok := b.sessions[clientID]
+	b.mu.Unlock()
+	if !ok {
+		return ErrUnknownClient
+	}
+	return s.conn.Close()
+}
+
+// Disconnect sends a DISCONNECT packet to the client and then closes the network connection (as a broker does
+// when, for example, another client connects with the same ID). The DISCONNECT packet has no reason code; use
+// SendRaw to send an MQTT v5 style DISCONNECT.
+func (b *Broker) Disconnect(clientID string) error {
+	b.mu.Lock()
+	s, ok := b.sessions[clientID]
+	b.mu.Unlock()
+	if !ok {
+		return ErrUnknownClient
+	}
+	s.writeMu.Lock()
+	err := packets.NewControlPacket(packets.Disconnect).Write(s.conn)
+	s.writeMu.Unlock()
+	if cErr := s.conn.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// DropConnections closes the network connection to all connected clients
+func (b *Broker) DropConnections() {
+	b.mu.Lock()
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+	for _, s := range sessions {
+		_ = s.conn.Close()
+	}
+}
+
+// SendRaw writes data directly to the clients connection. This allows malformed packets to be injected.
+func (b *Broker) SendRaw(clientID string, data []byte) error {
+	b.mu.Lock()
+	s, ok := b.sessions[clientID]
+	b.mu.Unlock()
+	if !ok {
+		return ErrUnknownClient
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(data)
+	return err
+}
+
+// Publish sends a message to all clients with a matching subscription (as if it was published by a client)
+func (b *Broker) Publish(topicName string, qos byte, retained bool, payload []byte) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topicName
+	p.Qos = qos
+	p.Retain = retained
+	p.Payload = payload
+	b.route(p)
+}
+
+// accept accepts incoming connections until the listener is closed
+func (b *Broker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.handle(conn)
+		}()
+	}
+}
+
+// handle processes packets received on conn until the connection is closed
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	cp, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	cm, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		return // first packet must be CONNECT [MQTT-3.1.0-1]
+	}
+
+	s := &session{broker: b, conn: conn, clientID: cm.ClientIdentifier, subscriptions: make(map[string]byte)}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	rc, delay := b.connackCode, b.ackDelay
+	if rc == packets.Accepted {
+		rc = cm.Validate()
+	}
+	if rc == packets.Accepted {
+		if existing, ok := b.sessions[s.clientID]; ok {
+			_ = existing.conn.Close() // The existing client MUST be disconnected [MQTT-3.1.4-2]
+		}
+		b.sessions[s.clientID] = s
+	}
+	b.mu.Unlock()
+	graceful := false
+	defer func() {
+		b.remove(s)
+		if cm.WillFlag && !graceful && rc == packets.Accepted { // The will is published unless the client disconnected [MQTT-3.1.2-8]
+			will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			will.TopicName, will.Payload, will.Qos, will.Retain = cm.WillTopic, cm.WillMessage, cm.WillQos, cm.WillRetain
+			b.route(will)
+		}
+	}()
+
+	time.Sleep(delay)
+	ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ca.ReturnCode = rc
+	if err := s.write(ca); err != nil || rc != packets.Accepted {
+		return
+	}
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.PublishPacket:
+			b.route(p)
+			switch p.Qos {
+			case 1:
+				pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				pa.MessageID = p.MessageID
+				s.ack(pa)
+			case 2:
+				pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pr.MessageID = p.MessageID
+				s.ack(pr)
+			}
+		case *packets.PubrelPacket:
+			pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pc.MessageID = p.MessageID
+			s.ack(pc)
+		case *packets.PubrecPacket: // QoS 2 message sent by the broker
+			pr := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pr.MessageID = p.MessageID
+			_ = s.write(pr)
+		case *packets.PubackPacket, *packets.PubcompPacket:
+			// Messages are not retransmitted so nothing to do
+		case *packets.SubscribePacket:
+			sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			sa.MessageID = p.MessageID
+			for i, t := range p.Topics {
+				b.mu.Lock()
+				refused := b.refused[t]
+				b.mu.Unlock()
+				if refused {
+					sa.ReturnCodes = append(sa.ReturnCodes, 0x80)
+					continue
+				}
+				qos := min(p.Qoss[i], 2)
+				s.subscribe(t, qos)
+				sa.ReturnCodes = append(sa.ReturnCodes, qos)
+			}
+			s.ack(sa)
+			for i, t := range p.Topics {
+				if sa.ReturnCodes[i] == 0x80 {
+					continue
+				}
+				for _, rm := range b.retainedFor(t) {
+					s.send(rm, p.Qoss[i], true)
+				}
+			}
+		case *packets.UnsubscribePacket:
+			for _, t := range p.Topics {
+				s.unsubscribe(t)
+			}
+			ua := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ua.MessageID = p.MessageID
+			s.ack(ua)
+		case *packets.PingreqPacket:
+			_ = s.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			graceful = true
+			return
+		default:
+			return // Unexpected packet; the spec requires that the connection be closed
+		}
+	}
+}
+
+// remove removes s from the connected sessions (if it has not already been replaced)
+func (b *Broker) remove(s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sessions[s.clientID] == s {
+		delete(b.sessions, s.clientID)
+	}
+}
+
+// route delivers p to all clients with matching subscriptions and updates the retained messages
+func (b *Broker) route(p *packets.PublishPacket) {
+	b.mu.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p
+		}
+	}
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+	for _, s := range sessions {
+		if qos, ok := s.subscribedQos(p.TopicName); ok {
+			s.send(p, qos, false)
+		}
+	}
+}
+
+// retainedFor returns the retained messages matching filter
+func (b *Broker) retainedFor(filter string) []*packets.PublishPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var msgs []*packets.PublishPacket
+	for t, p := range b.retained {
+		if topic.Match(filter, t) {
+			msgs = append(msgs, p)
+		}
+	}
+	return msgs
+}
+
+// session holds the state of a connected client
+type session struct {
+	broker   *Broker
+	conn     net.Conn
+	clientID string
+
+	writeMu sync.Mutex
+
+	mu            sync.Mutex
+	subscriptions map[string]byte
+	lastID        uint16
+}
+
+// write writes cp to the connection
+func (s *session) write(cp packets.ControlPacket) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return cp.Write(s.conn)
+}
+
+// ack writes cp to the connection after the configured acknowledgement delay
+func (s *session) ack(cp packets.ControlPacket) {
+	s.broker.mu.Lock()
+	delay := s.broker.ackDelay
+	s.broker.mu.Unlock()
+	if delay == 0 {
+		_ = s.write(cp)
+		return
+	}
+	time.AfterFunc(delay, func() { _ = s.write(cp) })
+}
+
+// send sends a copy of p to the client at the lower of p's QoS and maxQos
+func (s *session) send(p *packets.PublishPacket, maxQos byte, retained bool) {
+	pub := p.Copy()
+	pub.Qos = min(p.Qos, maxQos)
+	pub.Retain = retained
+	if pub.Qos > 0 {
+		s.mu.Lock()
+		s.lastID++
+		if s.lastID == 0 {
+			s.lastID = 1
+		}
+		pub.MessageID = s.lastID
+		s.mu.Unlock()
+	}
+	if err := s.write(pub); err != nil {
+		_ = s.conn.Close()
+	}
+}
+
+func (s *session) subscribe(filter string, qos byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[filter] = qos
+}
+
+func (s *session) unsubscribe(filter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscriptions, filter)
+}
+
+// subscribedQos returns the maximum QoS of the sessions subscriptions matching t (false if none match)
+func (s *session) subscribedQos(t string) (byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found bool
+	var maxQos byte
+	for filter, qos := range s.subscriptions {
+		if topic.Match(filter, t) {
+			found = true
+			maxQos = max(maxQos, qos)
+		}
+	}
+	return maxQos, found
+}
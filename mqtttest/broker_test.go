@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtttest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func newTestBroker(t *testing.T) *Broker {
+	t.Helper()
+	b, err := NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+	return b
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := newTestBroker(t)
+	received := make(chan mqtt.Message, 1)
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("sub"))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	b.Publish("retained/topic", 1, true, []byte("retained"))
+	if token := c.Subscribe("+/topic", 2, func(_ mqtt.Client, m mqtt.Message) { received <- m }); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+	select {
+	case m := <-received:
+		if !m.Retained() || string(m.Payload()) != "retained" {
+			t.Fatalf("unexpected message %s %s", m.Topic(), m.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("retained message not received")
+	}
+
+	if token := c.Publish("test/topic", 2, false, "hello"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("publish failed: %v", token.Error())
+	}
+	select {
+	case m := <-received:
+		if m.Topic() != "test/topic" || m.Qos() != 2 || string(m.Payload()) != "hello" {
+			t.Fatalf("unexpected message %s %d %s", m.Topic(), m.Qos(), m.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not received")
+	}
+}
+
+func TestDropConnection(t *testing.T) {
+	b := newTestBroker(t)
+	connected := make(chan struct{}, 2)
+	opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("drop").
+		SetAutoReconnect(true).SetMaxReconnectInterval(100 * time.Millisecond).
+		SetOnConnectHandler(func(mqtt.Client) { connected <- struct{}{} })
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	<-connected
+
+	if err := b.DropConnection("drop"); err != nil {
+		t.Fatalf("DropConnection: %s", err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client did not reconnect")
+	}
+	if err := b.DropConnection("unknown"); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("expected ErrUnknownClient, got %v", err)
+	}
+}
+
+func TestConnackReturnCode(t *testing.T) {
+	b := newTestBroker(t)
+	b.SetConnackReturnCode(packets.ErrRefusedNotAuthorised)
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(b.URL()).SetProtocolVersion(4))
+	token := c.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatalf("connect did not complete")
+	}
+	if !errors.Is(token.Error(), packets.ErrorRefusedNotAuthorised) {
+		t.Fatalf("expected not authorised, got %v", token.Error())
+	}
+}
+
+func TestSendRawMalformed(t *testing.T) {
+	b := newTestBroker(t)
+	lost := make(chan error, 1)
+	opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("raw").SetAutoReconnect(false).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { lost <- err })
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+
+	if err := b.SendRaw("raw", []byte{0x00, 0x00}); err != nil { // packet type 0 is reserved
+		t.Fatalf("SendRaw: %s", err)
+	}
+	select {
+	case err := <-lost:
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection not lost after malformed packet")
+	}
+}
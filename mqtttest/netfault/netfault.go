@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package netfault provides a net.Conn wrapper that injects faults into an MQTT connection. It understands MQTT
+// framing so faults can be targeted at particular packets; packets can be dropped, delayed, duplicated or truncated
+// and the connection can be killed at specific points in the protocol (e.g. immediately after a PUBREC is sent).
+//
+// The wrapper is typically installed using ClientOptions.SetCustomOpenConnectionFn:
+//
+//	opts.SetCustomOpenConnectionFn(func(uri *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+//		conn, err := net.Dial("tcp", uri.Host)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return netfault.Wrap(conn, netfault.Rule{Direction: netfault.Outbound, PacketType: packets.Pubrec, Action: netfault.KillAfter}), nil
+//	})
+package netfault
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrKilled is returned by Read and Write once the connection has been killed by a rule. A distinct error is used
+// (rather than net.ErrClosed) so the client sees a network failure rather than the connection having been closed
+// locally.
+var ErrKilled = errors.New("netfault: connection killed")
+
+// Direction specifies whether a Rule applies to packets written to, or read from, the connection
+type Direction int
+
+const (
+	Outbound Direction = iota // packets written to the connection (i.e. sent by the client)
+	Inbound                   // packets read from the connection (i.e. received by the client)
+)
+
+// Action is the fault injected when a Rule matches a packet
+type Action int
+
+const (
+	Drop       Action = iota // the packet is discarded
+	Delay                    // the packet is passed on after Rule.Delay
+	Duplicate                // the packet is passed on twice
+	Truncate                 // only the first Rule.TruncateTo bytes of the packet are passed on
+	KillBefore               // the connection is closed before the packet is passed on
+	KillAfter                // the connection is closed after the packet is passed on
+)
+
+// Rule determines which packets are affected, and how
+type Rule struct {
+	Direction  Direction
+	PacketType byte                             // if non-zero, only packets of this type match (e.g. packets.Pubrec)
+	Match      func(packets.ControlPacket) bool // if non-nil, only packets for which this returns true match
+	Skip       int                              // number of matching packets to pass unaffected before the rule applies
+	Times      int                              // number of packets the rule applies to (0 = unlimited)
+	Action     Action
+	Delay      time.Duration // used with Delay
+	TruncateTo int           // used with Truncate (0 = half of the packet)
+}
+
+// rule tracks the state of a Rule
+type rule struct {
+	Rule
+	matched int // number of packets matched
+}
+
+// Conn wraps a net.Conn injecting faults as specified by its rules. The first rule that applies to a packet is
+// used. Conn is safe for concurrent use by one reader and one writer.
+type Conn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	rules    []*rule
+	injected int
+	killed   bool
+
+	wBuf bytes.Buffer // outbound bytes not yet forming a complete packet
+	rRaw bytes.Buffer // inbound bytes not yet forming a complete packet
+	rOut bytes.Buffer // inbound bytes ready to be returned by Read
+}
+
+// Wrap returns a Conn wrapping conn that applies rules
+func Wrap(conn net.Conn, rules ...Rule) *Conn {
+	c := &Conn{Conn: conn}
+	for _, r := range rules {
+		c.AddRule(r)
+	}
+	return c
+}
+
+// AddRule adds a rule (which will be checked after any existing rules)
+func (c *Conn) AddRule(r Rule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = append(c.rules, &rule{Rule: r})
+}
+
+// ClearRules removes all rules (so subsequent packets pass unaffected)
+func (c *Conn) ClearRules() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = nil
+}
+
+// Injected returns the number of faults that have been injected
+func (c *Conn) Injected() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.injected
+}
+
+// Killed returns true if the connection has been closed due to a KillBefore or KillAfter rule
+func (c *Conn) Killed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.killed
+}
+
+// Write buffers b, passing each complete packet on (subject to the rules)
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wBuf.Write(b)
+	for {
+		raw := nextPacket(&c.wBuf)
+		if raw == nil {
+			return len(b), nil
+		}
+		if err := c.apply(Outbound, raw, func(p []byte) error {
+			_, err := c.Conn.Write(p)
+			return err
+		}); err != nil {
+			return 0, c.translate(err)
+		}
+	}
+}
+
+// Read returns data from the wrapped connection once complete packets have been received (subject to the rules)
+func (c *Conn) Read(b []byte) (int, error) {
+	buf := make([]byte, 4096)
+	for c.rOut.Len() == 0 {
+		if raw := nextPacket(&c.rRaw); raw != nil {
+			if err := c.apply(Inbound, raw, func(p []byte) error {
+				c.rOut.Write(p)
+				return nil
+			}); err != nil {
+				return 0, c.translate(err)
+			}
+			continue
+		}
+		n, err := c.Conn.Read(buf)
+		c.rRaw.Write(buf[:n])
+		if err != nil && n == 0 {
+			return 0, c.translate(err)
+		}
+	}
+	return c.rOut.Read(b)
+}
+
+// apply passes raw (a complete packet) to pass as determined by the first applicable rule
+func (c *Conn) apply(d Direction, raw []byte, pass func([]byte) error) error {
+	r := c.match(d, raw)
+	if r == nil {
+		return pass(raw)
+	}
+	switch r.Action {
+	case Drop:
+		return nil
+	case Delay:
+		time.Sleep(r.Delay)
+		return pass(raw)
+	case Duplicate:
+		if err := pass(raw); err != nil {
+			return err
+		}
+		return pass(raw)
+	case Truncate:
+		n := r.TruncateTo
+		if n <= 0 || n > len(raw) {
+			n = len(raw) / 2
+		}
+		return pass(raw[:n])
+	case KillBefore:
+		c.kill()
+		return ErrKilled
+	case KillAfter:
+		err := pass(raw)
+		if d == Outbound || err != nil {
+			c.kill()
+			return err
+		}
+		c.kill() // the packet will still be returned by Read (subsequent reads fail)
+		return nil
+	}
+	return pass(raw)
+}
+
+// match returns the rule that applies to raw (nil if none)
+func (c *Conn) match(d Direction, raw []byte) *rule {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var cp packets.ControlPacket // only decoded if a rule needs it
+	for _, r := range c.rules {
+		if r.Direction != d || (r.PacketType != 0 && raw[0]>>4 != r.PacketType) {
+			continue
+		}
+		if r.Match != nil {
+			if cp == nil {
+				var err error
+				if cp, err = packets.ReadPacket(bytes.NewReader(raw)); err != nil {
+					continue
+				}
+			}
+			if !r.Match(cp) {
+				continue
+			}
+		}
+		r.matched++
+		if r.matched <= r.Skip || (r.Times > 0 && r.matched > r.Skip+r.Times) {
+			continue
+		}
+		c.injected++
+		return r
+	}
+	return nil
+}
+
+// translate returns ErrKilled, in place of err, if the connection has been killed
+func (c *Conn) translate(err error) error {
+	if c.Killed() {
+		return ErrKilled
+	}
+	return err
+}
+
+// kill closes the wrapped connection
+func (c *Conn) kill() {
+	c.mu.Lock()
+	c.killed = true
+	c.mu.Unlock()
+	_ = c.Conn.Close()
+}
+
+// nextPacket removes, and returns, the first complete packet in buf (nil if buf does not hold a complete packet)
+func nextPacket(buf *bytes.Buffer) []byte {
+	b := buf.Bytes()
+	if len(b) < 2 {
+		return nil
+	}
+	length, multiplier := 0, 1
+	for i := 1; i < len(b) && i <= 4; i++ {
+		length += int(b[i]&127) * multiplier
+		if b[i]&128 == 0 {
+			total := 1 + i + length
+			if len(b) < total {
+				return nil
+			}
+			return bytes.Clone(buf.Next(total))
+		}
+		multiplier *= 128
+	}
+	if len(b) > 4 { // invalid remaining length; pass the data on unchanged
+		return bytes.Clone(buf.Next(len(b)))
+	}
+	return nil
+}
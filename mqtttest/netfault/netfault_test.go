@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package netfault
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// publishBytes returns an encoded QoS 1 PUBLISH packet
+func publishBytes(t *testing.T, id uint16, payload string) []byte {
+	t.Helper()
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Qos = 1
+	p.MessageID = id
+	p.TopicName = "a"
+	p.Payload = []byte(payload)
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOutboundRules(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := Wrap(client,
+		Rule{Direction: Outbound, PacketType: packets.Publish, Skip: 1, Times: 1, Action: Drop},
+		Rule{Direction: Outbound, Match: func(cp packets.ControlPacket) bool {
+			return string(cp.(*packets.PublishPacket).Payload) == "dup"
+		}, Action: Duplicate},
+	)
+
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			cp, err := packets.ReadPacket(server)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- cp.(*packets.PublishPacket).Payload
+		}
+	}()
+
+	p1 := publishBytes(t, 1, "1")
+	// Write a packet in two parts to check that it is reassembled
+	if _, err := c.Write(p1[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(p1[3:]); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][]byte{publishBytes(t, 2, "2"), publishBytes(t, 3, "dup"), publishBytes(t, 4, "4")} {
+		if _, err := c.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for range 4 {
+		select {
+		case p := <-received:
+			got = append(got, string(p))
+		case <-time.After(time.Second):
+			t.Fatalf("timeout (got %v)", got)
+		}
+	}
+	if exp := []string{"1", "dup", "dup", "4"}; len(got) != 4 || got[0] != exp[0] || got[1] != exp[1] || got[2] != exp[2] || got[3] != exp[3] {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	if n := c.Injected(); n != 2 {
+		t.Fatalf("expected 2 faults, got %d", n)
+	}
+}
+
+func TestInboundKill(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := Wrap(client, Rule{Direction: Inbound, PacketType: packets.Publish, Action: KillAfter})
+
+	go func() {
+		_, _ = server.Write(publishBytes(t, 1, "1"))
+	}()
+	cp, err := packets.ReadPacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cp.(*packets.PublishPacket).Payload) != "1" {
+		t.Fatalf("unexpected packet %v", cp)
+	}
+	if !c.Killed() {
+		t.Fatal("expected connection to be killed")
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrKilled) {
+		t.Fatalf("expected read from killed connection to fail, got %v", err)
+	}
+}
+
+// TestClientReconnect checks that the client recovers when the connection is killed after a PUBLISH is sent
+func TestClientReconnect(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var conns atomic.Int32
+	var first *Conn
+	opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("netfault").SetCleanSession(false).
+		SetMaxReconnectInterval(50 * time.Millisecond).
+		SetCustomOpenConnectionFn(func(uri *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+			conn, err := net.Dial("tcp", uri.Host)
+			if err != nil || conns.Add(1) > 1 {
+				return conn, err
+			}
+			first = Wrap(conn, Rule{Direction: Outbound, PacketType: packets.Publish, Action: KillAfter})
+			return first, nil
+		})
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(250)
+
+	if token := c.Publish("a", 1, false, "1"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("publish failed: %v", token.Error())
+	}
+	if !first.Killed() || conns.Load() < 2 {
+		t.Fatalf("expected the connection to be killed and re-established (connections: %d)", conns.Load())
+	}
+}
@@ -20,11 +20,14 @@
 package mqtt
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
-	"reflect"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -115,23 +118,32 @@ func verifyCONNACK(conn io.Reader, logger *slog.Logger) (byte, bool, error) {
 // err  - If != nil then an error has occurred
 // cp - A control packet received over the network link
 type inbound struct {
-	err error
-	cp  packets.ControlPacket
+	err      error
+	cp       packets.ControlPacket
+	consumed *packets.PublishPacket // a PUBLISH that has been processed (streamed or discarded) and needs acknowledging
 }
 
 // startIncoming initiates a goroutine that reads incoming messages off the wire and sends them to the channel (returned).
 // If there are any issues with the network connection then the returned channel will be closed and the goroutine will exit
 // (so closing the connection will terminate the goroutine)
-func startIncoming(conn io.Reader, logger *slog.Logger) <-chan inbound {
+func startIncoming(conn io.Reader, c commsFns, logger *slog.Logger) <-chan inbound {
 	var err error
 	var cp packets.ControlPacket
+	var payload *io.LimitedReader
 	ibound := make(chan inbound)
+	maxPayload, streamThreshold := c.maxInboundPayload(), c.streamThreshold()
 
 	logger.Debug("incoming started", slog.String("component", string(NET)))
 
 	go func() {
 		for {
-			if cp, err = packets.ReadPacket(conn); err != nil {
+			if cp, payload, err = packets.ReadPacketStream(conn, maxPayload, streamThreshold); err != nil {
+				var tooLarge *packets.PayloadTooLargeError
+				if errors.As(err, &tooLarge) { // the payload has been discarded so we can carry on reading
+					logger.Warn("discarding PUBLISH with oversize payload", slog.String("topic", tooLarge.Packet.TopicName), slog.Int("size", tooLarge.Size), slog.Int("limit", tooLarge.Limit), slog.String("component", string(NET)))
+					ibound <- inbound{consumed: tooLarge.Packet}
+					continue
+				}
 				// We do not want to log the error if it is due to the network connection having been closed
 				// elsewhere (i.e. after sending DisconnectPacket). Detecting this situation is the subject of
 				// https://github.com/golang/go/issues/4373
@@ -142,6 +154,18 @@ func startIncoming(conn io.Reader, logger *slog.Logger) <-chan inbound {
 				logger.Debug("incoming complete", slog.String("component", string(NET)))
 				return
 			}
+			if payload != nil { // The payload must be consumed by the streaming handler before we can continue reading
+				p := cp.(*packets.PublishPacket)
+				if c.persistInbound(p) {
+					logger.Debug("startIncoming streaming payload", slog.String("topic", p.TopicName), slog.Int64("size", payload.N), slog.String("component", string(NET)))
+					c.streamPayload(p, payload)
+				} else { // QoS 2 redelivery of a message that has already been streamed; the PUBREC will be repeated
+					logger.Debug("startIncoming discarding redelivered streamed payload", slog.Uint64("messageID", uint64(p.MessageID)), slog.String("component", string(NET)))
+					_, _ = io.Copy(io.Discard, payload) // any error will be picked up when the next packet is read
+				}
+				ibound <- inbound{consumed: p}
+				continue
+			}
 			logger.Debug("startIncoming Received Message", slog.String("component", string(NET)))
 			ibound <- inbound{cp: cp}
 		}
@@ -168,7 +192,7 @@ func startIncomingComms(conn io.Reader,
 	inboundFromStore <-chan packets.ControlPacket,
 	logger *slog.Logger,
 ) <-chan incomingComms {
-	ibound := startIncoming(conn, logger) // Start goroutine that reads from network connection
+	ibound := startIncoming(conn, c, logger) // Start goroutine that reads from network connection
 	output := make(chan incomingComms)
 
 	logger.Debug("startIncomingComms started", slog.String("component", string(NET)))
@@ -183,6 +207,7 @@ func startIncomingComms(conn io.Reader,
 
 			var msg packets.ControlPacket
 			var ok bool
+			redelivered := false // true if msg is a QoS 2 PUBLISH that has already been acknowledged (so must not be passed on)
 			select {
 			case msg, ok = <-inboundFromStore:
 				if !ok {
@@ -203,10 +228,30 @@ func startIncomingComms(conn io.Reader,
 					output <- incomingComms{err: ibMsg.err}
 					continue // Usually the channel will be closed immediately after sending an error but safer that we do not assume this
 				}
+				if p := ibMsg.consumed; p != nil {
+					// The message has been dealt with (streamed to the handler or discarded due to its size) so
+					// just needs acknowledging (it is not passed on). As with messages passed to handlers, the
+					// acknowledgement is persisted first so that a QoS 2 redelivery is not streamed again.
+					c.UpdateLastReceived()
+					switch p.Qos {
+					case 1:
+						pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+						pa.MessageID = p.MessageID
+						c.persistOutbound(pa)
+						output <- incomingComms{outbound: &PacketAndToken{p: pa, t: nil}}
+					case 2:
+						pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+						pr.MessageID = p.MessageID
+						c.persistOutbound(pr)
+						output <- incomingComms{outbound: &PacketAndToken{p: pr, t: nil}}
+					}
+					continue
+				}
 				msg = ibMsg.cp
 
-				c.persistInbound(msg)
+				redelivered = !c.persistInbound(msg)
 				c.UpdateLastReceived() // Notify keepalive logic that we recently received a packet
+				c.tracePacket(PacketReceived, msg)
 			}
 
 			switch m := msg.(type) {
@@ -218,13 +263,18 @@ func startIncomingComms(conn io.Reader,
 				token := c.getToken(m.MessageID)
 
 				if t, ok := token.(*SubscribeToken); ok {
-					logger.Debug("startIncomingComms: granted qoss", slog.Any("returnCodes", m.ReturnCodes), slog.String("component", string(NET)))
-					for i, qos := range m.ReturnCodes {
-						t.subResult[t.subs[i]] = qos
+					logger.Debug("startIncomingComms: granted qoss", slog.String("returnCodes", hex.EncodeToString(m.ReturnCodes)), slog.String("component", string(NET)))
+					err := t.setResult(m.ReturnCodes)
+					c.subscriptionsGranted(t.Result())
+					if err != nil {
+						logger.Warn("startIncomingComms: subscription refused", slog.String("error", err.Error()), slog.String("component", string(NET)))
+						t.setError(err)
+					} else {
+						t.flowComplete()
 					}
+				} else {
+					token.flowComplete()
 				}
-
-				token.flowComplete()
 				c.freeID(m.MessageID)
 			case *packets.UnsubackPacket:
 				logger.Debug("startIncomingComms: received unsuback", slog.Uint64("messageID", uint64(m.MessageID)), slog.String("component", string(NET)))
@@ -232,6 +282,13 @@ func startIncomingComms(conn io.Reader,
 				c.freeID(m.MessageID)
 			case *packets.PublishPacket:
 				logger.Debug("startIncomingComms: received publish", slog.Uint64("messageID", uint64(m.MessageID)), slog.String("component", string(NET)))
+				if redelivered { // The handler has already acknowledged this message; repeat the PUBREC
+					logger.Debug("startIncomingComms: publish already acknowledged", slog.Uint64("messageID", uint64(m.MessageID)), slog.String("component", string(NET)))
+					pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+					pr.MessageID = m.MessageID
+					output <- incomingComms{outbound: &PacketAndToken{p: pr, t: nil}}
+					continue
+				}
 				output <- incomingComms{incomingPub: m}
 			case *packets.PubackPacket:
 				logger.Debug("startIncomingComms: received puback", slog.Uint64("messageID", uint64(m.MessageID)), slog.String("component", string(NET)))
@@ -252,6 +309,11 @@ func startIncomingComms(conn io.Reader,
 				logger.Debug("startIncomingComms: received pubcomp", slog.Uint64("messageID", uint64(m.MessageID)), slog.String("component", string(NET)))
 				c.getToken(m.MessageID).flowComplete()
 				c.freeID(m.MessageID)
+			case *packets.DisconnectPacket:
+				// The broker will close the connection; reporting this first means that the reason is not lost
+				// (the connection loss would otherwise be reported as EOF)
+				logger.Warn("startIncomingComms: received disconnect from broker", slog.Int("reasonCode", int(m.ReasonCode)), slog.String("component", string(NET)))
+				output <- incomingComms{err: &ServerDisconnectError{ReasonCode: m.ReasonCode}}
 			}
 		}
 	}()
@@ -271,6 +333,7 @@ func startOutgoingComms(conn net.Conn,
 	logger *slog.Logger,
 ) <-chan error {
 	errChan := make(chan error)
+	stallTimeout := c.writeStallTimeout()
 	logger.Debug("outgoing started", slog.String("component", string(NET)))
 
 	go func() {
@@ -292,45 +355,45 @@ func startOutgoingComms(conn net.Conn,
 					obound = nil
 					continue
 				}
-				msg := pub.p.(*packets.PublishPacket)
-				logger.Debug("obound msg to write", slog.Uint64("messageID", uint64(msg.MessageID)), slog.String("component", string(NET)))
-
-				writeTimeout := c.getWriteTimeOut()
-				if writeTimeout > 0 {
-					if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
-						logger.Error("SetWriteDeadline error", slog.String("error", err.Error()), slog.String("component", string(NET)))
-					}
+				batch := pub.batch
+				if batch == nil {
+					batch = []*PacketAndToken{pub}
+					logger.Debug("obound msg to write", slog.Uint64("messageID", uint64(pub.p.Details().MessageID)), slog.String("component", string(NET)))
+				} else {
+					logger.Debug("obound batch to write", slog.Int("messages", len(batch)), slog.String("component", string(NET)))
 				}
 
-				if err := msg.Write(conn); err != nil {
+				err := guardedWrite(conn, c.getWriteTimeOut(), stallTimeout, logger, func() (err error) {
+					if pub.batch == nil {
+						return pub.p.Write(conn)
+					}
+					batch, err = writeBatch(conn, batch, logger)
+					return err
+				})
+				if err != nil {
 					logger.Error("outgoing obound reporting error", slog.String("error", err.Error()), slog.String("component", string(NET)))
-					pub.t.setError(err)
+					pub.setError(err)
 					// report error if it's not due to the connection being closed elsewhere
-					if !strings.Contains(err.Error(), closedNetConnErrorText) {
+					if errors.Is(err, ErrWriteStalled) || !strings.Contains(err.Error(), closedNetConnErrorText) {
 						errChan <- err
 					}
 					continue
 				}
 
-				if writeTimeout > 0 {
-					// If we successfully wrote, we don't want the timeout to happen during an idle period
-					// so we reset it to infinite.
-					if err := conn.SetWriteDeadline(time.Time{}); err != nil {
-						logger.Error("SetWriteDeadline to 0 error", slog.String("error", err.Error()), slog.String("component", string(NET)))
+				for _, b := range batch {
+					c.tracePacket(PacketSent, b.p)
+					if b.p.Details().Qos == 0 {
+						b.t.flowComplete()
 					}
 				}
-
-				if msg.Qos == 0 {
-					pub.t.flowComplete()
-				}
-				logger.Debug("obound wrote msg", slog.Uint64("messageID", uint64(msg.MessageID)), slog.String("component", string(NET)))
+				logger.Debug("obound wrote msg", slog.Int("messages", len(batch)), slog.String("component", string(NET)))
 			case msg, ok := <-oboundp:
 				if !ok {
 					oboundp = nil
 					continue
 				}
-				logger.Debug("obound priority msg to write", slog.String("type", reflect.TypeOf(msg.p).String()), slog.Uint64("messageID", uint64(msg.p.Details().MessageID)), slog.String("component", string(NET)))
-				if err := msg.p.Write(conn); err != nil {
+				logger.Debug("obound priority msg to write", slog.String("type", packets.PacketNames[packets.PacketType(msg.p)]), slog.Uint64("messageID", uint64(msg.p.Details().MessageID)), slog.String("component", string(NET)))
+				if err := guardedWrite(conn, 0, stallTimeout, logger, func() error { return msg.p.Write(conn) }); err != nil {
 					logger.Error("outgoing oboundp reporting error", slog.String("error", err.Error()), slog.String("component", string(NET)))
 					if msg.t != nil {
 						msg.t.setError(err)
@@ -338,6 +401,7 @@ func startOutgoingComms(conn net.Conn,
 					errChan <- err
 					continue
 				}
+				c.tracePacket(PacketSent, msg.p)
 
 				if _, ok := msg.p.(*packets.DisconnectPacket); ok {
 					msg.t.(*DisconnectToken).flowComplete()
@@ -351,8 +415,8 @@ func startOutgoingComms(conn net.Conn,
 					oboundFromIncoming = nil
 					continue
 				}
-				logger.Debug("obound from incoming msg to write", slog.String("type", reflect.TypeOf(msg.p).String()), slog.Uint64("messageID", uint64(msg.p.Details().MessageID)), slog.String("component", string(NET)))
-				if err := msg.p.Write(conn); err != nil {
+				logger.Debug("obound from incoming msg to write", slog.String("type", packets.PacketNames[packets.PacketType(msg.p)]), slog.Uint64("messageID", uint64(msg.p.Details().MessageID)), slog.String("component", string(NET)))
+				if err := guardedWrite(conn, 0, stallTimeout, logger, func() error { return msg.p.Write(conn) }); err != nil {
 					logger.Error("outgoing oboundFromIncoming reporting error", slog.String("error", err.Error()), slog.String("component", string(NET)))
 					if msg.t != nil {
 						msg.t.setError(err)
@@ -360,6 +424,7 @@ func startOutgoingComms(conn net.Conn,
 					errChan <- err
 					continue
 				}
+				c.tracePacket(PacketSent, msg.p)
 			}
 			c.UpdateLastSent() // Record that a packet has been received (for keepalive routine)
 		}
@@ -367,16 +432,84 @@ func startOutgoingComms(conn net.Conn,
 	return errChan
 }
 
+// guardedWrite calls write, which writes to conn, with a write deadline of the shorter of writeTimeout and
+// stallTimeout (if either is set). If stallTimeout is set and write is still blocked once it expires, conn is
+// closed (not all connections honour deadlines). An error wrapping ErrWriteStalled is returned if the write
+// stalled.
+func guardedWrite(conn net.Conn, writeTimeout, stallTimeout time.Duration, logger *slog.Logger, write func() error) error {
+	timeout := writeTimeout
+	if stallTimeout > 0 && (timeout <= 0 || stallTimeout < timeout) {
+		timeout = stallTimeout
+	}
+	if timeout <= 0 {
+		return write()
+	}
+	start := time.Now()
+	if err := conn.SetWriteDeadline(start.Add(timeout)); err != nil {
+		logger.Error("SetWriteDeadline error", slog.String("error", err.Error()), slog.String("component", string(NET)))
+	}
+	var watchdog *time.Timer
+	if stallTimeout > 0 {
+		watchdog = time.AfterFunc(stallTimeout, func() {
+			logger.Warn("write stalled; closing connection", slog.Duration("timeout", stallTimeout), slog.String("component", string(NET)))
+			_ = conn.Close()
+		})
+	}
+	err := write()
+	stalled := watchdog != nil && !watchdog.Stop()
+	if err == nil && !stalled {
+		// If we successfully wrote, we don't want the timeout to happen during an idle period
+		// so we reset it to infinite.
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			logger.Error("SetWriteDeadline to 0 error", slog.String("error", err.Error()), slog.String("component", string(NET)))
+		}
+		return nil
+	}
+	if stalled || (stallTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) && time.Since(start) >= stallTimeout) {
+		if err == nil {
+			return ErrWriteStalled
+		}
+		return fmt.Errorf("%w after %s: %w", ErrWriteStalled, stallTimeout, err)
+	}
+	return err
+}
+
 // commsFns provide access to the client state (messageids, requesting disconnection and updating timing)
 type commsFns interface {
-	getToken(id uint16) tokenCompletor       // Retrieve the token for the specified messageid (if none then a dummy token must be returned)
-	freeID(id uint16)                        // Release the specified messageid (clearing out of any persistent store)
-	UpdateLastReceived()                     // Must be called whenever a packet is received
-	UpdateLastSent()                         // Must be called whenever a packet is successfully sent
-	getWriteTimeOut() time.Duration          // Return the writetimeout (or 0 if none)
-	persistOutbound(m packets.ControlPacket) // add the packet to the outbound store
-	persistInbound(m packets.ControlPacket)  // add the packet to the inbound store
-	pingRespReceived()                       // Called when a ping response is received
+	getToken(id uint16) tokenCompletor                                 // Retrieve the token for the specified messageid (if none then a dummy token must be returned)
+	freeID(id uint16)                                                  // Release the specified messageid (clearing out of any persistent store)
+	UpdateLastReceived()                                               // Must be called whenever a packet is received
+	UpdateLastSent()                                                   // Must be called whenever a packet is successfully sent
+	getWriteTimeOut() time.Duration                                    // Return the writetimeout (or 0 if none)
+	writeStallTimeout() time.Duration                                  // Return the maximum time a packet write may block (0 = no limit)
+	persistOutbound(m packets.ControlPacket)                           // add the packet to the outbound store
+	persistInbound(m packets.ControlPacket) bool                       // add the packet to the inbound store (false if it is a QoS 2 redelivery)
+	pingRespReceived()                                                 // Called when a ping response is received
+	tracePacket(d Direction, cp packets.ControlPacket)                 // Called with each packet sent or received
+	subscriptionsGranted(result map[string]byte)                       // Called with the outcome of a subscription request
+	maxInboundPayload() int                                            // Return the maximum inbound PUBLISH payload size (0 = unlimited)
+	streamThreshold() int                                              // Return the payload size above which PUBLISH payloads are streamed (0 = never)
+	streamPayload(p *packets.PublishPacket, payload *io.LimitedReader) // Pass a streamed payload to the handler (payload must be drained)
+}
+
+// writeBatch encodes the PUBLISH packets in batch and writes them to conn using a single Write call.
+// Messages that cannot be encoded have their token errored and are omitted from the returned slice
+// (which contains the messages written).
+func writeBatch(conn net.Conn, batch []*PacketAndToken, logger *slog.Logger) ([]*PacketAndToken, error) {
+	var buf bytes.Buffer
+	written := make([]*PacketAndToken, 0, len(batch))
+	for _, pt := range batch {
+		l := buf.Len()
+		if err := pt.p.Write(&buf); err != nil {
+			logger.Error("unable to encode batched message", slog.Uint64("messageID", uint64(pt.p.Details().MessageID)), slog.String("error", err.Error()), slog.String("component", string(NET)))
+			buf.Truncate(l)
+			pt.t.setError(err)
+			continue
+		}
+		written = append(written, pt)
+	}
+	_, err := conn.Write(buf.Bytes())
+	return written, err
 }
 
 // startComms initiates goroutines that handles communications over the network connection
@@ -458,25 +591,31 @@ func startComms(conn net.Conn, // Network connection (must be active)
 
 // ackFunc acknowledges a packet
 // WARNING sendAck may be called at any time (even after the connection is dead). At the time of writing ACK sent after
-// connection loss will be dropped (this is not ideal)
-func ackFunc(sendAck func(*PacketAndToken), persist Store, packet *packets.PublishPacket, logger *slog.Logger) func() {
-	return func() {
+// connection loss will be dropped (this is not ideal); sendAck returns ErrAckNotSent in that case
+func ackFunc(sendAck func(*PacketAndToken) error, persist Store, packet *packets.PublishPacket, logger *slog.Logger) func() error {
+	return func() error {
 		switch packet.Qos {
 		case 2:
 			pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
 			pr.MessageID = packet.MessageID
 			logger.Debug("putting pubrec msg on obound", slog.String("component", string(NET)))
-			sendAck(&PacketAndToken{p: pr, t: nil})
+			persistOutbound(persist, pr, logger) // Records that the message has been handled (before the PUBREC is sent)
+			if err := sendAck(&PacketAndToken{p: pr, t: nil}); err != nil {
+				return err
+			}
 			logger.Debug("done putting pubrec msg on obound", slog.String("component", string(NET)))
 		case 1:
 			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
 			pa.MessageID = packet.MessageID
 			logger.Debug("putting puback msg on obound", slog.String("component", string(NET)))
 			persistOutbound(persist, pa, logger) // May fail if store has been closed
-			sendAck(&PacketAndToken{p: pa, t: nil})
+			if err := sendAck(&PacketAndToken{p: pa, t: nil}); err != nil {
+				return err
+			}
 			logger.Debug("done putting puback msg on obound", slog.String("component", string(NET)))
 		case 0:
 			// do nothing, since there is no need to send an ack packet back
 		}
+		return nil
 	}
 }
@@ -22,10 +22,9 @@ package mqtt
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
-	"net/http"
 	"net/url"
-	"os"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -36,21 +35,29 @@ import (
 //
 
 // openConnection opens a network connection using the protocol indicated in the URL.
-// Does not carry out any MQTT specific handshakes.
-func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions, dialer *net.Dialer) (net.Conn, error) {
+// Does not carry out any MQTT specific handshakes. tcp and ssl connections are made via proxyURL
+// (or the proxy specified in the ALL_PROXY environment variable if proxyURL is nil). If no proxy is
+// used and raceDelay > 0 then connection attempts to the addresses the host resolves to are raced.
+func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, wsConnOpts *WebsocketConnectionOptions, websocketOptions *WebsocketOptions, dialer *net.Dialer, proxyURL *url.URL, raceDelay time.Duration) (net.Conn, error) {
+	if (uri.Scheme == "ws" || uri.Scheme == "wss") && wsConnOpts != nil && wsConnOpts.URL != nil {
+		uri = wsConnOpts.URL
+	}
 	switch uri.Scheme {
 	case "ws":
 		dialURI := *uri // #623 - Gorilla Websockets does not accept URL's where uri.User != nil
 		dialURI.User = nil
-		conn, err := NewWebsocket(dialURI.String(), nil, timeout, headers, websocketOptions)
+		conn, err := newWebsocket(dialURI.String(), nil, timeout, wsConnOpts, websocketOptions)
 		return conn, err
 	case "wss":
 		dialURI := *uri // #623 - Gorilla Websockets does not accept URL's where uri.User != nil
 		dialURI.User = nil
-		conn, err := NewWebsocket(dialURI.String(), tlsc, timeout, headers, websocketOptions)
+		conn, err := newWebsocket(dialURI.String(), tlsc, timeout, wsConnOpts, websocketOptions)
 		return conn, err
 	case "mqtt", "tcp":
-		proxyDialer := proxy.FromEnvironmentUsing(dialer)
+		proxyDialer, err := newTCPDialer(proxyURL, dialer, raceDelay)
+		if err != nil {
+			return nil, err
+		}
 		conn, err := proxyDialer.Dial("tcp", uri.Host)
 		if err != nil {
 			return nil, err
@@ -73,29 +80,131 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 		}
 		return conn, nil
 	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
-		allProxy := os.Getenv("all_proxy")
-		if len(allProxy) == 0 {
+		proxyDialer, err := newTCPDialer(proxyURL, dialer, raceDelay)
+		if err != nil {
+			return nil, err
+		}
+		if proxyDialer == proxy.Dialer(dialer) { // No proxy or connection racing (which dial first, then handshake below)
 			conn, err := tls.DialWithDialer(dialer, "tcp", uri.Host, tlsc)
 			if err != nil {
 				return nil, err
 			}
 			return conn, nil
 		}
-		proxyDialer := proxy.FromEnvironment()
 		conn, err := proxyDialer.Dial("tcp", uri.Host)
 		if err != nil {
 			return nil, err
 		}
 
+		if tlsc == nil {
+			tlsc = &tls.Config{}
+		}
+		if tlsc.ServerName == "" && !tlsc.InsecureSkipVerify { // As per tls.DialWithDialer
+			tlsc = tlsc.Clone()
+			tlsc.ServerName = uri.Hostname()
+		}
 		tlsConn := tls.Client(conn, tlsc)
 
+		if dialer.Timeout > 0 {
+			_ = conn.SetDeadline(time.Now().Add(dialer.Timeout))
+		}
 		err = tlsConn.Handshake()
 		if err != nil {
 			_ = conn.Close()
 			return nil, err
 		}
+		_ = conn.SetDeadline(time.Time{})
 
 		return tlsConn, nil
 	}
 	return nil, errors.New("unknown protocol")
 }
+
+// isTLSScheme returns true if scheme is one of those that openConnection connects to using TLS over tcp
+func isTLSScheme(scheme string) bool {
+	switch scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		return true
+	}
+	return false
+}
+
+// resolveLocalAddr returns the local tcp address for addr, which may be an IP address or the name of a network
+// interface (in which case the first of the interfaces addresses, preferring IPv4, is used)
+func resolveLocalAddr(addr string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	iface, err := net.InterfaceByName(addr)
+	if err != nil {
+		return nil, fmt.Errorf("local address %q is neither an IP address nor an interface: %w", addr, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ipv6 net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+		if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv6 == nil {
+		return nil, fmt.Errorf("interface %q has no usable address", addr)
+	}
+	return &net.TCPAddr{IP: ipv6}, nil
+}
+
+// applySocketOptions applies the socket options to the tcp (or unix) connection underlying conn (which may be, for
+// example, a tls.Conn). noDelay is only applied to tcp connections and buffer sizes of 0 are left unchanged.
+// Nothing is done if there is no such connection (e.g. websockets).
+func applySocketOptions(conn net.Conn, noDelay bool, readBuffer, writeBuffer int) error {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			if err := c.SetNoDelay(noDelay); err != nil {
+				return err
+			}
+			return setSocketBuffers(c, readBuffer, writeBuffer)
+		case *net.UnixConn:
+			return setSocketBuffers(c, readBuffer, writeBuffer)
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// setSocketBuffers sets the socket buffer sizes (those that are 0 are left unchanged)
+func setSocketBuffers(c interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}, readBuffer, writeBuffer int) error {
+	if readBuffer > 0 {
+		if err := c.SetReadBuffer(readBuffer); err != nil {
+			return err
+		}
+	}
+	if writeBuffer > 0 {
+		return c.SetWriteBuffer(writeBuffer)
+	}
+	return nil
+}
+
+// newTCPDialer returns the dialer used to establish tcp connections: a proxy dialer if a proxy is used, otherwise a
+// racingDialer if raceDelay > 0, otherwise dialer itself
+func newTCPDialer(proxyURL *url.URL, dialer *net.Dialer, raceDelay time.Duration) (proxy.Dialer, error) {
+	d, err := newProxyDialer(proxyURL, dialer)
+	if err == nil && raceDelay > 0 && d == proxy.Dialer(dialer) {
+		d = &racingDialer{dialer: dialer, stagger: raceDelay}
+	}
+	return d, err
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// OfflineDropHandler is called when a message buffered whilst offline is discarded because the buffer is full,
+// the message expired before it could be sent or it could not be forwarded (e.g. a PublishInterceptor returned
+// an error) (see ClientOptions.SetOfflineBuffer)
+type OfflineDropHandler func(m Message)
+
+// ErrOfflineDropped is the error returned by the token for a QoS 1/2 message that was discarded from the offline
+// buffer (because the buffer was full or the message expired) before it could be sent.
+var ErrOfflineDropped = errors.New("message dropped from offline buffer")
+
+// offlineBuffer tracks messages, published while the connection was down, that are held in the Store awaiting
+// forwarding. Each message is held under a key of the form "f.[sequence]" (or "f.[sequence].[expiry]" where
+// expiry is in milliseconds since the Unix epoch) so that the order, and expiry, are retained across restarts.
+type offlineBuffer struct {
+	mu       sync.Mutex
+	entries  []offlineEntry // buffered messages, oldest first
+	next     uint64         // next sequence number to allocate
+	draining bool           // true while forwardOffline is running
+}
+
+// offlineEntry identifies a message in the offline buffer
+type offlineEntry struct {
+	seq     uint64
+	expires time.Time     // zero if the message does not expire
+	token   *PublishToken // completed when the forwarded flow completes (nil for QoS 0 and messages loaded from the store)
+}
+
+// key returns the key under which the message is held in the store
+func (e offlineEntry) key() string {
+	if e.expires.IsZero() {
+		return forwardPrefix + strconv.FormatUint(e.seq, 10)
+	}
+	return forwardPrefix + strconv.FormatUint(e.seq, 10) + "." + strconv.FormatInt(e.expires.UnixMilli(), 10)
+}
+
+// expired returns true if the message has expired
+func (e offlineEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// offlineEntryFromKey reverses offlineEntry.key
+func offlineEntryFromKey(key string) (offlineEntry, error) {
+	var e offlineEntry
+	seq, expires, hasExpiry := strings.Cut(key[2:], ".")
+	var err error
+	if e.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+		return e, err
+	}
+	if hasExpiry {
+		ms, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return e, err
+		}
+		e.expires = time.UnixMilli(ms)
+	}
+	return e, nil
+}
+
+// loadOfflineBuffer loads details of messages buffered by a previous instance of the client (the store must be open)
+func (c *client) loadOfflineBuffer() {
+	c.offline.mu.Lock()
+	defer c.offline.mu.Unlock()
+	c.offline.entries = c.offline.entries[:0]
+	for _, key := range c.persist.All() {
+		if !isKeyForward(key) {
+			continue
+		}
+		e, err := offlineEntryFromKey(key)
+		if err != nil {
+			c.logger.Error("invalid key in store (discarded)", slog.String("key", key), slog.String("component", string(STR)))
+			c.persist.Del(key)
+			continue
+		}
+		c.offline.entries = append(c.offline.entries, e)
+	}
+	sort.Slice(c.offline.entries, func(i, j int) bool { return c.offline.entries[i].seq < c.offline.entries[j].seq })
+	if n := len(c.offline.entries); n > 0 {
+		c.offline.next = c.offline.entries[n-1].seq + 1
+		c.logger.Debug("loaded offline messages", slog.Int("count", n), slog.String("component", string(STR)))
+	}
+}
+
+// bufferOffline writes the message to the store, to be forwarded when the connection is up, if the connection is
+// not currently up (or earlier messages are still awaiting forwarding). The message will be discarded if it cannot
+// be sent within expiry (0 = never expires). Returns true if the message was buffered; token is completed at once
+// for QoS 0 messages, otherwise when the flow for the forwarded message completes (or the message is discarded).
+func (c *client) bufferOffline(topic string, qos byte, retained bool, payload interface{}, expiry time.Duration, token *PublishToken) bool {
+	if c.options.OfflineBufferSize <= 0 || !c.IsConnected() {
+		return false
+	}
+	c.offline.mu.Lock()
+	if c.status.ConnectionStatus() == connected && len(c.offline.entries) == 0 {
+		c.offline.mu.Unlock()
+		return false
+	}
+	topic, data, release, err := c.outboundPayload(topic, payload)
+	if err != nil {
+		c.offline.mu.Unlock()
+		token.setError(err)
+		return true
+	}
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = qos
+	pub.TopicName = topic
+	pub.Retain = retained
+	pub.Payload = data
+	if release != nil { // The store may retain the packet so the data must be copied
+		pub.Payload = bytes.Clone(data)
+		release()
+	}
+
+	var dropped []*packets.PublishPacket
+	var droppedTokens []*PublishToken
+	for len(c.offline.entries) >= c.options.OfflineBufferSize {
+		key := c.offline.entries[0].key()
+		if p, ok := c.persist.Get(key).(*packets.PublishPacket); ok {
+			dropped = append(dropped, p)
+		}
+		if t := c.offline.entries[0].token; t != nil {
+			droppedTokens = append(droppedTokens, t)
+		}
+		c.persist.Del(key)
+		c.offline.entries = c.offline.entries[1:]
+	}
+	e := offlineEntry{seq: c.offline.next}
+	if expiry > 0 {
+		e.expires = c.clock.Now().Add(expiry)
+	}
+	if qos > 0 {
+		e.token = token
+	}
+	c.offline.next++
+	c.persist.Put(e.key(), pub)
+	c.offline.entries = append(c.offline.entries, e)
+	c.offline.mu.Unlock()
+
+	c.logger.Debug("publish buffered whilst offline", slog.String("topic", topic), slog.String("component", string(CLI)))
+	for _, p := range dropped {
+		c.logger.Warn("offline buffer full; message dropped", slog.String("topic", p.TopicName), slog.String("component", string(CLI)))
+		c.offlineDropped(p)
+	}
+	for _, t := range droppedTokens {
+		t.setError(fmt.Errorf("%w (buffer full)", ErrOfflineDropped))
+	}
+	if qos == 0 {
+		token.flowComplete()
+	}
+	return true
+}
+
+// forwardOffline publishes the messages buffered whilst offline, in order. Each message is removed from the buffer
+// once it has been passed to the outgoing comms (at which point QoS 1 and 2 messages are held in the store as usual).
+// Exits when the buffer is empty or the connection is lost (the remaining messages will be sent following reconnection).
+func (c *client) forwardOffline() {
+	c.offline.mu.Lock()
+	if c.offline.draining {
+		c.offline.mu.Unlock()
+		return
+	}
+	c.offline.draining = true
+	c.offline.mu.Unlock()
+	defer func() {
+		c.offline.mu.Lock()
+		c.offline.draining = false
+		c.offline.mu.Unlock()
+	}()
+
+	c.connMu.Lock()
+	stop := c.stop
+	c.connMu.Unlock()
+	for {
+		c.offline.mu.Lock()
+		if len(c.offline.entries) == 0 {
+			c.offline.mu.Unlock()
+			return
+		}
+		e := c.offline.entries[0]
+		key := e.key()
+		c.offline.mu.Unlock()
+
+		stored, ok := c.persist.Get(key).(*packets.PublishPacket)
+		if ok && c.status.ConnectionStatus() != connected {
+			return
+		}
+		settle := func(t *PublishToken) { t.setError(fmt.Errorf("%w (not in store)", ErrOfflineDropped)) }
+		if ok && e.expired(c.clock.Now()) {
+			c.logger.Debug("offline message expired", slog.String("topic", stored.TopicName), slog.String("component", string(CLI)))
+			c.offlineDropped(stored)
+			settle = func(t *PublishToken) { t.setError(fmt.Errorf("%w (expired)", ErrOfflineDropped)) }
+		} else if ok {
+			token := newToken(packets.Publish).(*PublishToken)
+			pub := c.forwardPublish(stored, token)
+			if pub == nil && (token.Error() == nil || errors.Is(token.Error(), ErrNotConnected)) {
+				return // the message will be forwarded following reconnection
+			}
+			if pub == nil { // retrying would fail again so the message is dropped (rather than blocking those that follow)
+				c.logger.Warn("unable to forward offline message; message dropped", slog.String("key", key), slog.String("error", fmt.Sprint(token.Error())), slog.String("component", string(CLI)))
+				c.offlineDropped(stored)
+				settle = func(t *PublishToken) { t.setError(token.Error()) }
+			} else {
+				select {
+				case c.obound <- &PacketAndToken{p: pub, t: token}:
+				case <-stop:
+					return // QoS 1/2 messages are in the store so will be resent; a QoS 0 message may be lost
+				}
+				settle = func(t *PublishToken) { relayForwarded(token, t) }
+			}
+		}
+		c.offline.mu.Lock()
+		c.persist.Del(key)
+		var caller *PublishToken
+		if len(c.offline.entries) > 0 && c.offline.entries[0].seq == e.seq { // may have been dropped (buffer full)
+			caller = c.offline.entries[0].token
+			c.offline.entries = c.offline.entries[1:]
+		}
+		c.offline.mu.Unlock()
+		if caller != nil {
+			settle(caller)
+		}
+	}
+}
+
+// relayForwarded completes caller (the token returned to the publisher of a buffered message) when the flow for the
+// forwarded message completes. A separate token is used for the forwarded flow so that an attempt that is abandoned
+// (to be retried following reconnection) does not complete caller.
+func relayForwarded(forwarded, caller *PublishToken) {
+	OnComplete(forwarded, func(err error) {
+		caller.messageID = forwarded.messageID
+		if err != nil {
+			caller.setError(err)
+			return
+		}
+		caller.flowComplete()
+	})
+}
+
+// offlineDisconnected completes the tokens for buffered messages with an error once the client has been disconnected
+// (the messages remain in the store and will be forwarded, without a token, if the client connects again).
+func (c *client) offlineDisconnected() {
+	c.offline.mu.Lock()
+	var tokens []*PublishToken
+	for i := range c.offline.entries {
+		if t := c.offline.entries[i].token; t != nil {
+			tokens = append(tokens, t)
+			c.offline.entries[i].token = nil
+		}
+	}
+	c.offline.mu.Unlock()
+	for _, t := range tokens {
+		t.setError(fmt.Errorf("%w before buffered message was sent", ErrNotConnected))
+	}
+}
+
+// offlineDropped passes a message discarded from the offline buffer to the OfflineDropHandler (if set)
+func (c *client) offlineDropped(p *packets.PublishPacket) {
+	if c.options.OnOfflineDrop != nil {
+		c.options.OnOfflineDrop(messageFromPublish(p, nil))
+	}
+}
+
+// resetStore empties the store (following connection with CleanSession) retaining any messages buffered whilst offline
+func (c *client) resetStore() {
+	if c.options.OfflineBufferSize <= 0 {
+		c.persist.Reset()
+		return
+	}
+	for _, key := range c.persist.All() {
+		if !isKeyForward(key) {
+			c.persist.Del(key)
+		}
+	}
+}
@@ -22,31 +22,66 @@
 package mqtt
 
 import (
+	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 // CredentialsProvider allows the username and password to be updated
 // before reconnecting. It should return the current username and password.
 type CredentialsProvider func() (username string, password string)
 
+// CredentialsProviderContext is a context aware CredentialsProvider; it allows credentials (e.g. a token) to be
+// retrieved from an external service before each connection attempt. ctx will be cancelled once the connect
+// timeout expires. A non-nil error aborts the connection attempt.
+type CredentialsProviderContext func(ctx context.Context) (username string, password string, err error)
+
+// TLSClientSignerProvider returns a client certificate chain (leaf first) and a crypto.Signer for the certificate's
+// private key (see SetTLSClientSignerProvider)
+type TLSClientSignerProvider func() (signer crypto.Signer, chain []*x509.Certificate, err error)
+
+// JWTProvider returns a token (e.g. a JWT), to be sent as the password, and the time at which it expires
+type JWTProvider func() (token string, expiry time.Time, err error)
+
 // MessageHandler is a callback type which can be set to be
 // executed upon the arrival of messages published to topics
 // to which the client is subscribed.
 type MessageHandler func(Client, Message)
 
+// AckTimeoutHandler is called when a message has not been acknowledged within the timeout set with
+// SetAckTimeout; the returned action determines what happens to the message.
+type AckTimeoutHandler func(Message) AckTimeoutAction
+
+// HandlerPanicHandler is called when a message handler panics (see SetHandlerPanicHandler); r is the value
+// passed to panic and stack the stack trace of the panicking goroutine.
+type HandlerPanicHandler func(topic string, r interface{}, stack []byte)
+
+// DecodeErrorHandler is called when the payload of a message passed to a handler created with TypedHandler
+// (e.g. via SubscribeJSON) cannot be decoded; err wraps ErrPayloadDecode.
+type DecodeErrorHandler func(client Client, msg Message, err error)
+
 // ConnectionLostHandler is a callback type which can be set to be
 // executed upon an unintended disconnection from the MQTT broker.
 // Disconnects caused by calling Disconnect or ForceDisconnect will
 // not cause an OnConnectionLost callback to execute.
 type ConnectionLostHandler func(Client, error)
 
+// ConnectionLostStatsHandler is as per ConnectionLostHandler but is also passed statistics for the connection
+// that was lost (to aid the analysis of unreliable connections).
+type ConnectionLostStatsHandler func(client Client, reason error, stats ConnectionStats)
+
 // OnConnectHandler is a callback that is called when the client
 // state changes from unconnected/disconnected to connected. Both
 // at initial connection and on reconnection
@@ -64,6 +99,20 @@ type ConnectionAttemptHandler func(broker *url.URL, tlsCfg *tls.Config) *tls.Con
 // Does not carry out any MQTT specific handshakes.
 type OpenConnectionFunc func(uri *url.URL, options ClientOptions) (net.Conn, error)
 
+// ConnWrapper is applied to each network connection once it has been established (before the MQTT handshake);
+// the returned connection is used in place of conn. For TLS and websocket connections conn carries the
+// unencrypted MQTT packets.
+type ConnWrapper func(conn net.Conn) net.Conn
+
+// ResumeFilter is consulted, when a session is resumed, for each outbound packet held in the store (other than
+// PUBREL packets, which must be sent to complete a QoS 2 flow). key is the key under which the packet is stored.
+// Returning false removes the packet from the store without it being resent.
+type ResumeFilter func(key string, cp packets.ControlPacket) bool
+
+// SessionResetHandler is invoked when the session state held in the store was unusable, so was discarded (see
+// SetCleanSessionFallback), and a clean session has been established. reason wraps ErrSessionCorrupt.
+type SessionResetHandler func(reason error)
+
 // ConnectionNotificationHandler is invoked for any type of connection event.
 type ConnectionNotificationHandler func(Client, ConnectionNotification)
 
@@ -74,12 +123,22 @@ type ConnectionNotificationHandler func(Client, ConnectionNotification)
 // with KeepAlive=0 by default).
 type ClientOptions struct {
 	Servers                  []*url.URL
+	ServerPriority           map[string]int      // keyed by the servers URL (as a string); higher priority servers are tried first
+	LocalAddrs               []string            // local addresses (or interface names) that connections are made from, in order of preference
+	BrokerLocalAddrs         map[string][]string // keyed by the servers URL (as a string); overrides LocalAddrs for that server
+	FailbackInterval         time.Duration       // 0 = disabled; otherwise how often to check if a higher priority server is available
+	SRVDomain                string              // if set, brokers are discovered via DNS SRV records for this domain
 	ClientID                 string
 	Username                 string
 	Password                 string
 	CredentialsProvider      CredentialsProvider
+	CredentialsProviderCtx   CredentialsProviderContext
+	JWTProvider              JWTProvider
 	CleanSession             bool
 	Order                    bool
+	OrderedPerTopic          bool
+	HandlerPoolSize          int
+	RouteMatchingStrategy    RouteMatchingStrategy
 	WillEnabled              bool
 	WillTopic                string
 	WillPayload              []byte
@@ -88,29 +147,88 @@ type ClientOptions struct {
 	ProtocolVersion          uint
 	protocolVersionExplicit  bool
 	TLSConfig                *tls.Config
+	BrokerTLSConfigs         map[string]*tls.Config // keyed by broker host (host:port)
+	ALPNProtocols            []string               // ALPN protocols offered on tcp based TLS connections (websocket connections are unaffected)
+	BrokerALPNProtocols      map[string][]string    // keyed by broker host (host:port); overrides ALPNProtocols for that broker
+	TLSSessionCache          tls.ClientSessionCache
+	TLSCertificateProvider   func() (*tls.Certificate, error)
+	TLSClientSigner          TLSClientSignerProvider
+	TLSPSK                   PSKCallback
+	BrokerTLSPSK             map[string]PSKCallback // keyed by broker host (host:port); overrides TLSPSK for that broker
+	TLSPSKConnector          PSKConnector
+	VerifyPeerCertificate    func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+	SPKIPins                 []string
 	KeepAlive                int64 // Warning: Some brokers may reject connections with Keepalive = 0.
 	PingTimeout              time.Duration
+	AdaptiveKeepAlive        bool
+	ServerKeepAlive          time.Duration // 0 = use KeepAlive; otherwise the keepalive interval required by the broker
 	ConnectTimeout           time.Duration // duration of 0 never times out
+	ConnectTimeouts          ConnectTimeouts
+	ParallelConnect          bool
 	MaxReconnectInterval     time.Duration
 	AutoReconnect            bool
 	ConnectRetryInterval     time.Duration
 	ConnectRetry             bool
+	ConnectRetryPolicy       ConnectRetryPolicy
+	OnConnectGiveUp          ConnectGiveUpHandler
 	Store                    Store
+	StoreHook                StoreHook
+	CleanSessionFallback     bool                // if true an unusable store is discarded and a clean session requested
+	OnSessionReset           SessionResetHandler // called when a clean session is established following CleanSessionFallback
 	DefaultPublishHandler    MessageHandler
+	NamedHandlers            map[string]MessageHandler
 	OnConnect                OnConnectHandler
 	OnConnectionLost         ConnectionLostHandler
+	OnConnectionLostStats    ConnectionLostStatsHandler
 	OnReconnecting           ReconnectHandler
 	OnConnectAttempt         ConnectionAttemptHandler
 	OnConnectionNotification ConnectionNotificationHandler
+	NotificationChannel      chan<- ConnectionNotificationEvent
 	WriteTimeout             time.Duration // duration of 0 never times out
+	WriteStallTimeout        time.Duration // 0 = disabled; otherwise the maximum time writing a packet may block
 	MessageChannelDepth      uint
 	ResumeSubs               bool
 	HTTPHeaders              http.Header
 	WebsocketOptions         *WebsocketOptions
+	OnWebsocketConnection    WebsocketConnectionOptionsHandler
 	MaxResumePubInFlight     int // 0 = no limit; otherwise this is the maximum simultaneous messages sent while resuming
+	ResumeRate               int // 0 = no limit; otherwise the maximum messages per second sent while resuming
+	ResumeBatchSize          int // number of messages sent while resuming between pauses and progress notifications
+	ResumeFilter             ResumeFilter
+	OfflineBufferSize        int // 0 = disabled; otherwise the maximum number of messages buffered in the Store whilst offline
+	OnOfflineDrop            OfflineDropHandler
 	Dialer                   *net.Dialer
+	TCPNoDelayDisabled       bool // if true Nagle's algorithm is enabled on TCP connections
+	SocketReadBuffer         int  // SO_RCVBUF (0 = operating system default)
+	SocketWriteBuffer        int  // SO_SNDBUF (0 = operating system default)
+	ProxyURL                 *url.URL
 	CustomOpenConnectionFn   OpenConnectionFunc
+	ConnWrapper              ConnWrapper
+	WriteRateLimit           int // bytes per second (0 = no limit)
+	ReadRateLimit            int // bytes per second (0 = no limit)
 	AutoAckDisabled          bool
+	DeduplicationWindow      time.Duration
+	AckTimeout               time.Duration
+	PacketHook               PacketHook
+	PacketHookSampleRate     uint
+	HappyEyeballsDelay       time.Duration
+	OnAckTimeout             AckTimeoutHandler
+	OnHandlerPanic           HandlerPanicHandler
+	OnDecodeError            DecodeErrorHandler
+	MaxInboundPayload        int                // 0 = no limit; otherwise PUBLISH packets with larger payloads are discarded
+	MaxOutboundPayload       int                // 0 = no limit; otherwise Publish rejects larger payloads
+	MaxInflight              int                // 0 = no limit; otherwise the maximum number of QoS 1/2 publishes awaiting acknowledgement
+	MessageIDWaitTimeout     time.Duration      // 0 = fail immediately; otherwise how long to wait for a message ID to become free
+	MessageIDAllocator       MessageIDAllocator // nil = sequential
+	Clock                    clock.Clock        // nil = clock.Real
+	ConnectionHistorySize    int                // number of connection attempts retained for Client.ConnectionHistory (0 = none)
+	StreamingThreshold       int
+	StreamingHandler         StreamingMessageHandler
+	PayloadCompression       CompressionCodec
+	CompressionMinSize       int
+	CompressionTopics        []string
+	PublishInterceptors      []PublishInterceptor
+	InboundInterceptors      []InboundInterceptor
 	Logger                   *slog.Logger
 }
 
@@ -158,6 +276,7 @@ func NewClientOptions() *ClientOptions {
 		Dialer:                   &net.Dialer{Timeout: 30 * time.Second},
 		CustomOpenConnectionFn:   nil,
 		AutoAckDisabled:          false,
+		ConnectionHistorySize:    20,
 		Logger: slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
 			Level: slog.LevelDebug,
 		})),
@@ -189,6 +308,70 @@ func (o *ClientOptions) AddBroker(server string) *ClientOptions {
 	return o
 }
 
+// AddBrokerWithPriority adds a broker URI (see AddBroker) with a priority. When connecting, brokers
+// are attempted in priority order (highest first); brokers with equal priority are attempted in the
+// order they were added. Brokers added with AddBroker have a priority of 0.
+// This allows primary/secondary topologies to be expressed; see also SetFailbackInterval.
+func (o *ClientOptions) AddBrokerWithPriority(server string, priority int) *ClientOptions {
+	n := len(o.Servers)
+	o.AddBroker(server)
+	if len(o.Servers) == n { // failed to parse (will have been logged)
+		return o
+	}
+	if o.ServerPriority == nil {
+		o.ServerPriority = make(map[string]int)
+	}
+	o.ServerPriority[o.Servers[n].String()] = priority
+	return o
+}
+
+// AddBrokerWithLocalAddr adds a broker URI (see AddBroker) to which connections will be made from one of
+// localAddrs (in place of those set with SetLocalAddr); see SetLocalAddr for details.
+func (o *ClientOptions) AddBrokerWithLocalAddr(server string, localAddrs ...string) *ClientOptions {
+	n := len(o.Servers)
+	o.AddBroker(server)
+	if len(o.Servers) == n { // failed to parse (will have been logged)
+		return o
+	}
+	if o.BrokerLocalAddrs == nil {
+		o.BrokerLocalAddrs = make(map[string][]string)
+	}
+	o.BrokerLocalAddrs[o.Servers[n].String()] = localAddrs
+	return o
+}
+
+// SetLocalAddr sets the local addresses that tcp and ssl connections are made from. Each address may be an IP
+// address (e.g. "192.168.1.10") or the name of a network interface (e.g. "wwan0"), in which case the
+// interfaces current address is used. When connecting to a broker the addresses are tried in order (i.e.
+// if a connection cannot be established from the first address, the second is tried and so on), so on a host
+// with multiple uplinks traffic can be pinned to a preferred uplink with failover to another. Because the
+// first address is tried on every connection attempt the client returns to the preferred uplink when it
+// reconnects. Note that, depending upon the operating system's routing configuration, binding to a source
+// address may not determine the interface that packets are sent from.
+func (o *ClientOptions) SetLocalAddr(addrs ...string) *ClientOptions {
+	o.LocalAddrs = addrs
+	return o
+}
+
+// SetFailbackInterval sets how often the client will check whether a broker with a higher priority
+// than the one it is currently connected to (see AddBrokerWithPriority) is available. If one is then
+// the current connection will be dropped and the automatic reconnection logic will connect to the
+// higher priority broker. The check only confirms that a network connection can be established
+// (to avoid disrupting the current session). Requires AutoReconnect; 0 (the default) disables this.
+func (o *ClientOptions) SetFailbackInterval(interval time.Duration) *ClientOptions {
+	o.FailbackInterval = interval
+	return o
+}
+
+// SetSRVLookup enables DNS SRV based broker discovery. Each time a connection is attempted (including
+// reconnects) the _secure-mqtt._tcp and _mqtt._tcp SRV records for domain are resolved and the targets
+// are tried (honouring the priority and weight of the records) before any brokers added with AddBroker.
+// Targets from _secure-mqtt records are connected to using TLS (see SetTLSConfig). Pass "" to disable.
+func (o *ClientOptions) SetSRVLookup(domain string) *ClientOptions {
+	o.SRVDomain = domain
+	return o
+}
+
 // SetResumeSubs will enable resuming of stored (un)subscribe messages when connecting
 // but not reconnecting if CleanSession is false. Otherwise these messages are discarded.
 func (o *ClientOptions) SetResumeSubs(resume bool) *ClientOptions {
@@ -229,6 +412,28 @@ func (o *ClientOptions) SetCredentialsProvider(p CredentialsProvider) *ClientOpt
 	return o
 }
 
+// SetCredentialsProviderContext will set a method to be called by this client before each
+// attempt to connect (including reconnects) to obtain the current username and password. The
+// context passed to the method is cancelled when the connect timeout (see SetConnectTimeout)
+// expires; if an error is returned the connection attempt fails, and the error is reported
+// via the connection notifications, wrapped in ErrCredentialsProvider.
+// This takes precedence over SetCredentialsProvider.
+func (o *ClientOptions) SetCredentialsProviderContext(p CredentialsProviderContext) *ClientOptions {
+	o.CredentialsProviderCtx = p
+	return o
+}
+
+// SetJWTProvider will set a method to be called before each attempt to connect (including reconnects) to obtain
+// a token that is sent as the password (the username is that set with SetUsername or, if none, "unused" as MQTT
+// 3.1.1 does not permit a password without a username). Shortly before the token expires (a tenth of its lifetime,
+// up to a minute, before) the client disconnects gracefully and, if AutoReconnect is enabled, reconnects with a new
+// token; the connection lost handler receives ErrCredentialsExpiring when this happens. Errors are handled as per
+// SetCredentialsProviderContext. This takes precedence over the other credentials providers.
+func (o *ClientOptions) SetJWTProvider(p JWTProvider) *ClientOptions {
+	o.JWTProvider = p
+	return o
+}
+
 // SetCleanSession will set the "clean session" flag in the connect message
 // when this client connects to an MQTT broker. By setting this flag, you are
 // indicating that no messages saved by the broker for this client should be
@@ -240,6 +445,35 @@ func (o *ClientOptions) SetCleanSession(clean bool) *ClientOptions {
 	return o
 }
 
+// SetOrderedPerTopic will, if true, pass messages with the same topic to handlers serially (in the order
+// they were received) whilst allowing messages on different topics to be handled concurrently (each topic
+// is handled in its own goroutine). This takes precedence over SetOrderMatters. Unlike SetOrderMatters(true)
+// handlers may block, but doing so will delay the handling of subsequent messages on the same topic.
+// Note that messages on different topics that match the same subscription may be handled out of order.
+func (o *ClientOptions) SetOrderedPerTopic(ordered bool) *ClientOptions {
+	o.OrderedPerTopic = ordered
+	return o
+}
+
+// SetHandlerPoolSize sets the number of goroutines used to call message handlers when SetOrderMatters(false)
+// (or SetOrderedPerTopic(true)) is in use. By default (0) a new goroutine is started for each message which,
+// when messages arrive in bursts, may result in a very large number of goroutines. With a pool, incoming
+// messages will not be read from the network while all workers are busy (so handlers should not block
+// indefinitely). When used with SetOrderedPerTopic each topic is consistently handled by the same worker.
+func (o *ClientOptions) SetHandlerPoolSize(n int) *ClientOptions {
+	o.HandlerPoolSize = n
+	return o
+}
+
+// SetRouteMatchingStrategy determines which handlers are called when a message matches more than one route
+// (e.g. a dedicated handler for "a/b" and a catch-all handler for "#"). By default (RouteMatchAll) every
+// matching handler is called; with RouteMatchMostSpecific only the handler(s) for the most specific topic
+// filter are. The default handler is only called if no route matches.
+func (o *ClientOptions) SetRouteMatchingStrategy(strategy RouteMatchingStrategy) *ClientOptions {
+	o.RouteMatchingStrategy = strategy
+	return o
+}
+
 // SetOrderMatters will set the message routing to guarantee order within
 // each QoS level. By default, this value is true. If set to false (recommended),
 // this flag indicates that messages can be delivered asynchronously
@@ -263,6 +497,130 @@ func (o *ClientOptions) SetTLSConfig(t *tls.Config) *ClientOptions {
 	return o
 }
 
+// SetBrokerTLSConfig sets the TLS configuration used when connecting to the broker at host (in the form
+// host:port, as it appears in the broker URL) in place of that set with SetTLSConfig. This allows,
+// for example, different CAs to be used for each endpoint. Pass a nil config to remove the override.
+func (o *ClientOptions) SetBrokerTLSConfig(host string, t *tls.Config) *ClientOptions {
+	if t == nil {
+		delete(o.BrokerTLSConfigs, host)
+		return o
+	}
+	if o.BrokerTLSConfigs == nil {
+		o.BrokerTLSConfigs = make(map[string]*tls.Config)
+	}
+	o.BrokerTLSConfigs[host] = t
+	return o
+}
+
+// SetALPNProtocols sets the protocols offered via TLS Application-Layer Protocol Negotiation (ALPN) when making
+// TLS connections (ssl, tls, mqtts etc.; websocket connections negotiate their own protocols so are unaffected).
+// This overrides NextProtos in the TLS configuration (see SetTLSConfig) and allows, for example, a broker that
+// multiplexes MQTT and HTTPS on port 443 (such as AWS IoT Core, see AWSIoTALPN) to be used without building a
+// tls.Config. Pass no protocols to use those in the TLS configuration.
+func (o *ClientOptions) SetALPNProtocols(protos ...string) *ClientOptions {
+	o.ALPNProtocols = protos
+	return o
+}
+
+// SetBrokerALPNProtocols sets the ALPN protocols (see SetALPNProtocols) offered when connecting to the broker at
+// host (in the form host:port, as it appears in the broker URL) in place of those set with SetALPNProtocols; as
+// the port is part of the key, the protocols can vary by port (e.g. ALPN on 443 but not on 8883). This applies to
+// all connections to the broker, including websocket connections, failback checks and failover attempts. Pass no
+// protocols to remove the override.
+func (o *ClientOptions) SetBrokerALPNProtocols(host string, protos ...string) *ClientOptions {
+	if len(protos) == 0 {
+		delete(o.BrokerALPNProtocols, host)
+		return o
+	}
+	if o.BrokerALPNProtocols == nil {
+		o.BrokerALPNProtocols = make(map[string][]string)
+	}
+	o.BrokerALPNProtocols[host] = protos
+	return o
+}
+
+// SetTLSSessionCache sets the cache used to hold TLS session tickets (e.g. tls.NewLRUClientSessionCache(0))
+// allowing reconnects to resume a previous TLS session rather than performing a full handshake. The cache
+// is applied to any TLS configuration that does not already specify a ClientSessionCache.
+func (o *ClientOptions) SetTLSSessionCache(cache tls.ClientSessionCache) *ClientOptions {
+	o.TLSSessionCache = cache
+	return o
+}
+
+// SetTLSCertificateProvider sets a function that returns the client certificate to be presented when the
+// broker requests one. The function is called during each TLS handshake (i.e. on every connection attempt)
+// so rotated certificates are picked up without recreating the client; it takes precedence over any
+// Certificates (or GetClientCertificate) in the tls.Config. An error will cause the connection attempt to fail.
+func (o *ClientOptions) SetTLSCertificateProvider(provider func() (*tls.Certificate, error)) *ClientOptions {
+	o.TLSCertificateProvider = provider
+	return o
+}
+
+// SetTLSClientSigner sets the client certificate chain (leaf first) and a crypto.Signer for its private key (e.g. a
+// key held in a PKCS#11 token, TPM or secure element, which never leaves the hardware). The signer is used for each
+// TLS handshake (including on reconnection) and takes precedence over SetTLSCertificateProvider and any
+// Certificates in the tls.Config. Use SetTLSClientSignerProvider if the certificate (or key) may be rotated.
+func (o *ClientOptions) SetTLSClientSigner(signer crypto.Signer, chain ...*x509.Certificate) *ClientOptions {
+	o.TLSClientSigner = func() (crypto.Signer, []*x509.Certificate, error) { return signer, chain, nil }
+	return o
+}
+
+// SetTLSClientSignerProvider sets a function, called during each TLS handshake (i.e. on every connection attempt),
+// that returns the client certificate chain and a crypto.Signer for its key (see SetTLSClientSigner); this allows
+// certificates, and keys, to be rotated without recreating the client. An error (including a certificate that does
+// not match the key) will cause the connection attempt to fail.
+func (o *ClientOptions) SetTLSClientSignerProvider(p TLSClientSignerProvider) *ClientOptions {
+	o.TLSClientSigner = p
+	return o
+}
+
+// SetTLSPSK configures TLS connections (ssl, tls, mqtts etc.) to authenticate using a pre-shared key (TLS-PSK)
+// rather than certificates. crypto/tls does not implement the PSK cipher suites so the handshake is performed by
+// connector (which will typically wrap a third party TLS implementation); the client establishes the tcp connection
+// (honouring the dialer, proxy and local address options) and passes it to connector along with psk, which supplies
+// the identity and key. Use SetBrokerTLSPSK to use a different key for a particular broker.
+func (o *ClientOptions) SetTLSPSK(psk PSKCallback, connector PSKConnector) *ClientOptions {
+	o.TLSPSK = psk
+	o.TLSPSKConnector = connector
+	return o
+}
+
+// SetBrokerTLSPSK sets the PSKCallback used when connecting to the broker at host (in the form host:port, as it
+// appears in the broker URL) in place of that set with SetTLSPSK (which must also be called to set the connector,
+// psk may be nil there). Pass a nil psk to remove the override.
+func (o *ClientOptions) SetBrokerTLSPSK(host string, psk PSKCallback) *ClientOptions {
+	if psk == nil {
+		delete(o.BrokerTLSPSK, host)
+		return o
+	}
+	if o.BrokerTLSPSK == nil {
+		o.BrokerTLSPSK = make(map[string]PSKCallback)
+	}
+	o.BrokerTLSPSK[host] = psk
+	return o
+}
+
+// SetVerifyPeerCertificate sets a function that is called, during each TLS handshake, after normal certificate
+// verification (see tls.Config.VerifyPeerCertificate; any function already in the tls.Config is also called).
+// Returning an error aborts the connection attempt; the failure is classed as ConnectErrorCertificate if the error
+// wraps ErrCertificatePinMismatch or a crypto/x509 verification error.
+func (o *ClientOptions) SetVerifyPeerCertificate(verify func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error) *ClientOptions {
+	o.VerifyPeerCertificate = verify
+	return o
+}
+
+// SetSPKIPins pins the broker's public key: TLS connections are only accepted if a certificate in the chain
+// presented by the broker has a SubjectPublicKeyInfo whose SHA-256 hash matches one of pins (in the form
+// "sha256/<base64>", as returned by SPKIPin, or just the base64 encoded hash). Pinning an intermediate or root
+// key, and including a backup pin, allows certificates to be renewed without updating devices. Pins are checked
+// in addition to normal verification (set InsecureSkipVerify in the tls.Config to rely on the pins alone, e.g.
+// with a self-signed certificate). A mismatch fails the attempt with ErrCertificatePinMismatch, which is classed
+// as ConnectErrorCertificate (so is not retried unless a ConnectRetryPolicy decides otherwise).
+func (o *ClientOptions) SetSPKIPins(pins ...string) *ClientOptions {
+	o.SPKIPins = pins
+	return o
+}
+
 // SetStore will set the implementation of the Store interface
 // used to provide message persistence in cases where QoS levels
 // QoS_ONE or QoS_TWO are used. If no store is provided, then the
@@ -272,6 +630,15 @@ func (o *ClientOptions) SetStore(s Store) *ClientOptions {
 	return o
 }
 
+// SetStoreHook sets a function that will be called following each put, get, del and reset operation on the Store
+// with the key, the packet type and how long the operation took. This allows persistence latency to be monitored
+// (and loops that repeatedly access the store to be detected) or the store contents to be replicated elsewhere
+// (the event holds the packet written). Set to nil (the default) to disable.
+func (o *ClientOptions) SetStoreHook(hook StoreHook) *ClientOptions {
+	o.StoreHook = hook
+	return o
+}
+
 // SetKeepAlive will set the amount of time (in seconds) that the client
 // should wait before sending a PING request to the broker. This will
 // allow the client to know that a connection has not been lost with the
@@ -289,6 +656,24 @@ func (o *ClientOptions) SetPingTimeout(k time.Duration) *ClientOptions {
 	return o
 }
 
+// SetAdaptiveKeepAlive will, if true, reduce the interval between pings based on the observed round trip time
+// of previous pings (by up to half of the keepalive period) so that pings reach the broker before the keepalive
+// period expires even when the network is slow.
+func (o *ClientOptions) SetAdaptiveKeepAlive(adaptive bool) *ClientOptions {
+	o.AdaptiveKeepAlive = adaptive
+	return o
+}
+
+// SetServerKeepAlive overrides the interval used by the keepalive routine (KeepAlive is still sent to the broker
+// in the CONNECT packet). MQTT v5 brokers can require a different keepalive to the one requested by the client;
+// this option allows the same with brokers that are known to enforce a shorter keepalive. 0 (the default) means
+// that KeepAlive is used, as does a value longer than KeepAlive (the broker would otherwise close the connection
+// before a ping was sent).
+func (o *ClientOptions) SetServerKeepAlive(k time.Duration) *ClientOptions {
+	o.ServerKeepAlive = k
+	return o
+}
+
 // SetProtocolVersion sets the MQTT version to be used to connect to the
 // broker. Legitimate values are currently 3 - MQTT 3.1 or 4 - MQTT 3.1.1
 func (o *ClientOptions) SetProtocolVersion(pv uint) *ClientOptions {
@@ -327,6 +712,24 @@ func (o *ClientOptions) SetBinaryWill(topic string, payload []byte, qos byte, re
 	return o
 }
 
+// Will holds the details of the message that the broker will publish should the client
+// disconnect unexpectedly.
+type Will struct {
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retained bool
+}
+
+// SetWillMessage sets the will message (see SetBinaryWill); passing nil is equivalent to
+// calling UnsetWill. Use WillUpdater.UpdateWill to change the will after the client is created.
+func (o *ClientOptions) SetWillMessage(w *Will) *ClientOptions {
+	if w == nil {
+		return o.UnsetWill()
+	}
+	return o.SetBinaryWill(w.Topic, w.Payload, w.Qos, w.Retained)
+}
+
 // SetDefaultPublishHandler sets the MessageHandler that will be called when a message
 // is received that does not match any known subscriptions.
 //
@@ -339,6 +742,20 @@ func (o *ClientOptions) SetDefaultPublishHandler(defaultHandler MessageHandler)
 	return o
 }
 
+// SetNamedHandler registers handler under name for use with SubscribeNamed. When CleanSession is
+// false, subscriptions made with SubscribeNamed are recorded in the Store so that, following a
+// restart, messages from the persistent session are passed to the handler registered under the
+// same name (handlers must therefore be registered before Connect is called).
+//
+// The same concurrency requirements as SetDefaultPublishHandler apply to handler.
+func (o *ClientOptions) SetNamedHandler(name string, handler MessageHandler) *ClientOptions {
+	if o.NamedHandlers == nil {
+		o.NamedHandlers = make(map[string]MessageHandler)
+	}
+	o.NamedHandlers[name] = handler
+	return o
+}
+
 // SetOnConnectHandler sets the function to be called when the client is connected. Both
 // at initial connection time and upon automatic reconnect.
 func (o *ClientOptions) SetOnConnectHandler(onConn OnConnectHandler) *ClientOptions {
@@ -353,6 +770,14 @@ func (o *ClientOptions) SetConnectionLostHandler(onLost ConnectionLostHandler) *
 	return o
 }
 
+// SetConnectionLostStatsHandler sets a callback that is executed, in addition to OnConnectionLost, when the
+// client unexpectedly loses connection with the MQTT broker. It is passed statistics for the lost connection
+// (uptime, packets and bytes transferred, flows in progress etc.).
+func (o *ClientOptions) SetConnectionLostStatsHandler(onLost ConnectionLostStatsHandler) *ClientOptions {
+	o.OnConnectionLostStats = onLost
+	return o
+}
+
 // SetReconnectingHandler sets the OnReconnecting callback to be executed prior
 // to the client attempting a reconnect to the MQTT broker.
 func (o *ClientOptions) SetReconnectingHandler(cb ReconnectHandler) *ClientOptions {
@@ -362,8 +787,8 @@ func (o *ClientOptions) SetReconnectingHandler(cb ReconnectHandler) *ClientOptio
 
 // SetConnectionAttemptHandler sets the ConnectionAttemptHandler callback to be executed prior
 // to each attempt to connect to an MQTT broker. Returns the *tls.Config that will be used when establishing
-// the connection (a copy of the tls.Config from ClientOptions will be passed in along with the broker URL).
-// This allows connection specific changes to be made to the *tls.Config.
+// the connection (a copy of the tls.Config from ClientOptions, or that set for the broker with SetBrokerTLSConfig,
+// will be passed in along with the broker URL). This allows connection specific changes to be made to the *tls.Config.
 func (o *ClientOptions) SetConnectionAttemptHandler(onConnectAttempt ConnectionAttemptHandler) *ClientOptions {
 	o.OnConnectAttempt = onConnectAttempt
 	return o
@@ -376,6 +801,15 @@ func (o *ClientOptions) SetConnectionNotificationHandler(onConnectionNotificatio
 	return o
 }
 
+// SetConnectionNotificationChannel sets a channel on which all connection events (as passed to the
+// ConnectionNotificationHandler) will be delivered along with the time they occurred. This allows the
+// connection lifecycle to be monitored from a select loop. Sends do not block, so events will be dropped
+// if the channel is full; use a buffered channel and read it promptly. The channel is never closed.
+func (o *ClientOptions) SetConnectionNotificationChannel(ch chan<- ConnectionNotificationEvent) *ClientOptions {
+	o.NotificationChannel = ch
+	return o
+}
+
 // SetWriteTimeout puts a limit on how long a mqtt publish should block until it unblocks with a
 // timeout error. A duration of 0 never times out. Default never times out
 func (o *ClientOptions) SetWriteTimeout(t time.Duration) *ClientOptions {
@@ -383,6 +817,17 @@ func (o *ClientOptions) SetWriteTimeout(t time.Duration) *ClientOptions {
 	return o
 }
 
+// SetWriteStallTimeout sets the maximum time that writing a single packet (or batch of packets) to the
+// connection may block. A write deadline is set on the connection and, as not all connections honour
+// deadlines, the connection is closed if the write is still blocked once the timeout expires. The
+// connection is then treated as lost, with an error wrapping ErrWriteStalled. This allows a half-open
+// connection (e.g. where the TCP send buffer has filled) to be detected without waiting for the keepalive
+// to expire. A duration of 0 (the default) disables stall detection.
+func (o *ClientOptions) SetWriteStallTimeout(t time.Duration) *ClientOptions {
+	o.WriteStallTimeout = t
+	return o
+}
+
 // SetConnectTimeout limits how long the client will wait when trying to open a connection
 // to an MQTT server before timing out. A duration of 0 never times out.
 // Default 30 seconds. Currently only operational on TCP/TLS connections.
@@ -392,6 +837,28 @@ func (o *ClientOptions) SetConnectTimeout(t time.Duration) *ClientOptions {
 	return o
 }
 
+// SetConnectTimeouts sets separate limits on each phase of establishing a connection (dialing, the TLS handshake
+// and waiting for CONNACK) and, optionally, an overall deadline for Connect that applies across all brokers and
+// retries (when it passes the token returned by Connect fails with an error wrapping ErrConnectDeadline). Phases
+// with a zero limit are bounded by ConnectTimeout as before. The TLS handshake limit applies to ssl, tls, mqtts etc.
+// connections (for wss it is part of the dial) and the overall deadline applies only to Connect, not reconnection.
+func (o *ClientOptions) SetConnectTimeouts(t ConnectTimeouts) *ClientOptions {
+	o.ConnectTimeouts = t
+	return o
+}
+
+// SetParallelConnect, when true, causes Connect to dial all brokers (see AddBroker) concurrently rather than one
+// after another, so that brokers that are down (or slow to respond) do not delay the connection to one that is up.
+// The MQTT handshake is performed on the first connection to be established, falling back to the next to complete
+// if the broker rejects it, and the other connections are closed; only one CONNECT is sent at a time, so a broker
+// cluster will not see competing sessions for the client ID. Broker priorities (see AddBrokerWithPriority) are not
+// used to order the attempts. This applies to the initial connection only; reconnection tries the brokers in turn.
+// Note that the OnConnectAttempt handler and per broker connection notifications may be called concurrently.
+func (o *ClientOptions) SetParallelConnect(parallel bool) *ClientOptions {
+	o.ParallelConnect = parallel
+	return o
+}
+
 // SetMaxReconnectInterval sets the maximum time that will be waited between reconnection attempts
 // when connection is lost
 func (o *ClientOptions) SetMaxReconnectInterval(t time.Duration) *ClientOptions {
@@ -426,6 +893,34 @@ func (o *ClientOptions) SetConnectRetry(a bool) *ClientOptions {
 	return o
 }
 
+// SetCleanSessionFallback enables recovery from session state that cannot be used. Without this a Store that
+// cannot be opened (for example, a FileStore whose directory holds files in an unsupported format) panics and
+// stored packets that cannot be read are skipped when the session is resumed. When enabled, Connect instead
+// discards the contents of the store (see DiscardableStore) and connects with the "clean session" flag set (so
+// the broker also discards the session); once connected, onReset (which may be nil) is called with the reason.
+// Note that this means messages that were in flight will be lost; this is intended for unattended devices
+// where a store that cannot be used would otherwise require manual intervention.
+func (o *ClientOptions) SetCleanSessionFallback(enabled bool, onReset SessionResetHandler) *ClientOptions {
+	o.CleanSessionFallback = enabled
+	o.OnSessionReset = onReset
+	return o
+}
+
+// SetConnectRetryPolicy sets a policy that decides, based on the class of error (e.g. bad credentials), whether
+// a failed connection attempt should be retried and how long to wait before doing so (see NewConnectRetryPolicy).
+// The policy applies to both the initial connection (setting a non-nil policy implies SetConnectRetry(true), and
+// replaces ConnectRetryInterval) and automatic reconnection (where it replaces the exponential backoff).
+// When the policy gives up, onGiveUp (which may be nil) is called, the client is disconnected and, for the initial
+// connection, the token returned by Connect completes with the error.
+func (o *ClientOptions) SetConnectRetryPolicy(p ConnectRetryPolicy, onGiveUp ConnectGiveUpHandler) *ClientOptions {
+	o.ConnectRetryPolicy = p
+	o.OnConnectGiveUp = onGiveUp
+	if p != nil {
+		o.ConnectRetry = true
+	}
+	return o
+}
+
 // SetMessageChannelDepth DEPRECATED The value set here no longer has any effect, this function
 // remains so the API is not altered.
 func (o *ClientOptions) SetMessageChannelDepth(s uint) *ClientOptions {
@@ -446,6 +941,26 @@ func (o *ClientOptions) SetWebsocketOptions(w *WebsocketOptions) *ClientOptions
 	return o
 }
 
+// SetWebsocketCompression enables permessage-deflate compression for websocket (ws/wss) connections; level is a
+// compress/flate compression level (e.g. flate.BestSpeed). Compression is only used if the server agrees to it
+// during the opening handshake. 0 (the default) disables compression.
+func (o *ClientOptions) SetWebsocketCompression(level int) *ClientOptions {
+	if o.WebsocketOptions == nil {
+		o.WebsocketOptions = &WebsocketOptions{}
+	}
+	o.WebsocketOptions.CompressionLevel = level
+	return o
+}
+
+// SetWebsocketConnectionOptions sets a callback that is invoked before each websocket opening handshake
+// (i.e. on every connection attempt, including reconnects). The callback can modify the HTTP headers,
+// cookies and subprotocols sent; this allows, for example, short-lived authentication tokens to be
+// refreshed. Changes made by the callback only apply to the current attempt.
+func (o *ClientOptions) SetWebsocketConnectionOptions(cb WebsocketConnectionOptionsHandler) *ClientOptions {
+	o.OnWebsocketConnection = cb
+	return o
+}
+
 // SetMaxResumePubInFlight sets the maximum simultaneous publish messages that will be sent while resuming. Note that
 // this only applies to messages coming from the store (so additional sends may push us over the limit)
 // Note that the connect token will not be flagged as complete until all messages have been sent from the
@@ -456,12 +971,141 @@ func (o *ClientOptions) SetMaxResumePubInFlight(MaxResumePubInFlight int) *Clien
 	return o
 }
 
+// SetResumeRate limits the rate (in messages per second) at which messages held in the store are resent when a
+// session is resumed; 0 (the default) means no limit. Messages are sent in batches (see SetResumeBatchSize) and,
+// after each batch, resume pauses until the time allotted to that batch has passed. As with
+// SetMaxResumePubInFlight, the connect token will not be flagged as complete until all messages have been sent
+// from the store. This option was put in place because some brokers throttle, or disconnect, clients that resend
+// their entire store at once.
+func (o *ClientOptions) SetResumeRate(msgsPerSec int) *ClientOptions {
+	o.ResumeRate = msgsPerSec
+	return o
+}
+
+// SetResumeBatchSize sets the number of messages that are resent, when resuming a session, between pauses (see
+// SetResumeRate); a ConnectionNotificationResume reporting progress is issued after each batch (and once all
+// messages have been sent). The default, 0, means that messages are paced individually (if a ResumeRate is set)
+// and that progress is only reported on completion.
+func (o *ClientOptions) SetResumeBatchSize(n int) *ClientOptions {
+	o.ResumeBatchSize = n
+	return o
+}
+
+// SetResumeFilter sets a function that is called, when a session is resumed, for each outbound message held in
+// the store; messages for which it returns false are discarded rather than being resent. This allows, for
+// example, stale messages to be dropped following a long outage. Note that the broker will not be aware of any
+// discarded QoS 1/2 messages that it has already received (and these will not be acknowledged).
+func (o *ClientOptions) SetResumeFilter(filter ResumeFilter) *ClientOptions {
+	o.ResumeFilter = filter
+	return o
+}
+
+// SetOfflineBuffer enables store-and-forward. Messages published (at any QoS) while the connection is down
+// (requires AutoReconnect or ConnectRetry) are written to the Store and, once the connection is up, published
+// in the order they were buffered (messages published meanwhile are queued behind them). For QoS 0 messages the
+// token returned by Publish completes once the message has been buffered; for QoS 1 and 2 it completes when the
+// flow for the forwarded message completes (or with ErrOfflineDropped if the message is discarded). When a
+// persistent Store (e.g. FileStore) is used the buffered messages survive a restart (including when CleanSession
+// is true). If more than size messages are buffered the oldest is discarded and onDrop (which may be nil) is
+// called; onDrop is also called for messages that expire before they can be sent (see PublishWithOptions). size
+// of 0 disables buffering.
+func (o *ClientOptions) SetOfflineBuffer(size int, onDrop OfflineDropHandler) *ClientOptions {
+	o.OfflineBufferSize = size
+	o.OnOfflineDrop = onDrop
+	return o
+}
+
+// SetHappyEyeballs enables racing of connection attempts when the broker hostname resolves to multiple addresses
+// (tcp and ssl connections that do not use a proxy). Attempts start delay apart (or as soon as the previous
+// attempt fails), alternating between IPv6 and IPv4, and the first connection established is used. This avoids
+// a long wait when some addresses are unreachable (e.g. broken IPv6). 250ms is a reasonable delay; 0 (the
+// default) disables racing (the Dialer is used as is).
+func (o *ClientOptions) SetHappyEyeballs(delay time.Duration) *ClientOptions {
+	o.HappyEyeballsDelay = delay
+	return o
+}
+
 // SetDialer sets the tcp dialer options used in a tcp connection
 func (o *ClientOptions) SetDialer(dialer *net.Dialer) *ClientOptions {
 	o.Dialer = dialer
 	return o
 }
 
+// SetTCPKeepAlive sets the interval between TCP keepalive probes on tcp and ssl connections (this is
+// independent of the MQTT keepalive). 0 uses the default (currently 15 seconds) and a negative value disables
+// TCP keepalives. This modifies the Dialer so should be called after SetDialer.
+func (o *ClientOptions) SetTCPKeepAlive(interval time.Duration) *ClientOptions {
+	if o.Dialer == nil {
+		o.Dialer = &net.Dialer{Timeout: o.ConnectTimeout}
+	}
+	o.Dialer.KeepAlive = interval
+	return o
+}
+
+// SetTCPNoDelay controls whether Nagle's algorithm is disabled (TCP_NODELAY) on tcp and ssl connections. By
+// default noDelay is true (packets are sent as soon as possible); setting it to false allows small packets to
+// be coalesced, reducing overhead at the expense of latency.
+func (o *ClientOptions) SetTCPNoDelay(noDelay bool) *ClientOptions {
+	o.TCPNoDelayDisabled = !noDelay
+	return o
+}
+
+// SetSocketBufferSizes sets the size, in bytes, of the operating system receive (SO_RCVBUF) and send
+// (SO_SNDBUF) buffers for tcp, ssl and unix connections; 0 leaves the operating system default in place. The
+// sizes are set once the connection has been established (so may not influence the TCP window scale).
+func (o *ClientOptions) SetSocketBufferSizes(read, write int) *ClientOptions {
+	o.SocketReadBuffer, o.SocketWriteBuffer = read, write
+	return o
+}
+
+// SetDialerControl sets a function that is called with each socket created by the Dialer, after it is created
+// but before it is connected (see net.Dialer.Control). This allows socket options not otherwise supported to be
+// set, e.g. SO_BINDTODEVICE to bind connections to a particular interface or VRF. This modifies the Dialer so
+// should be called after SetDialer.
+func (o *ClientOptions) SetDialerControl(control func(network, address string, c syscall.RawConn) error) *ClientOptions {
+	if o.Dialer == nil {
+		o.Dialer = &net.Dialer{Timeout: o.ConnectTimeout}
+	}
+	o.Dialer.Control = control
+	return o
+}
+
+// SetProxyURL sets the proxy through which tcp and ssl connections are made. socks5, socks5h and http/https
+// (HTTP CONNECT) proxies are supported (credentials may be provided in the URL). If not set, the ALL_PROXY
+// environment variable is used (hosts listed in NO_PROXY will be connected to directly). Websocket connections
+// use WebsocketOptions.Proxy instead.
+func (o *ClientOptions) SetProxyURL(proxyURL *url.URL) *ClientOptions {
+	o.ProxyURL = proxyURL
+	return o
+}
+
+// SetConnWrapper sets a function that wraps each network connection once it is established (including those opened
+// by a CustomOpenConnectionFn). This allows the bytes sent and received to be observed (e.g. recorded for a protocol
+// analyser or metered); as the wrapper sits above TLS, the unencrypted traffic is visible. The wrapper is applied
+// before the CONNECT packet is sent and must pass all calls through to conn (including Close and the deadline
+// methods, which the client relies upon).
+func (o *ClientOptions) SetConnWrapper(w ConnWrapper) *ClientOptions {
+	o.ConnWrapper = w
+	return o
+}
+
+// SetWriteRateLimit limits the rate at which data is written to the network connection (bytes per second). This
+// prevents the client saturating a shared or metered link; for example, when many messages are resent from the
+// store following a reconnection. Writes exceeding the limit block (so publishes may take longer to complete and
+// WriteTimeout should be set with this in mind). 0 (the default) means no limit.
+func (o *ClientOptions) SetWriteRateLimit(bytesPerSec int) *ClientOptions {
+	o.WriteRateLimit = bytesPerSec
+	return o
+}
+
+// SetReadRateLimit limits the rate at which data is read from the network connection (bytes per second); TCP flow
+// control then slows the broker. Note that reading slowly delays the receipt of acknowledgements and PINGRESP
+// packets (so PingTimeout may need to be increased). 0 (the default) means no limit.
+func (o *ClientOptions) SetReadRateLimit(bytesPerSec int) *ClientOptions {
+	o.ReadRateLimit = bytesPerSec
+	return o
+}
+
 // SetCustomOpenConnectionFn replaces the inbuilt function that establishes a network connection with a custom function.
 // The passed in function should return an open `net.Conn` or an error (see the existing openConnection function for an example)
 // It enables custom networking types in addition to the defaults (tcp, tls, websockets...)
@@ -475,11 +1119,182 @@ func (o *ClientOptions) SetCustomOpenConnectionFn(customOpenConnectionFn OpenCon
 // SetAutoAckDisabled enables or disables the Automated Acking of Messages received by the handler.
 //
 //	By default it is set to false. Setting it to true will disable the auto-ack globally.
+//	When disabled the handler must call Ack (or Acknowledge / Nack via ManualAckMessage); Nack requeues the
+//	message so that it is passed to the handler again. Acknowledging after the connection has been lost
+//	has no effect (Acknowledge returns ErrAckNotSent).
 func (o *ClientOptions) SetAutoAckDisabled(autoAckDisabled bool) *ClientOptions {
 	o.AutoAckDisabled = autoAckDisabled
 	return o
 }
 
+// SetAckTimeout sets the time allowed for a message to be acknowledged when automatic acknowledgement has
+// been disabled (SetAutoAckDisabled). If a message (including one for which no handler was found) is not
+// acknowledged (or nacked) within this time onTimeout is called and the message is processed according to
+// the action returned. If onTimeout is nil the message is acknowledged (AckTimeoutDiscard). QoS 0 messages are
+// not acknowledged, so are not subject to the timeout.
+// Unacknowledged messages consume the in-flight window so this prevents a stuck handler from stalling
+// delivery indefinitely. 0 (the default) disables the timeout.
+func (o *ClientOptions) SetAckTimeout(timeout time.Duration, onTimeout AckTimeoutHandler) *ClientOptions {
+	o.AckTimeout = timeout
+	o.OnAckTimeout = onTimeout
+	return o
+}
+
+// SetHandlerPanicHandler sets a function to be called if a message handler (or the default publish handler)
+// panics. When set, the panic is recovered, the handler is called and message processing continues as if the
+// message handler had returned (so the message is acknowledged unless SetAutoAckDisabled has been used).
+// When nil (the default) a panic in a message handler is not recovered and will terminate the program.
+func (o *ClientOptions) SetHandlerPanicHandler(handler HandlerPanicHandler) *ClientOptions {
+	o.OnHandlerPanic = handler
+	return o
+}
+
+// SetDecodeErrorHandler sets a function to be called when a payload cannot be decoded by a handler created
+// with TypedHandler (e.g. via SubscribeJSON). When nil (the default) such messages are silently discarded.
+func (o *ClientOptions) SetDecodeErrorHandler(handler DecodeErrorHandler) *ClientOptions {
+	o.OnDecodeError = handler
+	return o
+}
+
+// SetMaxInboundPayload sets the maximum size (in bytes) of the payload of messages received from the broker.
+// Messages with larger payloads are acknowledged and discarded (with a warning logged) without the payload
+// being held in memory; other packets larger than this cause the connection to be closed. 0 (the default)
+// means no limit.
+func (o *ClientOptions) SetMaxInboundPayload(bytes int) *ClientOptions {
+	o.MaxInboundPayload = bytes
+	return o
+}
+
+// SetPayloadCompression enables transparent payload compression: payloads of at least minSize bytes are compressed
+// with codec when published (unless this does not make them smaller) and compressed payloads are decompressed
+// before being passed to handlers. A compressed payload starts with a header (a zero byte, 'Z' and the codec's ID)
+// so that compressed and uncompressed messages can be mixed; other clients must use the same convention to
+// interoperate. Payloads compressed with gzip are always understood (see NewGzipCompression). MaxOutboundPayload
+// applies to the compressed payload and MaxInboundPayload limits the size of the decompressed payload (if it is not
+// set the limit is 268435455 bytes); messages exceeding this are acknowledged and discarded. By default this applies
+// to all topics; see SetPayloadCompressionTopics. Pass a nil codec to disable compression.
+func (o *ClientOptions) SetPayloadCompression(codec CompressionCodec, minSize int) *ClientOptions {
+	o.PayloadCompression = codec
+	o.CompressionMinSize = minSize
+	return o
+}
+
+// SetPayloadCompressionTopics limits payload compression (see SetPayloadCompression) to topics matching filters
+// (which may contain wildcards); messages on other topics are neither compressed nor decompressed. This allows
+// compression to be agreed per topic (e.g. with the other clients using a topic). Pass no filters to compress on
+// all topics.
+func (o *ClientOptions) SetPayloadCompressionTopics(filters ...string) *ClientOptions {
+	o.CompressionTopics = filters
+	return o
+}
+
+// SetPublishInterceptor sets the chain of interceptors that each published message passes through, in order, before
+// the PUBLISH packet is built (see PublishInterceptor). Interceptors run before payload compression (see
+// SetPayloadCompression) and before the message is stored. Pass no interceptors to remove the chain.
+func (o *ClientOptions) SetPublishInterceptor(interceptors ...PublishInterceptor) *ClientOptions {
+	o.PublishInterceptors = interceptors
+	return o
+}
+
+// SetInboundInterceptor sets the chain of interceptors that each received message passes through, in order, before
+// it is routed to a handler (see InboundInterceptor). Received payloads are decompressed (see
+// SetPayloadCompression) before being passed to the interceptors. Pass no interceptors to remove the chain.
+func (o *ClientOptions) SetInboundInterceptor(interceptors ...InboundInterceptor) *ClientOptions {
+	o.InboundInterceptors = interceptors
+	return o
+}
+
+// SetMaxOutboundPayload sets the maximum size (in bytes) of the payload passed to Publish. Larger payloads are
+// rejected with an error wrapping ErrPayloadTooLarge (a *packets.PayloadTooLargeError). 0 (the default) means
+// no limit.
+func (o *ClientOptions) SetMaxOutboundPayload(bytes int) *ClientOptions {
+	o.MaxOutboundPayload = bytes
+	return o
+}
+
+// SetMaxInflight sets the maximum number of QoS 1/2 messages that may be awaiting acknowledgement at any one time.
+// Once this limit is reached, Publish (and PublishBatch) blocks until an earlier flow completes, or fails with an
+// error wrapping ErrConnectionLost if the connection is lost first (brokers that limit the number of
+// unacknowledged messages will generally disconnect a client that exceeds their limit). Note that this
+// is separate from MessageChannelDepth and does not apply to messages resent from the store when resuming (see
+// SetMaxResumePubInFlight). 0 (the default) means no limit. The current usage is available via
+// HealthReporter.ConnectionHealth.
+func (o *ClientOptions) SetMaxInflight(n int) *ClientOptions {
+	o.MaxInflight = n
+	return o
+}
+
+// SetMessageIDWaitTimeout sets how long Publish, Subscribe and Unsubscribe will wait for a message ID to become free
+// when all 65535 are in use (this can happen with high throughput QoS 1/2 workloads). If no ID becomes free within
+// the timeout, the token fails with ErrMessageIDsExhausted. 0 (the default) means that the token fails immediately.
+// The number of free IDs is available via HealthReporter.ConnectionHealth.
+func (o *ClientOptions) SetMessageIDWaitTimeout(t time.Duration) *ClientOptions {
+	o.MessageIDWaitTimeout = t
+	return o
+}
+
+// SetMessageIDAllocator sets the strategy used to choose message IDs (see NewSequentialIDAllocator,
+// NewRandomIDAllocator, NewRangeIDAllocator and ReserveIDs). nil (the default) means IDs are issued in sequence.
+func (o *ClientOptions) SetMessageIDAllocator(a MessageIDAllocator) *ClientOptions {
+	o.MessageIDAllocator = a
+	return o
+}
+
+// SetConnectionHistorySize sets the number of connection attempts (including automatic reconnections) retained
+// for Client.ConnectionHistory. Each entry records the broker, time, outcome and the delay applied before the next
+// attempt. The default is 20; 0 disables the history.
+func (o *ClientOptions) SetConnectionHistorySize(n int) *ClientOptions {
+	o.ConnectionHistorySize = n
+	return o
+}
+
+// SetClock sets the source of time used for keepalive, reconnection backoff/retry delays and Token.WaitTimeout.
+// This is intended for testing; a clock.Fake allows time-dependent behaviour to be exercised without real delays.
+// nil (the default) means clock.Real.
+func (o *ClientOptions) SetClock(c clock.Clock) *ClientOptions {
+	o.Clock = c
+	return o
+}
+
+// SetStreamingHandler causes messages with a payload larger than threshold bytes to be passed to handler, which
+// reads the payload directly from the network connection, rather than being buffered in memory and routed in the
+// usual way (this allows large payloads, such as firmware images, to be received on devices with little memory).
+// The handler is called from the goroutine that reads from the network so no other packets will be received until
+// it returns; it must not wait on tokens (which cannot complete until it returns). Any part of the payload not read
+// by the handler is discarded and the message is acknowledged when the handler returns. Streamed messages are not
+// subject to SetAutoAckDisabled or routing (the handler receives all such messages regardless of topic).
+// A nil handler (the default) disables streaming.
+func (o *ClientOptions) SetStreamingHandler(threshold int, handler StreamingMessageHandler) *ClientOptions {
+	o.StreamingThreshold = threshold
+	o.StreamingHandler = handler
+	return o
+}
+
+// SetPacketHook sets a function that will be called with every packet sent to, or received from, the broker
+// (after it has been successfully written / decoded). This provides a way to trace the protocol exchange
+// without a network sniffer. Set to nil (the default) to disable.
+func (o *ClientOptions) SetPacketHook(hook PacketHook) *ClientOptions {
+	o.PacketHook = hook
+	return o
+}
+
+// SetPacketHookSampleRate limits the packets passed to the PacketHook when the message rate is high; only one in
+// every n PUBLISH (and related acknowledgement) packets will be passed to the hook. Other packets (CONNECT,
+// SUBSCRIBE, PINGREQ etc) are always passed. 0 or 1 (the default) passes all packets.
+func (o *ClientOptions) SetPacketHookSampleRate(n uint) *ClientOptions {
+	o.PacketHookSampleRate = n
+	return o
+}
+
+// SetDeduplicationWindow enables detection of redelivered QoS 1 messages. A message received with the DUP flag set
+// is not passed to handlers (but is acknowledged) if a message with the same message ID and topic was received within
+// the window (including before a reconnection). This provides at-most-once handling within the window for
+// applications whose handlers are not idempotent. 0 (the default) disables deduplication.
+func (o *ClientOptions) SetDeduplicationWindow(window time.Duration) *ClientOptions {
+	o.DeduplicationWindow = window
+	return o
+}
+
 // SetLogger sets the logger instance used by the client.
 //
 // By default, no logger is configured.
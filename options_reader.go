@@ -117,6 +117,14 @@ func (r *ClientOptionsReader) WillRetained() bool {
 	return s
 }
 
+// Will returns the will message (nil if no will is set)
+func (r *ClientOptionsReader) Will() *Will {
+	if !r.options.WillEnabled {
+		return nil
+	}
+	return &Will{Topic: r.options.WillTopic, Payload: r.options.WillPayload, Qos: r.options.WillQos, Retained: r.options.WillRetained}
+}
+
 func (r *ClientOptionsReader) ProtocolVersion() uint {
 	s := r.options.ProtocolVersion
 	return s
@@ -184,3 +192,8 @@ func (r *ClientOptionsReader) WebsocketOptions() *WebsocketOptions {
 	s := r.options.WebsocketOptions
 	return s
 }
+
+// DecodeErrorHandler returns the handler set with SetDecodeErrorHandler
+func (r *ClientOptionsReader) DecodeErrorHandler() DecodeErrorHandler {
+	return r.options.OnDecodeError
+}
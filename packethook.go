@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Direction indicates whether a packet passed to a PacketHook was sent or received
+type Direction int
+
+const (
+	PacketSent     Direction = iota // The packet was written to the network connection
+	PacketReceived                  // The packet was read from the network connection
+)
+
+func (d Direction) String() string {
+	if d == PacketReceived {
+		return "received"
+	}
+	return "sent"
+}
+
+// PacketHook is called with each decoded packet sent or received (see ClientOptions.SetPacketHook). The hook is
+// called from the goroutines handling network communication, so it should return quickly, and must not modify
+// the packet.
+type PacketHook func(direction Direction, cp packets.ControlPacket)
+
+// tracePacket passes cp to the PacketHook (if one is set and the packet is selected by the sample rate)
+// Each call is also counted in the connection stats.
+func (c *client) tracePacket(direction Direction, cp packets.ControlPacket) {
+	if direction == PacketReceived {
+		c.stats.packetsIn.Add(1)
+	} else {
+		c.stats.packetsOut.Add(1)
+	}
+	hook := c.options.PacketHook
+	if hook == nil {
+		return
+	}
+	if n := c.options.PacketHookSampleRate; n > 1 {
+		switch cp.(type) {
+		case *packets.PublishPacket, *packets.PubackPacket, *packets.PubrecPacket, *packets.PubrelPacket, *packets.PubcompPacket:
+			if c.packetsTraced.Add(1)%uint64(n) != 0 {
+				return
+			}
+		}
+	}
+	hook(direction, cp)
+}
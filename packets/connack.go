@@ -69,3 +69,24 @@ func (ca *ConnackPacket) Unpack(b io.Reader) error {
 func (ca *ConnackPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (ca *ConnackPacket) Append(dst []byte) ([]byte, error) {
+	ca.FixedHeader.RemainingLength = 2
+	dst, err := ca.FixedHeader.appendTo(dst)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, boolToByte(ca.SessionPresent), ca.ReturnCode), nil
+}
+
+// Marshal returns the encoded packet
+func (ca *ConnackPacket) Marshal() ([]byte, error) {
+	return ca.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete CONNACK packet
+func (ca *ConnackPacket) Unmarshal(b []byte) error {
+	*ca = ConnackPacket{FixedHeader: FixedHeader{MessageType: Connack}}
+	return unmarshal(b, ca, &ca.FixedHeader)
+}
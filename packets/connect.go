@@ -172,3 +172,19 @@ func (c *ConnectPacket) Validate() byte {
 func (c *ConnectPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (c *ConnectPacket) Append(dst []byte) ([]byte, error) {
+	return appendWritten(dst, c)
+}
+
+// Marshal returns the encoded packet
+func (c *ConnectPacket) Marshal() ([]byte, error) {
+	return c.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete CONNECT packet
+func (c *ConnectPacket) Unmarshal(b []byte) error {
+	*c = ConnectPacket{FixedHeader: FixedHeader{MessageType: Connect}}
+	return unmarshal(b, c, &c.FixedHeader)
+}
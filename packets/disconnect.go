@@ -24,6 +24,7 @@ import (
 // Disconnect MQTT packet
 type DisconnectPacket struct {
 	FixedHeader
+	ReasonCode byte // Only present in DISCONNECT packets sent by MQTT v5 servers (0 otherwise); not written
 }
 
 func (d *DisconnectPacket) String() string {
@@ -31,6 +32,7 @@ func (d *DisconnectPacket) String() string {
 }
 
 func (d *DisconnectPacket) Write(w io.Writer) error {
+	d.FixedHeader.RemainingLength = 0
 	packet, err := d.FixedHeader.pack()
 	if err != nil {
 		return err
@@ -43,7 +45,12 @@ func (d *DisconnectPacket) Write(w io.Writer) error {
 // Unpack decodes the details of a ControlPacket after the fixed
 // header has been read
 func (d *DisconnectPacket) Unpack(b io.Reader) error {
-	return nil
+	if d.RemainingLength == 0 {
+		return nil
+	}
+	var err error
+	d.ReasonCode, err = decodeByte(b) // Any v5 properties that follow are ignored
+	return err
 }
 
 // Details returns a Details struct containing the Qos and
@@ -51,3 +58,20 @@ func (d *DisconnectPacket) Unpack(b io.Reader) error {
 func (d *DisconnectPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (d *DisconnectPacket) Append(dst []byte) ([]byte, error) {
+	d.FixedHeader.RemainingLength = 0
+	return d.FixedHeader.appendTo(dst)
+}
+
+// Marshal returns the encoded packet
+func (d *DisconnectPacket) Marshal() ([]byte, error) {
+	return d.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete DISCONNECT packet
+func (d *DisconnectPacket) Unmarshal(b []byte) error {
+	*d = DisconnectPacket{FixedHeader: FixedHeader{MessageType: Disconnect}}
+	return unmarshal(b, d, &d.FixedHeader)
+}
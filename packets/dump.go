@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"encoding/hex"
+	"encoding/json"
+)
+
+// dumpPayloadPreview is the maximum number of payload bytes included (hex encoded) in the JSON representation
+const dumpPayloadPreview = 64
+
+// Dump returns a human-readable (indented JSON) representation of cp including all fields (the terse String()
+// methods are intended for logging). Passwords are redacted and only the start of payloads is included.
+func Dump(cp ControlPacket) string {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return cp.String()
+	}
+	return string(b)
+}
+
+// headerJSON is the JSON representation of a FixedHeader (FixedHeader does not implement json.Marshaler
+// because the method would be promoted to the packet types that embed it)
+type headerJSON struct {
+	Type            string `json:"type"`
+	Dup             bool   `json:"dup"`
+	Qos             byte   `json:"qos"`
+	Retain          bool   `json:"retain"`
+	RemainingLength int    `json:"remainingLength"`
+}
+
+func headerToJSON(fh FixedHeader) headerJSON {
+	return headerJSON{Type: PacketNames[fh.MessageType], Dup: fh.Dup, Qos: fh.Qos, Retain: fh.Retain, RemainingLength: fh.RemainingLength}
+}
+
+// payloadJSON is the JSON representation of a payload; the hex encoding is limited to dumpPayloadPreview bytes
+type payloadJSON struct {
+	Length    int    `json:"length"`
+	Hex       string `json:"hex"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+func payloadToJSON(payload []byte) payloadJSON {
+	p := payloadJSON{Length: len(payload)}
+	if len(payload) > dumpPayloadPreview {
+		payload, p.Truncated = payload[:dumpPayloadPreview], true
+	}
+	p.Hex = hex.EncodeToString(payload)
+	return p
+}
+
+// bytesToInts converts a slice of QoS values/return codes so they are not base64 encoded
+func bytesToInts(b []byte) []int {
+	ints := make([]int, len(b))
+	for i, v := range b {
+		ints[i] = int(v)
+	}
+	return ints
+}
+
+func marshalHeaderJSON(fh FixedHeader) ([]byte, error) {
+	return json.Marshal(struct {
+		Header headerJSON `json:"header"`
+	}{headerToJSON(fh)})
+}
+
+func marshalMessageIDJSON(fh FixedHeader, messageID uint16) ([]byte, error) {
+	return json.Marshal(struct {
+		Header    headerJSON `json:"header"`
+		MessageID uint16     `json:"messageID"`
+	}{headerToJSON(fh), messageID})
+}
+
+// MarshalJSON implements json.Marshaler
+func (c *ConnectPacket) MarshalJSON() ([]byte, error) {
+	var password string
+	if len(c.Password) > 0 {
+		password = "[redacted]"
+	}
+	return json.Marshal(struct {
+		Header           headerJSON  `json:"header"`
+		ProtocolName     string      `json:"protocolName"`
+		ProtocolVersion  byte        `json:"protocolVersion"`
+		CleanSession     bool        `json:"cleanSession"`
+		WillFlag         bool        `json:"willFlag"`
+		WillQos          byte        `json:"willQos"`
+		WillRetain       bool        `json:"willRetain"`
+		UsernameFlag     bool        `json:"usernameFlag"`
+		PasswordFlag     bool        `json:"passwordFlag"`
+		ReservedBit      byte        `json:"reservedBit"`
+		Keepalive        uint16      `json:"keepalive"`
+		ClientIdentifier string      `json:"clientIdentifier"`
+		WillTopic        string      `json:"willTopic"`
+		WillMessage      payloadJSON `json:"willMessage"`
+		Username         string      `json:"username"`
+		Password         string      `json:"password"`
+	}{
+		headerToJSON(c.FixedHeader), c.ProtocolName, c.ProtocolVersion, c.CleanSession, c.WillFlag, c.WillQos,
+		c.WillRetain, c.UsernameFlag, c.PasswordFlag, c.ReservedBit, c.Keepalive, c.ClientIdentifier,
+		c.WillTopic, payloadToJSON(c.WillMessage), c.Username, password,
+	})
+}
+
+// MarshalJSON implements json.Marshaler
+func (ca *ConnackPacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Header         headerJSON `json:"header"`
+		SessionPresent bool       `json:"sessionPresent"`
+		ReturnCode     byte       `json:"returnCode"`
+		Description    string     `json:"description"`
+	}{headerToJSON(ca.FixedHeader), ca.SessionPresent, ca.ReturnCode, ConnackReturnCodes[ca.ReturnCode]})
+}
+
+// MarshalJSON implements json.Marshaler
+func (p *PublishPacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Header    headerJSON  `json:"header"`
+		TopicName string      `json:"topicName"`
+		MessageID uint16      `json:"messageID"`
+		Payload   payloadJSON `json:"payload"`
+	}{headerToJSON(p.FixedHeader), p.TopicName, p.MessageID, payloadToJSON(p.Payload)})
+}
+
+// MarshalJSON implements json.Marshaler
+func (pa *PubackPacket) MarshalJSON() ([]byte, error) {
+	return marshalMessageIDJSON(pa.FixedHeader, pa.MessageID)
+}
+
+// MarshalJSON implements json.Marshaler
+func (pr *PubrecPacket) MarshalJSON() ([]byte, error) {
+	return marshalMessageIDJSON(pr.FixedHeader, pr.MessageID)
+}
+
+// MarshalJSON implements json.Marshaler
+func (pr *PubrelPacket) MarshalJSON() ([]byte, error) {
+	return marshalMessageIDJSON(pr.FixedHeader, pr.MessageID)
+}
+
+// MarshalJSON implements json.Marshaler
+func (pc *PubcompPacket) MarshalJSON() ([]byte, error) {
+	return marshalMessageIDJSON(pc.FixedHeader, pc.MessageID)
+}
+
+// MarshalJSON implements json.Marshaler
+func (s *SubscribePacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Header    headerJSON `json:"header"`
+		MessageID uint16     `json:"messageID"`
+		Topics    []string   `json:"topics"`
+		Qoss      []int      `json:"qoss"`
+	}{headerToJSON(s.FixedHeader), s.MessageID, s.Topics, bytesToInts(s.Qoss)})
+}
+
+// MarshalJSON implements json.Marshaler
+func (sa *SubackPacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Header      headerJSON `json:"header"`
+		MessageID   uint16     `json:"messageID"`
+		ReturnCodes []int      `json:"returnCodes"`
+	}{headerToJSON(sa.FixedHeader), sa.MessageID, bytesToInts(sa.ReturnCodes)})
+}
+
+// MarshalJSON implements json.Marshaler
+func (u *UnsubscribePacket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Header    headerJSON `json:"header"`
+		MessageID uint16     `json:"messageID"`
+		Topics    []string   `json:"topics"`
+	}{headerToJSON(u.FixedHeader), u.MessageID, u.Topics})
+}
+
+// MarshalJSON implements json.Marshaler
+func (ua *UnsubackPacket) MarshalJSON() ([]byte, error) {
+	return marshalMessageIDJSON(ua.FixedHeader, ua.MessageID)
+}
+
+// MarshalJSON implements json.Marshaler
+func (pr *PingreqPacket) MarshalJSON() ([]byte, error) {
+	return marshalHeaderJSON(pr.FixedHeader)
+}
+
+// MarshalJSON implements json.Marshaler
+func (pr *PingrespPacket) MarshalJSON() ([]byte, error) {
+	return marshalHeaderJSON(pr.FixedHeader)
+}
+
+// MarshalJSON implements json.Marshaler
+func (d *DisconnectPacket) MarshalJSON() ([]byte, error) {
+	return marshalHeaderJSON(d.FixedHeader)
+}
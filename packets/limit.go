@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrPayloadTooLarge is wrapped by PayloadTooLargeError
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrPacketTooLarge is returned by ReadPacketLimit when a packet other than PUBLISH exceeds the limit
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// PayloadTooLargeError is returned when the payload of a PUBLISH packet exceeds a configured limit
+type PayloadTooLargeError struct {
+	Packet *PublishPacket // The packet (without payload); only set by ReadPacketLimit
+	Size   int
+	Limit  int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("payload of %d bytes exceeds limit of %d bytes", e.Size, e.Limit)
+}
+
+func (e *PayloadTooLargeError) Unwrap() error {
+	return ErrPayloadTooLarge
+}
+
+// ReadPacketLimit is as ReadPacket but will not allocate a buffer for a PUBLISH payload larger than maxPayload
+// bytes. Instead the payload is read and discarded, and a *PayloadTooLargeError (containing the packet without its
+// payload, so that it can be acknowledged) returned; the reader is left at the start of the next packet. Other
+// packets with a remaining length greater than maxPayload result in an error wrapping ErrPacketTooLarge (the
+// packet is not read, so the connection should be closed). If maxPayload is <= 0 this is equivalent to ReadPacket.
+func ReadPacketLimit(r io.Reader, maxPayload int) (ControlPacket, error) {
+	cp, _, err := ReadPacketStream(r, maxPayload, 0)
+	return cp, err
+}
+
+// ReadPacketStream is as ReadPacketLimit but, additionally, the payload of a PUBLISH packet larger than threshold
+// bytes (if threshold > 0) is not read. Instead the packet is returned without its payload along with a reader from
+// which the payload can be read (N holds the payload length); the payload must be read in full (or discarded)
+// before the next packet is read from r.
+func ReadPacketStream(r io.Reader, maxPayload, threshold int) (ControlPacket, *io.LimitedReader, error) {
+	if maxPayload <= 0 && threshold <= 0 {
+		cp, err := ReadPacket(r)
+		return cp, nil, err
+	}
+	var fh FixedHeader
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, err
+	}
+	if err := fh.unpack(b[0], r); err != nil {
+		return nil, nil, err
+	}
+	if maxPayload > 0 && fh.RemainingLength > maxPayload && fh.MessageType != Publish {
+		return nil, nil, fmt.Errorf("%w: %s remaining length %d exceeds limit of %d bytes", ErrPacketTooLarge, PacketNames[fh.MessageType], fh.RemainingLength, maxPayload)
+	}
+	limit := maxPayload
+	if threshold > 0 && (limit <= 0 || threshold < limit) {
+		limit = threshold
+	}
+	if fh.MessageType != Publish || fh.RemainingLength <= limit {
+		cp, err := NewControlPacketWithHeader(fh)
+		if err != nil {
+			return nil, nil, err
+		}
+		packetBytes := make([]byte, fh.RemainingLength)
+		if _, err := io.ReadFull(r, packetBytes); err != nil {
+			return nil, nil, err
+		}
+		return cp, nil, cp.Unpack(bytes.NewBuffer(packetBytes))
+	}
+
+	// Read the variable header and check the payload length before allocating
+	p := &PublishPacket{FixedHeader: fh}
+	vh := &fullReader{r: io.LimitReader(r, int64(fh.RemainingLength))}
+	var err error
+	if p.TopicName, err = decodeString(vh); err != nil {
+		return nil, nil, err
+	}
+	payloadLen := fh.RemainingLength - len(p.TopicName) - 2
+	if p.Qos > 0 {
+		if p.MessageID, err = decodeUint16(vh); err != nil {
+			return nil, nil, err
+		}
+		payloadLen -= 2
+	}
+	if payloadLen < 0 {
+		return nil, nil, fmt.Errorf("error unpacking publish, payload length < 0")
+	}
+	if maxPayload > 0 && payloadLen > maxPayload {
+		if _, err := io.CopyN(io.Discard, r, int64(payloadLen)); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, &PayloadTooLargeError{Packet: p, Size: payloadLen, Limit: maxPayload}
+	}
+	if threshold > 0 && payloadLen > threshold {
+		return p, &io.LimitedReader{R: r, N: int64(payloadLen)}, nil
+	}
+	p.Payload = make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, p.Payload); err != nil {
+		return nil, nil, err
+	}
+	return p, nil, nil
+}
+
+// fullReader returns io.ErrUnexpectedEOF if a Read cannot be fully satisfied (decodeString etc. assume that reads
+// will be satisfied in full)
+type fullReader struct {
+	r io.Reader
+}
+
+func (f *fullReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return io.ReadFull(f.r, p)
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Each ControlPacket implementation also provides the following methods, which allow packets to be
+// encoded/decoded without an io.Writer/io.Reader (e.g. when carried over another transport):
+//
+//	Append(dst []byte) ([]byte, error) - appends the encoded packet to dst (avoiding allocation if dst has capacity)
+//	Marshal() ([]byte, error)          - returns the encoded packet
+//	Unmarshal(b []byte) error          - decodes b, which must hold exactly one complete packet of the receiver's type
+
+// errTrailingData is returned when unmarshalling data that is longer than the packet it contains
+var errTrailingData = errors.New("data extends beyond the end of the packet")
+
+// Unmarshal decodes the packet held in b (which must contain exactly one complete packet, including the fixed header)
+func Unmarshal(b []byte) (ControlPacket, error) {
+	r := bytes.NewReader(b)
+	cp, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, errTrailingData
+	}
+	return cp, nil
+}
+
+// unmarshal decodes b into cp; fh must be cp's FixedHeader
+func unmarshal(b []byte, cp ControlPacket, fh *FixedHeader) error {
+	if len(b) == 0 {
+		return errors.New("no data to unmarshal")
+	}
+	r := bytes.NewReader(b[1:])
+	var h FixedHeader
+	if err := h.unpack(b[0], r); err != nil {
+		return err
+	}
+	if h.MessageType != fh.MessageType {
+		return fmt.Errorf("cannot unmarshal %s packet into %T", PacketNames[h.MessageType], cp)
+	}
+	if r.Len() < h.RemainingLength {
+		return errors.New("failed to read expected data")
+	}
+	if r.Len() > h.RemainingLength {
+		return errTrailingData
+	}
+	*fh = h
+	return cp.Unpack(r)
+}
+
+// appendWritten appends the output of cp.Write to dst
+func appendWritten(dst []byte, cp ControlPacket) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	err := cp.Write(buf)
+	return buf.Bytes(), err
+}
+
+// appendMessageIDPacket appends a packet consisting of the fixed header and a message ID
+func appendMessageIDPacket(dst []byte, fh *FixedHeader, messageID uint16) ([]byte, error) {
+	fh.RemainingLength = 2
+	dst, err := fh.appendTo(dst)
+	if err != nil {
+		return dst, err
+	}
+	return binary.BigEndian.AppendUint16(dst, messageID), nil
+}
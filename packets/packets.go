@@ -98,15 +98,31 @@ var ConnackReturnCodes = map[uint8]string{
 }
 
 var (
-	ErrorRefusedBadProtocolVersion    = errors.New("unacceptable protocol version")
-	ErrorRefusedIDRejected            = errors.New("identifier rejected")
-	ErrorRefusedServerUnavailable     = errors.New("server Unavailable")
-	ErrorRefusedBadUsernameOrPassword = errors.New("bad user name or password")
-	ErrorRefusedNotAuthorised         = errors.New("not Authorized")
-	ErrorNetworkError                 = errors.New("network Error")
-	ErrorProtocolViolation            = errors.New("protocol Violation")
+	ErrorRefusedBadProtocolVersion    error = &ConnackError{Code: ErrRefusedBadProtocolVersion, msg: "unacceptable protocol version"}
+	ErrorRefusedIDRejected            error = &ConnackError{Code: ErrRefusedIDRejected, msg: "identifier rejected"}
+	ErrorRefusedServerUnavailable     error = &ConnackError{Code: ErrRefusedServerUnavailable, msg: "server Unavailable"}
+	ErrorRefusedBadUsernameOrPassword error = &ConnackError{Code: ErrRefusedBadUsernameOrPassword, msg: "bad user name or password"}
+	ErrorRefusedNotAuthorised         error = &ConnackError{Code: ErrRefusedNotAuthorised, msg: "not Authorized"}
+	ErrorNetworkError                       = errors.New("network Error")
+	ErrorProtocolViolation            error = &ConnackError{Code: ErrProtocolViolation, msg: "protocol Violation"}
 )
 
+// ConnackError is the error for a CONNACK return code other than Accepted. The ErrorRefused... errors (and
+// ErrorProtocolViolation) are ConnackErrors, so an error may be compared with them directly or examined with
+// errors.As.
+type ConnackError struct {
+	Code byte // return code from the CONNACK packet
+	msg  string
+}
+
+// Error returns the description of the return code
+func (e *ConnackError) Error() string {
+	if e.msg != "" {
+		return e.msg
+	}
+	return fmt.Sprintf("connection refused (return code %d)", e.Code)
+}
+
 // ConnErrors is a map of the errors codes constants for Connect()
 // to a Go error
 var ConnErrors = map[byte]error{
@@ -194,6 +210,42 @@ func NewControlPacket(packetType byte) ControlPacket {
 	return nil
 }
 
+// PacketType returns the MQTT control packet type of cp (e.g. Publish), or 0 if cp is not one of the types
+// defined in this package. This avoids the need for reflection when, for example, logging.
+func PacketType(cp ControlPacket) byte {
+	switch cp.(type) {
+	case *ConnectPacket:
+		return Connect
+	case *ConnackPacket:
+		return Connack
+	case *DisconnectPacket:
+		return Disconnect
+	case *PublishPacket:
+		return Publish
+	case *PubackPacket:
+		return Puback
+	case *PubrecPacket:
+		return Pubrec
+	case *PubrelPacket:
+		return Pubrel
+	case *PubcompPacket:
+		return Pubcomp
+	case *SubscribePacket:
+		return Subscribe
+	case *SubackPacket:
+		return Suback
+	case *UnsubscribePacket:
+		return Unsubscribe
+	case *UnsubackPacket:
+		return Unsuback
+	case *PingreqPacket:
+		return Pingreq
+	case *PingrespPacket:
+		return Pingresp
+	}
+	return 0
+}
+
 // NewControlPacketWithHeader is used to create a new ControlPacket of the type
 // specified within the FixedHeader that is passed to the function.
 // The newly created ControlPacket is empty and a pointer is returned.
@@ -264,13 +316,25 @@ func boolToByte(b bool) byte {
 
 func (fh *FixedHeader) pack() (bytes.Buffer, error) {
 	var header bytes.Buffer
-	header.WriteByte(fh.MessageType<<4 | boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain))
+	err := fh.packTo(&header)
+	return header, err
+}
+
+// packTo writes the fixed header to buf
+func (fh *FixedHeader) packTo(buf *bytes.Buffer) error {
+	b, err := fh.appendTo(buf.AvailableBuffer())
+	buf.Write(b)
+	return err
+}
+
+// appendTo appends the fixed header to dst
+func (fh *FixedHeader) appendTo(dst []byte) ([]byte, error) {
 	l, err := encodeLength(fh.RemainingLength)
 	if err != nil {
-		return header, err
+		return dst, err
 	}
-	header.Write(l)
-	return header, nil
+	dst = append(dst, fh.MessageType<<4|boolToByte(fh.Dup)<<3|fh.Qos<<1|boolToByte(fh.Retain))
+	return append(dst, l...), nil
 }
 
 func (fh *FixedHeader) unpack(typeAndFlags byte, r io.Reader) error {
@@ -18,6 +18,10 @@ package packets
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -270,3 +274,303 @@ func TestEncoding(t *testing.T) {
 	}
 
 }
+
+func TestPublishWrite(t *testing.T) {
+	p := NewControlPacket(Publish).(*PublishPacket)
+	p.Qos = 1
+	p.TopicName = "a/b"
+	p.MessageID = 0x1234
+	p.Payload = []byte("hi")
+	expected := []byte{0x32, 0x09, 0x00, 0x03, 'a', '/', 'b', 0x12, 0x34, 'h', 'i'}
+	for i := 0; i < 2; i++ { // second write uses a buffer from the pool
+		buf := new(bytes.Buffer)
+		if err := p.Write(buf); err != nil {
+			t.Fatalf("Write returned error: %s", err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("Write produced [% X], expected [% X]", buf.Bytes(), expected)
+		}
+	}
+}
+
+func BenchmarkPublishWrite(b *testing.B) {
+	p := NewControlPacket(Publish).(*PublishPacket)
+	p.Qos = 1
+	p.TopicName = "benchmark/topic"
+	p.MessageID = 1
+	p.Payload = make([]byte, 256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := p.Write(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// validPackets returns one valid example of each packet type
+func validPackets() []ControlPacket {
+	connect := NewControlPacket(Connect).(*ConnectPacket)
+	connect.ProtocolName, connect.ProtocolVersion, connect.ClientIdentifier = "MQTT", 4, "client"
+	publish := NewControlPacket(Publish).(*PublishPacket)
+	publish.TopicName, publish.Qos, publish.MessageID, publish.Payload = "a/b", 1, 1, []byte("payload")
+	puback := NewControlPacket(Puback).(*PubackPacket)
+	puback.MessageID = 1
+	pubrec := NewControlPacket(Pubrec).(*PubrecPacket)
+	pubrec.MessageID = 1
+	pubrel := NewControlPacket(Pubrel).(*PubrelPacket)
+	pubrel.MessageID = 1
+	pubcomp := NewControlPacket(Pubcomp).(*PubcompPacket)
+	pubcomp.MessageID = 1
+	subscribe := NewControlPacket(Subscribe).(*SubscribePacket)
+	subscribe.MessageID, subscribe.Topics, subscribe.Qoss = 1, []string{"a/+", "b/#"}, []byte{0, 2}
+	suback := NewControlPacket(Suback).(*SubackPacket)
+	suback.MessageID, suback.ReturnCodes = 1, []byte{0, 0x80}
+	unsubscribe := NewControlPacket(Unsubscribe).(*UnsubscribePacket)
+	unsubscribe.MessageID, unsubscribe.Topics = 1, []string{"a/+"}
+	unsuback := NewControlPacket(Unsuback).(*UnsubackPacket)
+	unsuback.MessageID = 1
+	return []ControlPacket{connect, NewControlPacket(Connack), publish, puback, pubrec, pubrel, pubcomp, subscribe,
+		suback, unsubscribe, unsuback, NewControlPacket(Pingreq), NewControlPacket(Pingresp), NewControlPacket(Disconnect)}
+}
+
+func TestReadPacketStrict(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, packet := range validPackets() {
+		buf.Reset()
+		if err := packet.Write(buf); err != nil {
+			t.Fatalf("Write of %T returned error: %s", packet, err)
+		}
+		read, err := ReadPacketStrict(buf)
+		if err != nil {
+			t.Fatalf("ReadPacketStrict of %T returned error: %s", packet, err)
+		}
+		if read.String() != packet.String() {
+			t.Errorf("Read of packed %T did not equal original.\nExpected: %v\n     Got: %v", packet, packet, read)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"reserved flags", []byte{0x41, 0x02, 0x00, 0x01}, ErrInvalidFlags}, // PUBACK with flags
+		{"pubrel flags", []byte{0x60, 0x02, 0x00, 0x01}, ErrInvalidFlags},   // PUBREL must have flags 0010
+		{"publish qos 3", []byte{0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01}, ErrInvalidQos},
+		{"publish dup qos 0", []byte{0x38, 0x03, 0x00, 0x01, 'a'}, ErrInvalidFlags},
+		{"publish wildcard", []byte{0x30, 0x03, 0x00, 0x01, '#'}, ErrInvalidTopic},
+		{"publish utf8", []byte{0x30, 0x03, 0x00, 0x01, 0xff}, ErrInvalidUTF8},
+		{"truncated topic", []byte{0x30, 0x03, 0x00, 0x05, 'a'}, ErrUnexpectedEndOfPacket},
+		{"extra data", []byte{0x40, 0x03, 0x00, 0x01, 0x00}, ErrRemainingLength},
+		{"zero message id", []byte{0x40, 0x02, 0x00, 0x00}, ErrInvalidMessageID},
+		{"connack flags", []byte{0x20, 0x02, 0x02, 0x00}, ErrInvalidFlags},
+		{"subscribe qos", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x03}, ErrInvalidQos},
+		{"subscribe no topics", []byte{0x82, 0x02, 0x00, 0x01}, ErrNoTopics},
+		{"suback return code", []byte{0x90, 0x03, 0x00, 0x01, 0x03}, ErrInvalidReturnCode},
+		{"packet type 0", []byte{0x00, 0x00}, ErrInvalidPacketType},
+		{"too large", []byte{0x30, 0x80, 0x80, 0x80, 0x01}, ErrPacketTooLarge}, // remaining length 2MiB (no data)
+	} {
+		_, err := ReadPacketStrict(bytes.NewReader(tc.data))
+		var mpe *MalformedPacketError
+		if !errors.As(err, &mpe) || !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected MalformedPacketError wrapping %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	puback := []byte{0x40, 0x02, 0x00, 0x01}
+	if _, err := ReadPacketStrictLimit(bytes.NewReader(puback), 1); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("expected ErrPacketTooLarge, got %v", err)
+	}
+	if _, err := ReadPacketStrictLimit(bytes.NewReader(puback), 0); err != nil {
+		t.Errorf("unexpected error with no limit: %v", err)
+	}
+	if _, err := ReadPacketStrict(bytes.NewReader([]byte{0x40, 0x02, 0x00})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF for truncated packet, got %v", err)
+	}
+}
+
+// marshaler is implemented by all of the packet types
+type marshaler interface {
+	ControlPacket
+	Append(dst []byte) ([]byte, error)
+	Marshal() ([]byte, error)
+	Unmarshal(b []byte) error
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	for _, packet := range validPackets() {
+		m := packet.(marshaler)
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal of %T returned error: %s", packet, err)
+		}
+		var buf bytes.Buffer
+		if err := packet.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, buf.Bytes()) {
+			t.Errorf("Marshal of %T differs from Write.\nExpected: %x\n     Got: %x", packet, buf.Bytes(), b)
+		}
+		if appended, err := m.Append([]byte{0xAA}); err != nil || !bytes.Equal(appended, append([]byte{0xAA}, b...)) {
+			t.Errorf("Append of %T returned %x, %v", packet, appended, err)
+		}
+
+		u := NewControlPacket(b[0] >> 4).(marshaler)
+		if err := u.Unmarshal(b); err != nil {
+			t.Fatalf("Unmarshal of %T returned error: %s", packet, err)
+		}
+		if u.String() != packet.String() {
+			t.Errorf("Unmarshal of %T did not equal original.\nExpected: %v\n     Got: %v", packet, packet, u)
+		}
+		if err := u.Unmarshal(append(b, 0)); err == nil {
+			t.Errorf("Unmarshal of %T with trailing data should fail", packet)
+		}
+		if cp, err := Unmarshal(b); err != nil || cp.String() != packet.String() {
+			t.Errorf("Unmarshal(%x) returned %v, %v", b, cp, err)
+		}
+	}
+	if err := new(PubackPacket).Unmarshal([]byte{0x50, 0x02, 0x00, 0x01}); err == nil {
+		t.Errorf("Unmarshal of PUBREC into PubackPacket should fail")
+	}
+}
+
+func FuzzReadPacketStrict(f *testing.F) {
+	buf := new(bytes.Buffer)
+	for _, packet := range validPackets() {
+		buf.Reset()
+		if err := packet.Write(buf); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(append([]byte(nil), buf.Bytes()...))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cp, err := ReadPacketStrict(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// Anything accepted must be valid and survive a round trip
+		var out bytes.Buffer
+		if err := cp.Write(&out); err != nil {
+			t.Fatalf("accepted %T could not be written: %v", cp, err)
+		}
+		if _, err := ReadPacketStrict(&out); err != nil {
+			t.Fatalf("accepted %T failed on re-read: %v", cp, err)
+		}
+	})
+}
+
+func TestDump(t *testing.T) {
+	for _, packet := range validPackets() {
+		d := Dump(packet)
+		if !json.Valid([]byte(d)) {
+			t.Errorf("Dump of %T is not valid JSON: %s", packet, d)
+		}
+		if !strings.Contains(d, `"type": "`+packetName(packet)+`"`) {
+			t.Errorf("Dump of %T does not include packet type: %s", packet, d)
+		}
+	}
+
+	p := NewControlPacket(Publish).(*PublishPacket)
+	p.TopicName, p.Payload = "a/b", bytes.Repeat([]byte{0xAB}, 100)
+	var got struct {
+		TopicName string `json:"topicName"`
+		Payload   struct {
+			Length    int    `json:"length"`
+			Hex       string `json:"hex"`
+			Truncated bool   `json:"truncated"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(Dump(p)), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.TopicName != "a/b" || got.Payload.Length != 100 || !got.Payload.Truncated || got.Payload.Hex != strings.Repeat("ab", dumpPayloadPreview) {
+		t.Errorf("unexpected publish dump %+v", got)
+	}
+
+	c := NewControlPacket(Connect).(*ConnectPacket)
+	c.Password = []byte("secret")
+	if d := Dump(c); strings.Contains(d, "secret") || !strings.Contains(d, "[redacted]") {
+		t.Errorf("password not redacted: %s", d)
+	}
+}
+
+// packetName returns the name of the packet type of cp
+func packetName(cp ControlPacket) string {
+	b, _ := cp.(marshaler).Marshal()
+	return PacketNames[b[0]>>4]
+}
+
+func TestReadPacketLimit(t *testing.T) {
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID = "a/b", 1, 7
+	pub.Payload = bytes.Repeat([]byte{'x'}, 100)
+	small := NewControlPacket(Publish).(*PublishPacket)
+	small.TopicName, small.Payload = "c", []byte("ok")
+	sub := NewControlPacket(Subscribe).(*SubscribePacket)
+	sub.MessageID, sub.Topics, sub.Qoss = 1, []string{strings.Repeat("t", 50)}, []byte{0}
+
+	var buf bytes.Buffer
+	for _, cp := range []ControlPacket{pub, small, sub} {
+		if err := cp.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := ReadPacketLimit(&buf, 10)
+	var tooLarge *PayloadTooLargeError
+	if !errors.As(err, &tooLarge) || !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected PayloadTooLargeError, got %v", err)
+	}
+	if tooLarge.Size != 100 || tooLarge.Limit != 10 || tooLarge.Packet.TopicName != "a/b" || tooLarge.Packet.MessageID != 7 || tooLarge.Packet.Payload != nil {
+		t.Errorf("unexpected error contents %+v (packet %+v)", tooLarge, tooLarge.Packet)
+	}
+	cp, err := ReadPacketLimit(&buf, 10) // the oversize payload must have been skipped
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := cp.(*PublishPacket); !ok || p.TopicName != "c" || string(p.Payload) != "ok" {
+		t.Errorf("unexpected packet %v", cp)
+	}
+	if _, err := ReadPacketLimit(&buf, 10); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("expected ErrPacketTooLarge, got %v", err)
+	}
+}
+
+func TestReadPacketStream(t *testing.T) {
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID = "fw", 1, 3
+	pub.Payload = bytes.Repeat([]byte{'x'}, 100)
+	var buf bytes.Buffer
+	if err := pub.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	cp, payload, err := ReadPacketStream(&buf, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := cp.(*PublishPacket); p.TopicName != "fw" || p.MessageID != 3 || p.Payload != nil {
+		t.Errorf("unexpected packet %v", cp)
+	}
+	if payload == nil || payload.N != 100 {
+		t.Fatalf("expected payload reader for 100 bytes")
+	}
+	if data, _ := io.ReadAll(payload); !bytes.Equal(data, pub.Payload) || buf.Len() != 0 {
+		t.Errorf("unexpected payload (%d bytes, %d remaining)", len(data), buf.Len())
+	}
+}
+
+func TestDisconnectReasonCode(t *testing.T) {
+	cp, err := ReadPacket(bytes.NewReader([]byte{0xE0, 0x00}))
+	if err != nil || cp.(*DisconnectPacket).ReasonCode != 0 {
+		t.Fatalf("unexpected result reading v3 DISCONNECT: %v, %v", cp, err)
+	}
+	// MQTT v5 DISCONNECT with reason code 0x8E (session taken over) and an empty property list
+	cp, err = ReadPacket(bytes.NewReader([]byte{0xE0, 0x02, 0x8E, 0x00}))
+	if err != nil || cp.(*DisconnectPacket).ReasonCode != 0x8E {
+		t.Fatalf("unexpected result reading v5 DISCONNECT: %v, %v", cp, err)
+	}
+	var buf bytes.Buffer
+	if err := cp.Write(&buf); err != nil || !bytes.Equal(buf.Bytes(), []byte{0xE0, 0x00}) {
+		t.Fatalf("reason code should not be written, got %x (%v)", buf.Bytes(), err)
+	}
+}
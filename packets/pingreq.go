@@ -51,3 +51,20 @@ func (pr *PingreqPacket) Unpack(b io.Reader) error {
 func (pr *PingreqPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (pr *PingreqPacket) Append(dst []byte) ([]byte, error) {
+	pr.FixedHeader.RemainingLength = 0
+	return pr.FixedHeader.appendTo(dst)
+}
+
+// Marshal returns the encoded packet
+func (pr *PingreqPacket) Marshal() ([]byte, error) {
+	return pr.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete PINGREQ packet
+func (pr *PingreqPacket) Unmarshal(b []byte) error {
+	*pr = PingreqPacket{FixedHeader: FixedHeader{MessageType: Pingreq}}
+	return unmarshal(b, pr, &pr.FixedHeader)
+}
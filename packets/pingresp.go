@@ -51,3 +51,20 @@ func (pr *PingrespPacket) Unpack(b io.Reader) error {
 func (pr *PingrespPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (pr *PingrespPacket) Append(dst []byte) ([]byte, error) {
+	pr.FixedHeader.RemainingLength = 0
+	return pr.FixedHeader.appendTo(dst)
+}
+
+// Marshal returns the encoded packet
+func (pr *PingrespPacket) Marshal() ([]byte, error) {
+	return pr.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete PINGRESP packet
+func (pr *PingrespPacket) Unmarshal(b []byte) error {
+	*pr = PingrespPacket{FixedHeader: FixedHeader{MessageType: Pingresp}}
+	return unmarshal(b, pr, &pr.FixedHeader)
+}
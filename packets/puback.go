@@ -59,3 +59,19 @@ func (pa *PubackPacket) Unpack(b io.Reader) error {
 func (pa *PubackPacket) Details() Details {
 	return Details{Qos: pa.Qos, MessageID: pa.MessageID}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (pa *PubackPacket) Append(dst []byte) ([]byte, error) {
+	return appendMessageIDPacket(dst, &pa.FixedHeader, pa.MessageID)
+}
+
+// Marshal returns the encoded packet
+func (pa *PubackPacket) Marshal() ([]byte, error) {
+	return pa.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete PUBACK packet
+func (pa *PubackPacket) Unmarshal(b []byte) error {
+	*pa = PubackPacket{FixedHeader: FixedHeader{MessageType: Puback}}
+	return unmarshal(b, pa, &pa.FixedHeader)
+}
@@ -59,3 +59,19 @@ func (pc *PubcompPacket) Unpack(b io.Reader) error {
 func (pc *PubcompPacket) Details() Details {
 	return Details{Qos: pc.Qos, MessageID: pc.MessageID}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (pc *PubcompPacket) Append(dst []byte) ([]byte, error) {
+	return appendMessageIDPacket(dst, &pc.FixedHeader, pc.MessageID)
+}
+
+// Marshal returns the encoded packet
+func (pc *PubcompPacket) Marshal() ([]byte, error) {
+	return pc.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete PUBCOMP packet
+func (pc *PubcompPacket) Unmarshal(b []byte) error {
+	*pc = PubcompPacket{FixedHeader: FixedHeader{MessageType: Pubcomp}}
+	return unmarshal(b, pc, &pc.FixedHeader)
+}
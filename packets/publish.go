@@ -17,9 +17,11 @@
 package packets
 
 import (
-	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"slices"
+	"sync"
 )
 
 // PublishPacket is an internal representation of the fields of the
@@ -35,24 +37,48 @@ func (p *PublishPacket) String() string {
 	return fmt.Sprintf("%s topicName: %s MessageID: %d payload: %s", p.FixedHeader, p.TopicName, p.MessageID, string(p.Payload))
 }
 
+// publishBufferPool holds the buffers used to encode PUBLISH packets; this avoids allocating a new
+// buffer for every message sent.
+var publishBufferPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// maxPooledBufferSize is the largest buffer that will be returned to publishBufferPool (to avoid
+// an occasional large message resulting in a lot of memory being held)
+const maxPooledBufferSize = 64 * 1024
+
 func (p *PublishPacket) Write(w io.Writer) error {
-	var body bytes.Buffer
-	var err error
+	buf := publishBufferPool.Get().(*[]byte)
+	packet, err := p.Append((*buf)[:0])
+	if err == nil {
+		_, err = w.Write(packet)
+	}
+	if cap(packet) <= maxPooledBufferSize {
+		*buf = packet
+		publishBufferPool.Put(buf)
+	}
+	return err
+}
 
-	body.Write(encodeString(p.TopicName))
+// Append appends the encoded packet to dst and returns the extended slice
+func (p *PublishPacket) Append(dst []byte) ([]byte, error) {
+	topic := p.TopicName
+	if len(topic) > 65535 { // truncated for consistency with encodeString
+		topic = topic[:65535]
+	}
+	p.FixedHeader.RemainingLength = 2 + len(topic) + len(p.Payload)
 	if p.Qos > 0 {
-		body.Write(encodeUint16(p.MessageID))
+		p.FixedHeader.RemainingLength += 2
 	}
-	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
-	packet, err := p.FixedHeader.pack()
+	dst, err := p.FixedHeader.appendTo(dst)
 	if err != nil {
-		return err
+		return dst, err
 	}
-	packet.Write(body.Bytes())
-	packet.Write(p.Payload)
-	_, err = w.Write(packet.Bytes())
-
-	return err
+	dst = slices.Grow(dst, p.FixedHeader.RemainingLength)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(topic)))
+	dst = append(dst, topic...)
+	if p.Qos > 0 {
+		dst = binary.BigEndian.AppendUint16(dst, p.MessageID)
+	}
+	return append(dst, p.Payload...), nil
 }
 
 // Unpack decodes the details of a ControlPacket after the fixed
@@ -100,3 +126,14 @@ func (p *PublishPacket) Copy() *PublishPacket {
 func (p *PublishPacket) Details() Details {
 	return Details{Qos: p.Qos, MessageID: p.MessageID}
 }
+
+// Marshal returns the encoded packet
+func (p *PublishPacket) Marshal() ([]byte, error) {
+	return p.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete PUBLISH packet
+func (p *PublishPacket) Unmarshal(b []byte) error {
+	*p = PublishPacket{FixedHeader: FixedHeader{MessageType: Publish}}
+	return unmarshal(b, p, &p.FixedHeader)
+}
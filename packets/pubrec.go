@@ -59,3 +59,19 @@ func (pr *PubrecPacket) Unpack(b io.Reader) error {
 func (pr *PubrecPacket) Details() Details {
 	return Details{Qos: pr.Qos, MessageID: pr.MessageID}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (pr *PubrecPacket) Append(dst []byte) ([]byte, error) {
+	return appendMessageIDPacket(dst, &pr.FixedHeader, pr.MessageID)
+}
+
+// Marshal returns the encoded packet
+func (pr *PubrecPacket) Marshal() ([]byte, error) {
+	return pr.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete PUBREC packet
+func (pr *PubrecPacket) Unmarshal(b []byte) error {
+	*pr = PubrecPacket{FixedHeader: FixedHeader{MessageType: Pubrec}}
+	return unmarshal(b, pr, &pr.FixedHeader)
+}
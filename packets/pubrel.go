@@ -59,3 +59,19 @@ func (pr *PubrelPacket) Unpack(b io.Reader) error {
 func (pr *PubrelPacket) Details() Details {
 	return Details{Qos: pr.Qos, MessageID: pr.MessageID}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (pr *PubrelPacket) Append(dst []byte) ([]byte, error) {
+	return appendMessageIDPacket(dst, &pr.FixedHeader, pr.MessageID)
+}
+
+// Marshal returns the encoded packet
+func (pr *PubrelPacket) Marshal() ([]byte, error) {
+	return pr.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete PUBREL packet
+func (pr *PubrelPacket) Unmarshal(b []byte) error {
+	*pr = PubrelPacket{FixedHeader: FixedHeader{MessageType: Pubrel}}
+	return unmarshal(b, pr, &pr.FixedHeader)
+}
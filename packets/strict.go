@@ -0,0 +1,302 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Errors wrapped by MalformedPacketError when a packet fails strict validation
+var (
+	ErrInvalidFlags          = errors.New("invalid flags")
+	ErrInvalidQos            = errors.New("invalid QoS")
+	ErrInvalidUTF8           = errors.New("invalid UTF-8 string")
+	ErrInvalidTopic          = errors.New("invalid topic")
+	ErrInvalidMessageID      = errors.New("packet identifier must be non-zero")
+	ErrInvalidProtocol       = errors.New("invalid protocol name or version")
+	ErrInvalidReturnCode     = errors.New("invalid return code")
+	ErrNoTopics              = errors.New("at least one topic is required")
+	ErrRemainingLength       = errors.New("remaining length does not match packet contents")
+	ErrInvalidPacketType     = errors.New("invalid packet type")
+	ErrPasswordWithoutUser   = errors.New("password flag set without username flag")
+	ErrUnexpectedEndOfPacket = errors.New("unexpected end of packet")
+)
+
+// MalformedPacketError is returned by ReadPacketStrict and Validate when a packet does not comply with the
+// MQTT v3.1.1 specification. Err will be one of the Err* errors above (use errors.Is to check).
+type MalformedPacketError struct {
+	PacketType byte
+	Err        error
+}
+
+func (e *MalformedPacketError) Error() string {
+	name, ok := PacketNames[e.PacketType]
+	if !ok {
+		name = fmt.Sprintf("type %d", e.PacketType)
+	}
+	return fmt.Sprintf("malformed %s packet: %s", name, e.Err)
+}
+
+func (e *MalformedPacketError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultStrictMaxPacketSize is the largest remaining length accepted by ReadPacketStrict
+const DefaultStrictMaxPacketSize = 1 << 20
+
+// ReadPacketStrict reads a packet as per ReadPacket but validates it against the specification (see Validate);
+// additionally the fixed header flags and remaining length are checked (ReadPacket ignores extra data and may
+// accept truncated fields). This should be used when reading packets from untrusted peers. Packets with a
+// remaining length greater than DefaultStrictMaxPacketSize are rejected (see ReadPacketStrictLimit).
+func ReadPacketStrict(r io.Reader) (ControlPacket, error) {
+	return ReadPacketStrictLimit(r, DefaultStrictMaxPacketSize)
+}
+
+// ReadPacketStrictLimit is as per ReadPacketStrict but rejects packets with a remaining length greater than
+// maxPacketSize bytes (<= 0 means no limit other than that imposed by the specification) with a
+// *MalformedPacketError wrapping ErrPacketTooLarge. The check is made before the packet body is read, so the
+// connection should be closed following this error.
+func ReadPacketStrictLimit(r io.Reader, maxPacketSize int) (ControlPacket, error) {
+	var fh FixedHeader
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if err := fh.unpack(b[0], r); err != nil {
+		return nil, err
+	}
+	if err := validateFlags(b[0]); err != nil {
+		return nil, err
+	}
+	cp, err := NewControlPacketWithHeader(fh)
+	if err != nil {
+		return nil, &MalformedPacketError{PacketType: fh.MessageType, Err: ErrInvalidPacketType}
+	}
+	if maxPacketSize > 0 && fh.RemainingLength > maxPacketSize {
+		return nil, &MalformedPacketError{PacketType: fh.MessageType, Err: ErrPacketTooLarge}
+	}
+
+	// The buffer grows as data arrives (rather than trusting the remaining length) so a peer cannot force a large
+	// allocation without sending the data
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(fh.RemainingLength)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	packetBytes := buf.Bytes()
+	if fh.MessageType == Connack && len(packetBytes) > 0 && packetBytes[0]&0xFE != 0 { // reserved acknowledge flags
+		return nil, &MalformedPacketError{PacketType: Connack, Err: ErrInvalidFlags}
+	}
+	sr := &strictReader{r: bytes.NewReader(packetBytes)}
+	var body io.Reader = sr
+	if fh.MessageType == Suback {
+		body = sr.r // SUBACK reads until the end of the data (a truncated packet is caught by Validate)
+	}
+	if err := cp.Unpack(body); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			err = ErrUnexpectedEndOfPacket
+		}
+		return nil, &MalformedPacketError{PacketType: fh.MessageType, Err: err}
+	}
+	if sr.r.Len() != 0 {
+		return nil, &MalformedPacketError{PacketType: fh.MessageType, Err: ErrRemainingLength}
+	}
+	if err := Validate(cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// strictReader returns io.ErrUnexpectedEOF if a Read cannot be fully satisfied (Unpack assumes that reads will
+// be satisfied in full so would otherwise accept truncated fields)
+type strictReader struct {
+	r *bytes.Reader
+}
+
+func (s *strictReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return io.ReadFull(s.r, p)
+}
+
+// validateFlags checks the flags in the first byte of the fixed header [MQTT-2.2.2-1] [MQTT-2.2.2-2]
+func validateFlags(typeAndFlags byte) error {
+	packetType, flags := typeAndFlags>>4, typeAndFlags&0x0F
+	switch packetType {
+	case Publish:
+		qos := (flags >> 1) & 0x03
+		if qos > 2 {
+			return &MalformedPacketError{PacketType: packetType, Err: ErrInvalidQos}
+		}
+		if qos == 0 && flags&0x08 != 0 { // DUP must be 0 for QoS 0 [MQTT-3.3.1-2]
+			return &MalformedPacketError{PacketType: packetType, Err: ErrInvalidFlags}
+		}
+	case Pubrel, Subscribe, Unsubscribe:
+		if flags != 0x02 {
+			return &MalformedPacketError{PacketType: packetType, Err: ErrInvalidFlags}
+		}
+	default:
+		if flags != 0 {
+			return &MalformedPacketError{PacketType: packetType, Err: ErrInvalidFlags}
+		}
+	}
+	return nil
+}
+
+// Validate checks that the contents of cp comply with the MQTT v3.1.1 specification, returning a
+// *MalformedPacketError if not. This can be used on packets received (ReadPacketStrict calls it) or
+// prior to sending a packet.
+func Validate(cp ControlPacket) error {
+	var err error
+	var packetType byte
+	switch p := cp.(type) {
+	case *ConnectPacket:
+		packetType, err = Connect, validateConnect(p)
+	case *ConnackPacket:
+		packetType = Connack
+		if p.ReturnCode > ErrRefusedNotAuthorised {
+			err = ErrInvalidReturnCode
+		}
+	case *PublishPacket:
+		packetType = Publish
+		switch {
+		case p.Qos > 2:
+			err = ErrInvalidQos
+		case p.Qos > 0 && p.MessageID == 0:
+			err = ErrInvalidMessageID
+		case p.Qos == 0 && p.Dup:
+			err = ErrInvalidFlags
+		case !validString(p.TopicName):
+			err = ErrInvalidUTF8
+		case len(p.TopicName) == 0 || strings.ContainsAny(p.TopicName, "+#"):
+			err = ErrInvalidTopic
+		}
+	case *PubackPacket:
+		packetType, err = Puback, validateMessageID(p.MessageID)
+	case *PubrecPacket:
+		packetType, err = Pubrec, validateMessageID(p.MessageID)
+	case *PubrelPacket:
+		packetType, err = Pubrel, validateMessageID(p.MessageID)
+	case *PubcompPacket:
+		packetType, err = Pubcomp, validateMessageID(p.MessageID)
+	case *SubscribePacket:
+		packetType, err = Subscribe, validateSubscribe(p)
+	case *SubackPacket:
+		packetType = Suback
+		if err = validateMessageID(p.MessageID); err == nil {
+			if len(p.ReturnCodes) == 0 {
+				err = ErrNoTopics
+			}
+			for _, rc := range p.ReturnCodes {
+				if rc > 2 && rc != 0x80 {
+					err = ErrInvalidReturnCode
+				}
+			}
+		}
+	case *UnsubscribePacket:
+		packetType = Unsubscribe
+		if err = validateMessageID(p.MessageID); err == nil {
+			err = validateTopics(p.Topics)
+		}
+	case *UnsubackPacket:
+		packetType, err = Unsuback, validateMessageID(p.MessageID)
+	case *PingreqPacket, *PingrespPacket, *DisconnectPacket:
+	default:
+		return &MalformedPacketError{Err: ErrInvalidPacketType}
+	}
+	if err != nil {
+		return &MalformedPacketError{PacketType: packetType, Err: err}
+	}
+	return nil
+}
+
+func validateConnect(c *ConnectPacket) error {
+	switch {
+	case !(c.ProtocolName == "MQTT" && (c.ProtocolVersion == 4 || c.ProtocolVersion == 0x84)) &&
+		!(c.ProtocolName == "MQIsdp" && (c.ProtocolVersion == 3 || c.ProtocolVersion == 0x83)):
+		return ErrInvalidProtocol
+	case c.ReservedBit != 0: // [MQTT-3.1.2-3]
+		return ErrInvalidFlags
+	case c.WillQos > 2:
+		return ErrInvalidQos
+	case !c.WillFlag && (c.WillQos != 0 || c.WillRetain): // [MQTT-3.1.2-13] [MQTT-3.1.2-15]
+		return ErrInvalidFlags
+	case c.PasswordFlag && !c.UsernameFlag: // [MQTT-3.1.2-22]
+		return ErrPasswordWithoutUser
+	case !validString(c.ProtocolName) || !validString(c.ClientIdentifier) || !validString(c.WillTopic) || !validString(c.Username):
+		return ErrInvalidUTF8
+	case c.WillFlag && (len(c.WillTopic) == 0 || strings.ContainsAny(c.WillTopic, "+#")):
+		return ErrInvalidTopic
+	}
+	return nil
+}
+
+func validateSubscribe(s *SubscribePacket) error {
+	if err := validateMessageID(s.MessageID); err != nil {
+		return err
+	}
+	if err := validateTopics(s.Topics); err != nil {
+		return err
+	}
+	for _, qos := range s.Qoss {
+		if qos > 2 { // also catches the reserved bits being set [MQTT-3.8.3-4]
+			return ErrInvalidQos
+		}
+	}
+	return nil
+}
+
+// validateTopics checks the topic filters in a SUBSCRIBE or UNSUBSCRIBE packet
+func validateTopics(topics []string) error {
+	if len(topics) == 0 {
+		return ErrNoTopics
+	}
+	for _, t := range topics {
+		if !validString(t) {
+			return ErrInvalidUTF8
+		}
+		if len(t) == 0 {
+			return ErrInvalidTopic
+		}
+		levels := strings.Split(t, "/")
+		for i, level := range levels {
+			if strings.ContainsAny(level, "+#") && len(level) > 1 || level == "#" && i != len(levels)-1 {
+				return ErrInvalidTopic
+			}
+		}
+	}
+	return nil
+}
+
+func validateMessageID(id uint16) error {
+	if id == 0 {
+		return ErrInvalidMessageID
+	}
+	return nil
+}
+
+// validString returns true if s is valid UTF-8 and does not contain U+0000 [MQTT-1.5.3-1] [MQTT-1.5.3-2]
+func validString(s string) bool {
+	return utf8.ValidString(s) && !strings.ContainsRune(s, 0)
+}
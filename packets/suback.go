@@ -74,3 +74,19 @@ func (sa *SubackPacket) Unpack(b io.Reader) error {
 func (sa *SubackPacket) Details() Details {
 	return Details{Qos: 0, MessageID: sa.MessageID}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (sa *SubackPacket) Append(dst []byte) ([]byte, error) {
+	return appendWritten(dst, sa)
+}
+
+// Marshal returns the encoded packet
+func (sa *SubackPacket) Marshal() ([]byte, error) {
+	return sa.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete SUBACK packet
+func (sa *SubackPacket) Unmarshal(b []byte) error {
+	*sa = SubackPacket{FixedHeader: FixedHeader{MessageType: Suback}}
+	return unmarshal(b, sa, &sa.FixedHeader)
+}
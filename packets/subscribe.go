@@ -86,3 +86,19 @@ func (s *SubscribePacket) Unpack(b io.Reader) error {
 func (s *SubscribePacket) Details() Details {
 	return Details{Qos: 1, MessageID: s.MessageID}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (s *SubscribePacket) Append(dst []byte) ([]byte, error) {
+	return appendWritten(dst, s)
+}
+
+// Marshal returns the encoded packet
+func (s *SubscribePacket) Marshal() ([]byte, error) {
+	return s.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete SUBSCRIBE packet
+func (s *SubscribePacket) Unmarshal(b []byte) error {
+	*s = SubscribePacket{FixedHeader: FixedHeader{MessageType: Subscribe}}
+	return unmarshal(b, s, &s.FixedHeader)
+}
@@ -59,3 +59,19 @@ func (ua *UnsubackPacket) Unpack(b io.Reader) error {
 func (ua *UnsubackPacket) Details() Details {
 	return Details{Qos: 0, MessageID: ua.MessageID}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (ua *UnsubackPacket) Append(dst []byte) ([]byte, error) {
+	return appendMessageIDPacket(dst, &ua.FixedHeader, ua.MessageID)
+}
+
+// Marshal returns the encoded packet
+func (ua *UnsubackPacket) Marshal() ([]byte, error) {
+	return ua.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete UNSUBACK packet
+func (ua *UnsubackPacket) Unmarshal(b []byte) error {
+	*ua = UnsubackPacket{FixedHeader: FixedHeader{MessageType: Unsuback}}
+	return unmarshal(b, ua, &ua.FixedHeader)
+}
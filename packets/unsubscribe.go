@@ -73,3 +73,19 @@ func (u *UnsubscribePacket) Unpack(b io.Reader) error {
 func (u *UnsubscribePacket) Details() Details {
 	return Details{Qos: 1, MessageID: u.MessageID}
 }
+
+// Append appends the encoded packet to dst and returns the extended slice
+func (u *UnsubscribePacket) Append(dst []byte) ([]byte, error) {
+	return appendWritten(dst, u)
+}
+
+// Marshal returns the encoded packet
+func (u *UnsubscribePacket) Marshal() ([]byte, error) {
+	return u.Append(nil)
+}
+
+// Unmarshal decodes b, which must contain exactly one complete UNSUBSCRIBE packet
+func (u *UnsubscribePacket) Unmarshal(b []byte) error {
+	*u = UnsubscribePacket{FixedHeader: FixedHeader{MessageType: Unsubscribe}}
+	return unmarshal(b, u, &u.FixedHeader)
+}
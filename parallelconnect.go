@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"net"
+	"net/url"
+	"time"
+)
+
+// dialResult is the outcome of dialing a broker as part of a brokerRace
+type dialResult struct {
+	broker   *url.URL
+	conn     net.Conn
+	deadline time.Time // time by which the MQTT handshake must be complete
+	err      error
+}
+
+// brokerRace dials a number of brokers concurrently (see SetParallelConnect); the results are made available in the
+// order in which the dials complete.
+type brokerRace struct {
+	results chan *dialResult
+	pending int // results not yet taken
+}
+
+// raceBrokers starts dialing each of brokers concurrently
+func (c *client) raceBrokers(brokers []*url.URL, attempt int, deadline time.Time) *brokerRace {
+	r := &brokerRace{results: make(chan *dialResult, len(brokers)), pending: len(brokers)}
+	for _, broker := range brokers {
+		go func(broker *url.URL) {
+			conn, connDeadline, err := c.dialBroker(broker, attempt, deadline)
+			r.results <- &dialResult{broker: broker, conn: conn, deadline: connDeadline, err: err}
+		}(broker)
+	}
+	return r
+}
+
+// next blocks until another dial completes and returns its result
+func (r *brokerRace) next() *dialResult {
+	r.pending--
+	return <-r.results
+}
+
+// close closes the connections established by dials whose results have not been taken (including those that
+// are yet to complete); it does not block.
+func (r *brokerRace) close() {
+	pending := r.pending
+	r.pending = 0
+	if pending == 0 {
+		return
+	}
+	go func() {
+		for ; pending > 0; pending-- {
+			if res := <-r.results; res.conn != nil {
+				_ = res.conn.Close()
+			}
+		}
+	}()
+}
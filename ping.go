@@ -19,7 +19,8 @@
 package mqtt
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"sync/atomic"
@@ -28,52 +29,184 @@ import (
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
+// ConnectionHealth provides a cheap indication of the health of the connection to the broker (suitable for
+// use in health check endpoints). Times are only tracked when KeepAlive is non-zero.
+type ConnectionHealth struct {
+	Connected        bool          // true if the connection is currently up
+	LastPingRTT      time.Duration // round trip time of the most recent PINGREQ/PINGRESP (0 if none has completed)
+	SinceLastReceive time.Duration // time since a packet was last received from the broker
+	OutstandingPings int           // number of PINGREQ packets awaiting a response (0 or 1)
+	Inflight         int           // number of QoS 1/2 publishes awaiting acknowledgement (only tracked if MaxInflight is set)
+	MaxInflight      int           // the limit set with ClientOptions.SetMaxInflight (0 = no limit)
+	FreeMessageIDs   int           // number of message IDs not currently in use (see ErrMessageIDsExhausted)
+	KeepAlive        time.Duration // the keepalive interval in use (0 = disabled; see ClientOptions.SetServerKeepAlive)
+}
+
+// ConnectionHealth returns a snapshot of the health of the connection
+func (c *client) ConnectionHealth() ConnectionHealth {
+	h := ConnectionHealth{
+		Connected:        c.IsConnectionOpen(),
+		LastPingRTT:      time.Duration(c.pingRTT.Load()),
+		OutstandingPings: int(atomic.LoadInt32(&c.pingOutstanding)),
+		Inflight:         c.inflight.inUse(),
+		MaxInflight:      c.options.MaxInflight,
+		FreeMessageIDs:   c.messageIds.freeIDs(),
+		KeepAlive:        c.keepAliveInterval(),
+	}
+	if lastReceived, ok := c.lastReceived.Load().(time.Time); ok {
+		h.SinceLastReceive = c.clock.Now().Sub(lastReceived)
+	}
+	return h
+}
+
+// keepAliveInterval returns the keepalive interval in use (ServerKeepAlive, if set and shorter than KeepAlive,
+// overrides KeepAlive); 0 means that keepalive is disabled (the keepalive goroutine is not started)
+func (c *client) keepAliveInterval() time.Duration {
+	keepAlive := time.Duration(c.options.KeepAlive) * time.Second
+	if c.options.ServerKeepAlive > 0 && (keepAlive == 0 || c.options.ServerKeepAlive < keepAlive) {
+		return c.options.ServerKeepAlive
+	}
+	return keepAlive
+}
+
+// Ping sends a PINGREQ to the broker and waits for the PINGRESP. A PINGRESP received in response to a ping
+// sent by the keepalive routine also satisfies the request. The round trip time is recorded as per keepalive
+// pings (see ConnectionHealth).
+func (c *client) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.connMu.Lock()
+	connected, stop := c.conn != nil, c.stop
+	c.connMu.Unlock()
+	if !connected || !c.IsConnectionOpen() {
+		return ErrNotConnected
+	}
+	resp := make(chan struct{})
+	c.pingMu.Lock()
+	c.pingWaiters = append(c.pingWaiters, resp)
+	c.pingMu.Unlock()
+
+	if atomic.CompareAndSwapInt32(&c.pingOutstanding, 0, 1) { // otherwise keep the time the outstanding ping was sent
+		c.pingSent.Store(c.clock.Now())
+	}
+	select {
+	case c.oboundP <- &PacketAndToken{p: packets.NewControlPacket(packets.Pingreq), t: nil}:
+	case <-stop:
+		c.removePingWaiter(resp)
+		return fmt.Errorf("%w before ping was sent", ErrConnectionLost)
+	case <-ctx.Done():
+		c.removePingWaiter(resp)
+		return ctx.Err()
+	}
+	select {
+	case <-resp:
+		return nil
+	case <-stop:
+		c.removePingWaiter(resp)
+		return fmt.Errorf("%w before pingresp was received", ErrConnectionLost)
+	case <-ctx.Done():
+		c.removePingWaiter(resp)
+		return ctx.Err()
+	}
+}
+
+// removePingWaiter removes resp (added by a call to Ping that has given up) from the ping waiters
+func (c *client) removePingWaiter(resp chan struct{}) {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	for i, w := range c.pingWaiters {
+		if w == resp {
+			c.pingWaiters = append(c.pingWaiters[:i], c.pingWaiters[i+1:]...)
+			return
+		}
+	}
+}
+
 // keepalive - Send ping when connection unused for set period
 // connection passed in to avoid race condition on shutdown
+// Rather than polling, a timer is set for the time at which the next ping is due (or the pingresp must have
+// been received by). All times are monotonic (time.Now() readings, when using clock.Real) so are unaffected by
+// changes to the wall clock.
 func keepalive(c *client, conn io.Writer) {
 	defer c.workers.Done()
 	c.logger.Debug("keepalive starting", slog.String("component", string(PNG)))
-	var checkInterval time.Duration
+	keepAlive := c.keepAliveInterval()
+	interval := keepAlive
 	var pingSent time.Time
+	var srtt time.Duration // smoothed ping round trip time (only used if AdaptiveKeepAlive)
 
-	if c.options.KeepAlive > 10 {
-		checkInterval = 5 * time.Second
-	} else {
-		checkInterval = time.Duration(c.options.KeepAlive) * time.Second / 4
-	}
-
-	intervalTicker := time.NewTicker(checkInterval)
-	defer intervalTicker.Stop()
+	timer := c.clock.NewTimer(interval)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-c.stop:
 			c.logger.Debug("keepalive stopped", slog.String("component", string(PNG)))
 			return
-		case <-intervalTicker.C:
-			lastSent := c.lastSent.Load().(time.Time)
-			lastReceived := c.lastReceived.Load().(time.Time)
-
-			c.logger.Debug("ping check", slog.Float64("secondsSinceLastSent", time.Since(lastSent).Seconds()), slog.String("component", string(PNG)))
-			if time.Since(lastSent) >= time.Duration(c.options.KeepAlive*int64(time.Second)) || time.Since(lastReceived) >= time.Duration(c.options.KeepAlive*int64(time.Second)) {
-				if atomic.LoadInt32(&c.pingOutstanding) == 0 {
-					c.logger.Debug("keepalive sending ping", slog.String("component", string(PNG)))
-					ping := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
-					// We don't want to wait behind large messages being sent, the `Write` call
-					// will block until it is able to send the packet.
-					atomic.StoreInt32(&c.pingOutstanding, 1)
-					if err := ping.Write(conn); err != nil {
-						c.logger.Error(err.Error(), slog.String("component", string(PNG)))
-					}
-					c.lastSent.Store(time.Now())
-					pingSent = time.Now()
+		case <-timer.C():
+		}
+		now := c.clock.Now()
+		if !pingSent.IsZero() { // awaiting pingresp
+			if atomic.LoadInt32(&c.pingOutstanding) > 0 {
+				if now.Sub(pingSent) >= c.options.PingTimeout {
+					c.logger.Warn("pingresp not received, disconnecting", slog.String("component", string(PNG)))
+					c.internalConnLost(fmt.Errorf("pingresp not received (%w), disconnecting", ErrTimeout)) // no harm in calling this if the connection is already down (or shutdown is in progress)
+					return
 				}
+				timer.Reset(pingSent.Add(c.options.PingTimeout).Sub(now))
+				continue
 			}
-			if atomic.LoadInt32(&c.pingOutstanding) > 0 && time.Since(pingSent) >= c.options.PingTimeout {
-				c.logger.Warn("pingresp not received, disconnecting", slog.String("component", string(PNG)))
-				c.internalConnLost(errors.New("pingresp not received, disconnecting")) // no harm in calling this if the connection is already down (or shutdown is in progress)
-				return
+			pingSent = time.Time{}
+			if c.options.AdaptiveKeepAlive {
+				srtt = smoothRTT(srtt, time.Duration(c.pingRTT.Load()))
+				interval = adaptiveKeepAliveInterval(keepAlive, srtt)
+				c.logger.Debug("keepalive interval adjusted", slog.Duration("interval", interval), slog.Duration("srtt", srtt), slog.String("component", string(PNG)))
 			}
 		}
+
+		// The two directions are considered separately. The spec requires that a packet is sent at least once
+		// per keepalive period, so any outgoing packet (e.g. a PUBLISH) delays the ping. Incoming packets show
+		// that the broker is alive, but, if nothing has been received for interval, a ping is sent to confirm
+		// that the connection is still up.
+		sendDue := c.lastSent.Load().(time.Time).Add(interval)
+		receiveDue := c.lastReceived.Load().(time.Time).Add(interval)
+		due := sendDue
+		if receiveDue.Before(due) {
+			due = receiveDue
+		}
+		if now.Before(due) {
+			timer.Reset(due.Sub(now))
+			continue
+		}
+
+		c.logger.Debug("keepalive sending ping", slog.Bool("sendIdle", !now.Before(sendDue)), slog.Bool("receiveIdle", !now.Before(receiveDue)), slog.String("component", string(PNG)))
+		ping := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
+		// We don't want to wait behind large messages being sent, the `Write` call
+		// will block until it is able to send the packet.
+		atomic.StoreInt32(&c.pingOutstanding, 1)
+		pingSent = c.clock.Now()
+		c.pingSent.Store(pingSent)
+		if err := ping.Write(conn); err != nil {
+			c.logger.Error(err.Error(), slog.String("component", string(PNG)))
+		} else {
+			c.tracePacket(PacketSent, ping)
+		}
+		c.lastSent.Store(c.clock.Now())
+		timer.Reset(c.options.PingTimeout)
+	}
+}
+
+// smoothRTT updates the smoothed round trip time with a new sample (as per RFC 6298; srtt of 0 means no samples yet)
+func smoothRTT(srtt, sample time.Duration) time.Duration {
+	if srtt == 0 {
+		return sample
 	}
+	return (7*srtt + sample) / 8
+}
+
+// adaptiveKeepAliveInterval returns the interval between pings such that a ping should reach the broker before
+// keepAlive expires. The interval is not reduced below half of keepAlive.
+func adaptiveKeepAliveInterval(keepAlive, srtt time.Duration) time.Duration {
+	return max(keepAlive-2*srtt, keepAlive/2)
 }
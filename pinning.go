@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCertificatePinMismatch is returned (wrapped) when no certificate presented by the broker matches the pinned
+// public keys (see SetSPKIPins)
+var ErrCertificatePinMismatch = errors.New("broker certificate does not match any pinned public key")
+
+// SPKIPin returns the pin ("sha256/<base64>") for the public key of cert (see SetSPKIPins)
+func SPKIPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(h[:])
+}
+
+// verifyPeerCertificate returns a tls.Config.VerifyPeerCertificate function that calls existing (from the
+// tls.Config, may be nil), checks pins (if any) and then calls verify (may be nil)
+func verifyPeerCertificate(existing func([][]byte, [][]*x509.Certificate) error, pins []string, verify func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if existing != nil {
+			if err := existing(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		if len(pins) > 0 {
+			if err := checkSPKIPins(pins, rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		if verify != nil {
+			return verify(rawCerts, verifiedChains)
+		}
+		return nil
+	}
+}
+
+// checkSPKIPins returns nil if a certificate in the verified chains (or, if verification was skipped, those
+// presented) matches one of pins
+func checkSPKIPins(pins []string, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var certs []*x509.Certificate
+	for _, chain := range verifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(verifiedChains) == 0 { // InsecureSkipVerify
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrCertificatePinMismatch, err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	for _, cert := range certs {
+		pin := strings.TrimPrefix(SPKIPin(cert), "sha256/")
+		for _, p := range pins {
+			if strings.TrimPrefix(p, "sha256/") == pin {
+				return nil
+			}
+		}
+	}
+	if len(certs) > 0 {
+		return fmt.Errorf("%w (presented %s)", ErrCertificatePinMismatch, SPKIPin(certs[0]))
+	}
+	return ErrCertificatePinMismatch
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// DefaultPresenceTopic is the topic template used by NewPresence if PresenceOptions.Topic is empty
+const DefaultPresenceTopic = "clients/{clientid}/status"
+
+// PresenceOptions configures a Presence
+type PresenceOptions struct {
+	Topic   string        // the status topic; "{clientid}" is replaced with the client ID (DefaultPresenceTopic if empty)
+	Online  []byte        // published when the client connects ("online" if nil)
+	Offline []byte        // published when the client disconnects or (as the will) the connection is lost ("offline" if nil)
+	Qos     byte          // QoS of the status messages (which are always retained)
+	Timeout time.Duration // how long Disconnect waits for the offline message to be published (default 5s)
+}
+
+// Presence maintains a retained status message for a client (the common online/offline pattern): the will is set
+// to the retained offline message, so the broker publishes it if the connection is lost; the retained online
+// message is published whenever a connection is established (including automatic reconnection); and Disconnect
+// publishes the offline message before disconnecting (the broker does not publish the will following a graceful
+// disconnection).
+type Presence struct {
+	topic   string
+	online  []byte
+	offline []byte
+	qos     byte
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+// NewPresence returns a Presence for the client that will be created with o. o is modified (the will is set and
+// the OnConnect handler wrapped so that the online message is published whenever a connection is established) so
+// must be passed to NewClient after this is called. An error is returned if the status topic is invalid.
+func NewPresence(o *ClientOptions, opts PresenceOptions) (*Presence, error) {
+	tmpl := opts.Topic
+	if tmpl == "" {
+		tmpl = DefaultPresenceTopic
+	}
+	topic, err := clientTopic(tmpl, o.ClientID)
+	if err != nil {
+		return nil, fmt.Errorf("presence topic: %w", err)
+	}
+	p := &Presence{
+		topic:   topic,
+		online:  opts.Online,
+		offline: opts.Offline,
+		qos:     opts.Qos,
+		timeout: opts.Timeout,
+		logger:  o.Logger,
+	}
+	if p.online == nil {
+		p.online = []byte("online")
+	}
+	if p.offline == nil {
+		p.offline = []byte("offline")
+	}
+	if p.timeout <= 0 {
+		p.timeout = 5 * time.Second
+	}
+	if p.logger == nil {
+		p.logger = slog.Default()
+	}
+
+	o.SetBinaryWill(p.topic, p.offline, p.qos, true)
+	onConnect := o.OnConnect
+	o.SetOnConnectHandler(func(c Client) {
+		go p.publish(c, p.online)
+		if onConnect != nil {
+			onConnect(c)
+		}
+	})
+	return p, nil
+}
+
+// Topic returns the status topic
+func (p *Presence) Topic() string { return p.topic }
+
+// Disconnect publishes the offline message (waiting up to the configured timeout for it to be delivered) and then
+// disconnects c; quiesce is passed to Client.Disconnect.
+func (p *Presence) Disconnect(c Client, quiesce uint) {
+	if c.IsConnectionOpen() {
+		p.publish(c, p.offline)
+	}
+	c.Disconnect(quiesce)
+}
+
+// clientTopic returns tmpl with "{clientid}" replaced by clientID; an error is returned if the result is not a
+// valid topic name (or clientID is required but empty)
+func clientTopic(tmpl, clientID string) (string, error) {
+	if strings.Contains(tmpl, "{clientid}") && clientID == "" {
+		return "", fmt.Errorf("%q requires a client ID", tmpl)
+	}
+	topic := strings.ReplaceAll(tmpl, "{clientid}", clientID)
+	if err := ValidateTopicName(topic); err != nil {
+		return "", fmt.Errorf("%q: %w", topic, err)
+	}
+	return topic, nil
+}
+
+// publish publishes payload to the status topic (retained), logging any failure
+func (p *Presence) publish(c Client, payload []byte) {
+	t := c.Publish(p.topic, p.qos, true, payload)
+	if !t.WaitTimeout(p.timeout) {
+		p.logger.Warn("timeout publishing presence", slog.String("topic", p.topic), slog.String("component", string(CLI)))
+	} else if err := t.Error(); err != nil {
+		p.logger.Warn("failed to publish presence", slog.String("topic", p.topic), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+	}
+}
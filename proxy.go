@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// newProxyDialer returns the dialer to be used when establishing tcp (and ssl) connections. If proxyURL is nil the
+// ALL_PROXY (and NO_PROXY) environment variables are used; forward is returned where no proxy is to be used.
+// socks5 and socks5h proxies are supported along with HTTP CONNECT proxies (http or https schemes); other schemes
+// can be supported by registering them with proxy.RegisterDialerType.
+func newProxyDialer(proxyURL *url.URL, forward *net.Dialer) (proxy.Dialer, error) {
+	if proxyURL != nil {
+		return proxyFromURL(proxyURL, forward)
+	}
+	allProxy := getEnvAny("ALL_PROXY", "all_proxy")
+	if len(allProxy) == 0 {
+		return forward, nil
+	}
+	u, err := url.Parse(allProxy)
+	if err != nil {
+		return forward, nil // As per proxy.FromEnvironment, an invalid proxy results in a direct connection
+	}
+	d, err := proxyFromURL(u, forward)
+	if err != nil {
+		return forward, nil
+	}
+	noProxy := getEnvAny("NO_PROXY", "no_proxy")
+	if len(noProxy) == 0 {
+		return d, nil
+	}
+	perHost := proxy.NewPerHost(d, forward)
+	perHost.AddFromString(noProxy)
+	return perHost, nil
+}
+
+// proxyFromURL returns a dialer that connects via the proxy at u. Dialers registered with proxy.RegisterDialerType
+// take precedence over the inbuilt HTTP CONNECT support.
+func proxyFromURL(u *url.URL, forward *net.Dialer) (proxy.Dialer, error) {
+	d, err := proxy.FromURL(u, forward)
+	if err == nil {
+		return d, nil
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &httpConnectDialer{proxyURL: u, forward: forward}, nil
+	}
+	return nil, err
+}
+
+// getEnvAny returns the value of the first of the environment variables that is set
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if val := os.Getenv(n); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// httpConnectDialer establishes connections through a HTTP proxy using the CONNECT method
+type httpConnectDialer struct {
+	proxyURL *url.URL
+	forward  *net.Dialer
+}
+
+// Dial connects to addr via the proxy
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	host := d.proxyURL.Host
+	if d.proxyURL.Port() == "" {
+		if d.proxyURL.Scheme == "https" {
+			host = net.JoinHostPort(d.proxyURL.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(d.proxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := d.forward.Dial(network, host)
+	if err != nil {
+		return nil, err
+	}
+	if d.forward.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.forward.Timeout))
+	}
+	if d.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxyURL.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.New("proxy CONNECT failed: " + resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 { // Unlikely (the broker should not send anything before CONNECT) but must not lose data
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn with data that has already been read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the connection to the proxy
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
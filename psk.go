@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+)
+
+// ErrPSKConnectorRequired is returned when a PSKCallback is configured without a PSKConnector (crypto/tls does not
+// implement the TLS-PSK cipher suites so cannot perform the handshake)
+var ErrPSKConnectorRequired = errors.New("TLS-PSK requires a PSKConnector (crypto/tls does not support PSK cipher suites)")
+
+// PSKCallback returns the identity and key used for a TLS-PSK handshake; hint is the identity hint sent by the
+// server (if any)
+type PSKCallback func(hint string) (identity string, key []byte, err error)
+
+// PSKConnector performs a TLS-PSK client handshake over conn (an established tcp connection), obtaining the
+// identity and key from psk, and returns the secured connection. tlsCfg (which may be nil) is the TLS configuration
+// that applies to the broker (its cipher suites, versions etc. may be used by the implementation).
+type PSKConnector func(conn net.Conn, serverName string, tlsCfg *tls.Config, psk PSKCallback) (net.Conn, error)
+
+// pskFor returns the PSKCallback to use when connecting to broker (nil if TLS-PSK is not used)
+func (c *client) pskFor(broker *url.URL) PSKCallback {
+	if !isTLSScheme(broker.Scheme) {
+		return nil
+	}
+	if psk, ok := c.options.BrokerTLSPSK[broker.Host]; ok {
+		return psk
+	}
+	return c.options.TLSPSK
+}
+
+// pskHandshake performs the TLS-PSK handshake over conn (which is closed if the handshake fails)
+func (c *client) pskHandshake(conn net.Conn, broker *url.URL, tlsCfg *tls.Config, psk PSKCallback, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	serverName := broker.Hostname()
+	if tlsCfg != nil && tlsCfg.ServerName != "" {
+		serverName = tlsCfg.ServerName
+	}
+	secured, err := c.options.TLSPSKConnector(conn, serverName, tlsCfg, psk)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return secured, nil
+}
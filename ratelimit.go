@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+)
+
+// byteRateLimiter is a token bucket limiting the rate at which bytes are transferred. The bucket holds up to
+// 100ms worth of bytes so short bursts (e.g. a PINGREQ after an idle period) are not delayed.
+type byteRateLimiter struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	rate   float64 // bytes per second
+	burst  int     // bucket capacity (and maximum chunk size)
+	tokens float64
+	last   time.Time
+}
+
+// newByteRateLimiter returns a limiter allowing bytesPerSec (nil if bytesPerSec <= 0, meaning no limit)
+func newByteRateLimiter(bytesPerSec int, clk clock.Clock) *byteRateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := max(bytesPerSec/10, 1)
+	return &byteRateLimiter{clock: clk, rate: float64(bytesPerSec), burst: burst, tokens: float64(burst), last: clk.Now()}
+}
+
+// reserve takes n bytes from the bucket (which may go into debt) and returns how long to wait before they may
+// be transferred
+func (l *byteRateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.burst))
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// rateLimitedConn limits the rate at which data is written to, and/or read from, a connection. Writes are split
+// into chunks (of at most the limiter's burst size) so that large packets (or batches) are spread out rather
+// than being sent at line rate after a long delay. Waits are abandoned if the connection is closed but do not
+// take deadlines into account.
+type rateLimitedConn struct {
+	net.Conn
+	clock       clock.Clock
+	read, write *byteRateLimiter // nil = unlimited
+	closeOnce   sync.Once
+	closed      chan struct{}
+}
+
+// newRateLimitedConn wraps conn if either limit is > 0 (otherwise conn is returned)
+func newRateLimitedConn(conn net.Conn, writeLimit, readLimit int, clk clock.Clock) net.Conn {
+	if writeLimit <= 0 && readLimit <= 0 {
+		return conn
+	}
+	return &rateLimitedConn{
+		Conn:   conn,
+		clock:  clk,
+		read:   newByteRateLimiter(readLimit, clk),
+		write:  newByteRateLimiter(writeLimit, clk),
+		closed: make(chan struct{}),
+	}
+}
+
+// wait blocks for d or until the connection is closed (returning net.ErrClosed)
+func (c *rateLimitedConn) wait(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := c.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// Write writes b in chunks, waiting as needed to keep within the limit
+func (c *rateLimitedConn) Write(b []byte) (int, error) {
+	if c.write == nil {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), c.write.burst)]
+		if err := c.wait(c.write.reserve(len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Read reads into b (at most the limiter's burst size at once) and then waits, if needed, before returning so
+// that the average rate does not exceed the limit (TCP flow control then slows the sender).
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	if c.read == nil {
+		return c.Conn.Read(b)
+	}
+	n, err := c.Conn.Read(b[:min(len(b), c.read.burst)])
+	if n > 0 {
+		if wErr := c.wait(c.read.reserve(n)); wErr != nil && err == nil {
+			err = wErr
+		}
+	}
+	return n, err
+}
+
+// Close closes the connection (abandoning any waits)
+func (c *rateLimitedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrCredentialsExpiring is the reason passed to the connection lost handler when the client disconnects in order
+// to reconnect with renewed credentials (e.g. before a token used as the password expires)
+var ErrCredentialsExpiring = errors.New("disconnecting to reconnect with renewed credentials")
+
+// reauthenticateTimeout limits the time spent sending the DISCONNECT packet before reauthenticating
+const reauthenticateTimeout = 5 * time.Second
+
+// reauthenticate gracefully closes the current connection (sending DISCONNECT, so the broker discards the will) and
+// treats this as a loss of connection so that, if AutoReconnect is enabled, the client reconnects (obtaining fresh
+// credentials); reason is passed to the connection lost handler. It does nothing if the client is not connected.
+func (c *client) reauthenticate(reason error) {
+	c.connMu.Lock()
+	open, stop := c.conn != nil, c.stop
+	c.connMu.Unlock()
+	if !open || c.status.ConnectionStatus() != connected {
+		return
+	}
+	c.logger.Info("disconnecting to reauthenticate", slog.String("reason", reason.Error()), slog.String("component", string(CLI)))
+	c.cycleReason.Store(&reason)
+	dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	dt := c.newToken(packets.Disconnect)
+	select {
+	case c.oboundP <- &PacketAndToken{p: dm, t: dt}:
+		dt.WaitTimeout(reauthenticateTimeout)
+	case <-stop:
+	case <-time.After(reauthenticateTimeout):
+	}
+	c.internalConnLost(reason) // no harm in calling this if the connection is already down
+}
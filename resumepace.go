@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+)
+
+// resumePacer paces the messages resent from the store when a session is resumed (see
+// ClientOptions.SetResumeRate) and reports progress (via ConnectionNotificationResume).
+// It is only used from the resume goroutine so needs no locking.
+type resumePacer struct {
+	clock    clock.Clock
+	batch    int           // messages per batch
+	interval time.Duration // minimum time between the start of consecutive batches (0 = no pacing)
+	notify   func(ConnectionNotificationResume)
+
+	total      int // messages to be resent
+	sent       int // messages resent so far
+	inBatch    int // messages sent in the current batch
+	batchStart time.Time
+}
+
+// newResumePacer returns a resumePacer for total messages; rate is in messages per second (0 = unlimited)
+func newResumePacer(rate, batch, total int, clk clock.Clock, notify func(ConnectionNotificationResume)) *resumePacer {
+	p := &resumePacer{clock: clk, batch: batch, total: total, notify: notify}
+	if rate > 0 {
+		if p.batch <= 0 {
+			p.batch = 1
+		}
+		p.interval = time.Duration(p.batch) * time.Second / time.Duration(rate)
+	}
+	return p
+}
+
+// wait is called before each message is sent; if the current batch is full it blocks until the time allotted to
+// the batch has passed. Returns false if stop is closed while waiting.
+func (p *resumePacer) wait(stop <-chan struct{}) bool {
+	if p.batch > 0 && p.inBatch >= p.batch {
+		if d := p.interval - p.clock.Now().Sub(p.batchStart); p.interval > 0 && d > 0 {
+			t := p.clock.NewTimer(d)
+			select {
+			case <-t.C():
+			case <-stop:
+				t.Stop()
+				return false
+			}
+		}
+		p.inBatch = 0
+	}
+	if p.inBatch == 0 {
+		p.batchStart = p.clock.Now()
+	}
+	p.inBatch++
+	return true
+}
+
+// done is called once a message has been sent
+func (p *resumePacer) done() {
+	p.sent++
+	if p.batch > 0 && p.sent%p.batch == 0 && p.sent < p.total {
+		p.notify(ConnectionNotificationResume{Sent: p.sent, Total: p.total})
+	}
+}
+
+// skip is called when a message that was included in the total will not be sent (e.g. it has been discarded)
+func (p *resumePacer) skip() {
+	p.total--
+}
+
+// finish reports completion (if there was anything to resend)
+func (p *resumePacer) finish() {
+	if p.total > 0 {
+		p.notify(ConnectionNotificationResume{Sent: p.sent, Total: p.total})
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ConnectErrorClass categorises the reason a connection attempt failed (see ConnectRetryPolicy)
+type ConnectErrorClass int
+
+const (
+	// ConnectErrorNetwork indicates that the network connection could not be established (or was lost during the handshake)
+	ConnectErrorNetwork ConnectErrorClass = iota
+	// ConnectErrorServerUnavailable indicates that the broker returned CONNACK code 3 (server unavailable)
+	ConnectErrorServerUnavailable
+	// ConnectErrorBadCredentials indicates that the broker returned CONNACK code 4 (bad user name or password)
+	ConnectErrorBadCredentials
+	// ConnectErrorNotAuthorized indicates that the broker returned CONNACK code 5 (not authorized)
+	ConnectErrorNotAuthorized
+	// ConnectErrorRefused indicates that the broker refused the connection for another reason (e.g. identifier rejected)
+	ConnectErrorRefused
+	// ConnectErrorCertificate indicates that the broker's TLS certificate was rejected (e.g. it could not be verified
+	// or does not match a pinned key, see SetSPKIPins). Without a ConnectRetryPolicy, failures due to a pinned key
+	// mismatch (ErrCertificatePinMismatch) are not retried; other certificate failures are retried as usual.
+	ConnectErrorCertificate
+)
+
+// String returns a description of the class
+func (c ConnectErrorClass) String() string {
+	switch c {
+	case ConnectErrorNetwork:
+		return "network"
+	case ConnectErrorServerUnavailable:
+		return "server unavailable"
+	case ConnectErrorBadCredentials:
+		return "bad credentials"
+	case ConnectErrorNotAuthorized:
+		return "not authorized"
+	case ConnectErrorRefused:
+		return "refused"
+	case ConnectErrorCertificate:
+		return "certificate"
+	}
+	return "unknown"
+}
+
+// classifyConnectError returns the class of error represented by the connect return code
+func classifyConnectError(rc byte) ConnectErrorClass {
+	switch rc {
+	case packets.ErrRefusedServerUnavailable:
+		return ConnectErrorServerUnavailable
+	case packets.ErrRefusedBadUsernameOrPassword:
+		return ConnectErrorBadCredentials
+	case packets.ErrRefusedNotAuthorised:
+		return ConnectErrorNotAuthorized
+	case packets.ErrRefusedBadProtocolVersion, packets.ErrRefusedIDRejected:
+		return ConnectErrorRefused
+	}
+	return ConnectErrorNetwork
+}
+
+// classifyConnectFailure returns the class of a failed connection attempt (rc and err as returned by
+// attemptConnection)
+func classifyConnectFailure(rc byte, err error) ConnectErrorClass {
+	if rc == packets.ErrNetworkError && isCertificateError(err) {
+		return ConnectErrorCertificate
+	}
+	return classifyConnectError(rc)
+}
+
+// isCertificateError returns true if err reports that the broker's certificate was rejected
+func isCertificateError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.Is(err, ErrCertificatePinMismatch) || errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
+
+// ConnectRetryPolicy is called following each failed connection attempt (attempt is the number of consecutive failed
+// attempts, starting at 1) and decides whether another attempt should be made and, if so, how long to wait first.
+type ConnectRetryPolicy func(class ConnectErrorClass, attempt int, err error) (retry bool, delay time.Duration)
+
+// ConnectGiveUpHandler is called, for both Connect and automatic reconnection, when the ConnectRetryPolicy decides
+// that no further attempts should be made. It is not called if attempts end for another reason (e.g. there is no
+// ConnectRetryPolicy, the broker's certificate does not match the pinned keys or ConnectTimeouts.Overall expires).
+type ConnectGiveUpHandler func(client Client, err error)
+
+// NewConnectRetryPolicy returns a ConnectRetryPolicy that retries, after interval, when the network connection fails or
+// the server is unavailable, and gives up immediately when the connection is refused (e.g. due to bad credentials) as
+// retrying is unlikely to succeed without intervention. maxAttempts limits the number of attempts (0 = no limit).
+func NewConnectRetryPolicy(interval time.Duration, maxAttempts int) ConnectRetryPolicy {
+	return func(class ConnectErrorClass, attempt int, _ error) (bool, time.Duration) {
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			return false, 0
+		}
+		switch class {
+		case ConnectErrorNetwork, ConnectErrorServerUnavailable:
+			return true, interval
+		}
+		return false, 0
+	}
+}
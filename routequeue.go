@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+// RouteDropPolicy determines what happens when a message arrives for a route whose queue is full (see RouteOptions)
+type RouteDropPolicy int
+
+const (
+	// RouteBlock blocks the router until there is space in the queue (this delays messages for all routes)
+	RouteBlock RouteDropPolicy = iota
+	// RouteDropNewest discards the message that has just arrived
+	RouteDropNewest
+	// RouteDropOldest discards the oldest message in the queue to make room for the new message
+	RouteDropOldest
+)
+
+// RouteOptions holds optional settings for SubscribeWithOptions and AddRouteWithOptions. If any option is set,
+// messages for the route are queued and passed to its handler independently of other routes (so a slow handler
+// cannot delay messages for other routes, and the order in which messages are handled, relative to other
+// routes, is not guaranteed). Messages that are discarded due to the DropPolicy are acknowledged without being
+// passed to the handler.
+type RouteOptions struct {
+	// BufferSize is the number of messages that may be queued awaiting a free handler
+	BufferSize int
+	// MaxConcurrency is the maximum number of concurrent calls to the handler (0 means 1)
+	MaxConcurrency int
+	// DropPolicy determines what happens when a message arrives and the queue is full
+	DropPolicy RouteDropPolicy
+	// LatestOnly coalesces messages; if a message arrives whilst an earlier message with the same topic is
+	// queued, the earlier message is discarded (so the handler only receives the latest value). When set a
+	// BufferSize of 0 means that the queue is not limited (it can hold at most one message per topic).
+	LatestOnly bool
+}
+
+// queued returns true if the options require that the route has its own queue
+func (o RouteOptions) queued() bool {
+	return o != RouteOptions{}
+}
+
+// queuedMessage is a message awaiting its handler
+type queuedMessage struct {
+	topic string
+	run   func() // passes the message to the handler
+	drop  func() // called if the message is discarded due to the drop policy (or superseded when LatestOnly)
+}
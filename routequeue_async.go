@@ -0,0 +1,123 @@
+//go:build !tinygo && !paho_noroutequeue
+
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sync"
+)
+
+// routeQueue holds the messages for a route that has RouteOptions and passes them to the handler on up to
+// maxConcurrency goroutines (which exit when the queue is empty)
+type routeQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled when a message is removed from items, a handler completes or a goroutine exits
+	items   []queuedMessage
+	size    int
+	max     int
+	policy  RouteDropPolicy
+	latest  bool
+	running int // number of goroutines started by push
+	busy    int // number of goroutines currently running a handler
+}
+
+// newRouteQueue returns a routeQueue configured as per opts
+func newRouteQueue(opts RouteOptions) *routeQueue {
+	q := &routeQueue{size: max(opts.BufferSize, 0), max: max(opts.MaxConcurrency, 1), policy: opts.DropPolicy,
+		latest: opts.LatestOnly}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// full returns true if there is no room for another message (items waiting for a running goroutine to pick
+// them up do not count towards the buffer size). Must be called with mu held.
+func (q *routeQueue) full() bool {
+	if q.latest && q.size == 0 {
+		return false
+	}
+	return len(q.items) >= q.size+q.max-q.busy
+}
+
+// push adds a message to the queue, applying the drop policy if the queue is full
+func (q *routeQueue) push(m queuedMessage) {
+	q.mu.Lock()
+	if q.latest {
+		for i, old := range q.items {
+			if old.topic == m.topic {
+				q.items[i] = m
+				q.mu.Unlock()
+				old.drop()
+				return
+			}
+		}
+	}
+	for q.full() {
+		switch q.policy {
+		case RouteDropNewest:
+			q.mu.Unlock()
+			m.drop()
+			return
+		case RouteDropOldest:
+			if len(q.items) == 0 { // all handlers busy and no buffer
+				q.mu.Unlock()
+				m.drop()
+				return
+			}
+			oldest := q.items[0]
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			oldest.drop()
+			q.mu.Lock()
+		default:
+			q.cond.Wait()
+		}
+	}
+	q.items = append(q.items, m)
+	if q.running < q.max {
+		q.running++
+		go q.work()
+	}
+	q.mu.Unlock()
+}
+
+// work runs queued messages until the queue is empty
+func (q *routeQueue) work() {
+	q.mu.Lock()
+	for len(q.items) > 0 {
+		m := q.items[0]
+		q.items = q.items[1:]
+		q.busy++
+		q.mu.Unlock()
+		m.run()
+		q.mu.Lock()
+		q.busy--
+		q.cond.Broadcast()
+	}
+	q.running--
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// wait blocks until the queue is empty and no handler is running (so the acknowledgements of the messages that were
+// queued have been sent)
+func (q *routeQueue) wait() {
+	q.mu.Lock()
+	for q.running > 0 {
+		q.cond.Wait()
+	}
+	q.mu.Unlock()
+}
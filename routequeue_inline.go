@@ -0,0 +1,36 @@
+//go:build tinygo || paho_noroutequeue
+
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+// routeQueue is used, in place of per-route queues, when building with TinyGo or the paho_noroutequeue build tag
+// (to reduce the number of goroutines on constrained devices). Messages for routes with RouteOptions are passed to
+// the handler on the router goroutine, so BufferSize, MaxConcurrency, DropPolicy and LatestOnly have no effect.
+type routeQueue struct{}
+
+// newRouteQueue returns a routeQueue (opts are ignored)
+func newRouteQueue(RouteOptions) *routeQueue {
+	return &routeQueue{}
+}
+
+// push passes the message to the handler immediately
+func (q *routeQueue) push(m queuedMessage) {
+	m.run()
+}
+
+// wait returns immediately (messages are handled by push)
+func (q *routeQueue) wait() {}
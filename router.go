@@ -20,19 +20,75 @@ package mqtt
 
 import (
 	"container/list"
+	"fmt"
+	"hash/fnv"
 	"log/slog"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
+// RouteMatchingStrategy determines which routes receive a message that matches more than one route
+// (see ClientOptions.SetRouteMatchingStrategy)
+type RouteMatchingStrategy int
+
+const (
+	// RouteMatchAll passes the message to every matching route (the default)
+	RouteMatchAll RouteMatchingStrategy = iota
+	// RouteMatchMostSpecific passes the message only to the most specific matching route(s). Filters are
+	// compared level by level (from the left); at the first level that differs an exact match beats '+',
+	// which beats '#'. Routes that are equally specific (e.g. shared subscriptions to the same filter) all
+	// receive the message.
+	RouteMatchMostSpecific
+)
+
 // route is a type which associates MQTT Topic strings with a
 // callback to be executed upon the arrival of a message associated
 // with a subscription to that topic.
 type route struct {
-	topic    string
-	callback MessageHandler
+	topic      string
+	callback   MessageHandler
+	shared     bool          // true if topic is a shared subscription ($share/<group>/<filter> or $queue/<filter>)
+	shareGroup string        // the share group (if shared)
+	matcher    RouteMatcher  // if not nil, used in place of topic when matching (topic is matcher.String())
+	queue      *routeQueue   // if not nil, messages are passed to callback via the queue (see RouteOptions)
+	messages   atomic.Uint64 // count of messages passed to callback
+}
+
+// newRoute returns a route for topic, which may be a shared subscription
+func newRoute(topic string, callback MessageHandler) *route {
+	group, _, shared := parseSharedSubscription(topic)
+	return &route{topic: topic, callback: callback, shared: shared, shareGroup: group}
+}
+
+// newMatcherRoute returns a route that uses matcher to match topics
+func newMatcherRoute(matcher RouteMatcher, callback MessageHandler) *route {
+	r := newRoute(matcher.Filter(), callback)
+	r.topic, r.matcher = matcher.String(), matcher
+	return r
+}
+
+// message returns the Message to pass to the routes callback; this carries the routes topic filter. Messages
+// routed via a shared subscription also carry the share group and those routed via a RouteMatcher the
+// parameters extracted from the topic.
+func (r *route) message(m *message, params map[string]string) Message {
+	filter := r.topic
+	if r.matcher != nil {
+		filter = r.matcher.Filter()
+	}
+	switch {
+	case r.matcher != nil && r.shared:
+		return &sharedParamsMessage{sharedMessage: &sharedMessage{message: m, group: r.shareGroup, filter: filter}, topicParams: params}
+	case r.matcher != nil:
+		return &paramsMessage{message: m, topicParams: params, filter: filter}
+	case r.shared:
+		return &sharedMessage{message: m, group: r.shareGroup, filter: filter}
+	}
+	return &routedMessage{message: m, filter: filter}
 }
 
 // match takes a slice of strings which represent the route being tested having been split on '/'
@@ -93,22 +149,56 @@ func isUnmatchedWildcardFilter(route, topic []string) bool {
 	return false
 }
 
-// removes $share and sharename when splitting the route to allow
+// removes $share and sharename (or $queue) when splitting the route to allow
 // shared subscription routes to correctly match the topic
 func routeSplit(route string) []string {
-	var result []string
-	if strings.HasPrefix(route, "$share") {
-		result = strings.Split(route, "/")[2:]
-	} else {
-		result = strings.Split(route, "/")
+	_, filter, _ := parseSharedSubscription(route)
+	return strings.Split(filter, "/")
+}
+
+// filterLevels returns the levels of the topic filter the route matches on (without any shared subscription prefix)
+func (r *route) filterLevels() []string {
+	if r.matcher != nil {
+		return routeSplit(r.matcher.Filter())
+	}
+	return routeSplit(r.topic)
+}
+
+// levelSpecificity ranks a topic filter level; exact matches are the most specific
+func levelSpecificity(level string) int {
+	switch level {
+	case "#":
+		return 0
+	case "+":
+		return 1
+	}
+	return 2
+}
+
+// compareSpecificity returns a positive number if filter a is more specific than b, a negative number if it is
+// less specific and 0 if they are equally specific. Both filters are assumed to match the same topic.
+func compareSpecificity(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if d := levelSpecificity(a[i]) - levelSpecificity(b[i]); d != 0 {
+			return d
+		}
 	}
-	return result
+	return len(b) - len(a) // a longer filter can only have a trailing "#" (e.g. "a/#" also matches "a")
 }
 
 // match takes the topic string of the published message and does a basic compare to the
 // string of the current Route, if they match it returns true
 func (r *route) match(topic string) bool {
-	return r.topic == topic || routeIncludesTopic(r.topic, topic)
+	_, ok := r.matchParams(topic)
+	return ok
+}
+
+// matchParams is as match but also returns the parameters extracted by the routes matcher (if any)
+func (r *route) matchParams(topic string) (map[string]string, bool) {
+	if r.matcher != nil {
+		return r.matcher.Match(topic)
+	}
+	return nil, r.topic == topic || routeIncludesTopic(r.topic, topic)
 }
 
 type router struct {
@@ -127,19 +217,49 @@ func newRouter(logger *slog.Logger) *router {
 }
 
 // addRoute takes a topic string and MessageHandler callback. It looks in the current list of
-// routes to see if there is already a matching Route. If there is it replaces the current
-// callback with the new one. If not it add a new entry to the list of Routes.
+// routes to see if there is already a matching Route (one with the same topic filter, ignoring any
+// shared subscription prefix, so that a message is not passed to the handler twice). If there is it
+// replaces the current topic and callback with the new ones. If not it add a new entry to the list of Routes.
 func (r *router) addRoute(topic string, callback MessageHandler) {
+	r.addRouteWithOptions(topic, callback, RouteOptions{})
+}
+
+// addRouteWithOptions is as addRoute but also applies opts to the route (replacing any existing options).
+func (r *router) addRouteWithOptions(topic string, callback MessageHandler, opts RouteOptions) {
+	var queue *routeQueue
+	if opts.queued() {
+		queue = newRouteQueue(opts)
+	}
+	nr := newRoute(topic, callback)
+	nr.queue = queue
+	_, filter, _ := parseSharedSubscription(topic)
 	r.Lock()
 	defer r.Unlock()
 	for e := r.routes.Front(); e != nil; e = e.Next() {
-		if e.Value.(*route).topic == topic {
-			r := e.Value.(*route)
-			r.callback = callback
+		rt := e.Value.(*route)
+		if _, f, _ := parseSharedSubscription(rt.topic); f == filter {
+			rt.topic, rt.shared, rt.shareGroup = nr.topic, nr.shared, nr.shareGroup
+			rt.callback, rt.queue = callback, queue
 			return
 		}
 	}
-	r.routes.PushBack(&route{topic: topic, callback: callback})
+	r.routes.PushBack(nr)
+}
+
+// addMatcherRoute is as addRoute but the route uses matcher to match topics; an existing route with the
+// same topic as matcher.String() is replaced.
+func (r *router) addMatcherRoute(matcher RouteMatcher, callback MessageHandler) {
+	r.Lock()
+	defer r.Unlock()
+	nr := newMatcherRoute(matcher, callback)
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*route).topic == nr.topic {
+			r.routes.InsertBefore(nr, e)
+			r.routes.Remove(e)
+			return
+		}
+	}
+	r.routes.PushBack(nr)
 }
 
 // deleteRoute takes a route string, looks for a matching Route in the list of Routes. If
@@ -155,6 +275,31 @@ func (r *router) deleteRoute(topic string) {
 	}
 }
 
+// messageCount returns the number of messages passed to the handler for the route for topic (0 if there is none)
+func (r *router) messageCount(topic string) uint64 {
+	r.RLock()
+	defer r.RUnlock()
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		if rt := e.Value.(*route); rt.topic == topic {
+			return rt.messages.Load()
+		}
+	}
+	return 0
+}
+
+// callHandler passes m to h; if a HandlerPanicHandler has been set any panic is recovered and reported to it
+func (r *router) callHandler(client *client, h MessageHandler, m Message) {
+	if onPanic := client.options.OnHandlerPanic; onPanic != nil {
+		defer func() {
+			if p := recover(); p != nil {
+				r.logger.Error("message handler panicked", slog.String("topic", m.Topic()), slog.String("panic", fmt.Sprint(p)), slog.String("component", string(ROU)))
+				onPanic(m.Topic(), p, debug.Stack())
+			}
+		}()
+	}
+	h(client, m)
+}
+
 // setDefaultHandler assigns a default callback that will be called if no matching Route
 // is found for an incoming Publish.
 func (r *router) setDefaultHandler(handler MessageHandler) {
@@ -175,67 +320,235 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 	// have reconnected, and the session is still live, then the Ack really should be sent (see Issus #726)
 	var ackMutex sync.RWMutex
 	sendAckChan := ackChan // This will be set to nil before ackChan is closed
-	sendAck := func(ack *PacketAndToken) {
+	sendAck := func(ack *PacketAndToken) error {
 		ackMutex.RLock()
 		defer ackMutex.RUnlock()
-		if sendAckChan != nil {
-			sendAckChan <- ack
-		} else {
+		if sendAckChan == nil {
 			r.logger.Debug("matchAndDispatch received acknowledgment after processing stopped (ACK dropped).", slog.String("component", string(ROU)))
+			return ErrAckNotSent
+		}
+		sendAckChan <- ack
+		return nil
+	}
+
+	// Nacked messages are queued for redelivery; the main goroutine is signalled and will pass them to the handlers
+	// again. QoS 1 and 2 messages are redelivered from the store (so that changes made to the message while it was
+	// being handled are not passed on). Messages nacked after processing has stopped are dropped (the broker will
+	// redeliver them if the session is retained).
+	type redelivery struct {
+		p          *packets.PublishPacket
+		receivedAt time.Time
+	}
+	var redeliverMu sync.Mutex
+	var redeliver []redelivery
+	redeliverStopped := false
+	redeliverSignal := make(chan struct{}, 1)
+	nackFunc := func(p *packets.PublishPacket, receivedAt time.Time) func() error {
+		return func() error {
+			redeliverMu.Lock()
+			defer redeliverMu.Unlock()
+			if redeliverStopped {
+				r.logger.Debug("matchAndDispatch received nack after processing stopped (message dropped).", slog.String("component", string(ROU)))
+				return ErrAckNotSent
+			}
+			dup := nackedPacket(client.persist, p)
+			if dup == nil {
+				r.logger.Debug("nacked message is no longer in the store (message dropped).", slog.Uint64("messageID", uint64(p.MessageID)), slog.String("component", string(ROU)))
+				return ErrAckNotSent
+			}
+			redeliver = append(redeliver, redelivery{p: dup, receivedAt: receivedAt})
+			select {
+			case redeliverSignal <- struct{}{}:
+			default:
+			}
+			return nil
 		}
 	}
 
+	// When order is false handlers are called in their own goroutine (or on the handler pool); with
+	// OrderedPerTopic messages for the same topic are handled serially
+	async := func(_ string, f func()) { go f() }
+	stopAsync := func() {}
+	switch {
+	case client.options.HandlerPoolSize > 0:
+		pool := newHandlerPool(client.options.HandlerPoolSize, client.options.OrderedPerTopic)
+		async, stopAsync = pool.run, pool.stop
+	case client.options.OrderedPerTopic:
+		async = newTopicSerializer().run
+	}
+
 	go func() { // Main go routine handling inbound messages
-		var handlers []MessageHandler
-		for message := range messages {
+		type handlerMessage struct {
+			handler MessageHandler
+			message Message
+		}
+		var handlers []handlerMessage
+		type queuedHandler struct {
+			queue *routeQueue
+			msg   queuedMessage
+		}
+		var queued []queuedHandler
+		var pooled []func()                          // passed to async once the lock is released (the handler pool may block)
+		usedQueues := make(map[*routeQueue]struct{}) // route queues that may hold messages from this connection
+		type routeMatch struct {
+			rt     *route
+			params map[string]string
+		}
+		var matches []routeMatch
+		mostSpecific := client.options.RouteMatchingStrategy == RouteMatchMostSpecific
+		broker := client.connectedBroker.Load() // the router is started for each connection
+		dispatch := func(message *packets.PublishPacket, receivedAt time.Time) {
 			// DEBUG.Println(ROU, "matchAndDispatch received message")
 			sent := false
-			r.RLock()
 			m := messageFromPublish(message, ackFunc(sendAck, client.persist, message, r.logger))
+			var ok bool
+			if m.payload, ok = client.inboundPayload(m.topic, m.payload); !ok {
+				m.Ack() // the broker still requires an acknowledgement
+				return
+			}
+			if len(client.options.InboundInterceptors) > 0 {
+				var err error
+				if m.topic, m.payload, err = client.interceptInbound(m.topic, m.payload); err != nil {
+					r.logger.Debug("message discarded by inbound interceptor", slog.String("topic", message.TopicName), slog.String("error", err.Error()), slog.String("component", string(ROU)))
+					m.Ack() // the broker still requires an acknowledgement
+					return
+				}
+			}
+			m.nack = nackFunc(message, receivedAt)
+			m.receivedAt, m.broker = receivedAt, broker
+			if client.options.AutoAckDisabled && client.options.AckTimeout > 0 && m.qos > 0 { // QoS 0 messages are never acknowledged
+				m.startAckTimer(client.clock, client.options.AckTimeout, client.options.OnAckTimeout)
+			}
+			r.RLock()
 			for e := r.routes.Front(); e != nil; e = e.Next() {
-				if e.Value.(*route).match(message.TopicName) {
-					if order {
-						handlers = append(handlers, e.Value.(*route).callback)
-					} else {
-						hd := e.Value.(*route).callback
-						go func() {
-							hd(client, m)
+				rt := e.Value.(*route)
+				if params, ok := rt.matchParams(m.topic); ok {
+					matches = append(matches, routeMatch{rt: rt, params: params})
+				}
+			}
+			if mostSpecific && len(matches) > 1 { // Only the most specific route(s) receive the message
+				best := matches[0].rt.filterLevels()
+				for _, rm := range matches[1:] {
+					if levels := rm.rt.filterLevels(); compareSpecificity(levels, best) > 0 {
+						best = levels
+					}
+				}
+				n := 0
+				for _, rm := range matches {
+					if compareSpecificity(rm.rt.filterLevels(), best) == 0 {
+						matches[n] = rm
+						n++
+					}
+				}
+				matches = matches[:n]
+			}
+			for _, rm := range matches {
+				rt, params := rm.rt, rm.params
+				rt.messages.Add(1)
+				hm := rt.message(m, params)
+				if rt.queue != nil {
+					hd := rt.callback
+					queued = append(queued, queuedHandler{queue: rt.queue, msg: queuedMessage{
+						topic: m.topic,
+						run: func() {
+							r.callHandler(client, hd, hm)
 							if !client.options.AutoAckDisabled {
-								m.Ack()
+								hm.Ack()
 							}
-						}()
-					}
-					sent = true
+						},
+						drop: func() {
+							r.logger.Debug("route queue full or message superseded; message discarded", slog.String("topic", m.topic), slog.String("component", string(ROU)))
+							hm.Ack()
+						},
+					}})
+				} else if order {
+					handlers = append(handlers, handlerMessage{handler: rt.callback, message: hm})
+				} else {
+					hd := rt.callback
+					pooled = append(pooled, func() {
+						r.callHandler(client, hd, hm)
+						if !client.options.AutoAckDisabled {
+							hm.Ack()
+						}
+					})
 				}
+				sent = true
 			}
+			clear(matches)
+			matches = matches[:0]
 			if !sent {
 				if r.defaultHandler != nil {
 					if order {
-						handlers = append(handlers, r.defaultHandler)
+						handlers = append(handlers, handlerMessage{handler: r.defaultHandler, message: m})
 					} else {
-						go func() {
-							r.defaultHandler(client, m)
+						hd := r.defaultHandler
+						pooled = append(pooled, func() {
+							r.callHandler(client, hd, m)
 							if !client.options.AutoAckDisabled {
 								m.Ack()
 							}
-						}()
+						})
 					}
 				} else {
 					r.logger.Debug("matchAndDispatch received message and no handler was available. Message will NOT be acknowledged.", slog.String("component", string(ROU)))
 				}
 			}
 			r.RUnlock()
+			for _, q := range queued { // may block (RouteBlock) so must be called without the lock held
+				usedQueues[q.queue] = struct{}{}
+				q.queue.push(q.msg)
+			}
+			queued = queued[:0]
+			for _, f := range pooled { // may block (HandlerPoolSize) so must be called without the lock held
+				async(m.topic, f)
+			}
+			clear(pooled)
+			pooled = pooled[:0]
 			if order {
-				for _, handler := range handlers {
-					handler(client, m)
+				for _, h := range handlers {
+					r.callHandler(client, h.handler, h.message)
 					if !client.options.AutoAckDisabled {
-						m.Ack()
+						h.message.Ack()
 					}
 				}
 				handlers = handlers[:0]
 			}
 			// DEBUG.Println(ROU, "matchAndDispatch handled message")
 		}
+		for messages != nil {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					messages = nil
+					continue
+				}
+				receivedAt := client.clock.Now()
+				if client.dedup != nil && client.dedup.duplicate(message, receivedAt) {
+					r.logger.Debug("duplicate message discarded", slog.Uint64("messageID", uint64(message.MessageID)), slog.String("topic", message.TopicName), slog.String("component", string(ROU)))
+					_ = ackFunc(sendAck, client.persist, message, r.logger)() // the broker still requires an acknowledgement
+					continue
+				}
+				dispatch(message, receivedAt)
+			case <-redeliverSignal:
+				redeliverMu.Lock()
+				queued := redeliver
+				redeliver = nil
+				redeliverMu.Unlock()
+				for _, rd := range queued {
+					dispatch(rd.p, rd.receivedAt)
+				}
+			}
+		}
+		redeliverMu.Lock()
+		redeliverStopped = true
+		redeliver = nil
+		redeliverMu.Unlock()
+		stopAsync() // wait for pooled handlers to complete so their acknowledgements can be sent
+
+		// Likewise for messages passed to route queues
+		for q := range usedQueues {
+			q.wait()
+		}
 		ackMutex.Lock()
 		sendAckChan = nil
 		ackMutex.Unlock()
@@ -244,3 +557,114 @@ func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order
 	}()
 	return ackChan
 }
+
+// nackedPacket returns a copy, flagged as a duplicate, of the packet to redeliver following a Nack of p. QoS 1 and 2
+// messages are read from the store (nil is returned if p is no longer there, e.g. because the session was reset);
+// QoS 0 messages are not stored so p itself is copied.
+func nackedPacket(s Store, p *packets.PublishPacket) *packets.PublishPacket {
+	src := p
+	if p.Qos > 0 {
+		sp, ok := s.Get(inboundKeyFromMID(p.MessageID)).(*packets.PublishPacket)
+		if !ok || sp.TopicName != p.TopicName {
+			return nil
+		}
+		src = sp
+	}
+	dup := *src
+	dup.Dup = true
+	return &dup
+}
+
+// topicSerializer runs functions such that those for the same topic run serially (in the order submitted)
+// whereas those for different topics may run concurrently. A goroutine is started for each topic with
+// pending work; it exits when there is nothing further queued for that topic.
+type topicSerializer struct {
+	mu     sync.Mutex
+	queues map[string][]func()
+}
+
+func newTopicSerializer() *topicSerializer {
+	return &topicSerializer{queues: make(map[string][]func())}
+}
+
+// run queues f to be run after any previously queued functions for topic have completed
+func (ts *topicSerializer) run(topic string, f func()) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if q, ok := ts.queues[topic]; ok { // a goroutine is already processing this topic
+		ts.queues[topic] = append(q, f)
+		return
+	}
+	ts.queues[topic] = []func(){}
+	go ts.process(topic, f)
+}
+
+// process runs f followed by any other functions queued for topic
+func (ts *topicSerializer) process(topic string, f func()) {
+	for {
+		f()
+		ts.mu.Lock()
+		q := ts.queues[topic]
+		if len(q) == 0 {
+			delete(ts.queues, topic)
+			ts.mu.Unlock()
+			return
+		}
+		f, ts.queues[topic] = q[0], q[1:]
+		ts.mu.Unlock()
+	}
+}
+
+// handlerPool runs functions on a fixed number of goroutines. If perTopic is set then functions for a
+// given topic always run on the same goroutine (so are run serially, in the order submitted).
+type handlerPool struct {
+	queues []chan func() // a single shared queue unless perTopic
+	wg     sync.WaitGroup
+}
+
+func newHandlerPool(size int, perTopic bool) *handlerPool {
+	p := &handlerPool{}
+	if perTopic {
+		p.queues = make([]chan func(), size)
+		for i := range p.queues {
+			p.queues[i] = make(chan func(), 1)
+			p.startWorkers(p.queues[i], 1)
+		}
+	} else {
+		p.queues = []chan func(){make(chan func(), size)}
+		p.startWorkers(p.queues[0], size)
+	}
+	return p
+}
+
+// startWorkers starts n goroutines that run the functions received on q
+func (p *handlerPool) startWorkers(q chan func(), n int) {
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer p.wg.Done()
+			for f := range q {
+				f()
+			}
+		}()
+	}
+}
+
+// run queues f to be run by the pool; this blocks if the pool is busy
+func (p *handlerPool) run(topic string, f func()) {
+	q := p.queues[0]
+	if len(p.queues) > 1 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(topic))
+		q = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+	q <- f
+}
+
+// stop waits for all queued functions to complete and stops the pool (run must not be called after this)
+func (p *handlerPool) stop() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
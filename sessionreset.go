@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ErrSessionCorrupt is the reason passed to the SessionResetHandler when the session state held in the store could
+// not be used (the specific problem is wrapped)
+var ErrSessionCorrupt = errors.New("session state corrupt")
+
+// openStore opens the store. If CleanSessionFallback is set and the store cannot be opened, or (when CleanSession
+// is false) holds packets that cannot be read, then the store is discarded and the next connection will request a
+// clean session (following which OnSessionReset is called). Otherwise a store that cannot be opened will panic.
+func (c *client) openStore() {
+	if !c.options.CleanSessionFallback {
+		c.persist.Open()
+		return
+	}
+	opened := true
+	err := openRecovered(c.persist)
+	if err != nil {
+		opened = false
+	} else if !c.options.CleanSession {
+		err = verifyStore(c.persist)
+	}
+	if err == nil {
+		return
+	}
+	err = fmt.Errorf("%w: %w", ErrSessionCorrupt, err)
+	c.logger.Warn("session state is unusable; discarding it and requesting a clean session", slog.String("error", err.Error()), slog.String("component", string(CLI)))
+	if opened {
+		c.persist.Reset()
+	} else {
+		if d, ok := c.persist.(DiscardableStore); ok {
+			if derr := d.Discard(); derr != nil {
+				c.logger.Error("failed to discard store", slog.String("error", derr.Error()), slog.String("component", string(CLI)))
+			}
+		}
+		c.persist.Open() // If the store remains unusable then this will panic (as it would without the fallback)
+	}
+	c.optionsMu.Lock()
+	c.sessionReset = err
+	c.optionsMu.Unlock()
+}
+
+// sessionResetComplete is called once a connection has been established; if the session was discarded by openStore
+// (so the connection requested a clean session) it calls OnSessionReset and returns true.
+func (c *client) sessionResetComplete() bool {
+	c.optionsMu.Lock()
+	reason := c.sessionReset
+	c.sessionReset = nil
+	c.optionsMu.Unlock()
+	if reason == nil {
+		return false
+	}
+	if c.options.OnSessionReset != nil {
+		go c.options.OnSessionReset(reason)
+	}
+	return true
+}
+
+// openRecovered opens s, returning an error if Open panics (the Store interface does not allow Open to return an
+// error, so stores, such as FileStore, that cannot be opened panic)
+func openRecovered(s Store) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if rerr, ok := r.(error); ok {
+				err = rerr
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	s.Open()
+	return nil
+}
+
+// verifyStore returns an error if any of the packets in s cannot be read
+func verifyStore(s Store) error {
+	for _, key := range s.All() {
+		if s.Get(key) == nil {
+			return fmt.Errorf("stored packet %q could not be read", key)
+		}
+	}
+	return nil
+}
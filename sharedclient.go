@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// SharedClient allows multiple independent consumers (e.g. libraries or modules within an application) to share a
+// single Client. Subscriptions are reference counted; a topic filter is subscribed to when the first consumer
+// subscribes to it and unsubscribed from when the last consumer unsubscribes. Messages are passed to the handler of
+// every consumer subscribed to the filter.
+type SharedClient struct {
+	client Client
+
+	mu   sync.Mutex
+	subs map[string]*sharedSubscription // topic filter -> subscription
+}
+
+// sharedSubscription is a subscription to a topic filter shared by one or more consumers
+type sharedSubscription struct {
+	qos       byte
+	token     Token // token returned by the most recent Subscribe call for this filter
+	consumers map[*SharedConsumer]MessageHandler
+}
+
+// NewSharedClient returns a SharedClient using c (which should not be used directly to subscribe or unsubscribe
+// from filters subscribed to via the SharedClient)
+func NewSharedClient(c Client) *SharedClient {
+	return &SharedClient{client: c, subs: make(map[string]*sharedSubscription)}
+}
+
+// Client returns the underlying Client (e.g. for publishing)
+func (s *SharedClient) Client() Client {
+	return s.client
+}
+
+// Consumer returns a new logical consumer of the client
+func (s *SharedClient) Consumer() *SharedConsumer {
+	return &SharedConsumer{shared: s}
+}
+
+// SharedConsumer is a logical consumer of a SharedClient
+type SharedConsumer struct {
+	shared *SharedClient
+}
+
+// Subscribe subscribes the consumer to topic, with messages passed to callback (which must not be nil). If another
+// consumer is already subscribed to the filter with the same, or higher, QoS then no SUBSCRIBE is sent (the returned
+// token will be that of the existing subscription); if qos is higher the filter is resubscribed at the new QoS.
+func (sc *SharedConsumer) Subscribe(topic string, qos byte, callback MessageHandler) Token {
+	s := sc.shared
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[topic]
+	if ok && sub.failed() {
+		ok = false
+	}
+	if !ok {
+		sub = &sharedSubscription{consumers: make(map[*SharedConsumer]MessageHandler)}
+		s.subs[topic] = sub
+	}
+	sub.consumers[sc] = callback
+	if !ok || qos > sub.qos {
+		sub.qos = max(sub.qos, qos)
+		sub.token = s.client.Subscribe(topic, sub.qos, func(c Client, m Message) { s.dispatch(topic, c, m) })
+	}
+	return sub.token
+}
+
+// Unsubscribe removes the consumer's subscription to each of topics; filters that no other consumer is subscribed to
+// are unsubscribed from. The returned token completes immediately if no UNSUBSCRIBE is needed.
+func (sc *SharedConsumer) Unsubscribe(topics ...string) Token {
+	s := sc.shared
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unsub []string
+	for _, topic := range topics {
+		sub, ok := s.subs[topic]
+		if !ok {
+			continue
+		}
+		if _, ok := sub.consumers[sc]; !ok {
+			continue
+		}
+		delete(sub.consumers, sc)
+		if len(sub.consumers) == 0 {
+			delete(s.subs, topic)
+			unsub = append(unsub, topic)
+		}
+	}
+	if len(unsub) == 0 {
+		t := newToken(packets.Unsubscribe).(*UnsubscribeToken)
+		t.flowComplete()
+		return t
+	}
+	return s.client.Unsubscribe(unsub...)
+}
+
+// Close unsubscribes the consumer from all of its subscriptions
+func (sc *SharedConsumer) Close() Token {
+	s := sc.shared
+	s.mu.Lock()
+	var topics []string
+	for topic, sub := range s.subs {
+		if _, ok := sub.consumers[sc]; ok {
+			topics = append(topics, topic)
+		}
+	}
+	s.mu.Unlock()
+	return sc.Unsubscribe(topics...)
+}
+
+// dispatch passes m to the handlers of all consumers subscribed to topic
+func (s *SharedClient) dispatch(topic string, c Client, m Message) {
+	s.mu.Lock()
+	var handlers []MessageHandler
+	if sub, ok := s.subs[topic]; ok {
+		handlers = make([]MessageHandler, 0, len(sub.consumers))
+		for _, h := range sub.consumers {
+			handlers = append(handlers, h)
+		}
+	}
+	s.mu.Unlock()
+	for _, h := range handlers {
+		h(c, m)
+	}
+}
+
+// failed returns true if the subscribe request failed (in which case a new request is needed)
+func (sub *sharedSubscription) failed() bool {
+	select {
+	case <-sub.token.Done():
+		return sub.token.Error() != nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrSignerMismatch is returned (wrapped) when the public key of a crypto.Signer does not match the certificate it
+// is used with
+var ErrSignerMismatch = errors.New("signer does not match certificate public key")
+
+// TLSCertificateFromSigner returns a tls.Certificate for chain (leaf first) whose private key operations are
+// performed by signer (e.g. a PKCS#11, TPM or secure element backed key). An error wrapping ErrSignerMismatch is
+// returned if the signer's public key does not match the leaf certificate. If signer has a method
+// SupportedSignatureAlgorithms() []tls.SignatureScheme (e.g. because the hardware cannot produce RSA-PSS
+// signatures) the result is used to limit the schemes offered.
+func TLSCertificateFromSigner(signer crypto.Signer, chain ...*x509.Certificate) (*tls.Certificate, error) {
+	if signer == nil || len(chain) == 0 || chain[0] == nil {
+		return nil, errors.New("a signer and certificate are required")
+	}
+	type publicKey interface{ Equal(crypto.PublicKey) bool }
+	pub, ok := signer.Public().(publicKey)
+	if !ok || !pub.Equal(chain[0].PublicKey) {
+		return nil, fmt.Errorf("%w (%s, %s)", ErrSignerMismatch, reflect.TypeOf(signer.Public()), chain[0].Subject)
+	}
+	cert := &tls.Certificate{PrivateKey: signer, Leaf: chain[0]}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	if s, ok := signer.(interface {
+		SupportedSignatureAlgorithms() []tls.SignatureScheme
+	}); ok {
+		cert.SupportedSignatureAlgorithms = s.SupportedSignatureAlgorithms()
+	}
+	return cert, nil
+}
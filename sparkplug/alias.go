@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package sparkplug
+
+import (
+	"log/slog"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// AliasTable records the metric aliases announced in NBIRTH and DBIRTH messages so that a host application can
+// resolve the aliases used in subsequent messages from the same edge node. It is safe for concurrent use.
+type AliasTable struct {
+	mu    sync.Mutex
+	nodes map[string]map[uint64]string // "group/node" -> alias -> name
+}
+
+// NewAliasTable returns an empty AliasTable
+func NewAliasTable() *AliasTable {
+	return &AliasTable{nodes: make(map[string]map[uint64]string)}
+}
+
+// Learn records the aliases in p if it is a birth certificate (an NBIRTH replaces all aliases known for the node)
+func (a *AliasTable) Learn(t Topic, p *Payload) {
+	if t.MessageType != NBIRTH && t.MessageType != DBIRTH {
+		return
+	}
+	key := t.GroupID + "/" + t.EdgeNodeID
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	aliases := a.nodes[key]
+	if aliases == nil || t.MessageType == NBIRTH {
+		aliases = make(map[uint64]string)
+		a.nodes[key] = aliases
+	}
+	for _, m := range p.Metrics {
+		if m.HasAlias && m.Name != "" {
+			aliases[m.Alias] = m.Name
+		}
+	}
+}
+
+// Resolve sets the name of each metric in p that is identified only by alias, returning false if any alias is
+// unknown (in which case the host would normally request a rebirth)
+func (a *AliasTable) Resolve(t Topic, p *Payload) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	aliases := a.nodes[t.GroupID+"/"+t.EdgeNodeID]
+	ok := true
+	for i := range p.Metrics {
+		m := &p.Metrics[i]
+		if m.Name != "" || !m.HasAlias {
+			continue
+		}
+		if m.Name = aliases[m.Alias]; m.Name == "" {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Handler returns an mqtt.MessageHandler that decodes Sparkplug messages, learns and resolves aliases, and passes
+// the result to fn (resolved is false if the payload refers to an unknown alias). Messages that are not valid
+// Sparkplug B messages are logged and dropped.
+func (a *AliasTable) Handler(fn func(c mqtt.Client, t Topic, p *Payload, resolved bool)) mqtt.MessageHandler {
+	return func(c mqtt.Client, m mqtt.Message) {
+		t, err := ParseTopic(m.Topic())
+		if err != nil {
+			slog.Warn("ignoring message", slog.String("topic", m.Topic()), slog.String("error", err.Error()), slog.String("component", "sparkplug"))
+			return
+		}
+		if t.MessageType == STATE { // STATE payloads are JSON
+			return
+		}
+		p, err := Unmarshal(m.Payload())
+		if err != nil {
+			slog.Warn("ignoring message", slog.String("topic", m.Topic()), slog.String("error", err.Error()), slog.String("component", "sparkplug"))
+			return
+		}
+		a.Learn(t, p)
+		fn(c, t, p, a.Resolve(t, p))
+	}
+}
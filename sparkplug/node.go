@@ -0,0 +1,348 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package sparkplug
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Names of the metrics that EdgeNode adds to each NBIRTH
+const (
+	MetricBdSeq   = "bdSeq"
+	MetricRebirth = "Node Control/Rebirth"
+)
+
+// ErrUnknownDevice is returned when publishing data or a death certificate for a device that has not been born
+var ErrUnknownDevice = errors.New("sparkplug: device has not been born")
+
+// EdgeNodeOptions configures an EdgeNode
+type EdgeNodeOptions struct {
+	GroupID    string
+	NodeID     string
+	Birth      func() []Metric           // returns the node metrics (with current values) that are included in each NBIRTH
+	UseAliases bool                      // if true aliases are assigned at birth and data messages identify metrics by alias
+	OnCommand  func(t Topic, p *Payload) // optional; called with NCMD and DCMD messages (aliases are resolved to names)
+	Timeout    time.Duration             // how long publish and subscribe operations wait for completion (default 5s)
+}
+
+// EdgeNode is a Sparkplug B edge node. It publishes an NBIRTH whenever a connection is established, registers an
+// NDEATH as the will (both carry the bdSeq metric, which is incremented for each session), numbers messages with
+// the sequence number that hosts use to detect loss, republishes device births following a reconnection or a
+// rebirth request ("Node Control/Rebirth" NCMD, which is handled automatically) and, optionally, manages metric
+// aliases.
+type EdgeNode struct {
+	opts      EdgeNodeOptions
+	client    mqtt.Client
+	lifecycle *mqtt.Lifecycle
+	logger    *slog.Logger
+
+	mu      sync.Mutex
+	seq     uint64              // sequence number of the last message published
+	devices map[string][]Metric // metrics from the last DBIRTH of each device (republished following NBIRTH)
+	aliases map[string]uint64   // aliasKey(device, name) -> alias
+	names   map[uint64]string   // alias -> name
+}
+
+// NewEdgeNode returns an EdgeNode that will connect using o. o is modified (the will is set, and the OnConnect,
+// OnConnectionLost and OnReconnecting handlers wrapped) and must not be used elsewhere. An error is returned if the
+// group or node ID is invalid.
+func NewEdgeNode(o *mqtt.ClientOptions, opts EdgeNodeOptions) (*EdgeNode, error) {
+	if !validID(opts.GroupID) || !validID(opts.NodeID) {
+		return nil, fmt.Errorf("%w: group %q, node %q", ErrInvalidTopic, opts.GroupID, opts.NodeID)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	n := &EdgeNode{
+		opts:    opts,
+		logger:  o.Logger,
+		devices: make(map[string][]Metric),
+		aliases: make(map[string]uint64),
+		names:   make(map[uint64]string),
+	}
+	if n.logger == nil {
+		n.logger = slog.Default()
+	}
+	var err error
+	n.lifecycle, err = mqtt.NewLifecycle(o, mqtt.LifecycleOptions{
+		BirthTopic:   n.topic(NBIRTH, "").String(),
+		DeathTopic:   n.topic(NDEATH, "").String(),
+		Death:        func(e mqtt.LifecycleEvent) []byte { return n.ndeath(e.Seq) },
+		Qos:          1, // the spec requires the NDEATH will to be QoS 1
+		SeqModulus:   256,
+		Timeout:      opts.Timeout,
+		BeforeBirth:  n.subscribe,
+		PublishBirth: n.nbirth,
+		OnBirthSent:  func(uint64) { n.deviceBirths() },
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.client = mqtt.NewClient(o)
+	return n, nil
+}
+
+// validID returns true if id can be used as a group, node or device ID
+func validID(id string) bool {
+	for _, r := range id {
+		switch r {
+		case '/', '+', '#', '{', '}':
+			return false
+		}
+	}
+	return id != ""
+}
+
+// Client returns the underlying MQTT client
+func (n *EdgeNode) Client() mqtt.Client { return n.client }
+
+// BdSeq returns the birth/death sequence number of the current (or, if not connected, the next) session
+func (n *EdgeNode) BdSeq() uint64 { return n.lifecycle.Seq() }
+
+// Connect connects to the broker (the NBIRTH is published once the connection is established)
+func (n *EdgeNode) Connect() error {
+	if t := n.client.Connect(); t.Wait() && t.Error() != nil {
+		return t.Error()
+	}
+	return nil
+}
+
+// Disconnect publishes the NDEATH and disconnects; quiesce is passed to Client.Disconnect
+func (n *EdgeNode) Disconnect(quiesce uint) {
+	n.lifecycle.Disconnect(n.client, quiesce)
+}
+
+// PublishData publishes an NDATA message containing metrics
+func (n *EdgeNode) PublishData(metrics []Metric) error {
+	return n.publish(n.topic(NDATA, ""), func() ([]Metric, error) { return n.data("", metrics), nil })
+}
+
+// PublishDeviceBirth publishes a DBIRTH for device; metrics must include every metric that the device will report.
+// The metrics are retained and republished (with their values at the time of this call) following each NBIRTH until
+// PublishDeviceDeath is called, so PublishDeviceBirth should be called again when values change significantly.
+func (n *EdgeNode) PublishDeviceBirth(device string, metrics []Metric) error {
+	if !validID(device) {
+		return fmt.Errorf("%w: device %q", ErrInvalidTopic, device)
+	}
+	return n.publish(n.topic(DBIRTH, device), func() ([]Metric, error) {
+		n.devices[device] = metrics
+		return n.birthMetrics(device, metrics), nil
+	})
+}
+
+// PublishDeviceData publishes a DDATA message containing metrics for device
+func (n *EdgeNode) PublishDeviceData(device string, metrics []Metric) error {
+	return n.publish(n.topic(DDATA, device), func() ([]Metric, error) {
+		if _, ok := n.devices[device]; !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownDevice, device)
+		}
+		return n.data(device, metrics), nil
+	})
+}
+
+// PublishDeviceDeath publishes a DDEATH for device
+func (n *EdgeNode) PublishDeviceDeath(device string) error {
+	return n.publish(n.topic(DDEATH, device), func() ([]Metric, error) {
+		if _, ok := n.devices[device]; !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownDevice, device)
+		}
+		delete(n.devices, device)
+		return nil, nil
+	})
+}
+
+// Rebirth republishes the NBIRTH (with the current bdSeq) followed by a DBIRTH for each device; this is done
+// automatically when a "Node Control/Rebirth" command is received.
+func (n *EdgeNode) Rebirth() error {
+	if err := n.wait(n.nbirth(n.client, n.lifecycle.Seq())); err != nil {
+		return err
+	}
+	return n.deviceBirths()
+}
+
+// topic returns the topic for a message of type mt relating to device (empty for the node itself)
+func (n *EdgeNode) topic(mt MessageType, device string) Topic {
+	return Topic{GroupID: n.opts.GroupID, MessageType: mt, EdgeNodeID: n.opts.NodeID, DeviceID: device}
+}
+
+// nbirth publishes an NBIRTH for session bdSeq; the message sequence number restarts at 0. As with publish, n.mu is
+// held until the message has been passed to the client so that no message with a later sequence number precedes it.
+func (n *EdgeNode) nbirth(c mqtt.Client, bdSeq uint64) mqtt.Token {
+	var metrics []Metric
+	if n.opts.Birth != nil {
+		metrics = n.opts.Birth()
+	}
+	metrics = append([]Metric{
+		{Name: MetricBdSeq, DataType: UInt64, Value: bdSeq},
+		{Name: MetricRebirth, DataType: Boolean, Value: false},
+	}, metrics...)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq = 0
+	b, err := Marshal(&Payload{Timestamp: time.Now(), Metrics: n.birthMetrics("", metrics), Seq: 0, HasSeq: true})
+	if err != nil {
+		n.logger.Error("failed to encode NBIRTH", slog.String("error", err.Error()), slog.String("component", "sparkplug"))
+	}
+	return c.Publish(n.topic(NBIRTH, "").String(), 1, false, b)
+}
+
+// ndeath builds the NDEATH for session bdSeq (which has no sequence number)
+func (n *EdgeNode) ndeath(bdSeq uint64) []byte {
+	b, _ := Marshal(&Payload{Timestamp: time.Now(), Metrics: []Metric{{Name: MetricBdSeq, DataType: UInt64, Value: bdSeq}}})
+	return b
+}
+
+// deviceBirths publishes a DBIRTH for each device that has been born
+func (n *EdgeNode) deviceBirths() error {
+	n.mu.Lock()
+	devices := make(map[string][]Metric, len(n.devices))
+	for d, m := range n.devices {
+		devices[d] = m
+	}
+	n.mu.Unlock()
+	var errs []error
+	for d, m := range devices {
+		if err := n.PublishDeviceBirth(d, m); err != nil {
+			errs = append(errs, fmt.Errorf("DBIRTH %q: %w", d, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// publish builds a payload (with the next sequence number) from the metrics returned by build and publishes it.
+// build is called with n.mu held (which is held until the message has been passed to the client, so that messages
+// are sent in sequence number order).
+func (n *EdgeNode) publish(t Topic, build func() ([]Metric, error)) error {
+	n.mu.Lock()
+	metrics, err := build()
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	seq := (n.seq + 1) % 256
+	b, err := Marshal(&Payload{Timestamp: time.Now(), Metrics: metrics, Seq: seq, HasSeq: true})
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.seq = seq
+	tok := n.client.Publish(t.String(), 0, false, b)
+	n.mu.Unlock()
+	return n.wait(tok)
+}
+
+// wait waits for t to complete
+func (n *EdgeNode) wait(t mqtt.Token) error {
+	if !t.WaitTimeout(n.opts.Timeout) {
+		return errors.New("sparkplug: timeout waiting for operation to complete")
+	}
+	return t.Error()
+}
+
+// aliasKey returns the key used to look up the alias of a metric (aliases are unique across the node's devices)
+func aliasKey(device, name string) string {
+	return device + "/" + name
+}
+
+// birthMetrics returns a copy of metrics with aliases assigned (if enabled); n.mu must be held
+func (n *EdgeNode) birthMetrics(device string, metrics []Metric) []Metric {
+	if !n.opts.UseAliases {
+		return metrics
+	}
+	out := make([]Metric, len(metrics))
+	for i, m := range metrics {
+		k := aliasKey(device, m.Name)
+		a, ok := n.aliases[k]
+		if !ok {
+			a = uint64(len(n.aliases))
+			n.aliases[k] = a
+			n.names[a] = m.Name
+		}
+		m.Alias, m.HasAlias = a, true
+		out[i] = m
+	}
+	return out
+}
+
+// data returns a copy of metrics in which metrics that have an alias are identified only by that alias; n.mu must
+// be held
+func (n *EdgeNode) data(device string, metrics []Metric) []Metric {
+	if !n.opts.UseAliases {
+		return metrics
+	}
+	out := make([]Metric, len(metrics))
+	for i, m := range metrics {
+		if a, ok := n.aliases[aliasKey(device, m.Name)]; ok {
+			m.Name, m.Alias, m.HasAlias = "", a, true
+		}
+		out[i] = m
+	}
+	return out
+}
+
+// subscribe subscribes to the NCMD and DCMD topics (called before each NBIRTH, as required by the specification)
+func (n *EdgeNode) subscribe(c mqtt.Client) {
+	filters := map[string]byte{
+		n.topic(NCMD, "").String():  1,
+		n.topic(DCMD, "+").String(): 1,
+	}
+	if err := n.wait(c.SubscribeMultiple(filters, n.command)); err != nil {
+		n.logger.Error("failed to subscribe to command topics", slog.String("error", err.Error()), slog.String("component", "sparkplug"))
+	}
+}
+
+// command handles an NCMD or DCMD message
+func (n *EdgeNode) command(_ mqtt.Client, m mqtt.Message) {
+	t, err := ParseTopic(m.Topic())
+	if err == nil {
+		var p *Payload
+		if p, err = Unmarshal(m.Payload()); err == nil {
+			n.resolve(p)
+			if t.MessageType == NCMD {
+				if r, ok := p.Metric(MetricRebirth); ok && r.Value == true {
+					go func() {
+						if err := n.Rebirth(); err != nil {
+							n.logger.Warn("rebirth failed", slog.String("error", err.Error()), slog.String("component", "sparkplug"))
+						}
+					}()
+				}
+			}
+			if n.opts.OnCommand != nil {
+				n.opts.OnCommand(t, p)
+			}
+			return
+		}
+	}
+	n.logger.Warn("ignoring invalid command", slog.String("topic", m.Topic()), slog.String("error", err.Error()), slog.String("component", "sparkplug"))
+}
+
+// resolve sets the name of metrics in p that are identified only by alias
+func (n *EdgeNode) resolve(p *Payload) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := range p.Metrics {
+		if m := &p.Metrics[i]; m.Name == "" && m.HasAlias {
+			m.Name = n.names[m.Alias]
+		}
+	}
+}
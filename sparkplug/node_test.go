@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package sparkplug
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+type hostMessage struct {
+	topic    Topic
+	payload  *Payload
+	resolved bool
+}
+
+func TestEdgeNode(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	received := make(chan hostMessage, 20)
+	host := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("host"))
+	if token := host.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer host.Disconnect(0)
+	aliases := NewAliasTable()
+	if token := host.Subscribe(Namespace+"/g/+/n/#", 1, aliases.Handler(func(_ mqtt.Client, t Topic, p *Payload, resolved bool) {
+		if t.MessageType != NCMD && t.MessageType != DCMD {
+			received <- hostMessage{t, p, resolved}
+		}
+	})); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect := func(mt MessageType, seq uint64) *Payload {
+		t.Helper()
+		select {
+		case m := <-received:
+			if m.topic.MessageType != mt {
+				t.Fatalf("expected %s, got %s", mt, m.topic.MessageType)
+			}
+			if !m.resolved {
+				t.Fatalf("unresolved alias in %+v", m.payload)
+			}
+			if mt != NDEATH && (!m.payload.HasSeq || m.payload.Seq != seq) {
+				t.Fatalf("%s: expected seq %d, got %d (%v)", mt, seq, m.payload.Seq, m.payload.HasSeq)
+			}
+			return m.payload
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", mt)
+		}
+		return nil
+	}
+	metricValue := func(p *Payload, name string) interface{} {
+		t.Helper()
+		m, ok := p.Metric(name)
+		if !ok {
+			t.Fatalf("metric %q not found in %+v", name, p)
+		}
+		return m.Value
+	}
+
+	commands := make(chan Topic, 5)
+	n, err := NewEdgeNode(mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("n"), EdgeNodeOptions{
+		GroupID:    "g",
+		NodeID:     "n",
+		Birth:      func() []Metric { return []Metric{{Name: "temp", DataType: Double, Value: 20.5}} },
+		UseAliases: true,
+		OnCommand:  func(t Topic, _ *Payload) { commands <- t },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	p := expect(NBIRTH, 0)
+	if metricValue(p, MetricBdSeq) != uint64(0) || metricValue(p, "temp") != 20.5 {
+		t.Fatalf("unexpected NBIRTH %+v", p)
+	}
+
+	if err := n.PublishData([]Metric{{Name: "temp", DataType: Double, Value: 21.0}}); err != nil {
+		t.Fatal(err)
+	}
+	p = expect(NDATA, 1)
+	if m := p.Metrics[0]; !m.HasAlias || metricValue(p, "temp") != 21.0 {
+		t.Fatalf("expected aliased metric, got %+v", m)
+	}
+	if err := n.PublishDeviceData("d", nil); err == nil {
+		t.Fatal("expected error publishing data for unborn device")
+	}
+	if err := n.PublishDeviceBirth("d", []Metric{{Name: "on", DataType: Boolean, Value: false}}); err != nil {
+		t.Fatal(err)
+	}
+	expect(DBIRTH, 2)
+	if err := n.PublishDeviceData("d", []Metric{{Name: "on", DataType: Boolean, Value: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if p = expect(DDATA, 3); metricValue(p, "on") != true {
+		t.Fatalf("unexpected DDATA %+v", p)
+	}
+
+	// a rebirth request republishes the node and device births
+	cmd, err := Marshal(&Payload{Metrics: []Metric{{Name: MetricRebirth, DataType: Boolean, Value: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Publish(Topic{GroupID: "g", MessageType: NCMD, EdgeNodeID: "n"}.String(), 1, false, cmd)
+	select {
+	case c := <-commands:
+		if c.MessageType != NCMD {
+			t.Fatalf("unexpected command %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for command")
+	}
+	expect(NBIRTH, 0)
+	expect(DBIRTH, 1)
+
+	n.Disconnect(0)
+	if p = expect(NDEATH, 0); metricValue(p, MetricBdSeq) != uint64(0) || p.HasSeq {
+		t.Fatalf("unexpected NDEATH %+v", p)
+	}
+	if n.BdSeq() != 1 {
+		t.Fatalf("expected bdSeq 1, got %d", n.BdSeq())
+	}
+}
+
+// lockCheckClient records whether the node's mutex is held when a message is published
+type lockCheckClient struct {
+	mqtt.Client
+	n      *EdgeNode
+	locked bool
+}
+
+func (c *lockCheckClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if c.n.mu.TryLock() {
+		c.n.mu.Unlock()
+	} else {
+		c.locked = true
+	}
+	return c.Client.Publish(topic, qos, retained, payload)
+}
+
+// TestEdgeNodeBirthLocked checks that the NBIRTH is passed to the client with n.mu held (otherwise a message with a
+// later sequence number could be sent before it)
+func TestEdgeNodeBirthLocked(t *testing.T) {
+	n, err := NewEdgeNode(mqtt.NewClientOptions(), EdgeNodeOptions{GroupID: "g", NodeID: "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &lockCheckClient{Client: n.Client(), n: n}
+	n.nbirth(c, 0)
+	if !c.locked {
+		t.Fatal("NBIRTH published without holding the node mutex")
+	}
+}
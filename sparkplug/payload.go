@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package sparkplug
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// ErrInvalidPayload is wrapped by errors returned by Unmarshal when the payload cannot be decoded
+var ErrInvalidPayload = errors.New("invalid sparkplug payload")
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Payload field numbers (see sparkplug_b.proto)
+const (
+	payloadTimestamp = 1
+	payloadMetrics   = 2
+	payloadSeq       = 3
+	payloadUUID      = 4
+	payloadBody      = 5
+)
+
+// Metric field numbers (see sparkplug_b.proto)
+const (
+	metricName         = 1
+	metricAlias        = 2
+	metricTimestamp    = 3
+	metricDataType     = 4
+	metricIsHistorical = 5
+	metricIsTransient  = 6
+	metricIsNull       = 7
+	metricIntValue     = 10
+	metricLongValue    = 11
+	metricFloatValue   = 12
+	metricDoubleValue  = 13
+	metricBooleanValue = 14
+	metricStringValue  = 15
+	metricBytesValue   = 16
+)
+
+// Marshal encodes p in the Sparkplug B (protobuf) format
+func Marshal(p *Payload) ([]byte, error) {
+	var b []byte
+	if !p.Timestamp.IsZero() {
+		b = appendVarintField(b, payloadTimestamp, uint64(p.Timestamp.UnixMilli()))
+	}
+	for i := range p.Metrics {
+		m, err := marshalMetric(&p.Metrics[i])
+		if err != nil {
+			return nil, fmt.Errorf("metric %q: %w", p.Metrics[i].Name, err)
+		}
+		b = appendBytesField(b, payloadMetrics, m)
+	}
+	if p.HasSeq {
+		b = appendVarintField(b, payloadSeq, p.Seq)
+	}
+	if p.UUID != "" {
+		b = appendBytesField(b, payloadUUID, []byte(p.UUID))
+	}
+	if p.Body != nil {
+		b = appendBytesField(b, payloadBody, p.Body)
+	}
+	return b, nil
+}
+
+// marshalMetric encodes m
+func marshalMetric(m *Metric) ([]byte, error) {
+	var b []byte
+	if m.Name != "" {
+		b = appendBytesField(b, metricName, []byte(m.Name))
+	}
+	if m.HasAlias {
+		b = appendVarintField(b, metricAlias, m.Alias)
+	}
+	if !m.Timestamp.IsZero() {
+		b = appendVarintField(b, metricTimestamp, uint64(m.Timestamp.UnixMilli()))
+	}
+	b = appendVarintField(b, metricDataType, uint64(m.DataType))
+	if m.IsHistorical {
+		b = appendVarintField(b, metricIsHistorical, 1)
+	}
+	if m.IsTransient {
+		b = appendVarintField(b, metricIsTransient, 1)
+	}
+	if m.Value == nil {
+		return appendVarintField(b, metricIsNull, 1), nil
+	}
+	switch m.DataType {
+	case Int8, Int16, Int32:
+		v, ok := toInt64(m.Value)
+		if !ok {
+			return nil, typeError(m)
+		}
+		return appendVarintField(b, metricIntValue, uint64(uint32(int32(v)))), nil // two's complement in a uint32
+	case UInt8, UInt16, UInt32:
+		v, ok := toUint64(m.Value)
+		if !ok {
+			return nil, typeError(m)
+		}
+		return appendVarintField(b, metricIntValue, uint64(uint32(v))), nil
+	case Int64:
+		v, ok := toInt64(m.Value)
+		if !ok {
+			return nil, typeError(m)
+		}
+		return appendVarintField(b, metricLongValue, uint64(v)), nil
+	case UInt64:
+		v, ok := toUint64(m.Value)
+		if !ok {
+			return nil, typeError(m)
+		}
+		return appendVarintField(b, metricLongValue, v), nil
+	case DateTime:
+		v, ok := m.Value.(time.Time)
+		if !ok {
+			return nil, typeError(m)
+		}
+		return appendVarintField(b, metricLongValue, uint64(v.UnixMilli())), nil
+	case Float:
+		v, ok := toFloat64(m.Value)
+		if !ok {
+			return nil, typeError(m)
+		}
+		b = binary.AppendUvarint(b, fieldKey(metricFloatValue, wireFixed32))
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v))), nil
+	case Double:
+		v, ok := toFloat64(m.Value)
+		if !ok {
+			return nil, typeError(m)
+		}
+		b = binary.AppendUvarint(b, fieldKey(metricDoubleValue, wireFixed64))
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v)), nil
+	case Boolean:
+		v, ok := m.Value.(bool)
+		if !ok {
+			return nil, typeError(m)
+		}
+		var n uint64
+		if v {
+			n = 1
+		}
+		return appendVarintField(b, metricBooleanValue, n), nil
+	case String, Text, UUID:
+		v, ok := m.Value.(string)
+		if !ok {
+			return nil, typeError(m)
+		}
+		return appendBytesField(b, metricStringValue, []byte(v)), nil
+	case Bytes, File:
+		v, ok := m.Value.([]byte)
+		if !ok {
+			return nil, typeError(m)
+		}
+		return appendBytesField(b, metricBytesValue, v), nil
+	}
+	return nil, fmt.Errorf("unsupported data type %d", m.DataType)
+}
+
+// typeError returns an error reporting that the type of m.Value does not suit m.DataType
+func typeError(m *Metric) error {
+	return fmt.Errorf("value of type %T cannot be encoded as data type %d", m.Value, m.DataType)
+}
+
+// toInt64 converts any integer to int64
+func toInt64(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+// toUint64 converts any integer to uint64
+func toUint64(v interface{}) (uint64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint(), true
+	}
+	return 0, false
+}
+
+// toFloat64 converts float32 or float64 to float64
+func toFloat64(v interface{}) (float64, bool) {
+	switch f := v.(type) {
+	case float32:
+		return float64(f), true
+	case float64:
+		return f, true
+	}
+	return 0, false
+}
+
+func fieldKey(field int, wireType int) uint64 {
+	return uint64(field)<<3 | uint64(wireType)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, fieldKey(field, wireVarint))
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, fieldKey(field, wireBytes))
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// Unmarshal decodes a Sparkplug B (protobuf) payload; errors wrap ErrInvalidPayload
+func Unmarshal(data []byte) (*Payload, error) {
+	p := &Payload{}
+	err := decodeFields(data, func(field int, wireType int, v uint64, raw []byte) error {
+		switch {
+		case field == payloadTimestamp && wireType == wireVarint:
+			p.Timestamp = time.UnixMilli(int64(v))
+		case field == payloadMetrics && wireType == wireBytes:
+			m, err := unmarshalMetric(raw)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, m)
+		case field == payloadSeq && wireType == wireVarint:
+			p.Seq, p.HasSeq = v, true
+		case field == payloadUUID && wireType == wireBytes:
+			p.UUID = string(raw)
+		case field == payloadBody && wireType == wireBytes:
+			p.Body = append([]byte{}, raw...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// unmarshalMetric decodes a metric
+func unmarshalMetric(data []byte) (Metric, error) {
+	var m Metric
+	var isNull bool
+	var value interface{}
+	var raw uint64 // the integer value (int_value or long_value)
+	var hasRaw bool
+	err := decodeFields(data, func(field int, wireType int, v uint64, b []byte) error {
+		switch {
+		case field == metricName && wireType == wireBytes:
+			m.Name = string(b)
+		case field == metricAlias && wireType == wireVarint:
+			m.Alias, m.HasAlias = v, true
+		case field == metricTimestamp && wireType == wireVarint:
+			m.Timestamp = time.UnixMilli(int64(v))
+		case field == metricDataType && wireType == wireVarint:
+			m.DataType = DataType(v)
+		case field == metricIsHistorical && wireType == wireVarint:
+			m.IsHistorical = v != 0
+		case field == metricIsTransient && wireType == wireVarint:
+			m.IsTransient = v != 0
+		case field == metricIsNull && wireType == wireVarint:
+			isNull = v != 0
+		case (field == metricIntValue || field == metricLongValue) && wireType == wireVarint:
+			raw, hasRaw = v, true
+		case field == metricFloatValue && wireType == wireFixed32:
+			value = math.Float32frombits(uint32(v))
+		case field == metricDoubleValue && wireType == wireFixed64:
+			value = math.Float64frombits(v)
+		case field == metricBooleanValue && wireType == wireVarint:
+			value = v != 0
+		case field == metricStringValue && wireType == wireBytes:
+			value = string(b)
+		case field == metricBytesValue && wireType == wireBytes:
+			value = append([]byte{}, b...)
+		}
+		return nil
+	})
+	if err != nil || isNull {
+		return m, err
+	}
+	if hasRaw {
+		switch m.DataType {
+		case Int8:
+			value = int8(raw)
+		case Int16:
+			value = int16(raw)
+		case Int32:
+			value = int32(raw)
+		case Int64:
+			value = int64(raw)
+		case UInt8:
+			value = uint8(raw)
+		case UInt16:
+			value = uint16(raw)
+		case UInt32:
+			value = uint32(raw)
+		case UInt64:
+			value = raw
+		case DateTime:
+			value = time.UnixMilli(int64(raw))
+		default:
+			value = raw
+		}
+	}
+	m.Value = value
+	return m, nil
+}
+
+// decodeFields calls fn with each field in data. For varint, fixed32 and fixed64 fields v holds the value; for
+// length delimited fields raw holds the data.
+func decodeFields(data []byte, fn func(field int, wireType int, v uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("%w: invalid field key", ErrInvalidPayload)
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&7)
+		var v uint64
+		var raw []byte
+		switch wireType {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("%w: invalid varint (field %d)", ErrInvalidPayload, field)
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("%w: truncated (field %d)", ErrInvalidPayload, field)
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("%w: truncated (field %d)", ErrInvalidPayload, field)
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return fmt.Errorf("%w: truncated (field %d)", ErrInvalidPayload, field)
+			}
+			raw, data = data[n:n+int(l)], data[n+int(l):]
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d (field %d)", ErrInvalidPayload, wireType, field)
+		}
+		if err := fn(field, wireType, v, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
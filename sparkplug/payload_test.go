@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package sparkplug
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	in := &Payload{
+		Timestamp: ts,
+		Seq:       7,
+		HasSeq:    true,
+		UUID:      "u",
+		Body:      []byte{1, 2},
+		Metrics: []Metric{
+			{Name: "i8", DataType: Int8, Value: int8(-5)},
+			{Name: "i16", DataType: Int16, Value: int16(-300)},
+			{Name: "i32", DataType: Int32, Value: int32(-70000)},
+			{Name: "i64", DataType: Int64, Value: int64(-1 << 40)},
+			{Name: "u8", DataType: UInt8, Value: uint8(200)},
+			{Name: "u16", DataType: UInt16, Value: uint16(60000)},
+			{Name: "u32", DataType: UInt32, Value: uint32(4000000000)},
+			{Name: "u64", DataType: UInt64, Value: uint64(1 << 63), Alias: 3, HasAlias: true},
+			{Name: "f", DataType: Float, Value: float32(1.5)},
+			{Name: "d", DataType: Double, Value: -2.25},
+			{Name: "b", DataType: Boolean, Value: true, IsHistorical: true, IsTransient: true},
+			{Name: "s", DataType: String, Value: "hello"},
+			{Name: "t", DataType: DateTime, Value: ts, Timestamp: ts},
+			{Name: "raw", DataType: Bytes, Value: []byte{9, 8}},
+			{Name: "null", DataType: Int32},
+		},
+	}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.Timestamp.Equal(in.Timestamp) || out.Seq != 7 || !out.HasSeq || out.UUID != "u" || !bytes.Equal(out.Body, in.Body) {
+		t.Fatalf("unexpected payload %+v", out)
+	}
+	if len(out.Metrics) != len(in.Metrics) {
+		t.Fatalf("expected %d metrics, got %d", len(in.Metrics), len(out.Metrics))
+	}
+	for i, want := range in.Metrics {
+		got := out.Metrics[i]
+		if tw, ok := want.Value.(time.Time); ok {
+			if !tw.Equal(got.Value.(time.Time)) {
+				t.Errorf("%s: expected %v, got %v", want.Name, tw, got.Value)
+			}
+			want.Value, got.Value = nil, nil
+		}
+		if !want.Timestamp.IsZero() && want.Timestamp.Equal(got.Timestamp) {
+			want.Timestamp, got.Timestamp = time.Time{}, time.Time{}
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	}
+
+	// any integer type is accepted when encoding
+	b, err = Marshal(&Payload{Metrics: []Metric{{Name: "x", DataType: Int16, Value: -3}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err = Unmarshal(b); err != nil || out.Metrics[0].Value != int16(-3) {
+		t.Fatalf("unexpected result %+v, %v", out, err)
+	}
+	if _, err = Marshal(&Payload{Metrics: []Metric{{Name: "x", DataType: Boolean, Value: 1}}}); err == nil {
+		t.Fatal("expected error encoding int as Boolean")
+	}
+}
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	b, err := Marshal(&Payload{Seq: 1, HasSeq: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unknown fixed32, length delimited and fixed64 fields are skipped
+	b = append(b, 6<<3|5, 1, 2, 3, 4, 7<<3|2, 2, 'a', 'b', 8<<3|1, 1, 2, 3, 4, 5, 6, 7, 8)
+	p, err := Unmarshal(b)
+	if err != nil || p.Seq != 1 {
+		t.Fatalf("unexpected result %+v, %v", p, err)
+	}
+	if _, err = Unmarshal(b[:len(b)-1]); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("expected ErrInvalidPayload, got %v", err)
+	}
+}
+
+func TestParseTopic(t *testing.T) {
+	valid := map[string]Topic{
+		"spBv1.0/g/NBIRTH/n":    {GroupID: "g", MessageType: NBIRTH, EdgeNodeID: "n"},
+		"spBv1.0/g/DDATA/n/d":   {GroupID: "g", MessageType: DDATA, EdgeNodeID: "n", DeviceID: "d"},
+		"spBv1.0/STATE/host1":   {MessageType: STATE, HostID: "host1"},
+		"spBv1.0/g/NCMD/n":      {GroupID: "g", MessageType: NCMD, EdgeNodeID: "n"},
+		"spBv1.0/g/DDEATH/n/d2": {GroupID: "g", MessageType: DDEATH, EdgeNodeID: "n", DeviceID: "d2"},
+	}
+	for s, want := range valid {
+		got, err := ParseTopic(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: expected %+v, got %+v", s, want, got)
+		}
+		if got.String() != s {
+			t.Errorf("expected %q, got %q", s, got.String())
+		}
+	}
+	for _, s := range []string{"spBv1.0/g/NBIRTH/n/d", "spBv1.0/g/DBIRTH/n", "spBv1.0/g/FOO/n", "spAv1.0/g/NDATA/n", "spBv1.0/STATE", "spBv1.0//NDATA/n"} {
+		if _, err := ParseTopic(s); !errors.Is(err, ErrInvalidTopic) {
+			t.Errorf("%s: expected ErrInvalidTopic, got %v", s, err)
+		}
+	}
+}
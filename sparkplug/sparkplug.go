@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package sparkplug implements the Sparkplug B specification on top of the MQTT client: encoding and decoding of
+// the protobuf payload, the topic namespace (spBv1.0/<group>/<message type>/<edge node>[/<device>]), an EdgeNode
+// that manages NBIRTH/NDEATH certificates and sequence numbers, and alias management for edge nodes and host
+// applications.
+//
+// The payload codec supports the scalar metric types (integers, floating point, boolean, string, date/time and
+// bytes); metadata, properties, data sets and templates are skipped when decoding and cannot be encoded.
+package sparkplug
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Namespace is the first level of all Sparkplug B topics
+const Namespace = "spBv1.0"
+
+// MessageType is the Sparkplug message type (the third level of the topic)
+type MessageType string
+
+// Sparkplug message types
+const (
+	NBIRTH MessageType = "NBIRTH"
+	NDEATH MessageType = "NDEATH"
+	DBIRTH MessageType = "DBIRTH"
+	DDEATH MessageType = "DDEATH"
+	NDATA  MessageType = "NDATA"
+	DDATA  MessageType = "DDATA"
+	NCMD   MessageType = "NCMD"
+	DCMD   MessageType = "DCMD"
+	STATE  MessageType = "STATE"
+)
+
+// ErrInvalidTopic is returned by ParseTopic if the topic is not a Sparkplug B topic
+var ErrInvalidTopic = errors.New("invalid sparkplug topic")
+
+// Topic identifies a Sparkplug message
+type Topic struct {
+	GroupID     string
+	MessageType MessageType
+	EdgeNodeID  string
+	DeviceID    string // empty for messages relating to the edge node
+	HostID      string // only used for STATE messages (which have the form spBv1.0/STATE/<host id>)
+}
+
+// String returns the MQTT topic name
+func (t Topic) String() string {
+	if t.MessageType == STATE {
+		return Namespace + "/" + string(STATE) + "/" + t.HostID
+	}
+	s := Namespace + "/" + t.GroupID + "/" + string(t.MessageType) + "/" + t.EdgeNodeID
+	if t.DeviceID != "" {
+		s += "/" + t.DeviceID
+	}
+	return s
+}
+
+// ParseTopic parses an MQTT topic name; errors wrap ErrInvalidTopic
+func ParseTopic(topic string) (Topic, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 || levels[0] != Namespace {
+		return Topic{}, fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+	if levels[1] == string(STATE) {
+		if len(levels) != 3 || levels[2] == "" {
+			return Topic{}, fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+		}
+		return Topic{MessageType: STATE, HostID: levels[2]}, nil
+	}
+	if len(levels) < 4 || len(levels) > 5 {
+		return Topic{}, fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+	t := Topic{GroupID: levels[1], MessageType: MessageType(levels[2]), EdgeNodeID: levels[3]}
+	if len(levels) == 5 {
+		t.DeviceID = levels[4]
+	}
+	switch t.MessageType {
+	case NBIRTH, NDEATH, NDATA, NCMD:
+		if t.DeviceID != "" {
+			return Topic{}, fmt.Errorf("%w: %q; %s is not a device message", ErrInvalidTopic, topic, t.MessageType)
+		}
+	case DBIRTH, DDEATH, DDATA, DCMD:
+		if t.DeviceID == "" {
+			return Topic{}, fmt.Errorf("%w: %q; %s requires a device", ErrInvalidTopic, topic, t.MessageType)
+		}
+	default:
+		return Topic{}, fmt.Errorf("%w: %q; unknown message type", ErrInvalidTopic, topic)
+	}
+	if t.GroupID == "" || t.EdgeNodeID == "" {
+		return Topic{}, fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+	return t, nil
+}
+
+// DataType is the Sparkplug B data type of a metric
+type DataType uint32
+
+// Sparkplug B data types
+const (
+	Unknown  DataType = 0
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+	Text     DataType = 14
+	UUID     DataType = 15
+	DataSet  DataType = 16
+	Bytes    DataType = 17
+	File     DataType = 18
+	Template DataType = 19
+)
+
+// Metric is a Sparkplug B metric. The Go type of Value depends upon the DataType: int8, int16, int32, int64, uint8,
+// uint16, uint32, uint64, float32 (Float), float64 (Double), bool (Boolean), string (String, Text and UUID),
+// time.Time (DateTime) or []byte (Bytes and File). When encoding, any integer type is accepted for the integer
+// data types (and either floating point type for Float and Double). A nil Value is encoded as a null.
+type Metric struct {
+	Name         string
+	Alias        uint64
+	HasAlias     bool      // true if Alias is set
+	Timestamp    time.Time // zero if not set
+	DataType     DataType
+	IsHistorical bool
+	IsTransient  bool
+	Value        interface{}
+}
+
+// Payload is a Sparkplug B payload
+type Payload struct {
+	Timestamp time.Time // zero if not set
+	Metrics   []Metric
+	Seq       uint64
+	HasSeq    bool // true if Seq is set (NDEATH and STATE payloads do not have a sequence number)
+	UUID      string
+	Body      []byte
+}
+
+// Metric returns the metric named name (and true) if it is present in the payload
+func (p *Payload) Metric(name string) (Metric, bool) {
+	for _, m := range p.Metrics {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Metric{}, false
+}
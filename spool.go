@@ -0,0 +1,582 @@
+//go:build !tinygo && !paho_nofilestore
+
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	spoolSegmentExt      = ".seg"
+	spoolCommittedFile   = "committed"
+	spoolRecordHeaderLen = 8  // body length (4 bytes) and CRC32 of the body (4 bytes)
+	spoolBodyHeaderLen   = 11 // sequence number (8), flags (1) and topic length (2)
+
+	spoolMaxPayload = 268435455                                    // the largest payload that can be published
+	spoolMaxBodyLen = spoolBodyHeaderLen + 65535 + spoolMaxPayload // anything larger must be corrupt
+)
+
+// ErrSpoolClosed is returned by Spooler.Enqueue after the spooler has been closed
+var ErrSpoolClosed = errors.New("spool closed")
+
+// SpoolOptions holds optional settings for a Spooler
+type SpoolOptions struct {
+	// SegmentSize is the size at which a new segment file is started (default 16MiB)
+	SegmentSize int64
+	// RetryInterval is the delay before retrying a publish that failed (e.g. due to the client being offline);
+	// default 1 second
+	RetryInterval time.Duration
+	// Sync causes each enqueued message to be flushed to stable storage (fsync) before Enqueue returns
+	Sync bool
+	// OnDelivered, if set, is called (from the spooler's goroutine) when a message has been published
+	// (i.e. the publish token has completed without error)
+	OnDelivered func(seq uint64, topic string)
+	// Logger is used for log output (defaults to slog.Default())
+	Logger *slog.Logger
+	// Blob, if set along with MaxLocalSize, holds the segments that do not fit in local storage (see BlobBackend)
+	Blob BlobBackend
+	// MaxLocalSize is the size of the segment files that may be held in dir; once exceeded, the most recent
+	// complete segments are moved to Blob (and retrieved when the messages they hold are due to be published)
+	MaxLocalSize int64
+}
+
+// spoolRecord is a message held in the spool
+type spoolRecord struct {
+	seq      uint64
+	qos      byte
+	retained bool
+	topic    string
+	payload  []byte
+}
+
+// Spooler provides durable queuing of outbound messages. Messages passed to Enqueue are appended to segment
+// files (each record is protected by a checksum) in a directory; a background goroutine publishes them, in
+// order, via the client, retrying until each publish succeeds. Progress is recorded so that, following a restart,
+// delivery resumes from the first message that was not confirmed (delivery is at-least-once; a message may be
+// published again if the process stops after it was published but before progress was recorded).
+// Fully delivered segment files are removed. If local storage is limited, segments can be moved to an object store
+// (see SpoolOptions.Blob) and retrieved when needed.
+//
+// This differs from the Store, which holds the state of the MQTT session; the spool holds messages that have
+// not yet been passed to Publish (so they are retained whilst the client is offline, or not running, for an
+// unlimited period).
+type Spooler struct {
+	dir    string
+	client Client
+	opts   SpoolOptions
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	closed    bool
+	segments  []uint64 // first sequence number of each segment (ascending); the last is being written to
+	writer    *os.File // the last segment
+	tailSize  int64    // bytes written to the last segment
+	nextSeq   uint64
+	committed uint64 // the sequence number of the last message delivered
+
+	remote     map[uint64]bool // segments held in opts.Blob (not in dir)
+	reading    uint64          // the segment being read by run
+	offloading uint64          // the segment being moved to opts.Blob
+
+	ctx         context.Context // cancelled by Close (so BlobBackend calls are abandoned)
+	cancel      context.CancelFunc
+	signal      chan struct{} // signalled when a message is enqueued
+	offload     chan struct{} // signalled when a segment is completed
+	stop        chan struct{}
+	done        chan struct{}
+	offloadDone chan struct{}
+}
+
+// NewSpooler opens (creating if necessary) the spool in dir and starts publishing any messages it contains via c.
+// Call Close to stop the spooler.
+func NewSpooler(c Client, dir string, opts SpoolOptions) (*Spooler, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 16 << 20
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	s := &Spooler{
+		dir:         dir,
+		client:      c,
+		opts:        opts,
+		logger:      opts.Logger,
+		remote:      make(map[uint64]bool),
+		signal:      make(chan struct{}, 1),
+		offload:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		offloadDone: make(chan struct{}),
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run()
+	if opts.Blob != nil && opts.MaxLocalSize > 0 {
+		s.offload <- struct{}{} // the spool may already exceed MaxLocalSize
+		go s.runOffload()
+	} else {
+		close(s.offloadDone)
+	}
+	return s, nil
+}
+
+// open loads the state of the spool from disk; any incomplete or corrupt record at the end of the last segment
+// (e.g. due to a crash during a write) is removed.
+func (s *Spooler) open() error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	local := make(map[uint64]bool)
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), spoolSegmentExt)
+		isRemote := false
+		if !ok {
+			if name, ok = strings.CutSuffix(e.Name(), spoolRemoteExt); !ok {
+				continue
+			}
+			isRemote = true
+		}
+		first, err := strconv.ParseUint(name, 16, 64)
+		if err != nil {
+			continue
+		}
+		if isRemote {
+			s.remote[first] = true
+		} else {
+			local[first] = true
+			s.segments = append(s.segments, first)
+		}
+	}
+	for first := range s.remote {
+		if local[first] { // the process stopped before the local copy was removed; it will be used
+			delete(s.remote, first)
+		} else {
+			s.segments = append(s.segments, first)
+		}
+	}
+	slices.Sort(s.segments)
+	if s.committed, err = s.readCommitted(); err != nil {
+		return err
+	}
+	s.nextSeq = s.committed + 1
+	if len(s.segments) == 0 {
+		return nil
+	}
+	last := s.segments[len(s.segments)-1]
+	f, err := os.OpenFile(s.segmentPath(last), os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	var off int64
+	for {
+		r, n, err := readSpoolRecord(f, off, fi.Size())
+		if err != nil {
+			break // end of valid data
+		}
+		s.nextSeq = max(s.nextSeq, r.seq+1)
+		off += n
+	}
+	if err := f.Truncate(off); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.writer, s.tailSize = f, off
+	return nil
+}
+
+// Enqueue appends a message to the spool and returns its sequence number. If an error is returned the message was
+// not spooled (unless a failed write could not be removed from the segment, in which case it may be delivered).
+func (s *Spooler) Enqueue(topic string, qos byte, retained bool, payload []byte) (uint64, error) {
+	if err := validatePublish(topic, qos); err != nil {
+		return 0, err
+	}
+	if len(payload) > spoolMaxPayload {
+		return 0, &packets.PayloadTooLargeError{Size: len(payload), Limit: spoolMaxPayload}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrSpoolClosed
+	}
+	seq := s.nextSeq
+	if s.writer == nil || s.tailSize >= s.opts.SegmentSize {
+		f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return 0, err
+		}
+		if s.writer != nil {
+			s.writer.Close()
+			select { // the completed segment may now be moved to opts.Blob
+			case s.offload <- struct{}{}:
+			default:
+			}
+		}
+		s.writer, s.tailSize = f, 0
+		s.segments = append(s.segments, seq)
+	}
+	rec := encodeSpoolRecord(spoolRecord{seq: seq, qos: qos, retained: retained, topic: topic, payload: payload})
+	if _, err := s.writer.Write(rec); err != nil {
+		s.discardTail() // The file may now contain a partial record
+		return 0, err
+	}
+	if s.opts.Sync {
+		if err := s.writer.Sync(); err != nil {
+			s.discardTail()
+			return 0, err
+		}
+	}
+	s.tailSize += int64(len(rec))
+	s.nextSeq++
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+	return seq, nil
+}
+
+// discardTail removes a record that could not be written (or synced) from the end of the last segment so that
+// its sequence number can be reused. If that fails, the record may remain so its sequence number is not reused;
+// the segment is closed (a new one will be started) leaving any partial record at its end (where it will be
+// treated as the end of the segment). Must be called with mu held.
+func (s *Spooler) discardTail() {
+	if err := s.writer.Truncate(s.tailSize); err == nil {
+		if _, err = s.writer.Seek(s.tailSize, io.SeekStart); err == nil {
+			return
+		}
+	}
+	s.logger.Error("unable to remove failed write from spool segment; starting a new segment", slog.String("component", string(SPL)))
+	s.writer.Close()
+	s.writer = nil
+	s.nextSeq++
+}
+
+// Pending returns the number of messages in the spool that have not been delivered
+func (s *Spooler) Pending() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextSeq - 1 - s.committed
+}
+
+// Close stops the spooler (waiting for any publish in progress to complete or fail) and closes its files.
+// Messages that have not been delivered remain in the spool.
+func (s *Spooler) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	s.cancel()
+	<-s.done
+	<-s.offloadDone
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer != nil {
+		return s.writer.Close()
+	}
+	return nil
+}
+
+// run publishes the messages in the spool until stopped
+func (s *Spooler) run() {
+	defer close(s.done)
+	var (
+		f    spoolSegment
+		seg  uint64 // first sequence number of the segment open in f
+		size int64  // size of the segment open in f (-1 until known; it is not known whilst it is the last segment)
+		off  int64
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		s.mu.Lock()
+		if f == nil {
+			// Move on to the next segment (sequence numbers start at 1 so, initially, this is the first)
+			idx := slices.IndexFunc(s.segments, func(first uint64) bool { return first > seg })
+			if idx == -1 {
+				s.mu.Unlock()
+				if !s.wait(nil) {
+					return
+				}
+				continue
+			}
+			if s.segments[idx] == s.offloading { // it will be retrieved from opts.Blob once moved
+				s.mu.Unlock()
+				if !s.wait(time.After(s.opts.RetryInterval)) {
+					return
+				}
+				continue
+			}
+			seg = s.segments[idx]
+			s.reading = seg
+			s.mu.Unlock()
+			var err error
+			if f, err = s.openSegment(seg); err != nil {
+				s.logger.Error("unable to open spool segment", slog.String("error", err.Error()), slog.String("component", string(SPL)))
+				if !s.wait(time.After(s.opts.RetryInterval)) {
+					return
+				}
+				f, seg = nil, 0
+				continue
+			}
+			off, size = 0, -1
+			s.mu.Lock()
+		}
+		isTail := seg == s.segments[len(s.segments)-1]
+		limit := s.tailSize
+		s.mu.Unlock()
+		if !isTail {
+			if size < 0 {
+				var err error
+				if size, err = segmentSize(f); err != nil {
+					s.logger.Error("unable to determine size of spool segment", slog.String("error", err.Error()), slog.String("component", string(SPL)))
+					if !s.wait(time.After(s.opts.RetryInterval)) {
+						return
+					}
+					continue
+				}
+			}
+			limit = size
+		}
+
+		r, n, err := readSpoolRecord(f, off, limit)
+		if err != nil {
+			if isTail {
+				if !s.wait(nil) {
+					return
+				}
+				continue
+			}
+			if !errors.Is(err, io.EOF) {
+				s.logger.Error("corrupt record in spool; skipping the remainder of the segment", slog.String("segment", s.segmentPath(seg)), slog.String("error", err.Error()), slog.String("component", string(SPL)))
+			}
+			// Finished with this segment; all of its messages have been delivered (or skipped)
+			f.Close()
+			f = nil
+			s.removeSegment(seg)
+			continue
+		}
+		off += n
+		if r.seq <= s.committedSeq() {
+			continue // already delivered
+		}
+		if !s.publish(r) {
+			return
+		}
+	}
+}
+
+// publish publishes r, retrying until successful; returns false if the spooler was stopped
+func (s *Spooler) publish(r spoolRecord) bool {
+	for {
+		t := s.client.Publish(r.topic, r.qos, r.retained, r.payload)
+		select {
+		case <-t.Done():
+		case <-s.stop:
+			return false
+		}
+		if err := t.Error(); err != nil {
+			s.logger.Debug("spooled publish failed; will retry", slog.Uint64("seq", r.seq), slog.String("error", err.Error()), slog.String("component", string(SPL)))
+			if !s.wait(time.After(s.opts.RetryInterval)) {
+				return false
+			}
+			continue
+		}
+		if err := s.commit(r.seq); err != nil {
+			s.logger.Error("unable to record spool progress", slog.String("error", err.Error()), slog.String("component", string(SPL)))
+		}
+		if s.opts.OnDelivered != nil {
+			s.opts.OnDelivered(r.seq, r.topic)
+		}
+		return true
+	}
+}
+
+// wait blocks until a message is enqueued (or ch, if not nil, receives); returns false if the spooler is stopped
+func (s *Spooler) wait(ch <-chan time.Time) bool {
+	if ch == nil {
+		select {
+		case <-s.signal:
+			return true
+		case <-s.stop:
+			return false
+		}
+	}
+	select {
+	case <-ch:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// removeSegment deletes the segment starting at first (unless it is the one being written to), including any copy
+// held in opts.Blob
+func (s *Spooler) removeSegment(first uint64) {
+	s.mu.Lock()
+	idx := slices.Index(s.segments, first)
+	if idx == -1 || idx == len(s.segments)-1 {
+		s.mu.Unlock()
+		return
+	}
+	s.segments = slices.Delete(s.segments, idx, idx+1)
+	isRemote := s.remote[first]
+	delete(s.remote, first)
+	if !isRemote {
+		if err := os.Remove(s.segmentPath(first)); err != nil {
+			s.logger.Error("unable to remove spool segment", slog.String("error", err.Error()), slog.String("component", string(SPL)))
+		}
+	}
+	s.mu.Unlock()
+	s.removeRemote(first)
+}
+
+func (s *Spooler) committedSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.committed
+}
+
+// commit records that seq has been delivered
+func (s *Spooler) commit(seq uint64) error {
+	s.mu.Lock()
+	s.committed = seq
+	s.mu.Unlock()
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[:8], seq)
+	binary.BigEndian.PutUint32(b[8:], crc32.ChecksumIEEE(b[:8]))
+	tmp := filepath.Join(s.dir, spoolCommittedFile+".tmp")
+	if err := os.WriteFile(tmp, b[:], 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, spoolCommittedFile))
+}
+
+// readCommitted returns the sequence number of the last message delivered (0 if none)
+func (s *Spooler) readCommitted() (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, spoolCommittedFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 12 || binary.BigEndian.Uint32(b[8:]) != crc32.ChecksumIEEE(b[:8]) {
+		return 0, fmt.Errorf("spool %s: corrupt %s file", s.dir, spoolCommittedFile)
+	}
+	return binary.BigEndian.Uint64(b[:8]), nil
+}
+
+func (s *Spooler) segmentPath(first uint64) string {
+	return filepath.Join(s.dir, spoolSegmentName(first))
+}
+
+// encodeSpoolRecord returns the on-disk representation of r
+func encodeSpoolRecord(r spoolRecord) []byte {
+	bodyLen := spoolBodyHeaderLen + len(r.topic) + len(r.payload)
+	b := make([]byte, spoolRecordHeaderLen+bodyLen)
+	body := b[spoolRecordHeaderLen:]
+	binary.BigEndian.PutUint64(body, r.seq)
+	body[8] = r.qos
+	if r.retained {
+		body[8] |= 0x80
+	}
+	binary.BigEndian.PutUint16(body[9:], uint16(len(r.topic)))
+	copy(body[spoolBodyHeaderLen:], r.topic)
+	copy(body[spoolBodyHeaderLen+len(r.topic):], r.payload)
+	binary.BigEndian.PutUint32(b, uint32(bodyLen))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(body))
+	return b
+}
+
+// readSpoolRecord reads the record at off in f, returning it and its on-disk length; data beyond limit (the size of
+// the segment, or the data written so far if it is the last segment) is not read. io.EOF is returned if there is no
+// complete record at off.
+func readSpoolRecord(f io.ReaderAt, off int64, limit int64) (spoolRecord, int64, error) {
+	var hdr [spoolRecordHeaderLen]byte
+	if off+spoolRecordHeaderLen > limit {
+		return spoolRecord{}, 0, io.EOF
+	}
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		return spoolRecord{}, 0, io.EOF
+	}
+	bodyLen := int64(binary.BigEndian.Uint32(hdr[:]))
+	if bodyLen < spoolBodyHeaderLen || bodyLen > spoolMaxBodyLen {
+		return spoolRecord{}, 0, errors.New("invalid record length")
+	}
+	if off+spoolRecordHeaderLen+bodyLen > limit {
+		return spoolRecord{}, 0, io.EOF
+	}
+	body := make([]byte, bodyLen)
+	if _, err := f.ReadAt(body, off+spoolRecordHeaderLen); err != nil {
+		return spoolRecord{}, 0, io.EOF
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(hdr[4:]) {
+		return spoolRecord{}, 0, errors.New("checksum mismatch")
+	}
+	topicLen := int(binary.BigEndian.Uint16(body[9:]))
+	if spoolBodyHeaderLen+topicLen > len(body) {
+		return spoolRecord{}, 0, errors.New("invalid topic length")
+	}
+	r := spoolRecord{
+		seq:      binary.BigEndian.Uint64(body),
+		qos:      body[8] & 0x03,
+		retained: body[8]&0x80 != 0,
+		topic:    string(body[spoolBodyHeaderLen : spoolBodyHeaderLen+topicLen]),
+		payload:  body[spoolBodyHeaderLen+topicLen:],
+	}
+	return r, spoolRecordHeaderLen + bodyLen, nil
+}
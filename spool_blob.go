@@ -0,0 +1,201 @@
+//go:build !tinygo && !paho_nofilestore
+
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// spoolRemoteExt is the extension of the (empty) files that record which segments are held in the BlobBackend
+const spoolRemoteExt = ".remote"
+
+// BlobBackend holds spool segments in an object store (e.g. Amazon S3, Azure Blob Storage or Google Cloud Storage)
+// when they do not fit in local storage (see SpoolOptions.Blob and MaxLocalSize). name is the segment's file name
+// (e.g. "0000000000000001.seg"); as this is only unique within a spool, an implementation should add a prefix
+// identifying the spool if the bucket is shared (e.g. by a fleet of devices). A segment is written once, read when
+// the messages it holds are due to be published (possibly following a restart) and deleted once they have been
+// delivered. ctx is cancelled when the Spooler is closed. Implementations must be safe for concurrent use.
+type BlobBackend interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// spoolSegment is a segment being read by run; either a local file or a segment retrieved from the BlobBackend
+type spoolSegment interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// blobSegment is a segment retrieved from the BlobBackend
+type blobSegment struct {
+	*bytes.Reader
+}
+
+func (blobSegment) Close() error { return nil }
+
+// segmentSize returns the size of a segment that is not being written to
+func segmentSize(f spoolSegment) (int64, error) {
+	if b, ok := f.(blobSegment); ok {
+		return b.Size(), nil
+	}
+	fi, err := f.(*os.File).Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// openSegment opens the segment starting at first, retrieving it from opts.Blob if it is not held locally
+func (s *Spooler) openSegment(first uint64) (spoolSegment, error) {
+	s.mu.Lock()
+	isRemote := s.remote[first]
+	s.mu.Unlock()
+	if !isRemote {
+		f, err := os.Open(s.segmentPath(first))
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	if s.opts.Blob == nil {
+		return nil, errors.New("segment is held in blob storage but no BlobBackend is set")
+	}
+	data, err := s.opts.Blob.Get(s.ctx, spoolSegmentName(first))
+	if err != nil {
+		return nil, fmt.Errorf("retrieve segment from blob storage: %w", err)
+	}
+	return blobSegment{bytes.NewReader(data)}, nil
+}
+
+// runOffload moves segments to opts.Blob whenever the local segments exceed opts.MaxLocalSize, until stopped
+func (s *Spooler) runOffload() {
+	defer close(s.offloadDone)
+	for {
+		select {
+		case <-s.offload:
+		case <-s.stop:
+			return
+		}
+		for {
+			moved, err := s.offloadSegment()
+			if err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
+				s.logger.Error("unable to move spool segment to blob storage; will retry", slog.String("error", err.Error()), slog.String("component", string(SPL)))
+				select {
+				case <-time.After(s.opts.RetryInterval):
+					continue
+				case <-s.stop:
+					return
+				}
+			}
+			if !moved {
+				break
+			}
+		}
+	}
+}
+
+// offloadSegment moves the most recent complete local segment (other than the one being read) to opts.Blob if the
+// local segments exceed opts.MaxLocalSize; returns false if nothing needed to be (or could be) moved. The most
+// recent segment is chosen because it holds the messages that will be published last.
+func (s *Spooler) offloadSegment() (bool, error) {
+	s.mu.Lock()
+	var size int64
+	var candidate uint64 // sequence numbers start at 1 so 0 means none
+	for i, first := range s.segments {
+		if s.remote[first] {
+			continue
+		}
+		if i == len(s.segments)-1 {
+			size += s.tailSize
+			continue
+		}
+		if fi, err := os.Stat(s.segmentPath(first)); err == nil {
+			size += fi.Size()
+		}
+		if first != s.reading {
+			candidate = first
+		}
+	}
+	if size <= s.opts.MaxLocalSize || candidate == 0 {
+		s.mu.Unlock()
+		return false, nil
+	}
+	s.offloading = candidate
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.offloading = 0
+		s.mu.Unlock()
+	}()
+
+	data, err := os.ReadFile(s.segmentPath(candidate))
+	if err != nil {
+		return false, err
+	}
+	if err := s.opts.Blob.Put(s.ctx, spoolSegmentName(candidate), data); err != nil {
+		return false, err
+	}
+	// The marker is written before the local copy is removed so that the segment cannot be lost (if the process
+	// stops in between, the local copy is used when the spool is reopened)
+	if err := os.WriteFile(s.remotePath(candidate), nil, 0o600); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	s.remote[candidate] = true
+	s.mu.Unlock()
+	if err := os.Remove(s.segmentPath(candidate)); err != nil {
+		s.logger.Error("unable to remove spool segment", slog.String("error", err.Error()), slog.String("component", string(SPL)))
+	}
+	s.logger.Debug("spool segment moved to blob storage", slog.String("segment", spoolSegmentName(candidate)), slog.Int("bytes", len(data)), slog.String("component", string(SPL)))
+	return true, nil
+}
+
+// removeRemote deletes the copy of the segment starting at first held in opts.Blob (if there is one)
+func (s *Spooler) removeRemote(first uint64) {
+	if err := os.Remove(s.remotePath(first)); err != nil {
+		return // the segment was not offloaded
+	}
+	if s.opts.Blob == nil {
+		s.logger.Warn("spool segment held in blob storage but no BlobBackend is set; it will not be deleted", slog.String("segment", spoolSegmentName(first)), slog.String("component", string(SPL)))
+		return
+	}
+	if err := s.opts.Blob.Delete(s.ctx, spoolSegmentName(first)); err != nil {
+		s.logger.Warn("unable to delete spool segment from blob storage", slog.String("segment", spoolSegmentName(first)), slog.String("error", err.Error()), slog.String("component", string(SPL)))
+	}
+}
+
+func (s *Spooler) remotePath(first uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", first, spoolRemoteExt))
+}
+
+// spoolSegmentName returns the name of the file (or blob) holding the segment starting at first
+func spoolSegmentName(first uint64) string {
+	return fmt.Sprintf("%016x%s", first, spoolSegmentExt)
+}
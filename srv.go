@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrNoBrokers is returned when there are no brokers to connect to (no servers have been added and
+// the SRV lookup, if configured, did not return any targets).
+var ErrNoBrokers = errors.New("no brokers available to connect to")
+
+// lookupSRV is a variable so that it can be replaced in tests
+var lookupSRV = net.LookupSRV
+
+// srvServices maps the SRV service names looked up to the scheme used to connect to the returned
+// targets. Secure services are listed first so that they are preferred.
+var srvServices = []struct {
+	service string
+	scheme  string
+}{
+	{service: "secure-mqtt", scheme: "ssl"},
+	{service: "mqtt", scheme: "tcp"},
+}
+
+// resolveSRVBrokers looks up the _secure-mqtt._tcp and _mqtt._tcp SRV records for domain and returns
+// the targets as broker URLs. The resolver returns records sorted by priority and randomized by weight
+// (RFC 2782), so that order is retained. Lookup failures are logged and result in no brokers for that service.
+func (c *client) resolveSRVBrokers(domain string) []*url.URL {
+	var brokers []*url.URL
+	for _, s := range srvServices {
+		_, addrs, err := lookupSRV(s.service, "tcp", domain)
+		if err != nil {
+			c.logger.Debug("SRV lookup failed", slog.String("service", s.service), slog.String("domain", domain), slog.String("error", err.Error()), slog.String("component", string(CLI)))
+			continue
+		}
+		for _, a := range addrs {
+			brokers = append(brokers, &url.URL{
+				Scheme: s.scheme,
+				Host:   net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port))),
+			})
+		}
+	}
+	if len(brokers) == 0 {
+		c.logger.Warn("SRV lookup returned no brokers", slog.String("domain", domain), slog.String("component", string(CLI)))
+	}
+	return brokers
+}
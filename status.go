@@ -67,6 +67,50 @@ func (s status) String() string {
 	}
 }
 
+// ConnState is the state of the client's connection to the broker (as returned by ConnectionWaiter.ConnectionState)
+type ConnState int
+
+const (
+	Disconnected  ConnState = iota // Not connected and no connection attempt is in progress
+	Connecting                     // Connect has been called and the initial connection attempt (or retries) is in progress
+	Reconnecting                   // The connection was lost and an automatic reconnection is in progress
+	Connected                      // The connection to the broker is up
+	Disconnecting                  // The connection is being closed (due to Disconnect, or connection loss, being processed)
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Reconnecting:
+		return "reconnecting"
+	case Connected:
+		return "connected"
+	case Disconnecting:
+		return "disconnecting"
+	default:
+		return "invalid"
+	}
+}
+
+// connState converts the internal status into a ConnState
+func (s status) connState() ConnState {
+	switch s {
+	case disconnecting:
+		return Disconnecting
+	case connecting:
+		return Connecting
+	case reconnecting:
+		return Reconnecting
+	case connected:
+		return Connected
+	default:
+		return Disconnected
+	}
+}
+
 type connCompletedFn func(success bool) error
 type disconnectCompletedFn func()
 type connectionLostHandledFn func(bool) (connCompletedFn, error)
@@ -121,6 +165,27 @@ type connectionStatus struct {
 	// `connecting`). `actionCompleted` will be set whenever we move into one of the above statues and the channel
 	// returned to anything else requesting a status change. The channel will be closed when the operation is complete.
 	actionCompleted chan struct{} // Only valid whilst status is Connecting or Reconnecting; will be closed when connection completed (success or failure)
+
+	changed chan struct{} // closed (and set to nil) when the status changes; created on demand by statusChanged
+}
+
+// setStatus changes the status and alerts anything waiting on a change (the lock must be held)
+func (c *connectionStatus) setStatus(s status) {
+	c.status = s
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// statusChanged returns the connection status and a channel that will be closed when it next changes
+func (c *connectionStatus) statusChanged() (status, <-chan struct{}) {
+	c.Lock()
+	defer c.Unlock()
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.status, c.changed
 }
 
 // ConnectionStatus returns the connection status.
@@ -152,7 +217,7 @@ func (c *connectionStatus) Connecting() (connCompletedFn, error) {
 	if c.status != disconnected {
 		return nil, errStatusMustBeDisconnected
 	}
-	c.status = connecting
+	c.setStatus(connecting)
 	c.actionCompleted = make(chan struct{})
 	return c.connected, nil
 }
@@ -172,9 +237,9 @@ func (c *connectionStatus) connected(success bool) error {
 		return errAbortConnection
 	}
 	if success {
-		c.status = connected
+		c.setStatus(connected)
 	} else {
-		c.status = disconnected
+		c.setStatus(disconnected)
 	}
 	return nil
 }
@@ -199,7 +264,7 @@ func (c *connectionStatus) Disconnecting() (disconnectCompletedFn, error) {
 	}
 
 	prevStatus := c.status
-	c.status = disconnecting
+	c.setStatus(disconnecting)
 
 	// We may need to wait for connection/reconnection process to complete (they should regularly check the status)
 	if prevStatus == connecting || prevStatus == reconnecting {
@@ -221,7 +286,7 @@ func (c *connectionStatus) Disconnecting() (disconnectCompletedFn, error) {
 func (c *connectionStatus) disconnectionCompleted() {
 	c.Lock()
 	defer c.Unlock()
-	c.status = disconnected
+	c.setStatus(disconnected)
 	close(c.actionCompleted) // Alert anything waiting on the connection process to complete
 	c.actionCompleted = nil
 }
@@ -244,7 +309,7 @@ func (c *connectionStatus) ConnectionLost(willReconnect bool) (connectionLostHan
 
 	c.willReconnect = willReconnect
 	prevStatus := c.status
-	c.status = disconnecting
+	c.setStatus(disconnecting)
 
 	// There is a slight possibility that a connection attempt is in progress (connection up and goroutines started but
 	// status not yet changed). By changing the status we ensure that process will exit cleanly
@@ -272,7 +337,7 @@ func (c *connectionStatus) getConnectionLostHandler(reconnectRequested bool) con
 
 		// `Disconnecting()` may have been called while the disconnection was being processed (this makes it permanent!)
 		if !c.willReconnect || !proceed {
-			c.status = disconnected
+			c.setStatus(disconnected)
 			close(c.actionCompleted) // Alert anything waiting on the connection process to complete
 			c.actionCompleted = nil
 			if !reconnectRequested || !proceed {
@@ -281,7 +346,7 @@ func (c *connectionStatus) getConnectionLostHandler(reconnectRequested bool) con
 			return nil, errDisconnectionRequested
 		}
 
-		c.status = reconnecting
+		c.setStatus(reconnecting)
 		return c.connected, nil // Note that c.actionCompleted is still live and will be closed in connected
 	}
 }
@@ -292,5 +357,5 @@ func (c *connectionStatus) getConnectionLostHandler(reconnectRequested bool) con
 func (c *connectionStatus) forceConnectionStatus(s status) {
 	c.Lock()
 	defer c.Unlock()
-	c.status = s
+	c.setStatus(s)
 }
@@ -19,7 +19,9 @@
 package mqtt
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log/slog"
 	"strconv"
 
@@ -27,15 +29,20 @@ import (
 )
 
 const (
-	inboundPrefix  = "i."
-	outboundPrefix = "o."
+	inboundPrefix      = "i."
+	outboundPrefix     = "o."
+	subscriptionPrefix = "s."
+	forwardPrefix      = "f."
 )
 
 // Store is an interface which can be used to provide implementations
 // for message persistence.
 // Because we may have to store distinct messages with the same
 // message ID, we need a unique key for each message. This is
-// possible by prepending "i." or "o." to each message id
+// possible by prepending "i." or "o." to each message id.
+// Subscriptions made with SubscribeNamed are stored under keys
+// prefixed with "s." and messages buffered whilst offline under keys
+// prefixed with "f." (these do not contain a message id).
 type Store interface {
 	Open()
 	Put(key string, message packets.ControlPacket)
@@ -46,6 +53,69 @@ type Store interface {
 	Reset()
 }
 
+// UpdateFunc is passed the packet currently held under a key (nil if there is none) and returns the packet that
+// should replace it (nil to delete the key). If an error is returned then the store is left unchanged.
+type UpdateFunc func(current packets.ControlPacket) (packets.ControlPacket, error)
+
+// UpdatableStore is implemented by Stores that can update the packet held under a key atomically. Update is
+// two-phase: fn is called with the current packet (prepare) and its result is then written (commit) with no
+// other operation on the key able to intervene; a persistent store must ensure that, following a crash, either the
+// old or the new packet is held (never a mix). The client uses this to commit inbound QoS 2 state transitions;
+// Stores that do not implement it fall back to Get followed by Put (which is not atomic).
+// MemoryStore, OrderedMemoryStore and FileStore all implement UpdatableStore.
+type UpdatableStore interface {
+	Store
+	Update(key string, fn UpdateFunc) error
+}
+
+// DiscardableStore is implemented by Stores that can discard their contents without being opened. When
+// CleanSessionFallback is set, the client uses this to recover from a store that cannot be opened (e.g. because
+// the persisted data is corrupt or in an unsupported format). FileStore implements DiscardableStore.
+type DiscardableStore interface {
+	Store
+	Discard() error
+}
+
+// ErrStoreClosed is returned by operations on a store that has not been opened (or has been closed)
+var ErrStoreClosed = errors.New("store not open")
+
+// errAlreadyAcknowledged is used by persistInbound to leave the store unchanged when a QoS 2 message is redelivered
+var errAlreadyAcknowledged = errors.New("message already acknowledged")
+
+// storeUpdate calls s.Update if s is an UpdatableStore; otherwise it emulates this using Get/Put/Del
+func storeUpdate(s Store, key string, fn UpdateFunc) error {
+	if us, ok := s.(UpdatableStore); ok {
+		return us.Update(key, fn)
+	}
+	next, err := fn(s.Get(key))
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		s.Del(key)
+	} else {
+		s.Put(key, next)
+	}
+	return nil
+}
+
+// CopyStore copies all packets from src to dst (both of which must be open), retaining their keys and the order
+// in which src returns them. This allows session state to be migrated between store implementations (or formats);
+// the client using the stores must not be running. Packets in dst with the same keys are overwritten. An error is
+// returned (after the remaining packets have been copied) if any packet in src cannot be read.
+func CopyStore(src, dst Store) error {
+	var errs []error
+	for _, key := range src.All() {
+		p := src.Get(key)
+		if p == nil {
+			errs = append(errs, fmt.Errorf("copy store: unable to read %q", key))
+			continue
+		}
+		dst.Put(key, p)
+	}
+	return errors.Join(errs...)
+}
+
 // A key MUST have the form "X.[messageid]"
 // where X is 'i' or 'o'
 func mIDFromKey(key string) uint16 {
@@ -65,6 +135,49 @@ func isKeyInbound(key string) bool {
 	return key[:2] == inboundPrefix
 }
 
+// Return true if key prefix is subscription
+func isKeySubscription(key string) bool {
+	return key[:2] == subscriptionPrefix
+}
+
+// Return true if the packet held under key may be evicted when a store's limits are exceeded. Only messages
+// buffered whilst offline may be; evicting session state (in-flight messages and subscriptions) would break the
+// delivery guarantees.
+func isKeyEvictable(key string) bool {
+	return isKeyForward(key)
+}
+
+// Return true if key prefix is forward (message buffered whilst offline)
+func isKeyForward(key string) bool {
+	return key[:2] == forwardPrefix
+}
+
+// Return a string of the form "s.[hash of topic]"
+func subscriptionKey(topic string) string {
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	return fmt.Sprintf("%s%016x", subscriptionPrefix, h.Sum64())
+}
+
+// persistSubscription stores a subscription made with a named handler. The Store only accepts
+// packets so the subscription is held as a PUBLISH packet with the handler name as its payload.
+func persistSubscription(s Store, topic string, qos byte, handlerName string) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Qos = qos
+	p.Payload = []byte(handlerName)
+	s.Put(subscriptionKey(topic), p)
+}
+
+// subscriptionFromPacket reverses persistSubscription
+func subscriptionFromPacket(p packets.ControlPacket) (topic string, qos byte, handlerName string, ok bool) {
+	pub, ok := p.(*packets.PublishPacket)
+	if !ok {
+		return "", 0, "", false
+	}
+	return pub.TopicName, pub.Qos, string(pub.Payload), true
+}
+
 // Return a string of the form "i.[id]"
 func inboundKeyFromMID(id uint16) string {
 	return fmt.Sprintf("%s%d", inboundPrefix, id)
@@ -84,6 +197,14 @@ func persistOutbound(s Store, m packets.ControlPacket, logger *slog.Logger) {
 			// Sending puback. delete matching publish
 			// from ibound
 			s.Del(inboundKeyFromMID(m.Details().MessageID))
+		case *packets.PubrecPacket:
+			// Sending pubrec (the message has been handled). replace the
+			// publish in ibound so a redelivery is not handled again
+			if err := storeUpdate(s, inboundKeyFromMID(m.Details().MessageID), func(packets.ControlPacket) (packets.ControlPacket, error) {
+				return m, nil
+			}); err != nil {
+				logger.Error("failed to record pubrec", slog.String("error", err.Error()), slog.String("component", string(STR)))
+			}
 		}
 	case 1:
 		switch m.(type) {
@@ -107,7 +228,9 @@ func persistOutbound(s Store, m packets.ControlPacket, logger *slog.Logger) {
 }
 
 // govern which incoming messages are persisted
-func persistInbound(s Store, m packets.ControlPacket, logger *slog.Logger) {
+// Returns false if m is a QoS 2 PUBLISH that has already been acknowledged (a PUBREC has been stored for its
+// message ID); such a redelivery must not be passed to the handler again.
+func persistInbound(s Store, m packets.ControlPacket, logger *slog.Logger) bool {
 	switch m.Details().Qos {
 	case 0:
 		switch m.(type) {
@@ -115,7 +238,7 @@ func persistInbound(s Store, m packets.ControlPacket, logger *slog.Logger) {
 			// Received a puback. delete matching publish
 			// from obound
 			s.Del(outboundKeyFromMID(m.Details().MessageID))
-		case *packets.PublishPacket, *packets.PubrecPacket, *packets.PingrespPacket, *packets.ConnackPacket:
+		case *packets.PublishPacket, *packets.PubrecPacket, *packets.PingrespPacket, *packets.ConnackPacket, *packets.DisconnectPacket:
 		default:
 			logger.Error("Asked to persist an invalid messages type", slog.String("component", string(STR)))
 		}
@@ -132,10 +255,19 @@ func persistInbound(s Store, m packets.ControlPacket, logger *slog.Logger) {
 		switch m.(type) {
 		case *packets.PublishPacket:
 			// Received a publish. store it in ibound
-			// until pubrel received
-			s.Put(inboundKeyFromMID(m.Details().MessageID), m)
+			// until pubrec sent (unless already acknowledged)
+			err := storeUpdate(s, inboundKeyFromMID(m.Details().MessageID), func(cur packets.ControlPacket) (packets.ControlPacket, error) {
+				if _, ok := cur.(*packets.PubrecPacket); ok {
+					return nil, errAlreadyAcknowledged
+				}
+				return m, nil
+			})
+			if errors.Is(err, errAlreadyAcknowledged) {
+				return false
+			}
 		default:
 			logger.Error("Asked to persist an invalid messages type", slog.String("component", string(STR)))
 		}
 	}
+	return true
 }
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// StoreOp identifies the Store operation reported to a StoreHook
+type StoreOp int
+
+const (
+	StorePut   StoreOp = iota // A packet was written (Put, or an Update that replaced the packet)
+	StoreGet                  // A packet was read
+	StoreDel                  // A packet was deleted (Del, or an Update that removed the packet)
+	StoreReset                // All packets were removed
+)
+
+func (op StoreOp) String() string {
+	switch op {
+	case StorePut:
+		return "put"
+	case StoreGet:
+		return "get"
+	case StoreDel:
+		return "del"
+	case StoreReset:
+		return "reset"
+	}
+	return "unknown"
+}
+
+// StoreEvent describes a completed Store operation (see SetStoreHook)
+type StoreEvent struct {
+	Op         StoreOp
+	Key        string                // empty for StoreReset
+	PacketType byte                  // type of the packet written or read (e.g. packets.Publish); 0 if there is none
+	Packet     packets.ControlPacket // the packet written or read (nil if there is none); must not be modified
+	Duration   time.Duration         // time taken by the Store
+}
+
+// StoreHook is called following each put, get, del and reset operation on the client's Store (see SetStoreHook).
+// It is called from the goroutine that performed the operation (which may be handling network communication) so
+// should return quickly.
+type StoreHook func(e StoreEvent)
+
+// hookedStore wraps a Store, reporting operations to a StoreHook
+type hookedStore struct {
+	Store
+	hook StoreHook
+}
+
+// discardableHookedStore is a hookedStore whose wrapped store implements DiscardableStore
+type discardableHookedStore struct {
+	*hookedStore
+}
+
+// newHookedStore returns s wrapped so that put, get, del and reset operations are reported to hook; the result
+// implements DiscardableStore only if s does
+func newHookedStore(s Store, hook StoreHook) Store {
+	h := &hookedStore{Store: s, hook: hook}
+	if _, ok := s.(DiscardableStore); ok {
+		return discardableHookedStore{h}
+	}
+	return h
+}
+
+// report passes details of an operation that started at start to the hook
+func (store *hookedStore) report(op StoreOp, key string, p packets.ControlPacket, start time.Time) {
+	e := StoreEvent{Op: op, Key: key, Packet: p, Duration: time.Since(start)}
+	if p != nil {
+		e.PacketType = packets.PacketType(p)
+	}
+	store.hook(e)
+}
+
+// Put stores the message in the wrapped store and reports the operation
+func (store *hookedStore) Put(key string, m packets.ControlPacket) {
+	start := time.Now()
+	store.Store.Put(key, m)
+	store.report(StorePut, key, m, start)
+}
+
+// Get retrieves the message from the wrapped store and reports the operation
+func (store *hookedStore) Get(key string) packets.ControlPacket {
+	start := time.Now()
+	p := store.Store.Get(key)
+	store.report(StoreGet, key, p, start)
+	return p
+}
+
+// Del removes the message from the wrapped store and reports the operation
+func (store *hookedStore) Del(key string) {
+	start := time.Now()
+	store.Store.Del(key)
+	store.report(StoreDel, key, nil, start)
+}
+
+// Reset removes all messages from the wrapped store and reports the operation
+func (store *hookedStore) Reset() {
+	start := time.Now()
+	store.Store.Reset()
+	store.report(StoreReset, "", nil, start)
+}
+
+// Update implements UpdatableStore (it is atomic if the wrapped store is); a successful update is reported as a put,
+// or a del if the packet was removed.
+func (store *hookedStore) Update(key string, fn UpdateFunc) error {
+	var next packets.ControlPacket
+	start := time.Now()
+	err := storeUpdate(store.Store, key, func(cur packets.ControlPacket) (packets.ControlPacket, error) {
+		var err error
+		next, err = fn(cur)
+		return next, err
+	})
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		store.report(StoreDel, key, nil, start)
+	} else {
+		store.report(StorePut, key, next, start)
+	}
+	return nil
+}
+
+// Discard implements DiscardableStore by discarding the contents of the wrapped store
+func (store discardableHookedStore) Discard() error {
+	return store.Store.(DiscardableStore).Discard()
+}
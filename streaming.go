@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// StreamingMessage is passed to a StreamingMessageHandler. Rather than being held in memory the payload is read
+// directly from the network connection via PayloadReader.
+type StreamingMessage interface {
+	Duplicate() bool
+	Qos() byte
+	Retained() bool
+	Topic() string
+	MessageID() uint16
+	// Size returns the length of the payload in bytes
+	Size() int
+	// PayloadReader returns a reader for the payload; it is only valid until the handler returns
+	PayloadReader() io.Reader
+}
+
+// StreamingMessageHandler is called with messages whose payload exceeds the threshold set with
+// ClientOptions.SetStreamingHandler
+type StreamingMessageHandler func(Client, StreamingMessage)
+
+// streamingMessage implements StreamingMessage
+type streamingMessage struct {
+	p    *packets.PublishPacket
+	size int
+	r    io.Reader
+}
+
+func (m *streamingMessage) Duplicate() bool          { return m.p.Dup }
+func (m *streamingMessage) Qos() byte                { return m.p.Qos }
+func (m *streamingMessage) Retained() bool           { return m.p.Retain }
+func (m *streamingMessage) Topic() string            { return m.p.TopicName }
+func (m *streamingMessage) MessageID() uint16        { return m.p.MessageID }
+func (m *streamingMessage) Size() int                { return m.size }
+func (m *streamingMessage) PayloadReader() io.Reader { return m.r }
+
+// activityReader calls onRead whenever data is read (so that the keepalive logic knows the connection is active)
+type activityReader struct {
+	r      io.Reader
+	onRead func()
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.onRead()
+	}
+	return n, err
+}
+
+// streamThreshold returns the threshold set with SetStreamingHandler (0 if streaming is disabled)
+func (c *client) streamThreshold() int {
+	if c.options.StreamingHandler == nil {
+		return 0
+	}
+	return c.options.StreamingThreshold
+}
+
+// streamPayload passes a message with a streamed payload to the StreamingHandler; any part of the payload not read
+// by the handler is then discarded. This is called from the goroutine reading from the network connection.
+func (c *client) streamPayload(p *packets.PublishPacket, payload *io.LimitedReader) {
+	m := &streamingMessage{p: p, size: int(payload.N), r: &activityReader{r: payload, onRead: c.UpdateLastReceived}}
+	func() {
+		if onPanic := c.options.OnHandlerPanic; onPanic != nil {
+			defer func() {
+				if r := recover(); r != nil {
+					c.logger.Error("streaming message handler panicked", slog.String("topic", p.TopicName), slog.String("panic", fmt.Sprint(r)), slog.String("component", string(NET)))
+					onPanic(p.TopicName, r, debug.Stack())
+				}
+			}()
+		}
+		c.options.StreamingHandler(c, m)
+	}()
+	if payload.N > 0 {
+		c.logger.Debug("discarding unread streamed payload", slog.Int64("remaining", payload.N), slog.String("component", string(NET)))
+		_, _ = io.Copy(io.Discard, payload) // any error will be picked up when the next packet is read
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sort"
+	"sync"
+)
+
+// SubscriptionInfo describes a subscription made by the client (see SubscriptionLister)
+type SubscriptionInfo struct {
+	Topic       string // The topic filter
+	Qos         byte   // The QoS requested
+	GrantedQos  byte   // The QoS granted by the broker (only valid if Pending is false)
+	Pending     bool   // true if the broker has not yet acknowledged the subscription
+	HandlerName string // The name of the handler (if subscribed with SubscribeNamed)
+	Messages    uint64 // The number of messages passed to the handler for this topic filter (if it has one)
+}
+
+// subscriptionRegistry tracks the subscriptions made by the client so that they can be reported by
+// Subscriptions (see SubscriptionLister). Subscriptions are added when requested, updated when the SUBACK is received and
+// removed when unsubscribed, rejected by the broker, or lost because the session was not present.
+// It also tracks the membership of subscription groups (see GroupSubscriber).
+type subscriptionRegistry struct {
+	mu      sync.Mutex
+	subs    map[string]*SubscriptionInfo
+	groups  map[string]map[string]struct{} // group name -> topic filters
+	offline map[string]struct{}            // store keys of subscriptions unsubscribed whilst not connected
+}
+
+// unsubscribedOffline records that topics were unsubscribed whilst the client was not connected so that any
+// record of them in the store can be removed when the client next connects
+func (r *subscriptionRegistry) unsubscribedOffline(topics ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.offline == nil {
+		r.offline = make(map[string]struct{})
+	}
+	for _, t := range topics {
+		r.offline[subscriptionKey(t)] = struct{}{}
+	}
+}
+
+// takeUnsubscribedOffline returns, and clears, the store keys recorded by unsubscribedOffline
+func (r *subscriptionRegistry) takeUnsubscribedOffline() map[string]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := r.offline
+	r.offline = nil
+	return keys
+}
+
+// requested records that a subscription to topic (with the named handler, if handlerName is not empty) has been
+// requested. This must happen before the request is sent (so the SUBACK cannot be processed first); the returned
+// function reverts the change (restoring any existing subscription to topic) and must be called if the request
+// is not sent.
+func (r *subscriptionRegistry) requested(topic string, qos byte, handlerName string) (revert func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subs == nil {
+		r.subs = make(map[string]*SubscriptionInfo)
+	}
+	s, existed := r.subs[topic]
+	if !existed {
+		s = &SubscriptionInfo{Topic: topic}
+		r.subs[topic] = s
+	}
+	prev := *s
+	s.Qos, s.Pending, s.HandlerName = qos, true, handlerName
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !existed {
+			delete(r.subs, topic)
+			return
+		}
+		restored := prev
+		r.subs[topic] = &restored
+	}
+}
+
+// granted records the return codes from a SUBACK (topic -> return code) and returns those of the granted
+// subscriptions that have a named handler
+func (r *subscriptionRegistry) granted(result map[string]byte) (named []SubscriptionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for topic, rc := range result {
+		s, ok := r.subs[topic]
+		if !ok {
+			continue
+		}
+		if rc == 0x80 { // failure
+			r.forget(topic)
+			continue
+		}
+		s.GrantedQos, s.Pending = rc, false
+		if s.HandlerName != "" {
+			named = append(named, *s)
+		}
+	}
+	return named
+}
+
+// remove removes the subscriptions to topics (following Unsubscribe)
+func (r *subscriptionRegistry) remove(topics ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range topics {
+		r.forget(t)
+	}
+}
+
+// sessionLost removes acknowledged subscriptions; called when connecting without an existing session (pending
+// subscriptions are retained as they will be resent if ResumeSubs is set)
+func (r *subscriptionRegistry) sessionLost() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for t, s := range r.subs {
+		if !s.Pending {
+			r.forget(t)
+		}
+	}
+}
+
+// forget removes topic from the registry and any groups; r.mu must be held
+func (r *subscriptionRegistry) forget(topic string) {
+	delete(r.subs, topic)
+	for name, g := range r.groups {
+		delete(g, topic)
+		if len(g) == 0 {
+			delete(r.groups, name)
+		}
+	}
+}
+
+// addToGroup adds those of topics that are in the registry (i.e. have been requested and not refused) to the
+// named group (creating it if needed)
+func (r *subscriptionRegistry) addToGroup(name string, topics ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range topics {
+		if _, ok := r.subs[t]; !ok {
+			continue
+		}
+		if r.groups == nil {
+			r.groups = make(map[string]map[string]struct{})
+		}
+		g, ok := r.groups[name]
+		if !ok {
+			g = make(map[string]struct{})
+			r.groups[name] = g
+		}
+		g[t] = struct{}{}
+	}
+}
+
+// groupTopics returns, sorted, the topics in the named group that are not members of any other group (i.e.
+// those that should be unsubscribed when the group is)
+func (r *subscriptionRegistry) groupTopics(name string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var topics []string
+	for t := range r.groups[name] {
+		shared := false
+		for other, g := range r.groups {
+			if _, ok := g[t]; ok && other != name {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			topics = append(topics, t)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// removeGroup removes the named group (the subscriptions are not affected)
+func (r *subscriptionRegistry) removeGroup(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.groups, name)
+}
+
+// topics returns, sorted, the topic filters of all subscriptions
+func (r *subscriptionRegistry) topics() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	topics := make([]string, 0, len(r.subs))
+	for t := range r.subs {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// list returns the subscriptions sorted by topic; messages is called to retrieve the message count for each topic
+func (r *subscriptionRegistry) list(messages func(topic string) uint64) []SubscriptionInfo {
+	r.mu.Lock()
+	subs := make([]SubscriptionInfo, 0, len(r.subs))
+	for _, s := range r.subs {
+		subs = append(subs, *s)
+	}
+	r.mu.Unlock()
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+	for i := range subs {
+		subs[i].Messages = messages(subs[i].Topic)
+	}
+	return subs
+}
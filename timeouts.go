@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ConnectTimeouts splits ConnectTimeout (which limits the dial, TLS handshake and CONNECT/CONNACK exchange as a
+// whole) into separate limits so that, for example, a broker that accepts connections but never completes the TLS
+// handshake fails quickly while a slow network is still given time to dial. A zero field falls back to
+// ConnectTimeout, so the zero value retains the behaviour of ConnectTimeout alone. See SetConnectTimeouts.
+type ConnectTimeouts struct {
+	Dial         time.Duration // limit on opening the network connection to each broker (per attempt)
+	TLSHandshake time.Duration // limit on the TLS handshake (measured from when the dial completes)
+	Connack      time.Duration // limit on sending CONNECT and receiving CONNACK (measured from when the connection is open)
+	Overall      time.Duration // limit on Connect as a whole, including all brokers and retries; 0 = no limit
+}
+
+// ErrConnackTimeout is wrapped by the error returned when the broker does not respond to CONNECT within the
+// limit set with SetConnectTimeouts (it wraps ErrTimeout)
+var ErrConnackTimeout = fmt.Errorf("%w waiting for CONNACK", ErrTimeout)
+
+// ErrConnectDeadline is wrapped by the error returned by Connect when ConnectTimeouts.Overall passes before a
+// connection is established (it wraps ErrTimeout)
+var ErrConnectDeadline = fmt.Errorf("%w: connect deadline exceeded", ErrTimeout)
+
+// phaseTimeouts applies ConnectTimeouts.Dial to dialer and returns the limit on the TLS handshake (0 if the
+// handshake is part of the dial). Both are capped at limit, the time remaining for the attempt.
+func (c *client) phaseTimeouts(dialer *net.Dialer, limit time.Duration) (*net.Dialer, time.Duration) {
+	t := c.options.ConnectTimeouts
+	if t == (ConnectTimeouts{}) {
+		return dialer, 0
+	}
+	dial := dialer.Timeout
+	if t.Dial > 0 {
+		dial = t.Dial
+	}
+	if dial == 0 || dial > limit {
+		dial = limit
+	}
+	if dial == maxDuration {
+		dial = 0
+	}
+	d := *dialer
+	d.Timeout = dial
+	return &d, min(t.TLSHandshake, limit)
+}
+
+// connackDeadline returns the time by which the CONNECT/CONNACK exchange must complete; attemptDeadline is the
+// deadline that applies to the attempt as a whole (used when ConnectTimeouts.Connack is not set). The deadlines
+// passed in are measured by the client clock whereas the result is passed to net.Conn.SetDeadline, so is a wall
+// clock time.
+func (c *client) connackDeadline(attemptDeadline time.Time, deadline time.Time) time.Time {
+	now := c.clock.Now()
+	d := attemptDeadline
+	if t := c.options.ConnectTimeouts.Connack; t != 0 {
+		d = now.Add(t)
+		if !deadline.IsZero() && deadline.Before(d) {
+			d = deadline
+		}
+	}
+	return time.Now().Add(d.Sub(now))
+}
+
+// connackError reports err (from the CONNECT/CONNACK exchange) as ErrConnackTimeout if the deadline was hit
+func connackError(err error) error {
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrConnackTimeout, err)
+	}
+	return err
+}
+
+// tlsHandshake performs the TLS handshake over conn (which is closed if the handshake fails), allowing at most
+// timeout. This is used in place of tls.DialWithDialer when ConnectTimeouts.TLSHandshake is set.
+func tlsHandshake(conn net.Conn, broker *url.URL, tlsCfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	if tlsCfg.ServerName == "" && !tlsCfg.InsecureSkipVerify { // As per tls.DialWithDialer
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ServerName = broker.Hostname()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsCfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: TLS handshake not completed within %s", ErrTimeout, timeout)
+		}
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -17,10 +17,14 @@
 package mqtt
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/eclipse/paho.mqtt.golang/clock"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -29,8 +33,19 @@ import (
 // code and the underlying code responsible for sending and receiving
 // MQTT messages.
 type PacketAndToken struct {
-	p packets.ControlPacket
-	t tokenCompletor
+	p     packets.ControlPacket
+	t     tokenCompletor
+	batch []*PacketAndToken // PUBLISH packets to be written together (p and t will be nil)
+}
+
+// setError sets the error on the token (or, for a batch, each token)
+func (pt *PacketAndToken) setError(e error) {
+	if pt.t != nil {
+		pt.t.setError(e)
+	}
+	for _, b := range pt.batch {
+		b.setError(e)
+	}
 }
 
 // Token defines the interface for the tokens used to indicate when
@@ -57,6 +72,46 @@ type Token interface {
 	Error() error
 }
 
+// MultiErrorToken is implemented by tokens that retain the errors encountered whilst the
+// flow was in progress (e.g. each failed attempt when ConnectRetry is enabled), not just the
+// error that the flow completed with. All tokens returned by this package implement it.
+type MultiErrorToken interface {
+	Token
+
+	// Errors returns the errors recorded against the token in the order they occurred. The final
+	// entry will match Error() if the flow completed with an error. At most 16 errors are
+	// retained: the first error and the most recent (so a flow retried indefinitely is bounded).
+	Errors() []error
+}
+
+const maxTokenErrors = 16 // the maximum number of errors retained by a token (see MultiErrorToken)
+
+// CompletionToken is implemented by tokens that can call a function when the flow completes; this avoids the need
+// for a goroutine per token (waiting on Done) when handling large numbers of operations. All tokens returned by
+// this package implement it (see also OnComplete).
+type CompletionToken interface {
+	Token
+
+	// OnComplete registers fn to be called with the tokens error (nil if the flow was successful) once the flow
+	// completes (or immediately, in the calling goroutine, if it has already completed). Callbacks are called in
+	// the order registered and run in the goroutine that completes the flow (which may be one of the client's
+	// network routines), so must not block and must not wait on other tokens.
+	OnComplete(fn func(error))
+}
+
+// OnComplete calls fn with the error from t once t completes. If t implements CompletionToken then its OnComplete
+// method is used; otherwise a goroutine waits for t to complete.
+func OnComplete(t Token, fn func(error)) {
+	if ct, ok := t.(CompletionToken); ok {
+		ct.OnComplete(fn)
+		return
+	}
+	go func() {
+		<-t.Done()
+		fn(t.Error())
+	}()
+}
+
 type TokenErrorSetter interface {
 	setError(error)
 }
@@ -71,6 +126,15 @@ type baseToken struct {
 	m        sync.RWMutex
 	complete chan struct{}
 	err      error
+	errs     []error     // all errors recorded (including those that did not complete the flow)
+	clock    clock.Clock // used by WaitTimeout (nil = clock.Real); set before the token is returned to the user
+
+	callbacks []func(error) // registered with OnComplete and called when the flow completes
+}
+
+// setClock sets the clock used by WaitTimeout
+func (b *baseToken) setClock(c clock.Clock) {
+	b.clock = c
 }
 
 // Wait implements the Token Wait method.
@@ -81,14 +145,18 @@ func (b *baseToken) Wait() bool {
 
 // WaitTimeout implements the Token WaitTimeout method.
 func (b *baseToken) WaitTimeout(d time.Duration) bool {
-	timer := time.NewTimer(d)
+	c := b.clock
+	if c == nil {
+		c = clock.Real
+	}
+	timer := c.NewTimer(d)
 	select {
 	case <-b.complete:
 		if !timer.Stop() {
-			<-timer.C
+			<-timer.C()
 		}
 		return true
-	case <-timer.C:
+	case <-timer.C():
 	}
 
 	return false
@@ -100,11 +168,61 @@ func (b *baseToken) Done() <-chan struct{} {
 }
 
 func (b *baseToken) flowComplete() {
+	b.m.Lock()
 	select {
 	case <-b.complete:
+		b.m.Unlock()
+		return
 	default:
 		close(b.complete)
 	}
+	callbacks, err := b.callbacks, b.err
+	b.callbacks = nil
+	b.m.Unlock()
+	for _, fn := range callbacks { // called without the lock held so they may call methods on the token
+		fn(err)
+	}
+}
+
+// completeWhenAll completes b once all of tokens have completed (immediately if there are none); the error
+// joins any errors from tokens. Callbacks are used (rather than a goroutine) where tokens support them.
+func (b *baseToken) completeWhenAll(tokens []Token) {
+	var remaining atomic.Int32
+	remaining.Store(int32(len(tokens)) + 1) // the extra count prevents completion before all callbacks are registered
+	done := func(error) {
+		if remaining.Add(-1) != 0 {
+			return
+		}
+		var errs []error
+		for _, t := range tokens {
+			if err := t.Error(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) > 0 {
+			b.setError(errors.Join(errs...))
+			return
+		}
+		b.flowComplete()
+	}
+	for _, t := range tokens {
+		OnComplete(t, done)
+	}
+	done(nil)
+}
+
+// OnComplete implements the CompletionToken OnComplete method.
+func (b *baseToken) OnComplete(fn func(error)) {
+	b.m.Lock()
+	select {
+	case <-b.complete:
+		err := b.err
+		b.m.Unlock()
+		fn(err)
+	default:
+		b.callbacks = append(b.callbacks, fn)
+		b.m.Unlock()
+	}
 }
 
 func (b *baseToken) Error() error {
@@ -113,13 +231,45 @@ func (b *baseToken) Error() error {
 	return b.err
 }
 
+// Errors implements the MultiErrorToken Errors method.
+func (b *baseToken) Errors() []error {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	errs := make([]error, len(b.errs))
+	copy(errs, b.errs)
+	return errs
+}
+
 func (b *baseToken) setError(e error) {
 	b.m.Lock()
 	b.err = e
+	if e != nil {
+		b.recordError(e)
+	}
+	b.m.Unlock()
 	b.flowComplete()
+}
+
+// addError records an error that did not terminate the flow (e.g. a failed attempt that will be retried)
+func (b *baseToken) addError(e error) {
+	if e == nil {
+		return
+	}
+	b.m.Lock()
+	b.recordError(e)
 	b.m.Unlock()
 }
 
+// recordError appends e to errs, dropping the second oldest error (the first is retained as it often explains
+// the later ones) if maxTokenErrors have already been recorded. b.m must be held.
+func (b *baseToken) recordError(e error) {
+	if len(b.errs) >= maxTokenErrors {
+		copy(b.errs[1:], b.errs[2:])
+		b.errs = b.errs[:maxTokenErrors-1]
+	}
+	b.errs = append(b.errs, e)
+}
+
 func newToken(tType byte) tokenCompletor {
 	switch tType {
 	case packets.Connect:
@@ -164,7 +314,18 @@ func (c *ConnectToken) SessionPresent() bool {
 // required to provide information about calls to Publish()
 type PublishToken struct {
 	baseToken
-	messageID uint16
+	messageID   uint16
+	release     func() // from PooledPayload; called when the flow completes successfully
+	releaseOnce sync.Once
+}
+
+// flowComplete completes the token and, if the payload was a PooledPayload and the flow completed
+// successfully, releases the payload (the client no longer references it)
+func (p *PublishToken) flowComplete() {
+	if p.release != nil && p.Error() == nil {
+		p.releaseOnce.Do(p.release) // before completion so the payload is released when Wait returns
+	}
+	p.baseToken.flowComplete()
 }
 
 // MessageID returns the MQTT message ID that was assigned to the
@@ -184,11 +345,59 @@ type SubscribeToken struct {
 
 // Result returns a map of topics that were subscribed to along with
 // the matching return code from the broker. This is either the Qos
-// value of the subscription or an error code.
+// value of the subscription or an error code (0x80). Once the token has
+// completed successfully there is an entry for every topic requested.
 func (s *SubscribeToken) Result() map[string]byte {
 	s.m.RLock()
 	defer s.m.RUnlock()
-	return s.subResult
+	result := make(map[string]byte, len(s.subResult))
+	for t, rc := range s.subResult {
+		result[t] = rc
+	}
+	return result
+}
+
+// setResult records the return codes from the SUBACK (in the order the topics were requested) and returns the
+// error to be set on the token (nil if all subscriptions were granted).
+func (s *SubscribeToken) setResult(returnCodes []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var errs []error
+	for i, rc := range returnCodes {
+		if i >= len(s.subs) {
+			break
+		}
+		s.subResult[s.subs[i]] = rc
+		if rc == 0x80 { // failure
+			errs = append(errs, &SubscriptionError{Topic: s.subs[i], ReturnCode: rc})
+		}
+	}
+	if len(returnCodes) != len(s.subs) {
+		errs = append(errs, fmt.Errorf("suback contained %d return codes for %d topics", len(returnCodes), len(s.subs)))
+	}
+	return errors.Join(errs...)
+}
+
+// ErrSubscriptionRefused is wrapped by the errors set on a SubscribeToken when the broker refused one or more of
+// the subscriptions (see SubscriptionError).
+var ErrSubscriptionRefused = errors.New("subscription refused")
+
+// SubscriptionError is the error set on a SubscribeToken for each topic that the broker refused (returning the
+// failure code 0x80 in the SUBACK); where multiple topics were refused the errors are joined. It wraps
+// ErrSubscriptionRefused.
+type SubscriptionError struct {
+	Topic      string
+	ReturnCode byte
+}
+
+// Error implements the error interface
+func (e *SubscriptionError) Error() string {
+	return fmt.Sprintf("%s: %s (return code 0x%02x)", ErrSubscriptionRefused, e.Topic, e.ReturnCode)
+}
+
+// Unwrap returns ErrSubscriptionRefused
+func (e *SubscriptionError) Unwrap() error {
+	return ErrSubscriptionRefused
 }
 
 // UnsubscribeToken is an extension of Token containing the extra fields
@@ -220,3 +429,57 @@ func WaitTokenTimeout(t Token, d time.Duration) error {
 	}
 	return t.Error()
 }
+
+// WaitTokenContext waits for the token to complete or the context to be done (whichever happens
+// first). It returns the tokens error if the token completed, otherwise ctx.Err().
+// This simplifies using tokens with errgroup and other context based APIs, e.g.
+//
+//	g.Go(func() error { return mqtt.WaitTokenContext(ctx, client.Publish("topic", 1, false, "msg")) })
+//
+// As with WaitTokenTimeout, if the context is done first the operation may still be running.
+func WaitTokenContext(ctx context.Context, t Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeliveryReceipt is delivered by PublishAsync once the flow for a message completes
+type DeliveryReceipt struct {
+	MessageID uint16    // MQTT message ID assigned to the message (0 for QoS 0 messages)
+	Completed time.Time // when the flow completed
+	Err       error     // nil if the message was delivered (as per Token.Error)
+}
+
+// PublishRequest holds the details of a message to be published with PublishBatch
+type PublishRequest struct {
+	Topic    string
+	Qos      byte
+	Retained bool
+	Payload  interface{}   // As per Publish
+	Expiry   time.Duration // As per PublishOptions
+}
+
+// BatchToken is returned by PublishBatch; it completes when the flows for all messages in the
+// batch have completed. Error returns the errors of any messages that failed (joined).
+type BatchToken struct {
+	baseToken
+	tokens []*PublishToken
+}
+
+func newBatchToken(tokens []*PublishToken) *BatchToken {
+	b := &BatchToken{baseToken: baseToken{complete: make(chan struct{})}, tokens: tokens}
+	ts := make([]Token, len(tokens))
+	for i, t := range tokens {
+		ts[i] = t
+	}
+	b.completeWhenAll(ts)
+	return b
+}
+
+// Tokens returns the tokens for the individual messages (in the same order as the requests)
+func (b *BatchToken) Tokens() []*PublishToken {
+	return b.tokens
+}
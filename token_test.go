@@ -17,9 +17,13 @@
 package mqtt
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 func TestWaitTimeout(t *testing.T) {
@@ -58,3 +62,68 @@ func TestWaitTokenTimeout(t *testing.T) {
 		t.Fatal("Unexpected error received")
 	}
 }
+
+func TestTokenErrors(t *testing.T) {
+	b := newToken(packets.Connect).(*ConnectToken)
+	if _, ok := tokenCompletor(b).(MultiErrorToken); !ok {
+		t.Fatal("ConnectToken should implement MultiErrorToken")
+	}
+
+	first := errors.New("first attempt")
+	final := errors.New("final attempt")
+	b.addError(first)
+	select {
+	case <-b.Done():
+		t.Fatal("addError should not complete the token")
+	default:
+	}
+	b.setError(final)
+
+	errs := b.Errors()
+	if len(errs) != 2 || errs[0] != first || errs[1] != final {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if b.Error() != final {
+		t.Fatalf("Error() should return the final error, got %v", b.Error())
+	}
+}
+
+func TestTokenErrorsLimit(t *testing.T) {
+	b := newToken(packets.Connect).(*ConnectToken)
+	attempts := make([]error, 3*maxTokenErrors)
+	for i := range attempts {
+		attempts[i] = fmt.Errorf("attempt %d", i)
+		b.addError(attempts[i])
+	}
+	final := errors.New("final attempt")
+	b.setError(final)
+
+	errs := b.Errors()
+	if len(errs) != maxTokenErrors {
+		t.Fatalf("expected %d errors, got %d", maxTokenErrors, len(errs))
+	}
+	if errs[0] != attempts[0] || errs[len(errs)-1] != final {
+		t.Fatalf("expected the first and final errors to be retained, got %v", errs)
+	}
+	for i, err := range errs[1 : len(errs)-1] { // the most recent attempts, in order
+		if want := attempts[len(attempts)-maxTokenErrors+2+i]; err != want {
+			t.Fatalf("expected %v at %d, got %v", want, i+1, err)
+		}
+	}
+}
+
+func TestWaitTokenContext(t *testing.T) {
+	b := baseToken{complete: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if !errors.Is(WaitTokenContext(ctx, &b), context.DeadlineExceeded) {
+		t.Fatal("Should have failed")
+	}
+
+	testError := errors.New("test")
+	b.setError(testError)
+	if !errors.Is(WaitTokenContext(context.Background(), &b), testError) {
+		t.Fatal("Unexpected error received")
+	}
+}
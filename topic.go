@@ -21,6 +21,7 @@ package mqtt
 import (
 	"errors"
 	"strings"
+	"unicode/utf8"
 )
 
 // ErrInvalidQos is the error returned when an packet is to be sent
@@ -36,6 +37,26 @@ var ErrInvalidTopicEmptyString = errors.New("invalid Topic; empty string")
 // the last
 var ErrInvalidTopicMultilevel = errors.New("invalid Topic; multi-level wildcard must be last level")
 
+// ErrInvalidTopicWildcardLevel is the error returned when a topic filter
+// contains a wildcard that does not occupy an entire level (e.g. "a/b+")
+var ErrInvalidTopicWildcardLevel = errors.New("invalid Topic; wildcards must occupy an entire level")
+
+// ErrInvalidTopicWildcard is the error returned when a topic name (i.e.
+// the topic passed to Publish) contains a wildcard character
+var ErrInvalidTopicWildcard = errors.New("invalid Topic; topic names must not contain wildcards")
+
+// ErrInvalidTopicLength is the error returned when a topic string is
+// longer than 65535 bytes (the maximum that can be encoded)
+var ErrInvalidTopicLength = errors.New("invalid Topic; must not exceed 65535 bytes")
+
+// ErrInvalidTopicUTF8 is the error returned when a topic string is not
+// valid UTF-8 or contains the null character (U+0000)
+var ErrInvalidTopicUTF8 = errors.New("invalid Topic; must be valid UTF-8 and not contain U+0000")
+
+// ErrInvalidSharedSubscription is the error returned when a shared subscription topic filter
+// is not of the form $share/<group>/<filter> (the group must not be empty or contain wildcards)
+var ErrInvalidSharedSubscription = errors.New("invalid Topic; shared subscription must be of the form $share/<group>/<filter>")
+
 // Topic Names and Topic Filters
 // The MQTT v3.1.1 spec clarifies a number of ambiguities with regard
 // to the validity of Topic strings.
@@ -52,6 +73,60 @@ var ErrInvalidTopicMultilevel = errors.New("invalid Topic; multi-level wildcard
 // - A TopicFilter may contain any number of + (single-level) wildcards.
 // - A TopicFilter with a # will match the absence of a level
 //     Example:  a subscription to "foo/#" will match messages published to "foo".
+// - A Topic beginning with $ is reserved for server use but is not rejected
+//     (some brokers, e.g. AWS IoT, accept publications to $ prefixed topics).
+
+// ValidateTopicFilter checks that filter is a valid topic filter (as passed to Subscribe) and returns
+// one of the ErrInvalidTopic* errors (or ErrInvalidSharedSubscription) if it is not. Subscribe carries
+// out this check before sending anything to the broker (most brokers drop the connection when sent an
+// invalid filter).
+func ValidateTopicFilter(filter string) error {
+	if err := validateTopicString(filter); err != nil {
+		return err
+	}
+	if strings.HasPrefix(filter, sharePrefix) {
+		group, shared, _ := parseSharedSubscription(filter)
+		if !validShareGroup(group) || len(shared) == 0 {
+			return ErrInvalidSharedSubscription
+		}
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return ErrInvalidTopicMultilevel
+		}
+		if len(level) > 1 && strings.ContainsAny(level, "+#") {
+			return ErrInvalidTopicWildcardLevel
+		}
+	}
+	return nil
+}
+
+// ValidateTopicName checks that topic is a valid topic name (as passed to Publish) and returns one of
+// the ErrInvalidTopic* errors if it is not. Publish carries out this check before sending anything
+// to the broker.
+func ValidateTopicName(topic string) error {
+	if err := validateTopicString(topic); err != nil {
+		return err
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return ErrInvalidTopicWildcard
+	}
+	return nil
+}
+
+// validateTopicString applies the rules common to topic names and filters
+func validateTopicString(topic string) error {
+	switch {
+	case len(topic) == 0:
+		return ErrInvalidTopicEmptyString
+	case len(topic) > 65535:
+		return ErrInvalidTopicLength
+	case !utf8.ValidString(topic) || strings.ContainsRune(topic, 0):
+		return ErrInvalidTopicUTF8
+	}
+	return nil
+}
 
 func validateSubscribeMap(subs map[string]byte) ([]string, []byte, error) {
 	if len(subs) == 0 {
@@ -72,19 +147,45 @@ func validateSubscribeMap(subs map[string]byte) ([]string, []byte, error) {
 }
 
 func validateTopicAndQos(topic string, qos byte) error {
-	if len(topic) == 0 {
-		return ErrInvalidTopicEmptyString
+	if err := ValidateTopicFilter(topic); err != nil {
+		return err
 	}
-
-	levels := strings.Split(topic, "/")
-	for i, level := range levels {
-		if level == "#" && i != len(levels)-1 {
-			return ErrInvalidTopicMultilevel
-		}
+	if qos > 2 {
+		return ErrInvalidQos
 	}
+	return nil
+}
 
+// validatePublish checks the topic and QoS passed to Publish
+func validatePublish(topic string, qos byte) error {
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
 	if qos > 2 {
 		return ErrInvalidQos
 	}
 	return nil
 }
+
+const (
+	sharePrefix = "$share/"
+	queuePrefix = "$queue/" // Non-standard shared subscription without a group (supported by some brokers)
+)
+
+// parseSharedSubscription splits a shared subscription topic filter ($share/<group>/<filter> or
+// $queue/<filter>) into its group and filter; ok will be false if topic is not a shared subscription.
+func parseSharedSubscription(topic string) (group, filter string, ok bool) {
+	switch {
+	case strings.HasPrefix(topic, sharePrefix):
+		group, filter, _ = strings.Cut(strings.TrimPrefix(topic, sharePrefix), "/")
+		return group, filter, true
+	case strings.HasPrefix(topic, queuePrefix):
+		return "", strings.TrimPrefix(topic, queuePrefix), true
+	}
+	return "", topic, false
+}
+
+// validShareGroup returns true if group is a valid share name [MQTT-4.8.2-2]
+func validShareGroup(group string) bool {
+	return len(group) > 0 && !strings.ContainsAny(group, "/+#")
+}
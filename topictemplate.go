@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidTopicTemplate is the error returned by ParseTopicTemplate when the template is not valid
+var ErrInvalidTopicTemplate = errors.New("invalid topic template")
+
+// RouteMatcher is implemented by matchers that can be passed to MatcherRouter.AddMatcherRoute. Matchers extend
+// the standard MQTT topic matching by extracting named parameters from the topic (see ParseTopicTemplate
+// and NewRegexpMatcher).
+type RouteMatcher interface {
+	// String identifies the route; passing this to Client.DeleteRoute removes it.
+	String() string
+	// Filter returns an MQTT topic filter that matches (at least) all of the topics matched by the
+	// matcher; this is the filter to pass to Subscribe.
+	Filter() string
+	// Match returns the parameters extracted from topic and true if the topic matches.
+	Match(topic string) (params map[string]string, ok bool)
+}
+
+// TopicParamsMessage is implemented by the Messages passed to handlers added with MatcherRouter.AddMatcherRoute
+type TopicParamsMessage interface {
+	Message
+	// Params returns the parameters extracted from the topic (the map must not be modified)
+	Params() map[string]string
+	// Param returns the value of the named parameter ("" if there is no such parameter)
+	Param(name string) string
+}
+
+// topicParams implements the TopicParamsMessage methods
+type topicParams map[string]string
+
+func (p topicParams) Params() map[string]string { return p }
+func (p topicParams) Param(name string) string  { return p[name] }
+
+// paramsMessage is a message passed to a handler added with AddMatcherRoute
+type paramsMessage struct {
+	*message
+	topicParams
+	filter string
+}
+
+func (m *paramsMessage) MatchedFilter() string {
+	return m.filter
+}
+
+// sharedParamsMessage is a message passed to a handler added with AddMatcherRoute for a shared subscription
+type sharedParamsMessage struct {
+	*sharedMessage
+	topicParams
+}
+
+// TopicTemplate is a RouteMatcher that matches topics against a template containing named parameters, e.g.
+// "devices/{deviceID}/state" matches "devices/d1/state" with the parameter deviceID = "d1". A parameter
+// must occupy an entire topic level; a final parameter with the suffix "..." (e.g. "logs/{path...}")
+// matches any number of levels (like the '#' wildcard) and its value is the remaining levels joined by '/'.
+// The standard wildcards ('+' and '#') may also be used and a template may be for a shared subscription
+// ("$share/<group>/...").
+type TopicTemplate struct {
+	template string
+	filter   string
+	levels   []templateLevel // levels of the template (excluding any shared subscription prefix)
+}
+
+// templateLevel is one level of a TopicTemplate
+type templateLevel struct {
+	literal string // the literal value (including "+" and "#") if param is ""
+	param   string // parameter name
+	rest    bool   // true if this level matches all remaining levels
+}
+
+// ParseTopicTemplate parses template (see TopicTemplate); errors wrap ErrInvalidTopicTemplate.
+func ParseTopicTemplate(template string) (*TopicTemplate, error) {
+	t := &TopicTemplate{template: template}
+	_, tmpl, shared := parseSharedSubscription(template)
+	prefix := template[:len(template)-len(tmpl)]
+	if shared && tmpl == "" {
+		return nil, fmt.Errorf("%w: %q has no topic filter", ErrInvalidTopicTemplate, template)
+	}
+	levels := strings.Split(tmpl, "/")
+	names := make(map[string]bool)
+	filter := make([]string, 0, len(levels))
+	for i, level := range levels {
+		last := i == len(levels)-1
+		var l templateLevel
+		switch {
+		case strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}"):
+			name := level[1 : len(level)-1]
+			if name, l.rest = strings.CutSuffix(name, "..."); l.rest && !last {
+				return nil, fmt.Errorf("%w: %q; {%s...} must be the last level", ErrInvalidTopicTemplate, template, name)
+			}
+			if name == "" || strings.ContainsAny(name, "{}+#") {
+				return nil, fmt.Errorf("%w: %q; invalid parameter name %q", ErrInvalidTopicTemplate, template, name)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("%w: %q; duplicate parameter %q", ErrInvalidTopicTemplate, template, name)
+			}
+			names[name] = true
+			l.param = name
+			if l.rest {
+				filter = append(filter, "#")
+			} else {
+				filter = append(filter, "+")
+			}
+		case strings.ContainsAny(level, "{}"):
+			return nil, fmt.Errorf("%w: %q; parameters must occupy an entire level", ErrInvalidTopicTemplate, template)
+		default:
+			l.literal, l.rest = level, level == "#"
+			filter = append(filter, level)
+		}
+		t.levels = append(t.levels, l)
+	}
+	t.filter = prefix + strings.Join(filter, "/")
+	if err := ValidateTopicFilter(t.filter); err != nil {
+		return nil, fmt.Errorf("%w: %q; %w", ErrInvalidTopicTemplate, template, err)
+	}
+	return t, nil
+}
+
+// MustParseTopicTemplate is like ParseTopicTemplate but panics if the template is invalid
+func MustParseTopicTemplate(template string) *TopicTemplate {
+	t, err := ParseTopicTemplate(template)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the template
+func (t *TopicTemplate) String() string { return t.template }
+
+// Filter returns the template with parameters replaced by wildcards (e.g. "devices/+/state")
+func (t *TopicTemplate) Filter() string { return t.filter }
+
+// Match returns the parameters extracted from topic and true if topic matches the template
+func (t *TopicTemplate) Match(topic string) (map[string]string, bool) {
+	levels := strings.Split(topic, "/")
+	// Wildcards do not match topics beginning with '$' [MQTT-4.7.2-1]
+	if (t.levels[0].param != "" || t.levels[0].literal == "+" || t.levels[0].rest) && strings.HasPrefix(topic, "$") {
+		return nil, false
+	}
+	params := make(map[string]string, len(t.levels))
+	for i, l := range t.levels {
+		if l.rest {
+			if l.param != "" {
+				if i < len(levels) {
+					params[l.param] = strings.Join(levels[i:], "/")
+				} else {
+					params[l.param] = ""
+				}
+			}
+			return params, i <= len(levels)
+		}
+		if i >= len(levels) {
+			return nil, false
+		}
+		switch {
+		case l.param != "":
+			params[l.param] = levels[i]
+		case l.literal != "+" && l.literal != levels[i]:
+			return nil, false
+		}
+	}
+	if len(levels) != len(t.levels) {
+		return nil, false
+	}
+	return params, true
+}
+
+// regexpMatcher is a RouteMatcher that matches topics using a regular expression
+type regexpMatcher struct {
+	filter string
+	re     *regexp.Regexp
+}
+
+// NewRegexpMatcher returns a RouteMatcher that matches topics that match both the MQTT topic filter and the
+// regular expression re; the parameters are the named capture groups (e.g. `^sensors/(?P<room>[a-z]+)/temp$`).
+// Note that the expression is not implicitly anchored.
+func NewRegexpMatcher(filter string, re *regexp.Regexp) RouteMatcher {
+	return &regexpMatcher{filter: filter, re: re}
+}
+
+// String returns the regular expression
+func (r *regexpMatcher) String() string { return r.re.String() }
+
+// Filter returns the MQTT topic filter
+func (r *regexpMatcher) Filter() string { return r.filter }
+
+// Match returns the named capture groups and true if topic matches both the filter and regular expression
+func (r *regexpMatcher) Match(topic string) (map[string]string, bool) {
+	if !routeIncludesTopic(r.filter, topic) {
+		return nil, false
+	}
+	m := r.re.FindStringSubmatch(topic)
+	if m == nil {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, name := range r.re.SubexpNames() {
+		if name != "" {
+			params[name] = m[i]
+		}
+	}
+	return params, true
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_AzureSASToken(t *testing.T) {
+	token, err := AzureSASToken("myhub.azure-devices.net/devices/dev1", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", "", time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// generated independently
+	if want := "SharedAccessSignature sr=myhub.azure-devices.net%2Fdevices%2Fdev1&sig=wosmA3uJK9T0mdB5CIYn%2BsAVA2ODflnucuvNO5S6mbM%3D&se=1700000000"; token != want {
+		t.Fatalf("expected %q, got %q", want, token)
+	}
+	if _, err = AzureSASToken("x", "not base64!", "", time.Now()); err == nil {
+		t.Fatal("expected error for invalid key")
+	}
+}
+
+func Test_AzureIoTHub(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// hub simulates the twin and direct method endpoints of IoT Hub
+	hub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("hub"))
+	if token := hub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer hub.Disconnect(0)
+	methodResponses := make(chan string, 1)
+	if token := hub.SubscribeMultiple(map[string]byte{"$iothub/twin/GET/#": 0, "$iothub/twin/PATCH/properties/reported/#": 0, "$iothub/methods/res/#": 0}, func(c Client, m Message) {
+		rid := topicQuery(m.Topic()).Get("$rid")
+		switch {
+		case strings.HasPrefix(m.Topic(), "$iothub/twin/GET/"):
+			c.Publish("$iothub/twin/res/200/?$rid="+rid, 0, false, `{"desired":{}}`)
+		case strings.HasPrefix(m.Topic(), "$iothub/twin/PATCH/"):
+			c.Publish("$iothub/twin/res/204/?$rid="+rid+"&$version=5", 0, false, "")
+		default:
+			methodResponses <- m.Topic() + " " + string(m.Payload())
+		}
+	}); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	var mu sync.Mutex
+	var connects []*packets.ConnectPacket
+	lost := make(chan error, 1)
+	o := NewClientOptions().
+		SetPacketHook(func(d Direction, cp packets.ControlPacket) {
+			if c, ok := cp.(*packets.ConnectPacket); ok {
+				mu.Lock()
+				connects = append(connects, c)
+				mu.Unlock()
+			}
+		}).
+		SetConnectionLostHandler(func(_ Client, err error) { lost <- err }).
+		SetMaxReconnectInterval(10 * time.Millisecond)
+	h, err := NewAzureIoTHub(o, AzureIoTHubOptions{
+		ConnectionString: "HostName=myhub.azure-devices.net;DeviceId=dev1;SharedAccessKey=MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		TokenLifetime:    2 * time.Second,
+		RenewBefore:      time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Servers[0].String() != "mqtts://myhub.azure-devices.net:8883" || o.ClientID != "dev1" {
+		t.Fatalf("unexpected options %v %q", o.Servers, o.ClientID)
+	}
+	o.Servers = nil
+	o.AddBroker(b.URL()) // connect to the test broker instead
+	c := NewClient(o)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+
+	ctx := context.Background()
+	if twin, err := h.GetTwin(ctx, c); err != nil || string(twin) != `{"desired":{}}` {
+		t.Fatalf("unexpected twin %q, %v", twin, err)
+	}
+	if version, err := h.UpdateReportedProperties(ctx, c, []byte(`{"a":1}`)); err != nil || version != 5 {
+		t.Fatalf("unexpected result %d, %v", version, err)
+	}
+	if token := h.SubscribeMethods(c, func(method string, payload []byte) (int, []byte) {
+		return 200, []byte(`"` + method + string(payload) + `"`)
+	}); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	hub.Publish("$iothub/methods/POST/reboot/?$rid=9", 0, false, "1")
+	select {
+	case r := <-methodResponses:
+		if r != `$iothub/methods/res/200/?$rid=9 "reboot1"` {
+			t.Fatalf("unexpected method response %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for method response")
+	}
+
+	// the connection is cycled before the token expires
+	select {
+	case err := <-lost:
+		if !errors.Is(err, ErrCredentialsExpiring) {
+			t.Fatalf("expected ErrCredentialsExpiring, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for renewal")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(connects)
+		mu.Unlock()
+		if n >= 2 && c.IsConnectionOpen() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for reconnection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	first, second := connects[0], connects[1]
+	if first.Username != "myhub.azure-devices.net/dev1/?api-version="+AzureIoTHubAPIVersion {
+		t.Fatalf("unexpected username %q", first.Username)
+	}
+	if !strings.HasPrefix(string(first.Password), "SharedAccessSignature sr=myhub.azure-devices.net%2Fdevices%2Fdev1&sig=") || string(first.Password) == string(second.Password) {
+		t.Fatalf("expected a new token on reconnection: %q, %q", first.Password, second.Password)
+	}
+
+	// a graceful disconnection cancels the renewal
+	h.Disconnect(c, 0)
+	h.mu.Lock()
+	renew := h.renew
+	h.mu.Unlock()
+	if renew != nil {
+		t.Fatal("renewal still scheduled following Disconnect")
+	}
+}
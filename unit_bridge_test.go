@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func Test_Bridge(t *testing.T) {
+	localBroker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localBroker.Close()
+	remoteBroker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteBroker.Close()
+
+	b := NewBridge(
+		NewClientOptions().AddBroker(localBroker.URL()).SetClientID("bridge-local"),
+		NewClientOptions().AddBroker(remoteBroker.URL()).SetClientID("bridge-remote"),
+		BridgeRule{Direction: BridgeOut, Filter: "sensors/#", Qos: 1, TargetPrefix: "site1/"},
+		BridgeRule{Direction: BridgeIn, Filter: "site1/cmd/#", Qos: 1, SourcePrefix: "site1/"},
+		// Forwarded in both directions (loop prevention required; messages forwarded to the remote broker are
+		// marked with the TargetPrefix so are not returned)
+		BridgeRule{Direction: BridgeOut, Filter: "shared/#", Qos: 1, TargetPrefix: "mirror/"},
+		BridgeRule{Direction: BridgeIn, Filter: "mirror/#", Qos: 1},
+	)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop(250)
+
+	connect := func(url, id string) Client {
+		c := NewClient(NewClientOptions().AddBroker(url).SetClientID(id))
+		if token := c.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+		return c
+	}
+	local := connect(localBroker.URL(), "local")
+	defer local.Disconnect(250)
+	remote := connect(remoteBroker.URL(), "remote")
+	defer remote.Disconnect(250)
+
+	received := make(chan string, 10)
+	var sharedCount atomic.Int32
+	local.Subscribe("cmd/#", 1, func(_ Client, m Message) { received <- "local:" + m.Topic() }).Wait()
+	local.Subscribe("mirror/#", 1, func(_ Client, m Message) { sharedCount.Add(1) }).Wait()
+	remote.Subscribe("site1/sensors/#", 1, func(_ Client, m Message) { received <- "remote:" + m.Topic() }).Wait()
+	remote.Subscribe("mirror/#", 1, func(_ Client, m Message) { received <- "remote:" + m.Topic() }).Wait()
+
+	expect := func(exp string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != exp {
+				t.Fatalf("expected %s, got %s", exp, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", exp)
+		}
+	}
+	local.Publish("sensors/temp", 1, false, "21").Wait()
+	expect("remote:site1/sensors/temp")
+	remote.Publish("site1/cmd/reboot", 1, false, "now").Wait()
+	expect("local:cmd/reboot")
+
+	local.Publish("shared/x", 1, false, "1").Wait()
+	expect("remote:mirror/shared/x")
+	remote.Publish("mirror/other", 1, false, "2").Wait() // not published by the bridge so is forwarded
+	expect("remote:mirror/other")
+	deadline := time.Now().Add(time.Second)
+	for sharedCount.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("mirror/other not forwarded to local broker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The remote broker has now delivered mirror/shared/x and mirror/other to the bridge (and local subscribers
+	// receive messages in order) so, had it been forwarded, mirror/shared/x would have arrived first
+	if n := sharedCount.Load(); n != 1 {
+		t.Errorf("expected local subscriber to receive one message, got %d (loop?)", n)
+	}
+	select {
+	case got := <-received:
+		t.Fatalf("unexpected message %s (loop?)", got)
+	default:
+	}
+}
+
+// Test_BridgeSubscribeRefused checks that Start returns an error if the bridge's subscriptions are refused
+func Test_BridgeSubscribeRefused(t *testing.T) {
+	localBroker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localBroker.Close()
+	remoteBroker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteBroker.Close()
+
+	b := NewBridge(
+		NewClientOptions().AddBroker(localBroker.URL()).SetClientID("bridge-local"),
+		NewClientOptions().AddBroker(remoteBroker.URL()).SetClientID("bridge-remote"),
+		BridgeRule{Direction: BridgeOut, Filter: "a/#/b", Qos: 1}, // invalid filter
+	)
+	defer b.Stop(0)
+	if err := b.Start(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func Test_BridgeRuleSourceTopicMatches(t *testing.T) {
+	for _, tc := range []struct {
+		rule  BridgeRule
+		topic string
+		match bool
+	}{
+		{BridgeRule{Filter: "shared/#", TargetPrefix: "mirror/"}, "mirror/shared/x", true},
+		{BridgeRule{Filter: "shared/#", TargetPrefix: "mirror/"}, "mirror/other", false},
+		{BridgeRule{Filter: "shared/#", TargetPrefix: "mirror/"}, "shared/x", false},
+		{BridgeRule{Filter: "site1/cmd/#", SourcePrefix: "site1/", TargetPrefix: "remote/"}, "remote/cmd/x", true},
+		{BridgeRule{Filter: "shared/#"}, "shared/x", false}, // no marker
+	} {
+		if got := tc.rule.sourceTopicMatches(tc.topic); got != tc.match {
+			t.Errorf("%+v %s: expected %t", tc.rule, tc.topic, tc.match)
+		}
+	}
+}
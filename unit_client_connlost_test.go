@@ -23,10 +23,14 @@ import (
 	"errors"
 	"log/slog"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
 )
 
 // syncBuffer is a goroutine-safe buffer. internalConnLost performs its work (and
@@ -97,3 +101,179 @@ func Test_internalConnLost_NoBugLogWhenAutoReconnectDisabled(t *testing.T) {
 		t.Fatalf("spurious bug log emitted when AutoReconnect is disabled:\n%s", got)
 	}
 }
+
+func Test_ServerDisconnect(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	lost := make(chan error, 1)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("srvdisc").SetAutoReconnect(false).
+		SetConnectionLostHandler(func(_ Client, err error) { lost <- err }))
+	for _, tc := range []struct {
+		name       string
+		disconnect func() error
+		reasonCode byte
+	}{
+		{"v3", func() error { return b.Disconnect("srvdisc") }, 0},
+		{"v5", func() error {
+			if err := b.SendRaw("srvdisc", []byte{0xE0, 0x02, 0x8E, 0x00}); err != nil {
+				return err
+			}
+			return b.DropConnection("srvdisc")
+		}, 0x8E},
+	} {
+		if token := c.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+		if err := tc.disconnect(); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		select {
+		case err := <-lost:
+			var sde *ServerDisconnectError
+			if !errors.Is(err, ErrServerDisconnected) || !errors.As(err, &sde) || sde.ReasonCode != tc.reasonCode {
+				t.Fatalf("%s: expected ServerDisconnectError with reason code %d, got %v", tc.name, tc.reasonCode, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: connection lost handler not called", tc.name)
+		}
+		for c.IsConnected() {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+// stallingConn blocks writes, ignoring any deadline, once stall is set (until the connection is closed)
+type stallingConn struct {
+	net.Conn
+	stall     atomic.Bool
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (s *stallingConn) Write(b []byte) (int, error) {
+	if s.stall.Load() {
+		<-s.closed
+		return 0, net.ErrClosed
+	}
+	return s.Conn.Write(b)
+}
+
+func (s *stallingConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (s *stallingConn) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.Conn.Close()
+}
+
+func Test_guardedWrite(t *testing.T) {
+	client, server := net.Pipe() // nothing reads from server so writes block until the deadline
+	defer server.Close()
+	defer client.Close()
+
+	err := guardedWrite(client, 0, 50*time.Millisecond, noopSLogger, func() error {
+		_, err := client.Write([]byte("test"))
+		return err
+	})
+	if !errors.Is(err, ErrWriteStalled) { // the deadline, or watchdog closing the connection, may end the write
+		t.Fatalf("expected ErrWriteStalled, got %v", err)
+	}
+
+	// A write timeout shorter than the stall timeout is not reported as a stall
+	client2, server2 := net.Pipe()
+	defer server2.Close()
+	defer client2.Close()
+	err = guardedWrite(client2, 20*time.Millisecond, time.Second, noopSLogger, func() error {
+		_, err := client2.Write([]byte("test"))
+		return err
+	})
+	if errors.Is(err, ErrWriteStalled) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+func Test_WriteStallTimeout(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	var conn *stallingConn
+	lost := make(chan error, 1)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetAutoReconnect(false).
+		SetWriteStallTimeout(100 * time.Millisecond).
+		SetConnWrapper(func(nc net.Conn) net.Conn {
+			conn = &stallingConn{Conn: nc, closed: make(chan struct{})}
+			return conn
+		}).
+		SetConnectionLostHandler(func(_ Client, err error) { lost <- err }))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+
+	conn.stall.Store(true)
+	token := c.Publish("test", 0, false, "stalled")
+	select {
+	case err := <-lost:
+		if !errors.Is(err, ErrWriteStalled) {
+			t.Fatalf("expected ErrWriteStalled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not lost following stalled write")
+	}
+	if !token.WaitTimeout(5*time.Second) || !errors.Is(token.Error(), ErrWriteStalled) {
+		t.Fatalf("expected publish to fail with ErrWriteStalled, got %v", token.Error())
+	}
+}
+
+func Test_ConnectionLostStats(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	lost := make(chan ConnectionStats, 1)
+	ops := NewClientOptions().AddBroker(b.URL()).SetClientID("stats").SetAutoReconnect(false).
+		SetConnectionLostStatsHandler(func(_ Client, _ error, s ConnectionStats) { lost <- s })
+	c := NewClient(ops)
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	if token := c.Publish("stats/test", 1, false, "hello"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("publish failed: %v", token.Error())
+	}
+	if err := b.DropConnection("stats"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-lost:
+		if s.Broker == nil || s.Broker.String() != b.URL() {
+			t.Errorf("unexpected broker %v", s.Broker)
+		}
+		if s.ConnectedAt.IsZero() || s.Uptime <= 0 {
+			t.Errorf("expected connection time to be recorded: %v, %v", s.ConnectedAt, s.Uptime)
+		}
+		// CONNECT + PUBLISH sent; CONNACK + PUBACK received
+		if s.PacketsOut != 2 || s.PacketsIn != 2 {
+			t.Errorf("expected 2 packets each way, got %d out and %d in", s.PacketsOut, s.PacketsIn)
+		}
+		if s.BytesOut == 0 || s.BytesIn != 8 { // CONNACK and PUBACK are 4 bytes each
+			t.Errorf("unexpected byte counts: %d out and %d in", s.BytesOut, s.BytesIn)
+		}
+		if s.LastError == nil {
+			t.Error("expected the reason for the loss to be recorded")
+		}
+		if s.InflightPublishes != 0 || s.InflightIDs != 0 {
+			t.Errorf("expected no flows in progress, got %d publishes and %d ids", s.InflightPublishes, s.InflightIDs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stats handler not called")
+	}
+}
@@ -19,10 +19,23 @@
 package mqtt
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 func init() {
@@ -108,3 +121,470 @@ func Test_isConnectionOpenNegative(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_UpdateWill(t *testing.T) {
+	c := NewClient(NewClientOptions().SetWillMessage(&Will{Topic: "status", Payload: []byte("offline"), Qos: 1})).(*client)
+	broker, _ := url.Parse("tcp://127.0.0.1:1883")
+
+	payload := []byte(`{"state":"on"}`)
+	c.UpdateWill("status/device", payload, 2, true)
+	payload[0] = 'x' // UpdateWill should copy the payload
+	cm := newConnectMsgFromOptions(&c.options, broker)
+	if !cm.WillFlag || cm.WillTopic != "status/device" || string(cm.WillMessage) != `{"state":"on"}` || cm.WillQos != 2 || !cm.WillRetain {
+		t.Fatalf("unexpected will in connect packet: %s", cm.String())
+	}
+	r := c.OptionsReader()
+	if w := r.Will(); w == nil || w.Topic != "status/device" {
+		t.Fatalf("unexpected will from options reader: %+v", w)
+	}
+
+	c.UpdateWill("", nil, 0, false)
+	if cm := newConnectMsgFromOptions(&c.options, broker); cm.WillFlag {
+		t.Fatal("will should have been removed")
+	}
+	if r := c.OptionsReader(); r.Will() != nil {
+		t.Fatal("will should have been removed")
+	}
+}
+
+// Test_UpdateWillConcurrent changes the will whilst the client reconnects; run with -race
+func Test_UpdateWillConcurrent(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	connected := make(chan struct{}, 1)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetAutoReconnect(true).
+		SetMaxReconnectInterval(10 * time.Millisecond).
+		SetOnConnectHandler(func(Client) { connected <- struct{}{} }))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	<-connected
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.(WillUpdater).UpdateWill("status", []byte(strconv.Itoa(i)), 1, false)
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		b.DropConnections()
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("client did not reconnect")
+		}
+		r := c.OptionsReader()
+		if w := r.Will(); w == nil || w.Topic != "status" {
+			t.Fatalf("unexpected will: %+v", w)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func Test_ConnectionState(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	w := c.(ConnectionWaiter)
+	if s := w.ConnectionState(); s != Disconnected {
+		t.Fatalf("expected disconnected, got %s", s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.WaitForConnection(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- w.WaitForConnection(context.Background()) }()
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForConnection did not return following connection")
+	}
+	if s := w.ConnectionState(); s != Connected {
+		t.Fatalf("expected connected, got %s", s)
+	}
+	c.Disconnect(250)
+	if s := w.ConnectionState(); s != Disconnected {
+		t.Fatalf("expected disconnected, got %s", s)
+	}
+}
+
+func Test_Subscriptions(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	received := make(chan struct{}, 1)
+	ops := NewClientOptions().AddBroker(b.URL()).
+		SetNamedHandler("named", func(Client, Message) { received <- struct{}{} })
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+
+	if token := c.(NamedSubscriber).SubscribeNamed("a/b", 1, "named"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := c.SubscribeMultiple(map[string]byte{"c/#": 2, "d/+": 0}, nil); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	b.Publish("a/b", 1, false, []byte("test"))
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	expected := []SubscriptionInfo{
+		{Topic: "a/b", Qos: 1, GrantedQos: 1, HandlerName: "named", Messages: 1},
+		{Topic: "c/#", Qos: 2, GrantedQos: 2},
+		{Topic: "d/+", Qos: 0, GrantedQos: 0},
+	}
+	if subs := c.(SubscriptionLister).Subscriptions(); !reflect.DeepEqual(subs, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, subs)
+	}
+
+	if token := c.Unsubscribe("c/#"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if subs := c.(SubscriptionLister).Subscriptions(); len(subs) != 2 || subs[1].Topic != "d/+" {
+		t.Fatalf("unexpected subscriptions following unsubscribe: %+v", subs)
+	}
+}
+
+func Test_SubscribeNamedPersistence(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.RefuseSubscriptions("refused")
+
+	store := NewMemoryStore()
+	ops := NewClientOptions().AddBroker(b.URL()).SetClientID("named").SetCleanSession(false).SetStore(store).
+		SetNamedHandler("named", func(Client, Message) {})
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+
+	if token := c.(NamedSubscriber).SubscribeNamed("granted", 1, "named"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := c.(NamedSubscriber).SubscribeNamed("refused", 1, "named"); token.Wait() && !errors.Is(token.Error(), ErrSubscriptionRefused) {
+		t.Fatalf("expected ErrSubscriptionRefused, got %v", token.Error())
+	}
+	if store.Get(subscriptionKey("granted")) == nil {
+		t.Fatal("granted subscription not stored")
+	}
+	if store.Get(subscriptionKey("refused")) != nil {
+		t.Fatal("refused subscription stored")
+	}
+}
+
+func Test_subscriptionRegistryRevert(t *testing.T) {
+	var r subscriptionRegistry
+	r.requested("a", 1, "h")
+	r.granted(map[string]byte{"a": 1})
+
+	r.requested("b", 0, "")() // not sent so reverted
+	r.requested("a", 2, "")()
+	expected := []SubscriptionInfo{{Topic: "a", Qos: 1, GrantedQos: 1, HandlerName: "h"}}
+	if subs := r.list(func(string) uint64 { return 0 }); !reflect.DeepEqual(subs, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, subs)
+	}
+}
+
+func Test_SubscriptionGroups(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.RefuseSubscriptions("refused")
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+
+	if token := c.(GroupSubscriber).SubscribeGroup("telemetry", map[string]byte{"t/1": 1, "t/2": 1, "shared": 0}, nil); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	c.(GroupSubscriber).SubscribeGroup("control", map[string]byte{"c/1": 1, "shared": 0, "refused": 0}, nil).Wait()
+	if token := c.Subscribe("other", 0, nil); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	topics := func() (topics []string) {
+		for _, s := range c.(SubscriptionLister).Subscriptions() {
+			topics = append(topics, s.Topic)
+		}
+		return topics
+	}
+
+	if token := c.(GroupSubscriber).UnsubscribeGroup("telemetry"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if s := topics(); !reflect.DeepEqual(s, []string{"c/1", "other", "shared"}) {
+		t.Fatalf("unexpected subscriptions following UnsubscribeGroup(telemetry): %v", s)
+	}
+	if token := c.(GroupSubscriber).UnsubscribeGroup("telemetry"); !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("UnsubscribeGroup of unknown group failed: %v", token.Error())
+	}
+	if token := c.(GroupSubscriber).UnsubscribeGroup("control"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if s := topics(); !reflect.DeepEqual(s, []string{"other"}) {
+		t.Fatalf("unexpected subscriptions following UnsubscribeGroup(control): %v", s)
+	}
+
+	c.Subscribe("another", 0, nil).Wait()
+	if token := c.(GroupSubscriber).UnsubscribeAll(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if s := topics(); len(s) != 0 {
+		t.Fatalf("unexpected subscriptions following UnsubscribeAll: %v", s)
+	}
+	if token := c.(GroupSubscriber).UnsubscribeAll(); !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("UnsubscribeAll with no subscriptions failed: %v", token.Error())
+	}
+}
+
+func Test_UnsubscribeGroupFailed(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("groups").SetAutoReconnect(false))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	gs := c.(GroupSubscriber)
+	if token := gs.SubscribeGroup("a", map[string]byte{"a/1": 1, "shared": 1}, nil); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := gs.SubscribeGroup("b", map[string]byte{"shared": 1}, nil); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	b.SetAckDelay(time.Hour) // the UNSUBACK will not arrive before the connection is lost
+	token := gs.UnsubscribeGroup("a")
+	if err := b.DropConnection("groups"); err != nil {
+		t.Fatal(err)
+	}
+	if !token.WaitTimeout(5*time.Second) || token.Error() == nil {
+		t.Fatalf("expected UnsubscribeGroup to fail, got %v", token.Error())
+	}
+	c.(*client).subs.mu.Lock()
+	_, retained := c.(*client).subs.groups["a"]
+	c.(*client).subs.mu.Unlock()
+	if !retained {
+		t.Fatal("group should be retained when the unsubscribe fails")
+	}
+}
+
+func Test_SubscriptionRefused(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.RefuseSubscriptions("denied/#", "x/y")
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+
+	token := c.SubscribeMultiple(map[string]byte{"a/b": 1, "denied/#": 2, "x/y": 0}, func(Client, Message) {}).(*SubscribeToken)
+	token.Wait()
+	expected := map[string]byte{"a/b": 1, "denied/#": 0x80, "x/y": 0x80}
+	if result := token.Result(); !reflect.DeepEqual(result, expected) {
+		t.Fatalf("expected result %v, got %v", expected, result)
+	}
+	if !errors.Is(token.Error(), ErrSubscriptionRefused) {
+		t.Fatalf("expected ErrSubscriptionRefused, got %v", token.Error())
+	}
+	var refused []string
+	for _, err := range token.Error().(interface{ Unwrap() []error }).Unwrap() {
+		var se *SubscriptionError
+		if !errors.As(err, &se) || se.ReturnCode != 0x80 {
+			t.Fatalf("expected SubscriptionError, got %v", err)
+		}
+		refused = append(refused, se.Topic)
+	}
+	if len(refused) != 2 {
+		t.Fatalf("expected two refused topics, got %v", refused)
+	}
+	if subs := c.(SubscriptionLister).Subscriptions(); len(subs) != 1 || subs[0].Topic != "a/b" {
+		t.Fatalf("unexpected subscriptions %+v", subs)
+	}
+	r := c.(*client).msgRouter
+	r.RLock()
+	var routes []string
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		routes = append(routes, e.Value.(*route).topic)
+	}
+	r.RUnlock()
+	if len(routes) != 1 || routes[0] != "a/b" {
+		t.Fatalf("expected routes for refused subscriptions to be removed, got %v", routes)
+	}
+
+	token = c.Subscribe("a/c", 2, nil).(*SubscribeToken)
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if result := token.Result(); len(result) != 1 || result["a/c"] != 2 {
+		t.Fatalf("unexpected result %v", result)
+	}
+}
+
+func Test_StructuredErrors(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if err := c.Publish("a", 0, false, "x").Error(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	b.SetConnackReturnCode(packets.ErrRefusedNotAuthorised)
+	token := c.Connect()
+	token.Wait()
+	var ce *ConnackError
+	if !errors.As(token.Error(), &ce) || ce.Code != packets.ErrRefusedNotAuthorised {
+		t.Fatalf("expected ConnackError, got %v", token.Error())
+	}
+	if token.Error() != packets.ErrorRefusedNotAuthorised { // callers written before ConnackError compare directly
+		t.Fatalf("expected packets.ErrorRefusedNotAuthorised, got %v", token.Error())
+	}
+
+	b.SetConnackReturnCode(packets.Accepted)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+	if err := c.Publish("a", 0, false, 42).Error(); !errors.Is(err, ErrUnsupportedPayload) {
+		t.Fatalf("expected ErrUnsupportedPayload, got %v", err)
+	}
+}
+
+func Test_SocketOptions(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var controlled atomic.Int32
+	var conn net.Conn
+	ops := NewClientOptions().AddBroker(b.URL()).
+		SetTCPKeepAlive(5*time.Second).
+		SetTCPNoDelay(false).
+		SetSocketBufferSizes(32768, 16384).
+		SetDialerControl(func(network, address string, _ syscall.RawConn) error {
+			if address != b.Addr() {
+				t.Errorf("unexpected address %s", address)
+			}
+			controlled.Add(1)
+			return nil
+		}).
+		SetConnWrapper(func(c net.Conn) net.Conn { conn = c; return c })
+	if ops.Dialer.KeepAlive != 5*time.Second || !ops.TCPNoDelayDisabled {
+		t.Fatalf("options not set: %+v", ops.Dialer)
+	}
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+	if controlled.Load() != 1 {
+		t.Fatalf("expected dialer control to be called once, got %d", controlled.Load())
+	}
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatalf("expected *net.TCPConn, got %T", conn)
+	}
+
+	// Options are applied to the connection underlying a tls.Conn
+	if err := applySocketOptions(tls.Client(conn, &tls.Config{}), true, 0, 4096); err != nil {
+		t.Fatalf("applySocketOptions: %s", err)
+	}
+	pipe, _ := net.Pipe()
+	defer pipe.Close()
+	if err := applySocketOptions(pipe, true, 4096, 4096); err != nil {
+		t.Fatalf("applySocketOptions should ignore connections without a socket: %s", err)
+	}
+}
+
+func Test_LocalAddr(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if _, err := resolveLocalAddr("no-such-interface0"); err == nil {
+		t.Fatal("expected error resolving unknown interface")
+	}
+	if a, err := resolveLocalAddr("127.0.0.1"); err != nil || !a.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("unexpected address %v (%v)", a, err)
+	}
+
+	// Addresses that cannot be used are skipped; 192.0.2.1 (TEST-NET-1) is not assigned locally
+	var conn net.Conn
+	ops := NewClientOptions().AddBroker(b.URL()).
+		SetLocalAddr("no-such-interface0", "192.0.2.1", "127.0.0.1").
+		SetConnWrapper(func(c net.Conn) net.Conn { conn = c; return c })
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	c.Disconnect(250)
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected connection from 127.0.0.1, got %s", ip)
+	}
+
+	// Per broker addresses take precedence
+	ops = NewClientOptions().SetLocalAddr("127.0.0.1").AddBrokerWithLocalAddr(b.URL(), "192.0.2.1")
+	ops.SetConnectRetry(false)
+	c = NewClient(ops)
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() == nil {
+		t.Fatal("expected connection from unassigned address to fail")
+	}
+}
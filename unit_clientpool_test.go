@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func Test_ClientPool(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	p := NewClientPool(NewClientOptions().AddBroker(b.URL()).SetClientID("pool").SetAutoReconnect(false), 3, PoolByTopic)
+	if s := p.ConnectionState(); s != Disconnected {
+		t.Fatalf("expected Disconnected, got %v", s)
+	}
+	if token := p.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer p.Disconnect(250)
+	if n := p.ConnectedCount(); n != 3 {
+		t.Fatalf("expected 3 connected clients, got %d", n)
+	}
+	if s := p.ConnectionState(); s != Connected {
+		t.Fatalf("expected Connected, got %v", s)
+	}
+	ids := b.Clients()
+	sort.Strings(ids)
+	if len(ids) != 3 || ids[0] != "pool-0" || ids[2] != "pool-2" {
+		t.Fatalf("unexpected client IDs %v", ids)
+	}
+
+	// PoolByTopic must always pick the same client for a topic
+	first := p.pick("a/b")
+	for i := 0; i < 10; i++ {
+		if p.pick("a/b") != first {
+			t.Fatal("expected the same client to be used for a topic")
+		}
+	}
+
+	received := make(chan string, 10)
+	sub := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := sub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer sub.Disconnect(250)
+	if token := sub.Subscribe("#", 1, func(_ Client, m Message) { received <- string(m.Payload()) }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := p.Publish("a/b", 1, false, "1"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	select {
+	case r := <-received:
+		if r != "1" {
+			t.Fatalf("unexpected payload %s", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+
+	// PoolByTopic must keep using the client for a topic while its connection is lost (to maintain ordering), but
+	// PoolRoundRobin must avoid it
+	if err := b.DropConnection(first.(*client).options.ClientID); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.ConnectedCount() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for connection loss")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.pick("a/b") != first {
+		t.Fatal("expected the same client to be used for a topic while its connection is lost")
+	}
+	p.distribution = PoolRoundRobin
+	for i := 0; i < 10; i++ {
+		if p.pick("a/b") == first {
+			t.Fatal("expected a connected client to be used")
+		}
+	}
+	if s := p.ConnectionState(); s != Disconnected {
+		t.Fatalf("expected state of lost client (Disconnected), got %v", s)
+	}
+}
+
+func Test_cloneOptions(t *testing.T) {
+	o := NewClientOptions().SetTLSConfig(&tls.Config{ServerName: "a"}).SetBrokerTLSConfig("h:1", &tls.Config{ServerName: "b"})
+	o.HTTPHeaders.Set("X", "1")
+	o.BrokerALPNProtocols = map[string][]string{"h:1": {"mqtt"}}
+	co := cloneOptions(o)
+	co.TLSConfig.ServerName = "c"
+	co.BrokerTLSConfigs["h:1"].ServerName = "c"
+	co.HTTPHeaders.Set("X", "2")
+	co.BrokerALPNProtocols["h:1"][0] = "x"
+	co.BrokerTLSConfigs["h:2"] = nil
+	if o.TLSConfig.ServerName != "a" || o.BrokerTLSConfigs["h:1"].ServerName != "b" || len(o.BrokerTLSConfigs) != 1 {
+		t.Fatal("TLS configuration shared with the copy")
+	}
+	if o.HTTPHeaders.Get("X") != "1" || o.BrokerALPNProtocols["h:1"][0] != "mqtt" {
+		t.Fatal("maps shared with the copy")
+	}
+}
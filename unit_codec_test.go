@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_TypedHandler(t *testing.T) {
+	type reading struct {
+		Sensor string  `json:"sensor"`
+		Value  float64 `json:"value"`
+	}
+	var decodeErr error
+	c := &client{}
+	c.options.SetDecodeErrorHandler(func(_ Client, _ Message, err error) { decodeErr = err })
+
+	var got []reading
+	h := TypedHandler(JSONCodec, func(_ Client, r reading, m Message) { got = append(got, r) })
+	msg := func(payload string) Message {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName, p.Payload = "sensors", []byte(payload)
+		return messageFromPublish(p, func() error { return nil })
+	}
+
+	h(c, msg(`{"sensor":"t1","value":21.5}`))
+	if len(got) != 1 || got[0] != (reading{Sensor: "t1", Value: 21.5}) {
+		t.Fatalf("unexpected result %+v", got)
+	}
+	if decodeErr != nil {
+		t.Fatalf("unexpected decode error %v", decodeErr)
+	}
+
+	h(c, msg(`not json`))
+	if len(got) != 1 {
+		t.Fatalf("handler should not be called when the payload cannot be decoded")
+	}
+	if !errors.Is(decodeErr, ErrPayloadDecode) {
+		t.Fatalf("expected ErrPayloadDecode, got %v", decodeErr)
+	}
+}
+
+func Test_PublishJSON(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+
+	type command struct {
+		Name string `json:"name"`
+	}
+	received := make(chan command, 1)
+	if token := SubscribeJSON(c, "cmd", 1, func(_ Client, cmd command, _ Message) { received <- cmd }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := PublishJSON(c, "cmd", 1, false, command{Name: "reboot"}); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	select {
+	case cmd := <-received:
+		if cmd.Name != "reboot" {
+			t.Errorf("unexpected command %+v", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	if token := PublishJSON(c, "cmd", 1, false, make(chan int)); !token.WaitTimeout(time.Second) || !errors.Is(token.Error(), ErrPayloadEncode) {
+		t.Errorf("expected ErrPayloadEncode, got %v", token.Error())
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_gzipCompression(t *testing.T) {
+	codec := NewGzipCompression(gzip.BestSpeed)
+	data := []byte(strings.Repeat("compressible ", 100))
+	compressed, err := codec.Compress(data)
+	if err != nil || len(compressed) >= len(data) {
+		t.Fatalf("compress: %d bytes (%v)", len(compressed), err)
+	}
+	if out, err := codec.Decompress(compressed, 0); err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("decompress: %q (%v)", out, err)
+	}
+	if _, err := codec.Decompress(compressed, 100); !errors.Is(err, packets.ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+func Test_PayloadCompression(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("broker: %s", err)
+	}
+	defer b.Close()
+
+	connect := func(o *ClientOptions) Client {
+		c := NewClient(o.AddBroker(b.URL()))
+		if tok := c.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("connect failed (err: %v)", tok.Error())
+		}
+		t.Cleanup(func() { c.Disconnect(0) })
+		return c
+	}
+	subscribe := func(c Client) chan []byte {
+		ch := make(chan []byte, 10)
+		if tok := c.Subscribe("compress/#", 1, func(_ Client, m Message) { ch <- m.Payload() }); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("subscribe failed (err: %v)", tok.Error())
+		}
+		return ch
+	}
+	receive := func(ch chan []byte) []byte {
+		select {
+		case p := <-ch:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for message")
+			return nil
+		}
+	}
+	gz := NewGzipCompression(gzip.DefaultCompression)
+	aware := subscribe(connect(NewClientOptions().SetClientID("aware").SetPayloadCompression(gz, 0)))
+	raw := subscribe(connect(NewClientOptions().SetClientID("raw")))
+	pub := connect(NewClientOptions().SetClientID("pub").SetPayloadCompression(gz, 64).SetPayloadCompressionTopics("compress/on/#"))
+
+	large := strings.Repeat("telemetry ", 50)
+	tests := []struct {
+		name       string
+		topic      string
+		payload    string
+		compressed bool
+	}{
+		{"large", "compress/on/a", large, true},
+		{"belowMinSize", "compress/on/b", "small", false},
+		{"otherTopic", "compress/off", large, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tok := pub.Publish(tt.topic, 1, false, tt.payload); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+				t.Fatalf("publish failed (err: %v)", tok.Error())
+			}
+			if p := receive(aware); string(p) != tt.payload {
+				t.Fatalf("expected the original payload, got %q", p)
+			}
+			p := receive(raw)
+			if compressed := bytes.HasPrefix(p, compressionHeader) && len(p) < len(tt.payload); compressed != tt.compressed {
+				t.Fatalf("expected compressed %t, got payload %q", tt.compressed, p)
+			}
+		})
+	}
+}
+
+// Test_PayloadCompressionLimit checks that a payload that decompresses to more than MaxInboundPayload is discarded
+// (rather than being delivered compressed)
+func Test_PayloadCompressionLimit(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("broker: %s", err)
+	}
+	defer b.Close()
+
+	gz := NewGzipCompression(gzip.DefaultCompression)
+	received := make(chan string, 10)
+	sub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("sub").SetPayloadCompression(gz, 0).SetMaxInboundPayload(100))
+	if tok := sub.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed (err: %v)", tok.Error())
+	}
+	defer sub.Disconnect(0)
+	if tok := sub.Subscribe("compress", 1, func(_ Client, m Message) { received <- string(m.Payload()) }); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed (err: %v)", tok.Error())
+	}
+	pub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("pub").SetPayloadCompression(gz, 0))
+	if tok := pub.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed (err: %v)", tok.Error())
+	}
+	defer pub.Disconnect(0)
+
+	for _, p := range []string{strings.Repeat("bomb ", 1000), "after"} {
+		if tok := pub.Publish("compress", 1, false, p); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish failed (err: %v)", tok.Error())
+		}
+	}
+	select {
+	case p := <-received:
+		if p != "after" {
+			t.Fatalf("expected oversize payload to be discarded, got %q", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+}
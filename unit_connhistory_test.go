@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_connHistory(t *testing.T) {
+	var h *connHistory // nil history records nothing
+	h.add(ConnectionAttempt{})
+	h.setBackoff(time.Second)
+	if s := h.snapshot(); s != nil {
+		t.Fatalf("expected nil, got %v", s)
+	}
+
+	h = newConnHistory(3)
+	h.setBackoff(time.Second) // no attempts; must not panic
+	for i := 1; i <= 5; i++ {
+		h.add(ConnectionAttempt{ReturnCode: byte(i)})
+		h.setBackoff(time.Duration(i))
+	}
+	s := h.snapshot()
+	if len(s) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(s))
+	}
+	for i, a := range s {
+		if a.ReturnCode != byte(i+3) || a.Backoff != time.Duration(i+3) {
+			t.Errorf("attempt %d: unexpected %+v", i, a)
+		}
+	}
+}
+
+func Test_ConnectionHistory(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+	b.SetConnackReturnCode(packets.ErrRefusedNotAuthorised)
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetProtocolVersion(4).
+		SetConnectRetry(true).SetConnectRetryInterval(10 * time.Millisecond))
+	token := c.Connect()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.(ConnectionHistoryReader).ConnectionHistory()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed attempts not recorded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	b.SetConnackReturnCode(packets.Accepted)
+	if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(250)
+
+	h := c.(ConnectionHistoryReader).ConnectionHistory()
+	last := h[len(h)-1]
+	if last.Err != nil || last.ReturnCode != packets.Accepted || last.Backoff != 0 || last.Reconnect {
+		t.Fatalf("unexpected final attempt %+v", last)
+	}
+	for _, a := range h {
+		if a.Broker != b.URL() {
+			t.Errorf("unexpected broker %q", a.Broker)
+		}
+	}
+	first := h[0]
+	var ce *ConnackError
+	if !errors.As(first.Err, &ce) || first.ReturnCode != packets.ErrRefusedNotAuthorised || first.Backoff != 10*time.Millisecond {
+		t.Fatalf("unexpected first attempt %+v", first)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_NotificationChannel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close() // Nothing listening so the connection will be refused
+
+	ch := make(chan ConnectionNotificationEvent, 10)
+	start := time.Now()
+	c := NewClient(NewClientOptions().AddBroker("tcp://" + addr).SetConnectionNotificationChannel(ch))
+	c.Connect().Wait()
+
+	expected := []ConnectionNotificationType{
+		ConnectionNotificationTypeConnecting,
+		ConnectionNotificationTypeBroker,
+		ConnectionNotificationTypeBrokerFailed,
+		ConnectionNotificationTypeFailed,
+	}
+	for _, e := range expected {
+		select {
+		case n := <-ch:
+			if n.Type() != e {
+				t.Fatalf("expected notification type %d, got %d (%#v)", e, n.Type(), n.ConnectionNotification)
+			}
+			if n.Time.Before(start) {
+				t.Fatalf("unexpected notification time %s", n.Time)
+			}
+		default:
+			t.Fatalf("expected notification type %d, channel empty", e)
+		}
+	}
+}
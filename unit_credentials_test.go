@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Test_CredentialsProviderContext checks that the credentials returned by the provider are sent in the CONNECT packet
+func Test_CredentialsProviderContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	connects := make(chan *packets.ConnectPacket, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			cp, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			if p, ok := cp.(*packets.ConnectPacket); ok {
+				connects <- p
+				ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				_ = ca.Write(conn)
+			}
+		}
+	}()
+
+	opts := NewClientOptions().AddBroker("tcp://" + l.Addr().String()).SetUsername("static").
+		SetCredentialsProviderContext(func(ctx context.Context) (string, string, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				return "", "", errors.New("expected context with deadline")
+			}
+			return "user", "token", nil
+		})
+	c := NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("connect: %s", token.Error())
+	}
+	defer c.Disconnect(0)
+	p := <-connects
+	if p.Username != "user" || string(p.Password) != "token" {
+		t.Fatalf("unexpected credentials %s/%s", p.Username, p.Password)
+	}
+}
+
+// Test_CredentialsProviderContextError checks that errors (including timeouts) abort the connection attempt and are notified
+func Test_CredentialsProviderContextError(t *testing.T) {
+	providerErr := errors.New("idp unavailable")
+	for name, p := range map[string]CredentialsProviderContext{
+		"error": func(context.Context) (string, string, error) { return "", "", providerErr },
+		"timeout": func(context.Context) (string, string, error) {
+			time.Sleep(time.Second) // ignores ctx; the attempt must still time out
+			return "user", "token", nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			notifications := make(chan ConnectionNotificationEvent, 10)
+			opts := NewClientOptions().AddBroker("tcp://127.0.0.1:1").SetConnectTimeout(100 * time.Millisecond).
+				SetCredentialsProviderContext(p).SetConnectionNotificationChannel(notifications)
+			c := NewClient(opts)
+			token := c.Connect()
+			if !token.WaitTimeout(500 * time.Millisecond) {
+				t.Fatal("connect did not complete")
+			}
+			if !errors.Is(token.Error(), ErrCredentialsProvider) {
+				t.Fatalf("expected ErrCredentialsProvider, got %v", token.Error())
+			}
+			for n := range notifications {
+				if f, ok := n.ConnectionNotification.(ConnectionNotificationFailed); ok {
+					if !errors.Is(f.Reason, ErrCredentialsProvider) {
+						t.Fatalf("unexpected reason %v", f.Reason)
+					}
+					break
+				}
+				if _, ok := n.ConnectionNotification.(ConnectionNotificationBroker); ok {
+					t.Fatal("broker connection attempted")
+				}
+			}
+		})
+	}
+}
+
+// Test_JWTProvider checks that the token is sent as the password and renewed before it expires
+func Test_JWTProvider(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var issued atomic.Int32
+	var mu sync.Mutex
+	var connects []*packets.ConnectPacket
+	lost := make(chan error, 1)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("jwt").
+		SetJWTProvider(func() (string, time.Time, error) {
+			n := issued.Add(1)
+			return "token" + strconv.Itoa(int(n)), time.Now().Add(time.Second), nil
+		}).
+		SetPacketHook(func(d Direction, cp packets.ControlPacket) {
+			if c, ok := cp.(*packets.ConnectPacket); ok {
+				mu.Lock()
+				connects = append(connects, c)
+				mu.Unlock()
+			}
+		}).
+		SetConnectionLostHandler(func(_ Client, err error) { lost <- err }).
+		SetMaxReconnectInterval(10 * time.Millisecond))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+
+	select {
+	case err := <-lost:
+		if !errors.Is(err, ErrCredentialsExpiring) {
+			t.Fatalf("expected ErrCredentialsExpiring, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for renewal")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(connects)
+		mu.Unlock()
+		if n >= 2 && c.IsConnectionOpen() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for reconnection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if cp := connects[0]; cp.Username != "unused" || string(cp.Password) != "token1" {
+		t.Fatalf("unexpected credentials %q/%q", cp.Username, cp.Password)
+	}
+	if cp := connects[1]; string(cp.Password) != "token2" {
+		t.Fatalf("expected new token on reconnection, got %q", cp.Password)
+	}
+
+	// errors from the provider fail the connection attempt
+	c2 := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("jwt2").
+		SetJWTProvider(func() (string, time.Time, error) { return "", time.Time{}, errors.New("no key") }))
+	if token := c2.Connect(); token.Wait() && !errors.Is(token.Error(), ErrCredentialsProvider) {
+		t.Fatalf("expected ErrCredentialsProvider, got %v", token.Error())
+	}
+}
+
+// Test_JWTProviderClock checks that token renewal is timed using the client's clock
+func Test_JWTProviderClock(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	fake := clock.NewFake(time.Now())
+	lost := make(chan error, 1)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("jwt").SetClock(fake).SetKeepAlive(0).
+		SetJWTProvider(func() (string, time.Time, error) { return "token", fake.Now().Add(time.Hour), nil }).
+		SetConnectionLostHandler(func(_ Client, err error) { lost <- err }))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+
+	fake.BlockUntil(1)
+	fake.Advance(time.Hour - jwtMaxRenewBefore - time.Second)
+	select {
+	case err := <-lost:
+		t.Fatalf("connection renewed early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fake.Advance(time.Second)
+	select {
+	case err := <-lost:
+		if !errors.Is(err, ErrCredentialsExpiring) {
+			t.Fatalf("expected ErrCredentialsExpiring, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for renewal")
+	}
+}
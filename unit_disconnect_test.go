@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Test_DisconnectContext checks that DisconnectContext waits for in-flight messages to be acknowledged
+// before sending DISCONNECT
+func Test_DisconnectContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	received := make(chan packets.ControlPacket, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			cp, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			received <- cp
+			switch p := cp.(type) {
+			case *packets.ConnectPacket:
+				ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				_ = ca.Write(conn)
+			case *packets.PublishPacket:
+				time.Sleep(100 * time.Millisecond) // Delay acknowledgement so the publish is in-flight
+				pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				pa.MessageID = p.MessageID
+				_ = pa.Write(conn)
+			}
+		}
+	}()
+
+	c := NewClient(NewClientOptions().AddBroker("tcp://" + l.Addr().String()).SetAutoReconnect(false))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("connect: %s", token.Error())
+	}
+	pubToken := c.Publish("test", 1, false, "payload")
+	for cp := range received {
+		if _, ok := cp.(*packets.PublishPacket); ok {
+			break
+		}
+	}
+
+	if err := c.(ContextDisconnecter).DisconnectContext(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case <-pubToken.Done():
+		if pubToken.Error() != nil {
+			t.Fatalf("publish failed: %s", pubToken.Error())
+		}
+	default:
+		t.Fatalf("DisconnectContext returned before publish acknowledged")
+	}
+	select {
+	case cp := <-received:
+		if _, ok := cp.(*packets.DisconnectPacket); !ok {
+			t.Fatalf("expected DISCONNECT, got %s", cp)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("DISCONNECT not received")
+	}
+	if token := c.Publish("test", 1, false, "payload"); !errors.Is(token.Error(), ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", token.Error())
+	}
+}
+
+func Test_DisconnectContextNotConnected(t *testing.T) {
+	c := NewClient(NewClientOptions())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.(ContextDisconnecter).DisconnectContext(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Test_DisconnectContextConnectionLost checks that DisconnectContext returns if the connection drops whilst
+// waiting for in-flight messages to be acknowledged
+func Test_DisconnectContextConnectionLost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	published := make(chan struct{})
+	drop := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			cp, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			switch cp.(type) {
+			case *packets.ConnectPacket:
+				ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				_ = ca.Write(conn)
+			case *packets.PublishPacket: // never acknowledged; the connection is dropped when requested
+				close(published)
+				<-drop
+				return
+			}
+		}
+	}()
+
+	c := NewClient(NewClientOptions().AddBroker("tcp://" + l.Addr().String()).SetAutoReconnect(false))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("connect: %s", token.Error())
+	}
+	c.Publish("test", 1, false, "payload")
+	<-published
+
+	result := make(chan error, 1)
+	go func() { result <- c.(ContextDisconnecter).DisconnectContext(context.Background()) }()
+	for c.(*client).status.ConnectionStatus() != disconnecting { // wait until the drain has begun
+		select {
+		case err := <-result:
+			t.Fatalf("DisconnectContext returned before connection dropped: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	close(drop)
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrConnectionLost) {
+			t.Fatalf("expected ErrConnectionLost, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DisconnectContext did not return after connection dropped")
+	}
+	if c.IsConnected() {
+		t.Fatalf("client should be disconnected")
+	}
+}
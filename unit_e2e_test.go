@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func newE2EKey(t *testing.T) *ecdh.PrivateKey {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func Test_E2EEncryption(t *testing.T) {
+	alice, bob, eve := newE2EKey(t), newE2EKey(t), newE2EKey(t)
+	recipients := map[string][]*ecdh.PublicKey{"secure/#": {alice.PublicKey(), bob.PublicKey()}}
+	forKey := func(k *ecdh.PrivateKey) *E2EEncryption {
+		e, err := NewE2EEncryption(NewClientOptions(), E2EOptions{Keys: StaticE2EKeys{Private: k, Recipients: recipients}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	payload := []byte("the secret")
+	enc, err := forKey(alice).Encrypt("secure/a", payload)
+	if err != nil {
+		t.Fatalf("encrypt: %s", err)
+	}
+	if bytes.Contains(enc, payload) {
+		t.Fatal("payload not encrypted")
+	}
+	for _, k := range []*ecdh.PrivateKey{alice, bob} {
+		if dec, err := forKey(k).Decrypt("secure/a", enc); err != nil || !bytes.Equal(dec, payload) {
+			t.Fatalf("decrypt: %q (%v)", dec, err)
+		}
+	}
+	if _, err := forKey(eve).Decrypt("secure/a", enc); !errors.Is(err, ErrE2EDecrypt) {
+		t.Fatalf("expected ErrE2EDecrypt for a non-recipient, got %v", err)
+	}
+	if _, err := forKey(bob).Decrypt("secure/b", enc); !errors.Is(err, ErrE2EDecrypt) {
+		t.Fatalf("expected ErrE2EDecrypt for a different topic, got %v", err)
+	}
+	tampered := bytes.Clone(enc)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := forKey(bob).Decrypt("secure/a", tampered); !errors.Is(err, ErrE2EDecrypt) {
+		t.Fatalf("expected ErrE2EDecrypt for a modified payload, got %v", err)
+	}
+	if _, err := forKey(bob).Decrypt("secure/a", payload); !errors.Is(err, ErrE2EPlaintext) {
+		t.Fatalf("expected ErrE2EPlaintext, got %v", err)
+	}
+	if _, err := forKey(alice).Encrypt("open/a", payload); !errors.Is(err, ErrE2ENoRecipients) {
+		t.Fatalf("expected ErrE2ENoRecipients, got %v", err)
+	}
+}
+
+func Test_E2EEncryptionClient(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("broker: %s", err)
+	}
+	defer b.Close()
+
+	alice, bob := newE2EKey(t), newE2EKey(t)
+	recipients := map[string][]*ecdh.PublicKey{"secure/#": {bob.PublicKey()}}
+	connect := func(o *ClientOptions, k *ecdh.PrivateKey) Client {
+		if k != nil {
+			if _, err := NewE2EEncryption(o, E2EOptions{Keys: StaticE2EKeys{Private: k, Recipients: recipients}, Topics: []string{"secure/#"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c := NewClient(o.AddBroker(b.URL()))
+		if tok := c.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("connect failed (err: %v)", tok.Error())
+		}
+		t.Cleanup(func() { c.Disconnect(0) })
+		return c
+	}
+	subscribe := func(c Client) chan Message {
+		ch := make(chan Message, 10)
+		if tok := c.Subscribe("#", 1, func(_ Client, m Message) { ch <- m }); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("subscribe failed (err: %v)", tok.Error())
+		}
+		return ch
+	}
+	receive := func(ch chan Message) Message {
+		select {
+		case m := <-ch:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for message")
+			return nil
+		}
+	}
+
+	decrypted := subscribe(connect(NewClientOptions().SetClientID("bob"), bob))
+	raw := subscribe(connect(NewClientOptions().SetClientID("broker-view"), nil))
+	pub := connect(NewClientOptions().SetClientID("alice"), alice)
+
+	for _, topic := range []string{"secure/a", "open/a"} {
+		if tok := pub.Publish(topic, 1, false, "hello"); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish failed (err: %v)", tok.Error())
+		}
+		if m := receive(decrypted); m.Topic() != topic || string(m.Payload()) != "hello" {
+			t.Fatalf("unexpected message %s: %q", m.Topic(), m.Payload())
+		}
+		m := receive(raw)
+		if encrypted := topic == "secure/a"; encrypted == bytes.Equal(m.Payload(), []byte("hello")) {
+			t.Fatalf("%s: expected encrypted %t, got %q", topic, encrypted, m.Payload())
+		}
+	}
+}
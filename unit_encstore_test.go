@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_EncryptedStore(t *testing.T) {
+	if _, err := NewEncryptedStore(NewMemoryStore(), []byte("short")); err == nil {
+		t.Fatal("expected error for invalid key length")
+	}
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	s, err := NewEncryptedStore(NewFileStore(dir), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Open()
+	defer s.Close()
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 12
+	pub.TopicName = "secret/topic"
+	pub.Payload = []byte("top secret payload")
+	s.Put(outboundKeyFromMID(12), pub)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.msg"))
+	if len(files) != 1 {
+		t.Fatalf("expected one file, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, pub.Payload) || bytes.Contains(data, []byte(pub.TopicName)) {
+		t.Fatal("plaintext found on disk")
+	}
+
+	got, ok := s.Get(outboundKeyFromMID(12)).(*packets.PublishPacket)
+	if !ok || got.MessageID != 12 || got.TopicName != pub.TopicName || string(got.Payload) != string(pub.Payload) {
+		t.Fatalf("unexpected packet %v", got)
+	}
+	if keys := s.All(); len(keys) != 1 || keys[0] != outboundKeyFromMID(12) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// Moving the encrypted packet to another key must be detected
+	inner := NewMemoryStore()
+	inner.Open()
+	ms, _ := NewEncryptedStore(inner, key)
+	ms.Put("o.1", pub)
+	inner.Put("o.2", inner.Get("o.1"))
+	if ms.Get("o.2") != nil {
+		t.Fatal("expected packet under a different key to be rejected")
+	}
+
+	// A store opened with a different key cannot read the packets
+	other, _ := NewEncryptedStore(inner, bytes.Repeat([]byte{2}, 32))
+	if other.Get("o.1") != nil {
+		t.Fatal("expected decryption with the wrong key to fail")
+	}
+
+	// Update sees, and stores, decrypted packets
+	pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pr.MessageID = 12
+	if err := s.Update(outboundKeyFromMID(12), func(cur packets.ControlPacket) (packets.ControlPacket, error) {
+		if p, ok := cur.(*packets.PublishPacket); !ok || p.MessageID != 12 {
+			t.Fatalf("unexpected current packet %v", cur)
+		}
+		return pr, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(outboundKeyFromMID(12)).(*packets.PubrecPacket); !ok {
+		t.Fatal("expected updated packet")
+	}
+}
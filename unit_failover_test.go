@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+)
+
+func Test_brokersByPriority(t *testing.T) {
+	o := NewClientOptions()
+	o.AddBroker("tcp://secondary-a:1883")
+	o.AddBrokerWithPriority("tcp://primary:1883", 10)
+	o.AddBroker("tcp://secondary-b:1883")
+	o.AddBrokerWithPriority("tcp://tertiary:1883", -1)
+
+	sorted := brokersByPriority(o.Servers, o.ServerPriority)
+	expected := []string{"primary:1883", "secondary-a:1883", "secondary-b:1883", "tertiary:1883"}
+	for i, e := range expected {
+		if sorted[i].Host != e {
+			t.Fatalf("position %d: expected %s, got %s", i, e, sorted[i].Host)
+		}
+	}
+	if o.Servers[0].Host != "secondary-a:1883" {
+		t.Fatalf("brokersByPriority must not modify the original slice")
+	}
+}
+
+func Test_preferredBrokers(t *testing.T) {
+	o := NewClientOptions()
+	o.AddBrokerWithPriority("tcp://primary:1883", 10)
+	o.AddBrokerWithPriority("tcp://secondary:1883", 5)
+	o.AddBroker("tcp://tertiary:1883")
+
+	current, _ := url.Parse("tcp://tertiary:1883")
+	preferred := preferredBrokers(o.Servers, o.ServerPriority, current)
+	if len(preferred) != 2 || preferred[0].Host != "primary:1883" || preferred[1].Host != "secondary:1883" {
+		t.Fatalf("unexpected preferred brokers: %v", preferred)
+	}
+
+	current, _ = url.Parse("tcp://primary:1883")
+	if preferred = preferredBrokers(o.Servers, o.ServerPriority, current); len(preferred) != 0 {
+		t.Fatalf("no brokers should be preferred over the primary, got %v", preferred)
+	}
+}
+
+func Test_brokerReachableTimeout(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	release := make(chan struct{})
+	defer close(release)
+	o := NewClientOptions().SetConnectTimeout(0).SetClock(fake).
+		SetCustomOpenConnectionFn(func(*url.URL, ClientOptions) (net.Conn, error) {
+			<-release // never connects
+			return nil, ErrNotConnected
+		})
+	c := NewClient(o).(*client)
+	broker, _ := url.Parse("tcp://primary:1883")
+
+	result := make(chan bool, 1)
+	go func() { result <- c.brokerReachable(broker) }()
+	c.UpdateWill("will", []byte("gone"), 1, false) // must not race with the check
+	fake.BlockUntil(1)
+	fake.Advance(failbackCheckTimeout)
+	select {
+	case reachable := <-result:
+		if reachable {
+			t.Fatal("broker should not be reachable")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("check was not bounded by failbackCheckTimeout")
+	}
+}
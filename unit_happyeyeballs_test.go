@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_interleaveAddrs(t *testing.T) {
+	ip := func(s string) net.IPAddr { return net.IPAddr{IP: net.ParseIP(s)} }
+	got := interleaveAddrs([]net.IPAddr{ip("::1"), ip("::2"), ip("::3"), ip("10.0.0.1")})
+	exp := []net.IPAddr{ip("::1"), ip("10.0.0.1"), ip("::2"), ip("::3")}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+}
+
+func Test_racingDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The first address is unreachable (TEST-NET-1); without racing the connection would not be made until it times out
+	d := &racingDialer{
+		dialer:  &net.Dialer{Timeout: 10 * time.Second},
+		stagger: 50 * time.Millisecond,
+		lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+		},
+	}
+	start := time.Now()
+	conn, err := d.Dial("tcp", net.JoinHostPort("broker.example", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != l.Addr().String() {
+		t.Fatalf("connected to %s, expected %s", conn.RemoteAddr(), l.Addr())
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("connection took %s", elapsed)
+	}
+
+	// All attempts failing returns an error
+	d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	_ = l.Close()
+	if _, err := d.Dial("tcp", net.JoinHostPort("broker.example", port)); err == nil {
+		t.Fatalf("expected error when no address accepts the connection")
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func Test_Interceptors(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("broker: %s", err)
+	}
+	defer b.Close()
+
+	errRejected := errors.New("rejected")
+	received := make(chan Message, 10)
+	so := NewClientOptions().AddBroker(b.URL()).SetClientID("sub").SetInboundInterceptor(
+		func(topic string, payload []byte) (string, []byte, error) {
+			if strings.HasSuffix(topic, "/drop") {
+				return "", nil, errRejected
+			}
+			return strings.Replace(topic, "out/", "in/", 1), payload, nil
+		},
+		func(topic string, payload []byte) (string, []byte, error) {
+			return topic, bytes.ToLower(payload), nil
+		})
+	sub := NewClient(so)
+	sub.AddRoute("in/#", func(_ Client, m Message) { received <- m }) // selected using the rewritten topic
+	if tok := sub.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed (err: %v)", tok.Error())
+	}
+	defer sub.Disconnect(0)
+	if tok := sub.Subscribe("out/#", 1, nil); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed (err: %v)", tok.Error())
+	}
+
+	po := NewClientOptions().AddBroker(b.URL()).SetClientID("pub").SetPublishInterceptor(
+		func(topic string, payload []byte) (string, []byte, error) {
+			if topic == "reject" {
+				return "", nil, errRejected
+			}
+			return "out/" + topic, payload, nil
+		},
+		func(topic string, payload []byte) (string, []byte, error) {
+			return topic, bytes.ToUpper(payload), nil
+		})
+	pub := NewClient(po)
+	if tok := pub.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed (err: %v)", tok.Error())
+	}
+	defer pub.Disconnect(0)
+
+	tok := pub.Publish("reject", 1, false, "payload")
+	if !tok.WaitTimeout(5*time.Second) || !errors.Is(tok.Error(), ErrIntercepted) || !errors.Is(tok.Error(), errRejected) {
+		t.Fatalf("expected the publish to be rejected, got %v", tok.Error())
+	}
+	for _, topic := range []string{"drop", "a"} { // the first is discarded by the inbound interceptor
+		if tok := pub.Publish(topic, 1, false, "Payload"); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("publish failed (err: %v)", tok.Error())
+		}
+	}
+	select {
+	case m := <-received:
+		if m.Topic() != "in/a" || string(m.Payload()) != "payload" {
+			t.Fatalf("unexpected message %s: %q", m.Topic(), m.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	select {
+	case m := <-received:
+		t.Fatalf("unexpected message %s: %q", m.Topic(), m.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
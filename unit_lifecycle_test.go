@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func Test_Lifecycle(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	received := make(chan string, 10)
+	observer := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("observer"))
+	if token := observer.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer observer.Disconnect(0)
+	if token := observer.Subscribe("node/#", 1, func(_ Client, m Message) {
+		received <- m.Topic() + "=" + string(m.Payload())
+	}); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	payload := func(kind string) LifecyclePayloadFunc {
+		return func(e LifecycleEvent) []byte { return []byte(fmt.Sprintf("%s:%s:%d", kind, e.ClientID, e.Seq)) }
+	}
+	ops := NewClientOptions().AddBroker(b.URL()).SetClientID("n1").SetMaxReconnectInterval(10 * time.Millisecond)
+	l, err := NewLifecycle(ops, LifecycleOptions{
+		BirthTopic: "node/{clientid}/birth",
+		DeathTopic: "node/{clientid}/death",
+		Birth:      payload("birth"),
+		Death:      payload("death"),
+		Qos:        1,
+		InitialSeq: 255,
+		SeqModulus: 256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ops.WillPayload) != "death:n1:255" {
+		t.Fatalf("unexpected will %q", ops.WillPayload)
+	}
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect("node/n1/birth=birth:n1:255")
+
+	// The will carries the sequence number of the session that was lost; the next session uses the next number
+	if err := b.DropConnection("n1"); err != nil {
+		t.Fatal(err)
+	}
+	expect("node/n1/death=death:n1:255")
+	expect("node/n1/birth=birth:n1:0")
+
+	l.Disconnect(c, 250)
+	expect("node/n1/death=death:n1:0")
+	if seq := l.Seq(); seq != 1 {
+		t.Fatalf("expected next sequence number to be 1, got %d", seq)
+	}
+	// Wait for the broker to process the DISCONNECT (otherwise it would be a session takeover, and the broker
+	// would publish the will)
+	for start := time.Now(); len(b.Clients()) > 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("broker did not process disconnection")
+		}
+	}
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect("node/n1/birth=birth:n1:1")
+	l.Disconnect(c, 250)
+	expect("node/n1/death=death:n1:1")
+
+	if _, err := NewLifecycle(NewClientOptions(), LifecycleOptions{BirthTopic: "node/{clientid}/birth", DeathTopic: "d"}); err == nil {
+		t.Fatal("expected error when client ID is required but not set")
+	}
+}
+
+func Test_LifecycleNoAutoReconnect(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	lost := make(chan struct{}, 1)
+	ops := NewClientOptions().AddBroker(b.URL()).SetClientID("n2").SetAutoReconnect(false).
+		SetConnectionLostHandler(func(Client, error) { lost <- struct{}{} })
+	births := make(chan uint64, 1)
+	l, err := NewLifecycle(ops, LifecycleOptions{BirthTopic: "node/n2/birth", DeathTopic: "node/n2/death", OnBirthSent: func(seq uint64) { births <- seq }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	if seq := <-births; seq != 0 {
+		t.Fatalf("expected birth 0, got %d", seq)
+	}
+	if err := b.DropConnection("n2"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection lost handler not called")
+	}
+	if seq := l.Seq(); seq != 1 {
+		t.Fatalf("expected sequence number 1 following connection loss, got %d", seq)
+	}
+}
@@ -20,6 +20,9 @@ package mqtt
 
 import (
 	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 func Test_getID(t *testing.T) {
@@ -80,3 +83,161 @@ func Test_noFreeID(t *testing.T) {
 		t.Errorf("shouldn't be any mids left")
 	}
 }
+
+func Test_getIDWait(t *testing.T) {
+	var d DummyToken
+
+	mids := &messageIds{index: make(map[uint16]tokenCompletor), logger: noopSLogger}
+	for i := midMin; i != 0; i++ {
+		mids.index[i] = &d
+	}
+	if free := mids.freeIDs(); free != 0 {
+		t.Fatalf("expected 0 free ids, got %d", free)
+	}
+
+	start := time.Now()
+	if mid := mids.getIDWait(&d, 20*time.Millisecond); mid != 0 {
+		t.Fatalf("shouldn't be any mids left")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("getIDWait did not wait")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		mids.freeID(100)
+	}()
+	if mid := mids.getIDWait(&d, time.Second); mid != 100 {
+		t.Fatalf("expected freed id 100, got %d", mid)
+	}
+}
+
+func Test_MessageIDAllocators(t *testing.T) {
+	inUse := func(used ...uint16) func(uint16) bool {
+		return func(id uint16) bool {
+			for _, u := range used {
+				if u == id {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	seq := NewSequentialIDAllocator()
+	if id := seq.Next(0, inUse()); id != 1 {
+		t.Errorf("expected 1, got %d", id)
+	}
+	if id := seq.Next(65535, inUse(1, 2)); id != 3 {
+		t.Errorf("expected wrap to 3, got %d", id)
+	}
+
+	r := NewRangeIDAllocator(100, 102)
+	if id := r.Next(0, inUse()); id != 100 {
+		t.Errorf("expected 100, got %d", id)
+	}
+	if id := r.Next(101, inUse(100)); id != 102 {
+		t.Errorf("expected 102, got %d", id)
+	}
+	if id := r.Next(102, inUse(102)); id != 100 {
+		t.Errorf("expected wrap to 100, got %d", id)
+	}
+	if id := r.Next(100, inUse(100, 101, 102)); id != 0 {
+		t.Errorf("expected no free id, got %d", id)
+	}
+
+	res := ReserveIDs(nil, 1, 10)
+	if id := res.Next(0, inUse()); id != 11 {
+		t.Errorf("expected 11, got %d", id)
+	}
+
+	rnd := NewRandomIDAllocator()
+	for i := 0; i < 100; i++ {
+		if id := rnd.Next(0, inUse(1)); id == 0 || id == 1 {
+			t.Fatalf("unexpected id %d", id)
+		}
+	}
+	all := func(uint16) bool { return true }
+	if id := rnd.Next(0, all); id != 0 {
+		t.Errorf("expected no free id, got %d", id)
+	}
+}
+
+func Test_getIDAllocator(t *testing.T) {
+	mids := &messageIds{index: make(map[uint16]tokenCompletor), allocator: NewRangeIDAllocator(10, 11), logger: noopSLogger}
+	pt := newToken(packets.Publish)
+	if id := mids.getID(pt); id != 10 {
+		t.Fatalf("expected 10, got %d", id)
+	}
+	if id := mids.getID(newToken(packets.Subscribe)); id != 11 {
+		t.Fatalf("expected 11, got %d", id)
+	}
+	if id := mids.getID(&DummyToken{}); id != 0 {
+		t.Fatalf("expected range to be exhausted, got %d", id)
+	}
+	ids := mids.inflight()
+	if len(ids) != 2 || ids[0] != (InflightID{ID: 10, Type: packets.Publish}) || ids[1] != (InflightID{ID: 11, Type: packets.Subscribe}) {
+		t.Fatalf("unexpected inflight ids %v", ids)
+	}
+	mids.freeID(10)
+	if id := mids.getID(pt); id != 10 {
+		t.Fatalf("expected freed id 10, got %d", id)
+	}
+}
+
+// Test_cleanUpReentrant checks that token completion callbacks may call into messageIds (i.e. tokens are not
+// completed whilst the mutex is held)
+func Test_cleanUpReentrant(t *testing.T) {
+	mids := &messageIds{index: make(map[uint16]tokenCompletor), logger: noopSLogger}
+
+	pub := newToken(packets.Publish)
+	sub := newToken(packets.Subscribe)
+	replaced := newToken(packets.Publish)
+	called := make(chan struct{}, 3)
+	reenter := func(error) {
+		mids.freeIDs()
+		mids.getID(&DummyToken{})
+		called <- struct{}{}
+	}
+	OnComplete(pub, reenter)
+	OnComplete(sub, reenter)
+	OnComplete(replaced, reenter)
+	mids.getID(pub)
+	mids.getID(sub)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		id := mids.getID(replaced)
+		mids.claimID(newToken(packets.Publish), id) // completes replaced
+		mids.cleanUpSubscribe()
+		mids.cleanUp()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock whilst completing tokens")
+	}
+	if len(called) != 3 {
+		t.Fatalf("expected 3 callbacks, got %d", len(called))
+	}
+}
+
+func Test_InflightIDs(t *testing.T) {
+	c := NewClient(NewClientOptions())
+	mids := &c.(*client).messageIds
+	mids.getID(newToken(packets.Subscribe))
+	mids.getID(newToken(packets.Publish))
+	mids.getID(&DummyToken{})
+
+	got := c.(InflightInspector).InflightIDs()
+	want := []InflightID{{ID: 1, Type: packets.Subscribe}, {ID: 2, Type: packets.Publish}, {ID: 3}}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// offlineTestSubscriber subscribes to topic on the broker and returns a channel that will receive message payloads
+func offlineTestSubscriber(t *testing.T, b *mqtttest.Broker, topic string) <-chan string {
+	received := make(chan string, 10)
+	sub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("sub"))
+	if token := sub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { sub.Disconnect(0) })
+	if token := sub.Subscribe(topic, 1, func(_ Client, m Message) { received <- string(m.Payload()) }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	return received
+}
+
+func expectPayloads(t *testing.T, received <-chan string, expected ...string) {
+	t.Helper()
+	for _, e := range expected {
+		select {
+		case p := <-received:
+			if p != e {
+				t.Fatalf("expected %s, got %s", e, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %s", e)
+		}
+	}
+}
+
+func Test_OfflineBuffer(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	received := offlineTestSubscriber(t, b, "offline")
+
+	var mu sync.Mutex
+	var dropped []string
+	lost := make(chan struct{}, 1)
+	reconnect := make(chan struct{})
+	opts := NewClientOptions().AddBroker(b.URL()).SetClientID("pub").SetAutoReconnect(true).
+		SetConnectionLostHandler(func(Client, error) { lost <- struct{}{} }).
+		SetReconnectingHandler(func(Client, *ClientOptions) { <-reconnect }). // hold the client offline
+		SetOfflineBuffer(3, func(m Message) {
+			mu.Lock()
+			dropped = append(dropped, string(m.Payload()))
+			mu.Unlock()
+		})
+	c := NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	if token := c.Publish("offline", 0, false, "online"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expectPayloads(t, received, "online")
+
+	if err := b.DropConnection("pub"); err != nil {
+		t.Fatal(err)
+	}
+	<-lost
+	tokens := make([]Token, 5)
+	for i := range tokens {
+		tokens[i] = c.Publish("offline", byte(i%2), false, fmt.Sprintf("msg%d", i))
+		if i%2 == 0 && (!tokens[i].WaitTimeout(time.Second) || tokens[i].Error() != nil) { // QoS 0 completes once buffered
+			t.Fatalf("publish %d whilst offline: %v", i, tokens[i].Error())
+		}
+	}
+	mu.Lock()
+	if len(dropped) != 2 || dropped[0] != "msg0" || dropped[1] != "msg1" {
+		t.Fatalf("unexpected dropped messages %v", dropped)
+	}
+	mu.Unlock()
+	if !tokens[1].WaitTimeout(time.Second) || !errors.Is(tokens[1].Error(), ErrOfflineDropped) {
+		t.Fatalf("expected ErrOfflineDropped for dropped QoS 1 message, got %v", tokens[1].Error())
+	}
+	if tokens[3].WaitTimeout(10 * time.Millisecond) {
+		t.Fatalf("QoS 1 token completed before the message was sent (err: %v)", tokens[3].Error())
+	}
+	close(reconnect)
+
+	// Following reconnection the buffered messages should be sent in order (and before any new messages)
+	expectPayloads(t, received, "msg2", "msg3", "msg4")
+	if !tokens[3].WaitTimeout(5*time.Second) || tokens[3].Error() != nil {
+		t.Fatalf("forwarded QoS 1 message not acknowledged: %v", tokens[3].Error())
+	}
+	if token := c.Publish("offline", 1, false, "after"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expectPayloads(t, received, "after")
+}
+
+// Test_OfflineBufferDurable checks that messages buffered by one client are sent by another using the same FileStore
+func Test_OfflineBufferDurable(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	received := offlineTestSubscriber(t, b, "offline")
+	dir := t.TempDir()
+
+	opts := NewClientOptions().AddBroker("tcp://127.0.0.1:1").SetClientID("pub").SetStore(NewFileStore(dir)).
+		SetConnectRetry(true).SetConnectRetryInterval(10*time.Millisecond).SetOfflineBuffer(10, nil)
+	c := NewClient(opts)
+	c.Connect()
+	tokens := make([]Token, 3)
+	for i := range tokens {
+		tokens[i] = c.Publish("offline", 1, false, fmt.Sprintf("msg%d", i))
+	}
+	c.Disconnect(0)
+	for i, token := range tokens { // the messages remain buffered but will not be sent by this client
+		if !token.WaitTimeout(time.Second) || !errors.Is(token.Error(), ErrNotConnected) {
+			t.Fatalf("expected ErrNotConnected for publish %d, got %v", i, token.Error())
+		}
+	}
+
+	opts = NewClientOptions().AddBroker(b.URL()).SetClientID("pub").SetStore(NewFileStore(dir)).SetOfflineBuffer(10, nil)
+	c = NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	expectPayloads(t, received, "msg0", "msg1", "msg2")
+}
+
+func Test_OfflineBufferExpiry(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	received := offlineTestSubscriber(t, b, "offline")
+
+	dropped := make(chan string, 1)
+	lost := make(chan struct{}, 1)
+	reconnect := make(chan struct{})
+	fake := clock.NewFake(time.Now())
+	opts := NewClientOptions().AddBroker(b.URL()).SetClientID("pub").SetAutoReconnect(true).SetClock(fake).
+		SetConnectionLostHandler(func(Client, error) { lost <- struct{}{} }).
+		SetReconnectingHandler(func(Client, *ClientOptions) { <-reconnect }).
+		SetOfflineBuffer(10, func(m Message) { dropped <- string(m.Payload()) })
+	c := NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	if err := b.DropConnection("pub"); err != nil {
+		t.Fatal(err)
+	}
+	<-lost
+
+	stale := c.(OptionsPublisher).PublishWithOptions("offline", 1, false, "stale", PublishOptions{Expiry: time.Minute})
+	fresh := c.(OptionsPublisher).PublishWithOptions("offline", 1, false, "fresh", PublishOptions{Expiry: time.Hour})
+	fake.Advance(2 * time.Minute)
+	close(reconnect)
+
+	expectPayloads(t, received, "fresh")
+	if !stale.WaitTimeout(time.Second) || !errors.Is(stale.Error(), ErrOfflineDropped) {
+		t.Fatalf("expected ErrOfflineDropped for expired message, got %v", stale.Error())
+	}
+	if !fresh.WaitTimeout(5*time.Second) || fresh.Error() != nil {
+		t.Fatalf("forwarded message not acknowledged: %v", fresh.Error())
+	}
+	select {
+	case p := <-dropped:
+		if p != "stale" {
+			t.Fatalf("unexpected dropped message %s", p)
+		}
+	default:
+		t.Fatal("expired message not passed to drop handler")
+	}
+}
+
+// Test_OfflineBufferUnsendable checks that a buffered message that cannot be forwarded is dropped rather than
+// preventing the messages that follow it from being sent
+func Test_OfflineBufferUnsendable(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	received := offlineTestSubscriber(t, b, "offline")
+
+	dropped := make(chan string, 1)
+	lost := make(chan struct{}, 1)
+	reconnect := make(chan struct{})
+	opts := NewClientOptions().AddBroker(b.URL()).SetClientID("pub").SetAutoReconnect(true).SetMaxOutboundPayload(5).
+		SetConnectionLostHandler(func(Client, error) { lost <- struct{}{} }).
+		SetReconnectingHandler(func(Client, *ClientOptions) { <-reconnect }).
+		SetOfflineBuffer(10, func(m Message) { dropped <- string(m.Payload()) })
+	c := NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	if err := b.DropConnection("pub"); err != nil {
+		t.Fatal(err)
+	}
+	<-lost
+
+	// A message that exceeds MaxOutboundPayload cannot be buffered via Publish so is added directly (as would be
+	// the case if the limit was reduced before a restart)
+	cl := c.(*client)
+	cl.offline.mu.Lock()
+	e := offlineEntry{seq: cl.offline.next}
+	cl.offline.next++
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.Payload = "offline", 1, []byte("oversized")
+	cl.persist.Put(e.key(), pub)
+	cl.offline.entries = append(cl.offline.entries, e)
+	cl.offline.mu.Unlock()
+	token := c.Publish("offline", 1, false, "ok")
+	close(reconnect)
+
+	expectPayloads(t, received, "ok")
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("forwarded message not acknowledged: %v", token.Error())
+	}
+	select {
+	case p := <-dropped:
+		if p != "oversized" {
+			t.Fatalf("unexpected dropped message %s", p)
+		}
+	default:
+		t.Fatal("unsendable message not passed to drop handler")
+	}
+}
+
+func Test_offlineEntryKey(t *testing.T) {
+	for _, e := range []offlineEntry{{seq: 12}, {seq: 13, expires: time.UnixMilli(1700000000123)}} {
+		key := e.key()
+		if !isKeyForward(key) {
+			t.Fatalf("%s is not a forward key", key)
+		}
+		got, err := offlineEntryFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.seq != e.seq || !got.expires.Equal(e.expires) {
+			t.Fatalf("expected %+v, got %+v (key %s)", e, got, key)
+		}
+	}
+	if _, err := offlineEntryFromKey("f.x"); err == nil {
+		t.Fatal("expected error for invalid key")
+	}
+}
+
+// Test_OfflineBufferIntercepted checks that PublishInterceptors are applied once to messages buffered whilst offline
+func Test_OfflineBufferIntercepted(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	received := offlineTestSubscriber(t, b, "offline")
+
+	lost := make(chan struct{}, 1)
+	reconnect := make(chan struct{})
+	opts := NewClientOptions().AddBroker(b.URL()).SetClientID("pub").SetAutoReconnect(true).
+		SetConnectionLostHandler(func(Client, error) { lost <- struct{}{} }).
+		SetReconnectingHandler(func(Client, *ClientOptions) { <-reconnect }).
+		SetOfflineBuffer(10, nil).
+		SetPublishInterceptor(func(topic string, payload []byte) (string, []byte, error) {
+			return topic, append([]byte("+"), payload...), nil
+		})
+	c := NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	if err := b.DropConnection("pub"); err != nil {
+		t.Fatal(err)
+	}
+	<-lost
+	c.Publish("offline", 1, false, "msg")
+	close(reconnect)
+
+	expectPayloads(t, received, "+msg")
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_PacketHook(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var mu sync.Mutex
+	var traced []string
+	hook := func(d Direction, cp packets.ControlPacket) {
+		mu.Lock()
+		defer mu.Unlock()
+		traced = append(traced, fmt.Sprintf("%s %T", d, cp))
+	}
+	received := make(chan struct{}, 1)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetPacketHook(hook))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := c.Subscribe("a", 1, func(Client, Message) { received <- struct{}{} }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := c.Publish("a", 1, false, "x"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	c.Disconnect(100)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, exp := range []string{
+		"sent *packets.ConnectPacket", "received *packets.ConnackPacket",
+		"sent *packets.SubscribePacket", "received *packets.SubackPacket",
+		"sent *packets.PublishPacket", "received *packets.PubackPacket",
+		"received *packets.PublishPacket", "sent *packets.PubackPacket",
+		"sent *packets.DisconnectPacket",
+	} {
+		found := false
+		for _, tr := range traced {
+			found = found || tr == exp
+		}
+		if !found {
+			t.Errorf("%q not traced (got %v)", exp, traced)
+		}
+	}
+}
+
+func Test_PacketHookPing(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	pinged := make(chan struct{}, 1)
+	hook := func(d Direction, cp packets.ControlPacket) {
+		if _, ok := cp.(*packets.PingreqPacket); ok && d == PacketSent {
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+		}
+	}
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetKeepAlive(time.Second).SetPacketHook(hook))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepalive ping not traced")
+	}
+}
+
+func Test_PacketHookSampleRate(t *testing.T) {
+	var publishes, pings int
+	c := &client{}
+	c.options.PacketHookSampleRate = 3
+	c.options.PacketHook = func(d Direction, cp packets.ControlPacket) {
+		switch cp.(type) {
+		case *packets.PublishPacket:
+			publishes++
+		case *packets.PingreqPacket:
+			pings++
+		}
+	}
+	for i := 0; i < 9; i++ {
+		c.tracePacket(PacketSent, packets.NewControlPacket(packets.Publish))
+		c.tracePacket(PacketSent, packets.NewControlPacket(packets.Pingreq))
+	}
+	if publishes != 3 || pings != 9 {
+		t.Fatalf("expected 3 publishes and 9 pings traced, got %d and %d", publishes, pings)
+	}
+}
+
+// recordingConn records the bytes written to and read from a connection
+type recordingConn struct {
+	net.Conn
+	mu            sync.Mutex
+	written, read bytes.Buffer
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	r.written.Write(b)
+	r.mu.Unlock()
+	return r.Conn.Write(b)
+}
+
+func (r *recordingConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.mu.Lock()
+	r.read.Write(b[:n])
+	r.mu.Unlock()
+	return n, err
+}
+
+func Test_ConnWrapper(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var rc *recordingConn
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetConnWrapper(func(conn net.Conn) net.Conn {
+		rc = &recordingConn{Conn: conn}
+		return rc
+	}))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := c.Publish("a/b", 1, false, "x"); !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("publish failed: %v", token.Error())
+	}
+	c.Disconnect(250)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var sent, received []string
+	for _, d := range []struct {
+		buf  *bytes.Buffer
+		into *[]string
+	}{{&rc.written, &sent}, {&rc.read, &received}} {
+		for d.buf.Len() > 0 {
+			cp, err := packets.ReadPacket(d.buf)
+			if err != nil {
+				t.Fatalf("recorded data could not be decoded: %s", err)
+			}
+			*d.into = append(*d.into, packets.PacketNames[packets.PacketType(cp)])
+		}
+	}
+	if fmt.Sprint(sent) != "[CONNECT PUBLISH DISCONNECT]" || fmt.Sprint(received) != "[CONNACK PUBACK]" {
+		t.Fatalf("unexpected packets sent %v, received %v", sent, received)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func Test_ParallelConnect(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("broker: %s", err)
+	}
+	defer b.Close()
+
+	// The first broker accepts tcp connections but never completes the TLS handshake so, when the brokers are
+	// dialed in turn, Connect would wait for the ConnectTimeout
+	o := NewClientOptions().AddBroker("ssl://" + silentListener(t)).AddBroker(b.URL()).SetClientID("parallel").
+		SetConnectTimeout(10 * time.Second).SetParallelConnect(true)
+	c := NewClient(o)
+	if tok := c.Connect(); !tok.WaitTimeout(3*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect did not complete promptly (err: %v)", tok.Error())
+	}
+	defer c.Disconnect(0)
+	if clients := b.Clients(); len(clients) != 1 || clients[0] != "parallel" {
+		t.Fatalf("expected client to be connected to the broker, got %v", clients)
+	}
+}
+
+func Test_ParallelConnectRejected(t *testing.T) {
+	refusing, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("broker: %s", err)
+	}
+	defer refusing.Close()
+	refusing.SetConnackReturnCode(5) // not authorised
+	accepting, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("broker: %s", err)
+	}
+	defer accepting.Close()
+
+	// Whichever connection is established first, the client must end up connected to the accepting broker
+	o := NewClientOptions().AddBroker(refusing.URL()).AddBroker(accepting.URL()).SetClientID("parallel").
+		SetProtocolVersion(4).SetParallelConnect(true)
+	c := NewClient(o)
+	if tok := c.Connect(); !tok.WaitTimeout(3*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed (err: %v)", tok.Error())
+	}
+	defer c.Disconnect(0)
+	if clients := accepting.Clients(); len(clients) != 1 || clients[0] != "parallel" {
+		t.Fatalf("expected client to be connected to the accepting broker, got %v", clients)
+	}
+	if clients := refusing.Clients(); len(clients) != 0 {
+		t.Fatalf("expected no clients on the refusing broker, got %v", clients)
+	}
+}
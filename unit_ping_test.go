@@ -20,8 +20,14 @@ package mqtt
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/eclipse/paho.mqtt.golang/clock"
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -67,3 +73,268 @@ func Test_DecodeMessage_pingresp(t *testing.T) {
 		t.Errorf("DecodeMessage ping response wrong rem len: %d", presp.(*packets.PingrespPacket).RemainingLength)
 	}
 }
+
+// pingWriter signals each time a packet is written
+type pingWriter chan time.Time
+
+func (w pingWriter) Write(b []byte) (int, error) {
+	w <- time.Now()
+	return len(b), nil
+}
+
+func Test_keepalive_schedule(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	c := &client{stop: make(chan struct{}), logger: noopSLogger, clock: fake}
+	c.options.KeepAlive = 1
+	c.options.PingTimeout = 10 * time.Second
+	c.lastSent.Store(start)
+	c.lastReceived.Store(start)
+	w := make(pingWriter, 1)
+	c.workers.Add(1)
+	go keepalive(c, w)
+	defer func() {
+		close(c.stop)
+		c.workers.Wait()
+	}()
+
+	// The ping should be sent as soon as the keepalive period expires (not up to 5 seconds later)
+	fake.BlockUntil(1)
+	fake.Advance(time.Second - time.Millisecond)
+	if n := fake.Timers(); n != 1 {
+		t.Fatalf("keepalive timer fired early (%d active timers)", n)
+	}
+	fake.Advance(time.Millisecond)
+	select {
+	case <-w:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping not sent")
+	}
+	fake.Advance(10 * time.Millisecond)
+	c.lastReceived.Store(fake.Now())
+	c.pingRespReceived()
+	if rtt := time.Duration(c.pingRTT.Load()); rtt != 10*time.Millisecond {
+		t.Fatalf("expected ping rtt of 10ms, got %s", rtt)
+	}
+}
+
+func Test_keepalive_fakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	c := &client{stop: make(chan struct{}), logger: noopSLogger, clock: fake}
+	c.options.KeepAlive = 30
+	c.options.PingTimeout = 10 * time.Second
+	c.lastSent.Store(start)
+	c.lastReceived.Store(start)
+	w := make(pingWriter, 1)
+	c.workers.Add(1)
+	go keepalive(c, w)
+	defer func() {
+		close(c.stop)
+		c.workers.Wait()
+	}()
+
+	fake.BlockUntil(1)
+	fake.Advance(29 * time.Second)
+	select {
+	case <-w:
+		t.Fatal("ping sent before keepalive expired")
+	case <-time.After(20 * time.Millisecond):
+	}
+	fake.Advance(time.Second)
+	select {
+	case <-w:
+	case <-time.After(time.Second):
+		t.Fatal("ping not sent")
+	}
+	fake.Advance(250 * time.Millisecond)
+	c.pingRespReceived()
+	if rtt := time.Duration(c.pingRTT.Load()); rtt != 250*time.Millisecond {
+		t.Fatalf("expected ping rtt of 250ms, got %s", rtt)
+	}
+}
+
+func Test_keepAliveInterval(t *testing.T) {
+	for _, tc := range []struct {
+		keepAlive int64
+		server    time.Duration
+		expected  time.Duration
+	}{
+		{30, 0, 30 * time.Second},
+		{30, 5 * time.Second, 5 * time.Second},
+		{30, time.Minute, 30 * time.Second}, // must not exceed the keepalive sent to the broker
+		{0, 5 * time.Second, 5 * time.Second},
+		{0, 0, 0},
+	} {
+		c := &client{}
+		c.options.KeepAlive, c.options.ServerKeepAlive = tc.keepAlive, tc.server
+		if got := c.keepAliveInterval(); got != tc.expected {
+			t.Errorf("keepalive %ds, server %s: expected %s, got %s", tc.keepAlive, tc.server, tc.expected, got)
+		}
+	}
+}
+
+func Test_keepalive_serverOverride(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		activity func(c *client)
+	}{
+		{"sending", func(c *client) { c.UpdateLastSent() }},       // outgoing traffic does not prevent a ping when nothing has been received
+		{"receiving", func(c *client) { c.UpdateLastReceived() }}, // nor does incoming traffic when nothing has been sent
+	} {
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		fake := clock.NewFake(start)
+		c := &client{stop: make(chan struct{}), logger: noopSLogger, clock: fake}
+		c.options.KeepAlive = 30
+		c.options.ServerKeepAlive = 5 * time.Second
+		c.options.PingTimeout = 10 * time.Second
+		c.lastSent.Store(start)
+		c.lastReceived.Store(start)
+		w := make(pingWriter, 1)
+		c.workers.Add(1)
+		go keepalive(c, w)
+
+		fake.BlockUntil(1)
+		fake.Advance(4 * time.Second)
+		tc.activity(c)
+		select {
+		case <-w:
+			t.Fatalf("%s: ping sent before server keepalive expired", tc.name)
+		case <-time.After(20 * time.Millisecond):
+		}
+		fake.Advance(time.Second)
+		select {
+		case <-w:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: ping not sent after server keepalive expired", tc.name)
+		}
+		close(c.stop)
+		c.workers.Wait()
+	}
+}
+
+func Test_adaptiveKeepAliveInterval(t *testing.T) {
+	if srtt := smoothRTT(0, 100*time.Millisecond); srtt != 100*time.Millisecond {
+		t.Fatalf("unexpected initial srtt %s", srtt)
+	}
+	if srtt := smoothRTT(100*time.Millisecond, 900*time.Millisecond); srtt != 200*time.Millisecond {
+		t.Fatalf("unexpected srtt %s", srtt)
+	}
+	if i := adaptiveKeepAliveInterval(30*time.Second, time.Second); i != 28*time.Second {
+		t.Fatalf("unexpected interval %s", i)
+	}
+	if i := adaptiveKeepAliveInterval(30*time.Second, 20*time.Second); i != 15*time.Second {
+		t.Fatalf("interval %s should be limited to half of keepalive", i)
+	}
+}
+
+func Test_ConnectionHealth(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetKeepAlive(time.Second))
+	if h := c.(HealthReporter).ConnectionHealth(); h.Connected || h.LastPingRTT != 0 {
+		t.Fatalf("unexpected health before connect %+v", h)
+	}
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for c.(HealthReporter).ConnectionHealth().LastPingRTT == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("ping round trip time not recorded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	h := c.(HealthReporter).ConnectionHealth()
+	if !h.Connected || h.OutstandingPings != 0 || h.SinceLastReceive > time.Second {
+		t.Fatalf("unexpected health %+v", h)
+	}
+}
+
+func Test_Ping(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetKeepAlive(0))
+	if err := c.(Pinger).Ping(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+
+	if h := c.(HealthReporter).ConnectionHealth(); h.KeepAlive != 0 {
+		t.Fatalf("expected keepalive to be disabled, got %s", h.KeepAlive)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := c.(Pinger).Ping(ctx); err != nil {
+			t.Fatalf("ping %d failed: %s", i, err)
+		}
+	}
+	if h := c.(HealthReporter).ConnectionHealth(); h.LastPingRTT == 0 || h.OutstandingPings != 0 {
+		t.Fatalf("unexpected health %+v", h)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.(Pinger).Ping(cancelled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// Test_PingCancelled checks that a Ping that gives up does not leave a waiter behind
+func Test_PingCancelled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go func() { // a broker that never responds to pings
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			cp, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			if _, ok := cp.(*packets.ConnectPacket); ok {
+				_ = packets.NewControlPacket(packets.Connack).Write(conn)
+			}
+		}
+	}()
+
+	c := NewClient(NewClientOptions().AddBroker("tcp://" + l.Addr().String()).SetKeepAlive(0))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := c.(Pinger).Ping(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+	}
+	cl := c.(*client)
+	cl.pingMu.Lock()
+	defer cl.pingMu.Unlock()
+	if n := len(cl.pingWaiters); n != 0 {
+		t.Fatalf("expected no ping waiters, got %d", n)
+	}
+}
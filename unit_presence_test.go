@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func Test_Presence(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	status := make(chan string, 10)
+	observer := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("observer"))
+	if token := observer.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer observer.Disconnect(0)
+	if token := observer.Subscribe("devices/+/status", 1, func(_ Client, m Message) {
+		status <- m.Topic() + "=" + string(m.Payload())
+	}); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-status:
+			if got != want {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	if _, err := NewPresence(NewClientOptions(), PresenceOptions{}); err == nil {
+		t.Fatal("expected error when client ID is required but not set")
+	}
+	if _, err := NewPresence(NewClientOptions().SetClientID("dev"), PresenceOptions{Topic: "status/+"}); err == nil {
+		t.Fatal("expected error for invalid topic")
+	}
+
+	ops := NewClientOptions().AddBroker(b.URL()).SetClientID("dev1").SetMaxReconnectInterval(10 * time.Millisecond)
+	p, err := NewPresence(ops, PresenceOptions{Topic: "devices/{clientid}/status", Qos: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Topic() != "devices/dev1/status" || ops.WillTopic != p.Topic() || !ops.WillRetained {
+		t.Fatalf("unexpected will/topic: %s, %s", p.Topic(), ops.WillTopic)
+	}
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect("devices/dev1/status=online")
+
+	// Unexpected loss results in the will being published; online is published again on reconnection
+	if err := b.DropConnection("dev1"); err != nil {
+		t.Fatal(err)
+	}
+	expect("devices/dev1/status=offline")
+	expect("devices/dev1/status=online")
+
+	p.Disconnect(c, 250)
+	expect("devices/dev1/status=offline")
+	if c.IsConnected() {
+		t.Fatal("expected client to be disconnected")
+	}
+}
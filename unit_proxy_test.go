@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+// testConnectProxy is a minimal HTTP CONNECT proxy; requests without the expected Proxy-Authorization
+// header (if auth is set) are rejected
+type testConnectProxy struct {
+	l       net.Listener
+	auth    string
+	targets chan string
+}
+
+func newTestConnectProxy(t *testing.T, auth string) *testConnectProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testConnectProxy{l: l, auth: auth, targets: make(chan string, 10)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testConnectProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	if p.auth != "" && req.Header.Get("Proxy-Authorization") != p.auth {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	p.targets <- req.Host
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() { _, _ = io.Copy(target, conn) }()
+	_, _ = io.Copy(conn, target)
+}
+
+func (p *testConnectProxy) url(userinfo *url.Userinfo) *url.URL {
+	return &url.URL{Scheme: "http", Host: p.l.Addr().String(), User: userinfo}
+}
+
+func Test_ProxyURL_HTTPConnect(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	p := newTestConnectProxy(t, "Basic dXNlcjpwYXNz") // user:pass
+
+	opts := NewClientOptions().AddBroker(b.URL()).SetClientID("proxy").SetProxyURL(p.url(url.UserPassword("user", "pass")))
+	c := NewClient(opts)
+	if tok := c.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect via proxy failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+	select {
+	case target := <-p.targets:
+		if target != b.Addr() {
+			t.Fatalf("expected CONNECT to %s, got %s", b.Addr(), target)
+		}
+	default:
+		t.Fatal("connection did not pass through proxy")
+	}
+}
+
+func Test_ProxyURL_HTTPConnectRejected(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	p := newTestConnectProxy(t, "Basic dXNlcjpwYXNz")
+
+	opts := NewClientOptions().AddBroker(b.URL()).SetClientID("proxy").SetProxyURL(p.url(url.UserPassword("user", "wrong")))
+	c := NewClient(opts)
+	if tok := c.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() == nil {
+		t.Fatal("expected connect to fail when proxy rejects credentials")
+	}
+}
+
+func Test_ProxyFromEnvironment(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	p := newTestConnectProxy(t, "")
+	t.Setenv("ALL_PROXY", p.url(nil).String())
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("proxy"))
+	if tok := c.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect via proxy failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+	if len(p.targets) != 1 {
+		t.Fatal("connection did not pass through proxy")
+	}
+
+	t.Setenv("NO_PROXY", "127.0.0.1")
+	d, err := newProxyDialer(nil, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", b.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(p.targets) != 1 {
+		t.Fatal("NO_PROXY host connected via proxy")
+	}
+}
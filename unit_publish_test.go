@@ -0,0 +1,387 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_PublishPooledPayloadAndReader(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	received := make(chan Message, 2)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	if token := c.Subscribe("test", 1, func(_ Client, m Message) { received <- m }); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+
+	var released atomic.Bool
+	token := c.Publish("test", 1, false, PooledPayload{Data: []byte("pooled"), Release: func() { released.Store(true) }})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("publish failed: %v", token.Error())
+	}
+	if !released.Load() {
+		t.Fatalf("pooled payload not released following successful publish")
+	}
+	if token := c.Publish("test", 1, false, strings.NewReader("reader")); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("publish failed: %v", token.Error())
+	}
+
+	for _, expected := range []string{"pooled", "reader"} {
+		select {
+		case m := <-received:
+			if got := string(m.Payload()); got != expected {
+				t.Fatalf("expected payload %q, got %q", expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message not received")
+		}
+	}
+}
+
+func Test_PublishBatch(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	received := make(chan Message, 3)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	if token := c.Subscribe("batch/#", 2, func(_ Client, m Message) { received <- m }); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+
+	token := c.(BatchPublisher).PublishBatch([]PublishRequest{
+		{Topic: "batch/0", Qos: 0, Payload: "zero"},
+		{Topic: "batch/1", Qos: 1, Payload: []byte("one")},
+		{Topic: "batch/bad", Qos: 1, Payload: 42},
+		{Topic: "batch/2", Qos: 2, Payload: "two"},
+	})
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatalf("batch did not complete")
+	}
+	if token.Error() == nil {
+		t.Fatalf("expected an error due to the invalid payload")
+	}
+	tokens := token.(*BatchToken).Tokens()
+	for i, pt := range tokens {
+		if (pt.Error() != nil) != (i == 2) {
+			t.Fatalf("unexpected result for message %d: %v", i, pt.Error())
+		}
+	}
+
+	for _, expected := range []string{"zero", "one", "two"} {
+		select {
+		case m := <-received:
+			if string(m.Payload()) != expected {
+				t.Fatalf("expected payload %q, got %q", expected, m.Payload())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message not received")
+		}
+	}
+}
+
+func Test_PublishPayloadLimits(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	received := make(chan string, 10)
+	sub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("sub").SetMaxInboundPayload(10))
+	if token := sub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer sub.Disconnect(250)
+	sub.Subscribe("limit/#", 1, func(_ Client, m Message) { received <- string(m.Payload()) }).Wait()
+
+	pub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("pub").SetMaxOutboundPayload(20))
+	if token := pub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer pub.Disconnect(250)
+
+	if token := pub.Publish("limit/a", 1, false, strings.Repeat("x", 21)); token.Wait() && !errors.Is(token.Error(), ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", token.Error())
+	}
+	if token := pub.Publish("limit/a", 1, false, strings.NewReader(strings.Repeat("x", 21))); token.Wait() && !errors.Is(token.Error(), ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge for reader, got %v", token.Error())
+	}
+	// The first message exceeds the subscribers limit so is discarded
+	for _, p := range []string{strings.Repeat("y", 20), "small"} {
+		if token := pub.Publish("limit/a", 1, false, p); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+	}
+	select {
+	case p := <-received:
+		if p != "small" {
+			t.Fatalf("expected small message, got %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	if !sub.IsConnectionOpen() {
+		t.Error("connection should remain open after discarding an oversize message")
+	}
+}
+
+func Test_PublishMaxInflight(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetMaxInflight(2))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+	b.SetAckDelay(200 * time.Millisecond)
+
+	t1 := c.Publish("a", 1, false, "1")
+	t2 := c.Publish("a", 2, false, "2")
+	if h := c.(HealthReporter).ConnectionHealth(); h.Inflight != 2 || h.MaxInflight != 2 {
+		t.Fatalf("expected 2/2 inflight, got %d/%d", h.Inflight, h.MaxInflight)
+	}
+	var t3 Token
+	done := make(chan struct{})
+	go func() {
+		t3 = c.Publish("a", 1, false, "3")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Publish did not block with a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, tk := range []Token{t1, t2} {
+		if !tk.WaitTimeout(time.Second) || tk.Error() != nil {
+			t.Fatalf("publish failed: %v", tk.Error())
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish did not unblock")
+	}
+	if !t3.WaitTimeout(time.Second) || t3.Error() != nil {
+		t.Fatalf("publish failed: %v", t3.Error())
+	}
+
+	// A batch larger than the window must not deadlock
+	reqs := make([]PublishRequest, 5)
+	for i := range reqs {
+		reqs[i] = PublishRequest{Topic: "a", Qos: 1, Payload: "b"}
+	}
+	b.SetAckDelay(0)
+	if token := c.(BatchPublisher).PublishBatch(reqs); !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		t.Fatalf("batch failed: %v", token.Error())
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.(HealthReporter).ConnectionHealth().Inflight != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("window not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test_PublishMaxInflightConnectionLost checks that a Publish waiting for space in the window fails, rather than
+// blocking indefinitely, if the connection is lost
+func Test_PublishMaxInflightConnectionLost(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("inflight").SetMaxInflight(1).
+		SetCleanSession(false).SetAutoReconnect(false))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+	b.SetAckDelay(time.Hour)
+
+	c.Publish("a", 1, false, "1") // occupies the window (and remains in the session following connection loss)
+	blocked := make(chan Token, 1)
+	go func() { blocked <- c.Publish("a", 1, false, "2") }()
+	select {
+	case <-blocked:
+		t.Fatal("Publish did not block with a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := b.DropConnection("inflight"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case tk := <-blocked:
+		if !tk.WaitTimeout(time.Second) || tk.Error() == nil {
+			t.Fatalf("expected publish to fail, got %v", tk.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish still blocked after connection lost")
+	}
+}
+
+func Test_TokenOnComplete(t *testing.T) {
+	// Callbacks registered before completion run once, in order, with the error
+	tk := newToken(packets.Publish)
+	var calls []int
+	var gotErr error
+	tk.(CompletionToken).OnComplete(func(err error) { calls = append(calls, 1); gotErr = err })
+	tk.(CompletionToken).OnComplete(func(err error) { calls = append(calls, 2) })
+	testErr := errors.New("test")
+	tk.setError(testErr)
+	tk.flowComplete() // must not call the callbacks again
+	if len(calls) != 2 || calls[0] != 1 || calls[1] != 2 || gotErr != testErr {
+		t.Fatalf("unexpected callbacks %v (err %v)", calls, gotErr)
+	}
+	// Registered after completion; called immediately
+	called := false
+	OnComplete(tk, func(err error) { called = err == testErr })
+	if !called {
+		t.Fatal("callback not called on completed token")
+	}
+
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+
+	var outstanding atomic.Int32
+	done := make(chan struct{})
+	const count = 20
+	outstanding.Store(count)
+	for i := 0; i < count; i++ {
+		OnComplete(c.Publish("a", byte(i%3), false, "x"), func(err error) {
+			if err != nil {
+				t.Errorf("publish failed: %s", err)
+			}
+			if outstanding.Add(-1) == 0 {
+				close(done)
+			}
+		})
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%d callbacks not called", outstanding.Load())
+	}
+}
+
+// Test_BatchTokenReentrant checks that a BatchToken callback may call into the client when the flows are completed
+// by the loss of the connection (i.e. the batch does not complete whilst the message ID lock is held)
+func Test_BatchTokenReentrant(t *testing.T) {
+	mids := &messageIds{index: make(map[uint16]tokenCompletor), logger: noopSLogger}
+	pubs := []*PublishToken{newToken(packets.Publish).(*PublishToken), newToken(packets.Publish).(*PublishToken)}
+	for _, p := range pubs {
+		mids.getID(p)
+	}
+	b := newBatchToken(pubs)
+	called := make(chan error, 1)
+	b.OnComplete(func(err error) {
+		mids.getID(&DummyToken{})
+		called <- err
+	})
+
+	go mids.cleanUp()
+	select {
+	case err := <-called:
+		if !errors.Is(err, ErrConnectionLost) {
+			t.Fatalf("expected ErrConnectionLost, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock whilst completing batch")
+	}
+}
+
+func Test_PublishAsync(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	start := time.Now()
+	receipts := []<-chan DeliveryReceipt{
+		c.(AsyncPublisher).PublishAsync("a", 0, false, "0"),
+		c.(AsyncPublisher).PublishAsync("a", 1, false, "1"),
+		c.(AsyncPublisher).PublishAsync("a", 2, false, "2"),
+	}
+	for i, ch := range receipts {
+		select {
+		case r := <-ch:
+			if r.Err != nil {
+				t.Fatalf("qos %d: unexpected error %s", i, r.Err)
+			}
+			if (i == 0) != (r.MessageID == 0) {
+				t.Errorf("qos %d: unexpected message ID %d", i, r.MessageID)
+			}
+			if r.Completed.Before(start) {
+				t.Errorf("qos %d: completion time %s before start", i, r.Completed)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("qos %d: no receipt", i)
+		}
+	}
+
+	c.Disconnect(250)
+	select {
+	case r := <-c.(AsyncPublisher).PublishAsync("a", 1, false, "x"):
+		if !errors.Is(r.Err, ErrNotConnected) {
+			t.Fatalf("expected ErrNotConnected, got %v", r.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no receipt after disconnect")
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+)
+
+func Test_byteRateLimiter(t *testing.T) {
+	if newByteRateLimiter(0, clock.Real) != nil {
+		t.Fatal("expected nil limiter when there is no limit")
+	}
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newByteRateLimiter(1000, fake) // burst of 100 bytes
+	if d := l.reserve(100); d != 0 {
+		t.Fatalf("burst should not be delayed, got %s", d)
+	}
+	if d := l.reserve(100); d != 100*time.Millisecond {
+		t.Fatalf("expected 100ms delay, got %s", d)
+	}
+	fake.Advance(time.Second) // the bucket does not fill beyond the burst size
+	if d := l.reserve(100); d != 0 {
+		t.Fatalf("expected no delay, got %s", d)
+	}
+	if d := l.reserve(50); d != 50*time.Millisecond {
+		t.Fatalf("expected 50ms delay, got %s", d)
+	}
+}
+
+func Test_rateLimitedConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+
+	if newRateLimitedConn(client, 0, 0, clock.Real) != client {
+		t.Fatal("connection should not be wrapped when there are no limits")
+	}
+	conn := newRateLimitedConn(client, 10000, 0, clock.Real) // 1000 byte chunks, 100ms apart
+	start := time.Now()
+	if n, err := conn.Write(make([]byte, 3000)); n != 3000 || err != nil {
+		t.Fatalf("write returned %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected write to take about 200ms, took %s", elapsed)
+	}
+
+	// Close abandons any wait
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 100000))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = conn.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("expected closed error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write did not return after close")
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_resumePacer(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	var progress []ConnectionNotificationResume
+	p := newResumePacer(10, 2, 5, fake, func(n ConnectionNotificationResume) { progress = append(progress, n) }) // 200ms per batch
+	stop := make(chan struct{})
+
+	for i := 0; i < 2; i++ { // first batch is not delayed
+		if !p.wait(stop) {
+			t.Fatal("unexpected stop")
+		}
+		p.done()
+	}
+	waited := make(chan bool)
+	go func() { waited <- p.wait(stop) }()
+	fake.BlockUntil(1)
+	fake.Advance(150 * time.Millisecond)
+	select {
+	case <-waited:
+		t.Fatal("second batch started early")
+	case <-time.After(10 * time.Millisecond):
+	}
+	fake.Advance(50 * time.Millisecond)
+	if !<-waited {
+		t.Fatal("unexpected stop")
+	}
+	p.done()
+	p.skip() // e.g. message discarded
+	p.finish()
+
+	expected := []ConnectionNotificationResume{{Sent: 2, Total: 5}, {Sent: 3, Total: 4}}
+	if len(progress) != len(expected) || progress[0] != expected[0] || progress[1] != expected[1] {
+		t.Fatalf("expected progress %v, got %v", expected, progress)
+	}
+
+	// Closing stop abandons the wait
+	p = newResumePacer(1, 1, 2, fake, func(ConnectionNotificationResume) {})
+	p.wait(stop)
+	p.done()
+	close(stop)
+	if p.wait(stop) {
+		t.Fatal("expected wait to be abandoned")
+	}
+}
+
+func Test_ResumeRate(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	store := NewMemoryStore()
+	store.Open()
+	for i := uint16(1); i <= 5; i++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.TopicName = "resume"
+		pub.MessageID = i
+		pub.Payload = []byte("test")
+		store.Put(outboundKeyFromMID(i), pub)
+	}
+
+	ch := make(chan ConnectionNotificationEvent, 20)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("resumerate").SetCleanSession(false).
+		SetStore(store).SetResumeRate(50).SetResumeBatchSize(2).SetConnectionNotificationChannel(ch))
+	start := time.Now()
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond { // three batches, 40ms apart
+		t.Fatalf("resume was not paced (took %s)", elapsed)
+	}
+
+	var progress []ConnectionNotificationResume
+	for len(ch) > 0 {
+		if n, ok := (<-ch).ConnectionNotification.(ConnectionNotificationResume); ok {
+			progress = append(progress, n)
+		}
+	}
+	expected := []ConnectionNotificationResume{{Sent: 2, Total: 5}, {Sent: 4, Total: 5}, {Sent: 5, Total: 5}}
+	if len(progress) != len(expected) {
+		t.Fatalf("expected progress %v, got %v", expected, progress)
+	}
+	for i := range expected {
+		if progress[i] != expected[i] {
+			t.Fatalf("expected progress %v, got %v", expected, progress)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(store.All()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("messages not acknowledged: %v", store.All())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ResumeFilter(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker: %s", err)
+	}
+	defer b.Close()
+
+	received := make(chan string, 10)
+	sub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("resumefiltersub"))
+	if token := sub.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer sub.Disconnect(0)
+	if token := sub.Subscribe("resume", 1, func(_ Client, m Message) { received <- string(m.Payload()) }); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+
+	store := NewMemoryStore()
+	store.Open()
+	for i, payload := range []string{"keep", "drop", "keep", "drop"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.TopicName = "resume"
+		pub.MessageID = uint16(i + 1)
+		pub.Payload = []byte(payload)
+		store.Put(outboundKeyFromMID(pub.MessageID), pub)
+	}
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = 5
+	store.Put(outboundKeyFromMID(5), pubrel)
+
+	filtered := make(map[string]bool)
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("resumefilter").SetCleanSession(false).
+		SetStore(store).SetResumeFilter(func(key string, cp packets.ControlPacket) bool {
+			filtered[key] = true
+			return string(cp.(*packets.PublishPacket).Payload) == "keep"
+		}))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	defer c.Disconnect(0)
+	if len(filtered) != 4 || filtered[outboundKeyFromMID(5)] {
+		t.Fatalf("filter called for unexpected keys %v", filtered)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-received:
+			if p != "keep" {
+				t.Fatalf("unexpected message %q", p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("resumed message not received")
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(store.All()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("store not emptied: %v", store.All())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case p := <-received:
+		t.Fatalf("unexpected message %q", p)
+	default:
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_NewConnectRetryPolicy(t *testing.T) {
+	p := NewConnectRetryPolicy(time.Second, 3)
+	for _, tc := range []struct {
+		class   ConnectErrorClass
+		attempt int
+		retry   bool
+	}{
+		{ConnectErrorNetwork, 1, true},
+		{ConnectErrorServerUnavailable, 2, true},
+		{ConnectErrorNetwork, 3, false},
+		{ConnectErrorBadCredentials, 1, false},
+		{ConnectErrorNotAuthorized, 1, false},
+		{ConnectErrorRefused, 1, false},
+	} {
+		if retry, _ := p(tc.class, tc.attempt, nil); retry != tc.retry {
+			t.Errorf("%s attempt %d: expected retry %t", tc.class, tc.attempt, tc.retry)
+		}
+	}
+	if c := classifyConnectError(packets.ErrRefusedNotAuthorised); c != ConnectErrorNotAuthorized {
+		t.Errorf("unexpected class %s", c)
+	}
+}
+
+func Test_ConnectRetryPolicy_GiveUp(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.SetConnackReturnCode(packets.ErrRefusedNotAuthorised)
+
+	var attempts atomic.Int32
+	gaveUp := make(chan error, 1)
+	opts := NewClientOptions().AddBroker(b.URL()).SetProtocolVersion(4).
+		SetConnectionAttemptHandler(func(_ *url.URL, cfg *tls.Config) *tls.Config { attempts.Add(1); return cfg }).
+		SetConnectRetryPolicy(NewConnectRetryPolicy(10*time.Millisecond, 0), func(_ Client, err error) { gaveUp <- err })
+	c := NewClient(opts)
+	token := c.Connect()
+	if !token.WaitTimeout(5*time.Second) || !errors.Is(token.Error(), packets.ErrorRefusedNotAuthorised) {
+		t.Fatalf("expected not authorised error, got %v", token.Error())
+	}
+	select {
+	case <-gaveUp:
+	case <-time.After(time.Second):
+		t.Fatal("give up handler not called")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("expected a single attempt, got %d", n)
+	}
+	if c.IsConnected() {
+		t.Fatal("client should be disconnected")
+	}
+}
+
+func Test_ConnectRetryPolicy_Reconnect(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	gaveUp := make(chan error, 1)
+	opts := NewClientOptions().AddBroker(b.URL()).SetClientID("retry").SetProtocolVersion(4).SetAutoReconnect(true).
+		SetConnectRetryPolicy(NewConnectRetryPolicy(10*time.Millisecond, 0), func(_ Client, err error) { gaveUp <- err })
+	c := NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(0)
+
+	b.SetConnackReturnCode(packets.ErrRefusedBadUsernameOrPassword)
+	if err := b.DropConnection("retry"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-gaveUp:
+		if !errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("give up handler not called")
+	}
+	if c.IsConnected() {
+		t.Fatal("client should be disconnected")
+	}
+}
+
+// Test_ConnectGiveUp_NoPolicy checks that, on both Connect and reconnection, OnConnectGiveUp is only called when the
+// ConnectRetryPolicy gives up (not when attempts end for another reason, here a certificate pin mismatch)
+func Test_ConnectGiveUp_NoPolicy(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var mismatch atomic.Bool // when set, connection attempts fail as if the broker's certificate did not match
+	dial := func(uri *url.URL, _ ClientOptions) (net.Conn, error) {
+		if mismatch.Load() {
+			return nil, fmt.Errorf("tls handshake: %w", ErrCertificatePinMismatch)
+		}
+		return net.Dial("tcp", uri.Host)
+	}
+	newOpts := func(t *testing.T) *ClientOptions {
+		o := NewClientOptions().AddBroker(b.URL()).SetClientID("giveup").SetProtocolVersion(4).SetCustomOpenConnectionFn(dial)
+		o.OnConnectGiveUp = func(_ Client, err error) { t.Errorf("unexpected call to OnConnectGiveUp: %v", err) }
+		return o
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		mismatch.Store(true)
+		c := NewClient(newOpts(t).SetConnectRetry(true).SetConnectRetryInterval(10 * time.Millisecond))
+		token := c.Connect()
+		if !token.WaitTimeout(5*time.Second) || !errors.Is(token.Error(), ErrCertificatePinMismatch) {
+			t.Fatalf("expected ErrCertificatePinMismatch, got %v", token.Error())
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		mismatch.Store(false)
+		c := NewClient(newOpts(t).SetAutoReconnect(true).SetMaxReconnectInterval(10 * time.Millisecond))
+		if token := c.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+		defer c.Disconnect(0)
+		mismatch.Store(true)
+		if err := b.DropConnection("giveup"); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for c.(ConnectionWaiter).ConnectionState() != Disconnected { // reconnection is abandoned
+			if time.Now().After(deadline) {
+				t.Fatal("reconnection was not abandoned")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
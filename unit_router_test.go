@@ -19,10 +19,16 @@
 package mqtt
 
 import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/eclipse/paho.mqtt.golang/clock"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
@@ -359,9 +365,11 @@ func Test_MatchAndDispatch(t *testing.T) {
 	router := newRouter(noopSLogger)
 	router.addRoute("a", cb)
 
+	store := NewMemoryStore() // the PUBREC is recorded in the store
+	store.Open()
 	stopped := make(chan bool)
 	go func() {
-		router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+		router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: store})
 		stopped <- true
 	}()
 	msgs <- pub
@@ -395,9 +403,11 @@ func Test_SharedSubscription_MatchAndDispatch(t *testing.T) {
 	router := newRouter(noopSLogger)
 	router.addRoute("$share/az1/a", cb)
 
+	store := NewMemoryStore() // the PUBREC is recorded in the store
+	store.Open()
 	stopped := make(chan bool)
 	go func() {
-		router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+		router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: store})
 		stopped <- true
 	}()
 
@@ -416,6 +426,440 @@ func Test_SharedSubscription_MatchAndDispatch(t *testing.T) {
 
 }
 
+func Test_SharedSubscription_MessageMetadata(t *testing.T) {
+	type result struct {
+		group  string
+		shared bool
+	}
+	sharedCB := make(chan result, 1)
+	plainCB := make(chan result, 1)
+	callback := func(ch chan result) MessageHandler {
+		return func(c Client, m Message) {
+			group, shared := m.(SharedSubscriptionMessage).SharedSubscription()
+			ch <- result{group: group, shared: shared}
+		}
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Payload = []byte("foo")
+
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("$share/az1/a/+", callback(sharedCB))
+	router.addRoute("a/#", callback(plainCB))
+	ackOut := router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real})
+
+	msgs <- pub
+	if r := <-sharedCB; !r.shared || r.group != "az1" {
+		t.Errorf("expected shared message from group az1, got %+v", r)
+	}
+	if r := <-plainCB; r.shared || r.group != "" {
+		t.Errorf("expected non-shared message, got %+v", r)
+	}
+	close(msgs)
+	for range ackOut {
+	}
+}
+
+// Test_SharedSubscription_AddRoute checks that routes for the same filter with, and without, a shared subscription
+// prefix replace each other (rather than both being called for each message)
+func Test_SharedSubscription_AddRoute(t *testing.T) {
+	router := newRouter(noopSLogger)
+	router.addRoute("$share/g1/a/b", func(Client, Message) {})
+	router.addRoute("$share/g2/a/b", func(Client, Message) {})
+	router.addRoute("a/c", func(Client, Message) {})
+	router.addRoute("$queue/a/c", func(Client, Message) {})
+	if n := router.routes.Len(); n != 2 {
+		t.Fatalf("expected 2 routes, got %d", n)
+	}
+	if rt := router.routes.Front().Value.(*route); rt.topic != "$share/g2/a/b" || rt.shareGroup != "g2" {
+		t.Errorf("expected route for group g2, got %q (%q)", rt.topic, rt.shareGroup)
+	}
+	if rt := router.routes.Back().Value.(*route); rt.topic != "$queue/a/c" || !rt.shared {
+		t.Errorf("expected shared route for $queue/a/c, got %q (shared %t)", rt.topic, rt.shared)
+	}
+	router.addRoute("a/b", func(Client, Message) {})
+	if rt := router.routes.Front().Value.(*route); rt.topic != "a/b" || rt.shared {
+		t.Errorf("expected non-shared route for a/b, got %q (shared %t)", rt.topic, rt.shared)
+	}
+}
+
+func Test_MatchAndDispatch_OrderedPerTopic(t *testing.T) {
+	bReceived := make(chan struct{})
+	var mu sync.Mutex
+	var aPayloads []string
+	aDone := make(chan struct{})
+
+	cb := func(c Client, m Message) {
+		switch m.Topic() {
+		case "a":
+			if string(m.Payload()) == "0" {
+				<-bReceived // block; "b" must be handled concurrently and later "a" messages must wait
+			}
+			mu.Lock()
+			aPayloads = append(aPayloads, string(m.Payload()))
+			if len(aPayloads) == 3 {
+				close(aDone)
+			}
+			mu.Unlock()
+		case "b":
+			close(bReceived)
+		}
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("#", cb)
+	cl := &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real}
+	cl.options.OrderedPerTopic = true
+	ackOut := router.matchAndDispatch(msgs, false, cl)
+	go func() {
+		for range ackOut {
+		}
+	}()
+
+	for _, tp := range [][2]string{{"a", "0"}, {"a", "1"}, {"b", "0"}, {"a", "2"}} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = tp[0]
+		pub.Payload = []byte(tp[1])
+		msgs <- pub
+	}
+
+	select {
+	case <-aDone:
+	case <-time.After(time.Second):
+		t.Fatalf("messages not handled (topics not handled concurrently?)")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(aPayloads, ",") != "0,1,2" {
+		t.Fatalf("messages on topic a handled out of order: %v", aPayloads)
+	}
+	close(msgs)
+}
+
+func Test_MatchAndDispatch_HandlerPool(t *testing.T) {
+	var mu sync.Mutex
+	var running, maxRunning, handled int
+
+	cb := func(c Client, m Message) {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		handled++
+		mu.Unlock()
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("#", cb)
+	cl := &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real}
+	cl.options.HandlerPoolSize = 2
+	ackOut := router.matchAndDispatch(msgs, false, cl)
+
+	for i := 0; i < 10; i++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = fmt.Sprintf("topic/%d", i)
+		msgs <- pub
+	}
+	close(msgs)
+	for range ackOut { // closed once all handlers have completed
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if handled != 10 {
+		t.Fatalf("expected 10 messages handled, got %d", handled)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("expected at most 2 concurrent handlers, got %d", maxRunning)
+	}
+}
+
+// Test_MatchAndDispatch_HandlerPoolSubscribe checks that a handler can add a route (as Subscribe does) whilst the
+// handler pool is full (the router must not hold its lock whilst waiting for the pool)
+func Test_MatchAndDispatch_HandlerPoolSubscribe(t *testing.T) {
+	release := make(chan struct{})
+	var handled atomic.Int32
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("a", func(c Client, m Message) {
+		if handled.Add(1) == 1 {
+			<-release
+			router.addRoute("b", func(Client, Message) {})
+		}
+	})
+	cl := &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real}
+	cl.options.HandlerPoolSize = 1
+	ackOut := router.matchAndDispatch(msgs, false, cl)
+
+	for i := 0; i < 3; i++ { // one running, one queued and one waiting for space in the pool
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a"
+		msgs <- pub
+	}
+	time.Sleep(20 * time.Millisecond) // allow the router to block on the pool
+	close(release)
+	close(msgs)
+
+	done := make(chan struct{})
+	go func() {
+		for range ackOut { // closed once all handlers have completed
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock between the router and a handler adding a route")
+	}
+	if n := handled.Load(); n != 3 {
+		t.Fatalf("expected 3 messages handled, got %d", n)
+	}
+}
+
+func Test_MatchAndDispatch_Deduplication(t *testing.T) {
+	var handled []string
+	cb := func(c Client, m Message) {
+		handled = append(handled, string(m.Payload()))
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("#", cb)
+	store := NewMemoryStore()
+	store.Open()
+	cl := &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: store, dedup: newDedupCache(time.Minute)}
+	ackOut := router.matchAndDispatch(msgs, true, cl)
+
+	var acks int
+	ackDone := make(chan struct{})
+	go func() {
+		for range ackOut {
+			acks++
+		}
+		close(ackDone)
+	}()
+
+	publish := func(id uint16, topic string, dup bool, payload string) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = id
+		pub.TopicName = topic
+		pub.Dup = dup
+		pub.Payload = []byte(payload)
+		msgs <- pub
+	}
+	publish(1, "a", false, "first")
+	publish(1, "a", true, "redelivered") // duplicate; should be acknowledged but not handled
+	publish(1, "b", true, "other topic") // different topic so not a duplicate
+	publish(1, "a", false, "id reused")  // DUP not set so this is a new message
+	close(msgs)
+	<-ackDone
+
+	if exp := []string{"first", "other topic", "id reused"}; !reflect.DeepEqual(handled, exp) {
+		t.Fatalf("expected %v to be handled, got %v", exp, handled)
+	}
+	if acks != 4 {
+		t.Fatalf("expected 4 acknowledgements, got %d", acks)
+	}
+}
+
+func Test_MatchAndDispatch_Nack(t *testing.T) {
+	type delivery struct {
+		dup bool
+		msg ManualAckMessage
+	}
+	deliveries := make(chan delivery, 10)
+	cb := func(c Client, m Message) {
+		mm := m.(ManualAckMessage)
+		if !m.Duplicate() {
+			m.Payload()[0] = 'X' // must not affect the redelivered message (which comes from the store)
+			if err := mm.Nack(); err != nil {
+				t.Errorf("unexpected error from Nack: %v", err)
+			}
+		}
+		deliveries <- delivery{dup: m.Duplicate(), msg: mm}
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("#", cb)
+	store := NewMemoryStore()
+	store.Open()
+	cl := &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: store}
+	cl.options.AutoAckDisabled = true
+	ackOut := router.matchAndDispatch(msgs, true, cl)
+	acks := make(chan *PacketAndToken, 10)
+	go func() {
+		for a := range ackOut {
+			acks <- a
+		}
+		close(acks)
+	}()
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 5
+	pub.TopicName = "a"
+	pub.Payload = []byte("payload")
+	stored := *pub // as stored by the network goroutine (a file store would return a decoded copy)
+	stored.Payload = []byte("payload")
+	store.Put(inboundKeyFromMID(5), &stored)
+	msgs <- pub
+
+	first, second := <-deliveries, <-deliveries
+	if first.dup || !second.dup {
+		t.Fatalf("expected original delivery followed by redelivery, got dup=%v then dup=%v", first.dup, second.dup)
+	}
+	if p := string(second.msg.Payload()); p != "payload" {
+		t.Fatalf("expected the stored payload to be redelivered, got %q", p)
+	}
+	if err := first.msg.Acknowledge(); err != ErrMessageSettled {
+		t.Fatalf("expected ErrMessageSettled acknowledging a nacked message, got %v", err)
+	}
+	if err := second.msg.Acknowledge(); err != nil {
+		t.Fatalf("unexpected error from Acknowledge: %v", err)
+	}
+	if a := <-acks; a.p.(*packets.PubackPacket).MessageID != 5 {
+		t.Fatalf("expected puback for message 5")
+	}
+
+	// Once processing has stopped acknowledgements cannot be sent
+	pub.Dup = true // so the handler does not nack it
+	msgs <- pub
+	late := <-deliveries
+	close(msgs)
+	for range acks {
+	}
+	if err := late.msg.Acknowledge(); err != ErrAckNotSent {
+		t.Fatalf("expected ErrAckNotSent, got %v", err)
+	}
+	late.msg.Ack() // must not panic
+}
+
+func Test_MatchAndDispatch_AckTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		action     AckTimeoutAction
+		deliveries int
+	}{
+		{AckTimeoutDiscard, 1},
+		{AckTimeoutRedispatch, 2},
+	} {
+		deliveries := make(chan Message, 10)
+		timedOut := make(chan Message, 10)
+		msgs := make(chan *packets.PublishPacket)
+		router := newRouter(noopSLogger)
+		router.addRoute("#", func(c Client, m Message) {
+			deliveries <- m // never acknowledged
+		})
+		store := NewMemoryStore()
+		store.Open()
+		fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		cl := &client{oboundP: make(chan *PacketAndToken, 100), clock: fake, persist: store}
+		cl.options.AutoAckDisabled = true
+		cl.options.AckTimeout = time.Minute
+		var calls atomic.Int32
+		cl.options.OnAckTimeout = func(m Message) AckTimeoutAction {
+			timedOut <- m
+			if calls.Add(1) > 1 {
+				return AckTimeoutIgnore // prevent endless redelivery
+			}
+			return tc.action
+		}
+		ackOut := router.matchAndDispatch(msgs, false, cl)
+
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = 3
+		pub.TopicName = "a"
+		store.Put(inboundKeyFromMID(3), pub)
+		msgs <- pub
+
+		for i := 0; i < tc.deliveries; i++ {
+			select {
+			case <-deliveries:
+			case <-time.After(time.Second):
+				t.Fatalf("action %d: expected %d deliveries, got %d", tc.action, tc.deliveries, i)
+			}
+			fake.BlockUntil(1)
+			select {
+			case <-timedOut:
+				t.Fatalf("action %d: ack timeout before the clock advanced", tc.action)
+			default:
+			}
+			fake.Advance(cl.options.AckTimeout)
+			<-timedOut
+		}
+		if tc.action == AckTimeoutDiscard {
+			if a := <-ackOut; a.p.(*packets.PubackPacket).MessageID != 3 {
+				t.Fatalf("expected puback for message 3")
+			}
+		}
+		close(msgs)
+		for range ackOut {
+		}
+	}
+}
+
+// Test_MatchAndDispatch_AckTimeoutQos0 checks that the ack timeout is not applied to QoS 0 messages (which are never
+// acknowledged)
+func Test_MatchAndDispatch_AckTimeoutQos0(t *testing.T) {
+	deliveries := make(chan Message, 1)
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("#", func(c Client, m Message) { deliveries <- m })
+	store := NewMemoryStore()
+	store.Open()
+	cl := &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: store}
+	cl.options.AutoAckDisabled = true
+	cl.options.AckTimeout = 10 * time.Millisecond
+	cl.options.OnAckTimeout = func(m Message) AckTimeoutAction {
+		t.Errorf("ack timeout for QoS 0 message %q", m.Topic())
+		return AckTimeoutIgnore
+	}
+	ackOut := router.matchAndDispatch(msgs, true, cl)
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a"
+	msgs <- pub
+	m := <-deliveries
+	if m.(*routedMessage).settledC != nil {
+		t.Fatal("ack timer started for QoS 0 message")
+	}
+	close(msgs)
+	for range ackOut {
+	}
+}
+
+func Test_dedupCacheExpiry(t *testing.T) {
+	d := newDedupCache(time.Second)
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 7
+	pub.TopicName = "a"
+	pub.Dup = true
+
+	now := time.Now()
+	if d.duplicate(pub, now) {
+		t.Fatalf("first receipt should not be a duplicate")
+	}
+	if !d.duplicate(pub, now.Add(500*time.Millisecond)) {
+		t.Fatalf("redelivery within window should be a duplicate")
+	}
+	if d.duplicate(pub, now.Add(2*time.Second)) {
+		t.Fatalf("redelivery outside window should not be a duplicate")
+	}
+	if len(d.seen) != 1 || len(d.entries) != 1 {
+		t.Fatalf("expected expired entries to be removed, got %d/%d", len(d.seen), len(d.entries))
+	}
+}
+
 func Benchmark_MatchAndDispatch(b *testing.B) {
 	calledback := make(chan bool, 1)
 
@@ -438,7 +882,7 @@ func Benchmark_MatchAndDispatch(b *testing.B) {
 	stopped := make(chan bool)
 	go func() {
 		wg.Done() // started
-		<-router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+		<-router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real})
 		stopped <- true
 	}()
 
@@ -459,3 +903,334 @@ func Benchmark_MatchAndDispatch(b *testing.B) {
 		b.Errorf("matchAndDispatch should have exited")
 	}
 }
+
+func Test_MatchAndDispatch_MessageMetadata(t *testing.T) {
+	type result struct {
+		receivedAt time.Time
+		broker     *url.URL
+		filter     string
+	}
+	results := make(chan result, 4)
+	cb := func(c Client, m Message) {
+		mm := m.(MetadataMessage)
+		results <- result{receivedAt: mm.ReceivedAt(), broker: mm.Broker(), filter: mm.MatchedFilter()}
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("$share/g1/a/+", cb)
+	router.addRoute("a/#", cb)
+	router.addMatcherRoute(MustParseTopicTemplate("a/{x}"), cb)
+	router.setDefaultHandler(cb)
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := &client{oboundP: make(chan *PacketAndToken, 100), clock: fake}
+	broker, _ := url.Parse("tcp://broker1:1883")
+	c.connectedBroker.Store(broker)
+	ackOut := router.matchAndDispatch(msgs, true, c)
+
+	for _, tc := range []struct {
+		topic   string
+		filters []string
+	}{
+		{"a/b", []string{"$share/g1/a/+", "a/#", "a/+"}},
+		{"z", []string{""}},
+	} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = tc.topic
+		msgs <- pub
+		for _, filter := range tc.filters {
+			r := <-results
+			if r.filter != filter || r.broker != broker || !r.receivedAt.Equal(fake.Now()) {
+				t.Errorf("%s: unexpected metadata %+v (expected filter %q)", tc.topic, r, filter)
+			}
+		}
+	}
+	close(msgs)
+	for range ackOut {
+	}
+}
+
+func Test_MatchAndDispatch_MatcherRoute(t *testing.T) {
+	type result struct {
+		params map[string]string
+		group  string
+	}
+	results := make(chan result, 2)
+	cb := func(c Client, m Message) {
+		group, _ := m.(SharedSubscriptionMessage).SharedSubscription()
+		results <- result{params: m.(TopicParamsMessage).Params(), group: group}
+	}
+
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addMatcherRoute(MustParseTopicTemplate("devices/{id}/state"), cb)
+	router.addMatcherRoute(MustParseTopicTemplate("$share/g1/devices/{id}/{attr}"), cb)
+	ackOut := router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real})
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "devices/d1/state"
+	msgs <- pub
+	got := []result{<-results, <-results}
+	expected := []result{
+		{params: map[string]string{"id": "d1"}},
+		{params: map[string]string{"id": "d1", "attr": "state"}, group: "g1"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+
+	router.deleteRoute("devices/{id}/state")
+	if router.routes.Len() != 1 {
+		t.Errorf("expected one route following delete, got %d", router.routes.Len())
+	}
+	close(msgs)
+	for range ackOut {
+	}
+}
+
+func Test_MatchAndDispatch_RouteOptions(t *testing.T) {
+	release := make(chan struct{})
+	var slowCount atomic.Int32
+	slow := func(c Client, m Message) {
+		slowCount.Add(1)
+		<-release
+	}
+	fast := make(chan string, 10)
+
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRouteWithOptions("slow", slow, RouteOptions{BufferSize: 1, DropPolicy: RouteDropNewest})
+	router.addRoute("fast", func(c Client, m Message) { fast <- string(m.Payload()) })
+	store := NewMemoryStore()
+	store.Open()
+	ackOut := router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: store})
+	acks := make(chan *PacketAndToken, 10)
+	go func() {
+		for a := range ackOut {
+			acks <- a
+		}
+		close(acks)
+	}()
+
+	send := func(topic string, id uint16) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName, pub.Qos, pub.MessageID, pub.Payload = topic, 1, id, []byte(topic)
+		msgs <- pub
+	}
+	// The first message is passed to the handler, the second is queued and the third is dropped (and acknowledged)
+	for i := uint16(1); i <= 3; i++ {
+		send("slow", i)
+	}
+	select {
+	case a := <-acks:
+		if id := a.p.(*packets.PubackPacket).MessageID; id != 3 {
+			t.Fatalf("expected ack for dropped message 3, got %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dropped message was not acknowledged")
+	}
+	// The blocked handler must not delay other routes
+	send("fast", 4)
+	select {
+	case <-fast:
+	case <-time.After(time.Second):
+		t.Fatal("message for fast route delayed by slow route")
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ { // acks for 1, 2 and 4 (in any order)
+		select {
+		case <-acks:
+		case <-time.After(time.Second):
+			t.Fatal("expected acknowledgement")
+		}
+	}
+	if n := slowCount.Load(); n != 2 {
+		t.Errorf("expected slow handler to be called twice, got %d", n)
+	}
+	close(msgs)
+	for range acks {
+	}
+}
+
+// Test_MatchAndDispatch_RouteQueueShutdown checks that messages in a route queue when the router stops are still
+// acknowledged
+func Test_MatchAndDispatch_RouteQueueShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRouteWithOptions("a", func(c Client, m Message) {
+		started <- struct{}{}
+		<-release
+	}, RouteOptions{BufferSize: 5})
+	store := NewMemoryStore()
+	store.Open()
+	ackOut := router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: store})
+
+	for id := uint16(1); id <= 3; id++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName, pub.Qos, pub.MessageID = "a", 1, id
+		msgs <- pub
+	}
+	<-started // the first message is being handled and the others are queued
+	close(msgs)
+	select { // the router must not stop while the handler is blocked (nothing can be received until it is released)
+	case _, ok := <-ackOut:
+		t.Fatalf("unexpected receive from the ack channel (open: %t)", ok)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	acks := 0
+	for range ackOut {
+		acks++
+	}
+	if acks != 3 {
+		t.Fatalf("expected 3 acknowledgements, got %d", acks)
+	}
+}
+
+func Test_routeQueue(t *testing.T) {
+	q := newRouteQueue(RouteOptions{MaxConcurrency: 2, DropPolicy: RouteDropOldest})
+	release := make(chan struct{})
+	var running, dropped atomic.Int32
+	var wg sync.WaitGroup
+	push := func() {
+		wg.Add(1)
+		q.push(queuedMessage{
+			run:  func() { running.Add(1); <-release; wg.Done() },
+			drop: func() { dropped.Add(1); wg.Done() },
+		})
+	}
+	push()
+	push()
+	for running.Load() != 2 { // wait for both handlers to start
+		time.Sleep(time.Millisecond)
+	}
+	push() // no buffer so dropped
+	if n := dropped.Load(); n != 1 {
+		t.Errorf("expected 1 dropped message, got %d", n)
+	}
+	close(release)
+	wg.Wait()
+}
+
+func Test_MatchAndDispatch_HandlerPanic(t *testing.T) {
+	type panicInfo struct {
+		topic string
+		r     interface{}
+		stack bool
+	}
+	panics := make(chan panicInfo, 1)
+	msgs := make(chan *packets.PublishPacket)
+	router := newRouter(noopSLogger)
+	router.addRoute("a", func(c Client, m Message) { panic("boom") })
+	store := NewMemoryStore()
+	store.Open()
+	cl := &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: store}
+	cl.options.OnHandlerPanic = func(topic string, r interface{}, stack []byte) {
+		panics <- panicInfo{topic: topic, r: r, stack: len(stack) > 0}
+	}
+	ackOut := router.matchAndDispatch(msgs, true, cl)
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID = "a", 1, 1
+	msgs <- pub
+	if p := <-panics; p.topic != "a" || p.r != "boom" || !p.stack {
+		t.Errorf("unexpected panic info %+v", p)
+	}
+	if ack := <-ackOut; ack.p.(*packets.PubackPacket).MessageID != 1 {
+		t.Errorf("expected message to be acknowledged following panic")
+	}
+	close(msgs)
+	for range ackOut {
+	}
+}
+
+func Test_routeQueue_LatestOnly(t *testing.T) {
+	q := newRouteQueue(RouteOptions{LatestOnly: true})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var mu sync.Mutex
+	var handled, dropped []string
+	var wg sync.WaitGroup
+	push := func(topic, value string) {
+		wg.Add(1)
+		q.push(queuedMessage{
+			topic: topic,
+			run: func() {
+				if value == "a0" {
+					close(started)
+					<-release
+				}
+				mu.Lock()
+				handled = append(handled, value)
+				mu.Unlock()
+				wg.Done()
+			},
+			drop: func() {
+				mu.Lock()
+				dropped = append(dropped, value)
+				mu.Unlock()
+				wg.Done()
+			},
+		})
+	}
+	push("a", "a0")
+	<-started // handler busy so subsequent messages are queued
+	push("a", "a1")
+	push("b", "b1")
+	push("a", "a2")
+	close(release)
+	wg.Wait()
+	if exp := []string{"a0", "a2", "b1"}; !reflect.DeepEqual(handled, exp) {
+		t.Errorf("expected %v to be handled, got %v", exp, handled)
+	}
+	if exp := []string{"a1"}; !reflect.DeepEqual(dropped, exp) {
+		t.Errorf("expected %v to be dropped, got %v", exp, dropped)
+	}
+}
+
+func Test_MatchAndDispatch_MostSpecific(t *testing.T) {
+	var called []string
+	router := newRouter(noopSLogger)
+	for _, filter := range []string{"#", "a/+/c", "a/b/+", "a/b/c", "$share/g/a/b/c", "+/b/#", "x/#", "x"} {
+		router.addRoute(filter, func(filter string) MessageHandler {
+			return func(Client, Message) { called = append(called, filter) }
+		}(filter))
+	}
+	done := make(chan struct{})
+	router.addRoute("done", func(Client, Message) { done <- struct{}{} })
+
+	msgs := make(chan *packets.PublishPacket)
+	c := &client{oboundP: make(chan *PacketAndToken, 100), clock: clock.Real, persist: NewMemoryStore()}
+	c.options.RouteMatchingStrategy = RouteMatchMostSpecific
+	acks := router.matchAndDispatch(msgs, true, c)
+
+	for _, tc := range []struct {
+		topic    string
+		expected []string
+	}{
+		{"a/b/c", []string{"$share/g/a/b/c"}}, // replaced the route for a/b/c
+		{"a/b/d", []string{"a/b/+"}},
+		{"a/x/c", []string{"a/+/c"}},
+		{"z/b/c", []string{"+/b/#"}},
+		{"x", []string{"x"}},
+		{"q", []string{"#"}},
+	} {
+		called = nil
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = tc.topic
+		msgs <- pub
+		marker := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket) // handled after pub (order is true)
+		marker.TopicName = "done"
+		msgs <- marker
+		<-done
+		if !reflect.DeepEqual(called, tc.expected) {
+			t.Errorf("%s: expected handlers %v, got %v", tc.topic, tc.expected, called)
+		}
+	}
+	close(msgs)
+	for range acks {
+	}
+}
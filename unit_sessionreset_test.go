@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// connectRecorder records the CONNECT packet sent over a connection
+type connectRecorder struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (r *connectRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	r.written.Write(b)
+	r.mu.Unlock()
+	return r.Conn.Write(b)
+}
+
+func (r *connectRecorder) connect(t *testing.T) *packets.ConnectPacket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cp, err := packets.ReadPacket(bytes.NewReader(r.written.Bytes()))
+	if err != nil {
+		t.Fatalf("reading CONNECT: %s", err)
+	}
+	return cp.(*packets.ConnectPacket)
+}
+
+func Test_CleanSessionFallback(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, tc := range []struct {
+		name    string
+		prepare func(dir string) error
+	}{
+		{"unsupported version", func(dir string) error {
+			return os.WriteFile(path.Join(dir, versionFile), []byte("99\n"), 0600)
+		}},
+		{"unreadable packet", func(dir string) error {
+			return os.WriteFile(path.Join(dir, "o.1"+msgExt), []byte{0xff, 0xff}, 0600)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := tc.prepare(dir); err != nil {
+				t.Fatal(err)
+			}
+			var rec *connectRecorder
+			reset := make(chan error, 1)
+			store := NewFileStore(dir)
+			c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("fallback").SetCleanSession(false).
+				SetStore(store).SetCleanSessionFallback(true, func(reason error) { reset <- reason }).
+				SetConnWrapper(func(conn net.Conn) net.Conn { rec = &connectRecorder{Conn: conn}; return rec }))
+			if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+				t.Fatalf("connect failed: %v", token.Error())
+			}
+			defer c.Disconnect(250)
+			select {
+			case reason := <-reset:
+				if !errors.Is(reason, ErrSessionCorrupt) {
+					t.Fatalf("unexpected reason: %v", reason)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnSessionReset not called")
+			}
+			if !rec.connect(t).CleanSession {
+				t.Fatal("expected a clean session to be requested")
+			}
+			if keys := store.All(); len(keys) != 0 {
+				t.Fatalf("expected store to be empty, got %v", keys)
+			}
+			if v, err := ReadFileStoreVersion(dir); err != nil || v != FileStoreFormatVersion {
+				t.Fatalf("unexpected store version %d (%v)", v, err)
+			}
+		})
+	}
+
+	// Without corruption the session is resumed as normal
+	dir := t.TempDir()
+	var rec *connectRecorder
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("fallback").SetCleanSession(false).
+		SetStore(NewFileStore(dir)).SetCleanSessionFallback(true, func(reason error) { t.Errorf("unexpected reset: %v", reason) }).
+		SetConnWrapper(func(conn net.Conn) net.Conn { rec = &connectRecorder{Conn: conn}; return rec }))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect failed: %v", token.Error())
+	}
+	c.Disconnect(250)
+	if rec.connect(t).CleanSession {
+		t.Fatal("expected the session to be resumed")
+	}
+}
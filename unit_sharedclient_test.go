@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func Test_SharedClient(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	c := NewClient(NewClientOptions().AddBroker(b.URL()))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+	s := NewSharedClient(c)
+
+	received := make(chan string, 10)
+	handler := func(name string) MessageHandler {
+		return func(_ Client, m Message) { received <- name + ":" + string(m.Payload()) }
+	}
+	expect := func(exp ...string) {
+		t.Helper()
+		got := map[string]bool{}
+		for range exp {
+			select {
+			case r := <-received:
+				got[r] = true
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for %v (got %v)", exp, got)
+			}
+		}
+		for _, e := range exp {
+			if !got[e] {
+				t.Fatalf("expected %v, got %v", exp, got)
+			}
+		}
+		select {
+		case r := <-received:
+			t.Fatalf("unexpected message %s", r)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	c1, c2 := s.Consumer(), s.Consumer()
+	if token := c1.Subscribe("a/b", 0, handler("c1")); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if token := c2.Subscribe("a/b", 1, handler("c2")); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if subs := c.(SubscriptionLister).Subscriptions(); len(subs) != 1 || subs[0].Qos != 1 {
+		t.Fatalf("expected a single subscription at QoS 1, got %+v", subs)
+	}
+	b.Publish("a/b", 1, false, []byte("1"))
+	expect("c1:1", "c2:1")
+
+	// Unsubscribing one consumer must not affect the other
+	if token := c1.Unsubscribe("a/b"); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if subs := c.(SubscriptionLister).Subscriptions(); len(subs) != 1 {
+		t.Fatalf("subscription should remain whilst c2 is subscribed, got %+v", subs)
+	}
+	b.Publish("a/b", 1, false, []byte("2"))
+	expect("c2:2")
+
+	if token := c2.Close(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	if subs := c.(SubscriptionLister).Subscriptions(); len(subs) != 0 {
+		t.Fatalf("expected no subscriptions, got %+v", subs)
+	}
+	b.Publish("a/b", 1, false, []byte("3"))
+	expect()
+}
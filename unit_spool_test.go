@@ -0,0 +1,324 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+)
+
+func Test_Spooler(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	sub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("sub"))
+	if token := sub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer sub.Disconnect(250)
+	received := make(chan string, 20)
+	sub.Subscribe("spool/#", 1, func(_ Client, m Message) { received <- string(m.Payload()) }).Wait()
+
+	dir := t.TempDir()
+	delivered := make(chan uint64, 20)
+	opts := SpoolOptions{SegmentSize: 64, RetryInterval: 10 * time.Millisecond, OnDelivered: func(seq uint64, _ string) { delivered <- seq }}
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("pub"))
+	s, err := NewSpooler(c, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages are spooled whilst the client is not connected
+	for _, p := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := s.Enqueue("spool/x", 1, false, []byte(p+"-0123456789012345678901234567890123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.Pending(); n != 5 {
+		t.Fatalf("expected 5 pending, got %d", n)
+	}
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+	for i, exp := range []string{"a", "b", "c", "d", "e"} {
+		select {
+		case p := <-received:
+			if p[:1] != exp {
+				t.Fatalf("expected message %s, got %s", exp, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for message %s", exp)
+		}
+		if seq := <-delivered; seq != uint64(i+1) {
+			t.Fatalf("expected delivery of %d, got %d", i+1, seq)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt)); len(segs) != 1 {
+		t.Errorf("expected delivered segments to be removed, found %v", segs)
+	}
+
+	// Nothing is redelivered following a restart
+	s, err = NewSpooler(c, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := s.Pending(); n != 0 {
+		t.Fatalf("expected nothing pending after restart, got %d", n)
+	}
+	if seq, err := s.Enqueue("spool/x", 1, false, []byte("f")); err != nil || seq != 6 {
+		t.Fatalf("expected seq 6, got %d (%v)", seq, err)
+	}
+	select {
+	case p := <-received:
+		if p != "f" {
+			t.Fatalf("expected message f, got %s", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message f")
+	}
+}
+
+func Test_Spooler_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	c := NewClient(NewClientOptions().AddBroker("tcp://127.0.0.1:1"))
+	s, err := NewSpooler(c, dir, SpoolOptions{RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a", "b"} {
+		if _, err := s.Enqueue("spool/x", 1, true, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Enqueue("spool/x", 1, false, nil); err != ErrSpoolClosed {
+		t.Fatalf("expected ErrSpoolClosed, got %v", err)
+	}
+
+	// Simulate a torn write at the end of the segment
+	seg := filepath.Join(dir, "0000000000000001"+spoolSegmentExt)
+	f, err := os.OpenFile(seg, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := encodeSpoolRecord(spoolRecord{seq: 3, topic: "spool/x", payload: []byte("c")})
+	f.Write(rec[:len(rec)-1])
+	f.Close()
+
+	s, err = NewSpooler(c, dir, SpoolOptions{RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := s.Pending(); n != 2 {
+		t.Fatalf("expected 2 pending, got %d", n)
+	}
+	if seq, err := s.Enqueue("spool/x", 1, false, []byte("c")); err != nil || seq != 3 {
+		t.Fatalf("expected seq 3, got %d (%v)", seq, err)
+	}
+	f, err = os.Open(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var off int64
+	for _, exp := range []string{"a", "b", "c"} {
+		r, n, err := readSpoolRecord(f, off, fi.Size())
+		if err != nil || string(r.payload) != exp || r.retained != (exp != "c") {
+			t.Fatalf("unexpected record %+v (%v)", r, err)
+		}
+		off += n
+	}
+}
+
+// Test_readSpoolRecordLength checks that a corrupt record length is rejected without allocating a buffer of that size
+func Test_readSpoolRecordLength(t *testing.T) {
+	rec := encodeSpoolRecord(spoolRecord{seq: 1, topic: "spool/x", payload: []byte("a")})
+	if _, n, err := readSpoolRecord(bytes.NewReader(rec), 0, int64(len(rec))); err != nil || n != int64(len(rec)) {
+		t.Fatalf("unexpected result %d (%v)", n, err)
+	}
+	if _, _, err := readSpoolRecord(bytes.NewReader(rec), 0, int64(len(rec)-1)); err != io.EOF {
+		t.Fatalf("expected io.EOF for record beyond limit, got %v", err)
+	}
+	binary.BigEndian.PutUint32(rec, 0xFFFFFFFF)
+	if _, _, err := readSpoolRecord(bytes.NewReader(rec), 0, math.MaxInt64); err == nil || err == io.EOF {
+		t.Fatalf("expected error for corrupt length, got %v", err)
+	}
+}
+
+// Test_Spooler_FailedWrite checks that the sequence number of a record that may have been written is not reused
+func Test_Spooler_FailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	c := NewClient(NewClientOptions().AddBroker("tcp://127.0.0.1:1"))
+	s, err := NewSpooler(c, dir, SpoolOptions{RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if seq, err := s.Enqueue("spool/x", 1, false, []byte("a")); err != nil || seq != 1 {
+		t.Fatalf("expected seq 1, got %d (%v)", seq, err)
+	}
+
+	// Replace the writer with a read only file, so the write fails and the segment cannot be truncated
+	ro, err := os.Open(filepath.Join(dir, "0000000000000001"+spoolSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.writer.Close()
+	s.writer = ro
+	s.mu.Unlock()
+	if _, err := s.Enqueue("spool/x", 1, false, []byte("b")); err == nil {
+		t.Fatal("expected error")
+	}
+	if seq, err := s.Enqueue("spool/x", 1, false, []byte("c")); err != nil || seq != 3 {
+		t.Fatalf("expected seq 3, got %d (%v)", seq, err)
+	}
+}
+
+// memBlob is an in-memory BlobBackend
+type memBlob struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (b *memBlob) Put(_ context.Context, name string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blobs[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (b *memBlob) Get(_ context.Context, name string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.blobs[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (b *memBlob) Delete(_ context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.blobs, name)
+	return nil
+}
+
+func (b *memBlob) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.blobs)
+}
+
+func Test_Spooler_Blob(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	dir := t.TempDir()
+	blob := &memBlob{blobs: make(map[string][]byte)}
+	// Each record exceeds SegmentSize so is held in its own segment
+	opts := SpoolOptions{SegmentSize: 64, RetryInterval: 10 * time.Millisecond, Blob: blob, MaxLocalSize: 150}
+	c := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("pub"))
+	s, err := NewSpooler(c, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := s.Enqueue("spool/x", 1, false, []byte(fmt.Sprintf("%d-0123456789012345678901234567890123456789", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the segment being read (the first) and that being written (the last) fit locally
+	deadline := time.Now().Add(5 * time.Second)
+	for blob.len() != 8 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 8 segments in blob storage, got %d", blob.len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt)); len(segs) != 2 {
+		t.Fatalf("expected 2 local segments, found %v", segs)
+	}
+
+	// Following a restart, the offloaded segments are retrieved as they are reached
+	sub := NewClient(NewClientOptions().AddBroker(b.URL()).SetClientID("sub"))
+	if token := sub.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer sub.Disconnect(250)
+	received := make(chan string, 20)
+	sub.Subscribe("spool/#", 1, func(_ Client, m Message) { received <- string(m.Payload()) }).Wait()
+	if s, err = NewSpooler(c, dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+	for i := 0; i < 10; i++ {
+		select {
+		case p := <-received:
+			if exp := fmt.Sprint(i); p[:1] != exp {
+				t.Fatalf("expected message %s, got %s", exp, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for blob.len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected delivered segments to be deleted from blob storage, %d remain", blob.len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if markers, _ := filepath.Glob(filepath.Join(dir, "*"+spoolRemoteExt)); len(markers) != 0 {
+		t.Errorf("expected no remote markers to remain, found %v", markers)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func Test_resolveSRVBrokers(t *testing.T) {
+	defer func(f func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if proto != "tcp" || name != "example.com" {
+			t.Fatalf("unexpected lookup %s %s %s", service, proto, name)
+		}
+		switch service {
+		case "secure-mqtt":
+			return "", []*net.SRV{{Target: "b1.example.com.", Port: 8883, Priority: 10, Weight: 5}}, nil
+		case "mqtt":
+			return "", []*net.SRV{
+				{Target: "b1.example.com.", Port: 1883, Priority: 10, Weight: 5},
+				{Target: "b2.example.com.", Port: 1884, Priority: 20, Weight: 5},
+			}, nil
+		}
+		return "", nil, errors.New("no such service")
+	}
+
+	c := NewClient(NewClientOptions().SetSRVLookup("example.com")).(*client)
+	brokers := c.resolveSRVBrokers("example.com")
+	expected := []string{"ssl://b1.example.com:8883", "tcp://b1.example.com:1883", "tcp://b2.example.com:1884"}
+	if len(brokers) != len(expected) {
+		t.Fatalf("expected %d brokers, got %v", len(expected), brokers)
+	}
+	for i, e := range expected {
+		if brokers[i].String() != e {
+			t.Fatalf("position %d: expected %s, got %s", i, e, brokers[i])
+		}
+	}
+}
+
+func Test_ConnectNoSRVBrokers(t *testing.T) {
+	defer func(f func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = f }(lookupSRV)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, errors.New("no such host")
+	}
+
+	c := NewClient(NewClientOptions().SetSRVLookup("example.com"))
+	token := c.Connect()
+	token.Wait()
+	if !errors.Is(token.Error(), ErrNoBrokers) {
+		t.Fatalf("expected ErrNoBrokers, got %v", token.Error())
+	}
+}
@@ -19,7 +19,14 @@
 package mqtt
 
 import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
@@ -187,14 +194,16 @@ func Test_persistOutbound_puback(t *testing.T) {
 func Test_persistOutbound_pubrec(t *testing.T) {
 	ts := &TestStore{}
 	m := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	m.MessageID = 44
 	persistOutbound(ts, m, noopSLogger)
 
-	if len(ts.mput) != 0 {
-		t.Fatalf("persistOutbound put message it should not have")
+	// The pubrec replaces the inbound publish (TestStore is not an UpdatableStore so this is a Get then Put)
+	if len(ts.mput) != 1 || ts.mput[0] != 44 {
+		t.Fatalf("persistOutbound in bad state")
 	}
 
-	if len(ts.mget) != 0 {
-		t.Fatalf("persistOutbound get message it should not have")
+	if len(ts.mget) != 1 || ts.mget[0] != 44 {
+		t.Fatalf("persistOutbound in bad state")
 	}
 
 	if len(ts.mdel) != 0 {
@@ -390,13 +399,15 @@ func Test_persistInbound_publish_2(t *testing.T) {
 	m.TopicName = "/pipub2"
 	m.Payload = []byte{0xCC, 0x03}
 	m.MessageID = 52
-	persistInbound(ts, m, noopSLogger)
+	if !persistInbound(ts, m, noopSLogger) {
+		t.Fatalf("persistInbound reported a new message as redelivered")
+	}
 
 	if len(ts.mput) != 1 || ts.mput[0] != 52 {
 		t.Fatalf("persistInbound in bad state")
 	}
 
-	if len(ts.mget) != 0 {
+	if len(ts.mget) != 1 || ts.mget[0] != 52 { // checks whether the message has already been acknowledged
 		t.Fatalf("persistInbound in bad state")
 	}
 
@@ -570,3 +581,372 @@ func Test_persistInbound_pingresp(t *testing.T) {
 		t.Fatalf("persistInbound in bad state")
 	}
 }
+
+func Test_persistSubscription(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	store.Open()
+	defer store.Close()
+
+	persistSubscription(store, "a/+/c", 1, "handler")
+	key := subscriptionKey("a/+/c")
+	if !isKeySubscription(key) || isKeyInbound(key) || isKeyOutbound(key) {
+		t.Fatalf("unexpected key %s", key)
+	}
+	topic, qos, name, ok := subscriptionFromPacket(store.Get(key))
+	if !ok || topic != "a/+/c" || qos != 1 || name != "handler" {
+		t.Fatalf("unexpected subscription (%t) %s %d %s", ok, topic, qos, name)
+	}
+}
+
+func Test_restoreSubscriptions(t *testing.T) {
+	called := make(chan string, 1)
+	opts := NewClientOptions().SetCleanSession(false).
+		SetNamedHandler("h", func(c Client, m Message) { called <- m.Topic() })
+	store := NewMemoryStore()
+	store.Open()
+	persistSubscription(store, "a/#", 1, "h")
+	persistSubscription(store, "b/#", 1, "unknown")
+	opts.SetStore(store)
+
+	c := NewClient(opts).(*client)
+	c.restoreSubscriptions()
+
+	var topics []string
+	for e := c.msgRouter.routes.Front(); e != nil; e = e.Next() {
+		topics = append(topics, e.Value.(*route).topic)
+	}
+	if len(topics) != 1 || topics[0] != "a/#" {
+		t.Fatalf("expected route for a/# only, got %v", topics)
+	}
+	e := c.msgRouter.routes.Front().Value.(*route)
+	e.callback(c, &message{topic: "a/b"})
+	if topic := <-called; topic != "a/b" {
+		t.Fatalf("unexpected topic %s", topic)
+	}
+}
+
+func Test_UnsubscribeOfflineForgetsSubscription(t *testing.T) {
+	store := NewMemoryStore()
+	opts := NewClientOptions().SetCleanSession(false).SetStore(store).
+		SetNamedHandler("h", func(Client, Message) {})
+	c := NewClient(opts).(*client)
+
+	if token := c.Unsubscribe("a/#"); token.Error() == nil {
+		t.Fatal("expected Unsubscribe to fail when not connected")
+	}
+	store.Open()
+	persistSubscription(store, "a/#", 1, "h")
+	persistSubscription(store, "b/#", 1, "h")
+	c.restoreSubscriptions()
+
+	if store.Get(subscriptionKey("a/#")) != nil {
+		t.Fatal("subscription to a/# should have been removed from the store")
+	}
+	if store.Get(subscriptionKey("b/#")) == nil {
+		t.Fatal("subscription to b/# should have been retained")
+	}
+	if n := c.msgRouter.routes.Len(); n != 1 {
+		t.Fatalf("expected 1 route, got %d", n)
+	}
+}
+
+func Test_FileStoreLimitsKeepSessionState(t *testing.T) {
+	store := NewFileStoreWithLimits(t.TempDir(), 1, 0)
+	store.Open()
+	defer store.Close()
+
+	persistSubscription(store, "a/#", 1, "h")
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos, pub.TopicName, pub.MessageID = 1, "a", 1
+	store.Put(outboundKeyFromMID(1), pub)
+	store.Put(forwardPrefix+"1", pub)
+	store.Put(forwardPrefix+"2", pub)
+
+	for _, key := range []string{subscriptionKey("a/#"), outboundKeyFromMID(1), forwardPrefix + "2"} {
+		if store.Get(key) == nil {
+			t.Fatalf("%s should have been retained", key)
+		}
+	}
+	if store.Get(forwardPrefix+"1") != nil {
+		t.Fatal("the oldest offline message should have been evicted")
+	}
+}
+
+func Test_FileStoreLimitsReject(t *testing.T) {
+	store := NewFileStoreWithLimits(t.TempDir(), 2, 0)
+	var dropped []string
+	store.SetDropHandler(func(keys []string) { dropped = append(dropped, keys...) })
+	store.SetLimitMode(FileStoreReject)
+	store.Open()
+	defer store.Close()
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos, pub.TopicName, pub.Payload = 1, "a", make([]byte, 100)
+	for i := 1; i <= 3; i++ {
+		store.Put(forwardPrefix+strconv.Itoa(i), pub)
+	}
+	if len(dropped) != 1 || dropped[0] != "f.3" {
+		t.Fatalf("expected f.3 to be rejected, got %v", dropped)
+	}
+	if keys := store.All(); len(keys) != 2 {
+		t.Fatalf("expected 2 messages in store, got %v", keys)
+	}
+
+	// The size limit is applied to the messages held (those held when the store is opened are included)
+	store.Close()
+	store.SetMaxSize(int64(len(encodeMessage(pub))) * 2)
+	store.SetLimitMode(FileStoreEvict)
+	store.Open()
+	store.Put(forwardPrefix+"4", pub)
+	if len(dropped) != 2 || dropped[1] != "f.1" {
+		t.Fatalf("expected f.1 to be evicted, got %v", dropped)
+	}
+	big := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	big.Qos, big.TopicName, big.Payload = 1, "a", make([]byte, 1000)
+	store.Put(forwardPrefix+"5", big)
+	if dropped[len(dropped)-1] != "f.5" || store.Get(forwardPrefix+"5") != nil {
+		t.Fatalf("expected oversized message to be rejected, got %v", dropped)
+	}
+}
+
+func Test_persistInbound_qos2Redelivery(t *testing.T) {
+	stores := map[string]Store{
+		"memory":  NewMemoryStore(),
+		"ordered": NewOrderedMemoryStore(),
+		"file":    NewFileStore(t.TempDir()),
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			s.Open()
+			defer s.Close()
+			pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pub.Qos = 2
+			pub.TopicName = "a"
+			pub.MessageID = 7
+			if !persistInbound(s, pub, noopSLogger) {
+				t.Fatal("new message reported as redelivered")
+			}
+			if !persistInbound(s, pub, noopSLogger) { // not acknowledged so must be passed to the handler
+				t.Fatal("unacknowledged message reported as redelivered")
+			}
+
+			pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			pr.MessageID = 7
+			persistOutbound(s, pr, noopSLogger)
+			if _, ok := s.Get(inboundKeyFromMID(7)).(*packets.PubrecPacket); !ok {
+				t.Fatal("expected pubrec in store")
+			}
+			if persistInbound(s, pub, noopSLogger) {
+				t.Fatal("acknowledged message not reported as redelivered")
+			}
+
+			prel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			prel.MessageID = 7
+			persistInbound(s, prel, noopSLogger)
+			pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pc.MessageID = 7
+			persistOutbound(s, pc, noopSLogger)
+			if len(s.All()) != 0 {
+				t.Fatalf("expected empty store, got %v", s.All())
+			}
+			if !persistInbound(s, pub, noopSLogger) { // message ID may now be reused
+				t.Fatal("new message reported as redelivered")
+			}
+		})
+	}
+}
+
+func Test_StoreUpdate(t *testing.T) {
+	s := NewMemoryStore()
+	if err := s.Update("o.1", func(packets.ControlPacket) (packets.ControlPacket, error) { return nil, nil }); !errors.Is(err, ErrStoreClosed) {
+		t.Fatalf("expected ErrStoreClosed, got %v", err)
+	}
+	s.Open()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.MessageID = 1
+	failed := errors.New("failed")
+	if err := s.Update("o.1", func(cur packets.ControlPacket) (packets.ControlPacket, error) {
+		if cur != nil {
+			t.Fatalf("expected nil, got %v", cur)
+		}
+		return pub, failed
+	}); err != failed {
+		t.Fatalf("expected error from fn, got %v", err)
+	}
+	if s.Get("o.1") != nil {
+		t.Fatal("store changed despite error")
+	}
+	if err := s.Update("o.1", func(packets.ControlPacket) (packets.ControlPacket, error) { return pub, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if s.Get("o.1") != pub {
+		t.Fatal("expected updated packet")
+	}
+	if err := s.Update("o.1", func(packets.ControlPacket) (packets.ControlPacket, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.All()) != 0 {
+		t.Fatal("expected key to be deleted")
+	}
+}
+
+func Test_CopyStore(t *testing.T) {
+	src := NewFileStore(t.TempDir())
+	src.Open()
+	defer src.Close()
+	for i := uint16(1); i <= 3; i++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = i
+		pub.TopicName = "a"
+		src.Put(outboundKeyFromMID(i), pub)
+		time.Sleep(10 * time.Millisecond) // FileStore orders by modification time
+	}
+	persistSubscription(src, "a/#", 1, "h")
+
+	dst := NewOrderedMemoryStore()
+	dst.Open()
+	if err := CopyStore(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := dst.All(), src.All(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected keys %v, got %v", exp, got)
+	}
+	if p, ok := dst.Get(outboundKeyFromMID(2)).(*packets.PublishPacket); !ok || p.MessageID != 2 {
+		t.Fatalf("unexpected packet %v", p)
+	}
+
+	// Unreadable packets are reported but do not prevent others being copied
+	broken := NewMemoryStore()
+	broken.Open()
+	broken.messages["o.9"] = nil
+	broken.Put("o.10", packets.NewControlPacket(packets.Publish))
+	dst = NewOrderedMemoryStore()
+	dst.Open()
+	if err := CopyStore(broken, dst); err == nil {
+		t.Fatal("expected error")
+	}
+	if dst.Get("o.10") == nil {
+		t.Fatal("expected readable packet to be copied")
+	}
+}
+
+func Test_FileStoreVersion(t *testing.T) {
+	dir := t.TempDir()
+	if v, err := ReadFileStoreVersion(dir); err != nil || v != 0 {
+		t.Fatalf("expected no version, got %d (%v)", v, err)
+	}
+	s := NewFileStore(dir)
+	s.Open()
+	s.Close()
+	if v, err := ReadFileStoreVersion(dir); err != nil || v != FileStoreFormatVersion {
+		t.Fatalf("expected version %d, got %d (%v)", FileStoreFormatVersion, v, err)
+	}
+	if keys := func() []string { s.Open(); defer s.Close(); return s.All() }(); len(keys) != 0 {
+		t.Fatalf("version file returned as key: %v", keys)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, versionFile), []byte("99\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Open to panic with a newer format version")
+		}
+	}()
+	NewFileStore(dir).Open()
+}
+
+func Test_FileStoreVerifyOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStore(dir)
+	s.SetSync(FileStoreSyncFull)
+	s.Open()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Qos = 1
+	pub.MessageID = 1
+	pub.Payload = []byte("hello")
+	s.Put("o.1", pub)
+	s.Put("o.2", pub)
+	s.Close()
+
+	// Simulate power loss part way through writing o.2 and whilst writing o.3
+	b, err := os.ReadFile(filepath.Join(dir, "o.2"+msgExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "o.2"+msgExt), b[:len(b)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "o.3"+tmpExt), b[:3], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewFileStore(dir)
+	s.SetVerifyOnOpen(true)
+	s.Open()
+	defer s.Close()
+	if keys := s.All(); len(keys) != 1 || keys[0] != "o.1" {
+		t.Fatalf("expected only o.1 to remain, got %v", keys)
+	}
+	if exists(filepath.Join(dir, "o.3"+tmpExt)) {
+		t.Fatal("expected incomplete write to be removed")
+	}
+	if !exists(filepath.Join(dir, "o.2"+corruptExt)) {
+		t.Fatal("expected truncated message to be archived")
+	}
+}
+
+func Test_FileStoreChecksum(t *testing.T) {
+	dir := t.TempDir()
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "a/b"
+	pub.Qos = 1
+	pub.MessageID = 1
+	pub.Payload = []byte("hello")
+
+	// A version 1 directory (messages without checksums) is upgraded when opened
+	var legacy bytes.Buffer
+	if err := pub.Write(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "o.1"+msgExt), legacy.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "o.1"+msgExt), old, old); err != nil {
+		t.Fatal(err)
+	}
+	s := NewFileStore(dir)
+	s.Open()
+	b, err := os.ReadFile(filepath.Join(dir, "o.1"+msgExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, fileHeader) {
+		t.Fatal("expected message to be upgraded")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "o.1"+msgExt)); err != nil || !info.ModTime().Equal(old) {
+		t.Fatalf("expected modification time to be retained (%v)", err)
+	}
+	if p, ok := s.Get("o.1").(*packets.PublishPacket); !ok || string(p.Payload) != "hello" {
+		t.Fatalf("unexpected packet %v", p)
+	}
+
+	// Corruption that leaves a valid packet is detected by the checksum
+	b[len(b)-1] = 'X'
+	if err := os.WriteFile(filepath.Join(dir, "o.1"+msgExt), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMessage(bytes.NewReader(b)); !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if s.Get("o.1") != nil {
+		t.Fatal("expected corrupt message to be discarded")
+	}
+	if !exists(filepath.Join(dir, "o.1"+corruptExt)) {
+		t.Fatal("expected corrupt message to be archived")
+	}
+	s.Close()
+}
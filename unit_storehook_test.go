@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_hookedStore(t *testing.T) {
+	var events []StoreEvent
+	s := newHookedStore(NewMemoryStore(), func(e StoreEvent) { events = append(events, e) })
+	s.Open()
+	defer s.Close()
+
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Qos, p.MessageID = 1, 7
+	s.Put("o.7", p)
+	if s.Get("o.7") != p {
+		t.Fatal("expected the stored packet")
+	}
+	_ = storeUpdate(s, "o.7", func(packets.ControlPacket) (packets.ControlPacket, error) {
+		return packets.NewControlPacket(packets.Pubrel), nil
+	})
+	s.Del("o.7")
+	s.Reset()
+
+	expected := []struct {
+		op  StoreOp
+		key string
+		pt  byte
+	}{
+		{StorePut, "o.7", packets.Publish},
+		{StoreGet, "o.7", packets.Publish},
+		{StorePut, "o.7", packets.Pubrel},
+		{StoreDel, "o.7", 0},
+		{StoreReset, "", 0},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+	for i, e := range expected {
+		if events[i].Op != e.op || events[i].Key != e.key || events[i].PacketType != e.pt || events[i].Duration < 0 {
+			t.Errorf("event %d: expected %s %q (type %d), got %+v", i, e.op, e.key, e.pt, events[i])
+		}
+	}
+}
+
+// Test_hookedStoreDiscard checks that the wrapper implements DiscardableStore only when the wrapped store does
+func Test_hookedStoreDiscard(t *testing.T) {
+	hook := func(StoreEvent) {}
+	if _, ok := newHookedStore(NewMemoryStore(), hook).(DiscardableStore); ok {
+		t.Fatal("wrapped MemoryStore should not implement DiscardableStore")
+	}
+	if _, ok := newHookedStore(NewFileStore(t.TempDir()), hook).(DiscardableStore); !ok {
+		t.Fatal("wrapped FileStore should implement DiscardableStore")
+	}
+}
+
+func Test_StoreHook(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("broker: %s", err)
+	}
+	defer b.Close()
+
+	var mu sync.Mutex
+	ops := make(map[StoreOp]int)
+	o := NewClientOptions().AddBroker(b.URL()).SetClientID("storehook").SetStoreHook(func(e StoreEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Key == "o.1" {
+			ops[e.Op]++
+		}
+	})
+	c := NewClient(o)
+	if tok := c.Connect(); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed (err: %v)", tok.Error())
+	}
+	defer c.Disconnect(0)
+	if tok := c.Publish("test", 1, false, "hello"); !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed (err: %v)", tok.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if ops[StorePut] != 1 || ops[StoreDel] != 1 {
+		t.Fatalf("expected the publish to be put and then deleted once acknowledged, got %v", ops)
+	}
+}
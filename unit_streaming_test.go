@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_StreamingHandler(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	type streamed struct {
+		topic   string
+		size    int
+		payload []byte
+	}
+	streams := make(chan streamed, 10)
+	received := make(chan string, 10)
+	ops := NewClientOptions().AddBroker(b.URL()).SetClientID("sub").
+		SetStreamingHandler(16, func(_ Client, m StreamingMessage) {
+			if m.Topic() == "fw/partial" { // only read part of the payload; the rest must be discarded
+				buf := make([]byte, 4)
+				io.ReadFull(m.PayloadReader(), buf)
+				streams <- streamed{topic: m.Topic(), size: m.Size(), payload: buf}
+				return
+			}
+			data, _ := io.ReadAll(m.PayloadReader())
+			streams <- streamed{topic: m.Topic(), size: m.Size(), payload: data}
+		})
+	c := NewClient(ops)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer c.Disconnect(250)
+	c.Subscribe("fw/#", 1, func(_ Client, m Message) { received <- string(m.Payload()) }).Wait()
+
+	image := bytes.Repeat([]byte("0123456789"), 100)
+	b.Publish("fw/image", 1, false, image)
+	b.Publish("fw/partial", 1, false, image)
+	b.Publish("fw/small", 1, false, []byte("small"))
+
+	for _, exp := range []streamed{{"fw/image", len(image), image}, {"fw/partial", len(image), image[:4]}} {
+		select {
+		case s := <-streams:
+			if s.topic != exp.topic || s.size != exp.size || !bytes.Equal(s.payload, exp.payload) {
+				t.Fatalf("unexpected streamed message %s (size %d, %d bytes read)", s.topic, s.size, len(s.payload))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for streamed message %s", exp.topic)
+		}
+	}
+	select {
+	case p := <-received:
+		if p != "small" {
+			t.Fatalf("expected small message via the router, got %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for small message")
+	}
+}
+
+func Test_StreamingHandlerQos2Redelivery(t *testing.T) {
+	streamed := make(chan struct{}, 2)
+	c := NewClient(NewClientOptions().SetStreamingHandler(16, func(_ Client, m StreamingMessage) {
+		io.ReadAll(m.PayloadReader())
+		streamed <- struct{}{}
+	})).(*client)
+	c.persist.Open()
+	defer c.persist.Close()
+
+	r, w := io.Pipe()
+	defer w.Close()
+	output := startIncomingComms(r, c, nil, c.logger)
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "fw/image"
+	pub.Qos = 2
+	pub.MessageID = 7
+	pub.Payload = bytes.Repeat([]byte("0123456789"), 10)
+	for i := 0; i < 2; i++ { // the second PUBLISH is a redelivery (e.g. following a reconnection)
+		pub.Dup = i > 0
+		go pub.Write(w)
+		select {
+		case out := <-output:
+			if pr, ok := out.outbound.p.(*packets.PubrecPacket); !ok || pr.MessageID != 7 {
+				t.Fatalf("expected PUBREC, got %+v", out)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for PUBREC")
+		}
+	}
+	if len(streamed) != 1 {
+		t.Fatalf("expected message to be streamed once, got %d", len(streamed))
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/clock"
+)
+
+// silentListener accepts connections but never sends anything (so neither a TLS handshake nor CONNACK completes)
+func silentListener(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func Test_ConnectTimeouts(t *testing.T) {
+	addr := silentListener(t)
+
+	tests := []struct {
+		name     string
+		broker   string
+		timeouts ConnectTimeouts
+		retry    bool
+		want     error
+	}{
+		{"connack", "tcp://" + addr, ConnectTimeouts{Connack: 100 * time.Millisecond}, false, ErrConnackTimeout},
+		{"tlsHandshake", "ssl://" + addr, ConnectTimeouts{TLSHandshake: 100 * time.Millisecond}, false, ErrTimeout},
+		{"overall", "tcp://" + addr, ConnectTimeouts{Connack: 50 * time.Millisecond, Overall: 300 * time.Millisecond}, true, ErrConnectDeadline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := NewClientOptions().AddBroker(tt.broker).SetConnectTimeout(10 * time.Second).SetConnectTimeouts(tt.timeouts)
+			if tt.retry {
+				o.SetConnectRetry(true).SetConnectRetryInterval(50 * time.Millisecond)
+			}
+			c := NewClient(o)
+			start := time.Now()
+			tok := c.Connect()
+			if !tok.WaitTimeout(5 * time.Second) {
+				t.Fatal("connect did not complete within the configured timeouts")
+			}
+			if !errors.Is(tok.Error(), tt.want) {
+				t.Fatalf("expected error wrapping %q, got %v", tt.want, tok.Error())
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("connect took %s (ConnectTimeout applied?)", elapsed)
+			}
+		})
+	}
+}
+
+// Test_connackDeadline checks that deadlines measured by the client clock are converted to wall clock times (as
+// required by net.Conn.SetDeadline)
+func Test_connackDeadline(t *testing.T) {
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := &client{clock: fake}
+	within := func(got time.Time, want time.Duration) {
+		t.Helper()
+		if d := time.Until(got); d > want || d < want-time.Second {
+			t.Fatalf("expected a deadline %s from now, got %s", want, d)
+		}
+	}
+	within(c.connackDeadline(fake.Now().Add(10*time.Second), time.Time{}), 10*time.Second)
+
+	c.options.ConnectTimeouts.Connack = 5 * time.Second
+	within(c.connackDeadline(fake.Now().Add(10*time.Second), time.Time{}), 5*time.Second)
+	within(c.connackDeadline(fake.Now().Add(10*time.Second), fake.Now().Add(2*time.Second)), 2*time.Second)
+}
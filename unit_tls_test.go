@@ -0,0 +1,370 @@
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/mqtttest"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_tlsConfigFor(t *testing.T) {
+	def := &tls.Config{ServerName: "default"}
+	other := &tls.Config{ServerName: "other"}
+	cache := tls.NewLRUClientSessionCache(0)
+	opts := NewClientOptions().SetTLSConfig(def).SetBrokerTLSConfig("other:8883", other).SetTLSSessionCache(cache)
+	c := NewClient(opts).(*client)
+
+	cfg := c.tlsConfigFor(&url.URL{Scheme: "ssl", Host: "default:8883"})
+	if cfg.ServerName != "default" || cfg.ClientSessionCache != cache {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if def.ClientSessionCache != nil {
+		t.Fatal("TLSConfig from options was modified")
+	}
+	cfg = c.tlsConfigFor(&url.URL{Scheme: "ssl", Host: "other:8883"})
+	if cfg.ServerName != "other" || cfg.ClientSessionCache != cache {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	c = NewClient(NewClientOptions()).(*client)
+	if cfg = c.tlsConfigFor(&url.URL{Scheme: "ssl", Host: "default:8883"}); cfg != nil {
+		t.Fatalf("expected nil config, got %+v", cfg)
+	}
+
+	// ALPN protocols (per broker host, so may vary by port)
+	def.NextProtos = []string{"mqtt"}
+	opts = NewClientOptions().SetTLSConfig(def).SetALPNProtocols("a").SetBrokerALPNProtocols("other:443", "b", "c")
+	c = NewClient(opts).(*client)
+	for _, tc := range []struct {
+		broker url.URL
+		want   string
+	}{
+		{url.URL{Scheme: "ssl", Host: "default:8883"}, "a"},
+		{url.URL{Scheme: "ssl", Host: "other:8883"}, "a"},
+		{url.URL{Scheme: "mqtts", Host: "other:443"}, "b c"},
+		{url.URL{Scheme: "wss", Host: "default:443"}, "mqtt"}, // websockets negotiate their own protocols
+		{url.URL{Scheme: "wss", Host: "other:443"}, "b c"},    // unless set for the broker
+	} {
+		if got := strings.Join(c.tlsConfigFor(&tc.broker).NextProtos, " "); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.broker.String(), tc.want, got)
+		}
+	}
+	if len(def.NextProtos) != 1 {
+		t.Fatal("TLSConfig from options was modified")
+	}
+}
+
+// Test_TLSSessionResumption confirms that a session ticket obtained by one connection is used by the next
+func Test_TLSSessionResumption(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	opts := NewClientOptions().SetTLSConfig(&tls.Config{RootCAs: roots}).SetTLSSessionCache(tls.NewLRUClientSessionCache(0))
+	c := NewClient(opts).(*client)
+	broker := &url.URL{Scheme: "ssl", Host: srv.Listener.Addr().String()}
+
+	for i, resumed := range []bool{false, true} {
+		conn, err := c.openNetConn(broker, c.tlsConfigFor(broker), 5*time.Second, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// TLS 1.3 session tickets are sent after the handshake so a request is needed to receive one
+		_, _ = io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+		if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.(*tls.Conn).ConnectionState().DidResume; got != resumed {
+			t.Fatalf("connection %d: expected DidResume %t, got %t", i, resumed, got)
+		}
+		conn.Close()
+	}
+}
+
+// testClientCertificate returns a self-signed certificate with the provided common name
+func testClientCertificate(t *testing.T, cn string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Test_TLSCertificateProvider confirms that the provider is called for each connection
+func Test_TLSCertificateProvider(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	certs := []*tls.Certificate{testClientCertificate(t, "first"), testClientCertificate(t, "second")}
+	calls := 0
+	provider := func() (*tls.Certificate, error) {
+		if calls == len(certs) {
+			return nil, errors.New("no more certificates")
+		}
+		calls++
+		return certs[calls-1], nil
+	}
+	opts := NewClientOptions().SetTLSConfig(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{*certs[1]}}).
+		SetTLSCertificateProvider(provider)
+	c := NewClient(opts).(*client)
+	broker := &url.URL{Scheme: "ssl", Host: srv.Listener.Addr().String()}
+
+	for _, cn := range []string{"first", "second"} {
+		conn, err := c.openNetConn(broker, c.tlsConfigFor(broker), 5*time.Second, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		if string(body) != cn {
+			t.Fatalf("expected certificate %s, got %s", cn, body)
+		}
+	}
+
+	// With TLS 1.3 the client certificate is sent after the client considers the handshake complete so
+	// the failure may only be apparent on the first read
+	conn, err := c.openNetConn(broker, c.tlsConfigFor(broker), 5*time.Second, 0)
+	if err == nil {
+		_, _ = io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+		_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("expected connection to fail when provider returns an error")
+	}
+}
+
+// Test_SPKIPins checks that connections are only accepted when the broker's key matches a pin
+func Test_SPKIPins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	broker := &url.URL{Scheme: "ssl", Host: srv.Listener.Addr().String()}
+	pin := SPKIPin(srv.Certificate())
+	wrong := "sha256/" + strings.Repeat("A", 43) + "="
+
+	verified := 0
+	for _, tc := range []struct {
+		name string
+		cfg  *tls.Config
+		pins []string
+		ok   bool
+	}{
+		{"match", &tls.Config{RootCAs: roots}, []string{wrong, pin}, true},
+		{"match without prefix", &tls.Config{RootCAs: roots}, []string{strings.TrimPrefix(pin, "sha256/")}, true},
+		{"self-signed", &tls.Config{InsecureSkipVerify: true}, []string{pin}, true},
+		{"mismatch", &tls.Config{RootCAs: roots}, []string{wrong}, false},
+		{"mismatch self-signed", &tls.Config{InsecureSkipVerify: true}, []string{wrong}, false},
+	} {
+		opts := NewClientOptions().SetTLSConfig(tc.cfg).SetSPKIPins(tc.pins...).
+			SetVerifyPeerCertificate(func([][]byte, [][]*x509.Certificate) error { verified++; return nil })
+		c := NewClient(opts).(*client)
+		conn, err := c.openNetConn(broker, c.tlsConfigFor(broker), 5*time.Second, 0)
+		if tc.ok {
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			conn.Close()
+			continue
+		}
+		if !errors.Is(err, ErrCertificatePinMismatch) {
+			t.Fatalf("%s: expected ErrCertificatePinMismatch, got %v", tc.name, err)
+		}
+		if class := classifyConnectFailure(packets.ErrNetworkError, err); class != ConnectErrorCertificate {
+			t.Fatalf("%s: expected certificate error class, got %s", tc.name, class)
+		}
+	}
+	if verified != 3 {
+		t.Fatalf("expected VerifyPeerCertificate to be called for 3 connections, got %d", verified)
+	}
+
+	// pin mismatches are not retried
+	c := NewClient(NewClientOptions().AddBroker(broker.String()).SetTLSConfig(&tls.Config{RootCAs: roots}).
+		SetSPKIPins(wrong).SetConnectRetry(true).SetConnectRetryInterval(10 * time.Millisecond))
+	token := c.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatal("connection attempt was retried")
+	}
+	if !errors.Is(token.Error(), ErrCertificatePinMismatch) {
+		t.Fatalf("expected ErrCertificatePinMismatch, got %v", token.Error())
+	}
+
+	// other certificate failures (here the broker's certificate is not trusted) are retried
+	attempts := make(chan struct{}, 10)
+	c = NewClient(NewClientOptions().AddBroker(broker.String()).SetConnectRetry(true).SetConnectRetryInterval(10 * time.Millisecond).
+		SetConnectionAttemptHandler(func(_ *url.URL, cfg *tls.Config) *tls.Config {
+			select {
+			case attempts <- struct{}{}:
+			default:
+			}
+			return cfg
+		}))
+	token = c.Connect()
+	defer c.Disconnect(0)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-attempts:
+		case <-token.Done():
+			t.Fatalf("connection attempt was not retried: %v", token.Error())
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for connection attempt")
+		}
+	}
+}
+
+// countingSigner is a crypto.Signer that does not expose its private key (as with a hardware backed key)
+type countingSigner struct {
+	key   crypto.Signer
+	calls atomic.Int32
+}
+
+func (s *countingSigner) Public() crypto.PublicKey { return s.key.Public() }
+
+func (s *countingSigner) Sign(r io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.calls.Add(1)
+	return s.key.Sign(r, digest, opts)
+}
+
+// Test_TLSClientSigner confirms that a crypto.Signer can be used for the client certificate key on each connection
+func Test_TLSClientSigner(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tc := testClientCertificate(t, "hsm")
+	leaf, err := x509.ParseCertificate(tc.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &countingSigner{key: tc.PrivateKey.(crypto.Signer)}
+	c := NewClient(NewClientOptions().SetTLSConfig(&tls.Config{RootCAs: roots}).SetTLSClientSigner(signer, leaf)).(*client)
+	broker := &url.URL{Scheme: "ssl", Host: srv.Listener.Addr().String()}
+	for i := 1; i <= 2; i++ {
+		conn, err := c.openNetConn(broker, c.tlsConfigFor(broker), 5*time.Second, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		if string(body) != "hsm" || int(signer.calls.Load()) != i {
+			t.Fatalf("connection %d: got certificate %q, %d signatures", i, body, signer.calls.Load())
+		}
+	}
+
+	other := testClientCertificate(t, "other")
+	if _, err := TLSCertificateFromSigner(other.PrivateKey.(crypto.Signer), leaf); !errors.Is(err, ErrSignerMismatch) {
+		t.Fatalf("expected ErrSignerMismatch, got %v", err)
+	}
+}
+
+// Test_TLSPSK checks that the PSKConnector is used to secure connections (the test connector does not encrypt)
+func Test_TLSPSK(t *testing.T) {
+	b, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	identities := make(chan string, 2)
+	connector := func(conn net.Conn, serverName string, _ *tls.Config, psk PSKCallback) (net.Conn, error) {
+		identity, key, err := psk("hint")
+		if err != nil {
+			return nil, err
+		}
+		identities <- serverName + " " + identity + " " + string(key)
+		return conn, nil
+	}
+	global := func(hint string) (string, []byte, error) { return "device-" + hint, []byte("k1"), nil }
+	broker := "ssl://" + b.Addr()
+	c := NewClient(NewClientOptions().AddBroker(broker).SetClientID("psk").SetTLSPSK(global, connector))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	c.Disconnect(0)
+	if id := <-identities; id != "127.0.0.1 device-hint k1" {
+		t.Fatalf("unexpected handshake %q", id)
+	}
+
+	perBroker := func(string) (string, []byte, error) { return "other", []byte("k2"), nil }
+	c = NewClient(NewClientOptions().AddBroker(broker).SetClientID("psk").SetTLSPSK(nil, connector).
+		SetTLSConfig(&tls.Config{ServerName: "broker.example"}).SetBrokerTLSPSK(b.Addr(), perBroker))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	c.Disconnect(0)
+	if id := <-identities; id != "broker.example other k2" {
+		t.Fatalf("unexpected handshake %q", id)
+	}
+
+	c = NewClient(NewClientOptions().AddBroker(broker).SetClientID("psk").SetTLSPSK(global, nil))
+	if token := c.Connect(); token.Wait() && !errors.Is(token.Error(), ErrPSKConnectorRequired) {
+		t.Fatalf("expected ErrPSKConnectorRequired, got %v", token.Error())
+	}
+}
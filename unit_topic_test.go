@@ -19,6 +19,10 @@
 package mqtt
 
 import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -49,3 +53,110 @@ func Test_ValidateTopicAndQos_H(t *testing.T) {
 		t.Fatalf("invalid error for bad multilevel topic filter")
 	}
 }
+
+func Test_ValidateTopicAndQos_Shared(t *testing.T) {
+	for _, topic := range []string{"$share/group/a/#", "$share/g/+"} {
+		if e := validateTopicAndQos(topic, 0); e != nil {
+			t.Fatalf("error from valid shared subscription %q: %s", topic, e)
+		}
+	}
+	for _, topic := range []string{"$share/", "$share/group", "$share//a", "$share/gr+oup/a", "$share/group/"} {
+		if e := validateTopicAndQos(topic, 0); e != ErrInvalidSharedSubscription {
+			t.Fatalf("invalid error for bad shared subscription %q: %v", topic, e)
+		}
+	}
+}
+
+func Test_ValidateTopicFilter(t *testing.T) {
+	valid := []string{"a", "/", "a/+/c", "+", "#", "a/#", "+/+/#", "$SYS/#", "a b/c"}
+	for _, f := range valid {
+		if e := ValidateTopicFilter(f); e != nil {
+			t.Errorf("error from valid filter %q: %s", f, e)
+		}
+	}
+	invalid := map[string]error{
+		"":                         ErrInvalidTopicEmptyString,
+		"a/#/c":                    ErrInvalidTopicMultilevel,
+		"a/b#":                     ErrInvalidTopicWildcardLevel,
+		"a/+b/c":                   ErrInvalidTopicWildcardLevel,
+		"a/\xff":                   ErrInvalidTopicUTF8,
+		"a/\x00":                   ErrInvalidTopicUTF8,
+		strings.Repeat("a", 1<<16): ErrInvalidTopicLength,
+		"$share/g+/a":              ErrInvalidSharedSubscription,
+	}
+	for f, exp := range invalid {
+		if e := ValidateTopicFilter(f); e != exp {
+			t.Errorf("expected %v for filter %q, got %v", exp, f, e)
+		}
+	}
+}
+
+func Test_ValidateTopicName(t *testing.T) {
+	for _, topic := range []string{"a", "/", "a/b/c", "$aws/things/x/shadow/update"} {
+		if e := ValidateTopicName(topic); e != nil {
+			t.Errorf("error from valid topic %q: %s", topic, e)
+		}
+	}
+	invalid := map[string]error{
+		"":       ErrInvalidTopicEmptyString,
+		"a/+":    ErrInvalidTopicWildcard,
+		"a/#":    ErrInvalidTopicWildcard,
+		"a\x00b": ErrInvalidTopicUTF8,
+	}
+	for topic, exp := range invalid {
+		if e := ValidateTopicName(topic); e != exp {
+			t.Errorf("expected %v for topic %q, got %v", exp, topic, e)
+		}
+	}
+}
+
+func Test_TopicTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		filter   string
+		topic    string
+		params   map[string]string // nil if topic should not match
+	}{
+		{"devices/{deviceID}/state", "devices/+/state", "devices/d1/state", map[string]string{"deviceID": "d1"}},
+		{"devices/{deviceID}/state", "devices/+/state", "devices/d1/other", nil},
+		{"devices/{deviceID}/state", "devices/+/state", "devices/d1/state/x", nil},
+		{"a/{x}/+/{y}", "a/+/+/+", "a/1/2/3", map[string]string{"x": "1", "y": "3"}},
+		{"logs/{path...}", "logs/#", "logs/a/b/c", map[string]string{"path": "a/b/c"}},
+		{"logs/{path...}", "logs/#", "logs", map[string]string{"path": ""}},
+		{"logs/#", "logs/#", "logs/a", map[string]string{}},
+		{"{site}/temp", "+/temp", "$SYS/temp", nil},
+		{"$share/g/devices/{id}", "$share/g/devices/+", "devices/x", map[string]string{"id": "x"}},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParseTopicTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %s", tt.template, err)
+		}
+		if f := tmpl.Filter(); f != tt.filter {
+			t.Errorf("expected filter %q for %q, got %q", tt.filter, tt.template, f)
+		}
+		params, ok := tmpl.Match(tt.topic)
+		if ok != (tt.params != nil) || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%q matching %q: expected %v, got %v (%t)", tt.template, tt.topic, tt.params, params, ok)
+		}
+	}
+
+	for _, tmpl := range []string{"a/{}", "a/{x}/{x}", "a/{x...}/b", "a/b{x}", "a/#/b", "$share/g"} {
+		if _, err := ParseTopicTemplate(tmpl); !errors.Is(err, ErrInvalidTopicTemplate) {
+			t.Errorf("expected ErrInvalidTopicTemplate for %q, got %v", tmpl, err)
+		}
+	}
+}
+
+func Test_RegexpMatcher(t *testing.T) {
+	m := NewRegexpMatcher("sensors/#", regexp.MustCompile(`^sensors/(?P<room>[a-z]+)/temp$`))
+	if params, ok := m.Match("sensors/kitchen/temp"); !ok || params["room"] != "kitchen" {
+		t.Errorf("unexpected result %v (%t)", params, ok)
+	}
+	if _, ok := m.Match("sensors/k1/temp"); ok {
+		t.Error("expected no match")
+	}
+	if _, ok := NewRegexpMatcher("other/#", regexp.MustCompile(`temp$`)).Match("sensors/k/temp"); ok {
+		t.Error("expected no match when the filter does not match")
+	}
+}
@@ -0,0 +1,113 @@
+//go:build !tinygo && !paho_nowebsocket
+
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"compress/flate"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_WebsocketConnectionOptions(t *testing.T) {
+	type handshake struct {
+		auth, cookie, protocol string
+	}
+	received := make(chan handshake, 1)
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqttv3.1"}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- handshake{auth: r.Header.Get("Authorization"), cookie: r.Header.Get("Cookie"), protocol: r.Header.Get("Sec-WebSocket-Protocol")}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = ws.Close()
+	}))
+	defer srv.Close()
+
+	broker, _ := url.Parse(strings.Replace(srv.URL, "http", "ws", 1))
+	var gotAttempt int
+	var gotBroker *url.URL
+	ops := NewClientOptions().SetHTTPHeaders(http.Header{"Authorization": []string{"static"}})
+	ops.SetWebsocketConnectionOptions(func(attempt int, b *url.URL, wsOpts *WebsocketConnectionOptions) {
+		gotAttempt, gotBroker = attempt, b
+		wsOpts.Header.Set("Authorization", "Bearer token")
+		wsOpts.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		wsOpts.Subprotocols = []string{"mqttv3.1"}
+	})
+	c := NewClient(ops).(*client)
+
+	conn, err := c.openNetConn(broker, nil, 5*time.Second, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_ = conn.Close()
+
+	h := <-received
+	if h.auth != "Bearer token" || h.cookie != "session=abc" || h.protocol != "mqttv3.1" {
+		t.Fatalf("handshake not modified as expected: %+v", h)
+	}
+	if gotAttempt != 3 || gotBroker != broker {
+		t.Fatalf("handler called with attempt %d, broker %v", gotAttempt, gotBroker)
+	}
+	if ops.HTTPHeaders.Get("Authorization") != "static" {
+		t.Fatalf("handler must not modify the headers in ClientOptions")
+	}
+}
+
+func Test_WebsocketCompression(t *testing.T) {
+	extensions := make(chan string, 1)
+	received := make(chan []byte, 1)
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}, EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extensions <- r.Header.Get("Sec-WebSocket-Extensions")
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		if _, msg, err := ws.ReadMessage(); err == nil {
+			received <- msg
+		}
+	}))
+	defer srv.Close()
+
+	broker, _ := url.Parse(strings.Replace(srv.URL, "http", "ws", 1))
+	c := NewClient(NewClientOptions().SetWebsocketCompression(flate.BestSpeed)).(*client)
+	conn, err := c.openNetConn(broker, nil, 5*time.Second, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+
+	if ext := <-extensions; !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("compression not requested; Sec-WebSocket-Extensions: %q", ext)
+	}
+	payload := []byte(strings.Repeat(`{"key":"value"}`, 1000))
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; string(msg) != string(payload) {
+		t.Fatalf("payload corrupted by compression")
+	}
+}
@@ -15,119 +15,55 @@ package mqtt
 
 import (
 	"crypto/tls"
-	"fmt"
-	"io"
+	"errors"
 	"net"
 	"net/http"
 	"net/url"
-	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
+// ErrWebsocketUnavailable is returned when connecting to a ws:// or wss:// broker and websocket support is not
+// available; either it has not been compiled in (the gorilla/websocket dependency is omitted when building with
+// TinyGo or the paho_nowebsocket build tag) or, when compiled for GOOS=js, the JavaScript environment does not
+// provide the WebSocket API (e.g. older versions of Node.js).
+var ErrWebsocketUnavailable = errors.New("websocket support not available")
+
 // WebsocketOptions are config options for a websocket dialer
 type WebsocketOptions struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	Proxy           ProxyFunction
+	// CompressionLevel enables permessage-deflate compression (if the server agrees to it) using the
+	// specified compress/flate level (e.g. flate.BestSpeed or flate.DefaultCompression). 0 (the default)
+	// disables compression.
+	CompressionLevel int
 }
 
 type ProxyFunction func(req *http.Request) (*url.URL, error)
 
-// NewWebsocket returns a new websocket and returns a net.Conn compatible interface using the gorilla/websocket package
-func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestHeader http.Header, options *WebsocketOptions) (net.Conn, error) {
-	if timeout == 0 { // should not happen as client.go now honours the docs "duration of 0 never times out" and sets timeout to max duration
-		WARN.Println(CLI, fmt.Sprintf("Websocket timeout was 0"))
-		timeout = 10 * time.Second
-	}
-
-	if options == nil {
-		// Apply default options
-		options = &WebsocketOptions{}
-	}
-	if options.Proxy == nil {
-		options.Proxy = http.ProxyFromEnvironment
-	}
-	dialer := &websocket.Dialer{
-		Proxy:             options.Proxy,
-		HandshakeTimeout:  timeout,
-		EnableCompression: false,
-		TLSClientConfig:   tlsc,
-		Subprotocols:      []string{"mqtt"},
-		ReadBufferSize:    options.ReadBufferSize,
-		WriteBufferSize:   options.WriteBufferSize,
-	}
-
-	ws, resp, err := dialer.Dial(host, requestHeader)
-
-	if err != nil {
-		if resp != nil {
-			WARN.Println(CLI, fmt.Sprintf("Websocket handshake failure. StatusCode: %d. Body: %s", resp.StatusCode, resp.Body))
-		}
-		return nil, err
-	}
-
-	wrapper := &websocketConnector{
-		Conn: ws,
-	}
-	return wrapper, err
+// WebsocketConnectionOptions holds the settings used for a single websocket opening handshake
+type WebsocketConnectionOptions struct {
+	Header       http.Header // HTTP headers sent in the opening handshake
+	Subprotocols []string    // Subprotocols requested (defaults to "mqtt")
+	URL          *url.URL    // URL requested (a copy of the broker URL; may be modified, e.g. to add a signature)
 }
 
-// websocketConnector is a websocket wrapper so it satisfies the net.Conn interface so it is a
-// drop in replacement of the golang.org/x/net/websocket package.
-// Implementation guide taken from https://github.com/gorilla/websocket/issues/282
-type websocketConnector struct {
-	*websocket.Conn
-	r   io.Reader
-	rio sync.Mutex
-	wio sync.Mutex
-}
-
-// SetDeadline sets both the read and write deadlines
-func (c *websocketConnector) SetDeadline(t time.Time) error {
-	if err := c.SetReadDeadline(t); err != nil {
-		return err
+// AddCookie adds a cookie to the headers sent in the opening handshake
+func (w *WebsocketConnectionOptions) AddCookie(c *http.Cookie) {
+	if w.Header == nil {
+		w.Header = make(http.Header)
 	}
-	err := c.SetWriteDeadline(t)
-	return err
+	r := http.Request{Header: w.Header}
+	r.AddCookie(c)
 }
 
-// Write writes data to the websocket
-func (c *websocketConnector) Write(p []byte) (int, error) {
-	c.wio.Lock()
-	defer c.wio.Unlock()
+// WebsocketConnectionOptionsHandler is invoked before each websocket opening handshake and may modify
+// wsOpts (which contains a copy of the HTTP headers from ClientOptions and of the broker URL). attempt is the connection
+// attempt number (as passed in ConnectionNotificationConnecting) and broker the URL being connected to.
+type WebsocketConnectionOptionsHandler func(attempt int, broker *url.URL, wsOpts *WebsocketConnectionOptions)
 
-	err := c.WriteMessage(websocket.BinaryMessage, p)
-	if err != nil {
-		return 0, err
-	}
-	return len(p), nil
-}
-
-// Read reads the current websocket frame
-func (c *websocketConnector) Read(p []byte) (int, error) {
-	c.rio.Lock()
-	defer c.rio.Unlock()
-	for {
-		if c.r == nil {
-			// Advance to next message.
-			var err error
-			_, c.r, err = c.NextReader()
-			if err != nil {
-				return 0, err
-			}
-		}
-		n, err := c.r.Read(p)
-		if err == io.EOF {
-			// At end of message.
-			c.r = nil
-			if n > 0 {
-				return n, nil
-			}
-			// No data read, continue to next message.
-			continue
-		}
-		return n, err
-	}
+// NewWebsocket returns a new websocket and returns a net.Conn compatible interface using the gorilla/websocket package
+// (or, when compiled for GOOS=js, the browsers WebSocket API)
+func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestHeader http.Header, options *WebsocketOptions) (net.Conn, error) {
+	return newWebsocket(host, tlsc, timeout, &WebsocketConnectionOptions{Header: requestHeader, Subprotocols: []string{"mqtt"}}, options)
 }
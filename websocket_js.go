@@ -0,0 +1,261 @@
+//go:build js && wasm
+
+/*
+ * Copyright (c) 2021 IBM Corp and others.
+ *
+ * All rights reserved. This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// newWebsocket opens a websocket using the browsers WebSocket API (raw network connections are not available to
+// WebAssembly running in a browser so only ws:// and wss:// brokers can be used). Browsers handle TLS themselves
+// and do not allow the HTTP headers sent in the opening handshake to be set; tlsc, connOpts.Header and options
+// are therefore ignored (cookies set for the broker's domain will be sent by the browser).
+func newWebsocket(host string, tlsc *tls.Config, timeout time.Duration, connOpts *WebsocketConnectionOptions, options *WebsocketOptions) (net.Conn, error) {
+	ctor := js.Global().Get("WebSocket")
+	if ctor.IsUndefined() {
+		return nil, ErrWebsocketUnavailable
+	}
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	if len(connOpts.Header) > 0 {
+		slog.Warn("websocket headers cannot be set by the browser and will not be sent", slog.String("component", string(CLI)))
+	}
+	protocols := make([]any, len(connOpts.Subprotocols))
+	for i, p := range connOpts.Subprotocols {
+		protocols[i] = p
+	}
+
+	var ws js.Value
+	if err := jsCall(func() { ws = ctor.New(host, protocols) }); err != nil { // e.g. SyntaxError if the URL is invalid
+		return nil, err
+	}
+	ws.Set("binaryType", "arraybuffer")
+	c := &browserWebsocket{ws: ws, addr: websocketAddr(host), notify: make(chan struct{}, 1)}
+	opened := make(chan error, 1)
+	c.funcs = []js.Func{
+		js.FuncOf(func(js.Value, []js.Value) any {
+			opened <- nil
+			return nil
+		}),
+		js.FuncOf(func(_ js.Value, args []js.Value) any {
+			data := js.Global().Get("Uint8Array").New(args[0].Get("data"))
+			b := make([]byte, data.Get("length").Int())
+			js.CopyBytesToGo(b, data)
+			c.mu.Lock()
+			c.queue = append(c.queue, b)
+			c.mu.Unlock()
+			c.wake()
+			return nil
+		}),
+		js.FuncOf(func(_ js.Value, args []js.Value) any {
+			c.closedBy(opened, fmt.Errorf("websocket closed (code %d)", args[0].Get("code").Int()))
+			return nil
+		}),
+		js.FuncOf(func(js.Value, []js.Value) any {
+			// Browsers follow an error with a close event, but some other environments do not
+			c.closedBy(opened, errors.New("websocket error"))
+			return nil
+		}),
+	}
+	ws.Set("onopen", c.funcs[0])
+	ws.Set("onmessage", c.funcs[1])
+	ws.Set("onclose", c.funcs[2])
+	ws.Set("onerror", c.funcs[3])
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-opened:
+		if err != nil {
+			c.release()
+			return nil, err
+		}
+	case <-timer.C:
+		_ = c.Close()
+		return nil, errors.New("websocket handshake timed out")
+	}
+	return c, nil
+}
+
+// jsCall calls fn, converting any JavaScript exception into an error
+func jsCall(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if jsErr, ok := r.(js.Error); ok {
+				err = jsErr
+				return
+			}
+			panic(r)
+		}
+	}()
+	fn()
+	return nil
+}
+
+// websocketAddr is the net.Addr of a browser websocket (the browser does not expose the underlying addresses)
+type websocketAddr string
+
+func (a websocketAddr) Network() string { return "websocket" }
+func (a websocketAddr) String() string  { return string(a) }
+
+// browserWebsocket wraps a JavaScript WebSocket so it satisfies the net.Conn interface. Each received message
+// is queued (JavaScript callbacks must not block) and returned by Read as a stream of bytes.
+type browserWebsocket struct {
+	ws    js.Value
+	addr  websocketAddr
+	funcs []js.Func // event handlers (released on Close)
+
+	mu           sync.Mutex
+	queue        [][]byte      // received messages not yet fully read
+	closed       bool          // no further messages will be received
+	readDeadline time.Time     // zero = none
+	notify       chan struct{} // signalled when the queue, closed or readDeadline changes
+}
+
+// closedBy records that the websocket has closed; err is passed to opened if the connection had not been opened
+func (c *browserWebsocket) closedBy(opened chan<- error, err error) {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.wake()
+	select {
+	case opened <- err:
+	default:
+	}
+}
+
+// wake notifies a blocked Read that something has changed
+func (c *browserWebsocket) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads data received over the websocket (message boundaries are not significant in MQTT)
+func (c *browserWebsocket) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			n := copy(p, c.queue[0])
+			if n == len(c.queue[0]) {
+				c.queue = c.queue[1:]
+			} else {
+				c.queue[0] = c.queue[0][n:]
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		closed, deadline := c.closed, c.readDeadline
+		c.mu.Unlock()
+		if closed {
+			return 0, io.EOF
+		}
+		if deadline.IsZero() {
+			<-c.notify
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-c.notify:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// Write sends p as a single binary message. The browser buffers outgoing messages so this does not block.
+func (c *browserWebsocket) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	data := js.Global().Get("Uint8Array").New(len(p))
+	js.CopyBytesToJS(data, p)
+	if err := jsCall(func() { c.ws.Call("send", data) }); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the websocket
+func (c *browserWebsocket) Close() error {
+	c.mu.Lock()
+	alreadyClosed := c.funcs == nil
+	c.closed = true
+	c.mu.Unlock()
+	if alreadyClosed {
+		return net.ErrClosed
+	}
+	err := jsCall(func() { c.ws.Call("close") })
+	c.release()
+	c.wake()
+	return err
+}
+
+// release removes the event handlers and releases the associated resources
+func (c *browserWebsocket) release() {
+	for _, h := range []string{"onopen", "onmessage", "onclose", "onerror"} {
+		c.ws.Set(h, js.Null())
+	}
+	c.mu.Lock()
+	funcs := c.funcs
+	c.funcs = nil
+	c.mu.Unlock()
+	for _, f := range funcs {
+		f.Release()
+	}
+}
+
+func (c *browserWebsocket) LocalAddr() net.Addr  { return c.addr }
+func (c *browserWebsocket) RemoteAddr() net.Addr { return c.addr }
+
+// SetDeadline sets the read deadline (writes do not block so the write deadline is not needed)
+func (c *browserWebsocket) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the time after which Read will return os.ErrDeadlineExceeded
+func (c *browserWebsocket) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.wake()
+	return nil
+}
+
+// SetWriteDeadline does nothing (writes do not block)
+func (c *browserWebsocket) SetWriteDeadline(time.Time) error {
+	return nil
+}
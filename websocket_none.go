@@ -0,0 +1,27 @@
+//go:build !js && (tinygo || paho_nowebsocket)
+
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// newWebsocket returns ErrWebsocketUnavailable
+func newWebsocket(host string, tlsc *tls.Config, timeout time.Duration, connOpts *WebsocketConnectionOptions, options *WebsocketOptions) (net.Conn, error) {
+	return nil, ErrWebsocketUnavailable
+}